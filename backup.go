@@ -0,0 +1,195 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/h2so5/murcott/storage/atomicfile"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	backupMagic    = "MCBK"
+	backupVersion  = 2
+	backupSaltSize = 16
+
+	// backupIterations is the PBKDF2 iteration count of new backups,
+	// which is stored in their header.
+	backupIterations = 600000
+
+	// maxBackupIterations bounds the iteration count read from a header.
+	maxBackupIterations = 10000000
+
+	// legacyBackupIterations is the iteration count of version 1 backups,
+	// whose header does not hold it.
+	legacyBackupIterations = 4096
+)
+
+type backupData struct {
+	Time    time.Time `msgpack:"time"`
+	Roster  *Roster   `msgpack:"roster"`
+	History *History  `msgpack:"history"`
+}
+
+func backupCipher(passphrase string, salt []byte, iterations int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, passphrase, salt, iterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Backup writes the roster and the message history to w,
+// encrypted with a key derived from the given passphrase.
+func (c *Client) Backup(w io.Writer, passphrase string) error {
+	data, err := msgpack.Marshal(backupData{
+		Time:    time.Now(),
+		Roster:  c.Roster.snapshot(),
+		History: c.History.snapshot(),
+	})
+	if err != nil {
+		return err
+	}
+
+	salt := make([]byte, backupSaltSize)
+	_, err = rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	aead, err := backupCipher(passphrase, salt, backupIterations)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	header := append([]byte(backupMagic), backupVersion, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(backupMagic)+1:], backupIterations)
+	var b bytes.Buffer
+	b.Write(header)
+	b.Write(salt)
+	b.Write(nonce)
+	b.Write(aead.Seal(nil, nonce, data, header))
+	_, err = w.Write(b.Bytes())
+	return err
+}
+
+// BackupFile writes a backup to the given path.
+func (c *Client) BackupFile(path string, passphrase string) error {
+	return atomicfile.Write(path, 0600, func(w io.Writer) error {
+		return c.Backup(w, passphrase)
+	})
+}
+
+// ScheduleBackup writes a backup to the given path at every interval
+// until the client is closed.
+func (c *Client) ScheduleBackup(path string, passphrase string, interval time.Duration) {
+	go func() {
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-c.exit:
+				return
+			case <-tick.C:
+				err := c.BackupFile(path, passphrase)
+				if err != nil {
+					c.Logger.Error("Backup: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+func readBackup(r io.Reader, passphrase string) (*backupData, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hlen := len(backupMagic) + 1
+	if len(b) < hlen || string(b[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a backup file")
+	}
+	iterations := legacyBackupIterations
+	switch v := b[len(backupMagic)]; v {
+	case 1:
+	case backupVersion:
+		hlen += 4
+		if len(b) < hlen {
+			return nil, errors.New("truncated backup file")
+		}
+		iterations = int(binary.BigEndian.Uint32(b[hlen-4 : hlen]))
+		if iterations < 1 || iterations > maxBackupIterations {
+			return nil, fmt.Errorf("invalid iteration count: %d", iterations)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported backup version: %d", v)
+	}
+	if len(b) < hlen+backupSaltSize {
+		return nil, errors.New("truncated backup file")
+	}
+	header, b := b[:hlen], b[hlen:]
+	salt, b := b[:backupSaltSize], b[backupSaltSize:]
+
+	aead, err := backupCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("truncated backup file")
+	}
+	nonce, b := b[:aead.NonceSize()], b[aead.NonceSize():]
+	data, err := aead.Open(nil, nonce, b, header)
+	if err != nil {
+		return nil, errors.New("backup integrity check failed")
+	}
+
+	d := backupData{Roster: &Roster{}, History: &History{}}
+	err = msgpack.Unmarshal(data, &d)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// VerifyBackup checks that r contains a backup which can be decrypted
+// with the given passphrase and has not been modified.
+func VerifyBackup(r io.Reader, passphrase string) error {
+	_, err := readBackup(r, passphrase)
+	return err
+}
+
+// Restore merges the contents of a backup into the roster and the message history.
+// Existing contacts and settings take precedence over the backup.
+func (c *Client) Restore(r io.Reader, passphrase string) error {
+	d, err := readBackup(r, passphrase)
+	if err != nil {
+		return err
+	}
+	c.Roster.merge(d.Roster)
+	for id, list := range c.History.merge(d.History) {
+		for _, e := range list {
+			if !e.Message.Ephemeral {
+				c.indexMessage(id, e)
+			}
+		}
+	}
+	return nil
+}
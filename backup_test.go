@@ -0,0 +1,95 @@
+package murcott
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/h2so5/murcott/search"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestBackupRestore(t *testing.T) {
+	id1 := utils.NewRandomNodeID(utils.GlobalNamespace)
+	id2 := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	src := &Client{Index: search.NewMemoryIndex(nil)}
+	src.Roster.Set(id1, UserProfile{Nickname: "backup"})
+	src.Roster.Set(id2, UserProfile{Nickname: "backup"})
+	src.Roster.approve(id2)
+	src.History.Push(id1, newHistoryEntry(id1, NewPlainChatMessage("hello")))
+
+	var b bytes.Buffer
+	err := src.Backup(&b, "passphrase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header := b.Bytes()[:len(backupMagic)+5]
+	if n := binary.BigEndian.Uint32(header[len(backupMagic)+1:]); n != backupIterations {
+		t.Errorf("header holds %d iterations; expects %d", n, backupIterations)
+	}
+	if VerifyBackup(bytes.NewReader(b.Bytes()), "wrong") == nil {
+		t.Errorf("VerifyBackup() should fail with a wrong passphrase")
+	}
+	broken := append([]byte{}, b.Bytes()...)
+	broken[len(broken)-1] ^= 1
+	if VerifyBackup(bytes.NewReader(broken), "passphrase") == nil {
+		t.Errorf("VerifyBackup() should fail with a modified backup")
+	}
+
+	dst := &Client{Index: search.NewMemoryIndex(nil)}
+	dst.Roster.Set(id1, UserProfile{Nickname: "local"})
+	dst.History.Push(id1, newHistoryEntry(id1, NewPlainChatMessage("local")))
+
+	for i := 0; i < 2; i++ {
+		err = dst.Restore(bytes.NewReader(b.Bytes()), "passphrase")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if dst.Roster.Get(id1).Nickname != "local" {
+		t.Errorf("Restore() should not overwrite existing contacts")
+	}
+	if dst.Roster.Get(id2).Nickname != "backup" || !dst.Roster.approved(id2) {
+		t.Errorf("Restore() should add missing contacts with their approval")
+	}
+	if l := len(dst.History.List(id1)); l != 2 {
+		t.Errorf("history has %d entries; expects %d", l, 2)
+	}
+	docs, _ := dst.Search(search.Query{Text: "hello"})
+	if len(docs) != 1 {
+		t.Errorf("restored messages should be indexed once")
+	}
+}
+
+func TestBackupConcurrent(t *testing.T) {
+	c := &Client{}
+	stop := make(chan bool)
+	started := make(chan bool)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := 0; i < 1000; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			id := utils.NewRandomNodeID(utils.GlobalNamespace)
+			c.Roster.Set(id, UserProfile{})
+			c.History.Push(id, newHistoryEntry(id, NewPlainChatMessage("hello")))
+			if i == 0 {
+				close(started)
+			}
+		}
+	}()
+	<-started
+	var b bytes.Buffer
+	if err := c.Backup(&b, "passphrase"); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-done
+}
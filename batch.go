@@ -0,0 +1,121 @@
+package murcott
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// batchWindow is the time for which small messages to a destination
+	// are held to be sent together.
+	batchWindow = 20 * time.Millisecond
+
+	// maxBatchLen is the maximum number of messages in a batch.
+	maxBatchLen = 16
+
+	// maxBatchedSize is the size of the largest encoded envelope
+	// which is batched.
+	maxBatchedSize = 512
+)
+
+// batcher holds the encoded envelopes waiting to be sent in a batch.
+type batcher struct {
+	pending map[utils.NodeID][][]byte
+	mutex   sync.Mutex
+}
+
+// add queues an envelope for the destination. It returns the batch if it
+// is full, and reports whether the envelope has started a new batch.
+func (b *batcher) add(dst utils.NodeID, data []byte) (full [][]byte, first bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.pending == nil {
+		b.pending = make(map[utils.NodeID][][]byte)
+	}
+	l := append(b.pending[dst], data)
+	if len(l) >= maxBatchLen {
+		delete(b.pending, dst)
+		return l, false
+	}
+	b.pending[dst] = l
+	return nil, len(l) == 1
+}
+
+// take removes the batch of the destination.
+func (b *batcher) take(dst utils.NodeID) [][]byte {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	l := b.pending[dst]
+	delete(b.pending, dst)
+	return l
+}
+
+// sendBatched sends a small envelope, such as an acknowledgement, together
+// with the other envelopes sent to the destination within batchWindow.
+// Envelopes are sent immediately to the nodes which do not advertise
+// batching support.
+func (c *Client) sendBatched(dst utils.NodeID, data []byte) error {
+	if len(data) > maxBatchedSize || !c.Roster.Get(dst).Supports(CapabilityBatch) {
+		return c.sendMessage(dst, data)
+	}
+	full, first := c.batch.add(dst, data)
+	if full != nil {
+		return c.sendBatch(dst, full)
+	}
+	if first {
+		time.AfterFunc(batchWindow, func() {
+			if l := c.batch.take(dst); len(l) > 0 {
+				c.sendBatch(dst, l)
+			}
+		})
+	}
+	return nil
+}
+
+func (c *Client) sendBatch(dst utils.NodeID, list [][]byte) error {
+	if len(list) == 1 {
+		return c.sendMessage(dst, list[0])
+	}
+	t := protocol.Envelope{Type: protocol.MsgBatch, ID: c.id.String(), Content: list}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	if err := c.sendMessage(dst, data); err != nil {
+		return err
+	}
+	for _, e := range list {
+		c.protocolStats.sent(dst, envelopeType(e), len(e), 0)
+	}
+	return nil
+}
+
+// parseBatch handles each envelope of a batch like a separate message.
+// Nested batches are ignored.
+func (c *Client) parseBatch(rm router.Message) {
+	u := struct {
+		Content [][]byte `msgpack:"content"`
+	}{}
+	if msgpack.Unmarshal(rm.Payload, &u) != nil {
+		return
+	}
+	if len(u.Content) > maxBatchLen {
+		u.Content = u.Content[:maxBatchLen]
+	}
+	for _, data := range u.Content {
+		var t struct {
+			Type string `msgpack:"type"`
+		}
+		if msgpack.Unmarshal(data, &t) != nil || t.Type == protocol.MsgBatch {
+			continue
+		}
+		m := rm
+		m.Payload = data
+		c.parseMessage(m)
+	}
+}
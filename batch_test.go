@@ -0,0 +1,36 @@
+package murcott
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestBatcher(t *testing.T) {
+	var b batcher
+	dst := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	if full, first := b.add(dst, []byte("a")); full != nil || !first {
+		t.Errorf("add() should start a new batch")
+	}
+	if full, first := b.add(dst, []byte("b")); full != nil || first {
+		t.Errorf("add() should append to the batch")
+	}
+	if l := b.take(dst); len(l) != 2 || string(l[1]) != "b" {
+		t.Errorf("take() returns %d messages; expects 2", len(l))
+	}
+	if l := b.take(dst); len(l) != 0 {
+		t.Errorf("take() returns %d messages; expects 0", len(l))
+	}
+
+	var full [][]byte
+	for i := 0; i < maxBatchLen; i++ {
+		full, _ = b.add(dst, []byte{byte(i)})
+	}
+	if len(full) != maxBatchLen {
+		t.Errorf("add() returns %d messages; expects %d", len(full), maxBatchLen)
+	}
+	if l := b.take(dst); len(l) != 0 {
+		t.Errorf("a full batch should be removed")
+	}
+}
@@ -0,0 +1,168 @@
+// Package blob provides content-addressed blobs split into Merkle-verified chunks.
+package blob
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ChunkSize is the size of the chunks of a blob, except the last one.
+const ChunkSize = 64 * 1024
+
+var ErrNotFound = errors.New("blob not found")
+
+// Manifest describes a blob. The root hash of the Merkle tree
+// over the chunk hashes identifies the blob.
+type Manifest struct {
+	Size   int64    `msgpack:"size"`
+	Chunks [][]byte `msgpack:"chunks"`
+}
+
+// ID returns the hex-encoded Merkle root of the manifest.
+func (m Manifest) ID() string {
+	return hex.EncodeToString(merkleRoot(m.Chunks))
+}
+
+// Verify checks that the manifest matches the given blob ID.
+func (m Manifest) Verify(id string) error {
+	n := (m.Size + ChunkSize - 1) / ChunkSize
+	if n == 0 {
+		n = 1
+	}
+	if int64(len(m.Chunks)) != n {
+		return errors.New("wrong number of chunks")
+	}
+	if m.ID() != id {
+		return errors.New("manifest does not match blob id")
+	}
+	return nil
+}
+
+// VerifyChunk checks that data is the i-th chunk of the blob.
+func (m Manifest) VerifyChunk(i int, data []byte) error {
+	if i < 0 || i >= len(m.Chunks) {
+		return fmt.Errorf("chunk index out of range: %d", i)
+	}
+	if !bytes.Equal(leafHash(data), m.Chunks[i]) {
+		return fmt.Errorf("chunk %d is corrupt", i)
+	}
+	return nil
+}
+
+// Split divides data into chunks and returns them with the manifest.
+func Split(data []byte) (Manifest, [][]byte) {
+	var chunks [][]byte
+	for i := 0; i < len(data); i += ChunkSize {
+		end := i + ChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunks = append(chunks, data[i:end])
+	}
+	if len(chunks) == 0 {
+		chunks = [][]byte{[]byte{}}
+	}
+	m := Manifest{Size: int64(len(data))}
+	for _, c := range chunks {
+		m.Chunks = append(m.Chunks, leafHash(c))
+	}
+	return m, chunks
+}
+
+func leafHash(data []byte) []byte {
+	h := sha256.Sum256(append([]byte{0}, data...))
+	return h[:]
+}
+
+func merkleRoot(level [][]byte) []byte {
+	if len(level) == 0 {
+		return nil
+	}
+	for len(level) > 1 {
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				continue
+			}
+			b := append([]byte{1}, level[i]...)
+			h := sha256.Sum256(append(b, level[i+1]...))
+			next = append(next, h[:])
+		}
+		level = next
+	}
+	return level[0]
+}
+
+type blob struct {
+	manifest Manifest
+	chunks   [][]byte
+}
+
+// Store holds the blobs which are published by this node.
+type Store struct {
+	blobs map[string]*blob
+	mutex sync.RWMutex
+}
+
+// NewStore generates an empty Store.
+func NewStore() *Store {
+	return &Store{blobs: make(map[string]*blob)}
+}
+
+// Put splits data into chunks, stores them and returns the blob ID.
+func (s *Store) Put(data []byte) string {
+	m, chunks := Split(data)
+	id := m.ID()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.blobs[id] = &blob{manifest: m, chunks: chunks}
+	return id
+}
+
+// Manifest returns the manifest of the given blob.
+func (s *Store) Manifest(id string) (Manifest, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, ok := s.blobs[id]
+	if !ok {
+		return Manifest{}, ErrNotFound
+	}
+	return b.manifest, nil
+}
+
+// Chunk returns the i-th chunk of the given blob.
+func (s *Store) Chunk(id string, i int) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, ok := s.blobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	if i < 0 || i >= len(b.chunks) {
+		return nil, fmt.Errorf("chunk index out of range: %d", i)
+	}
+	return b.chunks[i], nil
+}
+
+// Get returns the contents of the given blob.
+func (s *Store) Get(id string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	b, ok := s.blobs[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return bytes.Join(b.chunks, nil), nil
+}
+
+// Remove deletes the given blob.
+func (s *Store) Remove(id string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.blobs, id)
+}
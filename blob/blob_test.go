@@ -0,0 +1,63 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestSplitVerify(t *testing.T) {
+	data := bytes.Repeat([]byte("murcott"), ChunkSize/2)
+	m, chunks := Split(data)
+	if len(chunks) != 4 {
+		t.Errorf("Split() returns %d chunks; expects %d", len(chunks), 4)
+	}
+	if err := m.Verify(m.ID()); err != nil {
+		t.Error(err)
+	}
+
+	broken := m
+	broken.Chunks = append([][]byte{}, m.Chunks...)
+	broken.Chunks[1] = broken.Chunks[0]
+	if broken.Verify(m.ID()) == nil {
+		t.Errorf("Verify() should detect a modified manifest")
+	}
+	if m.VerifyChunk(1, chunks[0]) == nil {
+		t.Errorf("VerifyChunk() should detect a wrong chunk")
+	}
+
+	e, _ := Split(nil)
+	if err := e.Verify(e.ID()); err != nil {
+		t.Errorf("empty blob: %v", err)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	s := NewStore()
+	data := bytes.Repeat([]byte("blob"), ChunkSize)
+	id := s.Put(data)
+	m, _ := s.Manifest(id)
+
+	// provider 0 is unreachable, provider 1 serves corrupt chunks.
+	get := func(p int, i int) ([]byte, error) {
+		switch p {
+		case 0:
+			return nil, errors.New("unreachable")
+		case 1:
+			return []byte("corrupt"), nil
+		}
+		return s.Chunk(id, i)
+	}
+	b, err := Fetch(m, 3, 2, get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("Fetch() returns wrong contents")
+	}
+
+	_, err = Fetch(m, 2, 2, get)
+	if err == nil {
+		t.Errorf("Fetch() should fail without a valid provider")
+	}
+}
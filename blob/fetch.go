@@ -0,0 +1,70 @@
+package blob
+
+import (
+	"bytes"
+	"errors"
+)
+
+// ChunkFunc requests the i-th chunk of a blob from the given provider.
+type ChunkFunc func(provider int, i int) ([]byte, error)
+
+// Fetch downloads the chunks described by m from the providers in parallel
+// and returns the verified contents. Each chunk is tried on every provider,
+// starting from a different one per chunk, until a valid copy is received.
+// At most parallel requests are in flight at once.
+func Fetch(m Manifest, providers int, parallel int, get ChunkFunc) ([]byte, error) {
+	if providers == 0 {
+		return nil, errors.New("no providers")
+	}
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	type result struct {
+		index int
+		data  []byte
+		err   error
+	}
+
+	jobs := make(chan int)
+	results := make(chan result)
+	for w := 0; w < parallel; w++ {
+		go func() {
+			for i := range jobs {
+				var err error
+				var data []byte
+				for n := 0; n < providers; n++ {
+					data, err = get((i+n)%providers, i)
+					if err == nil {
+						err = m.VerifyChunk(i, data)
+					}
+					if err == nil {
+						break
+					}
+				}
+				results <- result{index: i, data: data, err: err}
+			}
+		}()
+	}
+
+	go func() {
+		for i := range m.Chunks {
+			jobs <- i
+		}
+		close(jobs)
+	}()
+
+	chunks := make([][]byte, len(m.Chunks))
+	var err error
+	for range m.Chunks {
+		r := <-results
+		if r.err != nil && err == nil {
+			err = r.err
+		}
+		chunks[r.index] = r.data
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.Join(chunks, nil), nil
+}
@@ -0,0 +1,170 @@
+package murcott
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/h2so5/murcott/blob"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	blobTimeout  = 5 * time.Second
+	blobParallel = 4
+)
+
+type blobRequest struct {
+	Blob  string `msgpack:"blob"`
+	Index int    `msgpack:"index"` // -1 requests the manifest
+}
+
+type blobResponse struct {
+	Blob     string         `msgpack:"blob"`
+	Index    int            `msgpack:"index"`
+	Data     []byte         `msgpack:"data"`
+	Manifest *blob.Manifest `msgpack:"manifest"`
+	Error    string         `msgpack:"error"`
+}
+
+func blobKey(id string) string {
+	return "blob:" + id
+}
+
+func blobWaitKey(src utils.NodeID, id string, index int) string {
+	return src.String() + "/" + id + "/" + strconv.Itoa(index)
+}
+
+// PublishBlob stores data locally, announces this node as its provider
+// in the DHT and returns the blob ID.
+func (c *Client) PublishBlob(data []byte) string {
+	id := c.blobs.Put(data)
+	c.router.Announce(blobKey(id))
+	return id
+}
+
+// FetchBlob downloads the given blob from the providers announced in the DHT.
+// The chunks are requested from several providers in parallel and verified
+// against the blob ID. The fetched blob is published again by this node.
+func (c *Client) FetchBlob(id string) ([]byte, error) {
+	if data, err := c.blobs.Get(id); err == nil {
+		return data, nil
+	}
+
+	providers := c.router.Providers(blobKey(id))
+	if len(providers) == 0 {
+		return nil, errors.New("no providers found")
+	}
+
+	var m *blob.Manifest
+	for _, p := range providers {
+		r, err := c.requestBlob(p.ID, id, -1)
+		if err == nil && r.Manifest != nil && r.Manifest.Verify(id) == nil {
+			m = r.Manifest
+			break
+		}
+	}
+	if m == nil {
+		return nil, errors.New("manifest not available")
+	}
+
+	data, err := blob.Fetch(*m, len(providers), blobParallel, func(p int, i int) ([]byte, error) {
+		r, err := c.requestBlob(providers[p].ID, id, i)
+		return r.Data, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.PublishBlob(data)
+	return data, nil
+}
+
+func (c *Client) requestBlob(dst utils.NodeID, id string, index int) (blobResponse, error) {
+	ch := make(chan blobResponse, 1)
+	key := blobWaitKey(dst, id, index)
+	c.blobMutex.Lock()
+	c.blobWaits[key] = ch
+	c.blobMutex.Unlock()
+	defer func() {
+		c.blobMutex.Lock()
+		delete(c.blobWaits, key)
+		c.blobMutex.Unlock()
+	}()
+
+	err := c.sendBlobMessage(dst, protocol.MsgBlobRequest, blobRequest{Blob: id, Index: index})
+	if err != nil {
+		return blobResponse{}, err
+	}
+
+	select {
+	case r := <-ch:
+		if r.Error != "" {
+			return r, errors.New(r.Error)
+		}
+		return r, nil
+	case <-time.After(blobTimeout):
+		return blobResponse{}, errors.New("timeout")
+	}
+}
+
+func (c *Client) handleBlobMessage(typ string, rm router.Message) {
+	switch typ {
+	case protocol.MsgBlobRequest:
+		u := struct {
+			Content blobRequest `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil {
+			return
+		}
+		req := u.Content
+		res := blobResponse{Blob: req.Blob, Index: req.Index}
+		if req.Index < 0 {
+			m, err := c.blobs.Manifest(req.Blob)
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Manifest = &m
+			}
+		} else {
+			data, err := c.blobs.Chunk(req.Blob, req.Index)
+			if err != nil {
+				res.Error = err.Error()
+			} else {
+				res.Data = data
+			}
+		}
+		c.sendBlobMessage(rm.Node, protocol.MsgBlobResponse, res)
+
+	case protocol.MsgBlobResponse:
+		u := struct {
+			Content blobResponse `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil {
+			return
+		}
+		key := blobWaitKey(rm.Node, u.Content.Blob, u.Content.Index)
+		c.blobMutex.Lock()
+		ch, ok := c.blobWaits[key]
+		c.blobMutex.Unlock()
+		if ok {
+			select {
+			case ch <- u.Content:
+			default:
+			}
+		}
+	}
+}
+
+func (c *Client) sendBlobMessage(dst utils.NodeID, typ string, content interface{}) error {
+	t := protocol.Envelope{Type: typ, ID: c.id.String(), Content: content}
+
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return c.sendMessage(dst, data)
+}
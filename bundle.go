@@ -0,0 +1,87 @@
+package murcott
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/storage/atomicfile"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	bundleMagic   = "MCSN"
+	bundleVersion = 1
+)
+
+// ExportBundle writes to w a bundle of the chat messages waiting in the
+// outbox and of the DHT records held by this node, to be carried to a
+// node of a network which cannot be reached, such as on a USB drive.
+// The bundle is signed but not encrypted.
+func (c *Client) ExportBundle(w io.Writer) error {
+	b, err := c.router.ExportBundle()
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(b)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(bundleMagic)
+	buf.WriteByte(bundleVersion)
+	buf.Write(data)
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// ExportBundleFile writes a bundle to the given path.
+func (c *Client) ExportBundleFile(path string) error {
+	return atomicfile.Write(path, 0600, c.ExportBundle)
+}
+
+func readBundle(r io.Reader) (*router.Bundle, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	hlen := len(bundleMagic) + 1
+	if len(b) < hlen || string(b[:len(bundleMagic)]) != bundleMagic {
+		return nil, errors.New("not a bundle file")
+	}
+	if v := b[len(bundleMagic)]; v != bundleVersion {
+		return nil, fmt.Errorf("unsupported bundle version: %d", v)
+	}
+	var bundle router.Bundle
+	err = msgpack.Unmarshal(b[hlen:], &bundle)
+	if err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// ImportBundle ingests a bundle exported by another node. The messages
+// addressed to this client are received as if they had been sent to it
+// directly, the others are sent towards their destinations, and the DHT
+// records are stored in the network of this node.
+func (c *Client) ImportBundle(r io.Reader) (router.BundleImport, error) {
+	b, err := readBundle(r)
+	if err != nil {
+		return router.BundleImport{}, err
+	}
+	return c.router.ImportBundle(b)
+}
+
+// ImportBundleFile ingests the bundle at the given path.
+func (c *Client) ImportBundleFile(path string) (router.BundleImport, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return router.BundleImport{}, err
+	}
+	defer f.Close()
+	return c.ImportBundle(f)
+}
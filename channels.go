@@ -0,0 +1,310 @@
+package murcott
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// maxChannelPosts is the number of posts kept for each channel
+// and served to the other subscribers.
+const maxChannelPosts = 256
+
+// ChannelPost is a post of a read-only broadcast channel. The channel ID
+// is a group ID generated from the key of the channel, and only the holder
+// of the key can sign posts.
+type ChannelPost struct {
+	Channel utils.NodeID    `msgpack:"channel"`
+	ID      []byte          `msgpack:"id"`
+	Message ChatMessage     `msgpack:"message"`
+	Time    time.Time       `msgpack:"time"`
+	Key     utils.PublicKey `msgpack:"key"`
+	Sign    utils.Signature `msgpack:"sign"`
+}
+
+func (p *ChannelPost) serialize() []byte {
+	msg, _ := msgpack.Marshal(p.Message)
+	data, _ := msgpack.Marshal([]interface{}{
+		p.Channel.Bytes(),
+		p.ID,
+		msg,
+		p.Time.UnixNano(),
+	})
+	return data
+}
+
+func (p *ChannelPost) sign(key *utils.PrivateKey) error {
+	p.Key = key.PublicKey
+	sign := key.Sign(p.serialize())
+	if sign == nil {
+		return errors.New("cannot sign channel post")
+	}
+	p.Sign = *sign
+	return nil
+}
+
+// Verify checks that the post is signed by the key of the channel.
+func (p *ChannelPost) Verify() error {
+	if p.Channel.Digest.Cmp(p.Key.Digest()) != 0 {
+		return errors.New("channel post signed by wrong key")
+	}
+	if !p.Key.Verify(p.serialize(), &p.Sign) {
+		return errors.New("invalid channel post signature")
+	}
+	return nil
+}
+
+// ChannelPostEvent is emitted when a new post of a subscribed channel
+// is received.
+type ChannelPostEvent struct {
+	Post ChannelPost
+}
+
+// channelSync requests the posts of a channel published after Since.
+// It is answered by about roomAckers subscribers, chosen by the
+// requester and Since, so that every subscriber does not reply.
+type channelSync struct {
+	Channel utils.NodeID `msgpack:"channel"`
+	Since   time.Time    `msgpack:"since"`
+}
+
+// seed returns the bytes from which the responders to the request
+// of the given node are chosen.
+func (s channelSync) seed(src utils.NodeID) []byte {
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(s.Since.UnixNano()))
+	return append(src.Bytes(), t[:]...)
+}
+
+type byPostTime []ChannelPost
+
+func (s byPostTime) Len() int           { return len(s) }
+func (s byPostTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byPostTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// channelStore keeps the posts of the subscribed channels.
+type channelStore struct {
+	posts map[utils.NodeID][]ChannelPost
+	mutex sync.RWMutex
+}
+
+func (s *channelStore) subscribe(id utils.NodeID) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.posts == nil {
+		s.posts = make(map[utils.NodeID][]ChannelPost)
+	}
+	if _, ok := s.posts[id]; ok {
+		return false
+	}
+	s.posts[id] = []ChannelPost{}
+	return true
+}
+
+func (s *channelStore) unsubscribe(id utils.NodeID) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.posts[id]; !ok {
+		return false
+	}
+	delete(s.posts, id)
+	return true
+}
+
+// list returns the subscribed channels.
+func (s *channelStore) list() []utils.NodeID {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var l []utils.NodeID
+	for id := range s.posts {
+		l = append(l, id)
+	}
+	return l
+}
+
+func (s *channelStore) subscribed(id utils.NodeID) bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	_, ok := s.posts[id]
+	return ok
+}
+
+// add stores a verified post of a subscribed channel and reports
+// whether it is new.
+func (s *channelStore) add(p ChannelPost) bool {
+	if p.Verify() != nil {
+		return false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	list, ok := s.posts[p.Channel]
+	if !ok {
+		return false
+	}
+	for _, q := range list {
+		if string(q.ID) == string(p.ID) {
+			return false
+		}
+	}
+	list = append(list, p)
+	sort.Stable(byPostTime(list))
+	if len(list) > maxChannelPosts {
+		list = list[len(list)-maxChannelPosts:]
+	}
+	s.posts[p.Channel] = list
+	return true
+}
+
+// since returns the posts of the channel published after t.
+func (s *channelStore) since(id utils.NodeID, t time.Time) []ChannelPost {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var list []ChannelPost
+	for _, p := range s.posts[id] {
+		if p.Time.After(t) {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// latest returns the time of the latest post of the channel.
+func (s *channelStore) latest(id utils.NodeID) time.Time {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	list := s.posts[id]
+	if len(list) == 0 {
+		return time.Time{}
+	}
+	return list[len(list)-1].Time
+}
+
+func channelKey(id utils.NodeID) string {
+	return "channel:" + id.String()
+}
+
+// NewChannelID returns the ID of the channel of the given key.
+func NewChannelID(key *utils.PrivateKey) utils.NodeID {
+	return utils.NewNodeID(utils.GroupNamespace, key.Digest())
+}
+
+// PublishChannelPost signs the message with the channel key, sends it to
+// the subscribers and stores it in the DHT for the subscribers which
+// are offline. The publisher is subscribed to the channel.
+func (c *Client) PublishChannelPost(key *utils.PrivateKey, msg ChatMessage) (ChannelPost, error) {
+	p := ChannelPost{
+		Channel: NewChannelID(key),
+		ID:      make([]byte, 16),
+		Message: msg,
+		Time:    time.Now(),
+	}
+	_, err := rand.Read(p.ID)
+	if err != nil {
+		return p, err
+	}
+	err = p.sign(key)
+	if err != nil {
+		return p, err
+	}
+	if c.channels.subscribe(p.Channel) {
+		c.router.Join(p.Channel)
+	}
+	c.channels.add(p)
+
+	data, err := msgpack.Marshal(p)
+	if err != nil {
+		return p, err
+	}
+	c.router.StoreSet(channelKey(p.Channel), []string{string(data)})
+	return p, c.sendChannelMessage(p.Channel, protocol.MsgChannelPost, p)
+}
+
+// Subscribe joins the channel and pulls the posts published while this
+// node was not subscribed from the DHT and from the other subscribers.
+func (c *Client) Subscribe(id utils.NodeID) error {
+	if !c.channels.subscribe(id) {
+		return errors.New("already subscribed")
+	}
+	c.router.Join(id)
+	c.SyncChannel(id)
+	return nil
+}
+
+// Unsubscribe leaves the channel and drops its posts.
+func (c *Client) Unsubscribe(id utils.NodeID) error {
+	if !c.channels.unsubscribe(id) {
+		return errors.New("not subscribed")
+	}
+	return c.router.Leave(id)
+}
+
+// ChannelPosts returns the known posts of a subscribed channel,
+// oldest first.
+func (c *Client) ChannelPosts(id utils.NodeID) []ChannelPost {
+	return c.channels.since(id, time.Time{})
+}
+
+// SyncChannel loads the posts of the channel from the DHT and asks the
+// other subscribers for the posts newer than the latest known one.
+func (c *Client) SyncChannel(id utils.NodeID) {
+	for _, str := range c.router.LoadSet(channelKey(id)) {
+		var p ChannelPost
+		if msgpack.Unmarshal([]byte(str), &p) == nil && p.Channel.Match(id) {
+			c.receivePost(p)
+		}
+	}
+	s := channelSync{Channel: id, Since: c.channels.latest(id)}
+	c.sendChannelMessage(id, protocol.MsgChannelSync, s)
+}
+
+func (c *Client) receivePost(p ChannelPost) {
+	if c.channels.add(p) {
+		c.mbuf.Push(readPair{M: ChannelPostEvent{Post: p}, ID: p.Channel})
+	}
+}
+
+func (c *Client) handleChannelMessage(typ string, rm router.Message) {
+	switch typ {
+	case protocol.MsgChannelPost:
+		u := struct {
+			Content ChannelPost `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil {
+			return
+		}
+		c.receivePost(u.Content)
+
+	case protocol.MsgChannelSync:
+		u := struct {
+			Content channelSync `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil || rm.Node.Match(c.id) {
+			return
+		}
+		if !roomAcker(c.id, u.Content.seed(rm.Node), c.router.MemberCount(u.Content.Channel)) {
+			return
+		}
+		for _, p := range c.channels.since(u.Content.Channel, u.Content.Since) {
+			c.sendChannelMessage(rm.Node, protocol.MsgChannelPost, p)
+		}
+	}
+}
+
+func (c *Client) sendChannelMessage(dst utils.NodeID, typ string, content interface{}) error {
+	t := protocol.Envelope{Type: typ, ID: c.id.String(), Content: content}
+
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return c.sendMessage(dst, data)
+}
@@ -0,0 +1,113 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestChannelStore(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := NewChannelID(key)
+	now := time.Now()
+
+	post := func(text string, t time.Time, key *utils.PrivateKey) ChannelPost {
+		p := ChannelPost{Channel: id, ID: []byte(text), Message: NewPlainChatMessage(text), Time: t}
+		p.sign(key)
+		return p
+	}
+
+	var s channelStore
+	p1 := post("first", now, key)
+	if s.add(p1) {
+		t.Errorf("add() accepts a post of an unsubscribed channel")
+	}
+
+	s.subscribe(id)
+	if !s.add(p1) {
+		t.Errorf("add() rejects a valid post")
+	}
+	if s.add(p1) {
+		t.Errorf("add() accepts a duplicate post")
+	}
+	if s.add(post("forged", now, utils.GeneratePrivateKey())) {
+		t.Errorf("add() accepts a post signed by another key")
+	}
+	p0 := post("zeroth", now.Add(-time.Minute), key)
+	p0.Message = NewPlainChatMessage("tampered")
+	if s.add(p0) {
+		t.Errorf("add() accepts a tampered post")
+	}
+
+	s.add(post("second", now.Add(time.Minute), key))
+	if l := s.since(id, time.Time{}); len(l) != 2 || string(l[0].ID) != "first" {
+		t.Errorf("since() returns %d posts; expects 2 in order", len(l))
+	}
+	if l := s.since(id, now); len(l) != 1 || string(l[0].ID) != "second" {
+		t.Errorf("since() should only return the newer posts")
+	}
+	if !s.latest(id).Equal(now.Add(time.Minute)) {
+		t.Errorf("latest() returns %v; expects %v", s.latest(id), now.Add(time.Minute))
+	}
+
+	s.unsubscribe(id)
+	if s.subscribed(id) || len(s.since(id, time.Time{})) != 0 {
+		t.Errorf("unsubscribe() should drop the posts")
+	}
+}
+
+func TestChannelStoreSave(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := NewChannelID(key)
+	empty := NewChannelID(utils.GeneratePrivateKey())
+	p := ChannelPost{Channel: id, ID: []byte("post"), Message: NewPlainChatMessage("post"), Time: time.Now()}
+	p.sign(key)
+
+	var s channelStore
+	s.subscribe(id)
+	s.subscribe(empty)
+	s.add(p)
+	st := storage.NewMemoryStorage()
+	err := st.Update(func(tx storage.Tx) error {
+		return s.save(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var s2 channelStore
+	err = st.View(func(tx storage.Tx) error {
+		return s2.restore(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s2.list()) != 2 || !s2.subscribed(empty) {
+		t.Errorf("restored subscriptions: %v; expects %v and %v", s2.list(), id, empty)
+	}
+	if l := s2.since(id, time.Time{}); len(l) != 1 || l[0].Verify() != nil {
+		t.Errorf("restored posts: %v; expects the signed post", l)
+	}
+}
+
+func TestChannelSyncResponders(t *testing.T) {
+	members := make([]utils.NodeID, 100)
+	for i := range members {
+		members[i] = utils.NewRandomNodeID(utils.GlobalNamespace)
+	}
+	responders := 0
+	for i := 0; i < 100; i++ {
+		src := utils.NewRandomNodeID(utils.GlobalNamespace)
+		s := channelSync{Channel: utils.NewRandomNodeID(utils.GroupNamespace), Since: time.Now()}
+		for _, m := range members {
+			if roomAcker(m, s.seed(src), len(members)) {
+				responders++
+			}
+		}
+	}
+	if responders < 50*roomAckers || responders > 150*roomAckers {
+		t.Errorf("%d subscribers answer 100 syncs; expects about %d", responders, 100*roomAckers)
+	}
+}
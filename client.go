@@ -5,9 +5,13 @@ import (
 	"bytes"
 	"errors"
 	"sync"
+	"time"
 
+	"github.com/h2so5/murcott/blob"
 	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
 	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/search"
 	"github.com/h2so5/murcott/utils"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
@@ -17,12 +21,57 @@ type Client struct {
 	readch chan router.Message
 	mbuf   *messageBuffer
 	id     utils.NodeID
+	key    *utils.PrivateKey
 	config utils.Config
 
-	profile UserProfile
-	Roster  Roster
+	profile  UserProfile
+	profiles profileCache
+	Roster   Roster
+	History  History
 
-	Logger *log.Logger
+	presence presence
+	probes   probeState
+	reach    reachability
+	channels channelStore
+
+	batch batcher
+	dicts dictionaries
+	ping  pingState
+
+	wakeToken []byte
+	wakeNodes []utils.NodeID
+	wakeMutex sync.Mutex
+
+	retention      RetentionPolicy
+	retentionMutex sync.Mutex
+
+	blobs     *blob.Store
+	blobWaits map[string]chan blobResponse
+	blobMutex sync.Mutex
+
+	delivery deliveryTracker
+	counters messageCounters
+	seen     seenMessages
+	sent     sentMessages
+
+	transformers transformers
+	roomMetadata roomMetadataCache
+	roomKeys     roomKeys
+	devices      deviceSync
+	snapshots    snapshotHistory
+
+	protocolStats protocolCounters
+
+	inboxes    []*PublicInbox
+	inboxMutex sync.Mutex
+
+	// Index is the full-text index of the message history.
+	// Ephemeral messages are never indexed.
+	Index search.Index
+
+	Logger    *log.Logger
+	exit      chan int
+	closeOnce sync.Once
 }
 
 type readPair struct {
@@ -92,9 +141,38 @@ func (b *messageBuffer) Close() {
 	}
 }
 
+var clientCapabilities = []string{CapabilityEphemeral, CapabilityBatch, CapabilityCompress}
+
 // Message represents an incoming message.
 type Message interface{}
 
+// ConnectivityEvent is emitted when the network addresses of this node
+// change. Sessions are re-established and the addresses are announced
+// again automatically.
+type ConnectivityEvent struct {
+	Addrs []string
+}
+
+// DecodeErrorEvent is emitted in strict decoding mode when a message
+// from a node is rejected.
+type DecodeErrorEvent struct {
+	Src utils.NodeID
+	Err *protocol.DecodeError
+}
+
+// CrashEvent is emitted when a goroutine of the node panics. The crashed
+// subsystem is restarted automatically with backoff.
+type CrashEvent struct {
+	Subsystem string
+	Err       *router.CrashError
+}
+
+// DeprecationEvent is emitted when a significant share of the peers seen
+// lately do not support the minimum protocol version of the configuration.
+type DeprecationEvent struct {
+	Warning router.DeprecationWarning
+}
+
 // NewClient generates a Client with the given PrivateKey.
 func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
 	logger := log.NewLogger()
@@ -103,29 +181,118 @@ func NewClient(key *utils.PrivateKey, config utils.Config) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
+	return newClient(key, config, r, logger), nil
+}
 
+// NewClientWithTransport creates a client which shares the listener of the
+// given transport with the other clients using it, so that several
+// identities can run in one process on a single port.
+// The transport is not closed with the client.
+func NewClientWithTransport(key *utils.PrivateKey, config utils.Config, t *router.Transport) (*Client, error) {
+	logger := log.NewLogger()
+
+	r, err := router.NewSharedRouter(key, logger, config, t)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(key, config, r, logger), nil
+}
+
+func newClient(key *utils.PrivateKey, config utils.Config, r *router.Router, logger *log.Logger) *Client {
 	c := &Client{
 		router: r,
 		readch: make(chan router.Message),
 		mbuf:   newMessageBuffer(128),
 		id:     utils.NewNodeID(utils.GlobalNamespace, key.Digest()),
+		key:    key,
 		config: config,
+		Index:  search.NewMemoryIndex(nil),
 		Logger: logger,
+		exit:   make(chan int),
+
+		blobs:     blob.NewStore(),
+		blobWaits: make(map[string]chan blobResponse),
 	}
+	c.snapshots.start = time.Now()
+	c.seen.filter = utils.NewDuplicateFilter(config.DedupCapacity, config.DedupFalsePositive)
+
+	c.Roster.setHandler(func(id utils.NodeID, s ContactSettings) {
+		c.mbuf.Push(readPair{M: ContactSettingsEvent{ID: id, Settings: s}, ID: id})
+	})
+	c.Roster.setTagHandler(func(id utils.NodeID, tags []string, favorite bool) {
+		c.mbuf.Push(readPair{M: ContactTagsEvent{ID: id, Tags: tags, Favorite: favorite}, ID: id})
+	})
+	c.Roster.setChangeHandler(func(changes []RosterChange) {
+		for _, ch := range changes {
+			if ch.Old.Settings.Transport != ch.New.Settings.Transport {
+				c.router.SetPreferredTransport(ch.ID, ch.New.Settings.Transport)
+			}
+		}
+		c.observeRoster()
+		c.mbuf.Push(readPair{M: RosterChangeEvent{Changes: changes}, ID: c.id})
+	})
+	c.Roster.setAliasHandler(func(id utils.NodeID, alias string) {
+		c.mbuf.Push(readPair{M: ContactAliasEvent{ID: id, Alias: alias, Name: c.Roster.Name(id)}, ID: id})
+	})
+	r.SetFloodHandler(func(group, src utils.NodeID) {
+		c.mbuf.Push(readPair{M: ModerationEvent{Room: group, Sender: src, Reason: ModerationFlood}, ID: group})
+	})
+	r.SetRouteHintFilter(func(id utils.NodeID) bool {
+		_, ok := c.Roster.profile(id)
+		return ok
+	})
+	r.SetCrashHandler(func(err *router.CrashError) {
+		c.mbuf.Push(readPair{M: CrashEvent{Subsystem: err.Subsystem, Err: err}, ID: c.id})
+	})
+	r.SetDeprecationHandler(func(w router.DeprecationWarning) {
+		c.mbuf.Push(readPair{M: DeprecationEvent{Warning: w}, ID: c.id})
+	})
+	r.SetFeatures(protocol.Types(), []string{CodecDeflate})
+	r.SetConnectivityHandler(func(addrs []string) {
+		c.mbuf.Push(readPair{M: ConnectivityEvent{Addrs: addrs}, ID: c.id})
+		c.setNetworkLost(len(addrs) == 0)
+		go c.publishRecords()
+		if len(addrs) > 0 {
+			go c.probePresence()
+		}
+	})
 
-	return c, nil
+	return c
 }
 
 func (c *Client) parseMessage(rm router.Message) {
+	if c.config.StrictDecoding {
+		if err := protocol.CheckEnvelope(rm.Payload); err != nil {
+			c.Logger.Warning("Rejected message from %s: %v", rm.Node.String(), err)
+			c.protocolStats.rejected(rm.Node, err.(*protocol.DecodeError).Type)
+			c.mbuf.Push(readPair{M: DecodeErrorEvent{Src: rm.Node, Err: err.(*protocol.DecodeError)}, ID: rm.Node})
+			return
+		}
+	}
+
 	var t struct {
-		Type string `msgpack:"type"`
-		ID   string `msgpack:"id"`
+		Type  string `msgpack:"type"`
+		ID    string `msgpack:"id"`
+		MsgID []byte `msgpack:"msgid"`
 	}
 	err := msgpack.Unmarshal(rm.Payload, &t)
 	if err != nil {
+		c.protocolStats.rejected(rm.Node, UnknownMessageType)
+		return
+	}
+
+	if c.config.RosterOnly && c.fromStranger(rm) {
 		return
 	}
 
+	start := time.Now()
+	if _, ok := c.Roster.profile(rm.Node); ok {
+		c.reach.heard(rm.Node, start)
+	}
+	defer func() {
+		c.protocolStats.received(rm.Node, t.Type, len(rm.Payload), time.Since(start))
+	}()
+
 	id, err := utils.NewNodeIDFromString(t.ID)
 	if err != nil {
 		return
@@ -133,7 +300,11 @@ func (c *Client) parseMessage(rm router.Message) {
 
 	var m Message
 	switch t.Type {
-	case "chat":
+	case protocol.MsgChat:
+		// Only signed posts are accepted in a channel.
+		if c.channels.subscribed(rm.Conversation()) {
+			return
+		}
 		u := struct {
 			Content ChatMessage `msgpack:"content"`
 		}{}
@@ -141,9 +312,30 @@ func (c *Client) parseMessage(rm router.Message) {
 		if err != nil {
 			return
 		}
+		u.Content.Time = c.localTime(rm.Node, u.Content.Time)
+		if t.MsgID != nil {
+			// The message is acknowledged again in case the ack was lost.
+			if !c.seen.add(rm.Node, t.MsgID) {
+				c.ackMessage(rm, t.MsgID)
+				return
+			}
+			u.Content.ID = formatMessageID(t.MsgID)
+		}
+		msg, err := c.transformInbound(rm.Node, u.Content)
+		if err != nil {
+			c.Logger.Warning("Rejected message from %s: %v", rm.Node.String(), err)
+			c.mbuf.Push(readPair{M: RejectedEvent{Src: rm.Node, ID: u.Content.ID, Err: err}, ID: rm.Node})
+			if t.MsgID != nil {
+				c.ackMessage(rm, t.MsgID)
+			}
+			return
+		}
+		u.Content = msg
+		u.Content.Notification = c.Roster.GetSettings(rm.Node).Notification
 		m = u.Content
+		c.archive(rm.Conversation(), newHistoryEntry(rm.Node, u.Content))
 
-	case "ack":
+	case protocol.MsgAck:
 		u := struct {
 			Content MessageAck `msgpack:"content"`
 		}{}
@@ -152,41 +344,196 @@ func (c *Client) parseMessage(rm router.Message) {
 			return
 		}
 		m = u.Content
+		if conv, ok := c.delivery.acked(u.Content.ID, time.Now()); ok {
+			c.mbuf.Push(readPair{M: DeliveryEvent{ID: formatMessageID(u.Content.ID), Dst: conv, Status: DeliveryDelivered}, ID: conv})
+		}
 
-	case "prof-res":
+	case protocol.MsgRead:
 		u := struct {
-			Content UserProfileResponse `msgpack:"content"`
+			Content MessageAck `msgpack:"content"`
 		}{}
 		err := msgpack.Unmarshal(rm.Payload, &u)
 		if err != nil {
 			return
 		}
+		conv, ok := c.readConversation(rm.Node, u.Content.ID)
+		if !ok {
+			return
+		}
+		c.delivery.acked(u.Content.ID, time.Now())
+		c.mbuf.Push(readPair{M: DeliveryEvent{ID: formatMessageID(u.Content.ID), Dst: conv, Status: DeliveryRead}, ID: conv})
+
+	case protocol.MsgProfileResponse:
+		u := struct {
+			Content UserProfileResponse `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil || !id.Match(rm.Node) {
+			return
+		}
+		// Only the requested profiles and those of the contacts
+		// are accepted.
+		if _, ok := c.Roster.profile(id); !ok && !c.profiles.pending(id) {
+			return
+		}
 		m = u.Content
-		c.Roster.Set(id, u.Content.Profile)
+		c.updateProfile(id, u.Content.Profile)
 
-	case "prof-req":
+	case protocol.MsgProfileRequest:
 		c.SendProfile(id)
 
+	case protocol.MsgBlobRequest, protocol.MsgBlobResponse:
+		c.handleBlobMessage(t.Type, rm)
+
+	case protocol.MsgChannelPost, protocol.MsgChannelSync:
+		c.handleChannelMessage(t.Type, rm)
+
+	case protocol.MsgBatch:
+		c.parseBatch(rm)
+
+	case protocol.MsgCompressed:
+		c.parseCompressed(rm)
+
+	case protocol.MsgRoomEvent:
+		u := struct {
+			Content RoomEvent `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil {
+			return
+		}
+		c.receiveRoomEvent(rm.Node, rm.Conversation(), u.Content)
+
+	case protocol.MsgRosterSync:
+		c.receiveRosterSync(rm)
+
+	case protocol.MsgRoomMetadata:
+		u := struct {
+			Content RoomMetadata `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil {
+			return
+		}
+		c.receiveRoomMetadata(rm.Conversation(), u.Content)
+
+	case protocol.MsgPing, protocol.MsgPong:
+		c.handlePingMessage(t.Type, rm)
+
+	case protocol.MsgContactSecret:
+		u := struct {
+			Content ContactSecret `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil {
+			return
+		}
+		c.receiveSecret(rm.Node, u.Content.Secret)
+
+	case protocol.MsgIntroduction:
+		u := struct {
+			Content Introduction `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil {
+			return
+		}
+		c.receiveIntroduction(rm.Node, u.Content)
+
+	case protocol.MsgPresence:
+		u := struct {
+			Content UserPresence `msgpack:"content"`
+		}{}
+		err := msgpack.Unmarshal(rm.Payload, &u)
+		if err != nil {
+			return
+		}
+		c.mbuf.Push(readPair{M: PresenceEvent{ID: rm.Node, Status: u.Content.Status}, ID: rm.Node})
+		c.probes.resolve(rm.Node, u.Content.Status)
+		if u.Content.Probe {
+			go c.answerProbe(rm.Node)
+		}
+
 	}
 
-	if m != nil && t.Type != "ack" {
-		c.mbuf.Push(readPair{M: m, ID: rm.Node})
-		if !bytes.Equal(rm.Node.NS[:], utils.GroupNamespace[:]) {
+	if m != nil && t.Type != protocol.MsgAck {
+		conv := rm.Conversation()
+		if t.Type != protocol.MsgChat || !c.Roster.GetSettings(conv).Muted {
+			c.mbuf.Push(readPair{M: m, ID: rm.Node})
+		}
+		if t.MsgID != nil {
+			c.ackMessage(rm, t.MsgID)
+		} else if !bytes.Equal(conv.NS[:], utils.GroupNamespace[:]) {
 			c.sendAck(rm.Node, rm.ID)
 		}
 	}
 }
 
+// localTime converts a timestamp of the given node to the local clock.
+// Timestamps too far in the future are replaced with the current time.
+func (c *Client) localTime(id utils.NodeID, t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	now := time.Now()
+	t = c.router.PeerTime(id, t)
+	if t.Sub(now) > router.MaxClockSkew {
+		return now
+	}
+	return t
+}
+
+func (c *Client) archive(id utils.NodeID, e HistoryEntry) {
+	c.History.Push(id, e)
+	if !e.Message.Ephemeral && e.Event == nil {
+		c.indexMessage(id, e)
+	}
+}
+
+func (c *Client) indexMessage(id utils.NodeID, e HistoryEntry) {
+	c.Index.Add(search.Document{
+		ID:      e.docID(),
+		Contact: id,
+		Src:     e.Src,
+		Time:    e.Message.Time,
+		Text:    e.Message.Text(),
+	})
+}
+
+func (c *Client) indexHistory() {
+	for _, id := range c.History.Contacts() {
+		for _, e := range c.History.List(id) {
+			if !e.Message.Ephemeral && e.Event == nil {
+				c.indexMessage(id, e)
+			}
+		}
+	}
+}
+
+// Search returns the archived messages that match the given query.
+func (c *Client) Search(q search.Query) ([]search.Document, error) {
+	return c.Index.Search(q)
+}
+
 func (c *Client) Read() (Message, utils.NodeID, error) {
 	m, err := c.mbuf.Pop()
 	return m.M, m.ID, err
 }
 
+// Join joins the group, announces it with a RoomJoin event and looks up
+// the metadata of the room.
 func (c *Client) Join(id utils.NodeID) error {
-	return c.router.Join(id)
+	err := c.router.Join(id)
+	if err != nil {
+		return err
+	}
+	go c.fetchRoomMetadata(id)
+	return c.postRoomEvent(c.key, RoomEvent{Room: id, Type: RoomJoin, Member: c.id})
 }
 
+// Leave announces a RoomLeave event and leaves the group.
 func (c *Client) Leave(id utils.NodeID) error {
+	c.postRoomEvent(c.key, RoomEvent{Room: id, Type: RoomLeave, Member: c.id})
 	return c.router.Leave(id)
 }
 
@@ -203,87 +550,147 @@ func (c *Client) Run() {
 			close(exit)
 		}()
 
+		c.router.Supervise(router.SubsystemClient, func() {
+			for {
+				m, err := c.router.RecvMessage()
+				if err != nil {
+					return
+				}
+				c.parseMessage(m)
+			}
+		})
+	}()
+
+	go c.router.Supervise(router.SubsystemClient, func() {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
+		records := time.NewTicker(recordInterval)
+		defer records.Stop()
+		c.publishRecords()
+		go c.probePresence()
 		for {
-			m, err := c.router.RecvMessage()
-			if err != nil {
+			select {
+			case <-exit:
 				return
+			case <-tick.C:
+				now := time.Now()
+				c.History.Expire(now)
+				c.applyRetention(now)
+				for _, f := range c.delivery.expire(now) {
+					c.mbuf.Push(readPair{M: DeliveryEvent{ID: formatMessageID(f.id), Dst: f.conv, Status: DeliveryFailed}, ID: f.conv})
+				}
+				c.updateStatus(false)
+				c.syncDevices(now)
+				c.probeReachability(now)
+				if c.snapshots.due(now) {
+					c.snapshots.add(c.snapshot(now))
+				}
+			case <-records.C:
+				c.publishRecords()
 			}
-			c.parseMessage(m)
 		}
-	}()
+	})
 
 	<-exit
 }
 
-// Stops the current mainloop.
+// Stops the current mainloop. Closing the client again does nothing.
 func (c *Client) Close() {
-	c.mbuf.Close()
-	c.router.Close()
+	c.closeOnce.Do(func() {
+		close(c.exit)
+		c.mbuf.Close()
+		c.inboxMutex.Lock()
+		inboxes := c.inboxes
+		c.inboxMutex.Unlock()
+		for _, i := range inboxes {
+			i.Close()
+		}
+		c.router.Close()
+	})
 }
 
 // Sends the given message to the destination node.
 func (c *Client) SendMessage(dst utils.NodeID, msg ChatMessage) error {
-	t := struct {
-		Type    string      `msgpack:"type"`
-		ID      string      `msgpack:"id"`
-		Content interface{} `msgpack:"content"`
-	}{Type: "chat", ID: c.id.String(), Content: msg}
+	_, err := c.SendMessageID(dst, msg)
+	return err
+}
+
+// SendMessageID sends the given message to the destination node and
+// returns its ID. A SentEvent is emitted before the message is sent.
+func (c *Client) SendMessageID(dst utils.NodeID, msg ChatMessage) (string, error) {
+	if ttl := c.Roster.GetSettings(dst).Ephemeral; ttl > 0 && !msg.Ephemeral {
+		msg.SetEphemeral(ttl)
+	}
+
+	if msg.ID == "" {
+		msg.ID = formatMessageID(contentMessageID(c.id, dst, c.counters.session(), c.counters.next(dst), msg))
+	}
+	msgid, err := parseMessageID(msg.ID)
+	if err != nil {
+		return "", err
+	}
+
+	wire, err := c.transformOutbound(dst, msg)
+	if err != nil {
+		return "", err
+	}
+	t := protocol.Envelope{Type: protocol.MsgChat, ID: c.id.String(), MsgID: msgid, Content: wire}
 
 	data, err := msgpack.Marshal(t)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	c.router.SendMessage(dst, data)
-	return nil
+	c.mbuf.Push(readPair{M: SentEvent{ID: msg.ID, Dst: dst, Message: msg}, ID: dst})
+	packet, _ := c.sendMessageID(dst, data)
+	c.delivery.sent(msgid, dst, packet, time.Now())
+	c.sent.add(msgid, dst, time.Now())
+	c.archive(dst, newHistoryEntry(c.id, msg))
+	return msg.ID, nil
+}
+
+// PostThread sends the given message to the thread in the room.
+// Use NewThreadID to start a new thread.
+func (c *Client) PostThread(room utils.NodeID, thread string, msg ChatMessage) error {
+	msg.Thread = thread
+	return c.SendMessage(room, msg)
 }
 
 func (c *Client) SendProfile(dst utils.NodeID) error {
-	t := struct {
-		Type    string      `msgpack:"type"`
-		ID      string      `msgpack:"id"`
-		Content interface{} `msgpack:"content"`
-	}{Type: "prof-res", ID: c.id.String(), Content: c.profile}
+	prof := c.profile
+	prof.Capabilities = c.capabilities()
+	t := protocol.Envelope{Type: protocol.MsgProfileResponse, ID: c.id.String(), Content: UserProfileResponse{Profile: prof}}
 
 	data, err := msgpack.Marshal(t)
 	if err != nil {
 		return err
 	}
 
-	c.router.SendMessage(dst, data)
+	c.sendMessage(dst, data)
 	return nil
 }
 
 func (c *Client) SendProfileRequest(dst utils.NodeID) error {
-	t := struct {
-		Type    string      `msgpack:"type"`
-		ID      string      `msgpack:"id"`
-		Content interface{} `msgpack:"content"`
-	}{Type: "prof-req", ID: c.id.String(), Content: UserProfileRequest{}}
+	t := protocol.Envelope{Type: protocol.MsgProfileRequest, ID: c.id.String(), Content: UserProfileRequest{}}
 
 	data, err := msgpack.Marshal(t)
 	if err != nil {
 		return err
 	}
 
-	c.router.SendMessage(dst, data)
+	c.sendMessage(dst, data)
 	return nil
 }
 
 func (c *Client) sendAck(dst utils.NodeID, id []byte) error {
-	t := struct {
-		Type    string      `msgpack:"type"`
-		ID      string      `msgpack:"id"`
-		Content interface{} `msgpack:"content"`
-	}{Type: "ack", ID: c.id.String(), Content: MessageAck{ID: id}}
+	t := protocol.Envelope{Type: protocol.MsgAck, ID: c.id.String(), Content: MessageAck{ID: id}}
 
 	data, err := msgpack.Marshal(t)
 	if err != nil {
 		return err
 	}
 
-	c.router.SendMessage(dst, data)
-	return nil
+	return c.sendBatched(dst, data)
 }
 
 func (c *Client) ID() utils.NodeID {
@@ -294,19 +701,128 @@ func (c *Client) ActiveSessions() []utils.NodeInfo {
 	return c.router.ActiveSessions()
 }
 
+// PeerVersions counts the peers seen lately by software
+// and protocol version.
+func (c *Client) PeerVersions() []router.VersionCount {
+	return c.router.PeerVersions()
+}
+
+// Sessions describes the open sessions of the node, from the oldest.
+func (c *Client) Sessions() []router.SessionInfo {
+	return c.router.Sessions()
+}
+
+// CloseSession closes the session to the node, which is opened again
+// when a packet is next sent to it. It reports whether a session was open.
+func (c *Client) CloseSession(id utils.NodeID) bool {
+	return c.router.CloseSession(id)
+}
+
+// Contacts returns the contacts selected by the filter in the given order,
+// such as OrderPresence or OrderActivity. Contacts with an active session
+// are online.
+func (c *Client) Contacts(filter ContactFilter, order int) []Contact {
+	online := make(map[utils.NodeID]bool)
+	for _, n := range c.router.ActiveSessions() {
+		online[n.ID] = true
+	}
+	return c.Roster.contacts(filter, order,
+		func(id utils.NodeID) bool { return online[id] },
+		c.History.LastActivity)
+}
+
 func (c *Client) KnownNodes() []utils.NodeInfo {
 	return c.router.KnownNodes()
 }
 
+// BootstrapProbes returns the round-trip times of the bootstrap nodes
+// measured when the client started.
+func (c *Client) BootstrapProbes() []router.ProbeResult {
+	return c.router.BootstrapProbes()
+}
+
+// NetworkStats returns the latest statistics of the network collected
+// by an observer client. It returns false if the client is not an observer.
+func (c *Client) NetworkStats() (router.NetworkStats, bool) {
+	return c.router.NetworkStats()
+}
+
+// DHTStats returns the statistics of the main DHT followed by those of
+// the DHTs of the joined groups: the occupancy of their routing tables,
+// the number of keys they hold, their requests and their latency.
+func (c *Client) DHTStats() []router.DHTStats {
+	return c.router.DHTStats()
+}
+
+// Usage returns the resources used by the client and their limits.
+func (c *Client) Usage() router.Usage {
+	return c.router.Usage()
+}
+
+// Power modes of a client. See router.PowerLow for the impact of the
+// low-power mode on delivery latency.
+const (
+	PowerNormal = router.PowerNormal
+	PowerLow    = router.PowerLow
+)
+
+// SetPowerMode sets the power mode of the client. Mobile applications
+// should switch to PowerLow when they are moved to the background.
+// The wake token set by SetWakeToken is registered with the mailbox
+// nodes when switching to PowerLow, and unregistered when switching back.
+func (c *Client) SetPowerMode(mode int) {
+	c.router.SetPowerMode(mode)
+	c.wakeMutex.Lock()
+	token, nodes := c.wakeToken, c.wakeNodes
+	c.wakeMutex.Unlock()
+	if token == nil {
+		return
+	}
+	var err error
+	if mode == PowerLow {
+		err = c.router.RegisterWake(token, nodes)
+	} else {
+		err = c.router.UnregisterWake()
+	}
+	if err != nil {
+		c.Logger.Error("Cannot register wake token: %v", err)
+	}
+}
+
+// SetWakeToken sets an application-defined token, such as a platform push
+// token, which the given mailbox nodes pass to their wake handler when
+// messages are queued for this client in low-power mode. Known mailbox
+// nodes are chosen if nodes is empty.
+func (c *Client) SetWakeToken(token []byte, nodes []utils.NodeID) {
+	c.wakeMutex.Lock()
+	defer c.wakeMutex.Unlock()
+	c.wakeToken = token
+	c.wakeNodes = nodes
+}
+
+// SetWakeHandler sets the function which a mailbox node calls with the
+// token of a registered client when messages are queued for it.
+func (c *Client) SetWakeHandler(h func(id utils.NodeID, token []byte)) {
+	c.router.SetWakeHandler(h)
+}
+
+// ReportAbuse lowers the reputation of the given node. Messages from
+// nodes with a bad reputation are no longer delivered.
+func (c *Client) ReportAbuse(id utils.NodeID) {
+	c.router.ReportAbuse(id)
+}
+
 type serializable struct {
-	Roster Roster           `msgpack:"roster"`
-	Nodes  []utils.NodeInfo `msgpack:"nodes"`
+	Roster  Roster           `msgpack:"roster"`
+	History *History         `msgpack:"history"`
+	Nodes   []utils.NodeInfo `msgpack:"nodes"`
 }
 
 func (c *Client) MarshalBinary() (data []byte, err error) {
 	s := serializable{
-		Roster: c.Roster,
-		Nodes:  c.router.KnownNodes(),
+		Roster:  c.Roster,
+		History: &c.History,
+		Nodes:   c.router.KnownNodes(),
 	}
 	return msgpack.Marshal(s)
 }
@@ -320,7 +836,11 @@ func (c *Client) UnmarshalBinary(data []byte) error {
 	for _, n := range s.Nodes {
 		c.router.DiscoverNode(n)
 	}
-	c.Roster = s.Roster
+	c.Roster.load(&s.Roster)
+	if s.History != nil {
+		c.History.load(s.History)
+		c.indexHistory()
+	}
 
 	//for _, id := range c.Roster.List() {
 	//	c.SendProfileRequest(id)
@@ -0,0 +1,319 @@
+package murcott
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// CodecDeflate is the codec of the compressed envelopes. DEFLATE with
+	// preset dictionaries is used instead of zstd, which is not available
+	// in the standard library, and the dictionaries are negotiated through
+	// the capabilities of the profiles rather than per session.
+	CodecDeflate = "deflate"
+
+	// MaxDictionarySize is the size of the largest compression dictionary,
+	// the window of DEFLATE.
+	MaxDictionarySize = 32 * 1024
+
+	// dictCapabilityPrefix starts the capabilities which advertise
+	// the compression dictionaries held by a client.
+	dictCapabilityPrefix = "dict:"
+
+	// minCompressedSize is the size of the smallest encoded envelope
+	// which is compressed.
+	minCompressedSize = 256
+
+	// maxDecompressedSize bounds the size of a decompressed envelope.
+	maxDecompressedSize = 4 << 20
+
+	// dictSegmentSize is the length of the substrings counted
+	// by TrainDictionary.
+	dictSegmentSize = 12
+)
+
+var errDecompressedSize = errors.New("decompressed envelope too large")
+
+// compressedContent is the content of a compressed envelope. Dict is the
+// ID of the dictionary of the compression, or empty if there is none.
+type compressedContent struct {
+	Dict string `msgpack:"dict"`
+	Data []byte `msgpack:"data"`
+}
+
+// dictionaries holds the compression dictionaries of a client
+// in the order they have been added.
+type dictionaries struct {
+	ids   []string
+	m     map[string][]byte
+	mutex sync.RWMutex
+}
+
+func (d *dictionaries) add(dict []byte) string {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.m == nil {
+		d.m = make(map[string][]byte)
+	}
+	id := DictionaryID(dict)
+	if _, ok := d.m[id]; !ok {
+		d.ids = append(d.ids, id)
+		d.m[id] = append([]byte(nil), dict...)
+	}
+	return id
+}
+
+func (d *dictionaries) get(id string) ([]byte, bool) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	dict, ok := d.m[id]
+	return dict, ok
+}
+
+// negotiate returns the newest dictionary which the profiles of all the
+// peers advertise, or an empty ID if they share none.
+func (d *dictionaries) negotiate(profs []UserProfile) (string, []byte) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	for i := len(d.ids) - 1; i >= 0; i-- {
+		if supportedBy(profs, dictCapabilityPrefix+d.ids[i]) {
+			return d.ids[i], d.m[d.ids[i]]
+		}
+	}
+	return "", nil
+}
+
+// supportedBy reports whether all the profiles support the capability.
+func supportedBy(profs []UserProfile, capability string) bool {
+	for _, p := range profs {
+		if !p.Supports(capability) {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *dictionaries) capabilities() []string {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	l := make([]string, len(d.ids))
+	for i, id := range d.ids {
+		l[i] = dictCapabilityPrefix + id
+	}
+	return l
+}
+
+// DictionaryID returns the ID under which a dictionary is advertised.
+func DictionaryID(dict []byte) string {
+	h := sha256.Sum256(dict)
+	return hex.EncodeToString(h[:8])
+}
+
+// AddDictionary adds a dictionary for the compression of the envelopes,
+// such as one built by TrainDictionary, and returns its ID. The client
+// advertises the dictionaries it holds in its profile, and compresses the
+// envelopes to a contact or a room with the newest dictionary held by the
+// contact or by all the known members of the room. Envelopes to those
+// which share no dictionary are compressed without one.
+func (c *Client) AddDictionary(dict []byte) (string, error) {
+	if len(dict) == 0 || len(dict) > MaxDictionarySize {
+		return "", errors.New("invalid dictionary size")
+	}
+	return c.dicts.add(dict), nil
+}
+
+// capabilities returns the capabilities advertised in the profile.
+func (c *Client) capabilities() []string {
+	return append(append([]string(nil), clientCapabilities...), c.dicts.capabilities()...)
+}
+
+type dictSegment struct {
+	s string
+	n int
+}
+
+type bySegmentCount []dictSegment
+
+func (s bySegmentCount) Len() int      { return len(s) }
+func (s bySegmentCount) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s bySegmentCount) Less(i, j int) bool {
+	if s[i].n != s[j].n {
+		return s[i].n > s[j].n
+	}
+	return s[i].s < s[j].s
+}
+
+// TrainDictionary builds a compression dictionary of at most size bytes
+// from samples of the envelopes to compress, such as the encoded messages
+// of a chat corpus. It keeps the substrings found in the most samples, and
+// places the most common at the end, where their matches are the nearest.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size <= 0 || size > MaxDictionarySize {
+		size = MaxDictionarySize
+	}
+	counts := make(map[string]int)
+	for _, b := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictSegmentSize <= len(b); i++ {
+			s := string(b[i : i+dictSegmentSize])
+			if !seen[s] {
+				seen[s] = true
+				counts[s]++
+			}
+		}
+	}
+	var list []dictSegment
+	for s, n := range counts {
+		if n > 1 {
+			list = append(list, dictSegment{s, n})
+		}
+	}
+	sort.Sort(bySegmentCount(list))
+
+	// covered holds the segments found in the chosen ones laid end to end,
+	// including those across their boundaries, which are not chosen again.
+	var chosen []string
+	var tail string
+	covered := make(map[string]bool)
+	n := 0
+	for _, seg := range list {
+		if n+len(seg.s) > size {
+			break
+		}
+		if covered[seg.s] {
+			continue
+		}
+		chosen = append(chosen, seg.s)
+		n += len(seg.s)
+		tail += seg.s
+		for i := 0; i+dictSegmentSize <= len(tail); i++ {
+			covered[tail[i:i+dictSegmentSize]] = true
+		}
+		tail = tail[len(tail)-(dictSegmentSize-1):]
+	}
+	b := make([]byte, 0, n)
+	for i := len(chosen) - 1; i >= 0; i-- {
+		b = append(b, chosen[i]...)
+	}
+	return b
+}
+
+// recipientProfiles returns the profiles of the recipients of the
+// envelopes to the destination: the contact, or the known members of the
+// room. It returns false if the profile of a member is unknown.
+func (c *Client) recipientProfiles(dst utils.NodeID) ([]UserProfile, bool) {
+	if !bytes.Equal(dst.NS[:], utils.GroupNamespace[:]) {
+		return []UserProfile{c.Roster.Get(dst)}, true
+	}
+	members := c.router.Members(dst)
+	if len(members) == 0 {
+		return nil, false
+	}
+	profs := make([]UserProfile, 0, len(members))
+	for _, id := range members {
+		prof, ok := c.Roster.profile(id)
+		if !ok {
+			return nil, false
+		}
+		profs = append(profs, prof)
+	}
+	return profs, true
+}
+
+// compressEnvelope returns a compressed envelope wrapping an encoded
+// envelope to the destination, or the envelope itself if it is small, if
+// a recipient does not support compression, or if it does not shrink.
+func (c *Client) compressEnvelope(dst utils.NodeID, data []byte) []byte {
+	if len(data) < minCompressedSize {
+		return data
+	}
+	profs, ok := c.recipientProfiles(dst)
+	if !ok {
+		return data
+	}
+	return c.compressFor(profs, data)
+}
+
+// compressFor compresses an encoded envelope for the recipients
+// with the given profiles.
+func (c *Client) compressFor(profs []UserProfile, data []byte) []byte {
+	if !supportedBy(profs, CapabilityCompress) {
+		return data
+	}
+	id, dict := c.dicts.negotiate(profs)
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriterDict(&buf, flate.BestCompression, dict)
+	if err != nil {
+		return data
+	}
+	w.Write(data)
+	if w.Close() != nil {
+		return data
+	}
+	t := protocol.Envelope{
+		Type:    protocol.MsgCompressed,
+		ID:      c.id.String(),
+		Content: compressedContent{Dict: id, Data: buf.Bytes()},
+	}
+	out, err := msgpack.Marshal(t)
+	if err != nil || len(out) >= len(data) {
+		return data
+	}
+	return out
+}
+
+func (c *Client) decompress(content compressedContent) ([]byte, error) {
+	var dict []byte
+	if content.Dict != "" {
+		var ok bool
+		dict, ok = c.dicts.get(content.Dict)
+		if !ok {
+			return nil, errors.New("unknown compression dictionary")
+		}
+	}
+	r := flate.NewReaderDict(bytes.NewReader(content.Data), dict)
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxDecompressedSize {
+		return nil, errDecompressedSize
+	}
+	return data, nil
+}
+
+// parseCompressed handles the envelope wrapped in a compressed envelope.
+// Nested compressed envelopes are ignored.
+func (c *Client) parseCompressed(rm router.Message) {
+	u := struct {
+		Content compressedContent `msgpack:"content"`
+	}{}
+	if msgpack.Unmarshal(rm.Payload, &u) != nil {
+		return
+	}
+	data, err := c.decompress(u.Content)
+	if err != nil {
+		c.Logger.Warning("Rejected message from %s: %v", rm.Node.String(), err)
+		return
+	}
+	if envelopeType(data) == protocol.MsgCompressed {
+		return
+	}
+	m := rm
+	m.Payload = data
+	c.parseMessage(m)
+}
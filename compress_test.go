@@ -0,0 +1,95 @@
+package murcott
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func chatEnvelope(id utils.NodeID, text string) []byte {
+	t := protocol.Envelope{Type: protocol.MsgChat, ID: id.String(), Content: NewPlainChatMessage(text)}
+	data, _ := msgpack.Marshal(t)
+	return data
+}
+
+func TestCompressEnvelope(t *testing.T) {
+	src := &Client{id: utils.NewRandomNodeID(utils.GlobalNamespace)}
+	dst := &Client{id: utils.NewRandomNodeID(utils.GlobalNamespace)}
+
+	var samples [][]byte
+	for i := 0; i < 50; i++ {
+		samples = append(samples, chatEnvelope(src.id, fmt.Sprintf("see you at the meeting room %d tomorrow morning", i)))
+	}
+	dict := TrainDictionary(samples, 4096)
+	if len(dict) == 0 || len(dict) > 4096 {
+		t.Fatalf("TrainDictionary() returns %d bytes; expects at most 4096", len(dict))
+	}
+	id, err := src.AddDictionary(dict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst.AddDictionary(dict)
+
+	data := chatEnvelope(src.id, fmt.Sprintf("%0300d see you at the meeting room 7 tomorrow morning", 0))
+	if out := src.compressEnvelope(dst.id, data); string(out) != string(data) {
+		t.Errorf("envelope should not be compressed for a peer without compression")
+	}
+
+	src.Roster.Set(dst.id, UserProfile{Capabilities: []string{CapabilityCompress}})
+	plain := src.compressEnvelope(dst.id, data)
+	if envelopeType(plain) != protocol.MsgCompressed || len(plain) >= len(data) {
+		t.Fatalf("compressEnvelope() returns %d bytes; expects less than %d", len(plain), len(data))
+	}
+
+	src.Roster.Set(dst.id, UserProfile{Capabilities: dst.capabilities()})
+	out := src.compressEnvelope(dst.id, data)
+	if len(out) >= len(plain) {
+		t.Errorf("compressEnvelope() returns %d bytes with a dictionary; expects less than %d", len(out), len(plain))
+	}
+
+	u := struct {
+		Content compressedContent `msgpack:"content"`
+	}{}
+	if err := msgpack.Unmarshal(out, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Content.Dict != id {
+		t.Errorf("dictionary is %q; expects %q", u.Content.Dict, id)
+	}
+	b, err := dst.decompress(u.Content)
+	if err != nil || string(b) != string(data) {
+		t.Errorf("decompress() returns %v; expects the envelope", err)
+	}
+	if _, err := (&Client{}).decompress(u.Content); err == nil {
+		t.Errorf("decompress() should fail without the dictionary")
+	}
+}
+
+func TestCompressGroup(t *testing.T) {
+	src := &Client{id: utils.NewRandomNodeID(utils.GlobalNamespace)}
+	dict := []byte("see you at the meeting room tomorrow morning")
+	id, _ := src.AddDictionary(dict)
+	data := chatEnvelope(src.id, fmt.Sprintf("%0300d see you at the meeting room 7 tomorrow morning", 0))
+
+	withDict := UserProfile{Capabilities: []string{CapabilityCompress, dictCapabilityPrefix + id}}
+	plain := UserProfile{Capabilities: []string{CapabilityCompress}}
+
+	u := struct {
+		Content compressedContent `msgpack:"content"`
+	}{}
+	out := src.compressFor([]UserProfile{withDict, withDict}, data)
+	if err := msgpack.Unmarshal(out, &u); err != nil || u.Content.Dict != id {
+		t.Errorf("dictionary is %q; expects %q shared by all the members", u.Content.Dict, id)
+	}
+	out = src.compressFor([]UserProfile{withDict, plain}, data)
+	u.Content = compressedContent{}
+	if err := msgpack.Unmarshal(out, &u); err != nil || envelopeType(out) != protocol.MsgCompressed || u.Content.Dict != "" {
+		t.Errorf("envelope should be compressed without a dictionary not held by every member")
+	}
+	if out := src.compressFor([]UserProfile{withDict, {}}, data); string(out) != string(data) {
+		t.Errorf("envelope should not be compressed for a member without compression")
+	}
+}
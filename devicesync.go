@@ -0,0 +1,346 @@
+package murcott
+
+import (
+	"bytes"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// deviceSyncInterval is the interval at which the roster is sent
+// to each device of the user with which there is a session.
+const deviceSyncInterval = time.Minute
+
+// Prefixes of the keys of the synced roster state.
+const (
+	syncContact  = "contact/"
+	syncSettings = "settings/"
+	syncAlias    = "alias/"
+	syncTags     = "tags/"
+	syncFavorite = "favorite/"
+)
+
+// RosterSyncEvent is emitted when changes of the roster
+// are received from another device of the user.
+type RosterSyncEvent struct {
+	Device  utils.NodeID
+	Changed int
+}
+
+// lwwEntry is an element of a last-writer-wins map. Removed elements are
+// kept as tombstones, so that a removal wins over older additions. Ties
+// are broken by the ID of the device which wrote the element.
+type lwwEntry struct {
+	Value   []byte `msgpack:"value"`
+	Time    int64  `msgpack:"time"`
+	Deleted bool   `msgpack:"deleted"`
+	Origin  []byte `msgpack:"origin"`
+}
+
+func (e lwwEntry) newer(o lwwEntry) bool {
+	if e.Time != o.Time {
+		return e.Time > o.Time
+	}
+	return bytes.Compare(e.Origin, o.Origin) > 0
+}
+
+// lwwMap is a last-writer-wins element map, a CRDT whose replicas
+// converge when they merge each other in any order.
+type lwwMap map[string]lwwEntry
+
+// merge adds the entries of o which are newer than those of m,
+// and returns them.
+func (m lwwMap) merge(o lwwMap) lwwMap {
+	changed := make(lwwMap)
+	for k, e := range o {
+		if old, ok := m[k]; !ok || e.newer(old) {
+			m[k] = e
+			changed[k] = e
+		}
+	}
+	return changed
+}
+
+// clamp returns a copy of m whose entries are not later than max,
+// so that a device whose clock is ahead cannot make its changes win
+// over all the later ones.
+func (m lwwMap) clamp(max int64) lwwMap {
+	c := make(lwwMap)
+	for k, e := range m {
+		if e.Time > max {
+			e.Time = max
+		}
+		c[k] = e
+	}
+	return c
+}
+
+// newerThan reports whether m has an entry which o lacks
+// or has an older version of.
+func (m lwwMap) newerThan(o lwwMap) bool {
+	for k, e := range m {
+		if old, ok := o[k]; !ok || e.newer(old) {
+			return true
+		}
+	}
+	return false
+}
+
+// rosterSync is the synced roster state sent to the other devices.
+type rosterSync struct {
+	Entries lwwMap `msgpack:"entries"`
+}
+
+// deviceSync holds the devices of the user, the time of the last sync
+// with each of them and the synced state of the roster. applying counts
+// the syncs whose entries are being applied to the roster, whose changes
+// are not the user's.
+type deviceSync struct {
+	devices  map[utils.NodeID]time.Time
+	state    lwwMap
+	applying int
+	mutex    sync.Mutex
+}
+
+// observe stamps the changes of the roster since the last observation
+// as written by origin at now.
+func (d *deviceSync) observe(current map[string][]byte, origin utils.NodeID, now time.Time) {
+	if d.state == nil {
+		d.state = make(lwwMap)
+	}
+	for k, v := range current {
+		if e, ok := d.state[k]; !ok || e.Deleted || !bytes.Equal(e.Value, v) {
+			d.state[k] = lwwEntry{Value: v, Time: now.UnixNano(), Origin: origin.Bytes()}
+		}
+	}
+	for k, e := range d.state {
+		if _, ok := current[k]; !ok && !e.Deleted {
+			d.state[k] = lwwEntry{Time: now.UnixNano(), Deleted: true, Origin: origin.Bytes()}
+		}
+	}
+}
+
+func (d *deviceSync) snapshot() lwwMap {
+	m := make(lwwMap)
+	for k, e := range d.state {
+		m[k] = e
+	}
+	return m
+}
+
+// due returns the devices with a session which have not been synced
+// for deviceSyncInterval, and records the sync.
+func (d *deviceSync) due(sessions []utils.NodeInfo, now time.Time) []utils.NodeID {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var list []utils.NodeID
+	for _, n := range sessions {
+		last, ok := d.devices[n.ID]
+		if ok && now.Sub(last) >= deviceSyncInterval {
+			d.devices[n.ID] = now
+			list = append(list, n.ID)
+		}
+	}
+	return list
+}
+
+// syncState returns the synced state of the roster. Settings, aliases,
+// tags and favorites are omitted when they are empty, so that their
+// removal is synced as a tombstone.
+func (r *Roster) syncState() map[string][]byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	m := make(map[string][]byte)
+	for id := range r.M {
+		m[syncContact+id.String()] = []byte{}
+	}
+	for id, s := range r.Settings {
+		if s != (ContactSettings{}) {
+			m[syncSettings+id.String()], _ = msgpack.Marshal(s)
+		}
+	}
+	for id, a := range r.Aliases {
+		if a != "" {
+			m[syncAlias+id.String()] = []byte(a)
+		}
+	}
+	for id, tags := range r.Tags {
+		if len(tags) > 0 {
+			sorted := append([]string(nil), tags...)
+			sort.Strings(sorted)
+			m[syncTags+id.String()], _ = msgpack.Marshal(sorted)
+		}
+	}
+	for id, f := range r.Favorites {
+		if f {
+			m[syncFavorite+id.String()] = []byte{1}
+		}
+	}
+	return m
+}
+
+// applySync applies an entry received from another device to the roster.
+func (r *Roster) applySync(key string, e lwwEntry) {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return
+	}
+	id, err := utils.NewNodeIDFromString(key[i+1:])
+	if err != nil {
+		return
+	}
+	switch key[:i+1] {
+	case syncContact:
+		if e.Deleted {
+			r.Remove(id)
+		} else {
+			// The contact has been added by the user on another device.
+			if _, ok := r.profile(id); !ok {
+				r.Set(id, UserProfile{})
+			}
+			r.approve(id)
+		}
+	case syncSettings:
+		var s ContactSettings
+		if !e.Deleted && msgpack.Unmarshal(e.Value, &s) != nil {
+			return
+		}
+		r.SetSettings(id, s)
+	case syncAlias:
+		r.SetAlias(id, string(e.Value))
+	case syncTags:
+		var tags []string
+		if !e.Deleted && msgpack.Unmarshal(e.Value, &tags) != nil {
+			return
+		}
+		for _, t := range r.GetTags(id) {
+			r.RemoveTag(id, t)
+		}
+		for _, t := range tags {
+			r.AddTag(id, t)
+		}
+	case syncFavorite:
+		r.SetFavorite(id, !e.Deleted)
+	}
+}
+
+// AddDevice adds another device of the user, with which the roster
+// is synced whenever they have a session. The device must add this
+// node too.
+func (c *Client) AddDevice(id utils.NodeID) {
+	c.devices.mutex.Lock()
+	defer c.devices.mutex.Unlock()
+	if c.devices.devices == nil {
+		c.devices.devices = make(map[utils.NodeID]time.Time)
+	}
+	if _, ok := c.devices.devices[id]; !ok {
+		c.devices.devices[id] = time.Time{}
+	}
+}
+
+// RemoveDevice stops syncing the roster with the device.
+func (c *Client) RemoveDevice(id utils.NodeID) {
+	c.devices.mutex.Lock()
+	defer c.devices.mutex.Unlock()
+	delete(c.devices.devices, id)
+}
+
+// Devices returns the other devices of the user.
+func (c *Client) Devices() []utils.NodeID {
+	c.devices.mutex.Lock()
+	defer c.devices.mutex.Unlock()
+	var list []utils.NodeID
+	for id := range c.devices.devices {
+		list = append(list, id)
+	}
+	return list
+}
+
+func (c *Client) isDevice(id utils.NodeID) bool {
+	c.devices.mutex.Lock()
+	defer c.devices.mutex.Unlock()
+	_, ok := c.devices.devices[id]
+	return ok
+}
+
+// syncDevices sends the roster to the devices which are due.
+func (c *Client) syncDevices(now time.Time) {
+	for _, id := range c.devices.due(c.router.ActiveSessions(), now) {
+		c.sendRosterSync(id)
+	}
+}
+
+// observeRoster stamps the changes of the roster as written by this
+// device when they are made, unless they are applied from a sync.
+func (c *Client) observeRoster() {
+	current := c.Roster.syncState()
+	c.devices.mutex.Lock()
+	defer c.devices.mutex.Unlock()
+	if c.devices.applying == 0 {
+		c.devices.observe(current, c.id, time.Now())
+	}
+}
+
+// sendRosterSync sends the synced state of the roster to the device.
+// The changes of the roster which have not been observed yet, such as
+// those of Load, are stamped now.
+func (c *Client) sendRosterSync(dst utils.NodeID) error {
+	current := c.Roster.syncState()
+	c.devices.mutex.Lock()
+	c.devices.observe(current, c.id, time.Now())
+	entries := c.devices.snapshot()
+	c.devices.mutex.Unlock()
+
+	t := protocol.Envelope{Type: protocol.MsgRosterSync, ID: c.id.String(), Content: rosterSync{Entries: entries}}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage(dst, data)
+}
+
+// receiveRosterSync merges the roster state of another device, applies
+// the newer entries and answers with the entries which the device lacks.
+// The times of the entries are clamped to MaxClockSkew ahead of now.
+func (c *Client) receiveRosterSync(rm router.Message) {
+	if !c.isDevice(rm.Node) {
+		return
+	}
+	u := struct {
+		Content rosterSync `msgpack:"content"`
+	}{}
+	if msgpack.Unmarshal(rm.Payload, &u) != nil {
+		return
+	}
+
+	now := time.Now()
+	entries := u.Content.Entries.clamp(now.Add(router.MaxClockSkew).UnixNano())
+	current := c.Roster.syncState()
+	c.devices.mutex.Lock()
+	c.devices.observe(current, c.id, now)
+	changed := c.devices.state.merge(entries)
+	reply := c.devices.state.newerThan(entries)
+	c.devices.applying++
+	c.devices.mutex.Unlock()
+
+	// The roster then matches the merged entries,
+	// which are not observed as local changes.
+	for k, e := range changed {
+		c.Roster.applySync(k, e)
+	}
+	c.devices.mutex.Lock()
+	c.devices.applying--
+	c.devices.mutex.Unlock()
+	if len(changed) > 0 {
+		c.mbuf.Push(readPair{M: RosterSyncEvent{Device: rm.Node, Changed: len(changed)}, ID: rm.Node})
+	}
+	if reply {
+		c.sendRosterSync(rm.Node)
+	}
+}
@@ -0,0 +1,122 @@
+package murcott
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestLWWMap(t *testing.T) {
+	a := lwwMap{"x": {Value: []byte("a"), Time: 1, Origin: []byte{1}}}
+	b := lwwMap{
+		"x": {Value: []byte("b"), Time: 1, Origin: []byte{2}},
+		"y": {Time: 2, Deleted: true, Origin: []byte{2}},
+	}
+	c := lwwMap{"y": {Value: []byte("c"), Time: 1, Origin: []byte{3}}}
+
+	ab := make(lwwMap)
+	ab.merge(a)
+	ab.merge(b)
+	ab.merge(c)
+	cba := make(lwwMap)
+	cba.merge(c)
+	cba.merge(b)
+	cba.merge(a)
+	if !reflect.DeepEqual(ab, cba) {
+		t.Errorf("merge() does not converge: %v and %v", ab, cba)
+	}
+	if string(ab["x"].Value) != "b" || !ab["y"].Deleted {
+		t.Errorf("merge() returns %v; expects the tie broken by origin and the removal", ab)
+	}
+	if changed := ab.merge(a); len(changed) != 0 {
+		t.Errorf("merge() returns %v for older entries; expects none", changed)
+	}
+	if !ab.newerThan(a) || a.newerThan(ab) {
+		t.Errorf("newerThan() should detect the missing entries")
+	}
+}
+
+func TestRosterSync(t *testing.T) {
+	dev1 := utils.NewRandomNodeID(utils.GlobalNamespace)
+	dev2 := utils.NewRandomNodeID(utils.GlobalNamespace)
+	contact := utils.NewRandomNodeID(utils.GlobalNamespace)
+	other := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+
+	var r1, r2 Roster
+	var s1, s2 deviceSync
+	r1.Set(contact, UserProfile{Nickname: "contact"})
+	r1.SetAlias(contact, "alias")
+	r1.AddTag(contact, "work")
+	r1.SetFavorite(contact, true)
+	r1.SetSettings(contact, ContactSettings{Muted: true})
+	r2.Set(other, UserProfile{})
+
+	s1.observe(r1.syncState(), dev1, now)
+	s2.observe(r2.syncState(), dev2, now)
+	for k, e := range s2.state.merge(s1.snapshot()) {
+		r2.applySync(k, e)
+	}
+	if !r2.IsFavorite(contact) || r2.Alias(contact) != "alias" || !r2.GetSettings(contact).Muted {
+		t.Errorf("applySync() does not apply the roster of the other device")
+	}
+	if _, ok := r2.profile(other); !ok {
+		t.Errorf("applySync() removes a contact of this device")
+	}
+
+	r2.Remove(contact)
+	s2.observe(r2.syncState(), dev2, now.Add(time.Second))
+	for k, e := range s1.state.merge(s2.snapshot()) {
+		r1.applySync(k, e)
+	}
+	if !reflect.DeepEqual(r1.syncState(), r2.syncState()) {
+		t.Errorf("rosters do not converge: %v and %v", r1.syncState(), r2.syncState())
+	}
+	if _, ok := r1.profile(contact); ok {
+		t.Errorf("applySync() does not apply the removal of a contact")
+	}
+}
+
+func TestRosterSyncTime(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	contact := utils.NewRandomNodeID(utils.GlobalNamespace)
+	dev := utils.NewRandomNodeID(utils.GlobalNamespace)
+	c.AddDevice(dev)
+
+	// The changes are stamped when they are made, not when they are sent.
+	c.Roster.Set(contact, UserProfile{})
+	changed := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	c.sendRosterSync(dev)
+	if e := c.devices.state[syncContact+contact.String()]; e.Time > changed.UnixNano() {
+		t.Errorf("contact is stamped %v after its addition", time.Duration(e.Time-changed.UnixNano()))
+	}
+
+	// The entries of a device whose clock is ahead are clamped,
+	// and are not stamped again when they are applied.
+	other := utils.NewRandomNodeID(utils.GlobalNamespace)
+	future := time.Now().Add(time.Hour).UnixNano()
+	sync := rosterSync{Entries: lwwMap{syncContact + other.String(): {Value: []byte{}, Time: future, Origin: dev.Bytes()}}}
+	data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgRosterSync, ID: dev.String(), Content: sync})
+	c.receiveRosterSync(router.Message{Node: dev, Payload: data})
+	e := c.devices.state[syncContact+other.String()]
+	if e.Time > time.Now().Add(router.MaxClockSkew).UnixNano() {
+		t.Errorf("entry is stamped %v ahead; expects at most %v", time.Duration(e.Time-time.Now().UnixNano()), router.MaxClockSkew)
+	}
+	if !bytes.Equal(e.Origin, dev.Bytes()) {
+		t.Errorf("applied entry is stamped again by this device")
+	}
+	if _, ok := c.Roster.profile(other); !ok {
+		t.Errorf("receiveRosterSync() does not add the contact of the device")
+	}
+}
@@ -0,0 +1,32 @@
+package dht
+
+import (
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// challenge pings a new node. The random ID of the ping works as a
+// challenge: the node is trusted for lookups once it answers, which
+// proves that it receives packets at its address, and is removed from
+// the routing table otherwise.
+func (p *DHT) challenge(id utils.NodeID) {
+	p.challengeMutex.Lock()
+	defer p.challengeMutex.Unlock()
+	if p.challenges[id] {
+		return
+	}
+	p.challenges[id] = true
+
+	go func() {
+		defer func() {
+			p.challengeMutex.Lock()
+			delete(p.challenges, id)
+			p.challengeMutex.Unlock()
+		}()
+		c := p.newRPCCommand(protocol.RPCPing, nil)
+		_, err := p.sendAndWaitPacket(id, c)
+		if err != nil && !p.table.isVerified(id) {
+			p.removeNode(id)
+		}
+	}()
+}
@@ -0,0 +1,186 @@
+package dht
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+var boltValueBucket = []byte("dht")
+
+type boltRecord struct {
+	Value string    `msgpack:"value"`
+	Time  time.Time `msgpack:"time"`
+}
+
+// BoltValueStore is a ValueStore backed by a Bolt database file,
+// which retains stored records across restarts.
+type BoltValueStore struct {
+	path   string
+	maxAge time.Duration
+	db     *bolt.DB
+	mutex  sync.RWMutex
+}
+
+// OpenBoltValueStore opens the store at the given path.
+// A corrupt database file is moved aside to path+".corrupt" and replaced,
+// undecodable records are dropped, and records which have not been stored
+// within maxAge are discarded while the file is compacted.
+// A zero maxAge keeps records forever.
+// Other errors, such as a timeout while another process holds the file lock,
+// are returned without touching the file.
+func OpenBoltValueStore(path string, maxAge time.Duration) (*BoltValueStore, error) {
+	db, err := openBoltValueDB(path)
+	if err != nil {
+		if !boltCorrupt(err) {
+			return nil, err
+		}
+		if _, serr := os.Stat(path); serr != nil {
+			return nil, err
+		}
+		err = os.Rename(path, path+".corrupt")
+		if err != nil {
+			return nil, err
+		}
+		db, err = openBoltValueDB(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &BoltValueStore{path: path, maxAge: maxAge, db: db}
+	err = s.Compact()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// boltCorrupt reports whether err from bolt.Open means the file itself
+// is damaged, as opposed to being locked or inaccessible.
+func boltCorrupt(err error) bool {
+	return err == bolt.ErrInvalid || err == bolt.ErrChecksum || err == bolt.ErrVersionMismatch
+}
+
+func openBoltValueDB(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltValueBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (s *BoltValueStore) Get(key string) (string, bool) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var r boltRecord
+	found := false
+	s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltValueBucket).Get([]byte(key))
+		if v != nil && msgpack.Unmarshal(v, &r) == nil {
+			found = true
+		}
+		return nil
+	})
+	return r.Value, found
+}
+
+func (s *BoltValueStore) Put(key, value string) error {
+	b, err := msgpack.Marshal(boltRecord{Value: value, Time: time.Now()})
+	if err != nil {
+		return err
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValueBucket).Put([]byte(key), b)
+	})
+}
+
+func (s *BoltValueStore) Delete(key string) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValueBucket).Delete([]byte(key))
+	})
+}
+
+func (s *BoltValueStore) Keys() []string {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var keys []string
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltValueBucket).ForEach(func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+	return keys
+}
+
+// Compact rewrites the database file with only the live records,
+// releasing the space of removed and expired ones.
+func (s *BoltValueStore) Compact() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	tmp := s.path + ".compact"
+	os.Remove(tmp)
+	dst, err := openBoltValueDB(tmp)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	err = s.db.View(func(src *bolt.Tx) error {
+		return dst.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(boltValueBucket)
+			return src.Bucket(boltValueBucket).ForEach(func(k, v []byte) error {
+				var r boltRecord
+				if msgpack.Unmarshal(v, &r) != nil {
+					return nil
+				}
+				if s.maxAge > 0 && now.Sub(r.Time) > s.maxAge {
+					return nil
+				}
+				return b.Put(k, v)
+			})
+		})
+	})
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	s.db.Close()
+	err = os.Rename(tmp, s.path)
+	if err != nil {
+		os.Remove(tmp)
+	}
+	db, oerr := openBoltValueDB(s.path)
+	if oerr != nil {
+		return oerr
+	}
+	s.db = db
+	return err
+}
+
+func (s *BoltValueStore) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.db.Close()
+}
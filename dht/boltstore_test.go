@@ -0,0 +1,59 @@
+package dht
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltValueStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dht.db")
+
+	s, err := OpenBoltValueStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Put("key", "value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = OpenBoltValueStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := s.Get("key"); !ok || v != "value" {
+		t.Errorf("Get() returns %q after reopen; expects value", v)
+	}
+	if _, err := OpenBoltValueStore(path, time.Hour); err == nil {
+		t.Errorf("OpenBoltValueStore() should fail while the database is open")
+	}
+	if _, err := os.Stat(path + ".corrupt"); err == nil {
+		t.Errorf("locked database should not be moved aside")
+	}
+	if v, ok := s.Get("key"); !ok || v != "value" {
+		t.Errorf("Get() returns %q after a locked open; expects value", v)
+	}
+	s.Close()
+
+	ioutil.WriteFile(path, []byte("broken"), 0600)
+	s, err = OpenBoltValueStore(path, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, ok := s.Get("key"); ok {
+		t.Errorf("Get() should not find records of a corrupt database")
+	}
+	if _, err := os.Stat(path + ".corrupt"); err != nil {
+		t.Errorf("corrupt database should be moved aside: %v", err)
+	}
+}
@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// bucketRefreshInterval is the interval after which a bucket
+	// which has not been looked up is refreshed.
+	bucketRefreshInterval = time.Hour
+
+	// evictionGrace is the time during which a node which has been heard
+	// from is kept in its full bucket without being pinged again.
+	evictionGrace = time.Minute
+
+	// maxNodeFailures is the number of consecutive unanswered requests
+	// after which a node is removed from the routing table.
+	maxNodeFailures = 2
+
+	// maxRefreshAttempts bounds the random IDs drawn to find one
+	// which falls in a bucket.
+	maxRefreshAttempts = 256
+)
+
+// removeNode removes the node from the routing table, and challenges
+// the replacement which takes its place.
+func (p *DHT) removeNode(id utils.NodeID) {
+	if n, ok := p.table.remove(id); ok {
+		p.challenge(n.ID)
+	}
+}
+
+// nodeFailed counts a request left unanswered by the node, and removes
+// the node once it has failed too many times in a row, if a replacement
+// waits to take its place. The node is kept otherwise, as a bucket which
+// cannot be refilled should not be emptied by a transient loss.
+func (p *DHT) nodeFailed(id utils.NodeID) {
+	if p.table.failed(id) >= maxNodeFailures && p.table.replaceable(id) {
+		p.removeNode(id)
+	}
+}
+
+// evict pings the least recently seen node of the full bucket of a node
+// kept as a replacement, as in Kademlia. The node is removed if it
+// does not answer, and the most recent replacement of the bucket takes its
+// place. Otherwise it moves to the end of the bucket and the bucket is kept.
+func (p *DHT) evict(node utils.NodeInfo) {
+	old, ok := p.table.leastRecent(node.ID)
+	if !ok || time.Since(p.table.lastSeen(old.ID)) < evictionGrace {
+		return
+	}
+
+	p.challengeMutex.Lock()
+	defer p.challengeMutex.Unlock()
+	if p.evictions[old.ID] {
+		return
+	}
+	p.evictions[old.ID] = true
+
+	go func() {
+		defer func() {
+			p.challengeMutex.Lock()
+			delete(p.evictions, old.ID)
+			p.challengeMutex.Unlock()
+		}()
+		c := p.newRPCCommand(protocol.RPCPing, nil)
+		_, err := p.sendAndWaitPacket(old.ID, c)
+		if err != nil {
+			p.removeNode(old.ID)
+		}
+	}()
+}
+
+// RefreshBuckets looks up a random ID in each bucket which has not been
+// looked up for bucketRefreshInterval, from the nearest bucket holding a
+// node, so that the buckets keep live nodes as the network changes.
+// It returns the number of buckets refreshed.
+func (p *DHT) RefreshBuckets(now time.Time) int {
+	n := 0
+	for _, b := range p.table.staleBuckets(now.Add(-bucketRefreshInterval)) {
+		id, ok := p.randomIDInBucket(b)
+		if !ok {
+			continue
+		}
+		p.FindNearestNode(id)
+		n++
+	}
+	return n
+}
+
+func (p *DHT) randomIDInBucket(b int) (utils.NodeID, bool) {
+	for i := 0; i < maxRefreshAttempts; i++ {
+		var d utils.PublicKeyDigest
+		if _, err := rand.Read(d[:]); err != nil {
+			break
+		}
+		id := utils.NewNodeID(p.id.NS, d)
+		if id.Digest.Xor(p.id.Digest).Log2int() == b {
+			return id, true
+		}
+	}
+	return utils.NodeID{}, false
+}
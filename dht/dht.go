@@ -12,10 +12,20 @@ import (
 	"time"
 
 	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
 	"github.com/h2so5/murcott/utils"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
+// maxSetSize is the maximum number of values held in a set.
+const maxSetSize = 256
+
+// DefaultMaxPendingRPCs is the default maximum number of requests
+// which wait for a response at the same time.
+const DefaultMaxPendingRPCs = 1024
+
+var errTooManyRPCs = errors.New("too many pending requests")
+
 type dhtRPCCallback func(*dhtRPCCommand, *net.UDPAddr)
 
 type dhtRPCReturn struct {
@@ -30,23 +40,36 @@ type DHT struct {
 	groupTable nodeTable
 	k          int
 
-	kvs      map[string]string
+	kvs      ValueStore
+	meta     map[string]valueMeta
 	kvsMutex sync.RWMutex
 
-	chmap      map[string]chan<- dhtRPCReturn
-	chmapMutex sync.Mutex
+	origins     map[string]origin
+	originMutex sync.Mutex
+
+	chmap       map[string]chan<- dhtRPCReturn
+	maxPending  int
+	retry       utils.RetryPolicy
+	alpha       int
+	replication int
+	chmapMutex  sync.Mutex
+
+	pool  lookupPool
+	rpcs  rpcStats
+	guard *Guard
+
+	challenges     map[utils.NodeID]bool
+	evictions      map[utils.NodeID]bool
+	challengeMutex sync.Mutex
+
+	filter      func(utils.NodeID) bool
+	filterMutex sync.RWMutex
 
 	conn   net.PacketConn
 	logger *log.Logger
 }
 
-type dhtRPCCommand struct {
-	Src    utils.NodeID           `msgpack:"src"`
-	Net    utils.NodeID           `msgpack:"net"`
-	ID     []byte                 `msgpack:"id"`
-	Method string                 `msgpack:"method"`
-	Args   map[string]interface{} `msgpack:"args"`
-}
+type dhtRPCCommand protocol.RPCCommand
 
 func (p *dhtRPCCommand) getArgs(k string, v ...interface{}) {
 	b, err := msgpack.Marshal(p.Args[k])
@@ -62,22 +85,40 @@ func NewDHT(k int, id, net utils.NodeID, conn net.PacketConn, logger *log.Logger
 		table:      newNodeTable(k, id),
 		groupTable: newNodeTable(k, id),
 		k:          k,
-		kvs:        make(map[string]string),
+		kvs:        make(memoryValueStore),
+		meta:       make(map[string]valueMeta),
+		origins:    make(map[string]origin),
 		chmap:      make(map[string]chan<- dhtRPCReturn),
+		maxPending: DefaultMaxPendingRPCs,
+		retry:      utils.DefaultRetryConfig.RPC,
+		alpha:      DefaultLookupAlpha,
+		guard:      NewGuard(0, 0),
+		challenges: make(map[utils.NodeID]bool),
+		evictions:  make(map[utils.NodeID]bool),
 		conn:       conn,
 		logger:     logger,
 	}
+	d.table.ipLimit = maxNodesPerIP
+	d.table.subnetLimit = maxNodesPerSubnet
+	d.replication = DefaultReplication
 	return &d
 }
 
 func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
-	var c dhtRPCCommand
+	var c protocol.RPCCommand
 	err := msgpack.Unmarshal(b, &c)
 	if err != nil {
 		p.logger.Error("%v", err)
+		p.Malformed(addr)
 		return
 	}
+	p.ProcessCommand(c, addr)
+}
 
+// ProcessCommand handles a decoded command, so that a packet shared by
+// several DHTs is only decoded once. Commands of other groups are ignored.
+func (p *DHT) ProcessCommand(cmd protocol.RPCCommand, addr net.Addr) {
+	c := dhtRPCCommand(cmd)
 	ns := utils.GlobalNamespace
 	if !bytes.Equal(p.net.NS[:], ns[:]) && p.net.Digest.Cmp(c.Net.Digest) != 0 {
 		return
@@ -87,20 +128,31 @@ func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
 		return
 	}
 
-	p.table.insert(utils.NodeInfo{ID: c.Src, Addr: addr})
+	if !p.guard.Allow(addr, c.Method != "", time.Now()) {
+		p.rpcs.limit()
+		return
+	}
+	p.rpcs.request(c.Method, false)
+
+	known := p.table.find(c.Src) != nil
+	if p.insertNode(utils.NodeInfo{ID: c.Src, Addr: addr}) && !known {
+		go p.handoff(utils.NodeInfo{ID: c.Src, Addr: addr})
+	}
+	p.table.setAcks(c.Src, c.Version >= protocol.RPCVersion)
 
 	switch c.Method {
-	case "ping":
+	case protocol.RPCPing:
 		p.logger.Info("%s: Receive DHT Ping from %s %v", p.id.String(), c.Src.String(), addr)
 		p.sendPacket(c.Src, p.newRPCReturnCommand(c.ID, nil))
 
-	case "find-node":
+	case protocol.RPCFindNode:
 		p.logger.Info("%s: Receive DHT Find-Node from %s", p.net.String(), c.Src.String())
 		if id, ok := c.Args["id"].(string); ok {
 			args := map[string]interface{}{}
 			nid, err := utils.NewNodeIDFromBytes([]byte(id))
 			if err != nil {
 				p.logger.Error("find-node: %v", err)
+				p.Malformed(addr)
 			} else {
 				nodes := append(p.table.nearestNodes(nid), p.groupTable.nearestNodes(nid)...)
 				args["nodes"] = nodes
@@ -108,33 +160,45 @@ func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
 			}
 		}
 
-	case "store":
+	case protocol.RPCStore:
 		p.logger.Info("%s: Receive DHT Store from %s", p.id.String(), c.Src.String())
 		if key, ok := c.Args["key"].(string); ok {
 			if val, ok := c.Args["value"].(string); ok {
-				p.kvsMutex.Lock()
-				p.kvs[key] = val
-				p.kvsMutex.Unlock()
+				if age, ok := valueAge(&c); ok && p.acceptStore(key, c.Method, val) {
+					p.putValue(key, val)
+					p.touch(key, c.Method, age)
+					p.ackStore(&c)
+					break
+				}
 			}
 		}
+		p.rejectStore(&c)
 
-	case "store-node":
+	case protocol.RPCStoreNode:
 		p.logger.Info("%s: Receive DHT Store-node from %s", p.id.String(), c.Src.String())
 		if key, ok := c.Args["key"].(string); ok {
 			if val, ok := c.Args["value"].(string); ok {
+				age, ok := valueAge(&c)
+				if !ok || !p.acceptStore(key, c.Method, val) {
+					p.rejectStore(&c)
+					break
+				}
 
 				var nodes []utils.NodeInfo
 				t := newNodeTable(p.k, p.id)
 
-				p.kvsMutex.RLock()
-				msgpack.Unmarshal([]byte(p.kvs[key]), &nodes)
-				p.kvsMutex.RUnlock()
+				if val, ok := p.getValue(key); ok {
+					msgpack.Unmarshal([]byte(val), &nodes)
+				}
 				for _, n := range nodes {
 					t.insert(n)
 				}
 
 				msgpack.Unmarshal([]byte(val), &nodes)
 				for _, n := range nodes {
+					if n.Addr == nil {
+						continue
+					}
 				    host, port, _ := net.SplitHostPort(n.Addr.String())
 				    if !net.ParseIP(host).IsGlobalUnicast() {
 				       host, _, _ := net.SplitHostPort(addr.String())
@@ -146,26 +210,68 @@ func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
 
 				b, err := msgpack.Marshal(t.nodes())
 				if err == nil {
-					p.kvsMutex.Lock()
-					p.kvs[key] = string(b)
-					p.kvsMutex.Unlock()
+					p.putValue(key, string(b))
+					p.touch(key, c.Method, age)
+					p.ackStore(&c)
+					break
+				}
+			}
+		}
+		p.rejectStore(&c)
+
+	case protocol.RPCStoreSet:
+		p.logger.Info("%s: Receive DHT Store-set from %s", p.id.String(), c.Src.String())
+		if key, ok := c.Args["key"].(string); ok {
+			if val, ok := c.Args["value"].(string); ok {
+				if age, ok := valueAge(&c); ok && p.acceptStore(key, c.Method, val) {
+					var values []string
+					msgpack.Unmarshal([]byte(val), &values)
+					p.mergeSet(key, values)
+					p.touch(key, c.Method, age)
+					p.ackStore(&c)
+					break
 				}
 			}
 		}
+		p.rejectStore(&c)
 
-	case "find-value":
+	case protocol.RPCStoreMulti:
+		p.logger.Info("%s: Receive DHT Store-multi from %s", p.id.String(), c.Src.String())
+		if key, ok := c.Args["key"].(string); ok {
+			if val, ok := c.Args["value"].(string); ok {
+				if age, ok := valueAge(&c); ok && p.acceptStore(key, c.Method, val) {
+					p.mergeMulti(key, storedMultiValues(&c, val, time.Now()))
+					p.touch(key, c.Method, age)
+					p.ackStore(&c)
+					break
+				}
+			}
+		}
+		p.rejectStore(&c)
+
+	case protocol.RPCFindValues:
+		p.logger.Info("%s: Receive DHT Find-Values from %s", p.id.String(), c.Src.String())
+		if key, ok := c.Args["key"].(string); ok {
+			args := map[string]interface{}{}
+			if val, ok := p.sendableValue(key, protocol.RPCStoreMulti); ok {
+				args["values"] = val
+			}
+			hash := sha1.Sum([]byte(key))
+			args["nodes"] = p.table.nearestNodes(utils.NewNodeID(c.Src.NS, hash))
+			p.sendPacket(c.Src, p.newRPCReturnCommand(c.ID, args))
+		}
+
+	case protocol.RPCFindValue:
 		p.logger.Info("%s: Receive DHT Find-Value from %s", p.id.String(), c.Src.String())
 		if key, ok := c.Args["key"].(string); ok {
 			args := map[string]interface{}{}
-			p.kvsMutex.RLock()
-			if val, ok := p.kvs[key]; ok {
+			if val, ok := p.getValue(key); ok {
 				args["value"] = val
 			} else {
 				hash := sha1.Sum([]byte(key))
 				n := p.table.nearestNodes(utils.NewNodeID(c.Src.NS, hash))
 				args["nodes"] = n
 			}
-			p.kvsMutex.RUnlock()
 			p.sendPacket(c.Src, p.newRPCReturnCommand(c.ID, args))
 		}
 
@@ -175,32 +281,27 @@ func (p *DHT) ProcessPacket(b []byte, addr net.Addr) {
 		defer p.chmapMutex.Unlock()
 		if ch, ok := p.chmap[id]; ok {
 			delete(p.chmap, id)
+			p.table.verify(c.Src)
 			ch <- dhtRPCReturn{command: c, addr: addr}
 		}
 	}
+
+	if p.table.find(c.Src) != nil && !p.table.isVerified(c.Src) {
+		p.challenge(c.Src)
+	}
 }
 
 func (p *DHT) FindNearestNode(findid utils.NodeID) []utils.NodeInfo {
-	reqch := make(chan utils.NodeInfo, 100)
-	endch := make(chan struct{}, 100)
-
-	f := func(id utils.NodeID, command dhtRPCCommand) {
-		defer func() { endch <- struct{}{} }()
-		ret, err := p.sendAndWaitPacket(id, command)
-		if err == nil {
-			if _, ok := ret.command.Args["nodes"]; ok {
-				var nodes []utils.NodeInfo
-				ret.command.getArgs("nodes", &nodes)
-				for _, n := range nodes {
-					if n.ID.Digest.Cmp(p.id.Digest) != 0 {
-						p.table.insert(n)
-						reqch <- n
-					}
-				}
-			}
-		}
+	nodes := p.lookupNodes(findid)
+	if len(nodes) > p.k {
+		return nodes[:p.k]
 	}
+	return nodes
+}
 
+// lookupNodes returns all the verified nodes met by a lookup of the ID,
+// from the nearest.
+func (p *DHT) lookupNodes(findid utils.NodeID) []utils.NodeInfo {
 	var res []utils.NodeInfo
 	nodes := p.table.nearestNodes(findid)
 
@@ -208,165 +309,217 @@ func (p *DHT) FindNearestNode(findid utils.NodeID) []utils.NodeInfo {
 		return res
 	}
 
-	for _, n := range nodes {
-		reqch <- n
+	done := make(chan struct{})
+	defer close(done)
+	args := map[string]interface{}{
+		"id": string(findid.Bytes()),
 	}
 
-	count := 0
+	q := p.newLookupQueue(findid)
 	requested := make(map[utils.NodeID]utils.NodeInfo)
-
-loop:
-	for {
-		select {
-		case node := <-reqch:
-			if _, ok := requested[node.ID]; !ok {
-				requested[node.ID] = node
-				c := p.newRPCCommand("find-node", map[string]interface{}{
-					"id": string(findid.Bytes()),
-				})
-				go f(node.ID, c)
-				count++
-			}
-		case <-endch:
-			count--
-			if count == 0 {
-				break loop
+	for _, n := range nodes {
+		q.add(n.ID)
+		requested[n.ID] = n
+	}
+	p.request(q, protocol.RPCFindNode, args, done)
+
+	for !q.finished() {
+		r := <-q.replies
+		q.done()
+		if r.err == nil {
+			var nodes []utils.NodeInfo
+			r.ret.command.getArgs("nodes", &nodes)
+			for _, n := range nodes {
+				if n.ID.Digest.Cmp(p.id.Digest) != 0 && p.insertNode(n) && q.add(n.ID) {
+					requested[n.ID] = n
+				}
 			}
 		}
+		p.request(q, protocol.RPCFindNode, args, done)
 	}
 
 	for _, v := range requested {
-		res = append(res, v)
+		if p.table.isVerified(v.ID) {
+			res = append(res, v)
+		}
 	}
 
 	sorter := utils.NodeInfoSorter{Nodes: res, ID: findid}
 	sort.Sort(sorter)
-
-	if len(sorter.Nodes) > p.k {
-		return sorter.Nodes[:p.k]
-	}
 	return sorter.Nodes
 }
 
 func (p *DHT) LoadValue(key string) *string {
-	p.kvsMutex.RLock()
-	if v, ok := p.kvs[key]; ok {
-		p.kvsMutex.RUnlock()
+	if v, ok := p.getValue(key); ok {
 		return &v
 	}
-	p.kvsMutex.RUnlock()
 
 	hash := sha1.Sum([]byte(key))
 	keyid := utils.NewNodeID(p.id.NS, hash)
 
-	retch := make(chan *string, 2)
-	reqch := make(chan utils.NodeID, 100)
-	endch := make(chan struct{}, 100)
-
 	nodes := p.table.nearestNodes(keyid)
 
-	f := func(id utils.NodeID, keyid utils.NodeID, command dhtRPCCommand) {
-		ret, err := p.sendAndWaitPacket(id, command)
-		if err == nil {
-			if val, ok := ret.command.Args["value"].(string); ok {
-				retch <- &val
-			} else if _, ok := ret.command.Args["nodes"]; ok {
-				var nodes []utils.NodeInfo
-				ret.command.getArgs("nodes", &nodes)
-				dist := id.Digest.Xor(keyid.Digest)
-				for _, n := range nodes {
-					p.table.insert(n)
-					if dist.Cmp(n.ID.Digest.Xor(keyid.Digest)) == 1 {
-						reqch <- n.ID
-					}
-				}
-			}
-		}
-		endch <- struct{}{}
-	}
-
 	if len(nodes) == 0 {
 		return nil
 	}
 
+	done := make(chan struct{})
+	defer close(done)
+	args := map[string]interface{}{
+		"key": key,
+	}
+
+	q := p.newLookupQueue(keyid)
 	for _, n := range nodes {
-		reqch <- n.ID
-	}
-
-	count := 0
-	requested := make(map[utils.NodeID]struct{})
-
-	for {
-		select {
-		case id := <-reqch:
-			if _, ok := requested[id]; !ok {
-				requested[id] = struct{}{}
-				c := p.newRPCCommand("find-value", map[string]interface{}{
-					"key": key,
-				})
-				go f(id, keyid, c)
-				count++
+		q.add(n.ID)
+	}
+	p.request(q, protocol.RPCFindValue, args, done)
+
+	for !q.finished() {
+		r := <-q.replies
+		q.done()
+		if r.err == nil {
+			if val, ok := r.ret.command.Args["value"].(string); ok && validValue(key, val) {
+				return &val
 			}
-		case <-endch:
-			count--
-			if count == 0 {
-				select {
-				case data := <-retch:
-					return data
-				default:
-					return nil
+			var nodes []utils.NodeInfo
+			r.ret.command.getArgs("nodes", &nodes)
+			dist := r.id.Digest.Xor(keyid.Digest)
+			for _, n := range nodes {
+				if p.insertNode(n) && dist.Cmp(n.ID.Digest.Xor(keyid.Digest)) == 1 {
+					q.add(n.ID)
 				}
 			}
-		case data := <-retch:
-			return data
-		default:
 		}
+		p.request(q, protocol.RPCFindValue, args, done)
 	}
+	return nil
 }
 
+// StoreValue stores the value at the key on the nodes nearest to it.
+// The value is stored again until Unpublish is called, and expires
+// after ValueTTL otherwise.
 func (p *DHT) StoreValue(key string, value string) {
-	hash := sha1.Sum([]byte(key))
-	c := p.newRPCCommand("store", map[string]interface{}{
-		"key":   key,
-		"value": value,
-	})
-	for _, n := range p.FindNearestNode(utils.NewNodeID(p.id.NS, hash)) {
-		p.sendPacket(n.ID, c)
-	}
+	p.originate(key, protocol.RPCStore, value)
+	p.store(key, protocol.RPCStore, value)
 }
 
 func (p *DHT) StoreNodes(key string, nodes []utils.NodeInfo) {
-	hash := sha1.Sum([]byte(key))
 	b, err := msgpack.Marshal(nodes)
 	if err != nil {
 		return
 	}
-	c := p.newRPCCommand("store-node", map[string]interface{}{
-		"key":   key,
-		"value": string(b),
-	})
+	p.originate(key, protocol.RPCStoreNode, string(b))
+	p.store(key, protocol.RPCStoreNode, string(b))
+}
+
+// StoreSet adds the given values to the set stored at the key.
+// Unlike StoreValue, the values stored by other nodes are kept.
+func (p *DHT) StoreSet(key string, values []string) {
+	b, err := msgpack.Marshal(values)
+	if err != nil {
+		return
+	}
+	p.originate(key, protocol.RPCStoreSet, string(b))
+	p.store(key, protocol.RPCStoreSet, string(b))
+}
+
+func (p *DHT) LoadSet(key string) []string {
+	str := p.LoadValue(key)
+	if str == nil {
+		return nil
+	}
+	var ret []string
+	msgpack.Unmarshal([]byte(*str), &ret)
+	return ret
+}
+
+// mergeSet adds values to the local set at the key. The oldest values
+// are dropped when the set grows beyond maxSetSize.
+func (p *DHT) mergeSet(key string, values []string) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+
+	var set []string
+	if val, ok := p.kvs.Get(key); ok {
+		msgpack.Unmarshal([]byte(val), &set)
+	}
 
-	for _, n := range p.FindNearestNode(utils.NewNodeID(p.id.NS, hash)) {
-		p.sendPacket(n.ID, c)
+	b, err := msgpack.Marshal(mergeValues(set, values))
+	if err != nil {
+		return
+	}
+	err = p.kvs.Put(key, string(b))
+	if err != nil {
+		p.logger.Error("store: %v", err)
 	}
+}
 
+// mergeValues adds values to a set, keeping at most maxSetSize
+// of the newest ones.
+func mergeValues(set, values []string) []string {
+	for _, v := range values {
+		for i, s := range set {
+			if s == v {
+				set = append(set[:i], set[i+1:]...)
+				break
+			}
+		}
+		set = append(set, v)
+	}
+	if len(set) > maxSetSize {
+		set = set[len(set)-maxSetSize:]
+	}
+	return set
+}
+
+// mergeNodes adds nodes to the local list at the key, keeping those
+// which fit in a node table.
+func (p *DHT) mergeNodes(key string, nodes []utils.NodeInfo) {
 	t := newNodeTable(p.k, p.id)
 	for _, n := range nodes {
 		t.insert(n)
 	}
 
-	p.kvsMutex.RLock()
-	msgpack.Unmarshal([]byte(p.kvs[key]), &nodes)
-	p.kvsMutex.RUnlock()
+	if val, ok := p.getValue(key); ok {
+		msgpack.Unmarshal([]byte(val), &nodes)
+	}
 	for _, n := range nodes {
 		t.insert(n)
 	}
 
-	b, err = msgpack.Marshal(t.nodes())
+	b, err := msgpack.Marshal(t.nodes())
 	if err == nil {
-		p.kvsMutex.Lock()
-		p.kvs[key] = string(b)
-		p.kvsMutex.Unlock()
+		p.putValue(key, string(b))
+	}
+}
+
+// SetValueStore replaces the storage of the records held by this node.
+// The store is closed with the DHT.
+func (p *DHT) SetValueStore(s ValueStore) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+	p.kvs.Close()
+	p.kvs = s
+	p.meta = make(map[string]valueMeta)
+}
+
+// getValue returns the value held at the key unless it has expired.
+func (p *DHT) getValue(key string) (string, bool) {
+	p.kvsMutex.RLock()
+	defer p.kvsMutex.RUnlock()
+	if m, ok := p.meta[key]; ok && time.Since(m.published) >= ValueTTL {
+		return "", false
+	}
+	return p.kvs.Get(key)
+}
+
+func (p *DHT) putValue(key, value string) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+	err := p.kvs.Put(key, value)
+	if err != nil {
+		p.logger.Error("store: %v", err)
 	}
 }
 
@@ -397,10 +550,41 @@ func (p *DHT) AddNode(node utils.NodeInfo) {
 	if p.id.Digest.Cmp(node.ID.Digest) == 0 {
 		return
 	}
-	p.table.insert(node)
+	if p.insertNode(node) {
+		p.table.verify(node.ID)
+	}
 	p.DiscoverNode(node)
 }
 
+// RemoveNode removes the node from the routing table.
+func (p *DHT) RemoveNode(id utils.NodeID) {
+	p.removeNode(id)
+}
+
+// SetNodeFilter sets a function which decides whether a node may be
+// added to the routing table.
+func (p *DHT) SetNodeFilter(f func(utils.NodeID) bool) {
+	p.filterMutex.Lock()
+	defer p.filterMutex.Unlock()
+	p.filter = f
+}
+
+func (p *DHT) insertNode(node utils.NodeInfo) bool {
+	p.filterMutex.RLock()
+	f := p.filter
+	p.filterMutex.RUnlock()
+	if f != nil && !f(node.ID) {
+		return false
+	}
+	if !p.table.insert(node) {
+		return false
+	}
+	if p.table.isReplacement(node.ID) {
+		p.evict(node)
+	}
+	return true
+}
+
 func (p *DHT) KnownNodes() []utils.NodeInfo {
 	return p.table.nodes()
 }
@@ -409,6 +593,17 @@ func (p *DHT) FingerNodes() []utils.NodeInfo {
 	return p.table.fingerNodes()
 }
 
+// Representatives returns up to n verified nodes spread over the routing
+// table, such as the peers to which keepalives are sent.
+func (p *DHT) Representatives(n int) []utils.NodeInfo {
+	return p.table.representatives(n)
+}
+
+// SendPing sends a ping to a known node without waiting for the answer.
+func (p *DHT) SendPing(id utils.NodeID) error {
+	return p.sendPing(id)
+}
+
 func (p *DHT) GetNodeInfo(id utils.NodeID) *utils.NodeInfo {
 	return p.table.find(id)
 }
@@ -420,21 +615,23 @@ func (p *DHT) newRPCCommand(method string, args map[string]interface{}) dhtRPCCo
 		panic(err)
 	}
 	return dhtRPCCommand{
-		Src:    p.id,
-		Net:    p.net,
-		ID:     id,
-		Method: method,
-		Args:   args,
+		Src:     p.id,
+		Net:     p.net,
+		ID:      id,
+		Method:  method,
+		Args:    args,
+		Version: protocol.RPCVersion,
 	}
 }
 
 func (p *DHT) newRPCReturnCommand(id []byte, args map[string]interface{}) dhtRPCCommand {
 	return dhtRPCCommand{
-		Src:    p.id,
-		Net:    p.net,
-		ID:     id,
-		Method: "",
-		Args:   args,
+		Src:     p.id,
+		Net:     p.net,
+		ID:      id,
+		Method:  "",
+		Args:    args,
+		Version: protocol.RPCVersion,
 	}
 }
 
@@ -446,7 +643,7 @@ func (p *DHT) Discover(addr net.Addr) error {
 	if bytes.Equal(udp.IP, net.IPv6zero) {
 		udp.IP = net.IPv6loopback
 	}
-	c := p.newRPCCommand("ping", nil)
+	c := p.newRPCCommand(protocol.RPCPing, nil)
 	b, err := msgpack.Marshal(c)
 	if err != nil {
 		return err
@@ -459,8 +656,52 @@ func (p *DHT) Discover(addr net.Addr) error {
 	return nil
 }
 
+// Ping sends a ping to the given address and returns the round-trip time.
+// A node which responds is added to the routing table.
+func (p *DHT) Ping(addr net.Addr, timeout time.Duration) (time.Duration, error) {
+	udp, err := net.ResolveUDPAddr(addr.Network(), addr.String())
+	if err != nil {
+		return 0, err
+	}
+	if bytes.Equal(udp.IP, net.IPv6zero) {
+		udp.IP = net.IPv6loopback
+	}
+	c := p.newRPCCommand(protocol.RPCPing, nil)
+	b, err := msgpack.Marshal(c)
+	if err != nil {
+		return 0, err
+	}
+
+	ch := make(chan dhtRPCReturn, 1)
+	err = p.addPending(c.ID, ch)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		p.chmapMutex.Lock()
+		delete(p.chmap, string(c.ID))
+		p.chmapMutex.Unlock()
+	}()
+
+	start := time.Now()
+	_, err = p.conn.WriteTo(b, udp)
+	if err != nil {
+		return 0, err
+	}
+
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	select {
+	case <-ch:
+		return time.Since(start), nil
+	case <-t.C:
+		return 0, errors.New("timeout")
+	}
+}
+
 func (p *DHT) sendPing(dst utils.NodeID) error {
-	c := p.newRPCCommand("ping", nil)
+	c := p.newRPCCommand(protocol.RPCPing, nil)
 	return p.sendPacket(dst, c)
 }
 
@@ -469,6 +710,7 @@ func (p *DHT) sendPacket(dst utils.NodeID, c dhtRPCCommand) error {
 	if i == nil || i.Addr == nil {
 		return errors.New("route not found")
 	}
+	c.Dst = dst.Bytes()
 	b, err := msgpack.Marshal(c)
 	if err != nil {
 		return err
@@ -477,15 +719,26 @@ func (p *DHT) sendPacket(dst utils.NodeID, c dhtRPCCommand) error {
 	if err != nil {
 		return err
 	}
+	p.rpcs.request(c.Method, true)
 	return nil
 }
 
 func (p *DHT) sendAndWaitPacket(dst utils.NodeID, c dhtRPCCommand) (dhtRPCReturn, error) {
-	ch := make(chan dhtRPCReturn, 2)
-
 	p.chmapMutex.Lock()
-	p.chmap[string(c.ID)] = ch
+	policy := p.retry
 	p.chmapMutex.Unlock()
+	return p.sendAndWait(dst, c, policy)
+}
+
+// sendAndWait sends a request and waits for its response,
+// attempting it according to the policy.
+func (p *DHT) sendAndWait(dst utils.NodeID, c dhtRPCCommand, policy utils.RetryPolicy) (dhtRPCReturn, error) {
+	ch := make(chan dhtRPCReturn, 2)
+
+	err := p.addPending(c.ID, ch)
+	if err != nil {
+		return dhtRPCReturn{}, err
+	}
 
 	defer func() {
 		p.chmapMutex.Lock()
@@ -493,19 +746,114 @@ func (p *DHT) sendAndWaitPacket(dst utils.NodeID, c dhtRPCCommand) (dhtRPCReturn
 		p.chmapMutex.Unlock()
 	}()
 
-	p.sendPacket(dst, c)
+	for n := 1; ; n++ {
+		sent := time.Now()
+		p.sendPacket(dst, c)
+		r, ok := waitReturn(ch, policy.Timeout)
+		if ok {
+			p.rpcs.answered(time.Since(sent))
+			return r, nil
+		}
+		if policy.Exhausted(n) {
+			p.rpcs.timedOut()
+			// Older nodes never answer the stores,
+			// which must not evict them.
+			if !isStore(c.Method) {
+				p.nodeFailed(dst)
+			}
+			return dhtRPCReturn{}, errors.New("timeout")
+		}
+		r, ok = waitReturn(ch, policy.Delay(n))
+		if ok {
+			p.rpcs.answered(time.Since(sent))
+			return r, nil
+		}
+	}
+}
 
-	t := time.NewTimer(time.Second)
+func waitReturn(ch <-chan dhtRPCReturn, d time.Duration) (dhtRPCReturn, bool) {
+	t := time.NewTimer(d)
 	defer t.Stop()
 
 	select {
 	case r := <-ch:
-		return r, nil
+		return r, true
 	case <-t.C:
-		return dhtRPCReturn{}, errors.New("timeout")
+		return dhtRPCReturn{}, false
+	}
+}
+
+// addPending registers the channel of a request which waits for a response.
+// It fails if the limit of pending requests has been reached.
+func (p *DHT) addPending(id []byte, ch chan<- dhtRPCReturn) error {
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	if len(p.chmap) >= p.maxPending {
+		return errTooManyRPCs
+	}
+	p.chmap[string(id)] = ch
+	return nil
+}
+
+// SetMaxPendingRPCs sets the maximum number of requests
+// which wait for a response at the same time.
+func (p *DHT) SetMaxPendingRPCs(n int) {
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	p.maxPending = n
+}
+
+// SetRetryPolicy sets the timeout of the requests and the delays
+// between their attempts.
+func (p *DHT) SetRetryPolicy(policy utils.RetryPolicy) {
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	p.retry = policy
+}
+
+// SetLookupAlpha sets the number of requests of a lookup
+// which are in flight at the same time. Zero uses DefaultLookupAlpha.
+func (p *DHT) SetLookupAlpha(n int) {
+	if n <= 0 {
+		n = DefaultLookupAlpha
 	}
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	p.alpha = n
+}
+
+// lookupPolicy returns the retry policy of the requests of the lookups,
+// whose attempts are bounded.
+func (p *DHT) lookupPolicy() utils.RetryPolicy {
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	policy := p.retry
+	if policy.Attempts <= 0 {
+		policy.Attempts = maxLookupAttempts
+	}
+	return policy
+}
+
+func (p *DHT) newLookupQueue(target utils.NodeID) *lookupQueue {
+	p.table.looked(target, time.Now())
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	return newLookupQueue(target, p.alpha)
+}
+
+// PendingRPCs returns the number of requests which wait for a response.
+func (p *DHT) PendingRPCs() int {
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	return len(p.chmap)
 }
 
 func (p *DHT) Close() error {
+	for _, t := range p.pool.close() {
+		t.reply(dhtRPCReturn{}, errLookupClosed)
+	}
+	p.kvsMutex.Lock()
+	p.kvs.Close()
+	p.kvsMutex.Unlock()
 	return p.conn.Close()
 }
@@ -156,3 +156,25 @@ func TestDhtGroup(t *testing.T) {
 		}
 	}
 }
+
+func TestDhtPendingRPCLimit(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := utils.NewRandomNodeID(namespace)
+	d := NewDHT(10, id, id, conn, log.NewLogger())
+	defer d.Close()
+
+	d.SetMaxPendingRPCs(1)
+	ch := make(chan dhtRPCReturn, 1)
+	if err := d.addPending([]byte("1"), ch); err != nil {
+		t.Errorf("addPending() returns %v; expects nil", err)
+	}
+	if err := d.addPending([]byte("2"), ch); err != errTooManyRPCs {
+		t.Errorf("addPending() returns %v; expects %v", err, errTooManyRPCs)
+	}
+	if n := d.PendingRPCs(); n != 1 {
+		t.Errorf("PendingRPCs() returns %d; expects 1", n)
+	}
+}
@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func FuzzProcessPacket(f *testing.F) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		f.Fatal(err)
+	}
+	id := utils.NewRandomNodeID(namespace)
+	d := NewDHT(10, id, id, conn, log.NewLogger())
+	defer d.Close()
+
+	src := utils.NewRandomNodeID(namespace)
+	nodes, _ := msgpack.Marshal([]utils.NodeInfo{utils.NodeInfo{ID: src, Addr: conn.LocalAddr()}})
+	set, _ := msgpack.Marshal([]string{"a", "b"})
+	multi, _ := msgpack.Marshal([]multiValueArg{{Value: "a", Publisher: src, TTL: 60}})
+	for _, c := range []protocol.RPCCommand{
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("1"), Method: protocol.RPCPing},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("2"), Method: protocol.RPCFindNode,
+			Args: map[string]interface{}{"id": string(id.Bytes())}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("3"), Method: protocol.RPCFindValue,
+			Args: map[string]interface{}{"key": "foo"}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("4"), Method: protocol.RPCStore,
+			Args: map[string]interface{}{"key": "foo", "value": "bar"}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("5"), Method: protocol.RPCStoreNode,
+			Args: map[string]interface{}{"key": "node", "value": string(nodes)}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("6"), Method: protocol.RPCStoreSet,
+			Args: map[string]interface{}{"key": "set", "value": string(set)}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("7"), Method: protocol.RPCStoreMulti,
+			Args: map[string]interface{}{"key": "multi", "value": string(multi)}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("8"), Method: protocol.RPCFindValues,
+			Args: map[string]interface{}{"key": "multi"}},
+		protocol.RPCCommand{Src: src, Net: id, ID: []byte("9"),
+			Args: map[string]interface{}{"nodes": nodes}},
+	} {
+		b, err := msgpack.Marshal(c)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	addr := conn.LocalAddr()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		d.ProcessPacket(data, addr)
+	})
+}
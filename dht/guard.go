@@ -0,0 +1,270 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPeerRate is the default number of requests per second which
+	// a DHT handles from each peer, and DefaultPeerBurst the number of
+	// requests which can exceed the rate at once.
+	DefaultPeerRate  = 50.0
+	DefaultPeerBurst = 100
+
+	// MalformedLimit is the number of malformed packets within
+	// malformedWindow after which the IP address of their sender is
+	// banned for AutoBanDuration.
+	MalformedLimit  = 10
+	malformedWindow = time.Minute
+	AutoBanDuration = time.Hour
+
+	// peerIdle is the time after which the state of a silent peer
+	// is forgotten.
+	peerIdle = time.Minute
+)
+
+// Ban is an IP address whose packets are ignored.
+type Ban struct {
+	IP     net.IP
+	Reason string
+
+	// Until is the time the ban is lifted, or zero for a ban
+	// which lasts until Unban.
+	Until time.Time
+}
+
+func (b Ban) expired(now time.Time) bool {
+	return !b.Until.IsZero() && !now.Before(b.Until)
+}
+
+type byUntil []Ban
+
+func (b byUntil) Len() int      { return len(b) }
+func (b byUntil) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byUntil) Less(i, j int) bool {
+	if b[i].Until.IsZero() || b[j].Until.IsZero() {
+		return b[i].Until.IsZero() && !b[j].Until.IsZero()
+	}
+	return b[i].Until.Before(b[j].Until)
+}
+
+// peerState holds the token bucket of the requests of a peer
+// and its recent malformed packets.
+type peerState struct {
+	tokens    float64
+	last      time.Time
+	malformed int
+	since     time.Time
+}
+
+// Guard protects DHTs from abusive peers. The requests of each peer,
+// identified by its address, are limited with a token bucket, and the
+// packets from banned IP addresses are ignored. The IP addresses which
+// send malformed packets repeatedly are banned automatically once
+// SetAutoBan enables it, as the source address of an unauthenticated
+// packet can be spoofed. A Guard can be shared by the DHTs of a node,
+// so that the limit applies to the requests to all of them.
+type Guard struct {
+	rate    float64
+	burst   float64
+	autoBan bool
+	peers   map[string]*peerState
+	bans    map[string]Ban
+	exempt  map[string]bool
+	mutex   sync.Mutex
+}
+
+// NewGuard returns a guard allowing rate requests per second from each
+// peer with bursts of up to burst requests. Zero values use the defaults
+// and a negative rate disables the limit.
+func NewGuard(rate float64, burst int) *Guard {
+	if rate == 0 {
+		rate = DefaultPeerRate
+	}
+	if burst <= 0 {
+		burst = DefaultPeerBurst
+	}
+	return &Guard{
+		rate:   rate,
+		burst:  float64(burst),
+		peers:  make(map[string]*peerState),
+		bans:   make(map[string]Ban),
+		exempt: make(map[string]bool),
+	}
+}
+
+// SetAutoBan enables the bans of the IP addresses which send malformed
+// packets. It should only be enabled when the packets are authenticated,
+// such as in a private network, so that a spoofed packet cannot get the
+// address of another node banned.
+func (g *Guard) SetAutoBan(enabled bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.autoBan = enabled
+}
+
+// Exempt prevents the IP address from being banned automatically,
+// for the addresses of the bootstrap nodes.
+func (g *Guard) Exempt(ip net.IP) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.exempt[ip.String()] = true
+}
+
+func (g *Guard) peer(addr net.Addr, now time.Time) *peerState {
+	k := addr.String()
+	s, ok := g.peers[k]
+	if !ok {
+		s = &peerState{tokens: g.burst, last: now}
+		g.peers[k] = s
+	}
+	return s
+}
+
+// banned reports whether the IP address of addr is banned.
+// The caller holds the mutex.
+func (g *Guard) banned(addr net.Addr, now time.Time) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	b, ok := g.bans[ip.String()]
+	if ok && b.expired(now) {
+		delete(g.bans, ip.String())
+		return false
+	}
+	return ok
+}
+
+// Allow reports whether a packet from addr is handled. The packets of
+// banned addresses are never handled, and requests beyond the rate of
+// the peer are dropped. Responses are not limited, as they answer the
+// requests of this node.
+func (g *Guard) Allow(addr net.Addr, request bool, now time.Time) bool {
+	if addr == nil {
+		return true
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.banned(addr, now) {
+		return false
+	}
+	if !request || g.rate < 0 {
+		return true
+	}
+	s := g.peer(addr, now)
+	s.tokens += now.Sub(s.last).Seconds() * g.rate
+	if s.tokens > g.burst {
+		s.tokens = g.burst
+	}
+	s.last = now
+	if s.tokens < 1 {
+		return false
+	}
+	s.tokens--
+	return true
+}
+
+// Malformed counts a malformed packet from addr, and bans its IP address
+// for AutoBanDuration after MalformedLimit of them within a minute if
+// the automatic bans are enabled and the address is not exempt.
+// It reports whether the address has been banned.
+func (g *Guard) Malformed(addr net.Addr, now time.Time) bool {
+	ip := addrIP(addr)
+	if ip == nil {
+		return false
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if !g.autoBan || g.exempt[ip.String()] || g.banned(addr, now) {
+		return false
+	}
+	s := g.peer(addr, now)
+	if now.Sub(s.since) > malformedWindow {
+		s.malformed = 0
+		s.since = now
+	}
+	s.malformed++
+	if s.malformed < MalformedLimit {
+		return false
+	}
+	delete(g.peers, addr.String())
+	g.bans[ip.String()] = Ban{IP: ip, Reason: "malformed packets", Until: now.Add(AutoBanDuration)}
+	return true
+}
+
+// Ban ignores the packets from the IP address for d,
+// or until Unban if d is zero.
+func (g *Guard) Ban(ip net.IP, d time.Duration, reason string) {
+	b := Ban{IP: ip, Reason: reason}
+	if d > 0 {
+		b.Until = time.Now().Add(d)
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.bans[ip.String()] = b
+}
+
+// Unban lifts the ban of the IP address.
+func (g *Guard) Unban(ip net.IP) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	delete(g.bans, ip.String())
+}
+
+// Bans returns the current bans, from the permanent ones
+// to the one lifted first.
+func (g *Guard) Bans() []Ban {
+	now := time.Now()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	var list []Ban
+	for k, b := range g.bans {
+		if b.expired(now) {
+			delete(g.bans, k)
+			continue
+		}
+		list = append(list, b)
+	}
+	sort.Sort(byUntil(list))
+	return list
+}
+
+// Prune forgets the peers which have been idle and the expired bans.
+func (g *Guard) Prune(now time.Time) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for k, s := range g.peers {
+		if now.Sub(s.last) > peerIdle {
+			delete(g.peers, k)
+		}
+	}
+	for k, b := range g.bans {
+		if b.expired(now) {
+			delete(g.bans, k)
+		}
+	}
+}
+
+// SetGuard replaces the guard of the DHT, so that it can be shared
+// with the other DHTs of the node. It is called before the DHT
+// receives packets.
+func (p *DHT) SetGuard(g *Guard) {
+	p.guard = g
+}
+
+// Guard returns the guard of the DHT.
+func (p *DHT) Guard() *Guard {
+	return p.guard
+}
+
+// Malformed reports a malformed packet from addr to the guard of the DHT,
+// for packets which are decoded before reaching the DHT.
+func (p *DHT) Malformed(addr net.Addr) {
+	if p.guard.Malformed(addr, time.Now()) {
+		p.logger.Info("%s: Ban %v for malformed packets", p.net.String(), addr)
+	}
+}
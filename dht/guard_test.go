@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestGuardRateLimit(t *testing.T) {
+	g := NewGuard(10, 5)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9200}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9201}
+
+	for i := 0; i < 5; i++ {
+		if !g.Allow(a, true, now) {
+			t.Errorf("Allow() returns false for request %d of a burst of 5", i)
+		}
+	}
+	if g.Allow(a, true, now) {
+		t.Errorf("Allow() should drop a request beyond the burst")
+	}
+	if !g.Allow(a, false, now) {
+		t.Errorf("Allow() should not limit the responses")
+	}
+	if !g.Allow(b, true, now) {
+		t.Errorf("Allow() should limit each peer separately")
+	}
+	if !g.Allow(a, true, now.Add(100*time.Millisecond)) {
+		t.Errorf("Allow() should allow a request once a token is refilled")
+	}
+
+	g.Prune(now.Add(peerIdle + time.Second))
+	if len(g.peers) != 0 {
+		t.Errorf("Prune() leaves %d peers; expects 0", len(g.peers))
+	}
+}
+
+func TestGuardBan(t *testing.T) {
+	g := NewGuard(0, 0)
+	now := time.Now()
+	a := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9200}
+	b := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9201}
+
+	for i := 0; i < MalformedLimit; i++ {
+		if g.Malformed(a, now) {
+			t.Errorf("Malformed() should not ban unauthenticated addresses")
+		}
+	}
+
+	g.SetAutoBan(true)
+	bootstrap := &net.UDPAddr{IP: net.ParseIP("192.0.2.2"), Port: 9200}
+	g.Exempt(bootstrap.IP)
+	for i := 0; i < MalformedLimit; i++ {
+		if g.Malformed(bootstrap, now) {
+			t.Errorf("Malformed() should not ban an exempt address")
+		}
+	}
+
+	now = now.Add(malformedWindow + time.Second)
+	for i := 1; i < MalformedLimit; i++ {
+		if g.Malformed(a, now) {
+			t.Errorf("Malformed() bans the address after %d packets; expects %d", i, MalformedLimit)
+		}
+	}
+	if !g.Malformed(a, now) {
+		t.Errorf("Malformed() should ban the address after %d packets", MalformedLimit)
+	}
+	if g.Allow(b, false, now) {
+		t.Errorf("Allow() should drop the packets of a banned IP address")
+	}
+	if !g.Allow(b, false, now.Add(AutoBanDuration)) {
+		t.Errorf("Allow() should allow the packets once the ban is lifted")
+	}
+
+	ip := net.ParseIP("198.51.100.1")
+	g.Ban(ip, 0, "spam")
+	g.Ban(net.ParseIP("198.51.100.2"), time.Hour, "spam")
+	bans := g.Bans()
+	if len(bans) != 2 || !bans[0].IP.Equal(ip) || !bans[0].Until.IsZero() {
+		t.Errorf("Bans() returns %v; expects the permanent ban first", bans)
+	}
+	if g.Allow(&net.UDPAddr{IP: ip, Port: 1}, true, now.Add(24*time.Hour)) {
+		t.Errorf("Allow() should drop the packets of a permanently banned address")
+	}
+	g.Unban(ip)
+	if !g.Allow(&net.UDPAddr{IP: ip, Port: 1}, true, now) {
+		t.Errorf("Allow() should allow the packets once Unban is called")
+	}
+}
+
+func TestDHTGuard(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	d := NewDHT(10, id, id, conn, log.NewLogger())
+	defer d.Close()
+	g := NewGuard(1, 1)
+	g.SetAutoBan(true)
+	d.SetGuard(g)
+	addr := &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 9200}
+
+	c := protocol.RPCCommand{
+		Src:    utils.NewRandomNodeID(utils.GlobalNamespace),
+		Net:    id,
+		Method: protocol.RPCPing,
+	}
+	d.ProcessCommand(c, addr)
+	d.ProcessCommand(c, addr)
+	if s := d.Stats(); s.Received[protocol.RPCPing] != 1 || s.Limited != 1 {
+		t.Errorf("Stats() returns %d pings and %d limited; expects 1 and 1", s.Received[protocol.RPCPing], s.Limited)
+	}
+
+	for i := 0; i < MalformedLimit; i++ {
+		d.ProcessPacket([]byte{0xc1}, addr)
+	}
+	if bans := d.Guard().Bans(); len(bans) != 1 || !bans[0].IP.Equal(addr.IP) {
+		t.Errorf("Bans() returns %v; expects the sender of malformed packets", bans)
+	}
+}
@@ -0,0 +1,318 @@
+package dht
+
+import (
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"sync"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// DefaultLookupAlpha is the default number of requests
+	// of a lookup which are in flight at the same time.
+	DefaultLookupAlpha = 3
+
+	// lookupWorkers is the number of requests of all the lookups
+	// which are in flight at the same time.
+	lookupWorkers = 16
+
+	// maxLookupAttempts bounds the attempts of each request of a lookup
+	// if the retry policy allows unlimited attempts, so that the lookups
+	// terminate even if the contacted nodes never respond.
+	maxLookupAttempts = 3
+)
+
+// LookupResult is an intermediate result of a lookup. Node is a node
+// closer to the target than the nodes in the previous results, and Value
+// is the value found by FindValue.
+type LookupResult struct {
+	Node  utils.NodeInfo
+	Value *string
+}
+
+// FindNode looks up the nodes nearest to the given ID. The nodes are
+// sent to the returned channel as they are found, progressively closer
+// to the target, and the channel is closed when the lookup converges or
+// the context is done. Callers must either drain the channel or cancel
+// the context.
+func (p *DHT) FindNode(ctx context.Context, id utils.NodeID) <-chan LookupResult {
+	return p.lookup(ctx, id, protocol.RPCFindNode, map[string]interface{}{
+		"id": string(id.Bytes()),
+	})
+}
+
+// FindValue looks up the value of the given key like FindNode. The last
+// result holds the value if it is found.
+func (p *DHT) FindValue(ctx context.Context, key string) <-chan LookupResult {
+	if v, ok := p.getValue(key); ok {
+		ch := make(chan LookupResult, 1)
+		ch <- LookupResult{Value: &v}
+		close(ch)
+		return ch
+	}
+	hash := sha1.Sum([]byte(key))
+	return p.lookup(ctx, utils.NewNodeID(p.id.NS, hash), protocol.RPCFindValue, map[string]interface{}{
+		"key": key,
+	})
+}
+
+type lookupReply struct {
+	id  utils.NodeID
+	ret dhtRPCReturn
+	err error
+}
+
+var errLookupClosed = errors.New("lookup on closed DHT")
+
+// lookupQueue schedules the requests of an iterative lookup. At most
+// alpha requests are in flight at the same time, and the nodes nearest
+// to the target are requested first. The replies are buffered, so that
+// the workers never wait for a lookup.
+type lookupQueue struct {
+	target    utils.NodeID
+	alpha     int
+	pending   []utils.NodeID
+	requested map[utils.NodeID]bool
+	inflight  int
+	replies   chan lookupReply
+}
+
+func newLookupQueue(target utils.NodeID, alpha int) *lookupQueue {
+	return &lookupQueue{
+		target:    target,
+		alpha:     alpha,
+		requested: make(map[utils.NodeID]bool),
+		replies:   make(chan lookupReply, alpha),
+	}
+}
+
+// add queues a node. It returns false if the node is already known.
+func (q *lookupQueue) add(id utils.NodeID) bool {
+	if q.requested[id] {
+		return false
+	}
+	q.requested[id] = true
+	q.pending = append(q.pending, id)
+	return true
+}
+
+func (q *lookupQueue) known(id utils.NodeID) bool {
+	return q.requested[id]
+}
+
+// next removes the nodes which can be requested now from the queue.
+func (q *lookupQueue) next() []utils.NodeID {
+	var list []utils.NodeID
+	for q.inflight < q.alpha && len(q.pending) > 0 {
+		n := 0
+		for i, id := range q.pending {
+			if id.Digest.Xor(q.target.Digest).Cmp(q.pending[n].Digest.Xor(q.target.Digest)) < 0 {
+				n = i
+			}
+		}
+		list = append(list, q.pending[n])
+		q.pending = append(q.pending[:n], q.pending[n+1:]...)
+		q.inflight++
+	}
+	return list
+}
+
+// done records the reply or the failure of a request.
+func (q *lookupQueue) done() {
+	q.inflight--
+}
+
+// finished reports whether no request is in flight or queued.
+func (q *lookupQueue) finished() bool {
+	return q.inflight == 0 && len(q.pending) == 0
+}
+
+// lookupTask is a request of a lookup waiting for a worker.
+type lookupTask struct {
+	dist    utils.PublicKeyDigest
+	id      utils.NodeID
+	c       dhtRPCCommand
+	policy  utils.RetryPolicy
+	replies chan<- lookupReply
+	done    <-chan struct{}
+}
+
+type lookupTasks []*lookupTask
+
+func (t lookupTasks) Len() int            { return len(t) }
+func (t lookupTasks) Less(i, j int) bool  { return t[i].dist.Cmp(t[j].dist) < 0 }
+func (t lookupTasks) Swap(i, j int)       { t[i], t[j] = t[j], t[i] }
+func (t *lookupTasks) Push(x interface{}) { *t = append(*t, x.(*lookupTask)) }
+func (t *lookupTasks) Pop() interface{} {
+	old := *t
+	task := old[len(old)-1]
+	*t = old[:len(old)-1]
+	return task
+}
+
+// lookupPool sends the requests of all the lookups from a fixed number
+// of workers, started with the first lookup. The requests wait in a queue
+// shared by the lookups, from the nearest to their target, so that the
+// lookups about to converge go first.
+type lookupPool struct {
+	tasks   lookupTasks
+	started bool
+	closed  bool
+	cond    *sync.Cond
+	mutex   sync.Mutex
+}
+
+func (l *lookupPool) push(t *lookupTask) (start, closed bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return false, true
+	}
+	if l.cond == nil {
+		l.cond = sync.NewCond(&l.mutex)
+	}
+	heap.Push(&l.tasks, t)
+	l.cond.Signal()
+	start = !l.started
+	l.started = true
+	return start, false
+}
+
+// pop waits for the nearest task. It returns nil once the pool is closed.
+func (l *lookupPool) pop() *lookupTask {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for len(l.tasks) == 0 && !l.closed {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return nil
+	}
+	return heap.Pop(&l.tasks).(*lookupTask)
+}
+
+// close stops the workers and returns the tasks which have not run.
+func (l *lookupPool) close() []*lookupTask {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.closed = true
+	if l.cond != nil {
+		l.cond.Broadcast()
+	}
+	tasks := l.tasks
+	l.tasks = nil
+	return tasks
+}
+
+func (t *lookupTask) reply(ret dhtRPCReturn, err error) {
+	select {
+	case t.replies <- lookupReply{t.id, ret, err}:
+	case <-t.done:
+	}
+}
+
+func (p *DHT) lookupWorker() {
+	for {
+		t := p.pool.pop()
+		if t == nil {
+			return
+		}
+		select {
+		case <-t.done:
+			continue
+		default:
+		}
+		ret, err := p.sendAndWait(t.id, t.c, t.policy)
+		t.reply(ret, err)
+	}
+}
+
+// request queues the requests of the lookup which are due. Each request
+// is attempted by a worker according to the lookup policy, and its reply
+// or failure is sent to the replies of the queue unless done is closed.
+func (p *DHT) request(q *lookupQueue, method string, args map[string]interface{}, done <-chan struct{}) {
+	policy := p.lookupPolicy()
+	for _, id := range q.next() {
+		t := &lookupTask{
+			dist:    id.Digest.Xor(q.target.Digest),
+			id:      id,
+			c:       p.newRPCCommand(method, args),
+			policy:  policy,
+			replies: q.replies,
+			done:    done,
+		}
+		start, closed := p.pool.push(t)
+		if closed {
+			t.reply(dhtRPCReturn{}, errLookupClosed)
+			continue
+		}
+		if start {
+			for i := 0; i < lookupWorkers; i++ {
+				go p.lookupWorker()
+			}
+		}
+	}
+}
+
+func (p *DHT) lookup(ctx context.Context, target utils.NodeID, method string, args map[string]interface{}) <-chan LookupResult {
+	out := make(chan LookupResult)
+	go func() {
+		defer close(out)
+		done := make(chan struct{})
+		defer close(done)
+
+		q := p.newLookupQueue(target)
+		var closest *utils.PublicKeyDigest
+
+		send := func(r LookupResult) bool {
+			select {
+			case out <- r:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		for _, n := range p.table.nearestNodes(target) {
+			q.add(n.ID)
+		}
+		p.request(q, method, args, done)
+
+		for !q.finished() {
+			select {
+			case <-ctx.Done():
+				return
+			case r := <-q.replies:
+				q.done()
+				if r.err == nil {
+					key, _ := args["key"].(string)
+					if val, ok := r.ret.command.Args["value"].(string); ok && validValue(key, val) {
+						send(LookupResult{Value: &val})
+						return
+					}
+					var nodes []utils.NodeInfo
+					r.ret.command.getArgs("nodes", &nodes)
+					for _, n := range nodes {
+						if n.ID.Digest.Cmp(p.id.Digest) == 0 || q.known(n.ID) || !p.insertNode(n) {
+							continue
+						}
+						dist := n.ID.Digest.Xor(target.Digest)
+						if closest == nil || closest.Cmp(dist) == 1 {
+							closest = &dist
+							if !send(LookupResult{Node: n}) {
+								return
+							}
+						}
+						q.add(n.ID)
+					}
+				}
+				p.request(q, method, args, done)
+			}
+		}
+	}()
+	return out
+}
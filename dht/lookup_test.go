@@ -0,0 +1,194 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+	"github.com/h2so5/utp"
+)
+
+func newTestDHTs(t *testing.T, n int) []*DHT {
+	logger := log.NewLogger()
+	var dhts []*DHT
+	for i := 0; i < n; i++ {
+		addr, err := utp.ResolveAddr("utp", ":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := utp.Listen("utp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uaddr, err := getLoopbackAddr(l.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := utils.NewRandomNodeID(namespace)
+		d := NewDHT(10, id, id, l.RawConn, logger)
+		dhts = append(dhts, d)
+
+		go func() {
+			var b [102400]byte
+			for {
+				n, addr, err := l.RawConn.ReadFrom(b[:])
+				if err != nil {
+					return
+				}
+				d.ProcessPacket(b[:n], addr)
+			}
+		}()
+
+		if i > 0 {
+			dhts[i-1].AddNode(utils.NodeInfo{ID: id, Addr: uaddr})
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	return dhts
+}
+
+func TestFindNode(t *testing.T) {
+	dhts := newTestDHTs(t, 5)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	target := dhts[len(dhts)-1].id
+	found := false
+	for r := range dhts[0].FindNode(context.Background(), target) {
+		if r.Node.ID.Match(target) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("FindNode() should find %s", target.String())
+	}
+}
+
+func TestFindValue(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[2].putValue("key", "value")
+	var value *string
+	for r := range dhts[1].FindValue(context.Background(), "key") {
+		if r.Value != nil {
+			value = r.Value
+		}
+	}
+	if value == nil || *value != "value" {
+		t.Errorf("FindValue() returns %v; expects value", value)
+	}
+}
+
+func TestFindNodeCancel(t *testing.T) {
+	dhts := newTestDHTs(t, 2)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ch := dhts[0].FindNode(ctx, utils.NewRandomNodeID(namespace))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Errorf("FindNode() should stop when the context is canceled")
+	}
+}
+
+func TestLookupQueue(t *testing.T) {
+	target := utils.NewRandomNodeID(namespace)
+	q := newLookupQueue(target, 2)
+	var ids []utils.NodeID
+	for i := 0; i < 3; i++ {
+		id := utils.NewRandomNodeID(namespace)
+		ids = append(ids, id)
+		if !q.add(id) {
+			t.Errorf("add() returns false for a new node")
+		}
+	}
+	if q.add(ids[0]) {
+		t.Errorf("add() returns true for a known node")
+	}
+
+	next := q.next()
+	if len(next) != 2 {
+		t.Fatalf("next() returns %d nodes; expects 2", len(next))
+	}
+	if next[0].Digest.Xor(target.Digest).Cmp(next[1].Digest.Xor(target.Digest)) > 0 {
+		t.Errorf("next() should return the nearest node first")
+	}
+	if len(q.next()) != 0 {
+		t.Errorf("next() should not exceed alpha requests in flight")
+	}
+	q.done()
+	if len(q.next()) != 1 {
+		t.Errorf("next() should return the last node")
+	}
+	q.done()
+	q.done()
+	if !q.finished() {
+		t.Errorf("finished() returns false; expects true")
+	}
+}
+
+func TestLookupUnresponsive(t *testing.T) {
+	dhts := newTestDHTs(t, 1)
+	defer dhts[0].Close()
+	d := dhts[0]
+	d.SetRetryPolicy(utils.RetryPolicy{Timeout: 50 * time.Millisecond, Initial: 10 * time.Millisecond, Multiplier: 1, Attempts: -1})
+
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:1")
+	for i := 0; i < 5; i++ {
+		d.AddNode(utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: addr})
+	}
+
+	done := make(chan int)
+	go func() {
+		d.LoadValue("key")
+		d.FindNearestNode(utils.NewRandomNodeID(namespace))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("lookups should terminate when no node responds")
+	}
+}
+
+func TestLookupPool(t *testing.T) {
+	var l lookupPool
+	target := utils.NewRandomNodeID(namespace)
+	for i := 0; i < 5; i++ {
+		id := utils.NewRandomNodeID(namespace)
+		start, closed := l.push(&lookupTask{id: id, dist: id.Digest.Xor(target.Digest)})
+		if closed || start != (i == 0) {
+			t.Errorf("push() returns %v, %v; expects %v, false", start, closed, i == 0)
+		}
+	}
+
+	prev := l.pop()
+	for i := 0; i < 3; i++ {
+		task := l.pop()
+		if task.dist.Cmp(prev.dist) < 0 {
+			t.Errorf("pop() should return the nearest task first")
+		}
+		prev = task
+	}
+
+	if rest := l.close(); len(rest) != 1 {
+		t.Errorf("close() returns %d tasks; expects 1", len(rest))
+	}
+	if l.pop() != nil {
+		t.Errorf("pop() should return nil once the pool is closed")
+	}
+	if _, closed := l.push(&lookupTask{}); !closed {
+		t.Errorf("push() should fail once the pool is closed")
+	}
+}
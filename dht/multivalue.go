@@ -0,0 +1,256 @@
+package dht
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// MultiValue is one of the values held at a multi-value key. The values
+// of the key are distinct by publisher and value, so that the nodes
+// storing at the same key do not replace the values of each other, and
+// each value expires on its own. The publisher is the node which has
+// stored the value: the values stored by a node are attributed to it,
+// whatever publisher it claims. The copies sent by the nodes holding the
+// values keep their publisher, which is not authenticated.
+type MultiValue struct {
+	Value     string       `msgpack:"value"`
+	Publisher utils.NodeID `msgpack:"publisher"`
+	Expires   time.Time    `msgpack:"expires"`
+}
+
+// multiValueArg is a MultiValue as sent to other nodes, with the number
+// of seconds left before it expires instead of its expiration time.
+type multiValueArg struct {
+	Value     string       `msgpack:"value"`
+	Publisher utils.NodeID `msgpack:"publisher"`
+	TTL       int64        `msgpack:"ttl"`
+}
+
+func (v MultiValue) same(o MultiValue) bool {
+	return v.Value == o.Value && v.Publisher.Match(o.Publisher)
+}
+
+// encodeMultiValues returns the values which have not expired at now,
+// as sent to other nodes.
+func encodeMultiValues(values []MultiValue, now time.Time) string {
+	args := make([]multiValueArg, 0, len(values))
+	for _, v := range values {
+		ttl := int64(v.Expires.Sub(now) / time.Second)
+		if ttl > 0 {
+			args = append(args, multiValueArg{Value: v.Value, Publisher: v.Publisher, TTL: ttl})
+		}
+	}
+	b, _ := msgpack.Marshal(args)
+	return string(b)
+}
+
+// decodeMultiValues reads the values sent by another node at now.
+// Their TTL is bounded by ValueTTL.
+func decodeMultiValues(value string, now time.Time) []MultiValue {
+	var args []multiValueArg
+	msgpack.Unmarshal([]byte(value), &args)
+	var values []MultiValue
+	for _, a := range args {
+		ttl := time.Duration(a.TTL) * time.Second
+		if ttl <= 0 {
+			continue
+		}
+		if ttl > ValueTTL {
+			ttl = ValueTTL
+		}
+		values = append(values, MultiValue{Value: a.Value, Publisher: a.Publisher, Expires: now.Add(ttl)})
+	}
+	return values
+}
+
+// storedMultiValues decodes the values of a multi-value store received
+// at now. The values sent without an age are sent by their publisher
+// rather than copied from another node, and are attributed to the sender.
+func storedMultiValues(c *dhtRPCCommand, value string, now time.Time) []MultiValue {
+	values := decodeMultiValues(value, now)
+	if _, copied := c.Args["age"]; !copied {
+		for i := range values {
+			values[i].Publisher = c.Src
+		}
+	}
+	return values
+}
+
+// mergeMultiValues adds values to a multi-value set, keeping the later
+// expiration of the values which are already in it. The expired values
+// are dropped, and the values which expire first are dropped when the
+// set grows beyond maxSetSize.
+func mergeMultiValues(set, values []MultiValue, now time.Time) []MultiValue {
+	var merged []MultiValue
+	all := make([]MultiValue, 0, len(set)+len(values))
+	for _, v := range append(append(all, set...), values...) {
+		if !v.Expires.After(now) {
+			continue
+		}
+		found := false
+		for i, m := range merged {
+			if m.same(v) {
+				if v.Expires.After(m.Expires) {
+					merged[i].Expires = v.Expires
+				}
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, v)
+		}
+	}
+	for len(merged) > maxSetSize {
+		first := 0
+		for i, m := range merged {
+			if m.Expires.Before(merged[first].Expires) {
+				first = i
+			}
+		}
+		merged = append(merged[:first], merged[first+1:]...)
+	}
+	return merged
+}
+
+// mergeMulti adds values to the local multi-value set at the key.
+func (p *DHT) mergeMulti(key string, values []MultiValue) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+
+	var set []MultiValue
+	if val, ok := p.kvs.Get(key); ok {
+		msgpack.Unmarshal([]byte(val), &set)
+	}
+
+	b, err := msgpack.Marshal(mergeMultiValues(set, values, time.Now()))
+	if err != nil {
+		return
+	}
+	err = p.kvs.Put(key, string(b))
+	if err != nil {
+		p.logger.Error("store: %v", err)
+	}
+}
+
+// getMulti returns the values held at the multi-value key which have not
+// expired at now.
+func (p *DHT) getMulti(key string, now time.Time) []MultiValue {
+	val, ok := p.getValue(key)
+	if !ok {
+		return nil
+	}
+	var set []MultiValue
+	msgpack.Unmarshal([]byte(val), &set)
+	return mergeMultiValues(nil, set, now)
+}
+
+// expireMulti drops the expired values of the multi-value set at the key,
+// and reports whether values are left. The caller holds kvsMutex.
+func (p *DHT) expireMulti(key string, now time.Time) bool {
+	val, ok := p.kvs.Get(key)
+	if !ok {
+		return false
+	}
+	var set []MultiValue
+	msgpack.Unmarshal([]byte(val), &set)
+	left := mergeMultiValues(nil, set, now)
+	if len(left) == len(set) {
+		return len(left) > 0
+	}
+	if len(left) == 0 {
+		return false
+	}
+	b, err := msgpack.Marshal(left)
+	if err == nil {
+		err = p.kvs.Put(key, string(b))
+	}
+	if err != nil {
+		p.logger.Error("store: %v", err)
+	}
+	return true
+}
+
+// sendableValue returns the value held at the key as sent to other nodes
+// with the method.
+func (p *DHT) sendableValue(key, method string) (string, bool) {
+	value, ok := p.getValue(key)
+	if ok && method == protocol.RPCStoreMulti {
+		return multiValueArgs(value, time.Now())
+	}
+	return value, ok
+}
+
+// multiValueArgs converts a multi-value set as held by this node to the
+// values sent to other nodes at now. It reports false if all the values
+// have expired.
+func multiValueArgs(value string, now time.Time) (string, bool) {
+	var set []MultiValue
+	msgpack.Unmarshal([]byte(value), &set)
+	set = mergeMultiValues(nil, set, now)
+	return encodeMultiValues(set, now), len(set) > 0
+}
+
+// StoreMultiValue adds the value to the multi-value key on the nodes
+// nearest to it, published by this node for the given time, which is
+// bounded by ValueTTL. The values published by other nodes at the same
+// key are kept. The value is stored again with its full TTL until
+// Unpublish is called, and expires after ttl otherwise.
+func (p *DHT) StoreMultiValue(key, value string, ttl time.Duration) {
+	if ttl > ValueTTL || ttl <= 0 {
+		ttl = ValueTTL
+	}
+	now := time.Now()
+	v := encodeMultiValues([]MultiValue{{Value: value, Publisher: p.id, Expires: now.Add(ttl)}}, now)
+	p.originate(key, protocol.RPCStoreMulti, v)
+	p.store(key, protocol.RPCStoreMulti, v)
+}
+
+// LoadMultiValues returns all the values of the multi-value key which
+// have not expired, as found on the nodes nearest to the key. Unlike
+// LoadValue, the lookup does not stop at the first node holding values.
+func (p *DHT) LoadMultiValues(key string) []MultiValue {
+	values := p.getMulti(key, time.Now())
+
+	keyid := p.keyID(key)
+	nodes := p.table.nearestNodes(keyid)
+	if len(nodes) == 0 {
+		return values
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	args := map[string]interface{}{
+		"key": key,
+	}
+
+	q := p.newLookupQueue(keyid)
+	for _, n := range nodes {
+		q.add(n.ID)
+	}
+	p.request(q, protocol.RPCFindValues, args, done)
+
+	for !q.finished() {
+		r := <-q.replies
+		q.done()
+		if r.err == nil {
+			if val, ok := r.ret.command.Args["values"].(string); ok {
+				now := time.Now()
+				values = mergeMultiValues(values, decodeMultiValues(val, now), now)
+			}
+			var nodes []utils.NodeInfo
+			r.ret.command.getArgs("nodes", &nodes)
+			dist := r.id.Digest.Xor(keyid.Digest)
+			for _, n := range nodes {
+				if p.insertNode(n) && dist.Cmp(n.ID.Digest.Xor(keyid.Digest)) == 1 {
+					q.add(n.ID)
+				}
+			}
+		}
+		p.request(q, protocol.RPCFindValues, args, done)
+	}
+	return values
+}
@@ -0,0 +1,109 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestMergeMultiValues(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	a := utils.NewRandomNodeID(namespace)
+	b := utils.NewRandomNodeID(namespace)
+
+	set := []MultiValue{
+		{Value: "x", Publisher: a, Expires: now.Add(time.Hour)},
+		{Value: "x", Publisher: b, Expires: now.Add(time.Hour)},
+		{Value: "y", Publisher: a, Expires: now.Add(-time.Second)},
+	}
+	merged := mergeMultiValues(set, []MultiValue{{Value: "x", Publisher: a, Expires: now.Add(2 * time.Hour)}}, now)
+	if len(merged) != 2 {
+		t.Fatalf("mergeMultiValues() returns %d values; expects 2", len(merged))
+	}
+	if !merged[0].Expires.Equal(now.Add(2 * time.Hour)) {
+		t.Errorf("mergeMultiValues() should keep the later expiration")
+	}
+	if len(set) != 3 || !set[0].Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("mergeMultiValues() should not modify its arguments")
+	}
+
+	values := decodeMultiValues(encodeMultiValues(merged, now), now)
+	if len(values) != 2 || !values[0].same(merged[0]) || !values[1].Expires.Equal(now.Add(time.Hour)) {
+		t.Errorf("decodeMultiValues() returns %v; expects %v", values, merged)
+	}
+}
+
+func TestMultiValues(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[0].StoreMultiValue("key", "a", time.Hour)
+	dhts[1].StoreMultiValue("key", "b", 0)
+	time.Sleep(100 * time.Millisecond)
+
+	values := dhts[2].LoadMultiValues("key")
+	if len(values) != 2 {
+		t.Fatalf("LoadMultiValues() returns %v; expects the values of both nodes", values)
+	}
+	for _, v := range values {
+		switch v.Value {
+		case "a":
+			if !v.Publisher.Match(dhts[0].id) {
+				t.Errorf("value a has publisher %v; expects %v", v.Publisher, dhts[0].id)
+			}
+		case "b":
+			if !v.Publisher.Match(dhts[1].id) {
+				t.Errorf("value b has publisher %v; expects %v", v.Publisher, dhts[1].id)
+			}
+		default:
+			t.Errorf("LoadMultiValues() returns unknown value %q", v.Value)
+		}
+	}
+
+	// Each value expires on its own.
+	dhts[2].Maintain(time.Now().Add(2 * time.Hour))
+	values = dhts[2].getMulti("key", time.Now().Add(2*time.Hour))
+	if len(values) != 1 || values[0].Value != "b" {
+		t.Errorf("getMulti() returns %v; expects [b]", values)
+	}
+	dhts[2].Maintain(time.Now().Add(ValueTTL))
+	if _, ok := dhts[2].getValue("key"); ok {
+		t.Errorf("Maintain() should remove a key without values")
+	}
+}
+
+func TestMultiValuesPublisher(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+	d := dhts[0]
+	d.SetRetryPolicy(utils.RetryPolicy{Timeout: time.Second, Attempts: 1})
+	d.SetReplication(2)
+
+	// A node storing a value in the name of another one
+	// is recorded as its publisher.
+	now := time.Now()
+	forged := encodeMultiValues([]MultiValue{{Value: "forged", Publisher: dhts[2].id, Expires: now.Add(time.Hour)}}, now)
+	if n := d.replicateStore("key", protocol.RPCStoreMulti, forged); n != 2 {
+		t.Fatalf("replicateStore() returns %d; expects 2", n)
+	}
+	values := dhts[1].getMulti("key", time.Now())
+	if len(values) != 1 || !values[0].Publisher.Match(d.id) {
+		t.Errorf("getMulti() returns %v; expects the value published by %v", values, d.id)
+	}
+
+	// The values of a multi-value key cannot be replaced.
+	for _, method := range []string{protocol.RPCStore, protocol.RPCStoreSet} {
+		if n := d.replicateStore("key", method, "value"); n != 0 {
+			t.Errorf("replicateStore() with %s returns %d; expects 0", method, n)
+		}
+	}
+	if values := dhts[1].getMulti("key", time.Now()); len(values) != 1 {
+		t.Errorf("getMulti() returns %v; expects the stored value", values)
+	}
+}
@@ -0,0 +1,266 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+// NAT types of the shim.
+const (
+	// natPortRestricted maps a socket to one external port and only
+	// accepts packets from the addresses it has sent to.
+	natPortRestricted = iota
+
+	// natSymmetric maps a socket to a new external port for each
+	// destination and only accepts packets from that destination.
+	natSymmetric
+)
+
+// natTimeout is the timeout of the pings which are expected to fail.
+const natTimeout = 200 * time.Millisecond
+
+// memNetwork is an in-memory UDP network in which sockets can be put
+// behind a user-space NAT.
+type memNetwork struct {
+	conns map[string]*memConn
+	nats  map[string]*natShim
+	mutex sync.Mutex
+}
+
+func newMemNetwork() *memNetwork {
+	return &memNetwork{
+		conns: make(map[string]*memConn),
+		nats:  make(map[string]*natShim),
+	}
+}
+
+// natShim translates the addresses of a socket behind a NAT and filters
+// the inbound packets. It is only accessed with the mutex of the network.
+type natShim struct {
+	typ      int
+	ip       net.IP
+	inside   *memConn
+	mappings map[string]*net.UDPAddr
+	allowed  map[string]map[string]bool
+	lastPort int
+}
+
+// outbound returns the external address of a packet to dst,
+// and allows the replies from dst.
+func (n *natShim) outbound(m *memNetwork, dst string) *net.UDPAddr {
+	key := ""
+	if n.typ == natSymmetric {
+		key = dst
+	}
+	ext, ok := n.mappings[key]
+	if !ok {
+		n.lastPort++
+		ext = &net.UDPAddr{IP: n.ip, Port: n.lastPort}
+		n.mappings[key] = ext
+		n.allowed[ext.String()] = make(map[string]bool)
+		m.nats[ext.String()] = n
+	}
+	n.allowed[ext.String()][dst] = true
+	return ext
+}
+
+type memPacket struct {
+	b    []byte
+	addr net.Addr
+}
+
+// memConn is a socket of a memNetwork. Packets to unknown or filtered
+// addresses are dropped silently.
+type memConn struct {
+	network *memNetwork
+	addr    *net.UDPAddr
+	nat     *natShim
+	ch      chan memPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// listen opens a socket at the given address. If typ is not negative,
+// the socket is put behind a NAT of the given type, and addr is the
+// external IP of the NAT.
+func (m *memNetwork) listen(addr string, typ int) *memConn {
+	udp, _ := net.ResolveUDPAddr("udp", addr)
+	c := &memConn{
+		network: m,
+		addr:    udp,
+		ch:      make(chan memPacket, 100),
+		closed:  make(chan struct{}),
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if typ < 0 {
+		m.conns[udp.String()] = c
+	} else {
+		c.nat = &natShim{
+			typ:      typ,
+			ip:       udp.IP,
+			inside:   c,
+			mappings: make(map[string]*net.UDPAddr),
+			allowed:  make(map[string]map[string]bool),
+			lastPort: udp.Port,
+		}
+	}
+	return c
+}
+
+func (m *memNetwork) send(from *memConn, b []byte, to string) {
+	m.mutex.Lock()
+	src := from.addr
+	if from.nat != nil {
+		src = from.nat.outbound(m, to)
+	}
+	dst := m.conns[to]
+	if n, ok := m.nats[to]; ok && n.allowed[to][src.String()] {
+		dst = n.inside
+	}
+	m.mutex.Unlock()
+	if dst == nil {
+		return
+	}
+	select {
+	case dst.ch <- memPacket{b: append([]byte(nil), b...), addr: src}:
+	case <-dst.closed:
+	default:
+	}
+}
+
+func (c *memConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.ch:
+		return copy(b, p.b), p.addr, nil
+	case <-c.closed:
+		return 0, nil, errors.New("use of closed connection")
+	}
+}
+
+func (c *memConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.network.send(c, b, addr.String())
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *memConn) LocalAddr() net.Addr                { return c.addr }
+func (c *memConn) SetDeadline(t time.Time) error      { return nil }
+func (c *memConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// newNATNode starts a DHT on a socket of the network.
+func newNATNode(m *memNetwork, addr string, typ int) *DHT {
+	conn := m.listen(addr, typ)
+	id := utils.NewRandomNodeID(namespace)
+	d := NewDHT(10, id, id, conn, log.NewLogger())
+	go func() {
+		var b [102400]byte
+		for {
+			l, addr, err := conn.ReadFrom(b[:])
+			if err != nil {
+				return
+			}
+			d.ProcessPacket(b[:l], addr)
+		}
+	}()
+	return d
+}
+
+// observedAddr returns the address of the node d as seen by the node o.
+func observedAddr(t *testing.T, o, d *DHT) net.Addr {
+	info := o.GetNodeInfo(d.id)
+	if info == nil || info.Addr == nil {
+		t.Fatalf("%s does not know the address of %s", o.id.String(), d.id.String())
+	}
+	return info.Addr
+}
+
+func TestNATPortRestricted(t *testing.T) {
+	m := newMemNetwork()
+	rendezvous := newNATNode(m, "198.51.100.1:4000", -1)
+	defer rendezvous.Close()
+	a := newNATNode(m, "203.0.113.1:4000", natPortRestricted)
+	defer a.Close()
+	b := newNATNode(m, "203.0.113.2:4000", natPortRestricted)
+	defer b.Close()
+
+	if _, err := a.Ping(rendezvous.conn.LocalAddr(), time.Second); err != nil {
+		t.Fatalf("Ping() to a public node returns %v; expects nil", err)
+	}
+	if _, err := b.Ping(rendezvous.conn.LocalAddr(), time.Second); err != nil {
+		t.Fatalf("Ping() to a public node returns %v; expects nil", err)
+	}
+	addrA := observedAddr(t, rendezvous, a)
+	addrB := observedAddr(t, rendezvous, b)
+
+	if _, err := rendezvous.Ping(addrA, time.Second); err != nil {
+		t.Errorf("Ping() through an open mapping returns %v; expects nil", err)
+	}
+	if _, err := b.Ping(addrA, natTimeout); err == nil {
+		t.Errorf("Ping() to an unsolicited NAT returns nil; expects an error")
+	}
+
+	// Hole punching: each side sends to the address of the other one
+	// learnt from the rendezvous node.
+	a.Discover(addrB)
+	b.Discover(addrA)
+	if _, err := b.Ping(addrA, time.Second); err != nil {
+		t.Errorf("Ping() after hole punching returns %v; expects nil", err)
+	}
+	if _, err := a.Ping(addrB, time.Second); err != nil {
+		t.Errorf("Ping() after hole punching returns %v; expects nil", err)
+	}
+}
+
+func TestNATSymmetric(t *testing.T) {
+	m := newMemNetwork()
+	relay := newNATNode(m, "198.51.100.1:4000", -1)
+	defer relay.Close()
+	other := newNATNode(m, "198.51.100.2:4000", -1)
+	defer other.Close()
+	a := newNATNode(m, "203.0.113.1:4000", natSymmetric)
+	defer a.Close()
+	b := newNATNode(m, "203.0.113.2:4000", natPortRestricted)
+	defer b.Close()
+
+	for _, n := range []*DHT{a, b} {
+		if _, err := n.Ping(relay.conn.LocalAddr(), time.Second); err != nil {
+			t.Fatalf("Ping() to a public node returns %v; expects nil", err)
+		}
+	}
+	if _, err := a.Ping(other.conn.LocalAddr(), time.Second); err != nil {
+		t.Fatalf("Ping() to a public node returns %v; expects nil", err)
+	}
+	addrA := observedAddr(t, relay, a)
+	addrB := observedAddr(t, relay, b)
+	if addrA.String() == observedAddr(t, other, a).String() {
+		t.Errorf("symmetric NAT uses %v for every destination; expects one port per destination", addrA)
+	}
+
+	// The address learnt from the relay node cannot be punched,
+	// because the NAT maps the packets to b to another port.
+	a.Discover(addrB)
+	b.Discover(addrA)
+	if _, err := b.Ping(addrA, natTimeout); err == nil {
+		t.Errorf("Ping() through a symmetric NAT returns nil; expects an error")
+	}
+
+	// The relay node can still reach both nodes to forward their packets.
+	if _, err := relay.Ping(addrA, time.Second); err != nil {
+		t.Errorf("Ping() from the relay node returns %v; expects nil", err)
+	}
+	if _, err := relay.Ping(addrB, time.Second); err != nil {
+		t.Errorf("Ping() from the relay node returns %v; expects nil", err)
+	}
+}
@@ -0,0 +1,47 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// Join looks up the ID of this node, as in the Kademlia join. The lookup
+// fills the buckets near this node, and the nodes nearest to it learn
+// about this node from the requests, so that other nodes can find it.
+// It returns the number of nodes found.
+func (p *DHT) Join(ctx context.Context) int {
+	n := 0
+	for range p.FindNode(ctx, p.id) {
+		n++
+	}
+	return n
+}
+
+// RefreshNeighborhood pings the k nodes nearest to this node, whether
+// they are verified or not, and removes those which do not answer.
+// It returns the number of nodes which have answered.
+func (p *DHT) RefreshNeighborhood() int {
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	alive := 0
+	for _, n := range p.table.neighborhood() {
+		wg.Add(1)
+		go func(n utils.NodeInfo) {
+			defer wg.Done()
+			c := p.newRPCCommand(protocol.RPCPing, nil)
+			_, err := p.sendAndWaitPacket(n.ID, c)
+			if err != nil {
+				p.removeNode(n.ID)
+				return
+			}
+			mutex.Lock()
+			alive++
+			mutex.Unlock()
+		}(n)
+	}
+	wg.Wait()
+	return alive
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"net"
+	"testing"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRefreshNeighborhood(t *testing.T) {
+	logger := log.NewLogger()
+	var dhts []*DHT
+	var nodes []utils.NodeInfo
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		node := utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: conn.LocalAddr()}
+		d := NewDHT(10, node.ID, node.ID, conn, logger)
+		defer d.Close()
+		go func() {
+			var b [102400]byte
+			for {
+				l, addr, err := conn.ReadFrom(b[:])
+				if err != nil {
+					return
+				}
+				d.ProcessPacket(b[:l], addr)
+			}
+		}()
+		dhts = append(dhts, d)
+		nodes = append(nodes, node)
+	}
+
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadNode := utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: dead.LocalAddr()}
+	dead.Close()
+
+	dhts[0].table.insert(nodes[1])
+	dhts[0].table.insert(deadNode)
+	if n := dhts[0].RefreshNeighborhood(); n != 1 {
+		t.Errorf("RefreshNeighborhood() returns %d; expects 1", n)
+	}
+	if dhts[0].GetNodeInfo(deadNode.ID) != nil {
+		t.Errorf("RefreshNeighborhood() should remove a node which does not answer")
+	}
+	if !dhts[0].table.isVerified(nodes[1].ID) {
+		t.Errorf("RefreshNeighborhood() should verify a node which answers")
+	}
+}
@@ -1,56 +1,356 @@
 package dht
 
 import (
+	"net"
 	"sync"
+	"time"
 
 	"github.com/h2so5/murcott/utils"
 )
 
 const bucketSize = 160
 
+// Limits of the nodes in the routing table which share an address,
+// so that an attacker cannot fill the table with IDs from one host.
+const (
+	maxNodesPerIP     = 2
+	maxNodesPerSubnet = 8
+)
+
 type nodeTable struct {
 	buckets [][]utils.NodeInfo
 	selfid  utils.NodeID
 	k       int
 	mutex   *sync.RWMutex
+
+	// verified holds the nodes which have answered a request of this node.
+	// Only verified nodes are used for lookups.
+	verified map[utils.NodeID]bool
+
+	// seen holds the last time each node was heard from, and failures
+	// the number of requests it has left unanswered since then.
+	seen     map[utils.NodeID]time.Time
+	failures map[utils.NodeID]int
+
+	// acks holds the nodes which acknowledge the stores.
+	acks map[utils.NodeID]bool
+
+	// replacements holds, for each bucket, the most recent nodes which
+	// did not fit in it, which replace the nodes removed from it.
+	replacements [][]utils.NodeInfo
+
+	// lookups holds the last time a lookup targeted each bucket.
+	lookups []time.Time
+
+	// ipLimit and subnetLimit are the maximum numbers of nodes with the
+	// same IP address and in the same /24 (/64 for IPv6) subnet.
+	// Zero means no limit.
+	ipLimit     int
+	subnetLimit int
 }
 
 func newNodeTable(k int, id utils.NodeID) nodeTable {
 	buckets := make([][]utils.NodeInfo, bucketSize)
 
 	return nodeTable{
-		buckets: buckets,
-		selfid:  id,
-		k:       k,
-		mutex:   &sync.RWMutex{},
+		buckets:      buckets,
+		selfid:       id,
+		k:            k,
+		mutex:        &sync.RWMutex{},
+		verified:     make(map[utils.NodeID]bool),
+		seen:         make(map[utils.NodeID]time.Time),
+		failures:     make(map[utils.NodeID]int),
+		acks:         make(map[utils.NodeID]bool),
+		replacements: make([][]utils.NodeInfo, bucketSize),
+		lookups:      make([]time.Time, bucketSize),
 	}
 }
 
-func (p *nodeTable) insert(node utils.NodeInfo) {
-	p.remove(node.ID)
-
+// insert adds the node to the table, or moves it to the end of its bucket
+// if it is already known, so that the buckets are ordered from the least
+// recently seen node. When the bucket is full, the newest unverified node
+// is replaced. If all are verified, the node is kept as a replacement,
+// which can be reached but is not returned for lookups until it takes the
+// place of a node removed from the bucket. It returns false if the node is
+// not admitted.
+func (p *nodeTable) insert(node utils.NodeInfo) bool {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
 	b := node.ID.Digest.Xor(p.selfid.Digest).Log2int()
 
+	for i, n := range p.buckets[b] {
+		if n.ID.Digest.Cmp(node.ID.Digest) == 0 {
+			if !sameIP(addrIP(n.Addr), addrIP(node.Addr)) {
+				delete(p.verified, n.ID)
+			}
+			p.buckets[b] = append(p.buckets[b][:i], p.buckets[b][i+1:]...)
+			break
+		}
+	}
+
+	if !p.admit(node) {
+		return false
+	}
+
 	if len(p.buckets[b]) < p.k {
 		p.buckets[b] = append(p.buckets[b], node)
-	} else {
-		p.buckets[b][len(p.buckets[b])-1] = node
+		p.touch(node.ID)
+		return true
+	}
+	for i := len(p.buckets[b]) - 1; i >= 0; i-- {
+		if id := p.buckets[b][i].ID; !p.verified[id] {
+			p.forget(id)
+			p.buckets[b] = append(p.buckets[b][:i], p.buckets[b][i+1:]...)
+			p.buckets[b] = append(p.buckets[b], node)
+			p.touch(node.ID)
+			return true
+		}
+	}
+	p.addReplacement(b, node)
+	return true
+}
+
+func (p *nodeTable) touch(id utils.NodeID) {
+	p.seen[id] = time.Now()
+	delete(p.failures, id)
+}
+
+func (p *nodeTable) forget(id utils.NodeID) {
+	delete(p.verified, id)
+	delete(p.seen, id)
+	delete(p.failures, id)
+	delete(p.acks, id)
+}
+
+// addReplacement caches a node which does not fit in its bucket,
+// dropping the oldest replacement if the cache is full.
+func (p *nodeTable) addReplacement(b int, node utils.NodeInfo) {
+	r := p.replacements[b]
+	for i, n := range r {
+		if n.ID.Digest.Cmp(node.ID.Digest) == 0 {
+			if !sameIP(addrIP(n.Addr), addrIP(node.Addr)) {
+				delete(p.verified, n.ID)
+			}
+			r = append(r[:i], r[i+1:]...)
+			break
+		}
+	}
+	r = append(r, node)
+	if len(r) > p.k {
+		for _, n := range r[:len(r)-p.k] {
+			p.forget(n.ID)
+		}
+		r = r[len(r)-p.k:]
+	}
+	p.replacements[b] = r
+}
+
+func (p *nodeTable) findReplacement(b int, id utils.NodeID) int {
+	for i, n := range p.replacements[b] {
+		if n.ID.Digest.Cmp(id.Digest) == 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// isReplacement reports whether the node waits for a place in its bucket.
+func (p *nodeTable) isReplacement(id utils.NodeID) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.findReplacement(id.Digest.Xor(p.selfid.Digest).Log2int(), id) >= 0
+}
+
+// admit reports whether the limits of the nodes sharing an address
+// allow the node to be added. Loopback addresses are not limited.
+func (p *nodeTable) admit(node utils.NodeInfo) bool {
+	ip := addrIP(node.Addr)
+	if ip == nil || ip.IsLoopback() {
+		return true
+	}
+	var ips, subnets int
+	for _, b := range p.buckets {
+		for _, n := range b {
+			nip := addrIP(n.Addr)
+			if nip == nil {
+				continue
+			}
+			if sameIP(nip, ip) {
+				ips++
+			}
+			if sameSubnet(nip, ip) {
+				subnets++
+			}
+		}
+	}
+	if p.ipLimit > 0 && ips >= p.ipLimit {
+		return false
+	}
+	if p.subnetLimit > 0 && subnets >= p.subnetLimit {
+		return false
 	}
+	return true
 }
 
-func (p *nodeTable) remove(id utils.NodeID) {
+// remove removes the node from the table. The most recent replacement
+// of its bucket takes its place, and is returned.
+func (p *nodeTable) remove(id utils.NodeID) (utils.NodeInfo, bool) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 	b := id.Digest.Xor(p.selfid.Digest).Log2int()
 	for i, n := range p.buckets[b] {
 		if n.ID.Digest.Cmp(id.Digest) == 0 {
 			p.buckets[b] = append(p.buckets[b][:i], p.buckets[b][i+1:]...)
+			p.forget(n.ID)
+			return p.promote(b)
+		}
+	}
+	if i := p.findReplacement(b, id); i >= 0 {
+		p.replacements[b] = append(p.replacements[b][:i], p.replacements[b][i+1:]...)
+		p.forget(id)
+	}
+	return utils.NodeInfo{}, false
+}
+
+// promote moves the most recent admitted replacement of the bucket
+// into it.
+func (p *nodeTable) promote(b int) (utils.NodeInfo, bool) {
+	for len(p.replacements[b]) > 0 {
+		last := len(p.replacements[b]) - 1
+		node := p.replacements[b][last]
+		p.replacements[b] = p.replacements[b][:last]
+		if p.admit(node) {
+			p.buckets[b] = append(p.buckets[b], node)
+			p.touch(node.ID)
+			return node, true
+		}
+	}
+	return utils.NodeInfo{}, false
+}
+
+// verify marks the node as verified if it is in the table.
+func (p *nodeTable) verify(id utils.NodeID) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b := id.Digest.Xor(p.selfid.Digest).Log2int()
+	for _, n := range p.buckets[b] {
+		if n.ID.Digest.Cmp(id.Digest) == 0 {
+			p.verified[n.ID] = true
+			p.touch(n.ID)
 			return
 		}
 	}
+	if p.findReplacement(b, id) >= 0 {
+		p.verified[id] = true
+		p.touch(id)
+	}
+}
+
+// setAcks records whether the node acknowledges the stores,
+// if it is in the table.
+func (p *nodeTable) setAcks(id utils.NodeID, acks bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	b := id.Digest.Xor(p.selfid.Digest).Log2int()
+	for _, n := range p.buckets[b] {
+		if n.ID.Digest.Cmp(id.Digest) == 0 {
+			p.acks[n.ID] = acks
+			return
+		}
+	}
+	if p.findReplacement(b, id) >= 0 {
+		p.acks[id] = acks
+	}
+}
+
+// acknowledges reports whether the node is known
+// to acknowledge the stores.
+func (p *nodeTable) acknowledges(id utils.NodeID) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.acks[id]
+}
+
+// failed counts a request left unanswered by the node, and returns
+// the number of such requests since it was last heard from.
+func (p *nodeTable) failed(id utils.NodeID) int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.seen[id]; !ok {
+		return 0
+	}
+	p.failures[id]++
+	return p.failures[id]
+}
+
+// replaceable reports whether a replacement waits for a node
+// of the bucket of the given ID to be removed.
+func (p *nodeTable) replaceable(id utils.NodeID) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return len(p.replacements[id.Digest.Xor(p.selfid.Digest).Log2int()]) > 0
+}
+
+// lastSeen returns the last time the node was heard from.
+func (p *nodeTable) lastSeen(id utils.NodeID) time.Time {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.seen[id]
+}
+
+// leastRecent returns the least recently seen node of the bucket of the
+// given ID if the bucket is full.
+func (p *nodeTable) leastRecent(id utils.NodeID) (utils.NodeInfo, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	b := id.Digest.Xor(p.selfid.Digest).Log2int()
+	if len(p.buckets[b]) < p.k {
+		return utils.NodeInfo{}, false
+	}
+	return p.buckets[b][0], true
+}
+
+// looked records a lookup of the given ID.
+func (p *nodeTable) looked(id utils.NodeID, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.lookups[id.Digest.Xor(p.selfid.Digest).Log2int()] = now
+}
+
+// staleBuckets returns the buckets which have not been targeted by a
+// lookup since the given time, from the nearest bucket holding a node.
+func (p *nodeTable) staleBuckets(since time.Time) []int {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var list []int
+	near := false
+	for i, b := range p.buckets {
+		if !near && len(b) == 0 {
+			continue
+		}
+		near = true
+		if p.lookups[i].Before(since) {
+			list = append(list, i)
+		}
+	}
+	return list
+}
+
+func (p *nodeTable) isVerified(id utils.NodeID) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.verified[id]
+}
+
+func (p *nodeTable) verifiedNodes(bucket []utils.NodeInfo) []utils.NodeInfo {
+	var n []utils.NodeInfo
+	for _, i := range bucket {
+		if p.verified[i.ID] {
+			n = append(n, i)
+		}
+	}
+	return n
 }
 
 func (p *nodeTable) nodes() []utils.NodeInfo {
@@ -88,23 +388,56 @@ loop:
 	return nodes
 }
 
+// representatives returns up to n verified nodes from distinct buckets,
+// starting with the buckets farthest from this node. The node seen least
+// recently is chosen in each bucket, as it has been known the longest.
+func (p *nodeTable) representatives(n int) []utils.NodeInfo {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var nodes []utils.NodeInfo
+	for i := len(p.buckets) - 1; i >= 0 && len(nodes) < n; i-- {
+		if v := p.verifiedNodes(p.buckets[i]); len(v) > 0 {
+			nodes = append(nodes, v[0])
+		}
+	}
+	return nodes
+}
+
+// neighborhood returns up to k nodes nearest to this node,
+// whether they are verified or not.
+func (p *nodeTable) neighborhood() []utils.NodeInfo {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var nodes []utils.NodeInfo
+	for _, b := range p.buckets {
+		for _, n := range b {
+			if len(nodes) == p.k {
+				return nodes
+			}
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// nearestNodes returns the verified nodes nearest to the given ID.
 func (p *nodeTable) nearestNodes(id utils.NodeID) []utils.NodeInfo {
 	p.mutex.RLock()
 	defer p.mutex.RUnlock()
 	var n []utils.NodeInfo
 	b := id.Digest.Xor(p.selfid.Digest).Log2int()
-	n = append(n, p.buckets[b]...)
+	n = append(n, p.verifiedNodes(p.buckets[b])...)
 	if len(n) > p.k {
 		return n[len(n)-p.k:]
 	}
 	for i := 0; i < bucketSize; i++ {
 		rb := b + i
 		if rb < bucketSize {
-			n = append(n, p.buckets[rb]...)
+			n = append(n, p.verifiedNodes(p.buckets[rb])...)
 		}
 		lb := b - i
 		if lb >= 0 {
-			n = append(n, p.buckets[lb]...)
+			n = append(n, p.verifiedNodes(p.buckets[lb])...)
 		}
 		if len(n) >= p.k {
 			return n[len(n)-p.k:]
@@ -122,5 +455,44 @@ func (p *nodeTable) find(id utils.NodeID) *utils.NodeInfo {
 			return &n
 		}
 	}
+	if i := p.findReplacement(b, id); i >= 0 {
+		n := p.replacements[b][i]
+		return &n
+	}
 	return nil
 }
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		if a == nil {
+			return nil
+		}
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func sameIP(a, b net.IP) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return a.Equal(b)
+}
+
+func sameSubnet(a, b net.IP) bool {
+	a4, b4 := a.To4(), b.To4()
+	if a4 != nil && b4 != nil {
+		return a4.Mask(net.CIDRMask(24, 32)).Equal(b4.Mask(net.CIDRMask(24, 32)))
+	}
+	if a4 != nil || b4 != nil {
+		return false
+	}
+	return a.Mask(net.CIDRMask(64, 128)).Equal(b.Mask(net.CIDRMask(64, 128)))
+}
@@ -2,7 +2,9 @@ package dht
 
 import (
 	"math/big"
+	"net"
 	"testing"
+	"time"
 
 	"github.com/h2so5/murcott/utils"
 )
@@ -41,3 +43,154 @@ func TestNodeTableInsertRemove(t *testing.T) {
 		}
 	}
 }
+
+func TestNodeTableAddrLimits(t *testing.T) {
+	n := newNodeTable(50, utils.NewRandomNodeID(namespace))
+	n.ipLimit = 2
+	n.subnetLimit = 3
+
+	cases := []struct {
+		ip    string
+		admit bool
+	}{
+		{"203.0.113.1", true},
+		{"203.0.113.1", true},
+		{"203.0.113.1", false},
+		{"203.0.113.2", true},
+		{"203.0.113.3", false},
+		{"198.51.100.1", true},
+		{"::1", true},
+		{"::1", true},
+		{"::1", true},
+	}
+	for _, c := range cases {
+		addr := &net.UDPAddr{IP: net.ParseIP(c.ip), Port: 9200}
+		node := utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: addr}
+		if admit := n.insert(node); admit != c.admit {
+			t.Errorf("insert(%s) returns %v; expects %v", c.ip, admit, c.admit)
+		}
+	}
+}
+
+func TestNodeTableVerify(t *testing.T) {
+	n := newNodeTable(50, utils.NewRandomNodeID(namespace))
+	node := utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 9200}}
+	n.insert(node)
+
+	if len(n.nearestNodes(node.ID)) != 0 {
+		t.Errorf("unverified node should not be used for lookups")
+	}
+	n.verify(node.ID)
+	if l := n.nearestNodes(node.ID); len(l) == 0 || !l[0].ID.Match(node.ID) {
+		t.Errorf("nearestNodes() returns %v; expects verified node", l)
+	}
+
+	n.insert(node)
+	if !n.isVerified(node.ID) {
+		t.Errorf("node should stay verified at the same address")
+	}
+	node.Addr = &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 9200}
+	n.insert(node)
+	if n.isVerified(node.ID) {
+		t.Errorf("node should be verified again at a new address")
+	}
+}
+
+func TestNodeTableRepresentatives(t *testing.T) {
+	var zero [20]byte
+	n := newNodeTable(50, utils.NewNodeID(namespace, zero))
+	for i := 0; i < 20; i++ {
+		var id [20]byte
+		b := new(big.Int).Lsh(big.NewInt(1), uint(i)).Bytes()
+		copy(id[len(id)-len(b):], b)
+		node := utils.NodeInfo{ID: utils.NewNodeID(namespace, id)}
+		n.insert(node)
+		if i%2 == 0 {
+			n.verify(node.ID)
+		}
+	}
+
+	l := n.representatives(3)
+	if len(l) != 3 {
+		t.Fatalf("representatives() returns %d nodes; expects 3", len(l))
+	}
+	buckets := make(map[int]bool)
+	for _, node := range l {
+		if !n.isVerified(node.ID) {
+			t.Errorf("representatives() returns an unverified node")
+		}
+		b := node.ID.Digest.Xor(n.selfid.Digest).Log2int()
+		if buckets[b] {
+			t.Errorf("representatives() returns two nodes of bucket %d", b)
+		}
+		buckets[b] = true
+	}
+}
+
+func TestNodeTableReplacements(t *testing.T) {
+	var zero [20]byte
+	n := newNodeTable(2, utils.NewNodeID(namespace, zero))
+	nodes := make([]utils.NodeInfo, 3)
+	for i := range nodes {
+		var id [20]byte
+		id[0] = 0x80
+		id[19] = byte(i)
+		nodes[i] = utils.NodeInfo{ID: utils.NewNodeID(namespace, id)}
+	}
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	n.insert(a)
+	n.insert(b)
+	n.verify(a.ID)
+	n.verify(b.ID)
+
+	n.insert(c)
+	if !n.isReplacement(c.ID) || n.find(c.ID) == nil {
+		t.Errorf("%s should be kept as a replacement", c.ID.String())
+	}
+	if l := n.nearestNodes(c.ID); len(l) != 2 {
+		t.Errorf("nearestNodes() returns %d nodes; expects 2", len(l))
+	}
+	if l, ok := n.leastRecent(c.ID); !ok || !l.ID.Match(a.ID) {
+		t.Errorf("leastRecent() returns %v; expects %v", l.ID, a.ID)
+	}
+	n.insert(a)
+	if l, _ := n.leastRecent(c.ID); !l.ID.Match(b.ID) {
+		t.Errorf("leastRecent() returns %v; expects %v", l.ID, b.ID)
+	}
+
+	if r, ok := n.remove(b.ID); !ok || !r.ID.Match(c.ID) {
+		t.Errorf("remove() returns %v; expects %v", r.ID, c.ID)
+	}
+	if n.isReplacement(c.ID) || n.find(c.ID) == nil {
+		t.Errorf("%s should replace the removed node", c.ID.String())
+	}
+	if n.failed(c.ID) != 1 || n.failed(c.ID) != 2 {
+		t.Errorf("failed() should count the unanswered requests")
+	}
+	n.insert(c)
+	if n.failed(c.ID) != 1 {
+		t.Errorf("failed() should restart once the node is seen")
+	}
+}
+
+func TestNodeTableStaleBuckets(t *testing.T) {
+	var zero [20]byte
+	n := newNodeTable(2, utils.NewNodeID(namespace, zero))
+	var id [20]byte
+	id[0] = 0x01
+	node := utils.NodeInfo{ID: utils.NewNodeID(namespace, id)}
+	n.insert(node)
+	b := node.ID.Digest.Xor(n.selfid.Digest).Log2int()
+
+	now := time.Now()
+	l := n.staleBuckets(now)
+	if len(l) != bucketSize-b || l[0] != b {
+		t.Errorf("staleBuckets() returns %v; expects buckets from %d", l, b)
+	}
+	n.looked(node.ID, now)
+	for _, i := range n.staleBuckets(now) {
+		if i == b {
+			t.Errorf("bucket %d should not be stale after a lookup", b)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"errors"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// DefaultReplication is the default number of nodes which must
+// acknowledge a value published by this node.
+const DefaultReplication = 3
+
+// SetReplication sets the number of nodes which must acknowledge a value
+// published by this node. Zero uses DefaultReplication.
+func (p *DHT) SetReplication(n int) {
+	if n <= 0 {
+		n = DefaultReplication
+	}
+	p.chmapMutex.Lock()
+	defer p.chmapMutex.Unlock()
+	p.replication = n
+}
+
+// ackStore acknowledges a store accepted by this node.
+func (p *DHT) ackStore(c *dhtRPCCommand) {
+	p.sendPacket(c.Src, p.newRPCReturnCommand(c.ID, nil))
+}
+
+// rejectStore answers a store rejected by this node with an error, so
+// that the sender does not wait for an acknowledgement.
+func (p *DHT) rejectStore(c *dhtRPCCommand) {
+	p.sendPacket(c.Src, p.newRPCReturnCommand(c.ID, map[string]interface{}{
+		"error": "store rejected",
+	}))
+}
+
+// isStore reports whether the method stores a value.
+func isStore(method string) bool {
+	switch method {
+	case protocol.RPCStore, protocol.RPCStoreNode, protocol.RPCStoreSet, protocol.RPCStoreMulti:
+		return true
+	}
+	return false
+}
+
+// storeResult is the outcome of a store sent to a node.
+type storeResult struct {
+	id  utils.NodeID
+	err error
+}
+
+// replicateStore sends a value published by this node to the k nodes
+// nearest to its key, and waits for their acknowledgements. Each node
+// which fails or rejects the value is replaced by the next nearest node met
+// by the lookup, until the replication factor is reached or there is no
+// candidate left. The nodes of older versions, which do not acknowledge
+// the stores, are sent the value without waiting and are counted as
+// holding it. It returns the number of nodes which hold the value.
+func (p *DHT) replicateStore(key, method, value string) int {
+	p.chmapMutex.Lock()
+	r := p.replication
+	p.chmapMutex.Unlock()
+
+	candidates := p.lookupNodes(p.keyID(key))
+	n := p.k
+	if r > n {
+		n = r
+	}
+	if n > len(candidates) {
+		n = len(candidates)
+	}
+
+	args := map[string]interface{}{
+		"key":   key,
+		"value": value,
+	}
+	ch := make(chan storeResult, len(candidates))
+	legacy := 0
+	send := func(id utils.NodeID) bool {
+		if !p.table.acknowledges(id) {
+			p.sendPacket(id, p.newRPCCommand(method, args))
+			legacy++
+			return false
+		}
+		go func() {
+			ret, err := p.sendAndWaitPacket(id, p.newRPCCommand(method, args))
+			if err == nil {
+				if msg, ok := ret.command.Args["error"].(string); ok {
+					err = errors.New(msg)
+				}
+			}
+			ch <- storeResult{id: id, err: err}
+		}()
+		return true
+	}
+	pending := 0
+	for _, c := range candidates[:n] {
+		if send(c.ID) {
+			pending++
+		}
+	}
+
+	next, acked := n, 0
+	for pending > 0 {
+		res := <-ch
+		pending--
+		if res.err == nil {
+			acked++
+			continue
+		}
+		for acked+legacy+pending < r && next < len(candidates) {
+			next++
+			if send(candidates[next-1].ID) {
+				pending++
+				break
+			}
+		}
+	}
+
+	if acked+legacy < r {
+		p.rpcs.underReplicated()
+		p.logger.Info("%s: %s is stored on %d nodes; expects %d", p.net.String(), key, acked+legacy, r)
+	}
+	return acked + legacy
+}
@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestReplicateStore(t *testing.T) {
+	dhts := newTestDHTs(t, 5)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+	d := dhts[0]
+	d.k = 1
+	d.SetRetryPolicy(utils.RetryPolicy{Timeout: 100 * time.Millisecond, Attempts: 1})
+
+	key := "replicated"
+	candidates := d.lookupNodes(d.keyID(key))
+	if len(candidates) != 4 {
+		t.Fatalf("lookupNodes() returns %d nodes; expects 4", len(candidates))
+	}
+	for _, o := range dhts[1:] {
+		if o.id.Match(candidates[0].ID) {
+			o.Close()
+		}
+	}
+
+	// The nearest node does not answer, so the store
+	// is sent to the third nearest one instead.
+	d.SetReplication(2)
+	if n := d.replicateStore(key, protocol.RPCStore, "value"); n != 2 {
+		t.Errorf("replicateStore() returns %d; expects 2", n)
+	}
+	stored := 0
+	for _, o := range dhts[1:] {
+		if _, ok := o.getValue(key); ok {
+			stored++
+		}
+	}
+	if stored != 2 {
+		t.Errorf("the value is stored on %d nodes; expects 2", stored)
+	}
+	if s := d.Stats(); s.UnderReplicated != 0 {
+		t.Errorf("Stats() returns %d under-replicated values; expects 0", s.UnderReplicated)
+	}
+
+	d.SetReplication(10)
+	if n := d.replicateStore(key, protocol.RPCStore, "value"); n != 3 {
+		t.Errorf("replicateStore() returns %d; expects 3", n)
+	}
+	if s := d.Stats(); s.UnderReplicated != 1 {
+		t.Errorf("Stats() returns %d under-replicated values; expects 1", s.UnderReplicated)
+	}
+}
+
+func TestReplicateStoreRejected(t *testing.T) {
+	dhts := newTestDHTs(t, 4)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+	d := dhts[0]
+	d.SetRetryPolicy(utils.RetryPolicy{Timeout: time.Second, Attempts: 1})
+	d.SetReplication(3)
+
+	// Invalid signed records are rejected by every node,
+	// which answers at once and is not counted as failed.
+	key := SignedKey(utils.GeneratePrivateKey().Digest(), "name")
+	start := time.Now()
+	if n := d.replicateStore(key, protocol.RPCStore, "invalid"); n != 0 {
+		t.Errorf("replicateStore() returns %d; expects 0", n)
+	}
+	if time.Since(start) >= time.Second {
+		t.Errorf("replicateStore() waits for the timeout of rejected stores")
+	}
+	for _, o := range dhts[1:] {
+		d.table.mutex.RLock()
+		f := d.table.failures[o.id]
+		d.table.mutex.RUnlock()
+		if f != 0 {
+			t.Errorf("a rejected store is counted as %d failures; expects 0", f)
+		}
+	}
+
+	// A node which does not acknowledge the stores is
+	// sent the value without being waited for.
+	legacy := dhts[1]
+	d.table.setAcks(legacy.id, false)
+	if n := d.replicateStore("legacy", protocol.RPCStore, "value"); n != 3 {
+		t.Errorf("replicateStore() returns %d; expects 3", n)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := legacy.getValue("legacy"); !ok {
+		t.Errorf("the value is not sent to the node which does not acknowledge it")
+	}
+}
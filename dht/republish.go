@@ -0,0 +1,358 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// ValueTTL is the time after its publication at which a stored value
+	// expires, unless its publisher has stored it again.
+	ValueTTL = 24 * time.Hour
+
+	// republishInterval is the interval at which the values originated by
+	// this node are stored again, so that they do not expire.
+	republishInterval = 12 * time.Hour
+
+	// replicateInterval is the interval at which the stored values are
+	// sent to the nodes nearest to their keys. A value which has been
+	// received within the interval is skipped, as its sender has sent it
+	// to the other nearest nodes as well.
+	replicateInterval = time.Hour
+)
+
+// valueMeta describes a value held by this node. Values restored from a
+// persistent store have no method, and are expired but not replicated.
+type valueMeta struct {
+	method    string
+	published time.Time
+	refreshed time.Time
+}
+
+// origin is a value stored by this node as its publisher.
+type origin struct {
+	method    string
+	value     string
+	published time.Time
+}
+
+func (p *DHT) keyID(key string) utils.NodeID {
+	return utils.NewNodeID(p.id.NS, sha1.Sum([]byte(key)))
+}
+
+// valueAge returns the time elapsed since the publication of a value sent
+// by another node. It reports false if the value has already expired.
+func valueAge(c *dhtRPCCommand) (time.Duration, bool) {
+	var sec int64
+	c.getArgs("age", &sec)
+	age := time.Duration(sec) * time.Second
+	if age < 0 {
+		age = 0
+	}
+	return age, age < ValueTTL
+}
+
+// touch records that the value at the key has been stored with the method,
+// age after its publication. A later publication is kept.
+func (p *DHT) touch(key, method string, age time.Duration) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+	now := time.Now()
+	m := p.meta[key]
+	m.method = method
+	m.refreshed = now
+	if published := now.Add(-age); published.After(m.published) {
+		m.published = published
+	}
+	p.meta[key] = m
+}
+
+// originate records a value published by this node, to be stored again
+// before it expires. The values of a set or of a multi-value key are
+// added to those published before.
+func (p *DHT) originate(key, method, value string) {
+	p.originMutex.Lock()
+	defer p.originMutex.Unlock()
+	if o, ok := p.origins[key]; ok && o.method == protocol.RPCStoreSet && method == o.method {
+		var set, values []string
+		msgpack.Unmarshal([]byte(o.value), &set)
+		msgpack.Unmarshal([]byte(value), &values)
+		if b, err := msgpack.Marshal(mergeValues(set, values)); err == nil {
+			value = string(b)
+		}
+	}
+	if o, ok := p.origins[key]; ok && o.method == protocol.RPCStoreMulti && method == o.method {
+		// The TTL of the values is kept, as they are refreshed each
+		// time they are stored again.
+		now := time.Now()
+		value = encodeMultiValues(mergeMultiValues(decodeMultiValues(o.value, now), decodeMultiValues(value, now), now), now)
+	}
+	p.origins[key] = origin{method: method, value: value, published: time.Now()}
+}
+
+// Unpublish stops storing again the value published by this node at the
+// key, which expires on the other nodes after ValueTTL.
+func (p *DHT) Unpublish(key string) {
+	p.originMutex.Lock()
+	defer p.originMutex.Unlock()
+	delete(p.origins, key)
+}
+
+// store sends a value published by this node to the nodes nearest to its
+// key until the replication factor is reached. Nodes, sets and
+// multi-values are merged into the copy held by this node as well.
+func (p *DHT) store(key, method, value string) {
+	p.replicateStore(key, method, value)
+
+	switch method {
+	case protocol.RPCStoreNode:
+		var nodes []utils.NodeInfo
+		msgpack.Unmarshal([]byte(value), &nodes)
+		p.mergeNodes(key, nodes)
+		p.touch(key, method, 0)
+	case protocol.RPCStoreSet:
+		var values []string
+		msgpack.Unmarshal([]byte(value), &values)
+		p.mergeSet(key, values)
+		p.touch(key, method, 0)
+	case protocol.RPCStoreMulti:
+		p.mergeMulti(key, decodeMultiValues(value, time.Now()))
+		p.touch(key, method, 0)
+	}
+}
+
+func (p *DHT) sendStore(key, method, value string, age time.Duration, nodes []utils.NodeInfo) {
+	// The age is always sent, as it marks the value as a copy
+	// rather than a value sent by its publisher.
+	args := map[string]interface{}{
+		"key":   key,
+		"value": value,
+		"age":   int64(age / time.Second),
+	}
+	c := p.newRPCCommand(method, args)
+	for _, n := range nodes {
+		p.sendPacket(n.ID, c)
+	}
+}
+
+// Maintain applies the Kademlia store rules: it removes the expired values,
+// stores again the values published by this node, and sends the values
+// which have not been received lately to the nodes nearest to their keys.
+// It is called periodically, and only sends the values which are due.
+func (p *DHT) Maintain(now time.Time) {
+	p.expireValues(now)
+	p.republish(now)
+	p.replicate(now)
+}
+
+func (p *DHT) expireValues(now time.Time) {
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+	keys := make(map[string]bool)
+	for _, key := range p.kvs.Keys() {
+		keys[key] = true
+		m, ok := p.meta[key]
+		if !ok {
+			p.meta[key] = valueMeta{published: now, refreshed: now}
+			continue
+		}
+		if now.Sub(m.published) >= ValueTTL || m.method == protocol.RPCStoreMulti && !p.expireMulti(key, now) {
+			err := p.kvs.Delete(key)
+			if err != nil {
+				p.logger.Error("store: %v", err)
+			}
+			delete(p.meta, key)
+		}
+	}
+	for key := range p.meta {
+		if !keys[key] {
+			delete(p.meta, key)
+		}
+	}
+}
+
+func (p *DHT) republish(now time.Time) {
+	var due []string
+	var origins []origin
+	p.originMutex.Lock()
+	for key, o := range p.origins {
+		if now.Sub(o.published) >= republishInterval {
+			o.published = now
+			p.origins[key] = o
+			due = append(due, key)
+			origins = append(origins, o)
+		}
+	}
+	p.originMutex.Unlock()
+
+	for i, key := range due {
+		p.store(key, origins[i].method, origins[i].value)
+	}
+}
+
+func (p *DHT) replicate(now time.Time) {
+	due := make(map[string]valueMeta)
+	p.kvsMutex.Lock()
+	for key, m := range p.meta {
+		if m.method != "" && now.Sub(m.refreshed) >= replicateInterval {
+			due[key] = m
+			m.refreshed = now
+			p.meta[key] = m
+		}
+	}
+	p.kvsMutex.Unlock()
+
+	for key, m := range due {
+		age := now.Sub(m.published)
+		if age >= ValueTTL {
+			continue
+		}
+		value, ok := p.sendableValue(key, m.method)
+		if !ok {
+			continue
+		}
+		var nodes []utils.NodeInfo
+		for _, n := range p.table.nearestNodes(p.keyID(key)) {
+			if p.table.isVerified(n.ID) {
+				nodes = append(nodes, n)
+			}
+		}
+		p.sendStore(key, m.method, value, age, nodes)
+	}
+}
+
+// handoff sends to a node which has joined the routing table the values
+// whose keys it is among the nearest nodes to. Only the node nearest to
+// the key among the other nodes sends a value, so that the new node does
+// not receive it from all of them.
+func (p *DHT) handoff(node utils.NodeInfo) {
+	now := time.Now()
+	due := make(map[string]valueMeta)
+	p.kvsMutex.RLock()
+	for key, m := range p.meta {
+		if m.method != "" && now.Sub(m.published) < ValueTTL {
+			due[key] = m
+		}
+	}
+	p.kvsMutex.RUnlock()
+
+	for key, m := range due {
+		keyid := p.keyID(key)
+		if !p.nearestHolder(keyid, node.ID) {
+			continue
+		}
+		value, ok := p.sendableValue(key, m.method)
+		if !ok {
+			continue
+		}
+		p.sendStore(key, m.method, value, now.Sub(m.published), []utils.NodeInfo{node})
+	}
+}
+
+// nearestHolder reports whether the node is among the nodes nearest to
+// the key, and this node is nearer to it than the others.
+func (p *DHT) nearestHolder(keyid, id utils.NodeID) bool {
+	dist := p.id.Digest.Xor(keyid.Digest)
+	found := false
+	for _, n := range p.table.nearestNodes(keyid) {
+		if n.ID.Digest.Cmp(id.Digest) == 0 {
+			found = true
+		} else if dist.Cmp(n.ID.Digest.Xor(keyid.Digest)) == 1 {
+			return false
+		}
+	}
+	return found
+}
+
+// Record is a value held by the DHT, as carried between disconnected
+// networks. Age is the time elapsed since its publication.
+type Record struct {
+	Key    string        `msgpack:"key"`
+	Value  string        `msgpack:"value"`
+	Method string        `msgpack:"method"`
+	Age    time.Duration `msgpack:"age"`
+}
+
+// Records returns the values held by this node which have not expired,
+// and the values published by this node which are not held by it. The
+// TTL of the multi-values held by this node is relative to the time of
+// the call, so that their records have no age.
+func (p *DHT) Records() []Record {
+	now := time.Now()
+	held := make(map[string]bool)
+	var list []Record
+	p.kvsMutex.RLock()
+	for key, m := range p.meta {
+		age := now.Sub(m.published)
+		if m.method == "" || age >= ValueTTL {
+			continue
+		}
+		v, ok := p.kvs.Get(key)
+		if ok && m.method == protocol.RPCStoreMulti {
+			v, ok = multiValueArgs(v, now)
+			age = 0
+		}
+		if ok {
+			held[key] = true
+			list = append(list, Record{Key: key, Value: v, Method: m.method, Age: age})
+		}
+	}
+	p.kvsMutex.RUnlock()
+
+	p.originMutex.Lock()
+	defer p.originMutex.Unlock()
+	for key, o := range p.origins {
+		if !held[key] {
+			list = append(list, Record{Key: key, Value: o.value, Method: o.method, Age: now.Sub(o.published)})
+		}
+	}
+	return list
+}
+
+// ImportRecord holds a record carried from another network. It is sent
+// to the nodes nearest to its key at the next maintenance, and expires
+// with the original value.
+func (p *DHT) ImportRecord(r Record) error {
+	if r.Age < 0 {
+		r.Age = 0
+	}
+	if r.Age >= ValueTTL {
+		return errors.New("record expired")
+	}
+	if !p.acceptStore(r.Key, r.Method, r.Value) {
+		return errors.New("invalid signed record")
+	}
+	switch r.Method {
+	case protocol.RPCStore:
+		p.putValue(r.Key, r.Value)
+	case protocol.RPCStoreNode:
+		var nodes []utils.NodeInfo
+		if err := msgpack.Unmarshal([]byte(r.Value), &nodes); err != nil {
+			return err
+		}
+		p.mergeNodes(r.Key, nodes)
+	case protocol.RPCStoreSet:
+		var values []string
+		if err := msgpack.Unmarshal([]byte(r.Value), &values); err != nil {
+			return err
+		}
+		p.mergeSet(r.Key, values)
+	case protocol.RPCStoreMulti:
+		p.mergeMulti(r.Key, decodeMultiValues(r.Value, time.Now().Add(-r.Age)))
+	default:
+		return errors.New("unknown record method: " + r.Method)
+	}
+	p.touch(r.Key, r.Method, r.Age)
+
+	p.kvsMutex.Lock()
+	defer p.kvsMutex.Unlock()
+	m := p.meta[r.Key]
+	m.refreshed = time.Time{}
+	p.meta[r.Key] = m
+	return nil
+}
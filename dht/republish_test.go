@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestValueExpiration(t *testing.T) {
+	dhts := newTestDHTs(t, 2)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[0].StoreValue("key", "value")
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[1].getValue("key"); !ok {
+		t.Fatalf("StoreValue() should store the value on the nearest node")
+	}
+
+	dhts[1].Maintain(time.Now().Add(ValueTTL))
+	if _, ok := dhts[1].getValue("key"); ok {
+		t.Errorf("Maintain() should remove an expired value")
+	}
+	dhts[1].kvsMutex.RLock()
+	keys := dhts[1].kvs.Keys()
+	dhts[1].kvsMutex.RUnlock()
+	if len(keys) != 0 {
+		t.Errorf("Keys() returns %v; expects none", keys)
+	}
+
+	dhts[0].Maintain(time.Now().Add(republishInterval))
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[1].getValue("key"); !ok {
+		t.Errorf("Maintain() should store again a value published by the node")
+	}
+
+	dhts[0].Unpublish("key")
+	dhts[1].Maintain(time.Now().Add(ValueTTL))
+	dhts[0].Maintain(time.Now().Add(2 * republishInterval))
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[1].getValue("key"); ok {
+		t.Errorf("Maintain() should not store again an unpublished value")
+	}
+}
+
+func TestValueReplication(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[1].putValue("key", "value")
+	dhts[1].touch("key", protocol.RPCStore, time.Hour)
+
+	dhts[1].Maintain(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[2].getValue("key"); ok {
+		t.Errorf("Maintain() should not replicate a value received lately")
+	}
+
+	dhts[1].Maintain(time.Now().Add(replicateInterval))
+	time.Sleep(100 * time.Millisecond)
+	if v, ok := dhts[2].getValue("key"); !ok || v != "value" {
+		t.Fatalf("getValue() returns %q; expects value", v)
+	}
+
+	// The replica expires with the original value.
+	dhts[2].Maintain(time.Now().Add(ValueTTL - time.Hour))
+	if _, ok := dhts[2].getValue("key"); ok {
+		t.Errorf("Maintain() should expire a replica after its publication")
+	}
+}
+
+func TestValueHandoff(t *testing.T) {
+	dhts := newTestDHTs(t, 2)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	if !dhts[1].nearestHolder(dhts[1].keyID("key"), dhts[0].id) {
+		t.Fatalf("nearestHolder() returns false for the only other node")
+	}
+	dhts[1].putValue("key", "value")
+	dhts[1].touch("key", protocol.RPCStore, 0)
+	dhts[1].handoff(*dhts[1].GetNodeInfo(dhts[0].id))
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[0].getValue("key"); !ok {
+		t.Errorf("handoff() should send the value to the new node")
+	}
+}
+
+func TestRecordImport(t *testing.T) {
+	dhts := newTestDHTs(t, 2)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[0].StoreValue("key", "value")
+	records := dhts[0].Records()
+	if len(records) != 1 || records[0].Value != "value" || records[0].Method != protocol.RPCStore {
+		t.Fatalf("Records() returns %v; expects the published value", records)
+	}
+
+	r := Record{Key: "set", Value: string(mustMarshal(t, []string{"a"})), Method: protocol.RPCStoreSet, Age: time.Hour}
+	if err := dhts[1].ImportRecord(r); err != nil {
+		t.Fatalf("ImportRecord() returns %v; expects nil", err)
+	}
+	if set := dhts[1].LoadSet("set"); len(set) != 1 || set[0] != "a" {
+		t.Errorf("LoadSet() returns %v; expects [a]", set)
+	}
+	r.Age = ValueTTL
+	if dhts[1].ImportRecord(r) == nil {
+		t.Errorf("ImportRecord() should reject an expired record")
+	}
+
+	dhts[1].Maintain(time.Now())
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := dhts[0].getValue("set"); !ok {
+		t.Errorf("Maintain() should replicate an imported record")
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
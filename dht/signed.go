@@ -0,0 +1,164 @@
+package dht
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// signedPrefix starts the keys of the signed records, which are followed
+// by the digest of the key of their owner and by their name.
+const signedPrefix = "signed:"
+
+// SignedRecord is a value which can only be stored by the owner of the
+// key it is stored at. The nodes storing it verify its signature and
+// keep the latest record, and the lookups skip the records which do
+// not verify, so that the records cannot be spoofed or replayed.
+type SignedRecord struct {
+	Key   string          `msgpack:"key"`
+	Value string          `msgpack:"value"`
+	Time  int64           `msgpack:"time"`
+	Owner utils.PublicKey `msgpack:"owner"`
+	Sign  utils.Signature `msgpack:"sign"`
+}
+
+// SignedKey returns the key of the signed record of the given name
+// owned by the node with the given digest.
+func SignedKey(owner utils.PublicKeyDigest, name string) string {
+	return signedPrefix + owner.String() + ":" + name
+}
+
+func isSignedKey(key string) bool {
+	return strings.HasPrefix(key, signedPrefix)
+}
+
+func (r *SignedRecord) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		r.Key,
+		r.Value,
+		r.Time,
+	})
+	return data
+}
+
+func (r *SignedRecord) sign(key *utils.PrivateKey) error {
+	r.Owner = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign record")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Verify checks that the record is stored at the given key
+// and signed by the owner of the key.
+func (r *SignedRecord) Verify(key string) error {
+	if r.Key != key {
+		return errors.New("record of another key")
+	}
+	rest := strings.TrimPrefix(key, signedPrefix)
+	i := strings.Index(rest, ":")
+	if !isSignedKey(key) || i < 0 || rest[:i] != r.Owner.Digest().String() {
+		return errors.New("record signed by wrong key")
+	}
+	if !r.Owner.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid record signature")
+	}
+	return nil
+}
+
+// DecodeSigned decodes and verifies the signed record at the key.
+func DecodeSigned(key, value string) (*SignedRecord, error) {
+	var r SignedRecord
+	err := msgpack.Unmarshal([]byte(value), &r)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Verify(key)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// validValue reports whether a value found at the key can be used.
+// The values of the signed keys must be records signed by their owner.
+func validValue(key, value string) bool {
+	if !isSignedKey(key) {
+		return true
+	}
+	_, err := DecodeSigned(key, value)
+	return err == nil
+}
+
+// acceptStore reports whether a value sent with the method may be stored
+// at the key. A signed record must verify and must not be older than the
+// record already held, and signed keys cannot hold nodes or sets. A key
+// holding multi-values only accepts multi-values, and the other keys do
+// not accept them, so that the values of several publishers cannot be
+// replaced by a single value.
+func (p *DHT) acceptStore(key, method, value string) bool {
+	p.kvsMutex.RLock()
+	m, ok := p.meta[key]
+	p.kvsMutex.RUnlock()
+	if ok && m.method != "" && (m.method == protocol.RPCStoreMulti) != (method == protocol.RPCStoreMulti) {
+		return false
+	}
+	if !isSignedKey(key) {
+		return true
+	}
+	if method != protocol.RPCStore {
+		return false
+	}
+	r, err := DecodeSigned(key, value)
+	if err != nil {
+		p.logger.Error("store: %v", err)
+		return false
+	}
+	if v, ok := p.getValue(key); ok {
+		if old, err := DecodeSigned(key, v); err == nil && old.Time > r.Time {
+			return false
+		}
+	}
+	return true
+}
+
+// StoreSigned stores a record of the given name signed with the key,
+// which can be loaded by LoadSigned with the digest of the key.
+func (p *DHT) StoreSigned(name, value string, key *utils.PrivateKey) error {
+	r := SignedRecord{
+		Key:   SignedKey(key.Digest(), name),
+		Value: value,
+		Time:  time.Now().UnixNano(),
+	}
+	err := r.sign(key)
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	p.StoreValue(r.Key, string(data))
+	return nil
+}
+
+// LoadSigned returns the value of the record of the given name
+// signed by the owner.
+func (p *DHT) LoadSigned(owner utils.PublicKeyDigest, name string) *string {
+	key := SignedKey(owner, name)
+	str := p.LoadValue(key)
+	if str == nil {
+		return nil
+	}
+	r, err := DecodeSigned(key, *str)
+	if err != nil {
+		return nil
+	}
+	return &r.Value
+}
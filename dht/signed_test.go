@@ -0,0 +1,79 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func signedRecord(t *testing.T, key *utils.PrivateKey, name, value string, tm time.Time) (string, string) {
+	r := SignedRecord{Key: SignedKey(key.Digest(), name), Value: value, Time: tm.UnixNano()}
+	if err := r.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.Key, string(data)
+}
+
+func TestSignedRecord(t *testing.T) {
+	owner := utils.GeneratePrivateKey()
+	other := utils.GeneratePrivateKey()
+	d := NewDHT(10, utils.NewRandomNodeID(namespace), utils.NewRandomNodeID(namespace), nil, log.NewLogger())
+
+	key, value := signedRecord(t, owner, "addr", "new", time.Now())
+	if !d.acceptStore(key, protocol.RPCStore, value) {
+		t.Errorf("acceptStore() returns false for a record signed by the owner")
+	}
+	d.putValue(key, value)
+
+	_, old := signedRecord(t, owner, "addr", "old", time.Now().Add(-time.Minute))
+	if d.acceptStore(key, protocol.RPCStore, old) {
+		t.Errorf("acceptStore() should reject a record older than the stored one")
+	}
+
+	_, spoofed := signedRecord(t, other, "addr", "spoofed", time.Now())
+	if d.acceptStore(key, protocol.RPCStore, spoofed) {
+		t.Errorf("acceptStore() should reject a record signed by another key")
+	}
+	if validValue(key, spoofed) {
+		t.Errorf("validValue() should reject a record signed by another key")
+	}
+	if d.acceptStore(key, protocol.RPCStore, "plain") {
+		t.Errorf("acceptStore() should reject a plain value at a signed key")
+	}
+	if d.acceptStore(key, protocol.RPCStoreSet, value) {
+		t.Errorf("acceptStore() should reject a set at a signed key")
+	}
+	if !d.acceptStore("plain", protocol.RPCStore, "value") {
+		t.Errorf("acceptStore() should accept a plain value at a plain key")
+	}
+}
+
+func TestSignedStoreLoad(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	owner := utils.GeneratePrivateKey()
+	if err := dhts[0].StoreSigned("addr", "value", owner); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	_, spoofed := signedRecord(t, utils.GeneratePrivateKey(), "addr", "spoofed", time.Now())
+	key := SignedKey(owner.Digest(), "addr")
+	dhts[0].sendStore(key, protocol.RPCStore, spoofed, 0, dhts[0].FindNearestNode(dhts[0].keyID(key)))
+	time.Sleep(100 * time.Millisecond)
+
+	if v := dhts[2].LoadSigned(owner.Digest(), "addr"); v == nil || *v != "value" {
+		t.Errorf("LoadSigned() returns %v; expects value", v)
+	}
+}
@@ -0,0 +1,176 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+)
+
+// latencyWeight is the weight of each round-trip time
+// in the moving average of the latency.
+const latencyWeight = 0.1
+
+// UnknownMethod is the method under which the requests
+// of the methods other than the known RPCs are counted.
+const UnknownMethod = "unknown"
+
+// Stats describes the health of a DHT.
+type Stats struct {
+	// Buckets holds the number of nodes of each bucket of the routing
+	// table. The nodes of bucket i share the bits of the ID of this node
+	// above bit i.
+	Buckets []int
+
+	// Nodes is the number of nodes in the routing table, Verified the
+	// number of those which have answered, and Replacements the number
+	// of nodes which wait for a place in a full bucket.
+	Nodes        int
+	Verified     int
+	Replacements int
+
+	// Keys is the number of keys whose values are held by this node.
+	Keys int
+
+	// Sent and Received count the requests by method. The requests
+	// of unknown methods are counted under UnknownMethod.
+	Sent     map[string]int
+	Received map[string]int
+
+	// Timeouts is the number of requests left unanswered after all
+	// their attempts.
+	Timeouts int
+
+	// UnderReplicated is the number of values published by this node
+	// which fewer nodes than the replication factor have acknowledged.
+	UnderReplicated int
+
+	// Limited is the number of packets dropped by the guard,
+	// from banned addresses or beyond the rate of their peer.
+	Limited int
+
+	// Latency is the moving average of the round-trip time
+	// of the answered requests.
+	Latency time.Duration
+}
+
+// rpcStats counts the requests of a DHT.
+type rpcStats struct {
+	sent     map[string]int
+	received map[string]int
+	timeouts int
+	limited  int
+	under    int
+	latency  time.Duration
+	mutex    sync.Mutex
+}
+
+// knownMethod reports whether the method is one of the DHT RPCs.
+func knownMethod(method string) bool {
+	switch method {
+	case protocol.RPCPing, protocol.RPCFindNode, protocol.RPCFindValue,
+		protocol.RPCStore, protocol.RPCStoreNode, protocol.RPCStoreSet,
+		protocol.RPCStoreMulti, protocol.RPCFindValues:
+		return true
+	}
+	return false
+}
+
+// request counts a request sent or received with the method, so that the
+// number of counters is bounded. Responses, which have no method, are not
+// counted.
+func (s *rpcStats) request(method string, sent bool) {
+	if method == "" {
+		return
+	}
+	if !knownMethod(method) {
+		method = UnknownMethod
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.sent == nil {
+		s.sent = make(map[string]int)
+		s.received = make(map[string]int)
+	}
+	if sent {
+		s.sent[method]++
+	} else {
+		s.received[method]++
+	}
+}
+
+func (s *rpcStats) answered(rtt time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.latency == 0 {
+		s.latency = rtt
+		return
+	}
+	s.latency += time.Duration(latencyWeight * float64(rtt-s.latency))
+}
+
+func (s *rpcStats) timedOut() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.timeouts++
+}
+
+func (s *rpcStats) limit() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.limited++
+}
+
+func (s *rpcStats) underReplicated() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.under++
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	c := make(map[string]int, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// occupancy returns the number of nodes of each bucket, of the verified
+// nodes and of the replacements.
+func (p *nodeTable) occupancy() (buckets []int, verified, replacements int) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	buckets = make([]int, len(p.buckets))
+	for i, b := range p.buckets {
+		buckets[i] = len(b)
+		verified += len(p.verifiedNodes(b))
+	}
+	for _, r := range p.replacements {
+		replacements += len(r)
+	}
+	return buckets, verified, replacements
+}
+
+// Stats returns the occupancy of the routing table, the number of keys
+// held by this node and the counters of the requests.
+func (p *DHT) Stats() Stats {
+	var s Stats
+	s.Buckets, s.Verified, s.Replacements = p.table.occupancy()
+	for _, n := range s.Buckets {
+		s.Nodes += n
+	}
+
+	p.kvsMutex.RLock()
+	s.Keys = len(p.kvs.Keys())
+	p.kvsMutex.RUnlock()
+
+	p.rpcs.mutex.Lock()
+	defer p.rpcs.mutex.Unlock()
+	s.Sent = copyCounts(p.rpcs.sent)
+	s.Received = copyCounts(p.rpcs.received)
+	s.Timeouts = p.rpcs.timeouts
+	s.Limited = p.rpcs.limited
+	s.UnderReplicated = p.rpcs.under
+	s.Latency = p.rpcs.latency
+	return s
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+)
+
+func TestStats(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	dhts[0].StoreValue("key", "value")
+	time.Sleep(100 * time.Millisecond)
+
+	s := dhts[0].Stats()
+	if len(s.Buckets) != bucketSize {
+		t.Errorf("Stats() returns %d buckets; expects %d", len(s.Buckets), bucketSize)
+	}
+	if s.Nodes == 0 || s.Verified == 0 || s.Verified > s.Nodes {
+		t.Errorf("Stats() returns %d nodes and %d verified; expects some verified nodes", s.Nodes, s.Verified)
+	}
+	if s.Sent[protocol.RPCFindNode] == 0 || s.Sent[protocol.RPCStore] == 0 {
+		t.Errorf("Stats() returns %v sent requests; expects find-node and store", s.Sent)
+	}
+	if s.Latency <= 0 {
+		t.Errorf("Stats() returns latency %v; expects a positive latency", s.Latency)
+	}
+	if n := dhts[1].Stats().Received[protocol.RPCStore]; n != 1 {
+		t.Errorf("Stats() returns %d received stores; expects 1", n)
+	}
+	if k := dhts[1].Stats().Keys; k != 1 {
+		t.Errorf("Stats() returns %d keys; expects 1", k)
+	}
+
+	var r rpcStats
+	r.request("no-such-method", false)
+	r.request("other-method", false)
+	if len(r.received) != 1 || r.received[UnknownMethod] != 2 {
+		t.Errorf("received is %v; expects 2 requests of unknown methods", r.received)
+	}
+	r.answered(100 * time.Millisecond)
+	r.answered(200 * time.Millisecond)
+	if r.latency != 110*time.Millisecond {
+		t.Errorf("latency is %v; expects %v", r.latency, 110*time.Millisecond)
+	}
+}
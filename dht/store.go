@@ -0,0 +1,40 @@
+package dht
+
+// ValueStore is implemented by DHT record storage backends.
+// Calls are serialized by the DHT.
+type ValueStore interface {
+	Get(key string) (string, bool)
+	Put(key, value string) error
+	Delete(key string) error
+	Keys() []string
+	Close() error
+}
+
+type memoryValueStore map[string]string
+
+func (s memoryValueStore) Get(key string) (string, bool) {
+	v, ok := s[key]
+	return v, ok
+}
+
+func (s memoryValueStore) Put(key, value string) error {
+	s[key] = value
+	return nil
+}
+
+func (s memoryValueStore) Delete(key string) error {
+	delete(s, key)
+	return nil
+}
+
+func (s memoryValueStore) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for k := range s {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func (s memoryValueStore) Close() error {
+	return nil
+}
@@ -0,0 +1,121 @@
+package dht
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// tableVersion is the version of the format of the saved tables.
+	tableVersion = 1
+
+	// maxTableAge is the time after which the nodes of a saved table
+	// which have not been heard from are not restored.
+	maxTableAge = 24 * time.Hour
+)
+
+// savedNode is a node of a saved routing table.
+type savedNode struct {
+	Node utils.NodeInfo `msgpack:"node"`
+	Seen time.Time      `msgpack:"seen"`
+}
+
+// savedTable is the routing table of a DHT as written by SaveTable.
+type savedTable struct {
+	Version int          `msgpack:"version"`
+	Net     utils.NodeID `msgpack:"net"`
+	Nodes   []savedNode  `msgpack:"nodes"`
+}
+
+// saved returns the verified nodes of the table, from the least recently
+// seen node of each bucket, followed by the verified replacements.
+func (p *nodeTable) saved() []savedNode {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	var list []savedNode
+	for _, b := range p.buckets {
+		for _, n := range b {
+			if p.verified[n.ID] {
+				list = append(list, savedNode{Node: n, Seen: p.seen[n.ID]})
+			}
+		}
+	}
+	for _, r := range p.replacements {
+		for _, n := range r {
+			if p.verified[n.ID] {
+				list = append(list, savedNode{Node: n, Seen: p.seen[n.ID]})
+			}
+		}
+	}
+	return list
+}
+
+// restore inserts a saved node as verified, keeping the time it was last
+// seen. It reports whether the node has been admitted.
+func (p *nodeTable) restore(n savedNode) bool {
+	if !p.insert(n.Node) {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.verified[n.Node.ID] = true
+	p.seen[n.Node.ID] = n.Seen
+	return true
+}
+
+// SaveTable writes the verified nodes of the routing table to w, so that
+// they can be restored by LoadTable after a restart.
+func (p *DHT) SaveTable(w io.Writer) error {
+	data, err := msgpack.Marshal(savedTable{
+		Version: tableVersion,
+		Net:     p.net,
+		Nodes:   p.table.saved(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// LoadTable restores the nodes of a routing table written by SaveTable,
+// and returns their number. The nodes which have not been heard from
+// within a day are skipped, and the restored nodes are used for lookups
+// at once. The nodes which do not answer anymore are removed as they
+// fail. The table of a group DHT is rejected by the DHTs of the other
+// groups.
+func (p *DHT) LoadTable(r io.Reader) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	var t savedTable
+	err = msgpack.Unmarshal(data, &t)
+	if err != nil {
+		return 0, err
+	}
+	if t.Version != tableVersion {
+		return 0, errors.New("unsupported routing table version")
+	}
+	ns := utils.GlobalNamespace
+	if !t.Net.NS.Match(p.net.NS) || !p.net.NS.Match(ns) && t.Net.Digest.Cmp(p.net.Digest) != 0 {
+		return 0, errors.New("routing table of another network")
+	}
+
+	now := time.Now()
+	n := 0
+	for _, s := range t.Nodes {
+		if now.Sub(s.Seen) >= maxTableAge || s.Node.ID.Digest.Cmp(p.id.Digest) == 0 || !p.id.NS.Match(s.Node.ID.NS) {
+			continue
+		}
+		if p.table.restore(s) {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestSaveLoadTable(t *testing.T) {
+	dhts := newTestDHTs(t, 3)
+	for _, d := range dhts {
+		defer d.Close()
+	}
+
+	d := dhts[1]
+	if !d.table.isVerified(dhts[0].id) || !d.table.isVerified(dhts[2].id) {
+		t.Fatalf("the nodes of the test DHTs should be verified")
+	}
+	d.table.mutex.Lock()
+	d.table.seen[dhts[2].id] = time.Now().Add(-maxTableAge)
+	d.table.mutex.Unlock()
+
+	var buf bytes.Buffer
+	if err := d.SaveTable(&buf); err != nil {
+		t.Fatalf("SaveTable() returns %v", err)
+	}
+	data := buf.Bytes()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewDHT(10, d.id, d.id, conn, log.NewLogger())
+	defer restored.Close()
+	n, err := restored.LoadTable(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("LoadTable() returns %v", err)
+	}
+	if n != 1 {
+		t.Errorf("LoadTable() returns %d; expects 1", n)
+	}
+	if !restored.table.isVerified(dhts[0].id) {
+		t.Errorf("LoadTable() should restore the node as verified")
+	}
+	if restored.table.find(dhts[2].id) != nil {
+		t.Errorf("LoadTable() should skip a node which has not been seen lately")
+	}
+	if !restored.table.lastSeen(dhts[0].id).Equal(d.table.lastSeen(dhts[0].id)) {
+		t.Errorf("LoadTable() should keep the time the node was last seen")
+	}
+
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	g := NewDHT(10, d.id, group, conn, log.NewLogger())
+	if _, err := g.LoadTable(bytes.NewReader(data)); err == nil {
+		t.Errorf("LoadTable() should reject the table of another network")
+	}
+}
@@ -0,0 +1,210 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"mime"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// Export formats of ExportConversation.
+const (
+	ExportJSON = "json"
+	ExportText = "text"
+	ExportHTML = "html"
+)
+
+// Export is an exported conversation. It is the document written in the
+// JSON format, from which the transcripts are rendered.
+type Export struct {
+	Conversation string            `json:"conversation"`
+	Name         string            `json:"name,omitempty"`
+	Room         bool              `json:"room"`
+	Exported     time.Time         `json:"exported"`
+	Messages     []ExportedMessage `json:"messages"`
+}
+
+// ExportedMessage is a message of an exported conversation. Event is set
+// instead of the contents for the system messages of a room.
+type ExportedMessage struct {
+	From        string               `json:"from"`
+	Name        string               `json:"name,omitempty"`
+	Time        time.Time            `json:"time"`
+	Thread      string               `json:"thread,omitempty"`
+	Text        string               `json:"text,omitempty"`
+	HTML        string               `json:"html,omitempty"`
+	Event       string               `json:"event,omitempty"`
+	Attachments []ExportedAttachment `json:"attachments,omitempty"`
+}
+
+// ExportedAttachment references a content of a message other than its
+// text by the SHA-256 hash of its data, which is not exported.
+type ExportedAttachment struct {
+	Mime   string `json:"mime"`
+	Size   int    `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// body returns the text of the message for the transcripts.
+func (m ExportedMessage) body() string {
+	if m.Event != "" {
+		return m.Event
+	}
+	if m.Text != "" {
+		return m.Text
+	}
+	return m.HTML
+}
+
+func (m ExportedMessage) sender() string {
+	if m.Name != "" {
+		return m.Name
+	}
+	return m.From
+}
+
+// ExportConversation writes the history of a contact or a room to w in
+// one of the export formats, oldest message first. Attachments are only
+// referenced by their hash, so the export can be checked against copies
+// of them archived separately.
+func (c *Client) ExportConversation(w io.Writer, id utils.NodeID, format string) error {
+	e := c.export(id, time.Now())
+	switch format {
+	case ExportJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(e)
+	case ExportText:
+		return writeTextTranscript(w, e)
+	case ExportHTML:
+		return htmlTranscript.Execute(w, e)
+	default:
+		return errors.New("unknown export format")
+	}
+}
+
+func (c *Client) export(id utils.NodeID, now time.Time) Export {
+	e := Export{
+		Conversation: id.String(),
+		Room:         bytes.Equal(id.NS[:], utils.GroupNamespace[:]),
+		Exported:     now,
+		Messages:     []ExportedMessage{},
+	}
+	if e.Room {
+		if m, ok := c.roomMetadata.get(id); ok {
+			e.Name = m.Name
+		}
+	} else {
+		e.Name = c.Roster.Name(id)
+	}
+	for _, h := range c.History.List(id) {
+		m := ExportedMessage{
+			From:   h.Src.String(),
+			Name:   c.Roster.Name(h.Src),
+			Time:   h.Message.Time,
+			Thread: h.Message.Thread,
+		}
+		if h.Event != nil {
+			m.Event = c.describeRoomEvent(h.Event)
+			e.Messages = append(e.Messages, m)
+			continue
+		}
+		for _, content := range h.Message.Contents {
+			t, _, _ := mime.ParseMediaType(content.Mime)
+			switch {
+			case t == "text/plain" && m.Text == "":
+				m.Text = content.Data
+			case t == "text/html" && m.HTML == "":
+				m.HTML = content.Data
+			default:
+				sum := sha256.Sum256([]byte(content.Data))
+				m.Attachments = append(m.Attachments, ExportedAttachment{
+					Mime:   content.Mime,
+					Size:   len(content.Data),
+					SHA256: hex.EncodeToString(sum[:]),
+				})
+			}
+		}
+		e.Messages = append(e.Messages, m)
+	}
+	return e
+}
+
+// describeRoomEvent returns a sentence describing the event.
+func (c *Client) describeRoomEvent(e *RoomEvent) string {
+	member := c.Roster.Name(e.Member)
+	if member == "" {
+		member = e.Member.String()
+	}
+	switch e.Type {
+	case RoomJoin:
+		return member + " joined"
+	case RoomLeave:
+		return member + " left"
+	case RoomKick:
+		return member + " was kicked"
+	case RoomTopic:
+		return fmt.Sprintf("topic changed to %q", e.Topic)
+	case RoomKeyRotation:
+		return "room key rotated"
+	default:
+		return e.Type
+	}
+}
+
+func writeTextTranscript(w io.Writer, e Export) error {
+	var b bytes.Buffer
+	if e.Name != "" {
+		fmt.Fprintf(&b, "Conversation: %s (%s)\n", e.Name, e.Conversation)
+	} else {
+		fmt.Fprintf(&b, "Conversation: %s\n", e.Conversation)
+	}
+	fmt.Fprintf(&b, "Exported: %s\n\n", e.Exported.Format(time.RFC3339))
+	for _, m := range e.Messages {
+		t := m.Time.Format(time.RFC3339)
+		if m.Event != "" {
+			fmt.Fprintf(&b, "[%s] * %s\n", t, m.Event)
+			continue
+		}
+		fmt.Fprintf(&b, "[%s] %s: %s\n", t, m.sender(), m.body())
+		for _, a := range m.Attachments {
+			fmt.Fprintf(&b, "    attachment %s, %d bytes, sha256:%s\n", a.Mime, a.Size, a.SHA256)
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// htmlTranscript escapes the contents of the messages, including their
+// HTML, so that the transcript cannot run scripts of the senders.
+var htmlTranscript = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"time":   func(t time.Time) string { return t.Format(time.RFC3339) },
+	"sender": ExportedMessage.sender,
+	"body":   ExportedMessage.body,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Name}}{{.Name}}{{else}}{{.Conversation}}{{end}}</title>
+</head>
+<body>
+<h1>{{if .Name}}{{.Name}} ({{.Conversation}}){{else}}{{.Conversation}}{{end}}</h1>
+<p>Exported {{time .Exported}}</p>
+<ul>
+{{range .Messages}}<li>
+<time>{{time .Time}}</time>
+{{if .Event}}<em>{{.Event}}</em>{{else}}<strong>{{sender .}}</strong>: {{body .}}{{end}}
+{{range .Attachments}}<div>attachment {{.Mime}}, {{.Size}} bytes, sha256:{{.SHA256}}</div>
+{{end}}</li>
+{{end}}</ul>
+</body>
+</html>
+`))
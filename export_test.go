@@ -0,0 +1,62 @@
+package murcott
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestExportConversation(t *testing.T) {
+	var c Client
+	room := utils.NewRandomNodeID(utils.GroupNamespace)
+	alice := utils.NewRandomNodeID(utils.GlobalNamespace)
+	c.Roster.SetAlias(alice, "alice")
+
+	msg := NewPlainChatMessage("hello <b>world</b>")
+	msg.Push(Content{Mime: "image/png", Data: "png data"})
+	c.History.Push(room, newHistoryEntry(alice, msg))
+	event := RoomEvent{Room: room, Type: RoomJoin, Member: alice, Time: msg.Time.Add(time.Second)}
+	c.History.Push(room, HistoryEntry{Src: alice, Message: ChatMessage{Time: event.Time}, Event: &event})
+
+	var b bytes.Buffer
+	if err := c.ExportConversation(&b, room, ExportJSON); err != nil {
+		t.Fatalf("ExportConversation() returns %v", err)
+	}
+	var e Export
+	if err := json.Unmarshal(b.Bytes(), &e); err != nil {
+		t.Fatalf("cannot decode the JSON export: %v", err)
+	}
+	if !e.Room || len(e.Messages) != 2 {
+		t.Fatalf("JSON export has %d messages; expects 2", len(e.Messages))
+	}
+	m := e.Messages[0]
+	if m.Name != "alice" || m.Text != "hello <b>world</b>" || len(m.Attachments) != 1 {
+		t.Errorf("JSON export has message %v", m)
+	}
+	if a := m.Attachments[0]; a.Size != 8 || a.SHA256 != "e12b061e0cc3b3e287c561a9075dc9562c704a4674615b78bb770fe97810ba68" {
+		t.Errorf("attachment is %v; expects its size and hash", a)
+	}
+	if e.Messages[1].Event != "alice joined" {
+		t.Errorf("JSON export has event %q; expects \"alice joined\"", e.Messages[1].Event)
+	}
+
+	b.Reset()
+	c.ExportConversation(&b, room, ExportText)
+	if s := b.String(); !strings.Contains(s, "alice: hello <b>world</b>") || !strings.Contains(s, "* alice joined") {
+		t.Errorf("text export is %q", s)
+	}
+
+	b.Reset()
+	c.ExportConversation(&b, room, ExportHTML)
+	if s := b.String(); strings.Contains(s, "<b>world</b>") || !strings.Contains(s, "&lt;b&gt;world&lt;/b&gt;") {
+		t.Errorf("HTML export should escape the messages: %q", s)
+	}
+
+	if c.ExportConversation(&b, room, "pdf") == nil {
+		t.Errorf("ExportConversation() accepts an unknown format")
+	}
+}
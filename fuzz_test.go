@@ -0,0 +1,36 @@
+package murcott
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// FuzzEnvelope passes message envelopes to the parseMessage of a client.
+func FuzzEnvelope(f *testing.F) {
+	f.Add(readGoldenEnvelope(f))
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	for _, e := range []protocol.Envelope{
+		protocol.Envelope{Type: protocol.MsgAck, ID: id.String(), Content: MessageAck{ID: []byte("id")}},
+		protocol.Envelope{Type: protocol.MsgProfileResponse, ID: id.String(), Content: UserProfileResponse{}},
+		protocol.Envelope{Type: protocol.MsgContactSecret, ID: id.String(), Content: ContactSecret{Secret: []byte("secret")}},
+	} {
+		b, err := msgpack.Marshal(e)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		f.Fatal(err)
+	}
+	defer c.Close()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c.parseMessage(router.Message{Node: id, Payload: data})
+	})
+}
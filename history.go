@@ -0,0 +1,262 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// History represents a message archive grouped by contact.
+type History struct {
+	M     map[utils.NodeID][]HistoryEntry
+	mutex sync.RWMutex
+}
+
+// HistoryEntry represents an archived chat message.
+type HistoryEntry struct {
+	Src     utils.NodeID `msgpack:"src"`
+	Message ChatMessage  `msgpack:"message"`
+	Expire  time.Time    `msgpack:"expire"`
+
+	// Event is set for the system messages recording the events of a room.
+	// Their Message only holds the time of the event.
+	Event *RoomEvent `msgpack:"event,omitempty"`
+}
+
+func newHistoryEntry(src utils.NodeID, m ChatMessage) HistoryEntry {
+	e := HistoryEntry{Src: src, Message: m}
+	if m.Ephemeral {
+		e.Expire = time.Now().Add(m.TTL)
+	}
+	return e
+}
+
+func (e HistoryEntry) expired(now time.Time) bool {
+	return !e.Expire.IsZero() && !now.Before(e.Expire)
+}
+
+// Push appends an entry to the conversation with the given contact.
+func (h *History) Push(id utils.NodeID, e HistoryEntry) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.M == nil {
+		h.M = make(map[utils.NodeID][]HistoryEntry)
+	}
+	h.M[id] = append(h.M[id], e)
+}
+
+// List returns the unexpired entries of the conversation with the given contact.
+func (h *History) List(id utils.NodeID) []HistoryEntry {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	now := time.Now()
+	var l []HistoryEntry
+	for _, e := range h.M[id] {
+		if !e.expired(now) {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// LastActivity returns the time of the latest unexpired message
+// in the conversation with the given contact.
+func (h *History) LastActivity(id utils.NodeID) time.Time {
+	var t time.Time
+	for _, e := range h.List(id) {
+		if e.Message.Time.After(t) {
+			t = e.Message.Time
+		}
+	}
+	return t
+}
+
+// Thread returns the unexpired entries of the given thread
+// in the conversation with the given contact or room.
+func (h *History) Thread(id utils.NodeID, thread string) []HistoryEntry {
+	var l []HistoryEntry
+	for _, e := range h.List(id) {
+		if e.Message.Thread == thread {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// Threads returns the threads in the conversation with the given contact
+// or room, in the order of their first message.
+func (h *History) Threads(id utils.NodeID) []string {
+	var l []string
+	seen := make(map[string]bool)
+	for _, e := range h.List(id) {
+		if t := e.Message.Thread; t != "" && !seen[t] {
+			seen[t] = true
+			l = append(l, t)
+		}
+	}
+	return l
+}
+
+// Contacts returns the contacts which have at least one archived message.
+func (h *History) Contacts() []utils.NodeID {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	var l []utils.NodeID
+	for id := range h.M {
+		l = append(l, id)
+	}
+	return l
+}
+
+// Expire removes the entries which have expired at the given time
+// and returns the number of removed entries.
+func (h *History) Expire(now time.Time) int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	n := 0
+	for id, list := range h.M {
+		var rest []HistoryEntry
+		for _, e := range list {
+			if e.expired(now) {
+				n++
+			} else {
+				rest = append(rest, e)
+			}
+		}
+		if len(rest) > 0 {
+			h.M[id] = rest
+		} else {
+			delete(h.M, id)
+		}
+	}
+	return n
+}
+
+// Remove deletes the conversation with the given contact
+// and returns the removed entries.
+func (h *History) Remove(id utils.NodeID) []HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	l := h.M[id]
+	delete(h.M, id)
+	return l
+}
+
+// Trim removes the entries which are older than maxAge at the given time
+// and the oldest entries exceeding maxMessages per contact.
+// Zero values are ignored. It returns the removed entries.
+func (h *History) Trim(now time.Time, maxAge time.Duration, maxMessages int) map[utils.NodeID][]HistoryEntry {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	removed := make(map[utils.NodeID][]HistoryEntry)
+	for id, list := range h.M {
+		var rest []HistoryEntry
+		for _, e := range list {
+			if maxAge > 0 && now.Sub(e.Message.Time) > maxAge {
+				removed[id] = append(removed[id], e)
+			} else {
+				rest = append(rest, e)
+			}
+		}
+		if maxMessages > 0 && len(rest) > maxMessages {
+			n := len(rest) - maxMessages
+			removed[id] = append(removed[id], rest[:n]...)
+			rest = rest[n:]
+		}
+		if len(removed[id]) == 0 {
+			continue
+		}
+		if len(rest) > 0 {
+			h.M[id] = rest
+		} else {
+			delete(h.M, id)
+		}
+	}
+	return removed
+}
+
+func (e HistoryEntry) key() []byte {
+	b, _ := msgpack.Marshal([]interface{}{
+		e.Src.Bytes(),
+		e.Message.Time.UnixNano(),
+		e.Message.Contents,
+	})
+	return b
+}
+
+// docID returns the identifier of the entry in the search index.
+func (e HistoryEntry) docID() string {
+	h := sha1.Sum(e.key())
+	return hex.EncodeToString(h[:])
+}
+
+// merge adds the unexpired entries of s which are not in h yet
+// and returns the added entries.
+func (h *History) merge(s *History) map[utils.NodeID][]HistoryEntry {
+	added := make(map[utils.NodeID][]HistoryEntry)
+	now := time.Now()
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.M == nil {
+		h.M = make(map[utils.NodeID][]HistoryEntry)
+	}
+
+	for id, list := range s.M {
+		current := h.M[id]
+		for _, e := range list {
+			if e.expired(now) {
+				continue
+			}
+			k := e.key()
+			dup := false
+			for _, c := range current {
+				if bytes.Equal(c.key(), k) {
+					dup = true
+					break
+				}
+			}
+			if !dup {
+				current = append(current, e)
+				added[id] = append(added[id], e)
+			}
+		}
+		if len(added[id]) > 0 {
+			sort.Stable(byMessageTime(current))
+			h.M[id] = current
+		}
+	}
+	return added
+}
+
+// snapshot returns a copy of the history which can be encoded
+// while the history is modified.
+func (h *History) snapshot() *History {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	s := &History{M: make(map[utils.NodeID][]HistoryEntry)}
+	for id, list := range h.M {
+		s.M[id] = append([]HistoryEntry{}, list...)
+	}
+	return s
+}
+
+type byMessageTime []HistoryEntry
+
+func (s byMessageTime) Len() int           { return len(s) }
+func (s byMessageTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMessageTime) Less(i, j int) bool { return s[i].Message.Time.Before(s[j].Message.Time) }
+
+func (h *History) load(s *History) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.M = s.M
+}
@@ -0,0 +1,59 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestHistoryEphemeral(t *testing.T) {
+	var h History
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	msg := NewPlainChatMessage("ephemeral")
+	msg.SetEphemeral(time.Millisecond * 10)
+	h.Push(id, newHistoryEntry(id, msg))
+	h.Push(id, newHistoryEntry(id, NewPlainChatMessage("persistent")))
+
+	if l := len(h.List(id)); l != 2 {
+		t.Errorf("List() returns %d entries; expects %d", l, 2)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+
+	if l := len(h.List(id)); l != 1 {
+		t.Errorf("List() returns %d entries; expects %d", l, 1)
+	}
+	if n := h.Expire(time.Now()); n != 1 {
+		t.Errorf("Expire() removes %d entries; expects %d", n, 1)
+	}
+	l := h.List(id)
+	if len(l) != 1 || l[0].Message.Text() != "persistent" {
+		t.Errorf("persistent message should remain in history")
+	}
+}
+
+func TestHistoryThreads(t *testing.T) {
+	var h History
+	room := utils.NewRandomNodeID(utils.GroupNamespace)
+	thread := NewThreadID()
+
+	msg := NewPlainChatMessage("root")
+	msg.Thread = thread
+	h.Push(room, newHistoryEntry(room, NewPlainChatMessage("main")))
+	h.Push(room, newHistoryEntry(room, msg))
+	msg.Thread = NewThreadID()
+	h.Push(room, newHistoryEntry(room, msg))
+
+	l := h.Thread(room, thread)
+	if len(l) != 1 || l[0].Message.Text() != "root" {
+		t.Errorf("Thread() returns %v", l)
+	}
+	if l := h.Thread(room, ""); len(l) != 1 || l[0].Message.Text() != "main" {
+		t.Errorf("Thread() returns %v for the main conversation", l)
+	}
+	if l := h.Threads(room); len(l) != 2 || l[0] != thread {
+		t.Errorf("Threads() returns %v", l)
+	}
+}
@@ -0,0 +1,394 @@
+package murcott
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	defaultInboxRate       = 1.0 / 60
+	defaultInboxBurst      = 3
+	defaultInboxDifficulty = 20
+
+	// maxInboxDifficulty is the highest difficulty for which
+	// SendToInbox computes a stamp.
+	maxInboxDifficulty = 28
+
+	// inboxMaxAge is the age after which a stamp expires. The stamps
+	// are remembered until then, so that they cannot be replayed.
+	inboxMaxAge = 10 * time.Minute
+
+	// inboxPublishDelay is the delay before the first publication of the
+	// inbox record, during which the router of the inbox is bootstrapped.
+	inboxPublishDelay = 5 * time.Second
+)
+
+var errInboxLimited = errors.New("inbox message over the limit")
+
+// InboxLimits are the limits applied by a public inbox to the messages of
+// strangers. Each sender may send Rate messages per second, with bursts
+// of up to Burst messages, and each message must carry a proof of work
+// of Difficulty leading zero bits. Zero values use the defaults: one
+// message per minute, bursts of 3 and 20 bits.
+type InboxLimits struct {
+	Rate       float64
+	Burst      int
+	Difficulty int
+}
+
+func (l InboxLimits) withDefaults() InboxLimits {
+	if l.Rate == 0 {
+		l.Rate = defaultInboxRate
+	}
+	if l.Burst == 0 {
+		l.Burst = defaultInboxBurst
+	}
+	if l.Difficulty == 0 {
+		l.Difficulty = defaultInboxDifficulty
+	}
+	return l
+}
+
+// InboxRecord advertises a public inbox and the difficulty of the proof
+// of work required by it. It is published in the DHT and signed with
+// the key of the inbox.
+type InboxRecord struct {
+	ID         utils.NodeID    `msgpack:"id"`
+	Difficulty int             `msgpack:"difficulty"`
+	Time       time.Time       `msgpack:"time"`
+	Key        utils.PublicKey `msgpack:"key"`
+	Sign       utils.Signature `msgpack:"sign"`
+}
+
+func (r *InboxRecord) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		r.ID.Bytes(),
+		r.Difficulty,
+		r.Time.UnixNano(),
+	})
+	return data
+}
+
+func (r *InboxRecord) sign(key *utils.PrivateKey) error {
+	r.Key = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign inbox record")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Verify checks that the record is signed by its inbox.
+func (r *InboxRecord) Verify() error {
+	if r.ID.Digest.Cmp(r.Key.Digest()) != 0 {
+		return errors.New("inbox record signed by wrong key")
+	}
+	if !r.Key.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid inbox record signature")
+	}
+	return nil
+}
+
+func inboxKey(id utils.NodeID) string {
+	return "inbox:" + id.String()
+}
+
+// InboxMessageEvent is emitted when a stranger sends a message
+// to a public inbox of the user.
+type InboxMessageEvent struct {
+	Inbox   utils.NodeID
+	Src     utils.NodeID
+	Message ChatMessage
+}
+
+// inboxMessage is a message to a public inbox
+// stamped with a proof of work.
+type inboxMessage struct {
+	Message ChatMessage `msgpack:"message"`
+	Time    time.Time   `msgpack:"time"`
+	Nonce   uint64      `msgpack:"nonce"`
+}
+
+// inboxStamp returns the hash whose leading zero bits are the work
+// done for the message, which is bound to the inbox and the sender.
+func inboxStamp(inbox, src utils.NodeID, m inboxMessage) [32]byte {
+	msg, _ := msgpack.Marshal(m.Message)
+	digest := sha256.Sum256(msg)
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(m.Time.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], m.Nonce)
+	h := sha256.New()
+	h.Write(inbox.Bytes())
+	h.Write(src.Bytes())
+	h.Write(digest[:])
+	h.Write(b[:])
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+func leadingZeros(h [32]byte) int {
+	n := 0
+	for _, b := range h {
+		n += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// solveStamp sets the nonce of the message so that its stamp
+// has the given number of leading zero bits.
+func solveStamp(inbox, src utils.NodeID, m *inboxMessage, difficulty int) {
+	for m.Nonce = 0; leadingZeros(inboxStamp(inbox, src, *m)) < difficulty; m.Nonce++ {
+	}
+}
+
+type inboxBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// PublicInbox is an alternate identity of the user which accepts messages
+// from strangers within strict limits, so that the primary identity can
+// be restricted to the roster with Config.RosterOnly. It shares the
+// transport of the client.
+type PublicInbox struct {
+	id      utils.NodeID
+	key     *utils.PrivateKey
+	limits  InboxLimits
+	router  *router.Router
+	client  *Client
+	buckets map[utils.NodeID]*inboxBucket
+	stamps  map[[32]byte]time.Time
+	mutex   sync.Mutex
+	exit    chan int
+}
+
+// OpenPublicInbox opens a public inbox with the given key, publishes its
+// record and emits an InboxMessageEvent for each accepted message.
+// Strangers send messages to it with SendToInbox.
+func (c *Client) OpenPublicInbox(key *utils.PrivateKey, limits InboxLimits) (*PublicInbox, error) {
+	r, err := router.NewSharedRouter(key, c.Logger, c.config, c.router.Transport())
+	if err != nil {
+		return nil, err
+	}
+	i := &PublicInbox{
+		id:      utils.NewNodeID(utils.GlobalNamespace, key.Digest()),
+		key:     key,
+		limits:  limits.withDefaults(),
+		router:  r,
+		client:  c,
+		buckets: make(map[utils.NodeID]*inboxBucket),
+		stamps:  make(map[[32]byte]time.Time),
+		exit:    make(chan int),
+	}
+	c.inboxMutex.Lock()
+	c.inboxes = append(c.inboxes, i)
+	c.inboxMutex.Unlock()
+
+	r.Discover(c.config.Bootstrap())
+	go c.router.Supervise(router.SubsystemClient, i.run)
+	go c.router.Supervise(router.SubsystemClient, i.maintain)
+	return i, nil
+}
+
+// ID returns the node ID of the inbox.
+func (i *PublicInbox) ID() utils.NodeID {
+	return i.id
+}
+
+// Close closes the inbox.
+func (i *PublicInbox) Close() {
+	c := i.client
+	c.inboxMutex.Lock()
+	defer c.inboxMutex.Unlock()
+	for n, j := range c.inboxes {
+		if j == i {
+			c.inboxes = append(c.inboxes[:n], c.inboxes[n+1:]...)
+			close(i.exit)
+			i.router.Close()
+			return
+		}
+	}
+}
+
+func (i *PublicInbox) run() {
+	for {
+		m, err := i.router.RecvMessage()
+		if err != nil {
+			return
+		}
+		msg, err := i.receive(m, time.Now())
+		if err != nil {
+			i.client.Logger.Warning("Rejected inbox message from %s: %v", m.Node.String(), err)
+			continue
+		}
+		i.client.mbuf.Push(readPair{M: InboxMessageEvent{Inbox: i.id, Src: m.Node, Message: msg}, ID: m.Node})
+	}
+}
+
+// maintain publishes the inbox record and forgets the expired stamps
+// and the buckets of the idle senders.
+func (i *PublicInbox) maintain() {
+	select {
+	case <-i.exit:
+		return
+	case <-time.After(inboxPublishDelay):
+	}
+	records := time.NewTicker(recordInterval)
+	defer records.Stop()
+	for {
+		i.publish()
+		select {
+		case <-i.exit:
+			return
+		case now := <-records.C:
+			i.prune(now)
+		}
+	}
+}
+
+func (i *PublicInbox) publish() {
+	r := InboxRecord{ID: i.id, Difficulty: i.limits.Difficulty, Time: time.Now()}
+	if r.sign(i.key) != nil {
+		return
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return
+	}
+	i.router.StoreValue(inboxKey(i.id), string(data))
+}
+
+func (i *PublicInbox) prune(now time.Time) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	for s, t := range i.stamps {
+		if now.Sub(t) > inboxMaxAge {
+			delete(i.stamps, s)
+		}
+	}
+	for id, b := range i.buckets {
+		if now.Sub(b.last) > inboxMaxAge {
+			delete(i.buckets, id)
+		}
+	}
+}
+
+// receive checks a message against the limits of the inbox.
+func (i *PublicInbox) receive(m router.Message, now time.Time) (ChatMessage, error) {
+	var t struct {
+		Type    string       `msgpack:"type"`
+		Content inboxMessage `msgpack:"content"`
+	}
+	if err := msgpack.Unmarshal(m.Payload, &t); err != nil {
+		return ChatMessage{}, err
+	}
+	if t.Type != protocol.MsgInbox {
+		return ChatMessage{}, errors.New("not an inbox message")
+	}
+	return t.Content.Message, i.check(m.Node, t.Content, now)
+}
+
+func (i *PublicInbox) check(src utils.NodeID, m inboxMessage, now time.Time) error {
+	if now.Sub(m.Time) > inboxMaxAge || m.Time.Sub(now) > router.MaxClockSkew {
+		return errors.New("inbox message expired")
+	}
+	stamp := inboxStamp(i.id, src, m)
+	if leadingZeros(stamp) < i.limits.Difficulty {
+		return errors.New("insufficient proof of work")
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	if _, ok := i.stamps[stamp]; ok {
+		return errors.New("inbox message replayed")
+	}
+	i.stamps[stamp] = now
+
+	b, ok := i.buckets[src]
+	if !ok {
+		b = &inboxBucket{tokens: float64(i.limits.Burst), last: now}
+		i.buckets[src] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * i.limits.Rate
+	if b.tokens > float64(i.limits.Burst) {
+		b.tokens = float64(i.limits.Burst)
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return errInboxLimited
+	}
+	b.tokens--
+	return nil
+}
+
+// Reply sends a message from the inbox, so that the primary identity
+// of the user is not revealed to the stranger.
+func (i *PublicInbox) Reply(dst utils.NodeID, msg ChatMessage) error {
+	t := protocol.Envelope{Type: protocol.MsgChat, ID: i.id.String(), Content: msg}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return i.router.SendMessage(dst, data)
+}
+
+// LookupInbox returns the record of the public inbox from the DHT.
+func (c *Client) LookupInbox(id utils.NodeID) (InboxRecord, error) {
+	var r InboxRecord
+	str := c.router.LoadValue(inboxKey(id))
+	if str == nil {
+		return r, errors.New("inbox record not found")
+	}
+	err := msgpack.Unmarshal([]byte(*str), &r)
+	if err != nil {
+		return r, err
+	}
+	if !r.ID.Match(id) {
+		return r, errors.New("inbox record for another inbox")
+	}
+	return r, r.Verify()
+}
+
+// SendToInbox sends a message to the public inbox of a user, with the
+// proof of work required by its record.
+func (c *Client) SendToInbox(inbox utils.NodeID, msg ChatMessage) error {
+	r, err := c.LookupInbox(inbox)
+	if err != nil {
+		return err
+	}
+	if r.Difficulty > maxInboxDifficulty {
+		return errors.New("inbox difficulty too high")
+	}
+	m := inboxMessage{Message: msg, Time: time.Now()}
+	solveStamp(inbox, c.id, &m, r.Difficulty)
+	t := protocol.Envelope{Type: protocol.MsgInbox, ID: c.id.String(), Content: m}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage(inbox, data)
+}
+
+// fromStranger reports whether the message is a direct message from
+// a node which is neither in the roster nor a device of the user.
+func (c *Client) fromStranger(rm router.Message) bool {
+	if !rm.Conversation().Match(rm.Node) {
+		return false
+	}
+	_, ok := c.Roster.profile(rm.Node)
+	return !ok && !c.isDevice(rm.Node)
+}
@@ -0,0 +1,84 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestInboxStamp(t *testing.T) {
+	inbox := utils.NewRandomNodeID(utils.GlobalNamespace)
+	src := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+	i := &PublicInbox{
+		id:      inbox,
+		limits:  InboxLimits{Rate: 1, Burst: 2, Difficulty: 8},
+		buckets: make(map[utils.NodeID]*inboxBucket),
+		stamps:  make(map[[32]byte]time.Time),
+	}
+
+	m := inboxMessage{Message: NewPlainChatMessage("hello"), Time: now}
+	solveStamp(inbox, src, &m, 8)
+	if err := i.check(src, m, now); err != nil {
+		t.Errorf("check() returns %v; expects nil", err)
+	}
+	if i.check(src, m, now) == nil {
+		t.Errorf("check() should reject a replayed stamp")
+	}
+	if i.check(utils.NewRandomNodeID(utils.GlobalNamespace), m, now) == nil {
+		t.Errorf("check() should reject a stamp of another sender")
+	}
+
+	m.Time = now.Add(-2 * inboxMaxAge)
+	solveStamp(inbox, src, &m, 8)
+	if i.check(src, m, now) == nil {
+		t.Errorf("check() should reject an expired message")
+	}
+
+	for n := 0; n < 2; n++ {
+		m = inboxMessage{Message: NewPlainChatMessage("hello"), Time: now.Add(time.Duration(n+1) * time.Millisecond)}
+		solveStamp(inbox, src, &m, 8)
+		err := i.check(src, m, now)
+		if n == 0 && err != nil {
+			t.Errorf("check() returns %v; expects nil", err)
+		}
+		if n == 1 && err != errInboxLimited {
+			t.Errorf("check() returns %v; expects %v", err, errInboxLimited)
+		}
+	}
+}
+
+func TestInboxRecord(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	r := InboxRecord{ID: utils.NewNodeID(utils.GlobalNamespace, key.Digest()), Difficulty: 20, Time: time.Now()}
+	if err := r.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+	r.Difficulty = 1
+	if r.Verify() == nil {
+		t.Errorf("Verify() should reject an altered difficulty")
+	}
+}
+
+func TestFromStranger(t *testing.T) {
+	c := &Client{}
+	friend := utils.NewRandomNodeID(utils.GlobalNamespace)
+	stranger := utils.NewRandomNodeID(utils.GlobalNamespace)
+	c.Roster.Set(friend, UserProfile{})
+
+	if c.fromStranger(router.Message{Node: friend, Dst: c.id}) {
+		t.Errorf("fromStranger() returns true for a contact")
+	}
+	if !c.fromStranger(router.Message{Node: stranger, Dst: c.id}) {
+		t.Errorf("fromStranger() returns false for a stranger")
+	}
+	room := utils.NewRandomNodeID(utils.GroupNamespace)
+	if c.fromStranger(router.Message{Node: stranger, Dst: room}) {
+		t.Errorf("fromStranger() returns true for a room message")
+	}
+}
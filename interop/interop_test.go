@@ -0,0 +1,262 @@
+//go:build interop
+// +build interop
+
+// Package interop tests the current build against the peers of prior
+// releases. Run it with
+//
+//	go test -tags interop ./interop
+//
+// The reference peers are listed in releases.txt. Additional binaries
+// can be given in $MURCOTT_REFERENCE_PEERS, separated like $PATH. The
+// test is skipped without reference peers, unless $CI is set.
+package interop
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const expectTimeout = 10 * time.Second
+
+type reference struct {
+	version string
+	path    string
+}
+
+type peer struct {
+	t     *testing.T
+	name  string
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+	lines chan string
+	id    string
+	port  string
+}
+
+func startPeer(t *testing.T, name, path string) *peer {
+	cmd := exec.Command(path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cmd.Start()
+	if err != nil {
+		t.Fatalf("cannot start %s: %v", name, err)
+	}
+	p := &peer{t: t, name: name, cmd: cmd, stdin: stdin, lines: make(chan string, 64)}
+	go func() {
+		s := bufio.NewScanner(stdout)
+		for s.Scan() {
+			p.lines <- s.Text()
+		}
+		close(p.lines)
+	}()
+	p.id = p.expect("id ")
+	p.port = p.expect("port ")
+	return p
+}
+
+func (p *peer) send(format string, a ...interface{}) {
+	fmt.Fprintf(p.stdin, format+"\n", a...)
+}
+
+// expect waits for a line with the given prefix and returns the rest of it.
+func (p *peer) expect(prefix string) string {
+	timeout := time.After(expectTimeout)
+	for {
+		select {
+		case line, ok := <-p.lines:
+			if !ok {
+				p.t.Fatalf("%s exited while waiting for %q", p.name, prefix)
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line[len(prefix):]
+			}
+		case <-timeout:
+			p.t.Fatalf("%s did not print %q", p.name, prefix)
+		}
+	}
+}
+
+func (p *peer) close() {
+	p.send("quit")
+	p.stdin.Close()
+	done := make(chan error, 1)
+	go func() { done <- p.cmd.Wait() }()
+	select {
+	case <-done:
+	case <-time.After(expectTimeout):
+		p.cmd.Process.Kill()
+	}
+}
+
+// buildCurrent builds the peer of the current tree.
+func buildCurrent(t *testing.T, dir string) string {
+	path := filepath.Join(dir, "peer-current")
+	out, err := exec.Command("go", "build", "-o", path, "./peer").CombinedOutput()
+	if err != nil {
+		t.Fatalf("cannot build peer: %v\n%s", err, out)
+	}
+	return path
+}
+
+func cacheDir() string {
+	if d := os.Getenv("MURCOTT_INTEROP_CACHE"); d != "" {
+		return d
+	}
+	return filepath.Join(os.TempDir(), "murcott-interop")
+}
+
+// fetch downloads a reference peer unless a verified copy is cached.
+func fetch(version, url, sum string) (string, error) {
+	path := filepath.Join(cacheDir(), "peer-"+version)
+	if checksum(path) == sum {
+		return path, nil
+	}
+	err := os.MkdirAll(cacheDir(), 0755)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+	f, err := ioutil.TempFile(cacheDir(), "download")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, resp.Body)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if checksum(f.Name()) != sum {
+		return "", errors.New("checksum mismatch")
+	}
+	err = os.Chmod(f.Name(), 0755)
+	if err != nil {
+		return "", err
+	}
+	return path, os.Rename(f.Name(), path)
+}
+
+func checksum(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// references returns the pinned reference peers.
+func references(t *testing.T) []reference {
+	var refs []reference
+	for _, path := range filepath.SplitList(os.Getenv("MURCOTT_REFERENCE_PEERS")) {
+		if path != "" {
+			refs = append(refs, reference{version: filepath.Base(path), path: path})
+		}
+	}
+	data, err := ioutil.ReadFile("releases.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) != 3 {
+			t.Fatalf("malformed line in releases.txt: %q", line)
+		}
+		path, err := fetch(f[0], f[1], f[2])
+		if err != nil {
+			t.Fatalf("cannot fetch peer %s: %v", f[0], err)
+		}
+		refs = append(refs, reference{version: f[0], path: path})
+	}
+	return refs
+}
+
+// exchange checks that a can talk to b through messages and the DHT.
+func exchange(t *testing.T, a, b *peer) {
+	text := "hello from " + a.name
+	a.send("send %s %s", b.id, text)
+	if m := b.expect("recv "); m != a.id+" "+text {
+		t.Errorf("%s received %q; expects %q", b.name, m, a.id+" "+text)
+	}
+	if m := a.expect("recv "); m != b.id+" echo "+text {
+		t.Errorf("%s received %q; expects %q", a.name, m, b.id+" echo "+text)
+	}
+
+	key := "interop-" + a.name
+	a.send("store %s %s", key, a.id)
+	time.Sleep(500 * time.Millisecond)
+	b.send("load %s", key)
+	if v := b.expect("value " + key + " "); v != a.id {
+		t.Errorf("%s loaded %q; expects %q", b.name, v, a.id)
+	}
+}
+
+func TestInterop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott-interop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	refs := references(t)
+	if len(refs) == 0 {
+		// A CI run without reference peers would pass without
+		// testing anything.
+		if os.Getenv("CI") != "" {
+			t.Fatal("no reference peers in CI; pin a release in releases.txt")
+		}
+		t.Skip("no reference peers; see releases.txt")
+	}
+	current := buildCurrent(t, dir)
+
+	for _, ref := range refs {
+		testReference(t, current, ref)
+	}
+}
+
+func testReference(t *testing.T, current string, ref reference) {
+	c := startPeer(t, "current", current)
+	defer c.close()
+	r := startPeer(t, ref.version, ref.path)
+	defer r.close()
+
+	c.send("bootstrap %s", r.port)
+	r.send("bootstrap %s", c.port)
+	time.Sleep(time.Second)
+
+	exchange(t, c, r)
+	exchange(t, r, c)
+}
@@ -0,0 +1,130 @@
+// Command peer is a headless node driven by line commands on the standard
+// input. It is built from each release and used by the interoperability
+// tests, so its command set must stay backward compatible.
+//
+// On startup it prints
+//
+//	id <node id>
+//	port <port>
+//
+// and accepts the commands
+//
+//	bootstrap <port>
+//	send <node id> <text>
+//	store <key> <value>
+//	load <key>
+//	quit
+//
+// Received chat messages are printed as "recv <node id> <text>" and
+// answered with "echo <text>". Loaded values are printed as
+// "value <key> <value>", or "novalue <key>" if not found.
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/h2so5/murcott"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+var out sync.Mutex
+
+func output(a ...interface{}) {
+	out.Lock()
+	defer out.Unlock()
+	fmt.Println(a...)
+}
+
+func sendChat(r *router.Router, dst utils.NodeID, text string) error {
+	msgid := make([]byte, 16)
+	rand.Read(msgid)
+	data, err := msgpack.Marshal(protocol.Envelope{
+		Type:    protocol.MsgChat,
+		ID:      r.ID().String(),
+		MsgID:   msgid,
+		Content: murcott.NewPlainChatMessage(text),
+	})
+	if err != nil {
+		return err
+	}
+	return r.SendMessage(dst, data)
+}
+
+func receive(r *router.Router) {
+	for {
+		m, err := r.RecvMessage()
+		if err != nil {
+			return
+		}
+		var e struct {
+			Type    string              `msgpack:"type"`
+			Content murcott.ChatMessage `msgpack:"content"`
+		}
+		if msgpack.Unmarshal(m.Payload, &e) != nil || e.Type != protocol.MsgChat {
+			continue
+		}
+		text := e.Content.Text()
+		output("recv", m.Node.String(), text)
+		if !strings.HasPrefix(text, "echo ") {
+			sendChat(r, m.Node, "echo "+text)
+		}
+	}
+}
+
+func main() {
+	ports := flag.String("ports", "9300-9400", "range of ports to listen on")
+	flag.Parse()
+
+	logger := log.NewLogger()
+	r, err := router.NewRouter(utils.GeneratePrivateKey(), logger, utils.Config{P: *ports})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer r.Close()
+
+	_, port, _ := net.SplitHostPort(r.Addr().String())
+	output("id", r.ID().String())
+	output("port", port)
+
+	go receive(r)
+
+	s := bufio.NewScanner(os.Stdin)
+	for s.Scan() {
+		c := strings.SplitN(s.Text(), " ", 3)
+		switch {
+		case c[0] == "bootstrap" && len(c) == 2:
+			p, err := strconv.Atoi(c[1])
+			if err == nil {
+				r.Discover([]net.UDPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: p}})
+			}
+		case c[0] == "send" && len(c) == 3:
+			dst, err := utils.NewNodeIDFromString(c[1])
+			if err == nil {
+				sendChat(r, dst, c[2])
+			}
+		case c[0] == "store" && len(c) == 3:
+			r.StoreValue(c[1], c[2])
+		case c[0] == "load" && len(c) == 2:
+			if v := r.LoadValue(c[1]); v != nil {
+				output("value", c[1], *v)
+			} else {
+				output("novalue", c[1])
+			}
+		case c[0] == "quit":
+			return
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package murcott
+
+import (
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Introduction is sent by a user to one of the contacts to introduce
+// another contact, the subject, so that two users who cannot exchange
+// their IDs out-of-band can connect through a contact they both trust.
+// Subject is the user record published by the subject, which proves its
+// key and addresses, and the introduction is signed by From.
+type Introduction struct {
+	From    utils.NodeID    `msgpack:"from"`
+	To      utils.NodeID    `msgpack:"to"`
+	Subject UserRecord      `msgpack:"subject"`
+	Time    time.Time       `msgpack:"time"`
+	Key     utils.PublicKey `msgpack:"key"`
+	Sign    utils.Signature `msgpack:"sign"`
+}
+
+// IntroductionEvent is emitted when a contact introduces another user.
+// The introduction can be accepted with AcceptIntroduction.
+type IntroductionEvent struct {
+	Introduction Introduction
+}
+
+func (i *Introduction) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		i.From.Bytes(),
+		i.To.Bytes(),
+		i.Subject.serialize(),
+		i.Time.UnixNano(),
+	})
+	return data
+}
+
+func (i *Introduction) sign(key *utils.PrivateKey) error {
+	i.Key = key.PublicKey
+	sign := key.Sign(i.serialize())
+	if sign == nil {
+		return errors.New("cannot sign introduction")
+	}
+	i.Sign = *sign
+	return nil
+}
+
+// Verify checks that the introduction is signed by the introducer
+// and that the record of the subject is signed by the subject.
+func (i *Introduction) Verify() error {
+	if i.From.Digest.Cmp(i.Key.Digest()) != 0 {
+		return errors.New("introduction signed by wrong key")
+	}
+	if !i.Key.Verify(i.serialize(), &i.Sign) {
+		return errors.New("invalid introduction signature")
+	}
+	if i.Subject.ID.Match(i.To) || i.Subject.ID.Match(i.From) {
+		return errors.New("introduction of a party to itself")
+	}
+	return i.Subject.Verify()
+}
+
+// Introduce introduces two contacts to each other. Both must have
+// authorized this user with AuthorizeContact, so that their user records
+// can be looked up and forwarded.
+func (c *Client) Introduce(a, b utils.NodeID) error {
+	if a.Match(b) {
+		return errors.New("cannot introduce a contact to itself")
+	}
+	ra, err := c.LookupRecord(a)
+	if err != nil {
+		return err
+	}
+	rb, err := c.LookupRecord(b)
+	if err != nil {
+		return err
+	}
+	err = c.sendIntroduction(a, rb)
+	if err != nil {
+		return err
+	}
+	return c.sendIntroduction(b, ra)
+}
+
+func (c *Client) sendIntroduction(dst utils.NodeID, subject UserRecord) error {
+	i := Introduction{From: c.id, To: dst, Subject: subject, Time: time.Now()}
+	err := i.sign(c.key)
+	if err != nil {
+		return err
+	}
+	t := protocol.Envelope{Type: protocol.MsgIntroduction, ID: c.id.String(), Content: i}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return c.sendMessage(dst, data)
+}
+
+// checkIntroduction accepts the introductions of this user made by
+// a contact in the roster.
+func (c *Client) checkIntroduction(i Introduction) error {
+	if !i.To.Match(c.id) {
+		return errors.New("introduction for another user")
+	}
+	if _, ok := c.Roster.profile(i.From); !ok {
+		return errors.New("introduction by a stranger")
+	}
+	err := i.Verify()
+	if err != nil {
+		return err
+	}
+	return c.router.CheckTimestamp(i.From, i.Time)
+}
+
+func (c *Client) receiveIntroduction(src utils.NodeID, i Introduction) {
+	if !i.From.Match(src) {
+		return
+	}
+	err := c.checkIntroduction(i)
+	if err != nil {
+		c.Logger.Warning("Rejected introduction from %s: %v", src.String(), err)
+		return
+	}
+	c.mbuf.Push(readPair{M: IntroductionEvent{Introduction: i}, ID: src})
+}
+
+// AcceptIntroduction adds the subject of the introduction to the roster
+// with the profile of its record, dials it at the introduced addresses
+// and authorizes it. The introduction must still be valid.
+func (c *Client) AcceptIntroduction(i Introduction) error {
+	err := c.checkIntroduction(i)
+	if err != nil {
+		return err
+	}
+	id := i.Subject.ID
+	if _, ok := c.Roster.profile(id); !ok {
+		c.Roster.Set(id, i.Subject.Profile)
+	}
+	if len(i.Subject.Addrs) > 0 {
+		c.router.AddRouteHint(id, i.Subject.Addrs[0])
+	}
+	return c.AuthorizeContact(id)
+}
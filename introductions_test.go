@@ -0,0 +1,65 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestIntroduction(t *testing.T) {
+	introducer := utils.GeneratePrivateKey()
+	subject := utils.GeneratePrivateKey()
+	from := utils.NewNodeID(utils.GlobalNamespace, introducer.Digest())
+	to := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+
+	r := UserRecord{
+		ID:      utils.NewNodeID(utils.GlobalNamespace, subject.Digest()),
+		Profile: UserProfile{Nickname: "carol"},
+		Addrs:   []string{"192.0.2.1:9200"},
+		Time:    time.Now(),
+	}
+	if err := r.sign(subject); err != nil {
+		t.Fatal(err)
+	}
+
+	i := Introduction{From: from, To: to, Subject: r, Time: time.Now()}
+	if err := i.sign(introducer); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := msgpack.Marshal(i)
+	var j Introduction
+	if err := msgpack.Unmarshal(data, &j); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+
+	k := j
+	k.Subject.Addrs = []string{"198.51.100.1:9200"}
+	if k.Verify() == nil {
+		t.Errorf("Verify() should reject altered addresses")
+	}
+
+	k = j
+	k.To = utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	if k.Verify() == nil {
+		t.Errorf("Verify() should reject an altered recipient")
+	}
+
+	k = j
+	k.From = k.To
+	if k.Verify() == nil {
+		t.Errorf("Verify() should reject an introduction signed by another key")
+	}
+
+	k = Introduction{From: from, To: r.ID, Subject: r, Time: time.Now()}
+	if err := k.sign(introducer); err != nil {
+		t.Fatal(err)
+	}
+	if k.Verify() == nil {
+		t.Errorf("Verify() should reject an introduction to the subject itself")
+	}
+}
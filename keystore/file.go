@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/h2so5/murcott/storage/atomicfile"
+	"github.com/h2so5/murcott/utils"
+)
+
+// FileKeystore stores the keys as PEM files of a directory, readable by
+// their owner only.
+type FileKeystore struct {
+	dir string
+}
+
+// NewFileKeystore returns a store of the keys in the given directory.
+func NewFileKeystore(dir string) *FileKeystore {
+	return &FileKeystore{dir: dir}
+}
+
+// Path returns the path of the file of the key of the given name.
+func (s *FileKeystore) Path(name string) string {
+	return filepath.Join(s.dir, name)
+}
+
+func (s *FileKeystore) Load(name string) (*utils.PrivateKey, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	pem, err := ioutil.ReadFile(s.Path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(pem)
+}
+
+func (s *FileKeystore) Save(name string, key *utils.PrivateKey) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	pem, err := key.MarshalText()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.Path(name), pem, 0600)
+}
+
+func (s *FileKeystore) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.Path(name))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+// Package keystore stores the private keys of the identities, in files or
+// in the keychain of the operating system.
+package keystore
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// Service is the name under which the keys are stored in the keychains.
+const Service = "murcott"
+
+var (
+	ErrNotFound    = errors.New("key not found")
+	ErrUnsupported = errors.New("system keychain not supported")
+	errKeyName     = errors.New("invalid key name")
+)
+
+// Keystore is implemented by the stores of private keys.
+// Embedders can supply their own store by implementing this interface.
+type Keystore interface {
+	// Load returns the key of the given name, or ErrNotFound.
+	Load(name string) (*utils.PrivateKey, error)
+	Save(name string, key *utils.PrivateKey) error
+	Delete(name string) error
+}
+
+// LoadOrCreate returns the key of the given name, generating and saving
+// a new key if the store holds none. It reports whether the key is new.
+func LoadOrCreate(s Keystore, name string) (*utils.PrivateKey, bool, error) {
+	key, err := s.Load(name)
+	if err == nil {
+		return key, false, nil
+	}
+	if err != ErrNotFound {
+		return nil, false, err
+	}
+	key = utils.GeneratePrivateKey()
+	err = s.Save(name, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+// NewSystemKeystore returns a store of the keys in the keychain of the
+// operating system: the Secret Service through libsecret on Linux, the
+// login keychain on macOS, and files encrypted with DPAPI for the user on
+// Windows. It returns ErrUnsupported if the keychain cannot be used.
+func NewSystemKeystore() (Keystore, error) {
+	return newSystemKeystore()
+}
+
+func checkName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\ \t\r\n\x00") {
+		return errKeyName
+	}
+	return nil
+}
+
+func decodeKey(pem []byte) (*utils.PrivateKey, error) {
+	var key utils.PrivateKey
+	err := key.UnmarshalText(pem)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// encodeSecret returns the key as a single line, as the keychain tools
+// read the secrets from a line.
+func encodeSecret(key *utils.PrivateKey) (string, error) {
+	pem, err := key.MarshalText()
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pem), nil
+}
+
+func decodeSecret(s string) (*utils.PrivateKey, error) {
+	pem, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(pem)
+}
@@ -0,0 +1,66 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestFileKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keystore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileKeystore(dir)
+
+	if _, err := s.Load("id"); err != ErrNotFound {
+		t.Errorf("Load() returns %v; expects %v", err, ErrNotFound)
+	}
+	key, created, err := LoadOrCreate(s, "id")
+	if err != nil || !created {
+		t.Fatalf("LoadOrCreate() returns %v, %v; expects a new key", created, err)
+	}
+	info, err := os.Stat(s.Path("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode is %v; expects %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+
+	loaded, created, err := LoadOrCreate(s, "id")
+	if err != nil || created {
+		t.Fatalf("LoadOrCreate() returns %v, %v; expects the saved key", created, err)
+	}
+	if loaded.Digest() != key.Digest() {
+		t.Errorf("Load() returns another key")
+	}
+
+	if err := s.Save("../id", key); err != errKeyName {
+		t.Errorf("Save() returns %v; expects %v", err, errKeyName)
+	}
+	if err := s.Delete("id"); err != nil {
+		t.Error(err)
+	}
+	if err := s.Delete("id"); err != ErrNotFound {
+		t.Errorf("Delete() returns %v; expects %v", err, ErrNotFound)
+	}
+}
+
+func TestSecretEncoding(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	secret, err := encodeSecret(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := decodeSecret(secret + "\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Digest() != key.Digest() {
+		t.Errorf("decodeSecret() returns another key")
+	}
+}
@@ -0,0 +1,63 @@
+package keystore
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// securityItemNotFound is the exit status of the security command
+// when the item is not in the keychain.
+const securityItemNotFound = 44
+
+// keychainKeystore stores the keys as generic passwords of the login
+// keychain, through the security command.
+type keychainKeystore struct{}
+
+func newSystemKeystore() (Keystore, error) {
+	if _, err := exec.LookPath("security"); err != nil {
+		return nil, ErrUnsupported
+	}
+	return keychainKeystore{}, nil
+}
+
+func (keychainKeystore) Load(name string) (*utils.PrivateKey, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	out, code, err := runTool("", "security", "find-generic-password", "-s", Service, "-a", name, "-w")
+	if code == securityItemNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecret(out)
+}
+
+// Save runs the command in the interactive mode of security, which reads
+// it from the standard input, so that the key is not in the arguments.
+func (keychainKeystore) Save(name string, key *utils.PrivateKey) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	secret, err := encodeSecret(key)
+	if err != nil {
+		return err
+	}
+	cmd := fmt.Sprintf("add-generic-password -U -s %s -a %s -w %s\n", Service, name, secret)
+	_, _, err = runTool(cmd, "security", "-i")
+	return err
+}
+
+func (keychainKeystore) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	_, code, err := runTool("", "security", "delete-generic-password", "-s", Service, "-a", name)
+	if code == securityItemNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+package keystore
+
+import (
+	"os/exec"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// secretServiceKeystore stores the keys with the Secret Service of the
+// desktop, such as GNOME Keyring or KWallet, through the secret-tool
+// command of libsecret.
+type secretServiceKeystore struct{}
+
+func newSystemKeystore() (Keystore, error) {
+	if _, err := exec.LookPath("secret-tool"); err != nil {
+		return nil, ErrUnsupported
+	}
+	return secretServiceKeystore{}, nil
+}
+
+func (secretServiceKeystore) Load(name string) (*utils.PrivateKey, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	out, _, err := runTool("", "secret-tool", "lookup", "service", Service, "account", name)
+	if _, ok := err.(*exec.ExitError); ok || (err == nil && out == "") {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decodeSecret(out)
+}
+
+func (secretServiceKeystore) Save(name string, key *utils.PrivateKey) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	secret, err := encodeSecret(key)
+	if err != nil {
+		return err
+	}
+	_, _, err = runTool(secret, "secret-tool", "store", "--label="+Service+" key "+name,
+		"service", Service, "account", name)
+	return err
+}
+
+func (s secretServiceKeystore) Delete(name string) error {
+	if _, err := s.Load(name); err != nil {
+		return err
+	}
+	_, _, err := runTool("", "secret-tool", "clear", "service", Service, "account", name)
+	return err
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !linux && !windows
+// +build !darwin,!linux,!windows
+
+package keystore
+
+func newSystemKeystore() (Keystore, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,130 @@
+package keystore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+
+	"github.com/h2so5/murcott/storage/atomicfile"
+	"github.com/h2so5/murcott/utils"
+)
+
+const cryptProtectUIForbidden = 0x1
+
+var (
+	crypt32  = syscall.NewLazyDLL("crypt32.dll")
+	kernel32 = syscall.NewLazyDLL("kernel32.dll")
+
+	procCryptProtectData   = crypt32.NewProc("CryptProtectData")
+	procCryptUnprotectData = crypt32.NewProc("CryptUnprotectData")
+	procLocalFree          = kernel32.NewProc("LocalFree")
+)
+
+type dataBlob struct {
+	size uint32
+	data *byte
+}
+
+func newDataBlob(b []byte) *dataBlob {
+	if len(b) == 0 {
+		return &dataBlob{}
+	}
+	return &dataBlob{size: uint32(len(b)), data: &b[0]}
+}
+
+// take copies the data allocated by DPAPI and frees it.
+func (b *dataBlob) take() []byte {
+	defer procLocalFree.Call(uintptr(unsafe.Pointer(b.data)))
+	return append([]byte(nil), unsafe.Slice(b.data, b.size)...)
+}
+
+func protect(b []byte) ([]byte, error) {
+	var out dataBlob
+	r, _, err := procCryptProtectData.Call(uintptr(unsafe.Pointer(newDataBlob(b))), 0, 0, 0, 0,
+		cryptProtectUIForbidden, uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return nil, err
+	}
+	return out.take(), nil
+}
+
+func unprotect(b []byte) ([]byte, error) {
+	var out dataBlob
+	r, _, err := procCryptUnprotectData.Call(uintptr(unsafe.Pointer(newDataBlob(b))), 0, 0, 0, 0,
+		cryptProtectUIForbidden, uintptr(unsafe.Pointer(&out)))
+	if r == 0 {
+		return nil, err
+	}
+	return out.take(), nil
+}
+
+// dpapiKeystore stores the keys in files encrypted with DPAPI, which only
+// the current user can decrypt on this computer.
+type dpapiKeystore struct {
+	dir string
+}
+
+func newSystemKeystore() (Keystore, error) {
+	if err := crypt32.Load(); err != nil {
+		return nil, ErrUnsupported
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	return dpapiKeystore{dir: filepath.Join(dir, Service, "keys")}, nil
+}
+
+func (s dpapiKeystore) path(name string) string {
+	return filepath.Join(s.dir, name+".dpapi")
+}
+
+func (s dpapiKeystore) Load(name string) (*utils.PrivateKey, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(s.path(name))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	pem, err := unprotect(data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeKey(pem)
+}
+
+func (s dpapiKeystore) Save(name string, key *utils.PrivateKey) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	pem, err := key.MarshalText()
+	if err != nil {
+		return err
+	}
+	data, err := protect(pem)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(s.dir, 0700)
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path(name), data, 0600)
+}
+
+func (s dpapiKeystore) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	err := os.Remove(s.path(name))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
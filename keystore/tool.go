@@ -0,0 +1,37 @@
+//go:build darwin || linux
+// +build darwin linux
+
+package keystore
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// runTool runs a keychain tool, writing the input to its standard input
+// so that the secrets do not appear in its arguments. It returns the
+// output of the tool and its exit status.
+func runTool(input string, name string, args ...string) (string, int, error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	msg := strings.TrimSpace(stderr.String())
+	if exit, ok := err.(*exec.ExitError); ok {
+		if msg == "" {
+			return stdout.String(), exit.ExitCode(), exit
+		}
+		return stdout.String(), exit.ExitCode(), fmt.Errorf("%s: %s", name, msg)
+	}
+	if err != nil {
+		return "", -1, err
+	}
+	if msg != "" {
+		return stdout.String(), 0, fmt.Errorf("%s: %s", name, msg)
+	}
+	return stdout.String(), 0, nil
+}
@@ -0,0 +1,303 @@
+// Package media provides a content-addressed cache for received files and avatars.
+package media
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/storage/atomicfile"
+)
+
+const (
+	pinsBucket = "pins"
+
+	// legacyPinsFile is where the pins were kept before they moved to
+	// the storage. It is imported and removed on Open.
+	legacyPinsFile = "pins"
+)
+
+var (
+	ErrNotFound = errors.New("not in cache")
+	ErrTooLarge = errors.New("exceeds cache quota")
+)
+
+type entry struct {
+	size   int64
+	access time.Time
+	pinned bool
+}
+
+// Cache stores blobs in a directory under their SHA-256 hash.
+// When the total size exceeds the quota, the least recently used
+// blobs are evicted. Pinned blobs are never evicted.
+type Cache struct {
+	dir     string
+	quota   int64
+	store   storage.Storage
+	size    int64
+	entries map[string]*entry
+	mutex   sync.Mutex
+}
+
+// Open opens the cache in the given directory, creating it if necessary.
+// The pins are kept in the given storage. A quota of zero disables eviction.
+func Open(dir string, quota int64, s storage.Storage) (*Cache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cache{dir: dir, quota: quota, store: s, entries: make(map[string]*entry)}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if !isHash(f.Name()) || f.IsDir() {
+			continue
+		}
+		c.entries[f.Name()] = &entry{size: f.Size(), access: f.ModTime()}
+		c.size += f.Size()
+	}
+
+	err = c.importPins()
+	if err != nil {
+		return nil, err
+	}
+	err = s.View(func(tx storage.Tx) error {
+		return tx.ForEach(pinsBucket, func(k, v []byte) error {
+			if e, ok := c.entries[string(k)]; ok {
+				e.pinned = true
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c.evict()
+	return c, nil
+}
+
+// Hash returns the key under which data is stored.
+func Hash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func isHash(name string) bool {
+	if len(name) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// Put stores data and returns its hash.
+func (c *Cache) Put(data []byte) (string, error) {
+	h := Hash(data)
+	size := int64(len(data))
+	if c.quota > 0 && size > c.quota {
+		return "", ErrTooLarge
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if e, ok := c.entries[h]; ok {
+		e.access = time.Now()
+		return h, nil
+	}
+	err := atomicfile.WriteFile(c.path(h), data, 0600)
+	if err != nil {
+		return "", err
+	}
+	c.entries[h] = &entry{size: size, access: time.Now()}
+	c.size += size
+	c.evict()
+	return h, nil
+}
+
+// Get returns the data stored under the given hash.
+func (c *Cache) Get(h string) ([]byte, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[h]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	data, err := ioutil.ReadFile(c.path(h))
+	if err != nil {
+		return nil, err
+	}
+	e.access = time.Now()
+	os.Chtimes(c.path(h), e.access, e.access)
+	return data, nil
+}
+
+// Has reports whether the given hash is in the cache.
+func (c *Cache) Has(h string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	_, ok := c.entries[h]
+	return ok
+}
+
+// Remove deletes the given hash from the cache even if it is pinned.
+func (c *Cache) Remove(h string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[h]
+	if !ok {
+		return ErrNotFound
+	}
+	err := c.remove(h)
+	if err != nil {
+		return err
+	}
+	if e.pinned {
+		return c.savePin(h, false)
+	}
+	return nil
+}
+
+// Pin protects the given hash from eviction.
+func (c *Cache) Pin(h string) error {
+	return c.setPinned(h, true)
+}
+
+// Unpin allows the given hash to be evicted again.
+func (c *Cache) Unpin(h string) error {
+	return c.setPinned(h, false)
+}
+
+func (c *Cache) setPinned(h string, pinned bool) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	e, ok := c.entries[h]
+	if !ok {
+		return ErrNotFound
+	}
+	if e.pinned == pinned {
+		return nil
+	}
+	e.pinned = pinned
+	err := c.savePin(h, pinned)
+	if err != nil {
+		e.pinned = !pinned
+		return err
+	}
+	if !pinned {
+		c.evict()
+	}
+	return nil
+}
+
+// Pinned returns the pinned hashes.
+func (c *Cache) Pinned() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	var l []string
+	for h, e := range c.entries {
+		if e.pinned {
+			l = append(l, h)
+		}
+	}
+	sort.Strings(l)
+	return l
+}
+
+// Size returns the total size of the cached data in bytes.
+func (c *Cache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.size
+}
+
+func (c *Cache) path(h string) string {
+	return filepath.Join(c.dir, h)
+}
+
+func (c *Cache) remove(h string) error {
+	err := os.Remove(c.path(h))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	c.size -= c.entries[h].size
+	delete(c.entries, h)
+	return nil
+}
+
+func (c *Cache) savePin(h string, pinned bool) error {
+	return c.store.Update(func(tx storage.Tx) error {
+		if pinned {
+			return tx.Put(pinsBucket, []byte(h), []byte{})
+		}
+		return tx.Delete(pinsBucket, []byte(h))
+	})
+}
+
+// importPins moves the pins of the legacy pins file to the storage.
+func (c *Cache) importPins() error {
+	path := filepath.Join(c.dir, legacyPinsFile)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = c.store.Update(func(tx storage.Tx) error {
+		for _, h := range strings.Fields(string(data)) {
+			err := tx.Put(pinsBucket, []byte(h), []byte{})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// evict removes the least recently used unpinned entries until
+// the cache fits in the quota.
+func (c *Cache) evict() {
+	if c.quota <= 0 || c.size <= c.quota {
+		return
+	}
+	var l []string
+	for h, e := range c.entries {
+		if !e.pinned {
+			l = append(l, h)
+		}
+	}
+	sort.Sort(byAccess{l, c.entries})
+	for _, h := range l {
+		if c.size <= c.quota {
+			return
+		}
+		c.remove(h)
+	}
+}
+
+type byAccess struct {
+	hashes  []string
+	entries map[string]*entry
+}
+
+func (s byAccess) Len() int      { return len(s.hashes) }
+func (s byAccess) Swap(i, j int) { s.hashes[i], s.hashes[j] = s.hashes[j], s.hashes[i] }
+func (s byAccess) Less(i, j int) bool {
+	return s.entries[s.hashes[i]].access.Before(s.entries[s.hashes[j]].access)
+}
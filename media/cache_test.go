@@ -0,0 +1,63 @@
+package media
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/storage"
+)
+
+func TestCacheEviction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := storage.NewMemoryStorage()
+	c, err := Open(dir, 12, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Put([]byte("too large for the quota")); err != ErrTooLarge {
+		t.Errorf("Put() returns %v; expects ErrTooLarge", err)
+	}
+
+	a, _ := c.Put([]byte("aaaa"))
+	b, _ := c.Put([]byte("bbbb"))
+	x, _ := c.Put([]byte("xxxx"))
+	time.Sleep(time.Millisecond * 10)
+	c.Get(a)
+	err = c.Pin(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	y, _ := c.Put([]byte("yyyy"))
+
+	if c.Has(x) {
+		t.Errorf("least recently used entry should be evicted")
+	}
+	if !c.Has(a) || !c.Has(y) {
+		t.Errorf("recently used entries should remain")
+	}
+	if !c.Has(b) {
+		t.Errorf("pinned entry should not be evicted")
+	}
+	if c.Size() > 12 {
+		t.Errorf("Size() returns %d; exceeds the quota", c.Size())
+	}
+
+	c, err = Open(dir, 12, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := c.Pinned(); len(p) != 1 || p[0] != b {
+		t.Errorf("Pinned() returns %v after reopen; expects [%s]", p, b)
+	}
+	data, err := c.Get(b)
+	if err != nil || string(data) != "bbbb" {
+		t.Errorf("Get() returns %q, %v", data, err)
+	}
+}
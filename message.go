@@ -1,6 +1,8 @@
 package murcott
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"mime"
 	"time"
@@ -12,8 +14,20 @@ type Content struct {
 }
 
 type ChatMessage struct {
-	Contents []Content `msgpack:"contents"`
-	Time     time.Time `msgpack:"time"`
+	// ID identifies the message in the delivery events. It is derived
+	// from the message by SendMessage if empty, and set on the received
+	// messages, of which those with an ID already received are dropped.
+	ID string `msgpack:"-"`
+
+	// Notification is the notification setting of the sender in the
+	// roster, set on the received messages of the contacts.
+	Notification string `msgpack:"-"`
+
+	Contents  []Content     `msgpack:"contents"`
+	Time      time.Time     `msgpack:"time"`
+	Ephemeral bool          `msgpack:"ephemeral"`
+	TTL       time.Duration `msgpack:"ttl"`
+	Thread    string        `msgpack:"thread"`
 }
 
 // NewPlainChatMessage generates a new ChatMessage with a plain text.
@@ -74,6 +88,19 @@ func (m *ChatMessage) Push(c Content) {
 	m.Contents = append(m.Contents, c)
 }
 
+// SetEphemeral marks the message to be deleted from history after the given duration.
+func (m *ChatMessage) SetEphemeral(ttl time.Duration) {
+	m.Ephemeral = true
+	m.TTL = ttl
+}
+
+// NewThreadID generates a random identifier for a new thread.
+func NewThreadID() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
 // Len returns the number of contents.
 func (m *ChatMessage) Len() int {
 	return len(m.Contents)
@@ -93,6 +120,9 @@ type UserProfileResponse struct {
 type UserPresence struct {
 	Status UserStatus `msgpack:"status"`
 	Ack    bool       `msgpack:"ack"`
+
+	// Probe asks the recipient to answer with its own presence.
+	Probe bool `msgpack:"probe"`
 }
 
 type UnknownMessage struct {
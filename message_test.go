@@ -1,7 +1,14 @@
 package murcott
 
 import (
+	"encoding/hex"
+	"io/ioutil"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
 func TestChatMessage(t *testing.T) {
@@ -60,3 +67,46 @@ func TestChatMessage(t *testing.T) {
 		t.Errorf("First(\"application/xml\") should return error")
 	}
 }
+
+// readGoldenEnvelope reads the golden chat envelope of the protocol package.
+func readGoldenEnvelope(t testing.TB) []byte {
+	data, err := ioutil.ReadFile("protocol/testdata/envelope_chat.hex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h string
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "#") {
+			h += strings.TrimSpace(line)
+		}
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestGoldenChatEnvelope(t *testing.T) {
+	b := readGoldenEnvelope(t)
+
+	var e struct {
+		Type    string      `msgpack:"type"`
+		ID      string      `msgpack:"id"`
+		MsgID   []byte      `msgpack:"msgid"`
+		Content ChatMessage `msgpack:"content"`
+	}
+	err := msgpack.Unmarshal(b, &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != protocol.MsgChat || e.ID != "zwfrndvx1p4MjCaiQquh95CimrkpEKRjPH" || len(e.MsgID) != 16 {
+		t.Errorf("envelope has wrong fields: %+v", e)
+	}
+	if e.Content.Text() != "hello" {
+		t.Errorf("Text() returns %s; expects %s", e.Content.Text(), "hello")
+	}
+	if !e.Content.Time.Equal(time.Unix(1400000000, 0)) {
+		t.Errorf("Time is %v; expects %v", e.Content.Time, time.Unix(1400000000, 0))
+	}
+}
@@ -0,0 +1,87 @@
+package murcott
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+)
+
+// OutboxMessage describes a chat message waiting for a route
+// to its destination.
+type OutboxMessage struct {
+	MsgID   []byte
+	Dst     utils.NodeID
+	Age     time.Duration
+	Retries int
+	Size    int
+}
+
+// Outbox returns the chat messages which have not been sent yet,
+// oldest first.
+func (c *Client) Outbox() []OutboxMessage {
+	ids := c.delivery.packets()
+	var list []OutboxMessage
+	for _, q := range c.router.Outbox() {
+		id, ok := ids[q.ID]
+		if !ok {
+			continue
+		}
+		list = append(list, OutboxMessage{
+			MsgID:   id,
+			Dst:     q.Dst,
+			Age:     q.Age,
+			Retries: q.Retries,
+			Size:    q.Size,
+		})
+	}
+	return list
+}
+
+// CancelMessage removes a chat message from the outbox. It fails if
+// the message has already been sent.
+func (c *Client) CancelMessage(msgid []byte) error {
+	for packet, id := range c.delivery.packets() {
+		if bytes.Equal(id, msgid) && c.router.CancelMessage(packet) {
+			c.delivery.cancel(msgid)
+			return nil
+		}
+	}
+	return errors.New("message not queued")
+}
+
+// outboxRecord is a queued chat message as kept in the storage.
+type outboxRecord struct {
+	Packet router.OutboxPacket `msgpack:"packet"`
+	MsgID  []byte              `msgpack:"msgid"`
+	Conv   utils.NodeID        `msgpack:"conv"`
+}
+
+// outboxRecords returns the queued chat messages with their packets.
+func (c *Client) outboxRecords() []outboxRecord {
+	pending := c.delivery.queued()
+	var list []outboxRecord
+	for _, q := range c.router.OutboxPackets() {
+		p, ok := pending[q.Packet.ID]
+		if !ok {
+			continue
+		}
+		list = append(list, outboxRecord{Packet: q, MsgID: p.id, Conv: p.conv})
+	}
+	return list
+}
+
+// restoreOutbox queues the stored chat messages again. Their delivery
+// is tracked from now on, so that the downtime does not count against
+// the delivery timeout.
+func (c *Client) restoreOutbox(list []outboxRecord) {
+	now := time.Now()
+	var packets []router.OutboxPacket
+	for _, r := range list {
+		c.delivery.sent(r.MsgID, r.Conv, r.Packet.Packet.ID, now)
+		packets = append(packets, r.Packet)
+	}
+	c.router.RestoreOutbox(packets)
+}
@@ -0,0 +1,367 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// pairingPoll is the interval at which the rendezvous is polled.
+	pairingPoll = time.Second
+
+	// minPairingCode is the minimum number of significant characters
+	// of a pairing code.
+	minPairingCode = 6
+
+	// pairingRendezvous is the number of the first characters of a code
+	// which select the rendezvous. They are not part of the password of
+	// the exchange, so that the nodes storing the rendezvous, which can
+	// find them by hashing every code, learn nothing of the password.
+	pairingRendezvous = 3
+
+	// pairingSASDigits is the number of digits of the short
+	// authentication string compared by the users.
+	pairingSASDigits = 6
+)
+
+var (
+	errPairingTimeout  = errors.New("pairing timed out")
+	errPairingMismatch = errors.New("pairing code mismatch")
+	errPairingRejected = errors.New("pairing rejected by the user")
+)
+
+// pairingCurve is the group of the key exchange. M is a point of it
+// whose discrete logarithm is unknown, derived by hashing.
+var (
+	pairingCurve         = elliptic.P256()
+	pairingMX, pairingMY = hashToPoint("murcott pairing M")
+)
+
+// hashToPoint maps a label to a point of pairingCurve
+// by trying successive counters until a point is found.
+func hashToPoint(label string) (*big.Int, *big.Int) {
+	params := pairingCurve.Params()
+	three := big.NewInt(3)
+	// The square root is y = v^((p+1)/4) as p = 3 mod 4.
+	exp := new(big.Int).Add(params.P, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	for i := uint32(0); ; i++ {
+		var ctr [4]byte
+		binary.BigEndian.PutUint32(ctr[:], i)
+		h := sha256.Sum256(append([]byte(label), ctr[:]...))
+		x := new(big.Int).SetBytes(h[:])
+		x.Mod(x, params.P)
+
+		// v = x^3 - 3x + b
+		v := new(big.Int).Exp(x, three, params.P)
+		v.Sub(v, new(big.Int).Mul(three, x))
+		v.Add(v, params.B)
+		v.Mod(v, params.P)
+
+		y := new(big.Int).Exp(v, exp, params.P)
+		if new(big.Int).Exp(y, big.NewInt(2), params.P).Cmp(v) == 0 {
+			return x, y
+		}
+	}
+}
+
+// NewPairingCode returns a random code of eight digits to be read
+// to the other user, who enters it together with this user.
+func NewPairingCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(100000000))
+	if err != nil {
+		return "", err
+	}
+	s := fmt.Sprintf("%08d", n.Int64())
+	return s[:4] + "-" + s[4:], nil
+}
+
+// normalizePairingCode ignores the case of a code and the characters
+// other than letters and digits, such as the separators.
+func normalizePairingCode(code string) (string, error) {
+	var b bytes.Buffer
+	for _, r := range strings.ToLower(code) {
+		if (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() < minPairingCode {
+		return "", errors.New("pairing code too short")
+	}
+	return b.String(), nil
+}
+
+// splitPairingCode splits a normalized code into the part which selects
+// the rendezvous and the password of the exchange.
+func splitPairingCode(code string) (rendezvous, password string) {
+	return code[:pairingRendezvous], code[pairingRendezvous:]
+}
+
+// pairingKey returns the DHT key of the rendezvous of the given kind.
+// It only depends on the rendezvous part of the code.
+func pairingKey(rendezvous, kind string) string {
+	h := sha256.Sum256([]byte("murcott pairing key " + rendezvous))
+	return "pair-" + kind + ":" + hex.EncodeToString(h[:])
+}
+
+// pairingSAS returns the short authentication string of a derived key,
+// which both users compare before the pairing completes. A node which
+// has answered both sides in place of the other derives a different key
+// with each of them.
+func pairingSAS(key []byte) string {
+	mac := pairingMAC(key, "sas", nil)
+	n := binary.BigEndian.Uint64(mac[:8]) % uint64(math.Pow10(pairingSASDigits))
+	return fmt.Sprintf("%0*d", pairingSASDigits, n)
+}
+
+// pake is one side of a symmetric SPAKE2 exchange keyed by the password
+// part of a code. Each side publishes x*G + w*M, where w is derived from
+// the password, and both derive the same key only if they entered the
+// same password.
+type pake struct {
+	w     *big.Int
+	x     *big.Int
+	point []byte
+}
+
+func newPake(password string) (*pake, error) {
+	params := pairingCurve.Params()
+	h := sha256.Sum256([]byte("murcott pairing w " + password))
+	w := new(big.Int).SetBytes(h[:])
+	w.Mod(w, params.N)
+
+	x, err := rand.Int(rand.Reader, params.N)
+	if err != nil {
+		return nil, err
+	}
+	gx, gy := pairingCurve.ScalarBaseMult(x.Bytes())
+	mx, my := pairingCurve.ScalarMult(pairingMX, pairingMY, w.Bytes())
+	px, py := pairingCurve.Add(gx, gy, mx, my)
+	return &pake{w: w, x: x, point: elliptic.Marshal(pairingCurve, px, py)}, nil
+}
+
+// finish derives the key shared with the peer which has published the
+// given point. The identities of both sides are bound to the key.
+func (p *pake) finish(id utils.NodeID, peer utils.NodeID, point []byte) ([]byte, error) {
+	params := pairingCurve.Params()
+	px, py := elliptic.Unmarshal(pairingCurve, point)
+	if px == nil {
+		return nil, errors.New("invalid pairing point")
+	}
+	// K = x * (T - w*M)
+	mx, my := pairingCurve.ScalarMult(pairingMX, pairingMY, p.w.Bytes())
+	my = new(big.Int).Sub(params.P, my)
+	tx, ty := pairingCurve.Add(px, py, mx, my)
+	kx, ky := pairingCurve.ScalarMult(tx, ty, p.x.Bytes())
+
+	// The transcript is ordered so that both sides derive the same key.
+	a := append(id.Bytes(), p.point...)
+	b := append(peer.Bytes(), point...)
+	if bytes.Compare(a, b) > 0 {
+		a, b = b, a
+	}
+	h := sha256.New()
+	h.Write([]byte("murcott pairing"))
+	h.Write(a)
+	h.Write(b)
+	h.Write(elliptic.Marshal(pairingCurve, kx, ky))
+	h.Write(p.w.Bytes())
+	return h.Sum(nil), nil
+}
+
+func pairingMAC(key []byte, label string, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// pairingOffer is published at the rendezvous by each side. It is signed
+// with the key of the node so that the identity cannot be claimed by
+// another node which knows the code.
+type pairingOffer struct {
+	ID    utils.NodeID    `msgpack:"id"`
+	Point []byte          `msgpack:"point"`
+	Time  time.Time       `msgpack:"time"`
+	Key   utils.PublicKey `msgpack:"key"`
+	Sign  utils.Signature `msgpack:"sign"`
+}
+
+func (o *pairingOffer) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		o.ID.Bytes(),
+		o.Point,
+		o.Time.UnixNano(),
+	})
+	return data
+}
+
+func (o *pairingOffer) sign(key *utils.PrivateKey) error {
+	o.Key = key.PublicKey
+	sign := key.Sign(o.serialize())
+	if sign == nil {
+		return errors.New("cannot sign pairing offer")
+	}
+	o.Sign = *sign
+	return nil
+}
+
+func (o *pairingOffer) verify() error {
+	if o.ID.Digest.Cmp(o.Key.Digest()) != 0 {
+		return errors.New("pairing offer signed by wrong key")
+	}
+	if !o.Key.Verify(o.serialize(), &o.Sign) {
+		return errors.New("invalid pairing offer signature")
+	}
+	return nil
+}
+
+// pairingConfirm proves to the side which has published Peer that the
+// side which has published Point derived the same key.
+type pairingConfirm struct {
+	Point []byte `msgpack:"point"`
+	Peer  []byte `msgpack:"peer"`
+	MAC   []byte `msgpack:"mac"`
+}
+
+// pairingPeer is a side found at the rendezvous.
+type pairingPeer struct {
+	id    utils.NodeID
+	point []byte
+	key   []byte
+}
+
+// Pair meets the user who enters the same code at a rendezvous in the
+// DHT, until the timeout expires. Both sides confirm that they share the
+// code before the other side is added to the roster and authorized with
+// a secret derived from the exchange, which pins its key. Only the first
+// valid offer found at the rendezvous is answered, and the pairing fails
+// if its confirmation does not match, so that an attacker who does not
+// know the code can only try one guess of it per pairing. The first
+// characters of the code only select the rendezvous, and the others are
+// the password of the exchange. Once both sides have confirmed the key,
+// confirm is called with the short authentication string of the key,
+// which the users compare out of band; the pairing fails unless it
+// returns true.
+func (c *Client) Pair(code string, timeout time.Duration, confirm func(sas string) bool) (utils.NodeID, error) {
+	code, err := normalizePairingCode(code)
+	if err != nil {
+		return utils.NodeID{}, err
+	}
+	rendezvous, password := splitPairingCode(code)
+	p, err := newPake(password)
+	if err != nil {
+		return utils.NodeID{}, err
+	}
+	start := time.Now()
+	offer := pairingOffer{ID: c.id, Point: p.point, Time: start}
+	err = offer.sign(c.key)
+	if err != nil {
+		return utils.NodeID{}, err
+	}
+	data, err := msgpack.Marshal(offer)
+	if err != nil {
+		return utils.NodeID{}, err
+	}
+	c.router.StoreSet(pairingKey(rendezvous, "offer"), []string{string(data)})
+
+	var peer *pairingPeer
+	for time.Since(start) < timeout {
+		if peer == nil {
+			peer = c.findPairingPeer(rendezvous, p, start, timeout)
+		}
+
+		if peer != nil {
+			ok, err := peer.confirmed(p, c.router.LoadSet(pairingKey(rendezvous, "confirm")))
+			if err != nil {
+				return utils.NodeID{}, err
+			}
+			if ok {
+				if !confirm(pairingSAS(peer.key)) {
+					return utils.NodeID{}, errPairingRejected
+				}
+				c.pin(peer.id, pairingMAC(peer.key, "secret", nil)[:contactSecretSize])
+				return peer.id, nil
+			}
+		}
+
+		select {
+		case <-c.exit:
+			return utils.NodeID{}, errors.New("client closed")
+		case <-time.After(pairingPoll):
+		}
+	}
+	return utils.NodeID{}, errPairingTimeout
+}
+
+// confirmed reports whether the peer has confirmed the key among the
+// confirmations found at the rendezvous. It fails if the confirmation of
+// the peer does not match, as the peer has entered another code.
+func (peer *pairingPeer) confirmed(p *pake, confirms []string) (bool, error) {
+	for _, str := range confirms {
+		var confirm pairingConfirm
+		if msgpack.Unmarshal([]byte(str), &confirm) != nil {
+			continue
+		}
+		if !bytes.Equal(confirm.Peer, p.point) || !bytes.Equal(confirm.Point, peer.point) {
+			continue
+		}
+		if !hmac.Equal(confirm.MAC, pairingMAC(peer.key, "confirm", confirm.Point)) {
+			return false, errPairingMismatch
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// findPairingPeer returns the side of the first valid offer found at
+// the rendezvous, and publishes the confirmation of the key derived with
+// it. It returns nil if no offer is found.
+func (c *Client) findPairingPeer(rendezvous string, p *pake, start time.Time, timeout time.Duration) *pairingPeer {
+	for _, str := range c.router.LoadSet(pairingKey(rendezvous, "offer")) {
+		var o pairingOffer
+		if msgpack.Unmarshal([]byte(str), &o) != nil || bytes.Equal(o.Point, p.point) {
+			continue
+		}
+		// Offers of previous pairings with the same code are ignored.
+		if start.Sub(c.router.PeerTime(o.ID, o.Time)) > timeout || o.verify() != nil {
+			continue
+		}
+		key, err := p.finish(c.id, o.ID, o.Point)
+		if err != nil {
+			continue
+		}
+		confirm := pairingConfirm{Point: p.point, Peer: o.Point, MAC: pairingMAC(key, "confirm", p.point)}
+		if data, err := msgpack.Marshal(confirm); err == nil {
+			c.router.StoreSet(pairingKey(rendezvous, "confirm"), []string{string(data)})
+		}
+		return &pairingPeer{id: o.ID, point: o.Point, key: key}
+	}
+	return nil
+}
+
+// pin adds a paired user to the roster and authorizes it with the secret
+// derived by both sides, so that they can look up each other's records.
+func (c *Client) pin(id utils.NodeID, secret []byte) {
+	if _, ok := c.Roster.profile(id); !ok {
+		c.Roster.Set(id, UserProfile{})
+	}
+	c.Roster.approve(id)
+	c.Roster.setSecret(id, secret)
+	go c.publishRecord(id, secret)
+	c.SendProfileRequest(id)
+}
@@ -0,0 +1,124 @@
+package murcott
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestPairingCode(t *testing.T) {
+	code, err := NewPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := normalizePairingCode(code)
+	if err != nil || len(n) != 8 {
+		t.Errorf("normalizePairingCode(%q) returns %q, %v; expects 8 digits", code, n, err)
+	}
+	if n, _ := normalizePairingCode(" AB12-cd34 "); n != "ab12cd34" {
+		t.Errorf("normalizePairingCode() returns %q; expects %q", n, "ab12cd34")
+	}
+	if _, err := normalizePairingCode("12-34"); err == nil {
+		t.Errorf("normalizePairingCode() should reject a short code")
+	}
+
+	// The rendezvous does not depend on the password.
+	rendezvous, password := splitPairingCode("12345678")
+	if rendezvous != "123" || password != "45678" {
+		t.Errorf("splitPairingCode() returns %q, %q; expects %q, %q", rendezvous, password, "123", "45678")
+	}
+	other, _ := splitPairingCode("12399999")
+	if pairingKey(rendezvous, "offer") != pairingKey(other, "offer") {
+		t.Errorf("pairingKey() should only depend on the rendezvous")
+	}
+}
+
+func TestPairingSAS(t *testing.T) {
+	sas := pairingSAS([]byte("key"))
+	if len(sas) != pairingSASDigits || sas != pairingSAS([]byte("key")) {
+		t.Errorf("pairingSAS() returns %q; expects %d digits for the key", sas, pairingSASDigits)
+	}
+	if pairingSAS([]byte("other key")) == sas {
+		t.Errorf("pairingSAS() should depend on the key")
+	}
+}
+
+func TestPake(t *testing.T) {
+	a := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	b := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+
+	pa, _ := newPake("12345678")
+	pb, _ := newPake("12345678")
+	ka, err := pa.finish(a, b, pb.point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := pb.finish(b, a, pa.point)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ka, kb) {
+		t.Errorf("finish() should derive the same key with the same code")
+	}
+
+	pc, _ := newPake("12345679")
+	kc, _ := pc.finish(b, a, pa.point)
+	ka, _ = pa.finish(a, b, pc.point)
+	if bytes.Equal(ka, kc) {
+		t.Errorf("finish() should derive different keys with different codes")
+	}
+
+	if _, err := pa.finish(a, b, []byte("invalid")); err == nil {
+		t.Errorf("finish() should reject an invalid point")
+	}
+}
+
+func TestPairingOffer(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	o := pairingOffer{ID: utils.NewNodeID(utils.GlobalNamespace, key.Digest()), Point: []byte{1, 2, 3}}
+	if err := o.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.verify(); err != nil {
+		t.Errorf("verify() returns %v; expects nil", err)
+	}
+	o.ID = utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	if o.verify() == nil {
+		t.Errorf("verify() should reject an offer claiming another identity")
+	}
+}
+
+func TestPairingConfirm(t *testing.T) {
+	a := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	b := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	pa, _ := newPake("12345678")
+	pb, _ := newPake("12345678")
+	ka, _ := pa.finish(a, b, pb.point)
+	kb, _ := pb.finish(b, a, pa.point)
+	peer := &pairingPeer{id: b, point: pb.point, key: ka}
+
+	confirm := func(point, peer, key []byte) string {
+		data, _ := msgpack.Marshal(pairingConfirm{Point: point, Peer: peer, MAC: pairingMAC(key, "confirm", point)})
+		return string(data)
+	}
+	if ok, err := peer.confirmed(pa, nil); ok || err != nil {
+		t.Errorf("confirmed() returns %v, %v; expects false, nil", ok, err)
+	}
+	other, _ := newPake("12345678")
+	if ok, err := peer.confirmed(pa, []string{confirm(other.point, pa.point, kb)}); ok || err != nil {
+		t.Errorf("confirmed() should ignore the confirmations of other sides")
+	}
+	if ok, err := peer.confirmed(pa, []string{confirm(pb.point, pa.point, kb)}); !ok || err != nil {
+		t.Errorf("confirmed() returns %v, %v; expects true, nil", ok, err)
+	}
+
+	pc, _ := newPake("12345679")
+	kc, _ := pc.finish(b, a, pa.point)
+	ka, _ = pa.finish(a, b, pc.point)
+	peer = &pairingPeer{id: b, point: pc.point, key: ka}
+	if _, err := peer.confirmed(pa, []string{confirm(pc.point, pa.point, kc)}); err != errPairingMismatch {
+		t.Errorf("confirmed() returns %v; expects %v", err, errPairingMismatch)
+	}
+}
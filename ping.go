@@ -0,0 +1,155 @@
+package murcott
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// PingResult is the answer of a node to Ping.
+type PingResult struct {
+	// RTT is the time between the ping and the pong.
+	RTT time.Duration
+
+	// Version is the newest protocol version supported by the node.
+	Version string
+}
+
+type pingRequest struct {
+	Nonce []byte `msgpack:"nonce"`
+}
+
+type pingResponse struct {
+	Nonce   []byte `msgpack:"nonce"`
+	Version string `msgpack:"version"`
+}
+
+// pingState holds the pings waiting for a pong and the handler
+// of the incoming pings.
+type pingState struct {
+	waits   map[string]chan pingResponse
+	handler func(id utils.NodeID) bool
+	mutex   sync.Mutex
+}
+
+func pingWaitKey(id utils.NodeID, nonce []byte) string {
+	return id.String() + "/" + string(nonce)
+}
+
+func (p *pingState) wait(id utils.NodeID, nonce []byte) chan pingResponse {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.waits == nil {
+		p.waits = make(map[string]chan pingResponse)
+	}
+	ch := make(chan pingResponse, 1)
+	p.waits[pingWaitKey(id, nonce)] = ch
+	return ch
+}
+
+func (p *pingState) cancel(id utils.NodeID, nonce []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.waits, pingWaitKey(id, nonce))
+}
+
+// resolve passes the pong of the node to the waiting ping, if any.
+func (p *pingState) resolve(id utils.NodeID, r pingResponse) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	key := pingWaitKey(id, r.Nonce)
+	ch, ok := p.waits[key]
+	if ok {
+		ch <- r
+		delete(p.waits, key)
+	}
+	return ok
+}
+
+// Ping checks whether the given node is reachable without sending a chat
+// message, and returns the round-trip time and the protocol version of the
+// node. It fails when ctx is done before the node answers.
+func (c *Client) Ping(ctx context.Context, id utils.NodeID) (PingResult, error) {
+	if id.Match(c.id) {
+		return PingResult{}, errors.New("cannot ping this node")
+	}
+	nonce := make([]byte, 16)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return PingResult{}, err
+	}
+	ch := c.ping.wait(id, nonce)
+	defer c.ping.cancel(id, nonce)
+
+	start := time.Now()
+	err = c.sendPingMessage(id, protocol.MsgPing, pingRequest{Nonce: nonce})
+	if err != nil {
+		return PingResult{}, err
+	}
+	select {
+	case r := <-ch:
+		return PingResult{RTT: time.Since(start), Version: r.Version}, nil
+	case <-ctx.Done():
+		return PingResult{}, ctx.Err()
+	}
+}
+
+// SetPingHandler sets a function which is called when a node pings this
+// client. The ping is left unanswered if the function returns false, so
+// that the client appears unreachable to that node. All pings are
+// answered by default.
+func (c *Client) SetPingHandler(h func(id utils.NodeID) bool) {
+	c.ping.mutex.Lock()
+	defer c.ping.mutex.Unlock()
+	c.ping.handler = h
+}
+
+func (c *Client) handlePingMessage(typ string, rm router.Message) {
+	switch typ {
+	case protocol.MsgPing:
+		u := struct {
+			Content pingRequest `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil || len(u.Content.Nonce) == 0 {
+			return
+		}
+		c.ping.mutex.Lock()
+		h := c.ping.handler
+		c.ping.mutex.Unlock()
+		if h != nil && !h(rm.Node) {
+			return
+		}
+		versions := router.ProtocolVersions()
+		c.sendPingMessage(rm.Node, protocol.MsgPong, pingResponse{
+			Nonce:   u.Content.Nonce,
+			Version: versions[len(versions)-1],
+		})
+
+	case protocol.MsgPong:
+		u := struct {
+			Content pingResponse `msgpack:"content"`
+		}{}
+		if msgpack.Unmarshal(rm.Payload, &u) != nil {
+			return
+		}
+		c.ping.resolve(rm.Node, u.Content)
+	}
+}
+
+func (c *Client) sendPingMessage(dst utils.NodeID, typ string, content interface{}) error {
+	t := protocol.Envelope{Type: typ, ID: c.id.String(), Content: content}
+
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return c.sendMessage(dst, data)
+}
@@ -0,0 +1,34 @@
+package murcott
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestPingState(t *testing.T) {
+	var p pingState
+	id1 := utils.NewRandomNodeID(utils.GlobalNamespace)
+	id2 := utils.NewRandomNodeID(utils.GlobalNamespace)
+	nonce := []byte("nonce")
+
+	ch := p.wait(id1, nonce)
+	if p.resolve(id2, pingResponse{Nonce: nonce}) {
+		t.Errorf("resolve() accepts a pong from another node")
+	}
+	if !p.resolve(id1, pingResponse{Nonce: nonce, Version: "murcott/1"}) {
+		t.Errorf("resolve() rejects the pong of the pinged node")
+	}
+	if r := <-ch; r.Version != "murcott/1" {
+		t.Errorf("wait() receives version %q; expects %q", r.Version, "murcott/1")
+	}
+	if p.resolve(id1, pingResponse{Nonce: nonce}) {
+		t.Errorf("resolve() accepts a duplicate pong")
+	}
+
+	p.wait(id1, nonce)
+	p.cancel(id1, nonce)
+	if p.resolve(id1, pingResponse{Nonce: nonce}) {
+		t.Errorf("resolve() accepts a pong of a cancelled ping")
+	}
+}
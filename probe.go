@@ -0,0 +1,156 @@
+package murcott
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// probeTimeout is the time to wait for the presence of a contact
+	// before it is considered offline.
+	probeTimeout = 5 * time.Second
+
+	// probeParallel is the number of contacts probed at the same time.
+	probeParallel = 8
+)
+
+// PresenceSnapshotEvent is emitted when the presence of all the contacts
+// has been probed, on startup and when the network is available again.
+// The contacts which have not answered are offline.
+type PresenceSnapshotEvent struct {
+	Statuses map[utils.NodeID]UserStatus
+}
+
+// probeState holds the probes waiting for the presence of a contact.
+type probeState struct {
+	waits   map[utils.NodeID][]chan UserStatus
+	running bool
+	mutex   sync.Mutex
+}
+
+// start reports whether no probe is running, and marks one as running if so.
+func (p *probeState) start() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.running {
+		return false
+	}
+	p.running = true
+	return true
+}
+
+func (p *probeState) done() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.running = false
+}
+
+func (p *probeState) wait(id utils.NodeID) chan UserStatus {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.waits == nil {
+		p.waits = make(map[utils.NodeID][]chan UserStatus)
+	}
+	ch := make(chan UserStatus, 1)
+	p.waits[id] = append(p.waits[id], ch)
+	return ch
+}
+
+func (p *probeState) cancel(id utils.NodeID, ch chan UserStatus) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	l := p.waits[id]
+	for i, c := range l {
+		if c == ch {
+			l = append(l[:i], l[i+1:]...)
+			break
+		}
+	}
+	if len(l) == 0 {
+		delete(p.waits, id)
+	} else {
+		p.waits[id] = l
+	}
+}
+
+// resolve passes the presence of the contact to the waiting probes.
+func (p *probeState) resolve(id utils.NodeID, s UserStatus) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, ch := range p.waits[id] {
+		ch <- s
+	}
+	delete(p.waits, id)
+}
+
+// probePresence asks all the contacts for their presence, probeParallel
+// at a time, and emits a PresenceSnapshotEvent. It does nothing if
+// a probe is already running.
+func (c *Client) probePresence() {
+	if !c.probes.start() {
+		return
+	}
+	defer c.probes.done()
+
+	s := c.Status()
+	if s.Type == StatusOffline {
+		return
+	}
+	t := protocol.Envelope{Type: protocol.MsgPresence, ID: c.id.String(), Content: UserPresence{Status: s, Probe: true}}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return
+	}
+
+	ids := c.Roster.List()
+	statuses := make(map[utils.NodeID]UserStatus)
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan int, probeParallel)
+	for _, id := range ids {
+		wg.Add(1)
+		sem <- 0
+		go func(id utils.NodeID) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			status := UserStatus{Type: StatusOffline}
+			ch := c.probes.wait(id)
+			defer c.probes.cancel(id, ch)
+			if c.sendMessage(id, data) == nil {
+				select {
+				case status = <-ch:
+				case <-time.After(probeTimeout):
+				}
+			}
+			mutex.Lock()
+			statuses[id] = status
+			mutex.Unlock()
+		}(id)
+	}
+	wg.Wait()
+	c.mbuf.Push(readPair{M: PresenceSnapshotEvent{Statuses: statuses}, ID: c.id})
+}
+
+// answerProbe sends the status of this user to a contact which has
+// probed it. Other nodes are not answered.
+func (c *Client) answerProbe(dst utils.NodeID) {
+	if _, ok := c.Roster.profile(dst); !ok {
+		return
+	}
+	s := c.Status()
+	if s.Type == StatusOffline {
+		return
+	}
+	t := protocol.Envelope{Type: protocol.MsgPresence, ID: c.id.String(), Content: UserPresence{Status: s}}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return
+	}
+	c.sendBatched(dst, data)
+}
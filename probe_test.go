@@ -0,0 +1,43 @@
+package murcott
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestProbeState(t *testing.T) {
+	var p probeState
+	if !p.start() {
+		t.Errorf("start() returns false; expects true")
+	}
+	if p.start() {
+		t.Errorf("start() should fail while a probe is running")
+	}
+	p.done()
+	if !p.start() {
+		t.Errorf("start() should succeed after done()")
+	}
+
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	ch1 := p.wait(id)
+	ch2 := p.wait(id)
+	p.cancel(id, ch2)
+	p.resolve(id, UserStatus{Type: StatusAway})
+	select {
+	case s := <-ch1:
+		if s.Type != StatusAway {
+			t.Errorf("wait() receives %q; expects %q", s.Type, StatusAway)
+		}
+	default:
+		t.Errorf("resolve() should pass the status to the probe")
+	}
+	select {
+	case <-ch2:
+		t.Errorf("resolve() should skip a cancelled probe")
+	default:
+	}
+	if len(p.waits) != 0 {
+		t.Errorf("resolve() should remove the waiting probes")
+	}
+}
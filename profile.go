@@ -10,10 +10,27 @@ import (
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
+const (
+	CapabilityEphemeral = "ephemeral"
+	CapabilityBatch     = "batch"
+	CapabilityCompress  = "compress"
+)
+
 type UserProfile struct {
-	Nickname  string            `msgpack:"nickname"`
-	Avatar    UserAvatar        `msgpack:"avatar"`
-	Extension map[string]string `msgpack:"ext"`
+	Nickname     string            `msgpack:"nickname"`
+	Avatar       UserAvatar        `msgpack:"avatar"`
+	Extension    map[string]string `msgpack:"ext"`
+	Capabilities []string          `msgpack:"caps"`
+}
+
+// Supports reports whether the profile advertises the given capability.
+func (p UserProfile) Supports(capability string) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
 }
 
 type UserAvatar struct {
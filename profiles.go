@@ -0,0 +1,193 @@
+package murcott
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// profileTTL is the time after which a cached profile is refreshed.
+	profileTTL = 10 * time.Minute
+
+	// profileTimeout is the time to wait for a profile response before
+	// falling back to the user record in the DHT.
+	profileTimeout = 5 * time.Second
+)
+
+var errProfileNotFound = errors.New("profile not found")
+
+// ProfileEvent is emitted when a fetched profile differs from the cached one.
+type ProfileEvent struct {
+	ID      utils.NodeID
+	Profile UserProfile
+}
+
+// profileCache keeps the time at which each profile was fetched and the
+// callers waiting for a profile. The profiles of the contacts are kept in
+// the roster, and those of the other nodes in the cache.
+type profileCache struct {
+	fetched  map[utils.NodeID]time.Time
+	waits    map[utils.NodeID][]chan UserProfile
+	profiles map[utils.NodeID]UserProfile
+	mutex    sync.Mutex
+}
+
+// stale reports whether the profile has not been fetched within profileTTL.
+// Profiles restored from storage are always stale.
+func (p *profileCache) stale(id utils.NodeID, now time.Time) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	t, ok := p.fetched[id]
+	return !ok || now.Sub(t) > profileTTL
+}
+
+// wait returns a channel which receives the profile when it is fetched,
+// and reports whether no fetch of the profile was in progress.
+func (p *profileCache) wait(id utils.NodeID) (<-chan UserProfile, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.waits == nil {
+		p.waits = make(map[utils.NodeID][]chan UserProfile)
+	}
+	ch := make(chan UserProfile, 1)
+	first := len(p.waits[id]) == 0
+	p.waits[id] = append(p.waits[id], ch)
+	return ch, first
+}
+
+// pending reports whether the profile is being fetched.
+func (p *profileCache) pending(id utils.NodeID) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.waits[id]) > 0
+}
+
+// profile returns the cached profile of a node which is not a contact.
+func (p *profileCache) profile(id utils.NodeID) (UserProfile, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	prof, ok := p.profiles[id]
+	return prof, ok
+}
+
+// store caches the profile of a node which is not a contact.
+func (p *profileCache) store(id utils.NodeID, prof UserProfile) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.profiles == nil {
+		p.profiles = make(map[utils.NodeID]UserProfile)
+	}
+	p.profiles[id] = prof
+}
+
+// resolve passes the fetched profile to the waiting callers.
+func (p *profileCache) resolve(id utils.NodeID, prof UserProfile, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.fetched == nil {
+		p.fetched = make(map[utils.NodeID]time.Time)
+	}
+	p.fetched[id] = now
+	for _, ch := range p.waits[id] {
+		ch <- prof
+	}
+	delete(p.waits, id)
+}
+
+// forget drops the cached profile and the fetch state of a node,
+// and closes the channels of the waiting callers.
+func (p *profileCache) forget(id utils.NodeID) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, ch := range p.waits[id] {
+		close(ch)
+	}
+	delete(p.waits, id)
+	delete(p.fetched, id)
+	delete(p.profiles, id)
+}
+
+// fail closes the channels of the waiting callers.
+func (p *profileCache) fail(id utils.NodeID) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, ch := range p.waits[id] {
+		close(ch)
+	}
+	delete(p.waits, id)
+}
+
+// GetProfile returns the profile of the given node. A cached profile is
+// returned immediately and refreshed in the background if it is older than
+// profileTTL. Otherwise the profile is requested from the node, and looked
+// up in the user record of the DHT if the node does not answer.
+func (c *Client) GetProfile(ctx context.Context, id utils.NodeID) (UserProfile, error) {
+	prof, ok := c.Roster.profile(id)
+	if !ok {
+		prof, ok = c.profiles.profile(id)
+	}
+	if ok {
+		if c.profiles.stale(id, time.Now()) {
+			c.refreshProfile(id)
+		}
+		return prof, nil
+	}
+	select {
+	case prof, ok := <-c.refreshProfile(id):
+		if !ok {
+			return UserProfile{}, errProfileNotFound
+		}
+		return prof, nil
+	case <-ctx.Done():
+		return UserProfile{}, ctx.Err()
+	}
+}
+
+// refreshProfile starts fetching the profile unless it is already being
+// fetched, and returns a channel which receives the result.
+func (c *Client) refreshProfile(id utils.NodeID) <-chan UserProfile {
+	ch, first := c.profiles.wait(id)
+	if first {
+		go c.fetchProfile(id)
+	}
+	return ch
+}
+
+func (c *Client) fetchProfile(id utils.NodeID) {
+	ch, _ := c.profiles.wait(id)
+	if c.SendProfileRequest(id) == nil {
+		select {
+		case <-ch:
+			return
+		case <-time.After(profileTimeout):
+		}
+	}
+	r, err := c.LookupRecord(id)
+	if err != nil {
+		c.profiles.fail(id)
+		return
+	}
+	c.updateProfile(id, r.Profile)
+}
+
+// updateProfile caches a fetched profile and emits a ProfileEvent
+// if it has changed. The profiles of the contacts are updated in the
+// roster, and the other nodes are not added to it.
+func (c *Client) updateProfile(id utils.NodeID, prof UserProfile) {
+	old, ok := c.Roster.profile(id)
+	if ok {
+		c.Roster.Set(id, prof)
+	} else {
+		old, ok = c.profiles.profile(id)
+		c.profiles.store(id, prof)
+	}
+	c.profiles.resolve(id, prof, time.Now())
+	if !ok || !reflect.DeepEqual(old, prof) {
+		c.mbuf.Push(readPair{M: ProfileEvent{ID: id, Profile: prof}, ID: id})
+	}
+}
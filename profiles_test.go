@@ -0,0 +1,117 @@
+package murcott
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestProfileCache(t *testing.T) {
+	var p profileCache
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+
+	if !p.stale(id, now) {
+		t.Errorf("stale() returns false for an unknown profile; expects true")
+	}
+
+	ch1, first := p.wait(id)
+	if !first {
+		t.Errorf("wait() returns false for the first caller; expects true")
+	}
+	ch2, first := p.wait(id)
+	if first {
+		t.Errorf("wait() returns true for the second caller; expects false")
+	}
+	p.resolve(id, UserProfile{Nickname: "alice"}, now)
+	for _, ch := range []<-chan UserProfile{ch1, ch2} {
+		if prof := <-ch; prof.Nickname != "alice" {
+			t.Errorf("wait() receives %q; expects %q", prof.Nickname, "alice")
+		}
+	}
+
+	if p.stale(id, now.Add(time.Minute)) {
+		t.Errorf("stale() returns true for a fresh profile; expects false")
+	}
+	if !p.stale(id, now.Add(profileTTL+time.Second)) {
+		t.Errorf("stale() returns false for an old profile; expects true")
+	}
+
+	ch, first := p.wait(id)
+	if !first {
+		t.Errorf("wait() returns false after resolve(); expects true")
+	}
+	p.fail(id)
+	if _, ok := <-ch; ok {
+		t.Errorf("fail() should close the waiting channels")
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	c := &Client{mbuf: newMessageBuffer(8)}
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	c.updateProfile(id, UserProfile{Nickname: "alice"})
+	c.updateProfile(id, UserProfile{Nickname: "alice"})
+	c.updateProfile(id, UserProfile{Nickname: "bob"})
+	if c.mbuf.size != 2 {
+		t.Errorf("updateProfile() emits %d events; expects 2", c.mbuf.size)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		m, _ := c.mbuf.Pop()
+		if e, ok := m.M.(ProfileEvent); !ok || e.Profile.Nickname != name {
+			t.Errorf("updateProfile() emits %v; expects a ProfileEvent of %q", m.M, name)
+		}
+	}
+
+	prof, err := c.GetProfile(context.Background(), id)
+	if err != nil || prof.Nickname != "bob" {
+		t.Errorf("GetProfile() returns %v, %v; expects the cached profile", prof, err)
+	}
+	if _, ok := c.Roster.profile(id); ok {
+		t.Errorf("updateProfile() adds a node which is not a contact to the roster")
+	}
+}
+
+func TestProfileResponse(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	node := utils.NewRandomNodeID(utils.GlobalNamespace)
+	other := utils.NewRandomNodeID(utils.GlobalNamespace)
+	respond := func(src, claimed utils.NodeID) {
+		data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgProfileResponse, ID: claimed.String(),
+			Content: UserProfileResponse{Profile: UserProfile{Nickname: "mallory"}}})
+		c.parseMessage(router.Message{Node: src, Payload: data})
+	}
+
+	respond(node, node)
+	respond(node, other)
+	if _, ok := c.Roster.profile(node); ok {
+		t.Errorf("an unsolicited profile response adds its sender to the roster")
+	}
+	if _, ok := c.profiles.profile(node); ok {
+		t.Errorf("an unsolicited profile response is cached")
+	}
+	if _, ok := c.profiles.profile(other); ok {
+		t.Errorf("a profile response for another node is cached")
+	}
+
+	// A requested profile is cached out of the roster.
+	c.profiles.wait(node)
+	respond(node, node)
+	if prof, ok := c.profiles.profile(node); !ok || prof.Nickname != "mallory" {
+		t.Errorf("the requested profile is not cached")
+	}
+	if _, ok := c.Roster.profile(node); ok {
+		t.Errorf("a requested profile adds its sender to the roster")
+	}
+}
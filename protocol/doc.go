@@ -0,0 +1,30 @@
+// Package protocol defines the structures exchanged between murcott nodes.
+//
+// All structures are encoded with msgpack. A struct is encoded as a map from
+// the names in its msgpack tags to the values, in the order of the fields.
+// Byte slices and arrays are encoded as bin, strings as str, node IDs as bin
+// of utils.NodeID.Bytes(), and times as an array of the Unix time in seconds
+// and the nanoseconds. Decoders must accept any integer width and ignore
+// unknown map keys.
+//
+// A session starts with a TypePubkey and a TypeKey packet in each direction,
+// after which the stream is encrypted with AES-OFB using the received keys.
+// The TypePubkey packets carry a random ID, the offered protocol versions
+// and the software version of the sender. If both nodes offer versions,
+// each then sends a TypeFinish packet with the SHA-256 of the
+// serializations of the TypePubkey packets, that of the dialing node
+// first, so that a modified offer is detected.
+// The TypePubkey packets of newer nodes also carry the signed capability
+// record of the sender, which older nodes send in a TypeCaps packet once
+// the session is open.
+// Every packet is signed over its canonical serialization (Packet.Serialize).
+// Nodes with a privacy level may pad packets to size buckets with the
+// Padding field, which is omitted when empty.
+//
+// DHT RPCs are sent as RPCCommand over UDP on the same port as the sessions.
+// Chat, profile, blob and contact secret messages are sent as Envelope
+// in TypeMsg packets. CheckEnvelope validates an envelope against the
+// schema registered for its type.
+//
+// The testdata directory contains golden encodings of these structures.
+package protocol
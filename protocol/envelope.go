@@ -0,0 +1,35 @@
+package protocol
+
+// Message types of an Envelope.
+const (
+	MsgChat            = "chat"
+	MsgAck             = "ack"
+	MsgRead            = "read"
+	MsgProfileRequest  = "prof-req"
+	MsgProfileResponse = "prof-res"
+	MsgBlobRequest     = "blob-req"
+	MsgBlobResponse    = "blob-res"
+	MsgContactSecret   = "contact-secret"
+	MsgPresence        = "presence"
+	MsgChannelPost     = "channel-post"
+	MsgChannelSync     = "channel-sync"
+	MsgBatch           = "batch"
+	MsgPing            = "ping"
+	MsgPong            = "pong"
+	MsgRoomEvent       = "room-event"
+	MsgRoomMetadata    = "room-meta"
+	MsgRosterSync      = "roster-sync"
+	MsgIntroduction    = "intro"
+	MsgInbox           = "inbox"
+	MsgCompressed      = "compressed"
+)
+
+// Envelope is the payload of a TypeMsg packet. ID is the base58-encoded
+// node ID of the sender. MsgID is set for chat messages, and is echoed
+// by the acknowledgement of the recipient.
+type Envelope struct {
+	Type    string      `msgpack:"type"`
+	ID      string      `msgpack:"id"`
+	MsgID   []byte      `msgpack:"msgid"`
+	Content interface{} `msgpack:"content"`
+}
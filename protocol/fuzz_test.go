@@ -0,0 +1,53 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func FuzzPacket(f *testing.F) {
+	f.Add(readGolden(f, "packet.hex"))
+	f.Add(readGolden(f, "handshake_pubkey.hex"))
+	key := utils.GeneratePrivateKey()
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var p Packet
+		if msgpack.Unmarshal(data, &p) != nil {
+			return
+		}
+		p.Serialize()
+		p.Digest()
+		p.Visited(goldenSrc)
+		p.Verify(&key.PublicKey)
+
+		b, err := msgpack.Marshal(p)
+		if err != nil {
+			t.Fatalf("cannot encode decoded packet: %v", err)
+		}
+		var q Packet
+		err = msgpack.Unmarshal(b, &q)
+		if err != nil {
+			t.Errorf("cannot decode re-encoded packet: %v", err)
+		}
+	})
+}
+
+func FuzzRPCCommand(f *testing.F) {
+	f.Add(readGolden(f, "rpc_find_node.hex"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var c RPCCommand
+		if msgpack.Unmarshal(data, &c) != nil {
+			return
+		}
+		b, err := msgpack.Marshal(c)
+		if err != nil {
+			t.Fatalf("cannot encode decoded RPC: %v", err)
+		}
+		var d RPCCommand
+		err = msgpack.Unmarshal(b, &d)
+		if err != nil {
+			t.Errorf("cannot decode re-encoded RPC: %v", err)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+var (
+	goldenGroup = goldenNodeID(utils.GroupNamespace, 0x01)
+	goldenSrc   = goldenNodeID(utils.GlobalNamespace, 0x21)
+)
+
+func goldenNodeID(ns utils.Namespace, first byte) utils.NodeID {
+	var d utils.PublicKeyDigest
+	for i := range d {
+		d[i] = first + byte(i)
+	}
+	return utils.NewNodeID(ns, d)
+}
+
+// readGolden reads a golden vector from testdata.
+// Lines starting with '#' are comments and the rest is hex.
+func readGolden(t testing.TB, name string) []byte {
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var h string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if !strings.HasPrefix(line, "#") {
+			h += line
+		}
+	}
+	b, err := hex.DecodeString(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// normalize decodes msgpack data into generic values with all integers
+// converted to int64, so that encodings which only differ in the chosen
+// integer widths or in the order of map keys compare equal.
+func normalize(t *testing.T, data []byte) interface{} {
+	var v interface{}
+	err := msgpack.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return normalizeValue(v)
+}
+
+func normalizeValue(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		for i := range x {
+			x[i] = normalizeValue(x[i])
+		}
+		return x
+	case map[interface{}]interface{}:
+		m := make(map[interface{}]interface{})
+		for k, e := range x {
+			m[normalizeValue(k)] = normalizeValue(e)
+		}
+		return m
+	}
+	r := reflect.ValueOf(v)
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return r.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return int64(r.Uint())
+	}
+	return v
+}
+
+func checkRoundTrip(t *testing.T, name string, golden []byte, v interface{}) {
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(normalize(t, data), normalize(t, golden)) {
+		t.Errorf("encoding of %s differs from the golden vector:\n%x\n%x", name, data, golden)
+	}
+}
+
+func TestGoldenPacket(t *testing.T) {
+	golden := readGolden(t, "packet.hex")
+	var p Packet
+	err := msgpack.Unmarshal(golden, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Dst.Match(goldenGroup) || !p.Src.Match(goldenSrc) {
+		t.Errorf("packet has wrong IDs: %v %v", p.Dst, p.Src)
+	}
+	if p.Type != TypeMsg || string(p.Payload) != "hello" || p.TTL != 3 {
+		t.Errorf("packet has wrong fields: %+v", p)
+	}
+	for i, b := range p.ID {
+		if b != byte(i) {
+			t.Errorf("packet ID is %x; expects 000102..13", p.ID)
+			break
+		}
+	}
+	checkRoundTrip(t, "packet", golden, p)
+
+	serialized := readGolden(t, "packet_serialize.hex")
+	if !reflect.DeepEqual(normalize(t, p.Serialize()), normalize(t, serialized)) {
+		t.Errorf("Serialize() returns %x; expects %x", p.Serialize(), serialized)
+	}
+}
+
+func TestGoldenHandshake(t *testing.T) {
+	golden := readGolden(t, "handshake_pubkey.hex")
+	var p Packet
+	err := msgpack.Unmarshal(golden, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Type != TypePubkey || p.Time != 1400000000000000000 {
+		t.Errorf("handshake packet has wrong fields: %+v", p)
+	}
+	var key utils.PublicKey
+	err = msgpack.Unmarshal(p.Payload, &key)
+	if err != nil {
+		t.Errorf("cannot decode public key: %v", err)
+	}
+	checkRoundTrip(t, "handshake packet", golden, p)
+}
+
+func TestGoldenRPC(t *testing.T) {
+	golden := readGolden(t, "rpc_find_node.hex")
+	var c RPCCommand
+	err := msgpack.Unmarshal(golden, &c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Src.Match(goldenSrc) || c.Method != RPCFindNode {
+		t.Errorf("RPC has wrong fields: %+v", c)
+	}
+	if id, ok := c.Args["id"].(string); !ok || !bytes.Equal([]byte(id), goldenGroup.Bytes()) {
+		t.Errorf("RPC has wrong target: %v", c.Args["id"])
+	}
+	checkRoundTrip(t, "RPC", golden, c)
+}
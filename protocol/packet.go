@@ -0,0 +1,138 @@
+package protocol
+
+import (
+	"crypto/sha1"
+	"errors"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Packet types.
+const (
+	TypePubkey = "pubkey" // handshake: msgpack-encoded utils.PublicKey
+	TypeKey    = "key"    // handshake: 32-byte AES key of the sender
+	TypeFinish = "finish" // handshake: SHA-256 of the pubkey packets
+	TypeMsg    = "msg"    // Envelope
+	TypePing   = "ping"   // payload is ignored
+	TypePong   = "pong"   // ID of the answered ping
+	TypeMember = "member" // group membership digest
+	TypeCaps   = "caps"   // capability record
+	TypePrune  = "prune"  // broadcast tree control
+	TypeIHave  = "ihave"  // broadcast tree control
+	TypeGraft  = "graft"  // broadcast tree control
+
+	TypeWakeRegister = "wake-reg" // wake registration of a node
+	TypeWake         = "wake"     // ID of a node with queued messages
+)
+
+// Packet is the unit of data exchanged over a session.
+type Packet struct {
+	Dst     utils.NodeID    `msgpack:"dst"`
+	Src     utils.NodeID    `msgpack:"src"`
+	Type    string          `msgpack:"type"`
+	Payload []byte          `msgpack:"payload"`
+	ID      [20]byte        `msgpack:"id"`
+	S       utils.Signature `msgpack:"sign"`
+	TTL     uint8           `msgpack:"ttl"`
+
+	// Path is a bloom filter of the nodes which have forwarded the packet.
+	// Like TTL, it is updated in transit and is not signed.
+	Path []byte `msgpack:"path"`
+
+	// Time is the sending time of the handshake packets in Unix nanoseconds,
+	// from which the clock offset of the peer is estimated.
+	Time int64 `msgpack:"time"`
+
+	// Padding fills the encoded packet up to a size bucket
+	// and is ignored by the receiver. It is not signed.
+	Padding []byte `msgpack:"pad,omitempty"`
+
+	// Offer lists the protocol versions supported by the sender of a
+	// TypePubkey packet. It is signed when present.
+	Offer []string `msgpack:"offer,omitempty"`
+
+	// Agent is the name and version of the software of the sender of
+	// a TypePubkey packet, such as "murcott/0.1". It is informational
+	// and is not signed, so that the packets verify on the nodes which
+	// do not know it.
+	Agent string `msgpack:"agent,omitempty"`
+
+	// Caps is the encoded capability record of the sender of a TypePubkey
+	// packet. The record is signed by itself, so the field is not signed.
+	Caps []byte `msgpack:"caps,omitempty"`
+}
+
+const (
+	pathFilterSize   = 64
+	pathFilterHashes = 3
+)
+
+// Serialize returns the canonical encoding of the signed fields,
+// a msgpack array of Dst, Src, Type, Payload and ID, followed by
+// Offer if it is not empty.
+func (p *Packet) Serialize() []byte {
+	ary := []interface{}{
+		p.Dst.Bytes(),
+		p.Src.Bytes(),
+		p.Type,
+		p.Payload,
+		p.ID,
+	}
+	if len(p.Offer) > 0 {
+		ary = append(ary, p.Offer)
+	}
+
+	data, _ := msgpack.Marshal(ary)
+	return data
+}
+
+func (p *Packet) Digest() [20]byte {
+	return sha1.Sum(p.Serialize())
+}
+
+func (p *Packet) Sign(key *utils.PrivateKey) error {
+	sign := key.Sign(p.Serialize())
+	if sign == nil {
+		return errors.New("cannot sign packet")
+	}
+	p.S = *sign
+	return nil
+}
+
+func (p *Packet) Verify(key *utils.PublicKey) bool {
+	return key.Verify(p.Serialize(), &p.S)
+}
+
+func pathBits(id utils.NodeID) []uint {
+	h := sha1.Sum(id.Bytes())
+	bits := make([]uint, pathFilterHashes)
+	for i := range bits {
+		bits[i] = (uint(h[i*2])<<8 | uint(h[i*2+1])) % (pathFilterSize * 8)
+	}
+	return bits
+}
+
+// Visit adds the node to the path of the packet.
+func (p *Packet) Visit(id utils.NodeID) {
+	if len(p.Path) != pathFilterSize {
+		p.Path = make([]byte, pathFilterSize)
+	}
+	for _, b := range pathBits(id) {
+		p.Path[b/8] |= 1 << (b % 8)
+	}
+}
+
+// Visited reports whether the node may be on the path of the packet.
+// It can return false positives but never false negatives.
+func (p *Packet) Visited(id utils.NodeID) bool {
+	if len(p.Path) != pathFilterSize {
+		return false
+	}
+	for _, b := range pathBits(id) {
+		if p.Path[b/8]&(1<<(b%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestPacketSignature(t *testing.T) {
+	packet := Packet{
+		Dst:     utils.NewRandomNodeID(utils.GlobalNamespace),
+		Src:     utils.NewRandomNodeID(utils.GlobalNamespace),
+		Type:    "dht",
+		Payload: []byte("payload"),
+	}
+
+	key := utils.GeneratePrivateKey()
+	packet.Sign(key)
+
+	if !packet.Verify(&key.PublicKey) {
+		t.Errorf("varification failed")
+	}
+
+	packet.Agent = "murcott/0.1"
+	if !packet.Verify(&key.PublicKey) {
+		t.Errorf("Verify() should ignore the agent")
+	}
+}
+
+func TestPacketPath(t *testing.T) {
+	var packet Packet
+	a := utils.NewRandomNodeID(utils.GlobalNamespace)
+	b := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	if packet.Visited(a) {
+		t.Errorf("Visited(a) returns true on an empty path")
+	}
+	packet.Visit(a)
+	if !packet.Visited(a) {
+		t.Errorf("Visited(a) returns false; expects true")
+	}
+	if packet.Visited(b) {
+		t.Errorf("Visited(b) returns true; expects false")
+	}
+}
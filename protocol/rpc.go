@@ -0,0 +1,44 @@
+package protocol
+
+import "github.com/h2so5/murcott/utils"
+
+// DHT RPC methods. A response has an empty method and the ID of the request.
+// Nodes of RPCVersion 1 and later answer the stores with an empty response
+// once the value is accepted, or with an error argument if it is rejected.
+const (
+	RPCPing      = "ping"       // no arguments
+	RPCFindNode  = "find-node"  // id: node ID bytes; returns nodes
+	RPCFindValue = "find-value" // key; returns value or nodes
+	RPCStore     = "store"      // key, value
+	RPCStoreNode = "store-node" // key, value: msgpack-encoded []utils.NodeInfo
+	RPCStoreSet  = "store-set"  // key, value: msgpack-encoded []string
+
+	// RPCStoreMulti adds values to a multi-value key. The value is a
+	// msgpack-encoded list of maps of value, publisher ID and ttl in
+	// seconds.
+	RPCStoreMulti = "store-multi"
+
+	// RPCFindValues returns the values of a multi-value key, encoded
+	// as for RPCStoreMulti, and the nodes nearest to it.
+	RPCFindValues = "find-values"
+)
+
+// RPCVersion is the version of the DHT RPCs sent by this implementation.
+// Older nodes send no version.
+const RPCVersion = 1
+
+// RPCCommand is a DHT request or response.
+// Net is the ID of the network, which is a group ID for group DHTs.
+// Dst is the ID bytes of the node to which it is sent, so that the nodes
+// which share a port can tell their commands apart. It is empty for the
+// commands sent to an address of an unknown node and for those of older
+// nodes.
+type RPCCommand struct {
+	Src     utils.NodeID           `msgpack:"src"`
+	Dst     []byte                 `msgpack:"dst,omitempty"`
+	Net     utils.NodeID           `msgpack:"net"`
+	ID      []byte                 `msgpack:"id"`
+	Method  string                 `msgpack:"method"`
+	Args    map[string]interface{} `msgpack:"args"`
+	Version int                    `msgpack:"version,omitempty"`
+}
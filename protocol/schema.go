@@ -0,0 +1,122 @@
+package protocol
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Schema describes the content of an Envelope type for strict decoding.
+// Required lists the map keys which the content must have. A nil
+// Required accepts any content, such as a non-map one.
+type Schema struct {
+	Required []string
+}
+
+var schemas = struct {
+	m     map[string]Schema
+	mutex sync.RWMutex
+}{m: map[string]Schema{
+	MsgChat:            {Required: []string{"contents", "time"}},
+	MsgAck:             {},
+	MsgRead:            {},
+	MsgProfileRequest:  {},
+	MsgProfileResponse: {Required: []string{"profile"}},
+	MsgBlobRequest:     {Required: []string{"blob", "index"}},
+	MsgBlobResponse:    {Required: []string{"blob", "index"}},
+	MsgContactSecret:   {Required: []string{"secret"}},
+	MsgPresence:        {Required: []string{"status"}},
+	MsgChannelPost:     {Required: []string{"channel", "id", "message", "time", "key", "sign"}},
+	MsgChannelSync:     {Required: []string{"channel"}},
+	MsgBatch:           {},
+	MsgPing:            {Required: []string{"nonce"}},
+	MsgPong:            {Required: []string{"nonce"}},
+	MsgRoomEvent:       {Required: []string{"room", "type", "time", "key", "sign"}},
+	MsgRoomMetadata:    {Required: []string{"room", "time", "key", "sign"}},
+	MsgRosterSync:      {Required: []string{"entries"}},
+	MsgIntroduction:    {Required: []string{"to", "subject", "time", "key", "sign"}},
+	MsgInbox:           {Required: []string{"message", "time", "nonce"}},
+	MsgCompressed:      {Required: []string{"data"}},
+}}
+
+// RegisterSchema registers the schema of an application-defined
+// Envelope type, or replaces the schema of a registered one.
+func RegisterSchema(typ string, s Schema) {
+	schemas.mutex.Lock()
+	defer schemas.mutex.Unlock()
+	schemas.m[typ] = s
+}
+
+// LookupSchema returns the schema of the Envelope type.
+func LookupSchema(typ string) (Schema, bool) {
+	schemas.mutex.RLock()
+	defer schemas.mutex.RUnlock()
+	s, ok := schemas.m[typ]
+	return s, ok
+}
+
+// Types returns the registered Envelope types in alphabetical order.
+func Types() []string {
+	schemas.mutex.RLock()
+	defer schemas.mutex.RUnlock()
+	l := make([]string, 0, len(schemas.m))
+	for typ := range schemas.m {
+		l = append(l, typ)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// DecodeError describes why an Envelope has been rejected.
+// Field is empty if the error is not about a field.
+type DecodeError struct {
+	Type   string
+	Field  string
+	Reason string
+}
+
+func (e *DecodeError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("decode %q envelope: field %q: %s", e.Type, e.Field, e.Reason)
+	}
+	return fmt.Sprintf("decode %q envelope: %s", e.Type, e.Reason)
+}
+
+// CheckEnvelope decodes an encoded Envelope and checks it against the
+// registered schemas. It rejects malformed envelopes, unknown types and
+// contents missing a required field with a *DecodeError.
+func CheckEnvelope(data []byte) error {
+	var e map[string]interface{}
+	if err := msgpack.Unmarshal(data, &e); err != nil {
+		return &DecodeError{Reason: err.Error()}
+	}
+	typ, ok := e["type"].(string)
+	if !ok {
+		return &DecodeError{Field: "type", Reason: "missing or not a string"}
+	}
+	s, ok := LookupSchema(typ)
+	if !ok {
+		return &DecodeError{Type: typ, Reason: "unknown type"}
+	}
+	if id, ok := e["id"].(string); !ok || id == "" {
+		return &DecodeError{Type: typ, Field: "id", Reason: "missing or not a string"}
+	}
+	if _, ok := e["content"]; !ok {
+		return &DecodeError{Type: typ, Field: "content", Reason: "missing"}
+	}
+	if s.Required == nil {
+		return nil
+	}
+	content, ok := e["content"].(map[interface{}]interface{})
+	if !ok {
+		return &DecodeError{Type: typ, Field: "content", Reason: "not a map"}
+	}
+	for _, f := range s.Required {
+		if _, ok := content[f]; !ok {
+			return &DecodeError{Type: typ, Field: "content." + f, Reason: "missing"}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import (
+	"testing"
+
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestCheckEnvelope(t *testing.T) {
+	if err := CheckEnvelope(readGolden(t, "envelope_chat.hex")); err != nil {
+		t.Errorf("CheckEnvelope() returns %v for a valid chat envelope", err)
+	}
+
+	check := func(e Envelope, field string) {
+		data, _ := msgpack.Marshal(e)
+		err := CheckEnvelope(data)
+		d, ok := err.(*DecodeError)
+		if !ok {
+			t.Errorf("CheckEnvelope(%+v) returns %v; expects a DecodeError", e, err)
+			return
+		}
+		if d.Field != field {
+			t.Errorf("DecodeError.Field is %q; expects %q", d.Field, field)
+		}
+	}
+	check(Envelope{Type: "unknown", ID: "a", Content: 1}, "")
+	check(Envelope{Type: MsgChat, Content: map[string]interface{}{}}, "id")
+	check(Envelope{Type: MsgChat, ID: "a", Content: "text"}, "content")
+	check(Envelope{Type: MsgChat, ID: "a", Content: map[string]interface{}{"contents": nil}}, "content.time")
+
+	if err := CheckEnvelope([]byte{0xc1}); err == nil {
+		t.Errorf("CheckEnvelope() accepts malformed data")
+	}
+
+	RegisterSchema("app-test", Schema{Required: []string{"x"}})
+	data, _ := msgpack.Marshal(Envelope{Type: "app-test", ID: "a", Content: map[string]int{"x": 1}})
+	if err := CheckEnvelope(data); err != nil {
+		t.Errorf("CheckEnvelope() returns %v for a registered type", err)
+	}
+}
@@ -0,0 +1,208 @@
+package murcott
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// UnknownMessageType is the type under which the envelopes of types
+// without a registered schema, and the malformed ones, are counted.
+const UnknownMessageType = "unknown"
+
+// maxProtocolPeers is the number of peers whose counters are kept.
+// The counters of the peer exchanged with least recently are dropped
+// to make room for a new peer.
+const maxProtocolPeers = 1024
+
+// ProtocolStats counts the envelopes of a type exchanged since the client
+// was created. Handling is the total time spent handling the received
+// envelopes, and Sending the total time spent queueing the sent ones.
+// Rejected counts the received envelopes which failed to decode.
+// The envelopes of a batch are counted both separately and as a part
+// of the batch.
+type ProtocolStats struct {
+	Type          string
+	Received      int64
+	Sent          int64
+	Rejected      int64
+	BytesReceived int64
+	BytesSent     int64
+	Handling      time.Duration
+	Sending       time.Duration
+}
+
+type byStatsType []ProtocolStats
+
+func (s byStatsType) Len() int           { return len(s) }
+func (s byStatsType) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byStatsType) Less(i, j int) bool { return s[i].Type < s[j].Type }
+
+// protocolCounters holds the counters of each envelope type,
+// in total and by peer, and the time of the last envelope
+// exchanged with each peer.
+type protocolCounters struct {
+	types map[string]*ProtocolStats
+	peers map[utils.NodeID]map[string]*ProtocolStats
+	last  map[utils.NodeID]time.Time
+	mutex sync.Mutex
+}
+
+// evict drops the counters of the peer exchanged with least recently.
+// The caller holds the mutex.
+func (p *protocolCounters) evict() {
+	var oldest utils.NodeID
+	var t time.Time
+	for id, last := range p.last {
+		if t.IsZero() || last.Before(t) {
+			oldest, t = id, last
+		}
+	}
+	delete(p.peers, oldest)
+	delete(p.last, oldest)
+}
+
+// get returns the total and the peer counters of the type.
+func (p *protocolCounters) get(peer utils.NodeID, typ string) (*ProtocolStats, *ProtocolStats) {
+	if _, ok := protocol.LookupSchema(typ); !ok {
+		typ = UnknownMessageType
+	}
+	if p.types == nil {
+		p.types = make(map[string]*ProtocolStats)
+		p.peers = make(map[utils.NodeID]map[string]*ProtocolStats)
+		p.last = make(map[utils.NodeID]time.Time)
+	}
+	total, ok := p.types[typ]
+	if !ok {
+		total = &ProtocolStats{Type: typ}
+		p.types[typ] = total
+	}
+	m, ok := p.peers[peer]
+	if !ok {
+		if len(p.peers) >= maxProtocolPeers {
+			p.evict()
+		}
+		m = make(map[string]*ProtocolStats)
+		p.peers[peer] = m
+	}
+	p.last[peer] = time.Now()
+	s, ok := m[typ]
+	if !ok {
+		s = &ProtocolStats{Type: typ}
+		m[typ] = s
+	}
+	return total, s
+}
+
+func (p *protocolCounters) received(peer utils.NodeID, typ string, size int, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	total, s := p.get(peer, typ)
+	for _, s := range []*ProtocolStats{total, s} {
+		s.Received++
+		s.BytesReceived += int64(size)
+		s.Handling += d
+	}
+}
+
+func (p *protocolCounters) sent(peer utils.NodeID, typ string, size int, d time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	total, s := p.get(peer, typ)
+	for _, s := range []*ProtocolStats{total, s} {
+		s.Sent++
+		s.BytesSent += int64(size)
+		s.Sending += d
+	}
+}
+
+func (p *protocolCounters) rejected(peer utils.NodeID, typ string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	total, s := p.get(peer, typ)
+	total.Rejected++
+	s.Rejected++
+}
+
+func listProtocolStats(m map[string]*ProtocolStats) []ProtocolStats {
+	var list []ProtocolStats
+	for _, s := range m {
+		list = append(list, *s)
+	}
+	sort.Sort(byStatsType(list))
+	return list
+}
+
+func (p *protocolCounters) total() []ProtocolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return listProtocolStats(p.types)
+}
+
+func (p *protocolCounters) peer(id utils.NodeID) []ProtocolStats {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return listProtocolStats(p.peers[id])
+}
+
+func (p *protocolCounters) peerIDs() []utils.NodeID {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	var list []utils.NodeID
+	for id := range p.peers {
+		list = append(list, id)
+	}
+	return list
+}
+
+// envelopeType returns the type of an encoded envelope.
+func envelopeType(data []byte) string {
+	var t struct {
+		Type string `msgpack:"type"`
+	}
+	if msgpack.Unmarshal(data, &t) != nil {
+		return UnknownMessageType
+	}
+	return t.Type
+}
+
+// sendMessage sends an encoded envelope through the router
+// and counts it in the protocol statistics.
+func (c *Client) sendMessage(dst utils.NodeID, data []byte) error {
+	_, err := c.sendMessageID(dst, data)
+	return err
+}
+
+func (c *Client) sendMessageID(dst utils.NodeID, data []byte) ([20]byte, error) {
+	start := time.Now()
+	typ := envelopeType(data)
+	data = c.compressEnvelope(dst, data)
+	id, err := c.router.SendMessageID(dst, data)
+	if err == nil {
+		c.protocolStats.sent(dst, typ, len(data), time.Since(start))
+	}
+	return id, err
+}
+
+// ProtocolStats returns the counters of each envelope type
+// exchanged with all the peers, sorted by type.
+func (c *Client) ProtocolStats() []ProtocolStats {
+	return c.protocolStats.total()
+}
+
+// PeerProtocolStats returns the counters of each envelope type exchanged
+// with the peer, sorted by type. They help to find the peers which flood
+// the node or send malformed envelopes.
+func (c *Client) PeerProtocolStats(id utils.NodeID) []ProtocolStats {
+	return c.protocolStats.peer(id)
+}
+
+// ProtocolPeers returns the peers with which envelopes have been exchanged,
+// up to the maxProtocolPeers peers exchanged with most recently.
+func (c *Client) ProtocolPeers() []utils.NodeID {
+	return c.protocolStats.peerIDs()
+}
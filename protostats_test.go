@@ -0,0 +1,74 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestProtocolCounters(t *testing.T) {
+	var p protocolCounters
+	a := utils.NewRandomNodeID(utils.GlobalNamespace)
+	b := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	p.received(a, protocol.MsgChat, 100, time.Millisecond)
+	p.received(b, protocol.MsgChat, 50, 2*time.Millisecond)
+	p.sent(a, protocol.MsgAck, 10, time.Millisecond)
+	p.received(a, "no-such-type", 10, 0)
+	p.rejected(b, "")
+
+	total := p.total()
+	if len(total) != 3 {
+		t.Fatalf("total() returns %d types; expects 3", len(total))
+	}
+	if total[0].Type != protocol.MsgAck || total[0].Sent != 1 || total[0].BytesSent != 10 {
+		t.Errorf("total()[0] = %+v; expects 1 sent ack", total[0])
+	}
+	chat := total[1]
+	if chat.Received != 2 || chat.BytesReceived != 150 || chat.Handling != 3*time.Millisecond {
+		t.Errorf("total()[1] = %+v; expects 2 received chats", chat)
+	}
+	if u := total[2]; u.Type != UnknownMessageType || u.Received != 1 || u.Rejected != 1 {
+		t.Errorf("total()[2] = %+v; expects 1 received and 1 rejected unknown", u)
+	}
+
+	l := p.peer(a)
+	if len(l) != 3 || l[1].Received != 1 || l[1].BytesReceived != 100 {
+		t.Errorf("peer() returns %+v; expects the counters of a", l)
+	}
+	if len(p.peerIDs()) != 2 {
+		t.Errorf("peerIDs() returns %d peers; expects 2", len(p.peerIDs()))
+	}
+}
+
+func TestEnvelopeType(t *testing.T) {
+	data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgPresence, ID: "a"})
+	if typ := envelopeType(data); typ != protocol.MsgPresence {
+		t.Errorf("envelopeType() returns %q; expects %q", typ, protocol.MsgPresence)
+	}
+	if typ := envelopeType([]byte{0xc1}); typ != UnknownMessageType {
+		t.Errorf("envelopeType() returns %q; expects %q", typ, UnknownMessageType)
+	}
+}
+
+func TestProtocolCountersLimit(t *testing.T) {
+	var p protocolCounters
+	first := utils.NewRandomNodeID(utils.GlobalNamespace)
+	p.received(first, protocol.MsgChat, 10, 0)
+	p.last[first] = time.Now().Add(-time.Minute)
+	for i := 0; i < maxProtocolPeers; i++ {
+		p.received(utils.NewRandomNodeID(utils.GlobalNamespace), protocol.MsgChat, 10, 0)
+	}
+	if n := len(p.peerIDs()); n != maxProtocolPeers {
+		t.Errorf("peerIDs() returns %d peers; expects %d", n, maxProtocolPeers)
+	}
+	if l := p.peer(first); len(l) != 0 {
+		t.Errorf("peer() returns %+v; expects the least recent peer to be dropped", l)
+	}
+	if total := p.total(); len(total) != 1 || total[0].Received != maxProtocolPeers+1 {
+		t.Errorf("total() returns %+v; expects the envelopes of all the peers", total)
+	}
+}
@@ -0,0 +1,232 @@
+package murcott
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// reachabilityInterval is the time after which a contact which has
+	// not been heard from is pinged in the background.
+	reachabilityInterval = 30 * time.Minute
+
+	// maxReachabilityInterval bounds the interval between the pings of a
+	// contact, which doubles after each unanswered ping.
+	maxReachabilityInterval = 24 * time.Hour
+
+	// reachabilityParallel is the number of contacts pinged at the same
+	// time in the background.
+	reachabilityParallel = 4
+)
+
+// ContactReachability tells whether a contact has answered recently,
+// and for how long it has been unreachable otherwise. A contact which
+// has been unreachable for a long time may have abandoned its identity,
+// while one which is only offline for a while answers again soon.
+type ContactReachability struct {
+	ID utils.NodeID
+
+	// LastSeen is the last time a message has been received from the
+	// contact. It is zero if the contact has never been heard from.
+	LastSeen time.Time
+
+	// LastProbed is the last time the contact has been pinged.
+	LastProbed time.Time
+
+	// UnreachableSince is the time of the first ping left unanswered
+	// since the contact has last been seen. It is zero if the contact
+	// is reachable.
+	UnreachableSince time.Time
+
+	// Failures is the number of pings left unanswered since then.
+	Failures int
+}
+
+// Reachable reports whether the contact has answered since its last
+// unanswered ping.
+func (r ContactReachability) Reachable() bool {
+	return r.UnreachableSince.IsZero()
+}
+
+// Unreachable returns the time elapsed since the contact has last been
+// seen, or since its first unanswered ping if it has never been seen.
+// It is zero for the reachable contacts.
+func (r ContactReachability) Unreachable(now time.Time) time.Duration {
+	switch {
+	case r.Reachable():
+		return 0
+	case !r.LastSeen.IsZero():
+		return now.Sub(r.LastSeen)
+	default:
+		return now.Sub(r.UnreachableSince)
+	}
+}
+
+type reachEntry struct {
+	Seen     time.Time `msgpack:"seen"`
+	Probed   time.Time `msgpack:"probed"`
+	Failing  time.Time `msgpack:"failing"`
+	Failures int       `msgpack:"failures"`
+}
+
+// next returns the time at which the contact is to be pinged. Contacts
+// which do not answer are pinged less and less often.
+func (e reachEntry) next() time.Time {
+	last := e.Seen
+	if e.Probed.After(last) {
+		last = e.Probed
+	}
+	interval := reachabilityInterval
+	for i := 0; i < e.Failures && interval < maxReachabilityInterval; i++ {
+		interval *= 2
+	}
+	if interval > maxReachabilityInterval {
+		interval = maxReachabilityInterval
+	}
+	return last.Add(interval)
+}
+
+// reachability tracks when the contacts have last been heard from
+// and the background pings which they have left unanswered.
+type reachability struct {
+	M       map[utils.NodeID]reachEntry
+	running int
+	mutex   sync.Mutex
+}
+
+// heard marks the contact as reachable.
+func (r *reachability) heard(id utils.NodeID, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.M == nil {
+		r.M = make(map[utils.NodeID]reachEntry)
+	}
+	e := r.M[id]
+	e.Seen = now
+	e.Failing = time.Time{}
+	e.Failures = 0
+	r.M[id] = e
+}
+
+// failed records a ping of the contact left unanswered.
+func (r *reachability) failed(id utils.NodeID, now time.Time) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.M == nil {
+		r.M = make(map[utils.NodeID]reachEntry)
+	}
+	e := r.M[id]
+	if e.Failing.IsZero() {
+		e.Failing = now
+	}
+	e.Failures++
+	r.M[id] = e
+}
+
+// due returns the contacts to ping now, without exceeding
+// reachabilityParallel running pings, and marks them as probed.
+// The entries of the former contacts are dropped.
+func (r *reachability) due(contacts []utils.NodeID, now time.Time) []utils.NodeID {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.M == nil {
+		r.M = make(map[utils.NodeID]reachEntry)
+	}
+	known := make(map[utils.NodeID]bool)
+	var ids []utils.NodeID
+	for _, id := range contacts {
+		known[id] = true
+		e := r.M[id]
+		if r.running >= reachabilityParallel || now.Before(e.next()) {
+			continue
+		}
+		e.Probed = now
+		r.M[id] = e
+		r.running++
+		ids = append(ids, id)
+	}
+	for id := range r.M {
+		if !known[id] {
+			delete(r.M, id)
+		}
+	}
+	return ids
+}
+
+func (r *reachability) done() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.running--
+}
+
+// forget drops the reachability of a contact.
+func (r *reachability) forget(id utils.NodeID) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.M, id)
+}
+
+// report returns the reachability of the contacts, the ones which have
+// been unreachable for the longest time first.
+func (r *reachability) report(contacts []utils.NodeID, now time.Time) []ContactReachability {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	list := make([]ContactReachability, 0, len(contacts))
+	for _, id := range contacts {
+		e := r.M[id]
+		list = append(list, ContactReachability{
+			ID:               id,
+			LastSeen:         e.Seen,
+			LastProbed:       e.Probed,
+			UnreachableSince: e.Failing,
+			Failures:         e.Failures,
+		})
+	}
+	sort.Sort(byUnreachable{list, now})
+	return list
+}
+
+type byUnreachable struct {
+	list []ContactReachability
+	now  time.Time
+}
+
+func (s byUnreachable) Len() int      { return len(s.list) }
+func (s byUnreachable) Swap(i, j int) { s.list[i], s.list[j] = s.list[j], s.list[i] }
+func (s byUnreachable) Less(i, j int) bool {
+	return s.list[i].Unreachable(s.now) > s.list[j].Unreachable(s.now)
+}
+
+// Reachability returns the reachability of the contacts of the roster,
+// the ones which have been unreachable for the longest time first.
+// The contacts which have not been heard from recently are pinged in
+// the background, less and less often while they do not answer.
+func (c *Client) Reachability() []ContactReachability {
+	ids := c.Roster.List()
+	return c.reach.report(ids, time.Now())
+}
+
+// probeReachability pings the contacts which are due.
+// Nothing is sent while the user is offline.
+func (c *Client) probeReachability(now time.Time) {
+	if c.Status().Type == StatusOffline {
+		return
+	}
+	ids := c.Roster.List()
+	for _, id := range c.reach.due(ids, now) {
+		go func(id utils.NodeID) {
+			defer c.reach.done()
+			ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+			defer cancel()
+			if _, err := c.Ping(ctx, id); err == nil {
+				c.reach.heard(id, time.Now())
+			} else {
+				c.reach.failed(id, time.Now())
+			}
+		}(id)
+	}
+}
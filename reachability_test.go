@@ -0,0 +1,84 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestReachability(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	seen := utils.NewRandomNodeID(utils.GlobalNamespace)
+	gone := utils.NewRandomNodeID(utils.GlobalNamespace)
+	contacts := []utils.NodeID{seen, gone}
+
+	var r reachability
+	r.heard(seen, now)
+	r.heard(gone, now.Add(-48*time.Hour))
+	r.heard(utils.NewRandomNodeID(utils.GlobalNamespace), now)
+
+	ids := r.due(contacts, now)
+	if len(ids) != 1 || !ids[0].Match(gone) {
+		t.Errorf("due() returns %v; expects only the contact not heard from", ids)
+	}
+	if len(r.M) != 2 {
+		t.Errorf("due() should drop the entries of the former contacts")
+	}
+	r.done()
+	r.failed(gone, now.Add(probeTimeout))
+
+	// The interval doubles after each unanswered ping.
+	if ids := r.due(contacts, now.Add(reachabilityInterval)); len(ids) != 1 || !ids[0].Match(seen) {
+		t.Errorf("due() returns %v; expects only the contact heard from before", ids)
+	}
+	r.done()
+	r.heard(seen, now.Add(reachabilityInterval+time.Second))
+	if ids := r.due(contacts, now.Add(2*reachabilityInterval)); len(ids) != 1 || !ids[0].Match(gone) {
+		t.Errorf("due() returns %v; expects the unreachable contact after the backoff", ids)
+	}
+	r.failed(gone, now.Add(2*reachabilityInterval))
+	if r.running != 1 {
+		t.Errorf("running is %d; expects 1", r.running)
+	}
+	r.done()
+
+	l := r.report(contacts, now.Add(3*time.Hour))
+	if len(l) != 2 || !l[0].ID.Match(gone) {
+		t.Fatalf("report() returns %v; expects the unreachable contact first", l)
+	}
+	if l[0].Reachable() || l[0].Failures != 2 || !l[0].UnreachableSince.Equal(now.Add(probeTimeout)) {
+		t.Errorf("report() returns %v; expects 2 failures", l[0])
+	}
+	if d := l[0].Unreachable(now.Add(3 * time.Hour)); d != 51*time.Hour {
+		t.Errorf("Unreachable() returns %v; expects %v", d, 51*time.Hour)
+	}
+	if !l[1].Reachable() || l[1].Unreachable(now) != 0 {
+		t.Errorf("report() returns %v; expects a reachable contact", l[1])
+	}
+
+	r.heard(gone, now.Add(3*time.Hour))
+	if l := r.report(contacts, now.Add(3*time.Hour)); !l[0].Reachable() || !l[1].Reachable() {
+		t.Errorf("heard() should mark the contact as reachable")
+	}
+}
+
+func TestReachabilityParallel(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	var contacts []utils.NodeID
+	for i := 0; i < reachabilityParallel+2; i++ {
+		contacts = append(contacts, utils.NewRandomNodeID(utils.GlobalNamespace))
+	}
+
+	var r reachability
+	if ids := r.due(contacts, now); len(ids) != reachabilityParallel {
+		t.Errorf("due() returns %d contacts; expects %d", len(ids), reachabilityParallel)
+	}
+	if ids := r.due(contacts, now); len(ids) != 0 {
+		t.Errorf("due() returns %d contacts while the pings are running; expects 0", len(ids))
+	}
+	r.done()
+	if ids := r.due(contacts, now); len(ids) != 1 {
+		t.Errorf("due() returns %d contacts; expects 1", len(ids))
+	}
+}
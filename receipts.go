@@ -0,0 +1,259 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Delivery states of a sent message.
+const (
+	DeliveryDelivered = iota
+	DeliveryRead
+	DeliveryFailed
+)
+
+// SentEvent is the local echo of a message sent by this client. It is
+// emitted before the message is sent, so that applications can display
+// the message and track its state with DeliveryEvent by its ID.
+type SentEvent struct {
+	ID      string
+	Dst     utils.NodeID
+	Message ChatMessage
+}
+
+// DeliveryEvent is emitted when the state of a sent message changes.
+// Messages which have not been acknowledged within deliveryTimeout fail.
+type DeliveryEvent struct {
+	ID     string
+	Dst    utils.NodeID
+	Status int
+}
+
+// NewMessageID generates a random UUID for a message. Applications can
+// set it as the ID of a ChatMessage to know the ID before sending it.
+// By default, SendMessage derives the ID from the message instead.
+func NewMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatMessageID(b[:])
+}
+
+// contentMessageID derives the ID of a message from its sender, its
+// conversation, the nonce of the session, the number of messages sent
+// before in the conversation and its body, so that its retransmissions
+// have the same ID.
+func contentMessageID(src, conv utils.NodeID, nonce []byte, counter uint64, msg ChatMessage) []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		src.Bytes(),
+		conv.Bytes(),
+		nonce,
+		counter,
+		msg.Contents,
+		msg.Thread,
+	})
+	h := sha256.Sum256(data)
+	return h[:16]
+}
+
+// messageCounters counts the messages sent in each conversation.
+// The counters are saved with the client. Since they may not have been
+// saved before a restart, the IDs are also derived from a random nonce
+// of each session.
+type messageCounters struct {
+	M     map[utils.NodeID]uint64
+	nonce []byte
+	mutex sync.Mutex
+}
+
+// session returns the nonce of this session.
+func (m *messageCounters) session() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.nonce == nil {
+		m.nonce = make([]byte, 8)
+		rand.Read(m.nonce)
+	}
+	return m.nonce
+}
+
+// next returns the counter of the conversation and increments it.
+func (m *messageCounters) next(conv utils.NodeID) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.M == nil {
+		m.M = make(map[utils.NodeID]uint64)
+	}
+	n := m.M[conv]
+	m.M[conv] = n + 1
+	return n
+}
+
+// forget drops the counter of the conversation.
+func (m *messageCounters) forget(conv utils.NodeID) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.M, conv)
+}
+
+// maxSentMessages bounds the number of sent messages whose
+// conversations are remembered for the read receipts.
+const maxSentMessages = 4096
+
+type sentMessage struct {
+	Conv utils.NodeID `msgpack:"conv"`
+	Time time.Time    `msgpack:"time"`
+}
+
+// sentMessages remembers the conversations of the last messages sent by
+// this node by their IDs, to which the read receipts refer. The oldest
+// messages are forgotten first. The conversations are saved with the client.
+type sentMessages struct {
+	M     map[string]sentMessage
+	mutex sync.Mutex
+}
+
+func (s *sentMessages) add(id []byte, conv utils.NodeID, now time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.M == nil {
+		s.M = make(map[string]sentMessage)
+	}
+	if _, ok := s.M[string(id)]; !ok && len(s.M) >= maxSentMessages {
+		var oldest string
+		for k, m := range s.M {
+			if oldest == "" || m.Time.Before(s.M[oldest].Time) {
+				oldest = k
+			}
+		}
+		delete(s.M, oldest)
+	}
+	s.M[string(id)] = sentMessage{Conv: conv, Time: now}
+}
+
+func (s *sentMessages) conversation(id []byte) (utils.NodeID, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	m, ok := s.M[string(id)]
+	return m.Conv, ok
+}
+
+// forget drops the sent messages of a conversation.
+func (s *sentMessages) forget(conv utils.NodeID) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for k, m := range s.M {
+		if m.Conv.Match(conv) {
+			delete(s.M, k)
+		}
+	}
+}
+
+// seenMessages remembers the IDs of the last received messages
+// in a filter of bounded memory.
+type seenMessages struct {
+	filter *utils.DuplicateFilter
+	mutex  sync.Mutex
+}
+
+// add records the ID of a received message. It returns false
+// if the message has already been received.
+func (s *seenMessages) add(src utils.NodeID, id []byte) bool {
+	key := src.String() + ":" + string(id)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.filter == nil {
+		s.filter = utils.NewDuplicateFilter(0, 0)
+	}
+	return s.filter.Add([]byte(key))
+}
+
+// reset forgets all the received messages, since the filter cannot
+// forget those of a single node.
+func (s *seenMessages) reset() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.filter != nil {
+		s.filter.Reset()
+	}
+}
+
+func (s *seenMessages) stats() utils.FilterStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.filter == nil {
+		s.filter = utils.NewDuplicateFilter(0, 0)
+	}
+	return s.filter.Stats()
+}
+
+// DuplicateFilterStats returns the occupancy of the filters which drop
+// the duplicates of the packets received by the router and of the
+// messages received by the client.
+func (c *Client) DuplicateFilterStats() (packets, messages utils.FilterStats) {
+	return c.router.Stats().Filter, c.seen.stats()
+}
+
+func formatMessageID(b []byte) string {
+	if len(b) != 16 {
+		return hex.EncodeToString(b)
+	}
+	h := hex.EncodeToString(b)
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+func parseMessageID(id string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.Replace(id, "-", "", -1))
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid message ID")
+	}
+	return b, nil
+}
+
+// readConversation returns the conversation of the message sent by this
+// node with the given ID, if the node which reports that it has read it
+// is the contact it was sent to or a member of the room.
+func (c *Client) readConversation(node utils.NodeID, msgid []byte) (utils.NodeID, bool) {
+	conv, ok := c.sent.conversation(msgid)
+	if !ok {
+		return utils.NodeID{}, false
+	}
+	if conv.Match(node) {
+		return conv, true
+	}
+	if bytes.Equal(conv.NS[:], utils.GroupNamespace[:]) {
+		for _, m := range c.router.Members(conv) {
+			if m.Match(node) {
+				return conv, true
+			}
+		}
+	}
+	return utils.NodeID{}, false
+}
+
+// MarkRead tells the sender of a received message that it has been read.
+func (c *Client) MarkRead(src utils.NodeID, id string) error {
+	msgid, err := parseMessageID(id)
+	if err != nil {
+		return err
+	}
+	t := protocol.Envelope{Type: protocol.MsgRead, ID: c.id.String(), Content: MessageAck{ID: msgid}}
+
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	return c.sendBatched(src, data)
+}
@@ -0,0 +1,175 @@
+package murcott
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestMessageID(t *testing.T) {
+	id := NewMessageID()
+	if len(id) != 36 || id[14] != '4' {
+		t.Errorf("NewMessageID() returns %q; expects a version 4 UUID", id)
+	}
+	if id == NewMessageID() {
+		t.Errorf("NewMessageID() should return a different ID each time")
+	}
+	b, err := parseMessageID(id)
+	if err != nil || len(b) != 16 {
+		t.Errorf("parseMessageID(%q) returns %v, %v", id, b, err)
+	}
+	if s := formatMessageID(b); s != id {
+		t.Errorf("formatMessageID() returns %q; expects %q", s, id)
+	}
+	if b, _ := parseMessageID("0102"); !bytes.Equal(b, []byte{1, 2}) {
+		t.Errorf("parseMessageID() returns %v; expects %v", b, []byte{1, 2})
+	}
+	if _, err := parseMessageID("not an id"); err == nil {
+		t.Errorf("parseMessageID() should fail for an invalid ID")
+	}
+}
+
+func TestContentMessageID(t *testing.T) {
+	src := utils.NewRandomNodeID(utils.GlobalNamespace)
+	conv := utils.NewRandomNodeID(utils.GlobalNamespace)
+	msg := NewPlainChatMessage("hello")
+
+	nonce := []byte("session")
+	id := contentMessageID(src, conv, nonce, 0, msg)
+	if len(id) != 16 {
+		t.Errorf("contentMessageID() returns %d bytes; expects 16", len(id))
+	}
+	later := msg
+	later.Time = msg.Time.Add(1)
+	if !bytes.Equal(contentMessageID(src, conv, nonce, 0, later), id) {
+		t.Errorf("contentMessageID() should not depend on the time")
+	}
+	if bytes.Equal(contentMessageID(src, conv, nonce, 1, msg), id) {
+		t.Errorf("contentMessageID() should depend on the counter")
+	}
+	if bytes.Equal(contentMessageID(src, conv, []byte("restart"), 0, msg), id) {
+		t.Errorf("contentMessageID() should depend on the session")
+	}
+	if bytes.Equal(contentMessageID(conv, src, nonce, 0, msg), id) {
+		t.Errorf("contentMessageID() should depend on the sender")
+	}
+	if bytes.Equal(contentMessageID(src, conv, nonce, 0, NewPlainChatMessage("bye")), id) {
+		t.Errorf("contentMessageID() should depend on the body")
+	}
+
+	var c messageCounters
+	if n := c.next(conv); n != 0 {
+		t.Errorf("next() returns %d; expects 0", n)
+	}
+	c.next(conv)
+	s := storage.NewMemoryStorage()
+	err := s.Update(c.save)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c2 messageCounters
+	err = s.View(c2.restore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := c2.next(conv); n != 2 {
+		t.Errorf("next() returns %d after restore; expects 2", n)
+	}
+	if !bytes.Equal(c.session(), c.session()) || bytes.Equal(c.session(), c2.session()) {
+		t.Errorf("session() should return a nonce of each session")
+	}
+}
+
+func TestSeenMessages(t *testing.T) {
+	src := utils.NewRandomNodeID(utils.GlobalNamespace)
+	var s seenMessages
+	if !s.add(src, []byte{1}) {
+		t.Errorf("add() returns false for a new message")
+	}
+	if s.add(src, []byte{1}) {
+		t.Errorf("add() returns true for a retransmitted message")
+	}
+	if !s.add(utils.NewRandomNodeID(utils.GlobalNamespace), []byte{1}) {
+		t.Errorf("add() should not mix up the senders")
+	}
+	s.filter = utils.NewDuplicateFilter(16, 0)
+	s.add(src, []byte{1})
+	for i := 0; i < 2*16; i++ {
+		s.add(src, []byte{2, byte(i), byte(i >> 8)})
+	}
+	if !s.add(src, []byte{1}) {
+		t.Errorf("add() should forget the oldest messages")
+	}
+	if st := s.stats(); st.Capacity != 16 || st.Rotations != 2 {
+		t.Errorf("stats() returns %+v; expects 2 rotations of 16 items", st)
+	}
+}
+
+func TestSentMessages(t *testing.T) {
+	var s sentMessages
+	conv := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+	for i := 0; i < maxSentMessages+1; i++ {
+		s.add([]byte{byte(i), byte(i >> 8)}, conv, now.Add(time.Duration(i)))
+	}
+	if len(s.M) != maxSentMessages {
+		t.Errorf("sentMessages holds %d messages; expects %d", len(s.M), maxSentMessages)
+	}
+	if _, ok := s.conversation([]byte{0, 0}); ok {
+		t.Errorf("conversation() should forget the oldest message")
+	}
+	if c, ok := s.conversation([]byte{1, 0}); !ok || !c.Match(conv) {
+		t.Errorf("conversation() returns %v, %v; expects %v", c, ok, conv)
+	}
+}
+
+func TestReadReceipts(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	contact := utils.NewRandomNodeID(utils.GlobalNamespace)
+	other := utils.NewRandomNodeID(utils.GlobalNamespace)
+	msgid, _ := parseMessageID(NewMessageID())
+	c.sent.add(msgid, contact, time.Now())
+
+	// The conversations of the sent messages are saved with the client.
+	s := storage.NewMemoryStorage()
+	if err := c.Save(s); err != nil {
+		t.Fatal(err)
+	}
+	c.sent.M = nil
+	if err := c.Load(s); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(src utils.NodeID, id []byte) []DeliveryEvent {
+		data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgRead, ID: src.String(), Content: MessageAck{ID: id}})
+		c.parseMessage(router.Message{Node: src, Payload: data})
+		var events []DeliveryEvent
+		for c.mbuf.size > 0 {
+			m, _ := c.mbuf.Pop()
+			if e, ok := m.M.(DeliveryEvent); ok {
+				events = append(events, e)
+			}
+		}
+		return events
+	}
+	if e := read(other, msgid); len(e) != 0 {
+		t.Errorf("a read receipt of another node emits %v; expects none", e)
+	}
+	if e := read(contact, []byte("unknown")); len(e) != 0 {
+		t.Errorf("a read receipt of an unknown message emits %v; expects none", e)
+	}
+	if e := read(contact, msgid); len(e) != 1 || e[0].Status != DeliveryRead || !e[0].Dst.Match(contact) {
+		t.Errorf("a read receipt of the recipient emits %v; expects a DeliveryRead event", e)
+	}
+}
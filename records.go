@@ -0,0 +1,234 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	contactSecretSize = 32
+
+	// recordInterval is the interval at which the user records
+	// are published again.
+	recordInterval = 10 * time.Minute
+)
+
+// ContactSecret carries the secret of a relationship to an authorized
+// contact. The secret blinds the DHT keys of the user records of both
+// sides, so that third parties observing the DHT cannot enumerate who
+// is looking up whom.
+type ContactSecret struct {
+	Secret []byte `msgpack:"secret"`
+}
+
+// UserRecord is the profile and the addresses of a user. A copy of it is
+// published in the DHT for each authorized contact, under a key blinded
+// with the secret of the relationship and encrypted with the same secret.
+// It is signed with the private key of the user.
+type UserRecord struct {
+	ID      utils.NodeID    `msgpack:"id"`
+	Profile UserProfile     `msgpack:"profile"`
+	Addrs   []string        `msgpack:"addrs"`
+	Time    time.Time       `msgpack:"time"`
+	Key     utils.PublicKey `msgpack:"key"`
+	Sign    utils.Signature `msgpack:"sign"`
+}
+
+func (r *UserRecord) serialize() []byte {
+	prof, _ := msgpack.Marshal(r.Profile)
+	data, _ := msgpack.Marshal([]interface{}{
+		r.ID.Bytes(),
+		prof,
+		r.Addrs,
+		r.Time.UnixNano(),
+	})
+	return data
+}
+
+func (r *UserRecord) sign(key *utils.PrivateKey) error {
+	r.Key = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign user record")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Verify checks that the record is signed by its user.
+func (r *UserRecord) Verify() error {
+	if r.ID.Digest.Cmp(r.Key.Digest()) != 0 {
+		return errors.New("user record signed by wrong key")
+	}
+	if !r.Key.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid user record signature")
+	}
+	return nil
+}
+
+func secretMAC(secret []byte, label string, id utils.NodeID) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	mac.Write(id.Bytes())
+	return mac.Sum(nil)
+}
+
+// blindKey returns the DHT key of the record of the given user,
+// which only the holders of the secret can derive.
+func blindKey(secret []byte, id utils.NodeID) string {
+	return "record:" + hex.EncodeToString(secretMAC(secret, "key", id))
+}
+
+func recordCipher(secret []byte, id utils.NodeID) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(secretMAC(secret, "cipher", id))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealRecord(secret []byte, r UserRecord) (string, error) {
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	aead, err := recordCipher(secret, r.ID)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return string(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+func openRecord(secret []byte, id utils.NodeID, str string) (UserRecord, error) {
+	var r UserRecord
+	aead, err := recordCipher(secret, id)
+	if err != nil {
+		return r, err
+	}
+	data := []byte(str)
+	if len(data) < aead.NonceSize() {
+		return r, errors.New("user record too short")
+	}
+	data, err = aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return r, err
+	}
+	err = msgpack.Unmarshal(data, &r)
+	if err != nil {
+		return r, err
+	}
+	if !r.ID.Match(id) {
+		return r, errors.New("user record for another user")
+	}
+	return r, r.Verify()
+}
+
+// AddContact adds the node to the roster with the given profile and
+// approves it, so that it may share the secret of the relationship.
+func (c *Client) AddContact(id utils.NodeID, prof UserProfile) {
+	c.Roster.Set(id, prof)
+	c.Roster.approve(id)
+}
+
+// AuthorizeContact approves the given contact, shares the secret of the
+// relationship with it and publishes the user record for it. The contact
+// can then look up the record with LookupRecord, and vice versa.
+func (c *Client) AuthorizeContact(id utils.NodeID) error {
+	c.Roster.approve(id)
+	secret := c.Roster.secret(id)
+	if secret == nil {
+		secret = make([]byte, contactSecretSize)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return err
+		}
+		c.Roster.setSecret(id, secret)
+	}
+
+	t := protocol.Envelope{Type: protocol.MsgContactSecret, ID: c.id.String(), Content: ContactSecret{Secret: secret}}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	c.sendMessage(id, data)
+	return c.publishRecord(id, secret)
+}
+
+// receiveSecret stores the secret shared by a contact. Secrets from nodes
+// which the user has not approved are dropped. If both sides authorized
+// each other at the same time, the smaller secret wins.
+func (c *Client) receiveSecret(id utils.NodeID, secret []byte) {
+	if len(secret) != contactSecretSize || !c.Roster.approved(id) {
+		return
+	}
+	old := c.Roster.secret(id)
+	if old != nil && bytes.Compare(old, secret) <= 0 {
+		return
+	}
+	c.Roster.setSecret(id, secret)
+	go c.publishRecord(id, secret)
+}
+
+// publishRecord stores the user record for the given contact in the DHT.
+func (c *Client) publishRecord(id utils.NodeID, secret []byte) error {
+	r := UserRecord{
+		ID:      c.id,
+		Profile: c.profile,
+		Addrs:   c.router.PublishedAddrs(),
+		Time:    time.Now(),
+	}
+	r.Profile.Capabilities = c.capabilities()
+	err := r.sign(c.key)
+	if err != nil {
+		return err
+	}
+	str, err := sealRecord(secret, r)
+	if err != nil {
+		return err
+	}
+	c.router.StoreValue(blindKey(secret, c.id), str)
+	return nil
+}
+
+// publishRecords stores the user records for all authorized contacts.
+func (c *Client) publishRecords() {
+	for id, secret := range c.Roster.secrets() {
+		err := c.publishRecord(id, secret)
+		if err != nil {
+			c.Logger.Error("Cannot publish user record: %v", err)
+		}
+	}
+}
+
+// LookupRecord returns the user record published by the given contact.
+func (c *Client) LookupRecord(id utils.NodeID) (UserRecord, error) {
+	secret := c.Roster.secret(id)
+	if secret == nil {
+		return UserRecord{}, errors.New("contact not authorized")
+	}
+	str := c.router.LoadValue(blindKey(secret, id))
+	if str == nil {
+		return UserRecord{}, errors.New("user record not found")
+	}
+	r, err := openRecord(secret, id, *str)
+	if err != nil {
+		return r, err
+	}
+	return r, c.router.CheckTimestamp(id, r.Time)
+}
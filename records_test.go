@@ -0,0 +1,126 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestBlindKey(t *testing.T) {
+	a := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	b := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	s1 := []byte("0123456789abcdef0123456789abcdef")
+	s2 := []byte("fedcba9876543210fedcba9876543210")
+
+	if blindKey(s1, a) != blindKey(s1, a) {
+		t.Errorf("blindKey() should be deterministic")
+	}
+	if blindKey(s1, a) == blindKey(s2, a) {
+		t.Errorf("blindKey() should differ between secrets")
+	}
+	if blindKey(s1, a) == blindKey(s1, b) {
+		t.Errorf("blindKey() should differ between users")
+	}
+}
+
+func TestUserRecord(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(utils.GlobalNamespace, key.Digest())
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	r := UserRecord{
+		ID:      id,
+		Profile: UserProfile{Nickname: "alice"},
+		Addrs:   []string{"192.0.2.1:9200"},
+		Time:    time.Now(),
+	}
+	err := r.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	str, err := sealRecord(secret, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := openRecord(secret, id, str)
+	if err != nil {
+		t.Fatalf("openRecord() returns %v", err)
+	}
+	if o.Profile.Nickname != "alice" || len(o.Addrs) != 1 || o.Addrs[0] != "192.0.2.1:9200" {
+		t.Errorf("openRecord() returns %+v; expects %+v", o, r)
+	}
+
+	_, err = openRecord([]byte("fedcba9876543210fedcba9876543210"), id, str)
+	if err == nil {
+		t.Errorf("openRecord() should fail with a wrong secret")
+	}
+	other := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	_, err = openRecord(secret, other, str)
+	if err == nil {
+		t.Errorf("openRecord() should fail for another user")
+	}
+
+	r.Profile.Nickname = "mallory"
+	if r.Verify() == nil {
+		t.Errorf("Verify() should fail for a modified record")
+	}
+}
+
+func TestRosterApproved(t *testing.T) {
+	a := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	b := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	stranger := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+
+	var r Roster
+	r.Set(stranger, UserProfile{Nickname: "stranger"})
+	r.SetSettings(stranger, ContactSettings{Muted: true})
+	if r.approved(stranger) {
+		t.Errorf("approved() should not accept a node only because it is in the roster")
+	}
+
+	r.Set(a, UserProfile{})
+	r.approve(a)
+	r.Batch(func(tx *RosterTx) error {
+		tx.Add(b, UserProfile{})
+		return nil
+	})
+	if !r.approved(a) || !r.approved(b) {
+		t.Errorf("approved() should accept the approved contacts")
+	}
+	r.Remove(a)
+	if r.approved(a) {
+		t.Errorf("approved() should reject a removed contact")
+	}
+}
+
+func TestReceiveSecretStranger(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	stranger := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	for _, e := range []protocol.Envelope{
+		{Type: protocol.MsgProfileResponse, ID: stranger.String(), Content: UserProfileResponse{Profile: UserProfile{Nickname: "stranger"}}},
+		{Type: protocol.MsgContactSecret, ID: stranger.String(), Content: ContactSecret{Secret: make([]byte, contactSecretSize)}},
+	} {
+		data, _ := msgpack.Marshal(e)
+		c.parseMessage(router.Message{Node: stranger, Payload: data})
+	}
+	if c.Roster.secret(stranger) != nil {
+		t.Errorf("the secret of a node which has not been approved is stored")
+	}
+
+	c.AddContact(stranger, UserProfile{})
+	data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgContactSecret, ID: stranger.String(), Content: ContactSecret{Secret: make([]byte, contactSecretSize)}})
+	c.parseMessage(router.Message{Node: stranger, Payload: data})
+	if c.Roster.secret(stranger) == nil {
+		t.Errorf("the secret of an added contact is not stored")
+	}
+}
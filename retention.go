@@ -0,0 +1,73 @@
+package murcott
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// RetentionPolicy limits how long archived messages are kept.
+// Zero values are ignored.
+type RetentionPolicy struct {
+	MaxAge      time.Duration
+	MaxMessages int
+}
+
+// PurgeEvent is emitted when archived data of a contact has been purged.
+type PurgeEvent struct {
+	ID       utils.NodeID
+	Messages int
+	Contact  bool
+}
+
+// SetRetention sets the retention policy applied to the message history.
+func (c *Client) SetRetention(p RetentionPolicy) {
+	c.retentionMutex.Lock()
+	c.retention = p
+	c.retentionMutex.Unlock()
+	c.applyRetention(time.Now())
+}
+
+// Retention returns the current retention policy.
+func (c *Client) Retention() RetentionPolicy {
+	c.retentionMutex.Lock()
+	defer c.retentionMutex.Unlock()
+	return c.retention
+}
+
+func (c *Client) applyRetention(now time.Time) {
+	p := c.Retention()
+	if p.MaxAge <= 0 && p.MaxMessages <= 0 {
+		return
+	}
+	for id, list := range c.History.Trim(now, p.MaxAge, p.MaxMessages) {
+		c.unindex(list)
+		c.mbuf.Push(readPair{M: PurgeEvent{ID: id, Messages: len(list)}, ID: id})
+	}
+}
+
+// PurgeContact removes the message history, the index entries, the cached
+// profile, the settings, the delivery statistics, the reachability, the
+// message counter and the sent messages of the given contact. The IDs of
+// the received messages are forgotten for all the nodes, since they are
+// kept in a filter which cannot forget those of a single node.
+func (c *Client) PurgeContact(id utils.NodeID) {
+	list := c.History.Remove(id)
+	c.unindex(list)
+	c.Roster.Remove(id)
+	c.profiles.forget(id)
+	c.delivery.forget(id)
+	c.reach.forget(id)
+	c.counters.forget(id)
+	c.sent.forget(id)
+	c.seen.reset()
+	c.mbuf.Push(readPair{M: PurgeEvent{ID: id, Messages: len(list), Contact: true}, ID: id})
+}
+
+func (c *Client) unindex(list []HistoryEntry) {
+	for _, e := range list {
+		if !e.Message.Ephemeral {
+			c.Index.Remove(e.docID())
+		}
+	}
+}
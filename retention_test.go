@@ -0,0 +1,68 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/search"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRetention(t *testing.T) {
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	c := &Client{Index: search.NewMemoryIndex(nil), mbuf: newMessageBuffer(8)}
+
+	old := NewPlainChatMessage("old")
+	old.Time = time.Now().Add(-time.Hour * 48)
+	for _, m := range []ChatMessage{old, NewPlainChatMessage("first"), NewPlainChatMessage("second")} {
+		c.archive(id, newHistoryEntry(id, m))
+	}
+
+	c.SetRetention(RetentionPolicy{MaxAge: time.Hour * 24})
+	if l := c.History.List(id); len(l) != 2 {
+		t.Errorf("history has %d entries; expects %d", len(l), 2)
+	}
+	m, _, _ := c.Read()
+	if e, ok := m.(PurgeEvent); !ok || e.Messages != 1 {
+		t.Errorf("Read() returns %v; expects PurgeEvent", m)
+	}
+	docs, _ := c.Search(search.Query{Text: "old"})
+	if len(docs) != 0 {
+		t.Errorf("purged message remains in the index")
+	}
+
+	c.SetRetention(RetentionPolicy{MaxMessages: 1})
+	if l := c.History.List(id); len(l) != 1 || l[0].Message.Text() != "second" {
+		t.Errorf("history should keep the latest message: %v", l)
+	}
+	c.Read()
+
+	c.Roster.Set(id, UserProfile{Nickname: "purged"})
+	c.profiles.resolve(id, UserProfile{Nickname: "purged"}, time.Now())
+	c.delivery.sent([]byte{1}, id, [20]byte{1}, time.Now())
+	c.delivery.acked([]byte{1}, time.Now())
+	c.delivery.sent([]byte{2}, id, [20]byte{2}, time.Now())
+	c.reach.heard(id, time.Now())
+	c.counters.next(id)
+	c.sent.add([]byte{2}, id, time.Now())
+	c.seen.add(id, []byte{3})
+	c.PurgeContact(id)
+	if len(c.History.List(id)) != 0 || len(c.Roster.List()) != 0 {
+		t.Errorf("PurgeContact() should remove history and profile")
+	}
+	if len(c.profiles.fetched) != 0 || len(c.delivery.samples) != 0 || len(c.delivery.pending) != 0 ||
+		len(c.reach.M) != 0 || len(c.counters.M) != 0 || len(c.sent.M) != 0 {
+		t.Errorf("PurgeContact() should remove the state kept for the contact")
+	}
+	if !c.seen.add(id, []byte{3}) {
+		t.Errorf("PurgeContact() should forget the messages received from the contact")
+	}
+	m, _, _ = c.Read()
+	if e, ok := m.(PurgeEvent); !ok || !e.Contact || !e.ID.Match(id) {
+		t.Errorf("Read() returns %v; expects PurgeEvent", m)
+	}
+	docs, _ = c.Search(search.Query{Contact: &id})
+	if len(docs) != 0 {
+		t.Errorf("index has %d documents of purged contact", len(docs))
+	}
+}
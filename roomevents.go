@@ -0,0 +1,271 @@
+package murcott
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Types of room events.
+const (
+	RoomJoin        = "join"
+	RoomLeave       = "leave"
+	RoomKick        = "kick"
+	RoomTopic       = "topic"
+	RoomKeyRotation = "key-rotation"
+)
+
+// RoomEvent is an administrative event of a room. It is recorded in the
+// history of the room as a system message, so that the state of the room
+// can be audited. Joins and leaves are signed by the member, and kicks,
+// topic changes and key rotations by the admin key of the room, which is
+// the key from which the room ID was generated until it is rotated.
+type RoomEvent struct {
+	Room utils.NodeID `msgpack:"room"`
+	Type string       `msgpack:"type"`
+
+	// Member is the joining, leaving or kicked member.
+	Member utils.NodeID `msgpack:"member"`
+
+	// Topic is the new topic of a topic change.
+	Topic string `msgpack:"topic"`
+
+	// NewKey is the new admin key of a key rotation.
+	NewKey utils.PublicKey `msgpack:"newkey"`
+
+	Time time.Time       `msgpack:"time"`
+	Key  utils.PublicKey `msgpack:"key"`
+	Sign utils.Signature `msgpack:"sign"`
+}
+
+func (e *RoomEvent) serialize() []byte {
+	var newkey []byte
+	if !e.NewKey.IsZero() {
+		d := e.NewKey.Digest()
+		newkey = d[:]
+	}
+	data, _ := msgpack.Marshal([]interface{}{
+		e.Room.Bytes(),
+		e.Type,
+		e.Member.Bytes(),
+		e.Topic,
+		newkey,
+		e.Time.UnixNano(),
+	})
+	return data
+}
+
+func (e *RoomEvent) sign(key *utils.PrivateKey) error {
+	e.Key = key.PublicKey
+	sign := key.Sign(e.serialize())
+	if sign == nil {
+		return errors.New("cannot sign room event")
+	}
+	e.Sign = *sign
+	return nil
+}
+
+// Verify checks that the event is signed by the member for a join or
+// a leave, and by the given admin key of the room otherwise.
+func (e *RoomEvent) Verify(admin utils.PublicKeyDigest) error {
+	switch e.Type {
+	case RoomJoin, RoomLeave:
+		if e.Member.Digest.Cmp(e.Key.Digest()) != 0 {
+			return errors.New("room event signed by wrong key")
+		}
+	case RoomKick, RoomTopic, RoomKeyRotation:
+		if admin.Cmp(e.Key.Digest()) != 0 {
+			return errors.New("room event signed by wrong key")
+		}
+	default:
+		return errors.New("unknown room event type")
+	}
+	if !e.Key.Verify(e.serialize(), &e.Sign) {
+		return errors.New("invalid room event signature")
+	}
+	return nil
+}
+
+// roomKeyChain holds the signed key rotations of a room, from the first
+// one signed by the key from which the room ID was generated, and the time
+// of the last event accepted from each signer.
+type roomKeyChain struct {
+	Rotations []RoomEvent      `msgpack:"rotations"`
+	Last      map[string]int64 `msgpack:"last"`
+}
+
+func (k *roomKeyChain) admin(room utils.NodeID) utils.PublicKeyDigest {
+	admin := room.Digest
+	for _, e := range k.Rotations {
+		admin = e.NewKey.Digest()
+	}
+	return admin
+}
+
+// roomKeys holds the key chains of the rooms. They are kept apart from
+// the history, which is pruned, and are carried in the room metadata for
+// the members who join after a rotation.
+type roomKeys struct {
+	m     map[utils.NodeID]*roomKeyChain
+	mutex sync.Mutex
+}
+
+func (r *roomKeys) chain(room utils.NodeID) *roomKeyChain {
+	if r.m == nil {
+		r.m = make(map[utils.NodeID]*roomKeyChain)
+	}
+	k, ok := r.m[room]
+	if !ok {
+		k = &roomKeyChain{Last: make(map[string]int64)}
+		r.m[room] = k
+	}
+	return k
+}
+
+// admin returns the digest of the current admin key of the room.
+func (r *roomKeys) admin(room utils.NodeID) utils.PublicKeyDigest {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.chain(room).admin(room)
+}
+
+// rotations returns the key rotations of the room.
+func (r *roomKeys) rotations(room utils.NodeID) []RoomEvent {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return append([]RoomEvent(nil), r.chain(room).Rotations...)
+}
+
+// accept verifies the event against the admin key of the room, rejects
+// it if it is not newer than the last event accepted from its signer, and
+// applies it if it is a key rotation. The admin events of successive keys
+// share their signer, so that an old event of a rotated-out key cannot be
+// replayed either.
+func (r *roomKeys) accept(e RoomEvent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	k := r.chain(e.Room)
+	err := e.Verify(k.admin(e.Room))
+	if err != nil {
+		return err
+	}
+	signer := e.Room.String()
+	if e.Type == RoomJoin || e.Type == RoomLeave {
+		signer = e.Member.String()
+	}
+	t := e.Time.UnixNano()
+	if t <= k.Last[signer] {
+		return errors.New("room event older than the last accepted one")
+	}
+	k.Last[signer] = t
+	if e.Type == RoomKeyRotation {
+		k.Rotations = append(k.Rotations, e)
+	}
+	return nil
+}
+
+// extend replaces the key chain of the room with a longer chain, such as
+// one carried in the room metadata, if each rotation of it is signed by
+// the admin key set by the previous one.
+func (r *roomKeys) extend(room utils.NodeID, rotations []RoomEvent) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	k := r.chain(room)
+	if len(rotations) <= len(k.Rotations) {
+		return nil
+	}
+	admin := room.Digest
+	var last int64
+	for _, e := range rotations {
+		if !e.Room.Match(room) || e.Type != RoomKeyRotation {
+			return errors.New("invalid room key chain")
+		}
+		if e.Time.UnixNano() <= last {
+			return errors.New("room key chain out of order")
+		}
+		err := e.Verify(admin)
+		if err != nil {
+			return err
+		}
+		admin = e.NewKey.Digest()
+		last = e.Time.UnixNano()
+	}
+	k.Rotations = append([]RoomEvent(nil), rotations...)
+	if k.Last[room.String()] < last {
+		k.Last[room.String()] = last
+	}
+	return nil
+}
+
+// roomAdmin returns the digest of the admin key of the room, which is
+// changed by the key rotations of its key chain.
+func (c *Client) roomAdmin(room utils.NodeID) utils.PublicKeyDigest {
+	return c.roomKeys.admin(room)
+}
+
+// KickMember kicks a member out of the room. The key must be
+// the admin key of the room.
+func (c *Client) KickMember(key *utils.PrivateKey, room, member utils.NodeID) error {
+	return c.postRoomEvent(key, RoomEvent{Room: room, Type: RoomKick, Member: member})
+}
+
+// SetRoomTopic changes the topic of the room. The key must be
+// the admin key of the room.
+func (c *Client) SetRoomTopic(key *utils.PrivateKey, room utils.NodeID, topic string) error {
+	return c.postRoomEvent(key, RoomEvent{Room: room, Type: RoomTopic, Topic: topic})
+}
+
+// RotateRoomKey replaces the admin key of the room with newKey. The key
+// must be the current admin key of the room.
+func (c *Client) RotateRoomKey(key *utils.PrivateKey, room utils.NodeID, newKey utils.PublicKey) error {
+	return c.postRoomEvent(key, RoomEvent{Room: room, Type: RoomKeyRotation, NewKey: newKey})
+}
+
+// postRoomEvent signs the event, sends it to the room and records it.
+func (c *Client) postRoomEvent(key *utils.PrivateKey, e RoomEvent) error {
+	e.Time = time.Now()
+	err := e.sign(key)
+	if err != nil {
+		return err
+	}
+	err = c.roomKeys.accept(e)
+	if err != nil {
+		return err
+	}
+	t := protocol.Envelope{Type: protocol.MsgRoomEvent, ID: c.id.String(), Content: e}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	c.recordRoomEvent(c.id, e)
+	return c.sendMessage(e.Room, data)
+}
+
+// receiveRoomEvent records a verified event of the room
+// from which it is received. Replayed events are rejected.
+func (c *Client) receiveRoomEvent(src, room utils.NodeID, e RoomEvent) {
+	if !e.Room.Match(room) {
+		return
+	}
+	err := c.roomKeys.accept(e)
+	if err != nil {
+		c.Logger.Warning("Rejected room event from %s: %v", src.String(), err)
+		return
+	}
+	c.recordRoomEvent(src, e)
+	c.mbuf.Push(readPair{M: e, ID: src})
+	if e.Type == RoomKick {
+		c.router.Admit(room, e.Member, AdmitReject)
+		if e.Member.Match(c.id) {
+			c.router.Leave(room)
+		}
+	}
+}
+
+func (c *Client) recordRoomEvent(src utils.NodeID, e RoomEvent) {
+	c.archive(e.Room, HistoryEntry{Src: src, Message: ChatMessage{Time: e.Time}, Event: &e})
+}
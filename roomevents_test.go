@@ -0,0 +1,145 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRoomEventVerify(t *testing.T) {
+	roomKey := utils.GeneratePrivateKey()
+	room := utils.NewNodeID(utils.GroupNamespace, roomKey.Digest())
+	memberKey := utils.GeneratePrivateKey()
+	member := utils.NewNodeID(utils.GlobalNamespace, memberKey.Digest())
+
+	join := RoomEvent{Room: room, Type: RoomJoin, Member: member, Time: time.Now()}
+	join.sign(memberKey)
+	if err := join.Verify(room.Digest); err != nil {
+		t.Errorf("Verify() returns %v for a join signed by the member", err)
+	}
+	forged := join
+	forged.sign(utils.GeneratePrivateKey())
+	if err := forged.Verify(room.Digest); err == nil {
+		t.Errorf("Verify() accepts a join signed by another key")
+	}
+
+	kick := RoomEvent{Room: room, Type: RoomKick, Member: member, Time: time.Now()}
+	kick.sign(memberKey)
+	if err := kick.Verify(room.Digest); err == nil {
+		t.Errorf("Verify() accepts a kick signed by a member")
+	}
+	kick.sign(roomKey)
+	if err := kick.Verify(room.Digest); err != nil {
+		t.Errorf("Verify() returns %v for a kick signed by the room key", err)
+	}
+	kick.Member = utils.NewRandomNodeID(utils.GlobalNamespace)
+	if err := kick.Verify(room.Digest); err == nil {
+		t.Errorf("Verify() accepts a tampered kick")
+	}
+}
+
+func TestRoomAdminRotation(t *testing.T) {
+	roomKey := utils.GeneratePrivateKey()
+	room := utils.NewNodeID(utils.GroupNamespace, roomKey.Digest())
+	newKey := utils.GeneratePrivateKey()
+
+	var c Client
+	if c.roomAdmin(room).Cmp(room.Digest) != 0 {
+		t.Errorf("roomAdmin() should be the room key before a rotation")
+	}
+	rotation := RoomEvent{Room: room, Type: RoomKeyRotation, NewKey: newKey.PublicKey, Time: time.Now()}
+	rotation.sign(roomKey)
+	if err := c.roomKeys.accept(rotation); err != nil {
+		t.Fatalf("accept() returns %v for a rotation signed by the room key", err)
+	}
+	c.recordRoomEvent(room, rotation)
+	if c.roomAdmin(room).Cmp(newKey.Digest()) != 0 {
+		t.Errorf("roomAdmin() should be the rotated key")
+	}
+
+	topic := RoomEvent{Room: room, Type: RoomTopic, Topic: "news", Time: time.Now()}
+	topic.sign(roomKey)
+	if err := topic.Verify(c.roomAdmin(room)); err == nil {
+		t.Errorf("Verify() accepts an event signed by the rotated-out key")
+	}
+	topic.sign(newKey)
+	if err := topic.Verify(c.roomAdmin(room)); err != nil {
+		t.Errorf("Verify() returns %v for an event signed by the new key", err)
+	}
+
+	l := c.History.List(room)
+	if len(l) != 1 || l[0].Event == nil || l[0].Event.Type != RoomKeyRotation {
+		t.Errorf("recordRoomEvent() should add a system message to the history")
+	}
+}
+
+func TestRoomKeyChain(t *testing.T) {
+	roomKey := utils.GeneratePrivateKey()
+	room := utils.NewNodeID(utils.GroupNamespace, roomKey.Digest())
+	newKey := utils.GeneratePrivateKey()
+	now := time.Now()
+
+	var keys roomKeys
+	topic := RoomEvent{Room: room, Type: RoomTopic, Topic: "news", Time: now}
+	topic.sign(roomKey)
+	if err := keys.accept(topic); err != nil {
+		t.Fatalf("accept() returns %v", err)
+	}
+	if err := keys.accept(topic); err == nil {
+		t.Errorf("accept() accepts a replayed event")
+	}
+	rotation := RoomEvent{Room: room, Type: RoomKeyRotation, NewKey: newKey.PublicKey, Time: now.Add(time.Second)}
+	rotation.sign(roomKey)
+	if err := keys.accept(rotation); err != nil {
+		t.Fatalf("accept() returns %v for a rotation", err)
+	}
+	old := RoomEvent{Room: room, Type: RoomTopic, Topic: "old", Time: now.Add(-time.Second)}
+	old.sign(newKey)
+	if err := keys.accept(old); err == nil {
+		t.Errorf("accept() accepts an event older than the last accepted one")
+	}
+	latest := RoomEvent{Room: room, Type: RoomTopic, Topic: "latest", Time: now.Add(2 * time.Second)}
+	latest.sign(newKey)
+	if err := keys.accept(latest); err != nil {
+		t.Errorf("accept() returns %v for an event signed by the new key", err)
+	}
+
+	// A member who joins after the rotation learns the admin
+	// key from the chain carried in the room metadata.
+	var late roomKeys
+	if err := late.extend(room, keys.rotations(room)); err != nil {
+		t.Fatalf("extend() returns %v", err)
+	}
+	if late.admin(room).Cmp(newKey.Digest()) != 0 {
+		t.Errorf("extend() does not apply the key chain")
+	}
+	forged := rotation
+	forged.sign(utils.GeneratePrivateKey())
+	var other roomKeys
+	if err := other.extend(room, []RoomEvent{forged}); err == nil {
+		t.Errorf("extend() accepts a rotation signed by another key")
+	}
+
+	s := storage.NewMemoryStorage()
+	err := s.Update(func(tx storage.Tx) error {
+		return keys.save(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored roomKeys
+	err = s.View(func(tx storage.Tx) error {
+		return restored.restore(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.admin(room).Cmp(newKey.Digest()) != 0 {
+		t.Errorf("restored admin key differs from the rotated key")
+	}
+	if err := restored.accept(latest); err == nil {
+		t.Errorf("restored chain accepts a replayed event")
+	}
+}
@@ -0,0 +1,268 @@
+package murcott
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// RoomMetadata holds the name, the topic and the avatar of a room. It is
+// signed by the admin key of the room, or by one of its moderators, who
+// cannot change the moderators, as the list of the moderators is signed
+// by the admin key. The latest metadata is published in the DHT, sent to
+// the members and cached by them.
+type RoomMetadata struct {
+	Room  utils.NodeID `msgpack:"room"`
+	Name  string       `msgpack:"name"`
+	Topic string       `msgpack:"topic"`
+
+	// Avatar is a PNG image. See AvatarImage.
+	Avatar []byte `msgpack:"avatar"`
+
+	// Moderators are the members who can change the other fields.
+	Moderators []utils.NodeID `msgpack:"moderators"`
+
+	// ModeratorsKey is the admin key which signed the moderators with
+	// ModeratorsSign at ModeratorsTime, so that the metadata signed by a
+	// moderator can be verified without the previous metadata.
+	ModeratorsTime time.Time       `msgpack:"mtime"`
+	ModeratorsKey  utils.PublicKey `msgpack:"mkey"`
+	ModeratorsSign utils.Signature `msgpack:"msign"`
+
+	// Rotations is the key chain of the room, which lets the members who
+	// joined after a key rotation learn the admin key. Each rotation is
+	// signed by the previous admin key, so it is not covered by Sign.
+	Rotations []RoomEvent `msgpack:"rotations"`
+
+	Time time.Time       `msgpack:"time"`
+	Key  utils.PublicKey `msgpack:"key"`
+	Sign utils.Signature `msgpack:"sign"`
+}
+
+// RoomMetadataEvent is emitted when the metadata of a room changes.
+type RoomMetadataEvent struct {
+	Metadata RoomMetadata
+}
+
+// AvatarImage decodes the avatar of the room.
+func (m *RoomMetadata) AvatarImage() (image.Image, error) {
+	if len(m.Avatar) == 0 {
+		return nil, errors.New("no avatar")
+	}
+	return png.Decode(bytes.NewReader(m.Avatar))
+}
+
+func (m *RoomMetadata) serialize() []byte {
+	var moderators [][]byte
+	for _, id := range m.Moderators {
+		moderators = append(moderators, id.Bytes())
+	}
+	data, _ := msgpack.Marshal([]interface{}{
+		m.Room.Bytes(),
+		m.Name,
+		m.Topic,
+		m.Avatar,
+		moderators,
+		m.Time.UnixNano(),
+	})
+	return data
+}
+
+func (m *RoomMetadata) serializeModerators() []byte {
+	var moderators [][]byte
+	for _, id := range m.Moderators {
+		moderators = append(moderators, id.Bytes())
+	}
+	data, _ := msgpack.Marshal([]interface{}{
+		m.Room.Bytes(),
+		moderators,
+		m.ModeratorsTime.UnixNano(),
+	})
+	return data
+}
+
+// signModerators signs the moderators with the admin key of the room.
+func (m *RoomMetadata) signModerators(key *utils.PrivateKey) error {
+	m.ModeratorsTime = m.Time
+	m.ModeratorsKey = key.PublicKey
+	sign := key.Sign(m.serializeModerators())
+	if sign == nil {
+		return errors.New("cannot sign room moderators")
+	}
+	m.ModeratorsSign = *sign
+	return nil
+}
+
+func (m *RoomMetadata) sign(key *utils.PrivateKey) error {
+	m.Key = key.PublicKey
+	sign := key.Sign(m.serialize())
+	if sign == nil {
+		return errors.New("cannot sign room metadata")
+	}
+	m.Sign = *sign
+	return nil
+}
+
+// Verify checks that the metadata is signed by the given admin key of the
+// room, or by one of the moderators signed by it.
+func (m *RoomMetadata) Verify(admin utils.PublicKeyDigest) error {
+	digest := m.Key.Digest()
+	if admin.Cmp(digest) != 0 {
+		if !m.moderator(digest) {
+			return errors.New("room metadata signed by wrong key")
+		}
+		if admin.Cmp(m.ModeratorsKey.Digest()) != 0 ||
+			!m.ModeratorsKey.Verify(m.serializeModerators(), &m.ModeratorsSign) {
+			return errors.New("room moderators not signed by the admin key")
+		}
+	}
+	if !m.Key.Verify(m.serialize(), &m.Sign) {
+		return errors.New("invalid room metadata signature")
+	}
+	return nil
+}
+
+func (m *RoomMetadata) moderator(digest utils.PublicKeyDigest) bool {
+	for _, id := range m.Moderators {
+		if id.Digest.Cmp(digest) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func roomMetadataKey(id utils.NodeID) string {
+	return "roommeta:" + id.String()
+}
+
+// roomMetadataCache keeps the latest metadata of the rooms.
+type roomMetadataCache struct {
+	m     map[utils.NodeID]RoomMetadata
+	mutex sync.RWMutex
+}
+
+func (c *roomMetadataCache) get(room utils.NodeID) (RoomMetadata, bool) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	m, ok := c.m[room]
+	return m, ok
+}
+
+// update verifies the metadata and caches it if it is newer than the
+// cached one and not ahead of the clock by more than MaxClockSkew.
+// It reports whether the metadata has changed.
+func (c *roomMetadataCache) update(admin utils.PublicKeyDigest, m RoomMetadata) (bool, error) {
+	if m.Time.Sub(time.Now()) > router.MaxClockSkew {
+		return false, errors.New("room metadata from the future")
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	prev, ok := c.m[m.Room]
+	if ok && !prev.Time.Before(m.Time) {
+		return false, nil
+	}
+	err := m.Verify(admin)
+	if err != nil {
+		return false, err
+	}
+	if c.m == nil {
+		c.m = make(map[utils.NodeID]RoomMetadata)
+	}
+	c.m[m.Room] = m
+	return true, nil
+}
+
+// SetRoomMetadata signs the metadata of the room with the admin key of the
+// room or the key of a moderator, publishes it and sends it to the members.
+// The admin key also signs the moderators, which a moderator keeps from
+// the cached metadata.
+func (c *Client) SetRoomMetadata(key *utils.PrivateKey, m RoomMetadata) error {
+	m.Time = time.Now()
+	m.Rotations = c.roomKeys.rotations(m.Room)
+	if c.roomAdmin(m.Room).Cmp(key.Digest()) == 0 {
+		err := m.signModerators(key)
+		if err != nil {
+			return err
+		}
+	} else if prev, ok := c.roomMetadata.get(m.Room); ok {
+		m.ModeratorsTime = prev.ModeratorsTime
+		m.ModeratorsKey = prev.ModeratorsKey
+		m.ModeratorsSign = prev.ModeratorsSign
+	}
+	err := m.sign(key)
+	if err != nil {
+		return err
+	}
+	changed, err := c.roomMetadata.update(c.roomAdmin(m.Room), m)
+	if err != nil {
+		return err
+	}
+	if changed {
+		c.mbuf.Push(readPair{M: RoomMetadataEvent{Metadata: m}, ID: m.Room})
+	}
+
+	t := protocol.Envelope{Type: protocol.MsgRoomMetadata, ID: c.id.String(), Content: m}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return err
+	}
+	c.router.StoreValue(roomMetadataKey(m.Room), string(data))
+	return c.sendMessage(m.Room, data)
+}
+
+// RoomMetadata returns the metadata of the room. It is looked up
+// in the DHT if it is not cached.
+func (c *Client) RoomMetadata(room utils.NodeID) (RoomMetadata, error) {
+	if m, ok := c.roomMetadata.get(room); ok {
+		return m, nil
+	}
+	c.fetchRoomMetadata(room)
+	if m, ok := c.roomMetadata.get(room); ok {
+		return m, nil
+	}
+	return RoomMetadata{}, errors.New("room metadata not found")
+}
+
+// fetchRoomMetadata looks up the published metadata of the room.
+func (c *Client) fetchRoomMetadata(room utils.NodeID) {
+	str := c.router.LoadValue(roomMetadataKey(room))
+	if str == nil {
+		return
+	}
+	u := struct {
+		Content RoomMetadata `msgpack:"content"`
+	}{}
+	if msgpack.Unmarshal([]byte(*str), &u) != nil {
+		return
+	}
+	c.receiveRoomMetadata(room, u.Content)
+}
+
+// receiveRoomMetadata applies the key chain carried in the metadata of the
+// room, caches the metadata and emits an event if it has changed.
+func (c *Client) receiveRoomMetadata(room utils.NodeID, m RoomMetadata) {
+	if !m.Room.Match(room) {
+		return
+	}
+	err := c.roomKeys.extend(room, m.Rotations)
+	if err != nil {
+		c.Logger.Warning("Rejected room key chain of %s: %v", room.String(), err)
+		return
+	}
+	changed, err := c.roomMetadata.update(c.roomAdmin(room), m)
+	if err != nil {
+		c.Logger.Warning("Rejected room metadata of %s: %v", room.String(), err)
+		return
+	}
+	if changed {
+		c.mbuf.Push(readPair{M: RoomMetadataEvent{Metadata: m}, ID: room})
+	}
+}
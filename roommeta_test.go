@@ -0,0 +1,87 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRoomMetadataCache(t *testing.T) {
+	roomKey := utils.GeneratePrivateKey()
+	room := utils.NewNodeID(utils.GroupNamespace, roomKey.Digest())
+	modKey := utils.GeneratePrivateKey()
+	mod := utils.NewNodeID(utils.GlobalNamespace, modKey.Digest())
+	now := time.Now()
+
+	meta := func(name string, moderators []utils.NodeID, t time.Time, key *utils.PrivateKey) RoomMetadata {
+		m := RoomMetadata{Room: room, Name: name, Moderators: moderators, Time: t}
+		m.signModerators(roomKey)
+		m.sign(key)
+		return m
+	}
+
+	var c roomMetadataCache
+	if _, err := c.update(room.Digest, meta("first", nil, now, modKey)); err == nil {
+		t.Errorf("update() accepts metadata signed by a non-moderator")
+	}
+	if ok, err := c.update(room.Digest, meta("first", []utils.NodeID{mod}, now, roomKey)); !ok || err != nil {
+		t.Errorf("update() returns %v, %v for metadata signed by the admin key", ok, err)
+	}
+	if ok, _ := c.update(room.Digest, meta("stale", []utils.NodeID{mod}, now.Add(-time.Minute), roomKey)); ok {
+		t.Errorf("update() accepts older metadata")
+	}
+	if ok, err := c.update(room.Digest, meta("second", []utils.NodeID{mod}, now.Add(time.Minute), modKey)); !ok || err != nil {
+		t.Errorf("update() returns %v, %v for metadata signed by a moderator", ok, err)
+	}
+	changed := meta("third", []utils.NodeID{mod}, now.Add(2*time.Minute), modKey)
+	changed.Moderators = nil
+	changed.sign(modKey)
+	if _, err := c.update(room.Digest, changed); err == nil {
+		t.Errorf("update() accepts a moderator changing the moderators")
+	}
+	if m, _ := c.get(room); m.Name != "second" {
+		t.Errorf("get() returns %q; expects second", m.Name)
+	}
+
+	tampered := meta("fourth", []utils.NodeID{mod}, now.Add(3*time.Minute), roomKey)
+	tampered.Topic = "tampered"
+	if _, err := c.update(room.Digest, tampered); err == nil {
+		t.Errorf("update() accepts tampered metadata")
+	}
+	if _, err := c.update(room.Digest, meta("future", []utils.NodeID{mod}, now.Add(time.Hour), roomKey)); err == nil {
+		t.Errorf("update() accepts metadata ahead of the clock")
+	}
+
+	// The metadata of a moderator is verified from the moderators
+	// signed by the admin key, without the cached metadata.
+	var fresh roomMetadataCache
+	if ok, err := fresh.update(room.Digest, meta("moderated", []utils.NodeID{mod}, now, modKey)); !ok || err != nil {
+		t.Errorf("update() returns %v, %v for a moderator without cached metadata", ok, err)
+	}
+	selfMade := RoomMetadata{Room: room, Name: "self", Moderators: []utils.NodeID{mod}, Time: now.Add(time.Minute)}
+	selfMade.signModerators(modKey)
+	selfMade.sign(modKey)
+	if _, err := fresh.update(room.Digest, selfMade); err == nil {
+		t.Errorf("update() accepts moderators signed by a moderator")
+	}
+
+	s := storage.NewMemoryStorage()
+	err := s.Update(func(tx storage.Tx) error {
+		return c.save(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var restored roomMetadataCache
+	err = s.View(func(tx storage.Tx) error {
+		return restored.restore(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := restored.get(room); m.Name != "second" {
+		t.Errorf("restored metadata %q; expects second", m.Name)
+	}
+}
@@ -0,0 +1,211 @@
+package murcott
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/search"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Join policies of a room.
+const (
+	JoinOpen    = "open"
+	JoinRequest = "request"
+	JoinInvite  = "invite"
+)
+
+const roomDirectoryKey = "rooms:"
+
+// Reasons of moderation events.
+const (
+	ModerationFlood = "flood"
+)
+
+// ModerationEvent is emitted when messages of a sender in a room are dropped.
+type ModerationEvent struct {
+	Room   utils.NodeID
+	Sender utils.NodeID
+	Reason string
+}
+
+// RoomDescriptor describes a room in the public room directory.
+// It is signed with the private key from which the room ID was generated.
+type RoomDescriptor struct {
+	ID      utils.NodeID    `msgpack:"id"`
+	Name    string          `msgpack:"name"`
+	Topic   string          `msgpack:"topic"`
+	Members int             `msgpack:"members"`
+	Policy  string          `msgpack:"policy"`
+	Time    time.Time       `msgpack:"time"`
+	Key     utils.PublicKey `msgpack:"key"`
+	Sign    utils.Signature `msgpack:"sign"`
+}
+
+func (d *RoomDescriptor) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		d.ID.Bytes(),
+		d.Name,
+		d.Topic,
+		d.Members,
+		d.Policy,
+		d.Time.UnixNano(),
+	})
+	return data
+}
+
+func (d *RoomDescriptor) sign(key *utils.PrivateKey) error {
+	d.Key = key.PublicKey
+	sign := key.Sign(d.serialize())
+	if sign == nil {
+		return errors.New("cannot sign room descriptor")
+	}
+	d.Sign = *sign
+	return nil
+}
+
+// Verify checks that the descriptor is signed by the owner of the room.
+func (d *RoomDescriptor) Verify() error {
+	if d.ID.Digest.Cmp(d.Key.Digest()) != 0 {
+		return errors.New("room descriptor signed by wrong key")
+	}
+	if !d.Key.Verify(d.serialize(), &d.Sign) {
+		return errors.New("invalid room descriptor signature")
+	}
+	return nil
+}
+
+func roomKey(id utils.NodeID) string {
+	return "room:" + id.String()
+}
+
+func roomTerms(d RoomDescriptor) []string {
+	return search.DefaultTokenizer.Tokenize(d.Name + " " + d.Topic)
+}
+
+// PublishRoom signs the descriptor with the room key and publishes it
+// in the room directory. The room ID is generated from the key,
+// and the member count is estimated from the joined group if it is zero.
+func (c *Client) PublishRoom(key *utils.PrivateKey, d RoomDescriptor) error {
+	d.ID = utils.NewNodeID(utils.GroupNamespace, key.Digest())
+	if d.Policy == "" {
+		d.Policy = JoinOpen
+	}
+	if d.Members == 0 {
+		d.Members = c.router.MemberCount(d.ID)
+	}
+	d.Time = time.Now()
+	err := d.sign(key)
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	c.router.StoreValue(roomKey(d.ID), string(data))
+	id := []string{d.ID.String()}
+	c.router.StoreSet(roomDirectoryKey, id)
+	for _, t := range roomTerms(d) {
+		c.router.StoreSet(roomDirectoryKey+t, id)
+	}
+	return nil
+}
+
+// LookupRoom returns the published descriptor of the given room.
+func (c *Client) LookupRoom(id utils.NodeID) (RoomDescriptor, error) {
+	var d RoomDescriptor
+	str := c.router.LoadValue(roomKey(id))
+	if str == nil {
+		return d, errors.New("room not found")
+	}
+	err := msgpack.Unmarshal([]byte(*str), &d)
+	if err != nil {
+		return d, err
+	}
+	if !d.ID.Match(id) {
+		return d, errors.New("room descriptor for another room")
+	}
+	err = d.Verify()
+	if err != nil {
+		return d, err
+	}
+	return d, c.router.CheckTimestamp(id, d.Time)
+}
+
+// SearchRooms returns the published rooms whose name or topic contains
+// all terms of the query, ordered by the member count.
+// An empty query lists the recently published rooms.
+func (c *Client) SearchRooms(query string) ([]RoomDescriptor, error) {
+	terms := search.DefaultTokenizer.Tokenize(query)
+	var ids []string
+	if len(terms) == 0 {
+		ids = c.router.LoadSet(roomDirectoryKey)
+	} else {
+		ids = c.router.LoadSet(roomDirectoryKey + terms[0])
+	}
+
+	var rooms []RoomDescriptor
+	for _, s := range ids {
+		id, err := utils.NewNodeIDFromString(s)
+		if err != nil {
+			continue
+		}
+		d, err := c.LookupRoom(id)
+		if err != nil {
+			continue
+		}
+		if matchTerms(roomTerms(d), terms) {
+			rooms = append(rooms, d)
+		}
+	}
+	sort.Stable(byMembers(rooms))
+	return rooms, nil
+}
+
+// Admission decisions for the nodes which participate in a room without
+// being known members. See SetAdmissionHandler.
+const (
+	AdmitAccept    = router.AdmitAccept
+	AdmitReject    = router.AdmitReject
+	AdmitChallenge = router.AdmitChallenge
+)
+
+// SetAdmissionHandler sets a function which decides whether a node which
+// is not a known member may send or forward messages in a joined room.
+// Invite-only rooms can return AdmitChallenge, check an invitation of
+// the node, and then call Admit. The function must not block.
+func (c *Client) SetAdmissionHandler(h func(room, node utils.NodeID) int) {
+	c.router.SetAdmissionHandler(h)
+}
+
+// Admit sets the admission decision for a node of a room.
+func (c *Client) Admit(room, node utils.NodeID, decision int) {
+	c.router.Admit(room, node, decision)
+}
+
+func matchTerms(terms, query []string) bool {
+	for _, q := range query {
+		found := false
+		for _, t := range terms {
+			if t == q {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type byMembers []RoomDescriptor
+
+func (s byMembers) Len() int           { return len(s) }
+func (s byMembers) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byMembers) Less(i, j int) bool { return s[i].Members > s[j].Members }
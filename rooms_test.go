@@ -0,0 +1,49 @@
+package murcott
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestRoomDescriptor(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	d := RoomDescriptor{
+		ID:     utils.NewNodeID(utils.GroupNamespace, key.Digest()),
+		Name:   "Go Programming",
+		Topic:  "gophers",
+		Policy: JoinOpen,
+	}
+	err := d.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := msgpack.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r RoomDescriptor
+	err = msgpack.Unmarshal(data, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Verify() returns %v", err)
+	}
+	if !matchTerms(roomTerms(r), []string{"go", "gophers"}) {
+		t.Errorf("room should match its name and topic")
+	}
+
+	r.Topic = "spam"
+	if r.Verify() == nil {
+		t.Errorf("Verify() should reject a modified descriptor")
+	}
+
+	other := d
+	other.sign(utils.GeneratePrivateKey())
+	if other.Verify() == nil {
+		t.Errorf("Verify() should reject a descriptor signed by another key")
+	}
+}
@@ -1,24 +1,162 @@
 package murcott
 
 import (
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/h2so5/murcott/utils"
 )
 
 // Roster represents a contact list.
 type Roster struct {
-	M     map[utils.NodeID]UserProfile
-	mutex sync.RWMutex
+	M        map[utils.NodeID]UserProfile
+	Settings map[utils.NodeID]ContactSettings
+
+	// Secrets holds the secrets of the relationships
+	// with the authorized contacts.
+	Secrets map[utils.NodeID][]byte
+
+	// Approved holds the contacts which the user has added, paired
+	// with or authorized, which may share the secret of a relationship.
+	Approved map[utils.NodeID]bool
+
+	// Tags holds the user-defined groups of the contacts,
+	// and Favorites the contacts marked as favorites.
+	Tags      map[utils.NodeID][]string
+	Favorites map[utils.NodeID]bool
+
+	// Aliases holds the local names given to the contacts, which are
+	// preferred to their self-published nicknames.
+	Aliases map[utils.NodeID]string
+
+	mutex         sync.RWMutex
+	handler       func(utils.NodeID, ContactSettings)
+	tagHandler    func(utils.NodeID, []string, bool)
+	aliasHandler  func(utils.NodeID, string)
+	changeHandler func([]RosterChange)
+}
+
+// ContactSettings represents local conversation settings for a contact.
+// The messages of a muted contact are not emitted, Notification is set on
+// the received messages and Ephemeral on the sent ones, and the sessions
+// to the contact are dialed over the Transport scheme first.
+type ContactSettings struct {
+	Muted        bool          `msgpack:"muted"`
+	Notification string        `msgpack:"notification"`
+	Ephemeral    time.Duration `msgpack:"ephemeral"`
+	Transport    string        `msgpack:"transport"`
+}
+
+// ContactSettingsEvent is emitted when the settings for a contact are changed.
+type ContactSettingsEvent struct {
+	ID       utils.NodeID
+	Settings ContactSettings
+}
+
+// ContactTagsEvent is emitted when the tags of a contact are changed
+// or it is added to or removed from the favorites.
+type ContactTagsEvent struct {
+	ID       utils.NodeID
+	Tags     []string
+	Favorite bool
+}
+
+// ContactAliasEvent is emitted when the local alias of a contact is changed.
+// Name is the alias, or the nickname of the contact if the alias is removed.
+type ContactAliasEvent struct {
+	ID    utils.NodeID
+	Alias string
+	Name  string
+}
+
+// RosterEntry is the state of a contact in the roster. Present is false
+// if the contact is not in the roster.
+type RosterEntry struct {
+	Present  bool
+	Profile  UserProfile
+	Settings ContactSettings
+	Alias    string
+	Tags     []string
+	Favorite bool
+}
+
+// RosterChange describes a change of a contact in the roster
+// by its entry before and after the change.
+type RosterChange struct {
+	ID  utils.NodeID
+	Old RosterEntry
+	New RosterEntry
+}
+
+// RosterChangeEvent is emitted when contacts are added to the roster,
+// removed or modified. The changes of a batch are emitted in one event.
+type RosterChangeEvent struct {
+	Changes []RosterChange
+}
+
+// Orders of a contact list.
+const (
+	// OrderName sorts the contacts by name.
+	OrderName = iota
+
+	// OrderPresence lists the online contacts first, each part by name.
+	OrderPresence
+
+	// OrderActivity lists the contacts with the most recent messages first.
+	OrderActivity
+)
+
+// Contact is an entry of a contact list.
+// Name is the local alias of the contact if any, or its nickname.
+type Contact struct {
+	ID           utils.NodeID
+	Name         string
+	Profile      UserProfile
+	Tags         []string
+	Favorite     bool
+	Online       bool
+	LastActivity time.Time
+}
+
+// ContactFilter selects the entries of a contact list.
+// The zero value selects all contacts.
+type ContactFilter struct {
+	Tag      string
+	Favorite bool
+	Online   bool
+}
+
+func (f ContactFilter) match(c Contact) bool {
+	if f.Favorite && !c.Favorite {
+		return false
+	}
+	if f.Online && !c.Online {
+		return false
+	}
+	if f.Tag == "" {
+		return true
+	}
+	for _, t := range c.Tags {
+		if t == f.Tag {
+			return true
+		}
+	}
+	return false
 }
 
 func (r *Roster) Set(id utils.NodeID, prof UserProfile) {
 	r.mutex.Lock()
-	defer r.mutex.Unlock()
+	old := r.entry(id)
 	if r.M == nil {
 		r.M = make(map[utils.NodeID]UserProfile)
 	}
 	r.M[id] = prof
+	changes := r.changed(id, old)
+	r.mutex.Unlock()
+	r.emit(changes)
 }
 
 func (r *Roster) Get(id utils.NodeID) UserProfile {
@@ -27,10 +165,563 @@ func (r *Roster) Get(id utils.NodeID) UserProfile {
 	return r.M[id]
 }
 
+func (r *Roster) profile(id utils.NodeID) (UserProfile, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	p, ok := r.M[id]
+	return p, ok
+}
+
+// SetSettings stores the conversation settings for the given contact.
+func (r *Roster) SetSettings(id utils.NodeID, s ContactSettings) {
+	r.mutex.Lock()
+	old := r.entry(id)
+	if r.Settings == nil {
+		r.Settings = make(map[utils.NodeID]ContactSettings)
+	}
+	r.Settings[id] = s
+	h := r.handler
+	changes := r.changed(id, old)
+	r.mutex.Unlock()
+	if h != nil {
+		h(id, s)
+	}
+	r.emit(changes)
+}
+
+// GetSettings returns the conversation settings for the given contact.
+func (r *Roster) GetSettings(id utils.NodeID) ContactSettings {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.Settings[id]
+}
+
+// Remove deletes the profile and the settings of the given contact.
+func (r *Roster) Remove(id utils.NodeID) {
+	r.mutex.Lock()
+	old := r.entry(id)
+	r.setEntry(id, RosterEntry{})
+	changes := r.changed(id, old)
+	r.mutex.Unlock()
+	r.emit(changes)
+}
+
+// List returns the IDs of the contacts.
 func (r *Roster) List() []utils.NodeID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
 	var l []utils.NodeID
 	for n, _ := range r.M {
 		l = append(l, n)
 	}
 	return l
 }
+
+// SetAlias sets the local alias of the contact.
+// An empty alias removes it.
+func (r *Roster) SetAlias(id utils.NodeID, alias string) {
+	r.mutex.Lock()
+	if r.Aliases[id] == alias {
+		r.mutex.Unlock()
+		return
+	}
+	old := r.entry(id)
+	if alias == "" {
+		delete(r.Aliases, id)
+	} else {
+		if r.Aliases == nil {
+			r.Aliases = make(map[utils.NodeID]string)
+		}
+		r.Aliases[id] = alias
+	}
+	h := r.aliasHandler
+	changes := r.changed(id, old)
+	r.mutex.Unlock()
+	if h != nil {
+		h(id, alias)
+	}
+	r.emit(changes)
+}
+
+// Alias returns the local alias of the contact.
+func (r *Roster) Alias(id utils.NodeID) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.Aliases[id]
+}
+
+// Name returns the local alias of the contact if any, or its nickname.
+func (r *Roster) Name(id utils.NodeID) string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.name(id)
+}
+
+func (r *Roster) name(id utils.NodeID) string {
+	if a, ok := r.Aliases[id]; ok {
+		return a
+	}
+	return r.M[id].Nickname
+}
+
+// Find returns the contacts with the given name, ignoring case.
+// Aliases are preferred: nicknames are only matched if no alias matches.
+func (r *Roster) Find(name string) []utils.NodeID {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var aliased, nicknamed []utils.NodeID
+	for id, a := range r.Aliases {
+		if strings.EqualFold(a, name) {
+			aliased = append(aliased, id)
+		}
+	}
+	if len(aliased) > 0 {
+		return aliased
+	}
+	for id, p := range r.M {
+		if _, ok := r.Aliases[id]; !ok && strings.EqualFold(p.Nickname, name) {
+			nicknamed = append(nicknamed, id)
+		}
+	}
+	return nicknamed
+}
+
+// AddTag adds the contact to a user-defined group.
+func (r *Roster) AddTag(id utils.NodeID, tag string) {
+	r.mutex.Lock()
+	for _, t := range r.Tags[id] {
+		if t == tag {
+			r.mutex.Unlock()
+			return
+		}
+	}
+	old := r.entry(id)
+	if r.Tags == nil {
+		r.Tags = make(map[utils.NodeID][]string)
+	}
+	tags := append(append([]string(nil), r.Tags[id]...), tag)
+	sort.Strings(tags)
+	r.Tags[id] = tags
+	r.notifyTags(id, old)
+}
+
+// RemoveTag removes the contact from a user-defined group.
+func (r *Roster) RemoveTag(id utils.NodeID, tag string) {
+	r.mutex.Lock()
+	var tags []string
+	for _, t := range r.Tags[id] {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	if len(tags) == len(r.Tags[id]) {
+		r.mutex.Unlock()
+		return
+	}
+	old := r.entry(id)
+	if len(tags) == 0 {
+		delete(r.Tags, id)
+	} else {
+		r.Tags[id] = tags
+	}
+	r.notifyTags(id, old)
+}
+
+// GetTags returns the user-defined groups of the contact.
+func (r *Roster) GetTags(id utils.NodeID) []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return append([]string(nil), r.Tags[id]...)
+}
+
+// AllTags returns all user-defined groups in alphabetical order.
+func (r *Roster) AllTags() []string {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	m := make(map[string]bool)
+	for _, tags := range r.Tags {
+		for _, t := range tags {
+			m[t] = true
+		}
+	}
+	var l []string
+	for t := range m {
+		l = append(l, t)
+	}
+	sort.Strings(l)
+	return l
+}
+
+// SetFavorite adds the contact to the favorites or removes it.
+func (r *Roster) SetFavorite(id utils.NodeID, favorite bool) {
+	r.mutex.Lock()
+	if r.Favorites[id] == favorite {
+		r.mutex.Unlock()
+		return
+	}
+	old := r.entry(id)
+	if favorite {
+		if r.Favorites == nil {
+			r.Favorites = make(map[utils.NodeID]bool)
+		}
+		r.Favorites[id] = true
+	} else {
+		delete(r.Favorites, id)
+	}
+	r.notifyTags(id, old)
+}
+
+// IsFavorite reports whether the contact is one of the favorites.
+func (r *Roster) IsFavorite(id utils.NodeID) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.Favorites[id]
+}
+
+// notifyTags unlocks the roster and calls the tag handler
+// and the change handler.
+func (r *Roster) notifyTags(id utils.NodeID, old RosterEntry) {
+	tags := append([]string(nil), r.Tags[id]...)
+	favorite := r.Favorites[id]
+	h := r.tagHandler
+	changes := r.changed(id, old)
+	r.mutex.Unlock()
+	if h != nil {
+		h(id, tags, favorite)
+	}
+	r.emit(changes)
+}
+
+// entry returns the state of the contact. The roster must be locked.
+func (r *Roster) entry(id utils.NodeID) RosterEntry {
+	p, ok := r.M[id]
+	e := RosterEntry{
+		Present:  ok,
+		Profile:  p,
+		Settings: r.Settings[id],
+		Alias:    r.Aliases[id],
+		Favorite: r.Favorites[id],
+	}
+	if len(r.Tags[id]) > 0 {
+		e.Tags = append([]string(nil), r.Tags[id]...)
+	}
+	return e
+}
+
+// setEntry replaces the state of the contact. The secret of the contact
+// is kept unless it is removed. The roster must be locked.
+func (r *Roster) setEntry(id utils.NodeID, e RosterEntry) {
+	if !e.Present {
+		delete(r.M, id)
+		delete(r.Settings, id)
+		delete(r.Secrets, id)
+		delete(r.Tags, id)
+		delete(r.Favorites, id)
+		delete(r.Aliases, id)
+		delete(r.Approved, id)
+		return
+	}
+	if r.M == nil {
+		r.M = make(map[utils.NodeID]UserProfile)
+	}
+	r.M[id] = e.Profile
+	if e.Settings == (ContactSettings{}) {
+		delete(r.Settings, id)
+	} else {
+		if r.Settings == nil {
+			r.Settings = make(map[utils.NodeID]ContactSettings)
+		}
+		r.Settings[id] = e.Settings
+	}
+	if e.Alias == "" {
+		delete(r.Aliases, id)
+	} else {
+		if r.Aliases == nil {
+			r.Aliases = make(map[utils.NodeID]string)
+		}
+		r.Aliases[id] = e.Alias
+	}
+	if len(e.Tags) == 0 {
+		delete(r.Tags, id)
+	} else {
+		if r.Tags == nil {
+			r.Tags = make(map[utils.NodeID][]string)
+		}
+		tags := append([]string(nil), e.Tags...)
+		sort.Strings(tags)
+		r.Tags[id] = tags
+	}
+	if !e.Favorite {
+		delete(r.Favorites, id)
+	} else {
+		if r.Favorites == nil {
+			r.Favorites = make(map[utils.NodeID]bool)
+		}
+		r.Favorites[id] = true
+	}
+}
+
+// changed returns the change of the contact since old, if any.
+// The roster must be locked.
+func (r *Roster) changed(id utils.NodeID, old RosterEntry) []RosterChange {
+	e := r.entry(id)
+	if reflect.DeepEqual(old, e) {
+		return nil
+	}
+	return []RosterChange{{ID: id, Old: old, New: e}}
+}
+
+// emit calls the change handler. The roster must not be locked.
+func (r *Roster) emit(changes []RosterChange) {
+	if len(changes) == 0 {
+		return
+	}
+	r.mutex.RLock()
+	h := r.changeHandler
+	r.mutex.RUnlock()
+	if h != nil {
+		h(changes)
+	}
+}
+
+// contacts returns the contacts of the roster selected by the filter
+// in the given order. online and activity provide the presence
+// and the time of the last message of a contact.
+func (r *Roster) contacts(filter ContactFilter, order int,
+	online func(utils.NodeID) bool, activity func(utils.NodeID) time.Time) []Contact {
+	r.mutex.RLock()
+	var list []Contact
+	for id, prof := range r.M {
+		list = append(list, Contact{
+			ID:       id,
+			Name:     r.name(id),
+			Profile:  prof,
+			Tags:     append([]string(nil), r.Tags[id]...),
+			Favorite: r.Favorites[id],
+		})
+	}
+	r.mutex.RUnlock()
+
+	var selected []Contact
+	for _, c := range list {
+		c.Online = online(c.ID)
+		c.LastActivity = activity(c.ID)
+		if filter.match(c) {
+			selected = append(selected, c)
+		}
+	}
+	sort.Sort(byContactName(selected))
+	switch order {
+	case OrderPresence:
+		sort.Stable(byContactPresence(selected))
+	case OrderActivity:
+		sort.Stable(byContactActivity(selected))
+	}
+	return selected
+}
+
+type byContactName []Contact
+
+func (s byContactName) Len() int      { return len(s) }
+func (s byContactName) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byContactName) Less(i, j int) bool {
+	a, b := strings.ToLower(s[i].Name), strings.ToLower(s[j].Name)
+	if a != b {
+		return a < b
+	}
+	return s[i].ID.String() < s[j].ID.String()
+}
+
+type byContactPresence []Contact
+
+func (s byContactPresence) Len() int           { return len(s) }
+func (s byContactPresence) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContactPresence) Less(i, j int) bool { return s[i].Online && !s[j].Online }
+
+type byContactActivity []Contact
+
+func (s byContactActivity) Len() int           { return len(s) }
+func (s byContactActivity) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byContactActivity) Less(i, j int) bool { return s[i].LastActivity.After(s[j].LastActivity) }
+
+func (r *Roster) secret(id utils.NodeID) []byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.Secrets[id]
+}
+
+// approved reports whether the user has approved the contact, so that
+// it may share the secret of a relationship. Being in the roster is not
+// enough, as the profiles of other nodes may be added to it.
+func (r *Roster) approved(id utils.NodeID) bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.Approved[id]
+}
+
+// approve records that the user has approved the contact.
+func (r *Roster) approve(id utils.NodeID) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.Approved == nil {
+		r.Approved = make(map[utils.NodeID]bool)
+	}
+	r.Approved[id] = true
+}
+
+func (r *Roster) setSecret(id utils.NodeID, secret []byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.Secrets == nil {
+		r.Secrets = make(map[utils.NodeID][]byte)
+	}
+	r.Secrets[id] = secret
+}
+
+func (r *Roster) secrets() map[utils.NodeID][]byte {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	m := make(map[utils.NodeID][]byte)
+	for id, s := range r.Secrets {
+		m[id] = s
+	}
+	return m
+}
+
+func (r *Roster) setHandler(h func(utils.NodeID, ContactSettings)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.handler = h
+}
+
+func (r *Roster) setAliasHandler(h func(utils.NodeID, string)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.aliasHandler = h
+}
+
+func (r *Roster) setChangeHandler(h func([]RosterChange)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.changeHandler = h
+}
+
+func (r *Roster) setTagHandler(h func(utils.NodeID, []string, bool)) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.tagHandler = h
+}
+
+// merge adds the contacts and settings of s which are not in r yet.
+func (r *Roster) merge(s *Roster) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.M == nil {
+		r.M = make(map[utils.NodeID]UserProfile)
+	}
+	if r.Settings == nil {
+		r.Settings = make(map[utils.NodeID]ContactSettings)
+	}
+	if r.Secrets == nil {
+		r.Secrets = make(map[utils.NodeID][]byte)
+	}
+	if r.Tags == nil {
+		r.Tags = make(map[utils.NodeID][]string)
+	}
+	if r.Favorites == nil {
+		r.Favorites = make(map[utils.NodeID]bool)
+	}
+	if r.Aliases == nil {
+		r.Aliases = make(map[utils.NodeID]string)
+	}
+	for id, p := range s.M {
+		if _, ok := r.M[id]; !ok {
+			r.M[id] = p
+		}
+	}
+	for id, c := range s.Settings {
+		if _, ok := r.Settings[id]; !ok {
+			r.Settings[id] = c
+		}
+	}
+	for id, c := range s.Secrets {
+		if _, ok := r.Secrets[id]; !ok {
+			r.Secrets[id] = c
+		}
+	}
+	for id, t := range s.Tags {
+		if _, ok := r.Tags[id]; !ok {
+			r.Tags[id] = t
+		}
+	}
+	for id, f := range s.Favorites {
+		if _, ok := r.Favorites[id]; !ok {
+			r.Favorites[id] = f
+		}
+	}
+	for id, a := range s.Aliases {
+		if _, ok := r.Aliases[id]; !ok {
+			r.Aliases[id] = a
+		}
+	}
+	if r.Approved == nil {
+		r.Approved = make(map[utils.NodeID]bool)
+	}
+	for id := range s.Approved {
+		if _, ok := r.M[id]; ok {
+			r.Approved[id] = true
+		}
+	}
+}
+
+// snapshot returns a copy of the roster which can be encoded
+// while the roster is modified.
+func (r *Roster) snapshot() *Roster {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	s := &Roster{
+		M:         make(map[utils.NodeID]UserProfile),
+		Settings:  make(map[utils.NodeID]ContactSettings),
+		Secrets:   make(map[utils.NodeID][]byte),
+		Approved:  make(map[utils.NodeID]bool),
+		Tags:      make(map[utils.NodeID][]string),
+		Favorites: make(map[utils.NodeID]bool),
+		Aliases:   make(map[utils.NodeID]string),
+	}
+	for id, p := range r.M {
+		s.M[id] = p
+	}
+	for id, c := range r.Settings {
+		s.Settings[id] = c
+	}
+	for id, c := range r.Secrets {
+		s.Secrets[id] = append([]byte{}, c...)
+	}
+	for id, a := range r.Approved {
+		s.Approved[id] = a
+	}
+	for id, t := range r.Tags {
+		s.Tags[id] = append([]string{}, t...)
+	}
+	for id, f := range r.Favorites {
+		s.Favorites[id] = f
+	}
+	for id, a := range r.Aliases {
+		s.Aliases[id] = a
+	}
+	return s
+}
+
+func (r *Roster) load(s *Roster) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.M = s.M
+	r.Settings = s.Settings
+	r.Secrets = s.Secrets
+	r.Tags = s.Tags
+	r.Favorites = s.Favorites
+	r.Aliases = s.Aliases
+	r.Approved = s.Approved
+}
@@ -0,0 +1,256 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestRosterSettings(t *testing.T) {
+	var r Roster
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	s := ContactSettings{Muted: true, Notification: "bell", Ephemeral: time.Minute}
+
+	var changed []utils.NodeID
+	r.setHandler(func(id utils.NodeID, s ContactSettings) {
+		changed = append(changed, id)
+	})
+	r.SetSettings(id, s)
+
+	if len(changed) != 1 || !changed[0].Match(id) {
+		t.Errorf("SetSettings() should call the change handler")
+	}
+	if r.GetSettings(id) != s {
+		t.Errorf("GetSettings() returns wrong value: %v; expects %v", r.GetSettings(id), s)
+	}
+
+	data, err := msgpack.Marshal(r.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2 Roster
+	err = msgpack.Unmarshal(data, &r2.Settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.GetSettings(id) != s {
+		t.Errorf("unmarshaled settings: %v; expects %v", r2.GetSettings(id), s)
+	}
+}
+
+func TestRosterSettingsNotification(t *testing.T) {
+	c, err := NewClient(utils.GeneratePrivateKey(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(utils.GlobalNamespace, key.Digest())
+	c.Roster.SetSettings(id, ContactSettings{Notification: "bell", Transport: "tcp"})
+	data, _ := msgpack.Marshal(protocol.Envelope{Type: protocol.MsgChat, ID: id.String(), Content: NewPlainChatMessage("hello")})
+	c.parseMessage(router.Message{Node: id, Payload: data})
+
+	for c.mbuf.size > 0 {
+		m, _ := c.mbuf.Pop()
+		if msg, ok := m.M.(ChatMessage); ok {
+			if msg.Notification != "bell" {
+				t.Errorf("received message has notification %q; expects %q", msg.Notification, "bell")
+			}
+			return
+		}
+	}
+	t.Errorf("parseMessage() does not emit the message")
+}
+
+func TestRosterTags(t *testing.T) {
+	var r Roster
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	var events int
+	r.setTagHandler(func(utils.NodeID, []string, bool) {
+		events++
+	})
+
+	r.AddTag(id, "work")
+	r.AddTag(id, "family")
+	r.AddTag(id, "work")
+	if tags := r.GetTags(id); len(tags) != 2 || tags[0] != "family" || tags[1] != "work" {
+		t.Errorf("GetTags() returns %v; expects [family work]", tags)
+	}
+	r.RemoveTag(id, "family")
+	r.RemoveTag(id, "friends")
+	if tags := r.AllTags(); len(tags) != 1 || tags[0] != "work" {
+		t.Errorf("AllTags() returns %v; expects [work]", tags)
+	}
+
+	r.SetFavorite(id, true)
+	r.SetFavorite(id, true)
+	if !r.IsFavorite(id) {
+		t.Errorf("IsFavorite() returns false; expects true")
+	}
+	if events != 4 {
+		t.Errorf("tag handler is called %d times; expects 4", events)
+	}
+
+	r.Remove(id)
+	if len(r.GetTags(id)) != 0 || r.IsFavorite(id) {
+		t.Errorf("Remove() should delete the tags and the favorite")
+	}
+}
+
+func TestRosterAlias(t *testing.T) {
+	var r Roster
+	alice := utils.NewRandomNodeID(utils.GlobalNamespace)
+	bob := utils.NewRandomNodeID(utils.GlobalNamespace)
+	r.Set(alice, UserProfile{Nickname: "alice"})
+	r.Set(bob, UserProfile{Nickname: "bob"})
+
+	events := 0
+	r.setAliasHandler(func(utils.NodeID, string) { events++ })
+
+	r.SetAlias(bob, "Alice")
+	r.SetAlias(bob, "Alice")
+	if n := r.Name(bob); n != "Alice" {
+		t.Errorf("Name() returns %q; expects %q", n, "Alice")
+	}
+	if n := r.Name(alice); n != "alice" {
+		t.Errorf("Name() returns %q; expects %q", n, "alice")
+	}
+	if l := r.Find("alice"); len(l) != 1 || !l[0].Match(bob) {
+		t.Errorf("Find() should prefer the alias to the nickname")
+	}
+	if l := r.Find("bob"); len(l) != 0 {
+		t.Errorf("Find() returns %v; expects no contact", l)
+	}
+
+	r.SetAlias(bob, "")
+	if n := r.Name(bob); n != "bob" {
+		t.Errorf("Name() returns %q; expects %q", n, "bob")
+	}
+	if events != 2 {
+		t.Errorf("alias handler is called %d times; expects 2", events)
+	}
+
+	r.SetAlias(alice, "zed")
+	r.Remove(alice)
+	if a := r.Alias(alice); a != "" {
+		t.Errorf("Remove() should delete the alias")
+	}
+}
+
+func TestRosterContacts(t *testing.T) {
+	var r Roster
+	alice := utils.NewRandomNodeID(utils.GlobalNamespace)
+	bob := utils.NewRandomNodeID(utils.GlobalNamespace)
+	carol := utils.NewRandomNodeID(utils.GlobalNamespace)
+	r.Set(alice, UserProfile{Nickname: "alice"})
+	r.Set(bob, UserProfile{Nickname: "Bob"})
+	r.Set(carol, UserProfile{Nickname: "carol"})
+	r.AddTag(bob, "work")
+	r.AddTag(carol, "work")
+	r.SetFavorite(carol, true)
+
+	now := time.Now()
+	online := func(id utils.NodeID) bool { return id.Match(carol) }
+	activity := func(id utils.NodeID) time.Time {
+		if id.Match(bob) {
+			return now
+		}
+		if id.Match(alice) {
+			return now.Add(-time.Hour)
+		}
+		return time.Time{}
+	}
+
+	check := func(name string, list []Contact, expected ...utils.NodeID) {
+		if len(list) != len(expected) {
+			t.Errorf("%s returns %d contacts; expects %d", name, len(list), len(expected))
+			return
+		}
+		for i, c := range list {
+			if !c.ID.Match(expected[i]) {
+				t.Errorf("%s returns %s at %d; expects %s", name, c.Profile.Nickname, i, r.Get(expected[i]).Nickname)
+			}
+		}
+	}
+
+	check("OrderName", r.contacts(ContactFilter{}, OrderName, online, activity), alice, bob, carol)
+	check("OrderPresence", r.contacts(ContactFilter{}, OrderPresence, online, activity), carol, alice, bob)
+	check("OrderActivity", r.contacts(ContactFilter{}, OrderActivity, online, activity), bob, alice, carol)
+	check("Tag", r.contacts(ContactFilter{Tag: "work"}, OrderName, online, activity), bob, carol)
+	check("Favorite", r.contacts(ContactFilter{Favorite: true}, OrderName, online, activity), carol)
+	check("Online", r.contacts(ContactFilter{Online: true}, OrderName, online, activity), carol)
+}
+
+func TestRosterChanges(t *testing.T) {
+	var r Roster
+	var changes []RosterChange
+	r.setChangeHandler(func(c []RosterChange) { changes = append(changes, c...) })
+
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	r.Set(id, UserProfile{Nickname: "alice"})
+	r.SetAlias(id, "al")
+	r.SetAlias(id, "al")
+	r.Remove(id)
+	if len(changes) != 3 {
+		t.Fatalf("change handler is called for %d changes; expects 3", len(changes))
+	}
+	if c := changes[0]; c.Old.Present || !c.New.Present || c.New.Profile.Nickname != "alice" {
+		t.Errorf("first change is %v; expects an added contact", c)
+	}
+	if c := changes[1]; c.Old.Alias != "" || c.New.Alias != "al" {
+		t.Errorf("second change is %v; expects an alias change", c)
+	}
+	if c := changes[2]; !c.Old.Present || c.Old.Alias != "al" || c.New.Present {
+		t.Errorf("third change is %v; expects a removed contact", c)
+	}
+}
+
+func TestRosterBatch(t *testing.T) {
+	var r Roster
+	var events [][]RosterChange
+	r.setChangeHandler(func(c []RosterChange) { events = append(events, c) })
+
+	alice := utils.NewRandomNodeID(utils.GlobalNamespace)
+	bob := utils.NewRandomNodeID(utils.GlobalNamespace)
+	err := r.Batch(func(tx *RosterTx) error {
+		tx.Add(alice, UserProfile{Nickname: "alice"})
+		if err := tx.AddTag(alice, "work"); err != nil {
+			return err
+		}
+		return tx.AddTag(bob, "work")
+	})
+	if err == nil {
+		t.Errorf("Batch() accepts a tag of a contact which is not in the roster")
+	}
+	if len(r.List()) != 0 || len(events) != 0 {
+		t.Errorf("Batch() should not apply a failed batch")
+	}
+
+	err = r.Batch(func(tx *RosterTx) error {
+		for _, id := range []utils.NodeID{alice, bob} {
+			tx.Add(id, UserProfile{})
+			if err := tx.AddTag(id, "work"); err != nil {
+				return err
+			}
+		}
+		return tx.SetFavorite(bob, true)
+	})
+	if err != nil {
+		t.Fatalf("Batch() returns %v", err)
+	}
+	if len(r.List()) != 2 || len(r.GetTags(alice)) != 1 || !r.IsFavorite(bob) {
+		t.Errorf("Batch() does not apply the operations")
+	}
+	if len(events) != 1 || len(events[0]) != 2 {
+		t.Fatalf("Batch() emits %d events; expects 1 with 2 changes", len(events))
+	}
+	if c := events[0][1]; !c.ID.Match(bob) || c.Old.Present || !c.New.Favorite {
+		t.Errorf("Batch() emits change %v; expects bob added as a favorite", c)
+	}
+}
@@ -0,0 +1,166 @@
+package murcott
+
+import (
+	"errors"
+	"reflect"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+var errContactNotFound = errors.New("contact not found")
+
+// RosterTx is a batch of roster operations applied by Roster.Batch.
+// The operations on contacts other than Add fail if the contact is
+// neither in the roster nor added by the batch.
+type RosterTx struct {
+	r       *Roster
+	entries map[utils.NodeID]*RosterEntry
+	order   []utils.NodeID
+	added   map[utils.NodeID]bool
+}
+
+func (tx *RosterTx) get(id utils.NodeID) *RosterEntry {
+	if e, ok := tx.entries[id]; ok {
+		return e
+	}
+	e := tx.r.entry(id)
+	tx.entries[id] = &e
+	tx.order = append(tx.order, id)
+	return &e
+}
+
+func (tx *RosterTx) present(id utils.NodeID) (*RosterEntry, error) {
+	e := tx.get(id)
+	if !e.Present {
+		return nil, errContactNotFound
+	}
+	return e, nil
+}
+
+// Add adds the contact with the given profile and approves it,
+// or replaces the profile of an existing contact.
+func (tx *RosterTx) Add(id utils.NodeID, prof UserProfile) {
+	e := tx.get(id)
+	e.Present = true
+	e.Profile = prof
+	tx.added[id] = true
+}
+
+// Remove removes the contact with its settings, alias and tags.
+func (tx *RosterTx) Remove(id utils.NodeID) error {
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	*e = RosterEntry{}
+	return nil
+}
+
+// SetSettings sets the conversation settings of the contact.
+func (tx *RosterTx) SetSettings(id utils.NodeID, s ContactSettings) error {
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	e.Settings = s
+	return nil
+}
+
+// SetAlias sets the local alias of the contact.
+// An empty alias removes it.
+func (tx *RosterTx) SetAlias(id utils.NodeID, alias string) error {
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	e.Alias = alias
+	return nil
+}
+
+// AddTag adds the contact to a user-defined group.
+func (tx *RosterTx) AddTag(id utils.NodeID, tag string) error {
+	if tag == "" {
+		return errors.New("empty tag")
+	}
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	for _, t := range e.Tags {
+		if t == tag {
+			return nil
+		}
+	}
+	e.Tags = append(e.Tags, tag)
+	return nil
+}
+
+// RemoveTag removes the contact from a user-defined group.
+func (tx *RosterTx) RemoveTag(id utils.NodeID, tag string) error {
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	var tags []string
+	for _, t := range e.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	e.Tags = tags
+	return nil
+}
+
+// SetFavorite adds the contact to the favorites or removes it.
+func (tx *RosterTx) SetFavorite(id utils.NodeID, favorite bool) error {
+	e, err := tx.present(id)
+	if err != nil {
+		return err
+	}
+	e.Favorite = favorite
+	return nil
+}
+
+// Batch runs f with a transaction whose operations are applied together
+// if f returns nil, and discarded otherwise. The roster is locked while
+// f runs, so f must not call the other methods of the roster. The changes
+// are emitted in a single RosterChangeEvent.
+func (r *Roster) Batch(f func(tx *RosterTx) error) error {
+	r.mutex.Lock()
+	tx := &RosterTx{r: r, entries: make(map[utils.NodeID]*RosterEntry), added: make(map[utils.NodeID]bool)}
+	err := f(tx)
+	if err != nil {
+		r.mutex.Unlock()
+		return err
+	}
+	var changes []RosterChange
+	for _, id := range tx.order {
+		old := r.entry(id)
+		r.setEntry(id, *tx.entries[id])
+		if tx.added[id] && tx.entries[id].Present {
+			if r.Approved == nil {
+				r.Approved = make(map[utils.NodeID]bool)
+			}
+			r.Approved[id] = true
+		}
+		changes = append(changes, r.changed(id, old)...)
+	}
+	h := r.handler
+	tagHandler := r.tagHandler
+	aliasHandler := r.aliasHandler
+	r.mutex.Unlock()
+
+	for _, c := range changes {
+		if h != nil && c.Old.Settings != c.New.Settings {
+			h(c.ID, c.New.Settings)
+		}
+		if aliasHandler != nil && c.Old.Alias != c.New.Alias {
+			aliasHandler(c.ID, c.New.Alias)
+		}
+		if tagHandler != nil && (c.Old.Favorite != c.New.Favorite || !reflect.DeepEqual(c.Old.Tags, c.New.Tags)) {
+			tagHandler(c.ID, c.New.Tags, c.New.Favorite)
+		}
+	}
+	r.emit(changes)
+	return nil
+}
@@ -0,0 +1,206 @@
+package router
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// addressRecordTTL is the lifetime of a published address record.
+// The record is published again with the capability record,
+// well before it expires.
+const addressRecordTTL = time.Hour
+
+// AddressRecord lists the candidate addresses at which a node accepts
+// sessions. It is signed with the key of the node and expires at Expiry,
+// given in Unix nanoseconds.
+type AddressRecord struct {
+	ID     utils.NodeID    `msgpack:"id"`
+	Addrs  []string        `msgpack:"addrs"`
+	Expiry int64           `msgpack:"expiry"`
+	Key    utils.PublicKey `msgpack:"key"`
+	Sign   utils.Signature `msgpack:"sign"`
+}
+
+func (r *AddressRecord) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		r.ID.Bytes(),
+		r.Addrs,
+		r.Expiry,
+	})
+	return data
+}
+
+func (r *AddressRecord) sign(key *utils.PrivateKey) error {
+	r.Key = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign address record")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Verify checks that the record is signed by the node it describes.
+func (r *AddressRecord) Verify() error {
+	if r.ID.Digest.Cmp(r.Key.Digest()) != 0 {
+		return errors.New("address record signed by wrong key")
+	}
+	if !r.Key.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid address record signature")
+	}
+	return nil
+}
+
+// addressRecordName is the name of the signed DHT record
+// holding the address record of a node.
+const addressRecordName = "addr"
+
+// LANScheme marks the published addresses which are only reachable from
+// the local network of the node, so that they are dialed last. Older
+// nodes do not know the scheme and skip them.
+const LANScheme = "lan"
+
+// PublishedAddrs returns the addresses of this node which are published
+// in its records: the addresses reachable from anywhere, then the local
+// ones marked with LANScheme.
+func (p *Router) PublishedAddrs() []string {
+	var global, lan []string
+	for _, a := range p.Addrs() {
+		scheme, addr := SplitTransportAddr(a)
+		if scheme == UTPScheme && isLocalAddr(a) {
+			lan = append(lan, JoinTransportAddr(LANScheme, addr))
+		} else {
+			global = append(global, a)
+		}
+	}
+	return append(global, lan...)
+}
+
+// unmarkLAN returns the address without its LAN mark.
+func unmarkLAN(address string) string {
+	if scheme, addr := SplitTransportAddr(address); scheme == LANScheme {
+		return addr
+	}
+	return address
+}
+
+// dialAddrs returns the published addresses of a node in the order in
+// which they are dialed: the LAN addresses come last, without their mark.
+func dialAddrs(addrs []string) []string {
+	var global, lan []string
+	for _, a := range addrs {
+		if u := unmarkLAN(a); u != a {
+			lan = append(lan, u)
+		} else {
+			global = append(global, a)
+		}
+	}
+	return append(global, lan...)
+}
+
+// SetPreferredTransport sets the scheme of the transport over which the
+// sessions to the node are dialed first, if its address record lists an
+// address of that scheme. An empty scheme clears the preference.
+func (p *Router) SetPreferredTransport(id utils.NodeID, scheme string) {
+	p.dialMutex.Lock()
+	defer p.dialMutex.Unlock()
+	if scheme == "" {
+		delete(p.preferred, id)
+		return
+	}
+	if p.preferred == nil {
+		p.preferred = make(map[utils.NodeID]string)
+	}
+	p.preferred[id] = scheme
+}
+
+// dialPreferred dials the node at the addresses of its preferred
+// transport, if any.
+func (p *Router) dialPreferred(id utils.NodeID) *session {
+	p.dialMutex.Lock()
+	scheme, ok := p.preferred[id]
+	p.dialMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	r, err := p.LookupAddress(id)
+	if err != nil {
+		return nil
+	}
+	for _, a := range dialAddrs(r.Addrs) {
+		if s, _ := SplitTransportAddr(a); s != scheme {
+			continue
+		}
+		if s := p.dial(id, a); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// publishAddress stores the address record of this node in the DHT.
+func (p *Router) publishAddress() {
+	addrs := p.PublishedAddrs()
+	if len(addrs) == 0 {
+		return
+	}
+	r := AddressRecord{
+		ID:     p.id,
+		Addrs:  addrs,
+		Expiry: time.Now().Add(addressRecordTTL).UnixNano(),
+	}
+	if r.sign(p.key) != nil {
+		return
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return
+	}
+	p.mainDht.StoreSigned(addressRecordName, string(data), p.key)
+}
+
+// LookupAddress returns the address record of the given node from the DHT.
+func (p *Router) LookupAddress(id utils.NodeID) (AddressRecord, error) {
+	var r AddressRecord
+	ctx, cancel := context.WithTimeout(context.Background(), locateTimeout)
+	defer cancel()
+
+	key := dht.SignedKey(id.Digest, addressRecordName)
+	var str *string
+	for res := range p.mainDht.FindValue(ctx, key) {
+		if res.Value != nil {
+			str = res.Value
+		}
+	}
+	if str == nil {
+		return r, errors.New("address record not found")
+	}
+	signed, err := dht.DecodeSigned(key, *str)
+	if err != nil {
+		return r, err
+	}
+	err = msgpack.Unmarshal([]byte(signed.Value), &r)
+	if err != nil {
+		return r, err
+	}
+	if !r.ID.Match(id) {
+		return r, errors.New("address record for another node")
+	}
+	err = r.Verify()
+	if err != nil {
+		return r, err
+	}
+	expiry := p.PeerTime(id, time.Unix(0, r.Expiry))
+	if expiry.Before(time.Now()) {
+		return r, errors.New("address record expired")
+	}
+	if expiry.Sub(time.Now()) > addressRecordTTL+MaxClockSkew {
+		return r, errors.New("address record expires too late")
+	}
+	return r, nil
+}
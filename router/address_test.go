@@ -0,0 +1,53 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestAddressRecord(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	r := AddressRecord{
+		ID:     utils.NewNodeID(namespace, key.Digest()),
+		Addrs:  []string{"192.0.2.1:9200", "[2001:db8::1]:9200"},
+		Expiry: time.Now().Add(addressRecordTTL).UnixNano(),
+	}
+	err := r.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+
+	r.Addrs = append(r.Addrs, "198.51.100.1:9200")
+	if r.Verify() == nil {
+		t.Errorf("Verify() should fail for a modified record")
+	}
+
+	other := AddressRecord{ID: utils.NewRandomNodeID(namespace), Addrs: r.Addrs}
+	other.sign(key)
+	if other.Verify() == nil {
+		t.Errorf("Verify() should fail for a record of another node")
+	}
+}
+
+func TestDialAddrs(t *testing.T) {
+	published := []string{"203.0.113.1:9200", JoinTransportAddr(LANScheme, "192.168.0.10:9200"), "ble://aa:bb"}
+	addrs := dialAddrs(published)
+	expects := []string{"203.0.113.1:9200", "ble://aa:bb", "192.168.0.10:9200"}
+	if len(addrs) != len(expects) {
+		t.Fatalf("dialAddrs() returns %v; expects %v", addrs, expects)
+	}
+	for i := range addrs {
+		if addrs[i] != expects[i] {
+			t.Errorf("dialAddrs() returns %v; expects %v", addrs, expects)
+			break
+		}
+	}
+	if a := unmarkLAN("lan://10.0.0.1:9200"); a != "10.0.0.1:9200" {
+		t.Errorf("unmarkLAN() returns %q; expects %q", a, "10.0.0.1:9200")
+	}
+}
@@ -0,0 +1,100 @@
+package router
+
+import (
+	"sync"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// Decisions of an admission handler.
+const (
+	// AdmitAccept lets the node participate in the group.
+	AdmitAccept = iota
+
+	// AdmitReject drops the packets sent or forwarded by the node.
+	AdmitReject
+
+	// AdmitChallenge drops the packets of the node until the application
+	// decides with Admit, for example after checking an invitation.
+	AdmitChallenge
+)
+
+// admissionState holds the admission handler and its decisions
+// for each group.
+type admissionState struct {
+	handler func(group, node utils.NodeID) int
+	decided map[utils.NodeID]map[utils.NodeID]int
+	mutex   sync.Mutex
+}
+
+func (a *admissionState) set(group, node utils.NodeID, decision int) {
+	if a.decided == nil {
+		a.decided = make(map[utils.NodeID]map[utils.NodeID]int)
+	}
+	m := a.decided[group]
+	if m == nil {
+		m = make(map[utils.NodeID]int)
+		a.decided[group] = m
+	}
+	m[node] = decision
+}
+
+// SetAdmissionHandler sets a function which is called when a node without
+// a member record sends or forwards a packet in a joined group for the
+// first time. It is called from the packet processing and must not block.
+// Without a handler, all nodes are accepted.
+func (p *Router) SetAdmissionHandler(h func(group, node utils.NodeID) int) {
+	p.admission.mutex.Lock()
+	defer p.admission.mutex.Unlock()
+	p.admission.handler = h
+}
+
+// Admit records the decision of the application for a node of a group,
+// such as the result of a challenge.
+func (p *Router) Admit(group, node utils.NodeID, decision int) {
+	p.admission.mutex.Lock()
+	defer p.admission.mutex.Unlock()
+	p.admission.set(group, node, decision)
+}
+
+// admitted reports whether the node may participate in the group.
+// The handler is called for the unknown nodes, whose packets are held
+// back while it decides. Rejections apply to members too.
+func (p *Router) admitted(group, node utils.NodeID) bool {
+	if node.Match(p.id) {
+		return true
+	}
+	p.admission.mutex.Lock()
+	h := p.admission.handler
+	d, ok := p.admission.decided[group][node]
+	if h == nil || ok {
+		p.admission.mutex.Unlock()
+		return !ok || d == AdmitAccept
+	}
+	p.memberMutex.RLock()
+	_, member := p.members[group][node]
+	p.memberMutex.RUnlock()
+	if member {
+		p.admission.mutex.Unlock()
+		return true
+	}
+	// Hold back the packets of the node until the handler returns.
+	p.admission.set(group, node, AdmitChallenge)
+	p.admission.mutex.Unlock()
+
+	d = h(group, node)
+	p.admission.mutex.Lock()
+	if p.admission.decided[group][node] == AdmitChallenge {
+		p.admission.set(group, node, d)
+	}
+	d = p.admission.decided[group][node]
+	p.admission.mutex.Unlock()
+	return d == AdmitAccept
+}
+
+// forgetAdmissions drops the decisions for a group which has been left.
+func (p *Router) forgetAdmissions(group utils.NodeID) {
+	p.admission.mutex.Lock()
+	defer p.admission.mutex.Unlock()
+	delete(p.admission.decided, group)
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestAdmission(t *testing.T) {
+	p := &Router{
+		id:      utils.NewRandomNodeID(utils.GlobalNamespace),
+		members: make(map[utils.NodeID]map[utils.NodeID]MemberRecord),
+	}
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	member := utils.NewRandomNodeID(utils.GlobalNamespace)
+	stranger := utils.NewRandomNodeID(utils.GlobalNamespace)
+	p.members[group] = map[utils.NodeID]MemberRecord{member: MemberRecord{}}
+
+	if !p.admitted(group, stranger) {
+		t.Errorf("admitted() should accept all nodes without a handler")
+	}
+
+	calls := 0
+	p.SetAdmissionHandler(func(g, n utils.NodeID) int {
+		calls++
+		return AdmitChallenge
+	})
+	if !p.admitted(group, member) {
+		t.Errorf("admitted() should accept a member")
+	}
+	if !p.admitted(group, p.id) {
+		t.Errorf("admitted() should accept this node")
+	}
+	if p.admitted(group, stranger) || p.admitted(group, stranger) {
+		t.Errorf("admitted() should hold back a challenged node")
+	}
+	if calls != 1 {
+		t.Errorf("handler is called %d times; expects 1", calls)
+	}
+
+	p.Admit(group, stranger, AdmitAccept)
+	if !p.admitted(group, stranger) {
+		t.Errorf("admitted() should accept an admitted node")
+	}
+	p.Admit(group, member, AdmitReject)
+	if p.admitted(group, member) {
+		t.Errorf("admitted() should reject a rejected member")
+	}
+
+	p.forgetAdmissions(group)
+	if p.admitted(group, stranger) || calls != 2 {
+		t.Errorf("forgetAdmissions() should ask the handler again")
+	}
+}
@@ -0,0 +1,203 @@
+package router
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+)
+
+const (
+	probeTimeout = time.Second
+
+	// bootstrapFanout is the number of the fastest bootstrap nodes
+	// used for the initial discovery.
+	bootstrapFanout = 4
+
+	// neighborhoodInterval is the interval at which the nodes nearest
+	// to this node are verified again.
+	neighborhoodInterval = 10 * time.Minute
+)
+
+// ProbeResult is the result of probing a bootstrap node.
+type ProbeResult struct {
+	Addr net.UDPAddr
+	RTT  time.Duration
+	Err  error
+}
+
+type probeResult struct {
+	index int
+	rtt   time.Duration
+	err   error
+}
+
+// bootstrap probes the bootstrap nodes concurrently. The group DHTs
+// discover the first nodes to respond. All the nodes are discovered
+// again by retryBootstrap until this node is bootstrapped.
+func (p *Router) bootstrap(addrs []net.UDPAddr) {
+	ch := make(chan probeResult, len(addrs))
+	for i := range addrs {
+		go func(i int) {
+			rtt, err := p.mainDht.Ping(&addrs[i], probeTimeout)
+			ch <- probeResult{index: i, rtt: rtt, err: err}
+		}(i)
+	}
+
+	var results []ProbeResult
+	n := 0
+	for range addrs {
+		r := <-ch
+		addr := addrs[r.index]
+		result := ProbeResult{Addr: addr, RTT: r.rtt, Err: r.err}
+		results = append(results, result)
+		if r.err == nil && n < bootstrapFanout {
+			n++
+			p.dhtMutex.RLock()
+			for _, d := range p.groupDht {
+				d.Discover(&addr)
+			}
+			p.dhtMutex.RUnlock()
+			p.logger.Info("Bootstrap node %v responded in %v", addr.String(), r.rtt)
+		}
+	}
+	sort.Sort(byRTT(results))
+
+	p.bootstrapMutex.Lock()
+	p.probes = results
+	p.bootstrapMutex.Unlock()
+
+	p.publishCapabilities()
+	p.publishAddress()
+}
+
+// addBootstrapNodes adds the nodes discovered by retryBootstrap
+// and restarts its backoff.
+func (p *Router) addBootstrapNodes(addrs []net.UDPAddr, now time.Time) {
+	p.bootstrapMutex.Lock()
+	defer p.bootstrapMutex.Unlock()
+	for _, a := range addrs {
+		found := false
+		for _, b := range p.bootstrapAddrs {
+			if a.String() == b.String() {
+				found = true
+				break
+			}
+		}
+		if !found {
+			p.bootstrapAddrs = append(p.bootstrapAddrs, a)
+		}
+	}
+	p.bootstrapAttempts = 1
+	p.nextBootstrap = now.Add(p.retry.Bootstrap.JitteredDelay(1, rand.Float64()))
+}
+
+// resetBootstrap makes retryBootstrap discover the bootstrap nodes
+// immediately and the node look up its ID again, such as after
+// a network change.
+func (p *Router) resetBootstrap() {
+	p.bootstrapMutex.Lock()
+	defer p.bootstrapMutex.Unlock()
+	p.bootstrapAttempts = 0
+	p.nextBootstrap = time.Time{}
+	p.joined = false
+}
+
+// Bootstrapped reports whether the routing table holds at least
+// the number of nodes required by the config.
+func (p *Router) Bootstrapped() bool {
+	return len(p.mainDht.KnownNodes()) >= p.bootstrapNodes
+}
+
+// retryBootstrap sends discovery packets to the bootstrap nodes while this
+// node is not bootstrapped, with exponential backoff and jitter according
+// to the bootstrap retry policy.
+func (p *Router) retryBootstrap(now time.Time) {
+	if p.Bootstrapped() {
+		return
+	}
+	p.bootstrapMutex.Lock()
+	if len(p.bootstrapAddrs) == 0 || now.Before(p.nextBootstrap) || p.retry.Bootstrap.Exhausted(p.bootstrapAttempts) {
+		p.bootstrapMutex.Unlock()
+		return
+	}
+	p.bootstrapAttempts++
+	p.nextBootstrap = now.Add(p.retry.Bootstrap.JitteredDelay(p.bootstrapAttempts, rand.Float64()))
+	addrs := p.bootstrapAddrs
+	attempt := p.bootstrapAttempts
+	p.bootstrapMutex.Unlock()
+
+	p.logger.Info("Bootstrap attempt %d", attempt)
+	p.dhtMutex.RLock()
+	defer p.dhtMutex.RUnlock()
+	for i := range addrs {
+		p.mainDht.Discover(&addrs[i])
+		for _, d := range p.groupDht {
+			d.Discover(&addrs[i])
+		}
+	}
+}
+
+// maintainNeighborhood looks up the ID of this node once it is
+// bootstrapped, and then verifies its nearest nodes periodically.
+func (p *Router) maintainNeighborhood(now time.Time) {
+	if !p.Bootstrapped() {
+		return
+	}
+	p.bootstrapMutex.Lock()
+	join := !p.joined
+	refresh := !join && now.Sub(p.lastNeighborhood) >= neighborhoodInterval
+	if join || refresh {
+		p.joined = true
+		p.lastNeighborhood = now
+	}
+	p.bootstrapMutex.Unlock()
+
+	if join {
+		ctx, cancel := context.WithTimeout(context.Background(), locateTimeout)
+		defer cancel()
+		n := p.mainDht.Join(ctx)
+		p.logger.Info("Self-lookup found %d nodes", n)
+	} else if refresh {
+		n := p.mainDht.RefreshNeighborhood()
+		p.logger.Info("%d neighbors answered", n)
+		n = p.mainDht.RefreshBuckets(now)
+		p.logger.Info("%d buckets refreshed", n)
+	}
+}
+
+// maintainValues expires, republishes and replicates the values
+// stored in the DHTs.
+func (p *Router) maintainValues(now time.Time) {
+	p.dhtMutex.RLock()
+	dhts := []*dht.DHT{p.mainDht}
+	for _, d := range p.groupDht {
+		dhts = append(dhts, d)
+	}
+	p.dhtMutex.RUnlock()
+	for _, d := range dhts {
+		d.Maintain(now)
+	}
+}
+
+// BootstrapProbes returns the results of the last probe of the bootstrap
+// nodes, ordered by round-trip time. Nodes which did not respond are last.
+func (p *Router) BootstrapProbes() []ProbeResult {
+	p.bootstrapMutex.Lock()
+	defer p.bootstrapMutex.Unlock()
+	return append([]ProbeResult(nil), p.probes...)
+}
+
+type byRTT []ProbeResult
+
+func (s byRTT) Len() int      { return len(s) }
+func (s byRTT) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byRTT) Less(i, j int) bool {
+	if (s[i].Err == nil) != (s[j].Err == nil) {
+		return s[i].Err == nil
+	}
+	return s[i].RTT < s[j].RTT
+}
@@ -0,0 +1,78 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestProbeOrder(t *testing.T) {
+	probes := []ProbeResult{
+		{Addr: net.UDPAddr{Port: 1}, Err: errors.New("timeout")},
+		{Addr: net.UDPAddr{Port: 2}, RTT: 30 * time.Millisecond},
+		{Addr: net.UDPAddr{Port: 3}, RTT: 10 * time.Millisecond},
+	}
+	sort.Sort(byRTT(probes))
+	for i, port := range []int{3, 2, 1} {
+		if probes[i].Addr.Port != port {
+			t.Errorf("probes[%d].Addr.Port is %d; expects %d", i, probes[i].Addr.Port, port)
+		}
+	}
+}
+
+func TestRetryBootstrap(t *testing.T) {
+	logger := log.NewLogger()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	bootstrap, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bootstrap.Close()
+
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	p := &Router{
+		id:             id,
+		mainDht:        dht.NewDHT(10, id, id, conn, logger),
+		retry:          utils.RetryConfig{Bootstrap: utils.RetryPolicy{Initial: time.Second, Multiplier: 2, Attempts: 3}}.WithDefaults(),
+		bootstrapNodes: 1,
+		logger:         logger,
+	}
+	p.retry.Bootstrap.Jitter = 0
+
+	addr := *bootstrap.LocalAddr().(*net.UDPAddr)
+	now := time.Now()
+	p.addBootstrapNodes([]net.UDPAddr{addr, addr}, now)
+	if len(p.bootstrapAddrs) != 1 {
+		t.Errorf("addBootstrapNodes() adds %d nodes; expects 1", len(p.bootstrapAddrs))
+	}
+
+	p.retryBootstrap(now)
+	if p.bootstrapAttempts != 1 {
+		t.Errorf("retryBootstrap() should wait for the first delay")
+	}
+	p.retryBootstrap(now.Add(time.Second))
+	if p.bootstrapAttempts != 2 || !p.nextBootstrap.Equal(now.Add(3*time.Second)) {
+		t.Errorf("retryBootstrap() should back off; next attempt at %v", p.nextBootstrap.Sub(now))
+	}
+	bootstrap.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1024]byte
+	if _, _, err := bootstrap.ReadFrom(b[:]); err != nil {
+		t.Errorf("retryBootstrap() should send a discovery packet: %v", err)
+	}
+
+	p.retryBootstrap(now.Add(3 * time.Second))
+	p.retryBootstrap(now.Add(time.Hour))
+	if p.bootstrapAttempts != 3 {
+		t.Errorf("retryBootstrap() makes %d attempts; expects 3", p.bootstrapAttempts)
+	}
+}
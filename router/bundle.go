@@ -0,0 +1,148 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// maxBundleAge is the age after which the messages of a bundle are not
+// delivered anymore.
+const maxBundleAge = 30 * 24 * time.Hour
+
+// Bundle carries the messages of a node waiting for a route and the
+// records of its DHT to a network which cannot reach it, such as on a USB
+// drive. It is signed by the node, so that the node which imports it can
+// deliver the messages on its behalf. Group messages are not carried, and
+// the messages are not encrypted.
+type Bundle struct {
+	Src     utils.NodeID      `msgpack:"src"`
+	Time    time.Time         `msgpack:"time"`
+	Packets []protocol.Packet `msgpack:"packets"`
+	Records []dht.Record      `msgpack:"records"`
+	Key     utils.PublicKey   `msgpack:"key"`
+	Sign    utils.Signature   `msgpack:"sign"`
+}
+
+// BundleImport counts what has been done with the contents of a bundle.
+type BundleImport struct {
+	Delivered int
+	Forwarded int
+	Records   int
+}
+
+func (b *Bundle) serialize() []byte {
+	packets := make([][]byte, len(b.Packets))
+	for i := range b.Packets {
+		packets[i] = b.Packets[i].Serialize()
+	}
+	records := make([]interface{}, len(b.Records))
+	for i, r := range b.Records {
+		records[i] = []interface{}{r.Key, r.Value, r.Method, int64(r.Age)}
+	}
+	data, _ := msgpack.Marshal([]interface{}{
+		b.Src.Bytes(),
+		b.Time.UnixNano(),
+		packets,
+		records,
+	})
+	return data
+}
+
+// Verify checks that the bundle is signed by its source, and that all of
+// its messages are from it.
+func (b *Bundle) Verify() error {
+	if b.Src.Digest.Cmp(b.Key.Digest()) != 0 {
+		return errors.New("bundle signed by wrong key")
+	}
+	if !b.Key.Verify(b.serialize(), &b.Sign) {
+		return errors.New("invalid bundle signature")
+	}
+	for _, pkt := range b.Packets {
+		if !pkt.Src.Match(b.Src) || pkt.Type != protocol.TypeMsg || isGroup(pkt.Dst) {
+			return errors.New("foreign packet in bundle")
+		}
+	}
+	return nil
+}
+
+// isGroup reports whether the ID is that of a group.
+func isGroup(id utils.NodeID) bool {
+	return bytes.Equal(id.NS[:], utils.GroupNamespace[:])
+}
+
+// ExportBundle returns a bundle of the messages of this node waiting in
+// the outbox and of the records of the main DHT. The messages stay in the
+// outbox, and are only delivered once if they are also sent directly.
+func (p *Router) ExportBundle() (*Bundle, error) {
+	b := &Bundle{
+		Src:     p.id,
+		Time:    time.Now(),
+		Records: p.mainDht.Records(),
+		Key:     p.key.PublicKey,
+	}
+	p.queueMutex.Lock()
+	for _, q := range p.queuedPackets {
+		if q.pkt.Type == protocol.TypeMsg && q.pkt.Src.Match(p.id) && !isGroup(q.pkt.Dst) {
+			pkt := q.pkt
+			pkt.Path = nil
+			b.Packets = append(b.Packets, pkt)
+		}
+	}
+	p.queueMutex.Unlock()
+
+	sign := p.key.Sign(b.serialize())
+	if sign == nil {
+		return nil, errors.New("cannot sign bundle")
+	}
+	b.Sign = *sign
+	return b, nil
+}
+
+// ImportBundle delivers the messages of a bundle addressed to this node,
+// sends the others towards their destinations, and holds its records in
+// the main DHT, from which they are replicated to the nearest nodes.
+// A bundle can be imported several times, as the messages which have
+// already been received are ignored.
+func (p *Router) ImportBundle(b *Bundle) (BundleImport, error) {
+	var n BundleImport
+	if err := b.Verify(); err != nil {
+		return n, err
+	}
+	age := time.Since(p.PeerTime(b.Src, b.Time))
+	if age < 0 {
+		age = 0
+	}
+
+	if age < maxBundleAge {
+		for _, pkt := range b.Packets {
+			if checkNamespaces(pkt.Src, pkt.Dst, pkt.Type) != nil || !p.acceptPacket(pkt) {
+				continue
+			}
+			if pkt.Dst.Match(p.id) {
+				if p.Trusted(pkt.Src) {
+					id, _ := time.Now().MarshalBinary()
+					p.recv <- Message{Node: pkt.Src, Dst: pkt.Dst, Payload: pkt.Payload, ID: id}
+					n.Delivered++
+				}
+				continue
+			}
+			pkt.TTL = defaultTTL
+			p.send <- pkt
+			n.Forwarded++
+		}
+	}
+
+	for _, r := range b.Records {
+		r.Age += age
+		if p.mainDht.ImportRecord(r) == nil {
+			n.Records++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,62 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestBundleVerify(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	src := utils.NewNodeID(namespace, key.Digest())
+	dst := utils.NewRandomNodeID(namespace)
+
+	b := Bundle{
+		Src:  src,
+		Time: time.Now(),
+		Packets: []protocol.Packet{
+			{Src: src, Dst: dst, Type: protocol.TypeMsg, Payload: []byte("hello"), TTL: defaultTTL},
+		},
+		Records: []dht.Record{{Key: "key", Value: "value", Method: protocol.RPCStore, Age: time.Hour}},
+		Key:     key.PublicKey,
+	}
+	b.Sign = *key.Sign(b.serialize())
+
+	data, err := msgpack.Marshal(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c Bundle
+	if err := msgpack.Unmarshal(data, &c); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+
+	d := c
+	d.Records = []dht.Record{{Key: "key", Value: "other", Method: protocol.RPCStore}}
+	if d.Verify() == nil {
+		t.Errorf("Verify() should reject an altered record")
+	}
+
+	d = c
+	d.Packets = []protocol.Packet{c.Packets[0]}
+	d.Packets[0].Payload = []byte("altered")
+	if d.Verify() == nil {
+		t.Errorf("Verify() should reject an altered message")
+	}
+
+	other := utils.GeneratePrivateKey()
+	d = c
+	d.Packets = []protocol.Packet{c.Packets[0]}
+	d.Packets[0].Src = utils.NewNodeID(namespace, other.Digest())
+	d.Sign = *key.Sign(d.serialize())
+	if d.Verify() == nil {
+		t.Errorf("Verify() should reject a message of another node")
+	}
+}
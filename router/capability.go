@@ -0,0 +1,376 @@
+package router
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Services which a node can advertise.
+const (
+	ServiceRelay     = "relay"
+	ServiceMailbox   = "mailbox"
+	ServiceBootstrap = "bootstrap"
+)
+
+// Bandwidth classes of a node.
+const (
+	BandwidthUnknown = iota
+	BandwidthLow
+	BandwidthMedium
+	BandwidthHigh
+)
+
+// capabilityInterval is the interval at which the capability record
+// of this node is published again to the DHT.
+const capabilityInterval = 10 * time.Minute
+
+var protocolVersions = []string{"murcott/1"}
+
+// ProtocolVersions returns the protocol versions supported by this
+// implementation, oldest first.
+func ProtocolVersions() []string {
+	return append([]string(nil), protocolVersions...)
+}
+
+// CapabilityRecord advertises the services and the resources of a node,
+// and the message types, codecs and stream transports it supports.
+// It is signed with the key of the node.
+type CapabilityRecord struct {
+	ID         utils.NodeID    `msgpack:"id"`
+	Services   []string        `msgpack:"services"`
+	Bandwidth  int             `msgpack:"bandwidth"`
+	Protocols  []string        `msgpack:"protocols"`
+	Messages   []string        `msgpack:"messages"`
+	Codecs     []string        `msgpack:"codecs"`
+	Transports []string        `msgpack:"transports"`
+	Time       int64           `msgpack:"time"`
+	Key        utils.PublicKey `msgpack:"key"`
+	Sign       utils.Signature `msgpack:"sign"`
+}
+
+// CachedCapabilities is an entry of the cache of the capability records
+// of the peers, which embedders save to gate the features of the peers
+// before the records are exchanged again. Version is the protocol version
+// of the session over which the record has been received, and Local the
+// newest protocol version of this node when the entry has been saved.
+type CachedCapabilities struct {
+	Record  CapabilityRecord `msgpack:"record"`
+	Version string           `msgpack:"version"`
+	Local   string           `msgpack:"local"`
+}
+
+func newCapabilityRecord(id utils.NodeID, config utils.Config) CapabilityRecord {
+	return CapabilityRecord{
+		ID:        id,
+		Services:  config.Services,
+		Bandwidth: config.Bandwidth,
+		Protocols: protocolVersions,
+		Time:      time.Now().UnixNano(),
+	}
+}
+
+// serialize returns the signed fields. The features are only appended
+// if the record has some, so that the records of the older nodes verify.
+func (c *CapabilityRecord) serialize() []byte {
+	fields := []interface{}{
+		c.ID.Bytes(),
+		c.Services,
+		c.Bandwidth,
+		c.Protocols,
+		c.Time,
+	}
+	if len(c.Messages) > 0 || len(c.Codecs) > 0 || len(c.Transports) > 0 {
+		fields = append(fields, c.Messages, c.Codecs, c.Transports)
+	}
+	data, _ := msgpack.Marshal(fields)
+	return data
+}
+
+func (c *CapabilityRecord) sign(key *utils.PrivateKey) error {
+	c.Key = key.PublicKey
+	sign := key.Sign(c.serialize())
+	if sign == nil {
+		return errors.New("cannot sign capability record")
+	}
+	c.Sign = *sign
+	return nil
+}
+
+// Verify checks that the record is signed by the node it describes.
+func (c *CapabilityRecord) Verify() error {
+	if c.ID.Digest.Cmp(c.Key.Digest()) != 0 {
+		return errors.New("capability record signed by wrong key")
+	}
+	if !c.Key.Verify(c.serialize(), &c.Sign) {
+		return errors.New("invalid capability record signature")
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Supports reports whether the node advertises the given service.
+func (c CapabilityRecord) Supports(service string) bool {
+	return contains(c.Services, service)
+}
+
+// SupportsMessage reports whether the node handles the given message type.
+func (c CapabilityRecord) SupportsMessage(typ string) bool {
+	return contains(c.Messages, typ)
+}
+
+// SupportsCodec reports whether the node decodes the given codec.
+func (c CapabilityRecord) SupportsCodec(codec string) bool {
+	return contains(c.Codecs, codec)
+}
+
+// SupportsTransport reports whether the node accepts sessions
+// over the stream transport of the given scheme.
+func (c CapabilityRecord) SupportsTransport(scheme string) bool {
+	return contains(c.Transports, scheme)
+}
+
+// ownCapabilities returns the capability record of this node.
+func (p *Router) ownCapabilities() CapabilityRecord {
+	p.capsMutex.RLock()
+	defer p.capsMutex.RUnlock()
+	return p.caps
+}
+
+// SetFeatures sets the message types and the codecs supported by the
+// embedder, such as the client, and advertises them to the peers with the
+// stream transports of this node.
+func (p *Router) SetFeatures(messages, codecs []string) error {
+	p.capsMutex.Lock()
+	c := p.caps
+	c.Messages = append([]string(nil), messages...)
+	c.Codecs = append([]string(nil), codecs...)
+	c.Transports = p.transport.schemes()
+	c.Time = time.Now().UnixNano()
+	err := c.sign(p.key)
+	if err == nil {
+		p.caps = c
+	}
+	p.capsMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	go p.publishCapabilities()
+	p.sessionMutex.RLock()
+	for _, s := range p.sessions {
+		go p.sendCapabilities(s)
+	}
+	p.sessionMutex.RUnlock()
+	return nil
+}
+
+// capabilityRecordName is the name of the signed DHT record
+// holding the capability record of a node.
+const capabilityRecordName = "caps"
+
+// publishCapabilities stores the capability record of this node in the DHT.
+func (p *Router) publishCapabilities() {
+	data, err := msgpack.Marshal(p.ownCapabilities())
+	if err != nil {
+		return
+	}
+	p.mainDht.StoreSigned(capabilityRecordName, string(data), p.key)
+}
+
+// encodedCapabilities returns the encoded capability record of this
+// node, which is sent in the handshakes.
+func (p *Router) encodedCapabilities() []byte {
+	data, _ := msgpack.Marshal(p.ownCapabilities())
+	return data
+}
+
+// sendCapabilities sends the capability record of this node to the
+// peer of a new session which has not sent its own in the handshake.
+func (p *Router) sendCapabilities(s *session) {
+	pkt, err := p.makePacket(s.ID(), protocol.TypeCaps, p.encodedCapabilities())
+	if err != nil {
+		return
+	}
+	if s.Write(pkt) != nil {
+		p.removeSession(s)
+	}
+}
+
+func (p *Router) processCapabilities(src utils.NodeID, payload []byte) {
+	var c CapabilityRecord
+	err := msgpack.Unmarshal(payload, &c)
+	if err != nil {
+		p.reportMisbehavior(src, AbuseMalformed)
+		return
+	}
+	if !c.ID.Match(src) {
+		return
+	}
+	err = c.Verify()
+	if err != nil {
+		p.reportMisbehavior(src, AbuseInvalidSignature)
+	} else {
+		err = p.CheckTimestamp(src, time.Unix(0, c.Time))
+	}
+	if err != nil {
+		p.logger.Error("capability: %v", err)
+		return
+	}
+	var version string
+	p.sessionMutex.RLock()
+	if s, ok := p.sessions[src]; ok {
+		version = s.version
+	}
+	p.sessionMutex.RUnlock()
+	p.addCapabilities(c, version)
+}
+
+// addCapabilities caches the record of a peer, received over a session
+// of the given protocol version or from the DHT if version is empty.
+func (p *Router) addCapabilities(c CapabilityRecord, version string) {
+	p.capsMutex.Lock()
+	defer p.capsMutex.Unlock()
+	old, ok := p.peerCaps[c.ID]
+	if !ok || old.record.Time < c.Time || (version != "" && old.version != version) {
+		p.peerCaps[c.ID] = cachedCapabilities{record: c, version: version}
+	}
+}
+
+// cachedCapabilities is the record of a peer with the protocol version
+// of the session over which it has been received.
+type cachedCapabilities struct {
+	record  CapabilityRecord
+	version string
+}
+
+// checkCapabilities invalidates the cached record of the peer of a new
+// session if the protocol version of the session has changed since the
+// record has been received, or if the record does not offer it, as the
+// features of the peer may have changed with its version.
+func (p *Router) checkCapabilities(id utils.NodeID, version string) {
+	p.capsMutex.Lock()
+	defer p.capsMutex.Unlock()
+	c, ok := p.peerCaps[id]
+	if !ok || version == "" {
+		return
+	}
+	if (c.version != "" && c.version != version) || !contains(c.record.Protocols, version) {
+		delete(p.peerCaps, id)
+	}
+}
+
+// CapabilityCache returns the cached capability records of the peers.
+func (p *Router) CapabilityCache() []CachedCapabilities {
+	local := protocolVersions[len(protocolVersions)-1]
+	p.capsMutex.RLock()
+	defer p.capsMutex.RUnlock()
+	var l []CachedCapabilities
+	for _, c := range p.peerCaps {
+		l = append(l, CachedCapabilities{Record: c.record, Version: c.version, Local: local})
+	}
+	return l
+}
+
+// RestoreCapabilityCache adds saved entries to the cache of the capability
+// records. The entries saved by another protocol version of this node and
+// the records which do not verify are ignored. It returns the number of
+// entries added.
+func (p *Router) RestoreCapabilityCache(l []CachedCapabilities) int {
+	local := protocolVersions[len(protocolVersions)-1]
+	n := 0
+	for _, c := range l {
+		if c.Local != local || c.Record.Verify() != nil {
+			continue
+		}
+		p.addCapabilities(c.Record, c.Version)
+		n++
+	}
+	return n
+}
+
+// Capabilities returns the capability record of the given node.
+// The record is looked up in the DHT if it has not been exchanged directly.
+func (p *Router) Capabilities(id utils.NodeID) (CapabilityRecord, bool) {
+	if id.Match(p.id) {
+		return p.ownCapabilities(), true
+	}
+	if c, ok := p.knownCapabilities(id); ok {
+		return c, true
+	}
+
+	var c CapabilityRecord
+	str := p.mainDht.LoadSigned(id.Digest, capabilityRecordName)
+	if str == nil {
+		return c, false
+	}
+	err := msgpack.Unmarshal([]byte(*str), &c)
+	if err != nil || !c.ID.Match(id) || c.Verify() != nil ||
+		p.CheckTimestamp(id, time.Unix(0, c.Time)) != nil {
+		return CapabilityRecord{}, false
+	}
+	p.addCapabilities(c, "")
+	return c, true
+}
+
+// knownCapabilities returns the capability record of the given node
+// if it is already known, without looking it up in the DHT.
+func (p *Router) knownCapabilities(id utils.NodeID) (CapabilityRecord, bool) {
+	p.capsMutex.RLock()
+	defer p.capsMutex.RUnlock()
+	c, ok := p.peerCaps[id]
+	return c.record, ok
+}
+
+// KnownCapabilities returns the cached capability record of the given
+// node without looking it up, to gate the features of the node.
+func (p *Router) KnownCapabilities(id utils.NodeID) (CapabilityRecord, bool) {
+	return p.knownCapabilities(id)
+}
+
+// NodesWithService returns the known nodes which advertise the given
+// service, such as relays and mailboxes, ordered by their bandwidth class.
+func (p *Router) NodesWithService(service string) []utils.NodeInfo {
+	var nodes []utils.NodeInfo
+	var classes []int
+	for _, n := range p.KnownNodes() {
+		c, ok := p.knownCapabilities(n.ID)
+		if ok && c.Supports(service) && p.Trusted(n.ID) {
+			nodes = append(nodes, n)
+			classes = append(classes, c.Bandwidth)
+		}
+	}
+	sort.Stable(byBandwidth{nodes, classes})
+	return nodes
+}
+
+type byBandwidth struct {
+	nodes   []utils.NodeInfo
+	classes []int
+}
+
+func (s byBandwidth) Len() int { return len(s.nodes) }
+func (s byBandwidth) Swap(i, j int) {
+	s.nodes[i], s.nodes[j] = s.nodes[j], s.nodes[i]
+	s.classes[i], s.classes[j] = s.classes[j], s.classes[i]
+}
+func (s byBandwidth) Less(i, j int) bool { return s.classes[i] > s.classes[j] }
+
+// lowBandwidth reports whether the peer advertises a low bandwidth class.
+// Such peers only receive announcements of group messages
+// when other peers can push them.
+func (p *Router) lowBandwidth(id utils.NodeID) bool {
+	c, ok := p.knownCapabilities(id)
+	return ok && c.Bandwidth == BandwidthLow
+}
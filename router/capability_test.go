@@ -0,0 +1,84 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestCapabilityRecord(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(namespace, key.Digest())
+	config := utils.Config{Services: []string{ServiceRelay}, Bandwidth: BandwidthHigh}
+
+	c := newCapabilityRecord(id, config)
+	err := c.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+	if !c.Supports(ServiceRelay) || c.Supports(ServiceMailbox) {
+		t.Errorf("Supports() returns wrong result for %v", c.Services)
+	}
+
+	c.Services = append(c.Services, ServiceMailbox)
+	if c.Verify() == nil {
+		t.Errorf("Verify() should fail for a modified record")
+	}
+
+	other := newCapabilityRecord(utils.NewRandomNodeID(namespace), config)
+	other.sign(key)
+	if other.Verify() == nil {
+		t.Errorf("Verify() should fail for a record of another node")
+	}
+}
+
+func TestCapabilityCache(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(namespace, key.Digest())
+	c := newCapabilityRecord(id, utils.Config{})
+	c.Messages = []string{"chat"}
+	c.Codecs = []string{"deflate"}
+	if err := c.sign(key); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Verify(); err != nil {
+		t.Errorf("Verify() returns %v; expects nil", err)
+	}
+	if !c.SupportsMessage("chat") || !c.SupportsCodec("deflate") || c.SupportsTransport(UTPScheme) {
+		t.Errorf("record does not match its features")
+	}
+
+	p := &Router{peerCaps: make(map[utils.NodeID]cachedCapabilities)}
+	p.addCapabilities(c, protocolVersions[0])
+	saved := p.CapabilityCache()
+
+	p.checkCapabilities(id, protocolVersions[0])
+	if _, ok := p.KnownCapabilities(id); !ok {
+		t.Errorf("record should be kept for the same version")
+	}
+	p.checkCapabilities(id, "murcott/0")
+	if _, ok := p.KnownCapabilities(id); ok {
+		t.Errorf("record should be invalidated for another version")
+	}
+
+	if n := p.RestoreCapabilityCache(saved); n != 1 {
+		t.Errorf("RestoreCapabilityCache() returns %d; expects 1", n)
+	}
+	if r, ok := p.KnownCapabilities(id); !ok || !r.SupportsCodec("deflate") {
+		t.Errorf("KnownCapabilities() should return the restored record")
+	}
+
+	saved[0].Local = "murcott/0"
+	p = &Router{peerCaps: make(map[utils.NodeID]cachedCapabilities)}
+	if n := p.RestoreCapabilityCache(saved); n != 0 {
+		t.Errorf("entries saved by another version should be ignored")
+	}
+	saved[0].Local = protocolVersions[len(protocolVersions)-1]
+	saved[0].Record.Codecs = nil
+	if n := p.RestoreCapabilityCache(saved); n != 0 {
+		t.Errorf("entries which do not verify should be ignored")
+	}
+}
@@ -0,0 +1,74 @@
+package router
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// MaxClockSkew is the maximum difference between a timestamp, corrected
+// by the clock offset of its sender, and the local clock.
+const MaxClockSkew = 5 * time.Minute
+
+// setClockOffset records the clock offset of a peer measured
+// during the handshake.
+func (p *Router) setClockOffset(id utils.NodeID, offset time.Duration) {
+	if offset == 0 {
+		return
+	}
+	p.clockMutex.Lock()
+	defer p.clockMutex.Unlock()
+	p.offsets[id] = offset
+}
+
+// ClockOffset returns the difference between the clock of the given peer
+// and the local clock.
+func (p *Router) ClockOffset(id utils.NodeID) (time.Duration, bool) {
+	p.clockMutex.RLock()
+	defer p.clockMutex.RUnlock()
+	d, ok := p.offsets[id]
+	return d, ok
+}
+
+// NetworkOffset returns the median clock offset of the peers.
+// A large value suggests that the local clock is wrong.
+func (p *Router) NetworkOffset() time.Duration {
+	p.clockMutex.RLock()
+	var l []time.Duration
+	for _, d := range p.offsets {
+		l = append(l, d)
+	}
+	p.clockMutex.RUnlock()
+	if len(l) == 0 {
+		return 0
+	}
+	sort.Sort(byDuration(l))
+	return l[len(l)/2]
+}
+
+// PeerTime converts a timestamp of the given peer to the local clock.
+// Timestamps of unknown peers are corrected by the network offset.
+func (p *Router) PeerTime(id utils.NodeID, t time.Time) time.Time {
+	d, ok := p.ClockOffset(id)
+	if !ok {
+		d = p.NetworkOffset()
+	}
+	return t.Add(-d)
+}
+
+// CheckTimestamp returns an error if a timestamp of the given peer
+// is too far in the future.
+func (p *Router) CheckTimestamp(id utils.NodeID, t time.Time) error {
+	if p.PeerTime(id, t).Sub(time.Now()) > MaxClockSkew {
+		return errors.New("timestamp too far in the future")
+	}
+	return nil
+}
+
+type byDuration []time.Duration
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
@@ -0,0 +1,34 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestClockOffset(t *testing.T) {
+	p := Router{offsets: make(map[utils.NodeID]time.Duration)}
+	a := utils.NewRandomNodeID(namespace)
+	b := utils.NewRandomNodeID(namespace)
+	c := utils.NewRandomNodeID(namespace)
+
+	p.setClockOffset(a, time.Hour)
+	p.setClockOffset(b, time.Second)
+	p.setClockOffset(c, -time.Second)
+
+	if d := p.NetworkOffset(); d != time.Second {
+		t.Errorf("NetworkOffset() returns %v; expects %v", d, time.Second)
+	}
+
+	now := time.Now()
+	if tm := p.PeerTime(a, now.Add(time.Hour)); !tm.Equal(now) {
+		t.Errorf("PeerTime() returns %v; expects %v", tm, now)
+	}
+	if err := p.CheckTimestamp(a, now.Add(time.Hour)); err != nil {
+		t.Errorf("CheckTimestamp() returns %v; expects nil", err)
+	}
+	if err := p.CheckTimestamp(b, now.Add(time.Hour)); err == nil {
+		t.Errorf("CheckTimestamp() should fail for a future timestamp")
+	}
+}
@@ -0,0 +1,152 @@
+package router
+
+import (
+	"bytes"
+	"net"
+	"sync"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// dhtQueueSize is the number of received commands which can wait for
+// a DHT. Commands beyond it are dropped.
+const dhtQueueSize = 256
+
+// DHTStats counts the commands dispatched to the main DHT or a group DHT.
+// Net is the ID of this node for the main DHT and the group ID otherwise.
+// DHT holds the statistics of the DHT itself.
+type DHTStats struct {
+	Net      utils.NodeID
+	Received int
+	Dropped  int
+	Queued   int
+	DHT      dht.Stats
+}
+
+type inboundCommand struct {
+	cmd  protocol.RPCCommand
+	addr net.Addr
+}
+
+// dhtQueue passes the commands of a DHT to it from a dedicated goroutine,
+// so that a busy group cannot delay the others.
+type dhtQueue struct {
+	ch    chan inboundCommand
+	dht   *dht.DHT
+	stats DHTStats
+}
+
+// newDHTQueue starts the goroutine of the queue. It is restarted by the
+// supervisor if the DHT panics on a command.
+func newDHTQueue(net utils.NodeID, d *dht.DHT, sup *supervisor) *dhtQueue {
+	q := &dhtQueue{
+		ch:    make(chan inboundCommand, dhtQueueSize),
+		dht:   d,
+		stats: DHTStats{Net: net},
+	}
+	go sup.run(SubsystemDHT, func() {
+		for c := range q.ch {
+			d.ProcessCommand(c.cmd, c.addr)
+		}
+	})
+	return q
+}
+
+// dispatcher routes the received commands to the DHT of their network,
+// instead of passing every command to every DHT.
+type dispatcher struct {
+	main   *dhtQueue
+	groups map[utils.NodeID]*dhtQueue
+	sup    *supervisor
+	mutex  sync.Mutex
+}
+
+func newDispatcher(id utils.NodeID, main *dht.DHT, sup *supervisor) *dispatcher {
+	return &dispatcher{
+		main:   newDHTQueue(id, main, sup),
+		groups: make(map[utils.NodeID]*dhtQueue),
+		sup:    sup,
+	}
+}
+
+func (d *dispatcher) add(group utils.NodeID, g *dht.DHT) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if _, ok := d.groups[group]; !ok {
+		d.groups[group] = newDHTQueue(group, g, d.sup)
+	}
+}
+
+func (d *dispatcher) remove(group utils.NodeID) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if q, ok := d.groups[group]; ok {
+		close(q.ch)
+		delete(d.groups, group)
+	}
+}
+
+// close stops the goroutines of all the queues.
+func (d *dispatcher) close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.main == nil {
+		return
+	}
+	close(d.main.ch)
+	d.main = nil
+	for group, q := range d.groups {
+		close(q.ch)
+		delete(d.groups, group)
+	}
+}
+
+// dispatch queues the command for the DHT of its network. Commands of
+// groups which this node has not joined are dropped without counting.
+func (d *dispatcher) dispatch(c protocol.RPCCommand, addr net.Addr) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	q := d.main
+	if bytes.Equal(c.Net.NS[:], utils.GroupNamespace[:]) {
+		q = d.groups[c.Net]
+	}
+	if q == nil {
+		return
+	}
+	q.stats.Received++
+	select {
+	case q.ch <- inboundCommand{cmd: c, addr: addr}:
+	default:
+		q.stats.Dropped++
+	}
+}
+
+func (d *dispatcher) stats() []DHTStats {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	var list []DHTStats
+	if d.main != nil {
+		list = append(list, d.main.snapshot())
+	}
+	for _, q := range d.groups {
+		list = append(list, q.snapshot())
+	}
+	return list
+}
+
+func (q *dhtQueue) snapshot() DHTStats {
+	s := q.stats
+	s.Queued = len(q.ch)
+	if q.dht != nil {
+		s.DHT = q.dht.Stats()
+	}
+	return s
+}
+
+// DHTStats returns the counters and the statistics of the main DHT
+// followed by those of the group DHTs.
+func (p *Router) DHTStats() []DHTStats {
+	return p.dispatcher.stats()
+}
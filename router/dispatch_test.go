@@ -0,0 +1,55 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestDispatcher(t *testing.T) {
+	logger := log.NewLogger()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	other := utils.NewRandomNodeID(utils.GroupNamespace)
+	src := utils.NewRandomNodeID(utils.GlobalNamespace)
+
+	d := newDispatcher(id, dht.NewDHT(10, id, id, conn, logger), newSupervisor(make(chan int), logger))
+	defer d.close()
+	d.add(group, dht.NewDHT(10, id, group, conn, logger))
+
+	addr := conn.LocalAddr()
+	d.dispatch(protocol.RPCCommand{Src: src, Net: id}, addr)
+	d.dispatch(protocol.RPCCommand{Src: src, Net: group}, addr)
+	d.dispatch(protocol.RPCCommand{Src: src, Net: group}, addr)
+	d.dispatch(protocol.RPCCommand{Src: src, Net: other}, addr)
+
+	stats := d.stats()
+	if len(stats) != 2 {
+		t.Fatalf("stats() returns %d DHTs; expects 2", len(stats))
+	}
+	if !stats[0].Net.Match(id) || stats[0].Received != 1 {
+		t.Errorf("main DHT received %d commands; expects 1", stats[0].Received)
+	}
+	if !stats[1].Net.Match(group) || stats[1].Received != 2 {
+		t.Errorf("group DHT received %d commands; expects 2", stats[1].Received)
+	}
+	if len(stats[0].DHT.Buckets) == 0 {
+		t.Errorf("stats() should return the statistics of the DHT")
+	}
+
+	d.remove(group)
+	d.dispatch(protocol.RPCCommand{Src: src, Net: group}, addr)
+	if len(d.stats()) != 1 {
+		t.Errorf("remove() should remove the queue of the group")
+	}
+}
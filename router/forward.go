@@ -0,0 +1,130 @@
+package router
+
+import (
+	"bytes"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	defaultTTL  = 3
+	minGroupTTL = 2
+	maxGroupTTL = 8
+)
+
+// Stats contains the counters of the router.
+type Stats struct {
+	// Forwarded is the number of group packets forwarded to other members.
+	Forwarded int
+
+	// Duplicates is the number of packets dropped because they had been
+	// received before.
+	Duplicates int
+
+	// Loops is the number of packets dropped because this node
+	// was already on their path.
+	Loops int
+
+	// Filter is the occupancy of the filter of the received packets.
+	Filter utils.FilterStats
+}
+
+// groupTTL returns the TTL for a group with the given number of members.
+// Each hop reaches about twice as many members, so the TTL grows with
+// the logarithm of the group size.
+func groupTTL(members int) uint8 {
+	ttl := uint8(1)
+	for n := 1; n < members && ttl < maxGroupTTL; n *= 2 {
+		ttl++
+	}
+	if ttl < minGroupTTL {
+		ttl = minGroupTTL
+	}
+	return ttl
+}
+
+// Stats returns the counters of the router.
+func (p *Router) Stats() Stats {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	s := p.stats
+	s.Filter = p.receivedPackets.Stats()
+	return s
+}
+
+// acceptPacket reports whether a received packet is new and has not looped
+// back to this node, and counts the suppressed ones.
+func (p *Router) acceptPacket(pkt protocol.Packet) bool {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	d := pkt.Digest()
+	if !p.receivedPackets.Add(d[:]) {
+		p.stats.Duplicates++
+		return false
+	}
+	if pkt.Visited(p.id) {
+		p.stats.Loops++
+		return false
+	}
+	return true
+}
+
+// forwardPacket forwards a group packet to the other members
+// unless its TTL has expired. Observer nodes do not forward packets.
+func (p *Router) forwardPacket(pkt protocol.Packet) {
+	if p.observer != nil {
+		return
+	}
+	pkt.TTL--
+	if pkt.TTL == 0 {
+		return
+	}
+	pkt.Visit(p.id)
+	p.statsMutex.Lock()
+	p.stats.Forwarded++
+	p.statsMutex.Unlock()
+	p.send <- pkt
+}
+
+// routeSessions returns the sessions to which the packet should be written.
+// Group packets of this node are sent to the ingress members of the group.
+// Forwarded group packets are only pushed to the eager peers of the
+// broadcast tree which are not already on their path. The lazy peers,
+// and the peers with low bandwidth if there are other eager peers,
+// receive an announcement instead. found is false if there is no route
+// to the destination, or if no ingress member of an own group packet is
+// trusted, so that the packet waits in the queue instead of being lost.
+// The missing sessions are dialed if dial is true.
+func (p *Router) routeSessions(pkt protocol.Packet, dial bool) (sessions []*session, found bool) {
+	all := p.getSessions(pkt.Dst, dial)
+	if !bytes.Equal(pkt.Dst.NS[:], utils.GroupNamespace[:]) {
+		return all, len(all) > 0
+	}
+	if pkt.Src.Match(p.id) && pkt.Type == protocol.TypeMsg {
+		sessions = p.ingressSessions(pkt.Dst, all)
+		return sessions, len(sessions) > 0
+	}
+	lazy := p.lazyPeers(pkt)
+	var low []*session
+	for _, s := range all {
+		id := s.ID()
+		if pkt.Visited(id) {
+			continue
+		}
+		if lazy[id] {
+			p.sendIHave(s, pkt)
+		} else if p.lowBandwidth(id) {
+			low = append(low, s)
+		} else {
+			sessions = append(sessions, s)
+		}
+	}
+	if len(sessions) == 0 {
+		return low, len(all) > 0
+	}
+	for _, s := range low {
+		p.sendIHave(s, pkt)
+	}
+	return sessions, len(all) > 0
+}
@@ -0,0 +1,21 @@
+package router
+
+import "testing"
+
+func TestGroupTTL(t *testing.T) {
+	cases := []struct {
+		members int
+		ttl     uint8
+	}{
+		{0, minGroupTTL},
+		{2, minGroupTTL},
+		{8, 4},
+		{100, 8},
+		{100000, maxGroupTTL},
+	}
+	for _, c := range cases {
+		if ttl := groupTTL(c.members); ttl != c.ttl {
+			t.Errorf("groupTTL(%d) returns %d; expects %d", c.members, ttl, c.ttl)
+		}
+	}
+}
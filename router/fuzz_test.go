@@ -0,0 +1,57 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func FuzzHandshake(f *testing.F) {
+	key := utils.GeneratePrivateKey()
+	pub, err := msgpack.Marshal(key.PublicKey)
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, pkt := range []protocol.Packet{
+		protocol.Packet{
+			Src:     utils.NewNodeID(namespace, key.Digest()),
+			Type:    protocol.TypePubkey,
+			Payload: pub,
+			Time:    time.Now().UnixNano(),
+		},
+		protocol.Packet{
+			Dst:     utils.NewRandomNodeID(namespace),
+			Src:     utils.NewNodeID(namespace, key.Digest()),
+			Type:    protocol.TypePubkey,
+			Payload: pub,
+		},
+	} {
+		pkt.Sign(key)
+		b, err := msgpack.Marshal(pkt)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var pkt protocol.Packet
+		if msgpack.Unmarshal(data, &pkt) != nil {
+			return
+		}
+		var s session
+		err := s.setPubkey(pkt)
+		if err != nil {
+			return
+		}
+		if s.rkey == nil {
+			t.Fatalf("setPubkey() accepts a packet without a public key")
+		}
+		if !s.ID().Match(pkt.Src) {
+			t.Errorf("session ID is %v; expects %v", s.ID(), pkt.Src)
+		}
+	})
+}
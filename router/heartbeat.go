@@ -0,0 +1,87 @@
+package router
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+)
+
+// heartbeat holds the liveness of a session. The RTT is measured from
+// the pings of this node and the pongs of the peer, and is smoothed
+// like the SRTT of TCP.
+type heartbeat struct {
+	pingID   [20]byte
+	pingTime time.Time
+	rtt      time.Duration
+	lastSeen time.Time
+	hmutex   sync.Mutex
+}
+
+// ping records a ping sent to the peer.
+func (h *heartbeat) ping(id [20]byte, now time.Time) {
+	h.hmutex.Lock()
+	defer h.hmutex.Unlock()
+	h.pingID = id
+	h.pingTime = now
+}
+
+// pong updates the RTT if the pong answers the last ping.
+func (h *heartbeat) pong(id []byte, now time.Time) {
+	h.hmutex.Lock()
+	defer h.hmutex.Unlock()
+	if h.pingTime.IsZero() || !bytes.Equal(id, h.pingID[:]) {
+		return
+	}
+	rtt := now.Sub(h.pingTime)
+	if h.rtt == 0 {
+		h.rtt = rtt
+	} else {
+		h.rtt = (7*h.rtt + rtt) / 8
+	}
+	h.pingTime = time.Time{}
+}
+
+// seen records that a packet has been received from the peer.
+func (h *heartbeat) seen(now time.Time) {
+	h.hmutex.Lock()
+	defer h.hmutex.Unlock()
+	h.lastSeen = now
+}
+
+// liveness returns the RTT and the time of the last packet.
+func (h *heartbeat) liveness() (time.Duration, time.Time) {
+	h.hmutex.Lock()
+	defer h.hmutex.Unlock()
+	return h.rtt, h.lastSeen
+}
+
+// sendPong answers a ping of the peer.
+func (p *Router) sendPong(s *session, id [20]byte) {
+	pkt, err := p.makePacket(s.ID(), protocol.TypePong, id[:])
+	if err != nil {
+		return
+	}
+	if s.Write(pkt) != nil {
+		p.removeSession(s)
+	}
+}
+
+// checkSessions closes the sessions whose peers have been silent for
+// longer than sessionTimeout, which are considered half-open.
+func (p *Router) checkSessions(now time.Time) {
+	timeout := p.sessionTimeout()
+	p.sessionMutex.RLock()
+	var dead []*session
+	for _, s := range p.sessions {
+		if _, last := s.liveness(); now.Sub(last) > timeout {
+			dead = append(dead, s)
+		}
+	}
+	p.sessionMutex.RUnlock()
+	for _, s := range dead {
+		p.logger.Info("Session timeout: %s", s.ID().String())
+		p.removeSession(s)
+	}
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	var h heartbeat
+	now := time.Now()
+	id := [20]byte{1, 2, 3}
+
+	h.pong(id[:], now)
+	if rtt, _ := h.liveness(); rtt != 0 {
+		t.Errorf("pong without ping should be ignored")
+	}
+
+	h.ping(id, now)
+	h.pong([]byte{4, 5, 6}, now.Add(time.Millisecond))
+	if rtt, _ := h.liveness(); rtt != 0 {
+		t.Errorf("pong for another ping should be ignored")
+	}
+
+	h.pong(id[:], now.Add(80*time.Millisecond))
+	if rtt, _ := h.liveness(); rtt != 80*time.Millisecond {
+		t.Errorf("liveness() returns %v; expects %v", rtt, 80*time.Millisecond)
+	}
+
+	h.ping(id, now)
+	h.pong(id[:], now.Add(160*time.Millisecond))
+	if rtt, _ := h.liveness(); rtt != 90*time.Millisecond {
+		t.Errorf("liveness() returns %v; expects %v", rtt, 90*time.Millisecond)
+	}
+
+	h.seen(now)
+	if _, last := h.liveness(); !last.Equal(now) {
+		t.Errorf("liveness() returns %v; expects %v", last, now)
+	}
+}
@@ -0,0 +1,88 @@
+package router
+
+import (
+	"sync"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// routeHints caches the last address at which a session to each selected
+// node was established, so that frequent contacts are dialed directly
+// instead of being looked up in the DHT first.
+type routeHints struct {
+	addrs  map[utils.NodeID]string
+	filter func(id utils.NodeID) bool
+	mutex  sync.Mutex
+}
+
+// learn records the address of a node which has accepted a session.
+func (h *routeHints) learn(id utils.NodeID, addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.filter == nil || !h.filter(id) {
+		return
+	}
+	if h.addrs == nil {
+		h.addrs = make(map[utils.NodeID]string)
+	}
+	h.addrs[id] = addr
+}
+
+func (h *routeHints) get(id utils.NodeID) (string, bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	addr, ok := h.addrs[id]
+	return addr, ok
+}
+
+// forget removes the address of a node unless it has changed meanwhile.
+func (h *routeHints) forget(id utils.NodeID, addr string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.addrs[id] == addr {
+		delete(h.addrs, id)
+	}
+}
+
+// SetRouteHintFilter sets a function which selects the nodes whose last
+// known good address is cached, such as the contacts of the user. The
+// cached address is dialed before the node is looked up.
+func (p *Router) SetRouteHintFilter(f func(id utils.NodeID) bool) {
+	p.hints.mutex.Lock()
+	defer p.hints.mutex.Unlock()
+	p.hints.filter = f
+	for id := range p.hints.addrs {
+		if f == nil || !f(id) {
+			delete(p.hints.addrs, id)
+		}
+	}
+}
+
+// AddRouteHint caches an address of the node learned by other means, such
+// as an introduction. It is ignored if the node is not selected by the
+// filter set with SetRouteHintFilter.
+func (p *Router) AddRouteHint(id utils.NodeID, addr string) {
+	p.hints.learn(id, unmarkLAN(addr))
+}
+
+// RouteHint returns the cached address of the node.
+func (p *Router) RouteHint(id utils.NodeID) (string, bool) {
+	return p.hints.get(id)
+}
+
+// dialHint opens a session to the cached address of the node. A failed
+// dial forgets the address without delaying the dials to the addresses
+// found in the DHT.
+func (p *Router) dialHint(id utils.NodeID) *session {
+	address, ok := p.hints.get(id)
+	if !ok {
+		return nil
+	}
+	s := p.connect(id, address)
+	if s == nil {
+		p.hints.forget(id, address)
+		return nil
+	}
+	p.dialSucceeded(id)
+	return s
+}
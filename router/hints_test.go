@@ -0,0 +1,44 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRouteHints(t *testing.T) {
+	contact := utils.NewRandomNodeID(namespace)
+	other := utils.NewRandomNodeID(namespace)
+	p := &Router{}
+
+	p.hints.learn(contact, "127.0.0.1:9200")
+	if _, ok := p.RouteHint(contact); ok {
+		t.Errorf("RouteHint() returns true without a filter; expects false")
+	}
+
+	p.SetRouteHintFilter(func(id utils.NodeID) bool { return id.Match(contact) })
+	p.hints.learn(contact, "127.0.0.1:9200")
+	p.hints.learn(other, "127.0.0.1:9201")
+	if addr, ok := p.RouteHint(contact); !ok || addr != "127.0.0.1:9200" {
+		t.Errorf("RouteHint() returns %q, %v; expects 127.0.0.1:9200", addr, ok)
+	}
+	if _, ok := p.RouteHint(other); ok {
+		t.Errorf("RouteHint() returns true for a node rejected by the filter")
+	}
+
+	p.hints.learn(contact, "127.0.0.1:9202")
+	p.hints.forget(contact, "127.0.0.1:9200")
+	if addr, _ := p.RouteHint(contact); addr != "127.0.0.1:9202" {
+		t.Errorf("forget() removes an address which has changed")
+	}
+	p.hints.forget(contact, "127.0.0.1:9202")
+	if _, ok := p.RouteHint(contact); ok {
+		t.Errorf("RouteHint() returns true after forget()")
+	}
+
+	p.hints.learn(contact, "127.0.0.1:9200")
+	p.SetRouteHintFilter(nil)
+	if _, ok := p.RouteHint(contact); ok {
+		t.Errorf("SetRouteHintFilter() should drop the addresses of the nodes it rejects")
+	}
+}
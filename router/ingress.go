@@ -0,0 +1,73 @@
+package router
+
+import (
+	"sort"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// ingressCount is the number of members of a group to which this node
+// sends its own group messages.
+const ingressCount = 3
+
+// electIngress returns n ingress members. The current members are kept as
+// long as they are candidates and acceptable, and the others are replaced
+// by the acceptable candidates nearest to self. Since the ranking only
+// depends on the IDs, the same members are elected again after a restart.
+func electIngress(self utils.NodeID, current, candidates []utils.NodeID, acceptable func(utils.NodeID) bool, n int) []utils.NodeID {
+	available := make(map[utils.NodeID]bool)
+	for _, id := range candidates {
+		available[id] = true
+	}
+
+	var elected []utils.NodeID
+	chosen := make(map[utils.NodeID]bool)
+	for _, id := range current {
+		if len(elected) < n && available[id] && acceptable(id) {
+			elected = append(elected, id)
+			chosen[id] = true
+		}
+	}
+	if len(elected) == n {
+		return elected
+	}
+
+	var nodes []utils.NodeInfo
+	for _, id := range candidates {
+		if !chosen[id] && acceptable(id) {
+			nodes = append(nodes, utils.NodeInfo{ID: id})
+		}
+	}
+	sort.Sort(utils.NodeInfoSorter{Nodes: nodes, ID: self})
+	for _, node := range nodes {
+		if len(elected) == n {
+			break
+		}
+		elected = append(elected, node.ID)
+	}
+	return elected
+}
+
+// ingressSessions returns the sessions of the ingress members of the group
+// among the given sessions. A member is re-elected when its session fails
+// or it becomes distrusted.
+func (p *Router) ingressSessions(group utils.NodeID, all []*session) []*session {
+	byID := make(map[utils.NodeID]*session)
+	var candidates []utils.NodeID
+	for _, s := range all {
+		id := s.ID()
+		byID[id] = s
+		candidates = append(candidates, id)
+	}
+
+	p.ingressMutex.Lock()
+	elected := electIngress(p.id, p.ingress[group], candidates, p.Trusted, ingressCount)
+	p.ingress[group] = elected
+	p.ingressMutex.Unlock()
+
+	var sessions []*session
+	for _, id := range elected {
+		sessions = append(sessions, byID[id])
+	}
+	return sessions
+}
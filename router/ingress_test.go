@@ -0,0 +1,83 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestElectIngress(t *testing.T) {
+	self := utils.NewRandomNodeID(namespace)
+	var candidates []utils.NodeID
+	for i := 0; i < 8; i++ {
+		candidates = append(candidates, utils.NewRandomNodeID(namespace))
+	}
+	all := func(utils.NodeID) bool { return true }
+
+	elected := electIngress(self, nil, candidates, all, 3)
+	if len(elected) != 3 {
+		t.Fatalf("electIngress() returns %d members; expects 3", len(elected))
+	}
+	again := electIngress(self, nil, candidates, all, 3)
+	for i := range elected {
+		if !elected[i].Match(again[i]) {
+			t.Errorf("electIngress() should be deterministic")
+		}
+	}
+
+	// The current members are kept even if nearer candidates appear.
+	current := []utils.NodeID{candidates[7], candidates[6], candidates[5]}
+	kept := electIngress(self, current, candidates, all, 3)
+	for i := range current {
+		if !kept[i].Match(current[i]) {
+			t.Errorf("electIngress() should keep the current members")
+		}
+	}
+
+	// A failed member is replaced.
+	failed := current[0]
+	var rest []utils.NodeID
+	for _, id := range candidates {
+		if !id.Match(failed) {
+			rest = append(rest, id)
+		}
+	}
+	reelected := electIngress(self, current, rest, all, 3)
+	if len(reelected) != 3 {
+		t.Fatalf("electIngress() returns %d members; expects 3", len(reelected))
+	}
+	for _, id := range reelected {
+		if id.Match(failed) {
+			t.Errorf("electIngress() should replace the failed member")
+		}
+	}
+
+	// Distrusted members are not elected.
+	none := electIngress(self, current, candidates, func(utils.NodeID) bool { return false }, 3)
+	if len(none) != 0 {
+		t.Errorf("electIngress() returns %v; expects no members", none)
+	}
+}
+
+func TestIngressSessionsDistrusted(t *testing.T) {
+	router, err := NewRouter(utils.GeneratePrivateKey(), log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router.Close()
+
+	key := utils.GeneratePrivateKey()
+	s := &session{rkey: &key.PublicKey}
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	if l := router.ingressSessions(group, []*session{s}); len(l) != 1 {
+		t.Errorf("ingressSessions() returns %d sessions; expects 1", len(l))
+	}
+	for router.Trusted(s.ID()) {
+		router.reputation.penalize(s.ID(), abusePenalties[AbuseFlood], time.Now())
+	}
+	if l := router.ingressSessions(group, []*session{s}); len(l) != 0 {
+		t.Errorf("ingressSessions() returns %d sessions; expects none for distrusted members", len(l))
+	}
+}
@@ -0,0 +1,60 @@
+package router
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	defaultKeepalivePeers = 3
+
+	// defaultKeepaliveInterval is shorter than the UDP mapping timeout
+	// of most NATs, which is 30 seconds or more.
+	defaultKeepaliveInterval = 25 * time.Second
+)
+
+// keepaliveState holds the settings of the keepalives and the time at
+// which they were last sent. It is only used by the run loop.
+type keepaliveState struct {
+	peers    int
+	interval time.Duration
+	last     time.Time
+}
+
+func newKeepaliveState(config utils.Config) keepaliveState {
+	k := keepaliveState{peers: config.KeepalivePeers, interval: config.KeepaliveInterval}
+	if k.peers == 0 {
+		k.peers = defaultKeepalivePeers
+	}
+	if k.interval <= 0 {
+		k.interval = defaultKeepaliveInterval
+	}
+	return k
+}
+
+// due reports whether the keepalives should be sent now,
+// and records the time if so.
+func (k *keepaliveState) due(now time.Time) bool {
+	if k.peers < 0 || now.Sub(k.last) < k.interval {
+		return false
+	}
+	k.last = now
+	return true
+}
+
+// sendKeepalives pings a few DHT peers spread over the routing table, so
+// that the NAT mapping of the socket survives while the node is idle.
+// The peers with an open session are skipped, as the session pings them.
+// No session is dialed, so that only the cheap DHT ping is sent.
+func (p *Router) sendKeepalives() {
+	for _, n := range p.mainDht.Representatives(p.keepalive.peers) {
+		p.sessionMutex.RLock()
+		_, ok := p.sessions[n.ID]
+		p.sessionMutex.RUnlock()
+		if ok {
+			continue
+		}
+		p.mainDht.SendPing(n.ID)
+	}
+}
@@ -0,0 +1,70 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestKeepaliveDue(t *testing.T) {
+	k := newKeepaliveState(utils.Config{})
+	if k.peers != defaultKeepalivePeers || k.interval != defaultKeepaliveInterval {
+		t.Errorf("newKeepaliveState() returns %+v; expects the defaults", k)
+	}
+
+	now := time.Now()
+	if !k.due(now) {
+		t.Errorf("due() returns false; expects true")
+	}
+	if k.due(now.Add(k.interval / 2)) {
+		t.Errorf("due() returns true before the interval")
+	}
+	if !k.due(now.Add(k.interval)) {
+		t.Errorf("due() returns false after the interval")
+	}
+
+	k = newKeepaliveState(utils.Config{KeepalivePeers: -1})
+	if k.due(now) {
+		t.Errorf("due() should return false when the keepalives are disabled")
+	}
+}
+
+func TestSendKeepalives(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	router1, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router2, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+
+	// The peer could be dialed over the memory transport,
+	// but the keepalive must not open a session to it.
+	n := NewMemoryNetwork(1)
+	if err := router1.RegisterTransport(n.Transport("node")); err != nil {
+		t.Fatal(err)
+	}
+	router1.hints.filter = func(utils.NodeID) bool { return true }
+	router1.hints.learn(router2.ID(), JoinTransportAddr(MemoryScheme, "node"))
+	router1.mainDht.AddNode(utils.NodeInfo{ID: router2.ID(), Addr: tr.Addr()})
+	if len(router1.mainDht.Representatives(router1.keepalive.peers)) == 0 {
+		t.Fatalf("Representatives() returns no peer")
+	}
+	router1.sendKeepalives()
+	time.Sleep(100 * time.Millisecond)
+	if n := len(router1.Sessions()); n != 0 {
+		t.Errorf("sendKeepalives() opens %d sessions; expects none", n)
+	}
+}
@@ -0,0 +1,195 @@
+package router
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// Default resource limits.
+const (
+	defaultMaxSessions   = 256
+	defaultMaxGoroutines = 1024
+
+	// maxQueuedPackets is the maximum number of packets waiting for a route.
+	maxQueuedPackets = 1024
+
+	// maxHandshakes is the maximum number of concurrent handshakes
+	// of a transport.
+	maxHandshakes = 64
+)
+
+// Usage reports the resources used by the router and their limits.
+// PendingRPCs is the total of all DHTs and MaxPendingRPCs is the limit
+// of each DHT.
+type Usage struct {
+	Sessions       int
+	MaxSessions    int
+	Goroutines     int
+	MaxGoroutines  int
+	PendingRPCs    int
+	MaxPendingRPCs int
+	QueuedPackets  int
+
+	// RejectedSessions is the number of sessions rejected because the
+	// limit was reached, and DroppedPackets is the number of received
+	// and queued packets dropped to shed load.
+	RejectedSessions int
+	DroppedPackets   int
+}
+
+// governor enforces the resource limits of a router.
+type governor struct {
+	maxSessions    int
+	maxPendingRPCs int
+	workers        chan struct{}
+
+	queued   int
+	rejected int
+	dropped  int
+	mutex    sync.Mutex
+}
+
+func newGovernor(config utils.Config) *governor {
+	g := &governor{
+		maxSessions:    config.MaxSessions,
+		maxPendingRPCs: config.MaxPendingRPCs,
+	}
+	if g.maxSessions <= 0 {
+		g.maxSessions = defaultMaxSessions
+	}
+	if g.maxPendingRPCs <= 0 {
+		g.maxPendingRPCs = dht.DefaultMaxPendingRPCs
+	}
+	n := config.MaxGoroutines
+	if n <= 0 {
+		n = defaultMaxGoroutines
+	}
+	g.workers = make(chan struct{}, n)
+	return g
+}
+
+// spawn runs f in a new goroutine. f is dropped if the limit
+// of goroutines has been reached.
+func (g *governor) spawn(f func()) bool {
+	select {
+	case g.workers <- struct{}{}:
+		go func() {
+			defer func() { <-g.workers }()
+			f()
+		}()
+		return true
+	default:
+		g.drop()
+		return false
+	}
+}
+
+func (g *governor) reject() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.rejected++
+}
+
+func (g *governor) drop() {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.dropped++
+}
+
+func (g *governor) setQueued(n int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.queued = n
+}
+
+// admit reports whether a new session can be accepted,
+// and counts the rejected ones.
+func (p *Router) admit() bool {
+	p.sessionMutex.RLock()
+	n := len(p.sessions)
+	p.sessionMutex.RUnlock()
+	if n >= p.governor.maxSessions {
+		p.governor.reject()
+		return false
+	}
+	return true
+}
+
+// packetPriority returns the priority of a queued packet. Group packets
+// forwarded for other members are dropped first, then the group packets
+// of this node and finally the direct packets.
+func (p *Router) packetPriority(pkt protocol.Packet) int {
+	if !bytes.Equal(pkt.Dst.NS[:], utils.GroupNamespace[:]) {
+		return 2
+	}
+	if pkt.Src.Match(p.id) {
+		return 1
+	}
+	return 0
+}
+
+// queuePacket queues a packet until a route is found. When the queue is
+// full, the oldest packet with the lowest priority is dropped, or the
+// packet itself if its priority is lower than that of all queued packets.
+func (p *Router) queuePacket(pkt protocol.Packet) {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	if p.retry.Resend.Exhausted(1) {
+		p.governor.drop()
+		return
+	}
+	if len(p.queuedPackets) >= maxQueuedPackets {
+		low := 0
+		for i, q := range p.queuedPackets {
+			if p.packetPriority(q.pkt) < p.packetPriority(p.queuedPackets[low].pkt) {
+				low = i
+			}
+		}
+		p.governor.drop()
+		if p.packetPriority(pkt) < p.packetPriority(p.queuedPackets[low].pkt) {
+			return
+		}
+		p.queuedPackets = append(p.queuedPackets[:low], p.queuedPackets[low+1:]...)
+	}
+	now := time.Now()
+	p.queuedPackets = append(p.queuedPackets, &queuedPacket{
+		pkt:    pkt,
+		queued: now,
+		next:   now.Add(p.retry.Resend.Delay(1)),
+	})
+	p.governor.setQueued(len(p.queuedPackets))
+}
+
+// Usage returns the resources used by the router and their limits.
+func (p *Router) Usage() Usage {
+	p.sessionMutex.RLock()
+	sessions := len(p.sessions)
+	p.sessionMutex.RUnlock()
+
+	p.dhtMutex.RLock()
+	pending := p.mainDht.PendingRPCs()
+	for _, d := range p.groupDht {
+		pending += d.PendingRPCs()
+	}
+	p.dhtMutex.RUnlock()
+
+	g := p.governor
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return Usage{
+		Sessions:         sessions,
+		MaxSessions:      g.maxSessions,
+		Goroutines:       len(g.workers),
+		MaxGoroutines:    cap(g.workers),
+		PendingRPCs:      pending,
+		MaxPendingRPCs:   g.maxPendingRPCs,
+		QueuedPackets:    g.queued,
+		RejectedSessions: g.rejected,
+		DroppedPackets:   g.dropped,
+	}
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestGovernorSpawn(t *testing.T) {
+	g := newGovernor(utils.Config{MaxGoroutines: 1})
+	block := make(chan int)
+	done := make(chan int)
+	if !g.spawn(func() { <-block; close(done) }) {
+		t.Fatalf("spawn() returns false; expects true")
+	}
+	if g.spawn(func() {}) {
+		t.Errorf("spawn() returns true beyond the limit; expects false")
+	}
+	if g.dropped != 1 {
+		t.Errorf("dropped is %d; expects 1", g.dropped)
+	}
+	close(block)
+	<-done
+}
+
+func TestQueuePacket(t *testing.T) {
+	id := utils.NewRandomNodeID(namespace)
+	p := &Router{id: id, governor: newGovernor(utils.Config{})}
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	other := utils.NewRandomNodeID(namespace)
+
+	forwarded := protocol.Packet{Dst: group, Src: other}
+	own := protocol.Packet{Dst: group, Src: id}
+	direct := protocol.Packet{Dst: other, Src: id}
+
+	p.queuePacket(forwarded)
+	for i := 1; i < maxQueuedPackets; i++ {
+		p.queuePacket(own)
+	}
+	p.queuePacket(direct)
+	if len(p.queuedPackets) != maxQueuedPackets {
+		t.Fatalf("queue has %d packets; expects %d", len(p.queuedPackets), maxQueuedPackets)
+	}
+	for _, q := range p.queuedPackets {
+		if q.pkt.Src.Match(other) {
+			t.Errorf("forwarded packet should be dropped first")
+		}
+	}
+	if last := p.queuedPackets[len(p.queuedPackets)-1]; !last.pkt.Dst.Match(other) {
+		t.Errorf("direct packet should be queued")
+	}
+
+	p.queuePacket(forwarded)
+	for _, q := range p.queuedPackets {
+		if q.pkt.Src.Match(other) {
+			t.Errorf("forwarded packet should not replace packets with a higher priority")
+		}
+	}
+	if p.governor.dropped != 2 {
+		t.Errorf("dropped is %d; expects 2", p.governor.dropped)
+	}
+}
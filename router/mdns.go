@@ -0,0 +1,269 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// mdnsService is the DNS-SD service type of the nodes.
+	mdnsService = "_murcott._udp.local."
+
+	// mdnsInterval is the interval at which the nodes of the LAN
+	// are queried in mesh mode.
+	mdnsInterval = 30 * time.Second
+
+	mdnsTTL = 120
+
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsClassIN = 1
+
+	// dnsCacheFlush is set in the class of the records
+	// which are unique to the responder.
+	dnsCacheFlush = 0x8000
+
+	dnsFlagResponse = 0x8400
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+var errDNSMessage = errors.New("malformed DNS message")
+
+// mdnsAnnouncement is the service instance of a node found on the LAN.
+type mdnsAnnouncement struct {
+	ID   utils.NodeID
+	Port int
+}
+
+func appendDNSName(b []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func appendDNSRecord(b []byte, name string, typ, class uint16, rdata []byte) []byte {
+	b = appendDNSName(b, name)
+	var h [10]byte
+	binary.BigEndian.PutUint16(h[0:], typ)
+	binary.BigEndian.PutUint16(h[2:], class)
+	binary.BigEndian.PutUint32(h[4:], mdnsTTL)
+	binary.BigEndian.PutUint16(h[8:], uint16(len(rdata)))
+	b = append(b, h[:]...)
+	return append(b, rdata...)
+}
+
+func dnsHeader(flags, questions, answers uint16) []byte {
+	var h [12]byte
+	binary.BigEndian.PutUint16(h[2:], flags)
+	binary.BigEndian.PutUint16(h[4:], questions)
+	binary.BigEndian.PutUint16(h[6:], answers)
+	return h[:]
+}
+
+// mdnsQuery returns a query for the instances of the service.
+func mdnsQuery() []byte {
+	b := appendDNSName(dnsHeader(0, 1, 0), mdnsService)
+	var q [4]byte
+	binary.BigEndian.PutUint16(q[0:], dnsTypePTR)
+	binary.BigEndian.PutUint16(q[2:], dnsClassIN)
+	return append(b, q[:]...)
+}
+
+// mdnsResponse returns the announcement of the instance of a node,
+// a PTR record of the service and a TXT record holding its ID and port.
+func mdnsResponse(a mdnsAnnouncement) []byte {
+	instance := a.ID.Digest.String() + "." + mdnsService
+	var txt []byte
+	for _, s := range []string{"id=" + a.ID.String(), "port=" + strconv.Itoa(a.Port)} {
+		txt = append(txt, byte(len(s)))
+		txt = append(txt, s...)
+	}
+	b := dnsHeader(dnsFlagResponse, 0, 2)
+	b = appendDNSRecord(b, mdnsService, dnsTypePTR, dnsClassIN, appendDNSName(nil, instance))
+	return appendDNSRecord(b, instance, dnsTypeTXT, dnsClassIN|dnsCacheFlush, txt)
+}
+
+// readDNSName reads the name at off, following the compression pointers.
+// It returns the name and the offset following it.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(b) {
+			return "", 0, errDNSMessage
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) || jumps > 16 {
+				return "", 0, errDNSMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errDNSMessage
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+}
+
+// parseMDNS reads a message of the LAN. It reports whether the message
+// is a query for the service, and returns the instances it announces.
+func parseMDNS(b []byte) (query bool, list []mdnsAnnouncement, err error) {
+	if len(b) < 12 {
+		return false, nil, errDNSMessage
+	}
+	flags := binary.BigEndian.Uint16(b[2:])
+	questions := int(binary.BigEndian.Uint16(b[4:]))
+	records := int(binary.BigEndian.Uint16(b[6:])) + int(binary.BigEndian.Uint16(b[8:])) + int(binary.BigEndian.Uint16(b[10:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, err := readDNSName(b, off)
+		if err != nil || next+4 > len(b) {
+			return false, nil, errDNSMessage
+		}
+		if flags&0x8000 == 0 && strings.EqualFold(name, mdnsService) && binary.BigEndian.Uint16(b[next:]) == dnsTypePTR {
+			query = true
+		}
+		off = next + 4
+	}
+
+	for i := 0; i < records; i++ {
+		name, next, err := readDNSName(b, off)
+		if err != nil || next+10 > len(b) {
+			return query, list, errDNSMessage
+		}
+		typ := binary.BigEndian.Uint16(b[next:])
+		size := int(binary.BigEndian.Uint16(b[next+8:]))
+		rdata := next + 10
+		if rdata+size > len(b) {
+			return query, list, errDNSMessage
+		}
+		off = rdata + size
+		if typ != dnsTypeTXT || !strings.HasSuffix(strings.ToLower(name), "."+mdnsService) {
+			continue
+		}
+		if a, ok := parseMDNSText(b[rdata:off]); ok {
+			list = append(list, a)
+		}
+	}
+	return query, list, nil
+}
+
+func parseMDNSText(b []byte) (mdnsAnnouncement, bool) {
+	var a mdnsAnnouncement
+	var hasID bool
+	for len(b) > 0 {
+		n := int(b[0])
+		if 1+n > len(b) {
+			return a, false
+		}
+		kv := strings.SplitN(string(b[1:1+n]), "=", 2)
+		b = b[1+n:]
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "id":
+			id, err := utils.NewNodeIDFromString(kv[1])
+			if err != nil {
+				return a, false
+			}
+			a.ID = id
+			hasID = true
+		case "port":
+			port, err := strconv.Atoi(kv[1])
+			if err != nil || port <= 0 || port > 65535 {
+				return a, false
+			}
+			a.Port = port
+		}
+	}
+	return a, hasID && a.Port != 0
+}
+
+// runMDNS announces this node on the LAN with multicast DNS and discovers
+// the nodes which announce themselves, until the router is closed.
+func (p *Router) runMDNS() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		p.logger.Error("mDNS: %v", err)
+		return
+	}
+	go func() {
+		<-p.exit
+		conn.Close()
+	}()
+
+	port := 0
+	if addr, ok := p.transport.Addr().(*net.UDPAddr); ok {
+		port = addr.Port
+	} else if _, s, err := net.SplitHostPort(p.transport.Addr().String()); err == nil {
+		port, _ = strconv.Atoi(s)
+	}
+	self := mdnsResponse(mdnsAnnouncement{ID: p.id, Port: port})
+
+	go func() {
+		tick := time.NewTicker(mdnsInterval)
+		defer tick.Stop()
+		for {
+			conn.WriteTo(self, mdnsGroup)
+			conn.WriteTo(mdnsQuery(), mdnsGroup)
+			select {
+			case <-p.exit:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+
+	// Nodes are discovered again when their address changes.
+	found := make(map[utils.NodeID]string)
+	var b [9000]byte
+	for {
+		n, addr, err := conn.ReadFrom(b[:])
+		if err != nil {
+			return
+		}
+		query, list, _ := parseMDNS(b[:n])
+		if query {
+			conn.WriteTo(self, mdnsGroup)
+		}
+		src, ok := addr.(*net.UDPAddr)
+		if !ok || !isLocalIP(src.IP) {
+			continue
+		}
+		for _, a := range list {
+			if a.ID.Match(p.id) {
+				continue
+			}
+			node := net.UDPAddr{IP: src.IP, Port: a.Port}
+			if found[a.ID] == node.String() {
+				continue
+			}
+			found[a.ID] = node.String()
+			p.logger.Info("mDNS: found %s at %v", a.ID.String(), node.String())
+			p.Discover([]net.UDPAddr{node})
+		}
+	}
+}
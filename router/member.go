@@ -0,0 +1,261 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// MemberRecord announces that a node is a member of a group at the given
+// addresses. It is signed by the member, and can be countersigned by the
+// key of the group, whose digest is the digest of the group ID.
+// The countersignature only covers the group, the member and the expiry,
+// so that the member can update its addresses without the group key, and
+// the group can revoke a member by not renewing its countersignature.
+type MemberRecord struct {
+	Group     utils.NodeID    `msgpack:"group"`
+	ID        utils.NodeID    `msgpack:"id"`
+	Addrs     []string        `msgpack:"addrs"`
+	Time      int64           `msgpack:"time"`
+	Key       utils.PublicKey `msgpack:"key"`
+	Sign      utils.Signature `msgpack:"sign"`
+	GroupKey  utils.PublicKey `msgpack:"gkey"`
+	GroupSign utils.Signature `msgpack:"gsign"`
+	Expiry    int64           `msgpack:"expiry,omitempty"`
+}
+
+func (r *MemberRecord) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		r.Group.Bytes(),
+		r.ID.Bytes(),
+		r.Addrs,
+		r.Time,
+	})
+	return data
+}
+
+func (r *MemberRecord) serializeMembership() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		r.Group.Bytes(),
+		r.ID.Bytes(),
+		r.Expiry,
+	})
+	return data
+}
+
+func (r *MemberRecord) sign(key *utils.PrivateKey) error {
+	r.Key = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign member record")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Countersign signs the membership with the key of the group
+// until the given expiry.
+func (r *MemberRecord) Countersign(key *utils.PrivateKey, expiry time.Time) error {
+	if r.Group.Digest.Cmp(key.Digest()) != 0 {
+		return errors.New("key of another group")
+	}
+	r.Expiry = expiry.UnixNano()
+	r.GroupKey = key.PublicKey
+	sign := key.Sign(r.serializeMembership())
+	if sign == nil {
+		return errors.New("cannot countersign member record")
+	}
+	r.GroupSign = *sign
+	return nil
+}
+
+// Verify checks that the record is signed by the member it describes,
+// and also countersigned by the group if countersigned is true, in which
+// case the countersignature must not have expired.
+func (r *MemberRecord) Verify(countersigned bool) error {
+	if r.ID.Digest.Cmp(r.Key.Digest()) != 0 {
+		return errors.New("member record signed by wrong key")
+	}
+	if !r.Key.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid member record signature")
+	}
+	if !countersigned {
+		return nil
+	}
+	if r.GroupKey.IsZero() {
+		return errors.New("member record is not countersigned")
+	}
+	if r.Group.Digest.Cmp(r.GroupKey.Digest()) != 0 {
+		return errors.New("member record countersigned by wrong key")
+	}
+	if !r.GroupKey.Verify(r.serializeMembership(), &r.GroupSign) {
+		return errors.New("invalid member record countersignature")
+	}
+	if r.expired() {
+		return errors.New("member record countersignature expired")
+	}
+	return nil
+}
+
+func (r *MemberRecord) expired() bool {
+	return time.Now().UnixNano() > r.Expiry
+}
+
+func memberKey(group utils.NodeID) string {
+	return "members:" + group.String()
+}
+
+// RequireCountersign makes this node only accept the members of the given
+// group whose records are countersigned by the group key.
+func (p *Router) RequireCountersign(group utils.NodeID) {
+	p.memberMutex.Lock()
+	defer p.memberMutex.Unlock()
+	p.countersigned[group] = true
+}
+
+// SetMemberRecord sets the record of this node for a group, such as
+// a record countersigned by the owner of the group. The addresses and
+// the time are updated and signed again when it is published.
+func (p *Router) SetMemberRecord(r MemberRecord) error {
+	if !r.ID.Match(p.id) {
+		return errors.New("member record of another node")
+	}
+	p.memberMutex.Lock()
+	defer p.memberMutex.Unlock()
+	p.ownMembers[r.Group] = r
+	return nil
+}
+
+// ownMemberRecord returns the signed record of this node for the group.
+func (p *Router) ownMemberRecord(group utils.NodeID) (MemberRecord, error) {
+	p.memberMutex.RLock()
+	r, ok := p.ownMembers[group]
+	p.memberMutex.RUnlock()
+	if !ok {
+		r = MemberRecord{Group: group, ID: p.id}
+	}
+	r.Addrs = append(p.PublishedAddrs(), p.transport.Addr().String())
+	r.Time = time.Now().UnixNano()
+	err := r.sign(p.key)
+	return r, err
+}
+
+// addMemberRecord stores a verified record of a member and reports
+// whether it has been accepted.
+func (p *Router) addMemberRecord(r MemberRecord) bool {
+	p.memberMutex.Lock()
+	defer p.memberMutex.Unlock()
+	if r.Verify(p.countersigned[r.Group]) != nil {
+		return false
+	}
+	m := p.members[r.Group]
+	if m == nil {
+		m = make(map[utils.NodeID]MemberRecord)
+		p.members[r.Group] = m
+	}
+	if old, ok := m[r.ID]; !ok || old.Time < r.Time {
+		m[r.ID] = r
+	}
+	return true
+}
+
+// isMember reports whether a verified record of the node is known for
+// the group, and has not expired if the group requires countersigning.
+func (p *Router) isMember(group, id utils.NodeID) bool {
+	p.memberMutex.RLock()
+	defer p.memberMutex.RUnlock()
+	r, ok := p.members[group][id]
+	if ok && p.countersigned[group] {
+		return !r.expired()
+	}
+	return ok
+}
+
+// memberFilter returns the node filter of the DHT of the group, which
+// only accepts the trusted nodes with a verified member record, so that
+// outsiders cannot enter the routing state of the group.
+func (p *Router) memberFilter(group utils.NodeID) func(utils.NodeID) bool {
+	return func(id utils.NodeID) bool {
+		return p.Trusted(id) && p.isMember(group, id)
+	}
+}
+
+// memberRecords returns the known member records of the group
+// including the record of this node.
+func (p *Router) memberRecords(group utils.NodeID) []MemberRecord {
+	var records []MemberRecord
+	if r, err := p.ownMemberRecord(group); err == nil {
+		records = append(records, r)
+	}
+	p.memberMutex.RLock()
+	defer p.memberMutex.RUnlock()
+	for id, r := range p.members[group] {
+		if !id.Match(p.id) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// publishMembership stores the record of this node for the group in
+// the DHT. The unsigned member list is still stored for older nodes,
+// but it is not used to discover the members.
+func (p *Router) publishMembership(group utils.NodeID) {
+	r, err := p.ownMemberRecord(group)
+	if err != nil {
+		return
+	}
+	data, err := msgpack.Marshal(r)
+	if err != nil {
+		return
+	}
+	p.mainDht.StoreSet(memberKey(group), []string{string(data)})
+	p.mainDht.StoreNodes(group.String(), []utils.NodeInfo{
+		utils.NodeInfo{ID: p.id, Addr: p.transport.Addr()},
+	})
+}
+
+// publishMemberships publishes the records of this node
+// for all joined groups.
+func (p *Router) publishMemberships() {
+	p.dhtMutex.RLock()
+	var groups []utils.NodeID
+	for g := range p.groupDht {
+		groups = append(groups, g)
+	}
+	p.dhtMutex.RUnlock()
+	for _, g := range groups {
+		p.publishMembership(g)
+	}
+}
+
+// loadMembers loads the member records of the group from the DHT and
+// returns the accepted ones.
+func (p *Router) loadMembers(group utils.NodeID) []MemberRecord {
+	var records []MemberRecord
+	for _, str := range p.mainDht.LoadSet(memberKey(group)) {
+		var r MemberRecord
+		err := msgpack.Unmarshal([]byte(str), &r)
+		if err != nil || !r.Group.Match(group) || r.ID.Match(p.id) {
+			continue
+		}
+		if p.addMemberRecord(r) {
+			records = append(records, r)
+		}
+	}
+	return records
+}
+
+// discoverMember sends discovery packets to the addresses of a member.
+func discoverMember(d *dht.DHT, r MemberRecord) {
+	for _, a := range dialAddrs(r.Addrs) {
+		addr, err := net.ResolveUDPAddr("udp", a)
+		if err == nil {
+			d.Discover(addr)
+		}
+	}
+}
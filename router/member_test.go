@@ -0,0 +1,130 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestMemberRecord(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	gkey := utils.GeneratePrivateKey()
+	group := utils.NewNodeID(utils.GroupNamespace, gkey.Digest())
+
+	r := MemberRecord{
+		Group: group,
+		ID:    utils.NewNodeID(namespace, key.Digest()),
+		Addrs: []string{"192.0.2.1:9200"},
+	}
+	err := r.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(false); err != nil {
+		t.Errorf("Verify(false) returns %v; expects nil", err)
+	}
+	if r.Verify(true) == nil {
+		t.Errorf("Verify(true) should fail for a record which is not countersigned")
+	}
+
+	if r.Countersign(key, time.Now().Add(time.Hour)) == nil {
+		t.Errorf("Countersign() should fail with the key of another group")
+	}
+	err = r.Countersign(gkey, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Verify(true); err != nil {
+		t.Errorf("Verify(true) returns %v; expects nil", err)
+	}
+
+	extended := r
+	extended.Expiry = time.Now().Add(24 * time.Hour).UnixNano()
+	if extended.Verify(true) == nil {
+		t.Errorf("Verify(true) should fail for a record whose expiry is modified")
+	}
+	expired := r
+	expired.Countersign(gkey, time.Now().Add(-time.Second))
+	if expired.Verify(true) == nil {
+		t.Errorf("Verify(true) should fail for an expired record")
+	}
+	if err := expired.Verify(false); err != nil {
+		t.Errorf("Verify(false) returns %v; expects nil", err)
+	}
+
+	r.Addrs = []string{"198.51.100.1:9200"}
+	if r.Verify(false) == nil {
+		t.Errorf("Verify() should fail for a modified record")
+	}
+	r.sign(key)
+	if err := r.Verify(true); err != nil {
+		t.Errorf("countersignature should remain valid after the addresses change: %v", err)
+	}
+
+	fake := MemberRecord{Group: group, ID: utils.NewRandomNodeID(namespace), Addrs: r.Addrs}
+	fake.sign(key)
+	if fake.Verify(false) == nil {
+		t.Errorf("Verify() should fail for a record of another node")
+	}
+}
+
+func TestAddMemberRecord(t *testing.T) {
+	gkey := utils.GeneratePrivateKey()
+	group := utils.NewNodeID(utils.GroupNamespace, gkey.Digest())
+	p := &Router{
+		id:            utils.NewRandomNodeID(namespace),
+		members:       make(map[utils.NodeID]map[utils.NodeID]MemberRecord),
+		ownMembers:    make(map[utils.NodeID]MemberRecord),
+		countersigned: make(map[utils.NodeID]bool),
+	}
+
+	key := utils.GeneratePrivateKey()
+	r := MemberRecord{Group: group, ID: utils.NewNodeID(namespace, key.Digest())}
+	r.sign(key)
+	if p.isMember(group, r.ID) {
+		t.Errorf("isMember() returns true before the record is added")
+	}
+	if !p.addMemberRecord(r) {
+		t.Errorf("addMemberRecord() returns false; expects true")
+	}
+	if !p.isMember(group, r.ID) {
+		t.Errorf("isMember() returns false for a verified member")
+	}
+
+	p.RequireCountersign(group)
+	if p.addMemberRecord(r) {
+		t.Errorf("addMemberRecord() accepts a record which is not countersigned")
+	}
+	r.Countersign(gkey, time.Now().Add(time.Hour))
+	if !p.addMemberRecord(r) {
+		t.Errorf("addMemberRecord() rejects a countersigned record")
+	}
+
+	expired := r
+	expired.Countersign(gkey, time.Now().Add(-time.Second))
+	if p.addMemberRecord(expired) {
+		t.Errorf("addMemberRecord() accepts an expired record")
+	}
+	m := p.members[group][r.ID]
+	m.Expiry = time.Now().Add(-time.Second).UnixNano()
+	p.members[group][r.ID] = m
+	if p.isMember(group, r.ID) {
+		t.Errorf("isMember() returns true after the record expires")
+	}
+	p.members[group][r.ID] = r
+
+	forged := r
+	forged.Addrs = []string{"203.0.113.1:9200"}
+	if p.addMemberRecord(forged) {
+		t.Errorf("addMemberRecord() accepts a forged record")
+	}
+	outsider := utils.NewRandomNodeID(namespace)
+	if p.isMember(group, outsider) {
+		t.Errorf("isMember() returns true for a node without a record")
+	}
+
+	if err := p.SetMemberRecord(r); err == nil {
+		t.Errorf("SetMemberRecord() should fail for a record of another node")
+	}
+}
@@ -0,0 +1,209 @@
+package router
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	gossipInterval = 10 * time.Second
+	gossipFanout   = 3
+)
+
+// membershipDigest is a signed summary of the group members known by a node.
+// Members is only filled when the full list is exchanged for reconciliation,
+// together with the records of the members. Only the members with a valid
+// record are added to the group.
+type membershipDigest struct {
+	Group   utils.NodeID     `msgpack:"group"`
+	Hash    []byte           `msgpack:"hash"`
+	Time    int64            `msgpack:"time"`
+	Members []utils.NodeInfo `msgpack:"members"`
+	Records []MemberRecord   `msgpack:"records"`
+	Reply   bool             `msgpack:"reply"`
+	Key     utils.PublicKey  `msgpack:"key"`
+	Sign    utils.Signature  `msgpack:"sign"`
+}
+
+func memberHash(nodes []utils.NodeInfo) []byte {
+	var ids []string
+	for _, n := range nodes {
+		ids = append(ids, string(n.ID.Bytes()))
+	}
+	sort.Strings(ids)
+	h := sha1.New()
+	for _, id := range ids {
+		h.Write([]byte(id))
+	}
+	return h.Sum(nil)
+}
+
+func (d *membershipDigest) serialize() []byte {
+	data, _ := msgpack.Marshal([]interface{}{
+		d.Group.Bytes(),
+		d.Hash,
+		d.Time,
+		d.Reply,
+	})
+	return data
+}
+
+func newMembershipDigest(group utils.NodeID, members []utils.NodeInfo) membershipDigest {
+	return membershipDigest{
+		Group: group,
+		Hash:  memberHash(members),
+		Time:  time.Now().UnixNano(),
+	}
+}
+
+func (d *membershipDigest) sign(key *utils.PrivateKey) error {
+	d.Key = key.PublicKey
+	sign := key.Sign(d.serialize())
+	if sign == nil {
+		return errors.New("cannot sign membership digest")
+	}
+	d.Sign = *sign
+	return nil
+}
+
+// verify checks that the digest is signed by src and that the member list,
+// if any, matches the signed hash.
+func (d *membershipDigest) verify(src utils.NodeID) error {
+	if src.Digest.Cmp(d.Key.Digest()) != 0 {
+		return errors.New("membership digest signed by wrong key")
+	}
+	if !d.Key.Verify(d.serialize(), &d.Sign) {
+		return errors.New("invalid membership digest signature")
+	}
+	if d.Members != nil && !bytes.Equal(memberHash(d.Members), d.Hash) {
+		return errors.New("membership digest hash mismatch")
+	}
+	return nil
+}
+
+// groupMembers returns the known members of the group including this node.
+func (p *Router) groupMembers(group utils.NodeID) []utils.NodeInfo {
+	d := p.getGroupDht(group)
+	if d == nil {
+		return nil
+	}
+	members := []utils.NodeInfo{utils.NodeInfo{ID: p.id, Addr: p.transport.Addr()}}
+	for _, n := range d.KnownNodes() {
+		if !n.ID.Match(p.id) {
+			members = append(members, n)
+		}
+	}
+	return members
+}
+
+// Members returns the IDs of the known members of a joined group
+// other than this node.
+func (p *Router) Members(group utils.NodeID) []utils.NodeID {
+	var l []utils.NodeID
+	for _, n := range p.groupMembers(group) {
+		if !n.ID.Match(p.id) {
+			l = append(l, n.ID)
+		}
+	}
+	return l
+}
+
+// gossipMembership sends the membership digest of each joined group
+// to a few random members.
+func (p *Router) gossipMembership() {
+	p.dhtMutex.RLock()
+	var groups []utils.NodeID
+	for g := range p.groupDht {
+		groups = append(groups, g)
+	}
+	p.dhtMutex.RUnlock()
+
+	for _, g := range groups {
+		members := p.groupMembers(g)
+		d := newMembershipDigest(g, members)
+		err := d.sign(p.key)
+		if err != nil {
+			p.logger.Error("gossip: %v", err)
+			continue
+		}
+		n := 0
+		for _, i := range rand.Perm(len(members)) {
+			if n >= gossipFanout {
+				break
+			}
+			if !members[i].ID.Match(p.id) {
+				p.sendMembership(members[i].ID, d)
+				n++
+			}
+		}
+	}
+}
+
+func (p *Router) sendMembership(dst utils.NodeID, d membershipDigest) {
+	payload, err := msgpack.Marshal(d)
+	if err != nil {
+		return
+	}
+	pkt, err := p.makePacket(dst, protocol.TypeMember, payload)
+	if err == nil {
+		p.send <- pkt
+	}
+}
+
+// processMembership reconciles the member list of a group with a digest
+// received from src. When the hashes differ, the full lists are exchanged
+// and merged by both nodes.
+func (p *Router) processMembership(src utils.NodeID, payload []byte) {
+	var d membershipDigest
+	err := msgpack.Unmarshal(payload, &d)
+	if err != nil {
+		p.reportMisbehavior(src, AbuseMalformed)
+		return
+	}
+	err = d.verify(src)
+	if err != nil {
+		p.reportMisbehavior(src, AbuseInvalidSignature)
+	} else {
+		err = p.CheckTimestamp(src, time.Unix(0, d.Time))
+	}
+	if err != nil {
+		p.logger.Error("gossip: %v", err)
+		return
+	}
+	dht := p.getGroupDht(d.Group)
+	if dht == nil {
+		return
+	}
+
+	for _, r := range d.Records {
+		if !r.Group.Match(d.Group) || r.ID.Match(p.id) || r.ID.Match(src) {
+			continue
+		}
+		if p.addMemberRecord(r) && dht.GetNodeInfo(r.ID) == nil {
+			discoverMember(dht, r)
+		}
+	}
+
+	members := p.groupMembers(d.Group)
+	if d.Members != nil && !d.Reply {
+		return
+	}
+	if bytes.Equal(memberHash(members), d.Hash) {
+		return
+	}
+	r := newMembershipDigest(d.Group, members)
+	r.Members = members
+	r.Records = p.memberRecords(d.Group)
+	r.Reply = d.Members == nil
+	if r.sign(p.key) == nil {
+		p.sendMembership(src, r)
+	}
+}
@@ -0,0 +1,53 @@
+package router
+
+import (
+	"net"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestMembershipDigest(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	src := utils.NewNodeID(namespace, key.Digest())
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:9200")
+	members := []utils.NodeInfo{
+		utils.NodeInfo{ID: src, Addr: addr},
+		utils.NodeInfo{ID: utils.NewRandomNodeID(namespace), Addr: addr},
+	}
+
+	d := newMembershipDigest(group, members)
+	d.Members = members
+	err := d.sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := msgpack.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r membershipDigest
+	err = msgpack.Unmarshal(data, &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.verify(src); err != nil {
+		t.Errorf("verify() returns %v", err)
+	}
+	if r.verify(utils.NewRandomNodeID(namespace)) == nil {
+		t.Errorf("verify() should reject a digest from another node")
+	}
+
+	r.Members = r.Members[:1]
+	if r.verify(src) == nil {
+		t.Errorf("verify() should reject a modified member list")
+	}
+
+	reversed := []utils.NodeInfo{members[1], members[0]}
+	if string(memberHash(reversed)) != string(memberHash(members)) {
+		t.Errorf("memberHash() should not depend on the order")
+	}
+}
@@ -0,0 +1,443 @@
+package router
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// MemoryScheme is the scheme of the in-memory transports.
+const MemoryScheme = "mem"
+
+// LinkFate is what happens to a segment sent over a memory link. A segment
+// is a dial or the bytes of a single write.
+type LinkFate int
+
+const (
+	// FateDeliver delivers the segment once.
+	FateDeliver LinkFate = iota
+
+	// FateDrop loses the segment. A lost dial times out.
+	FateDrop
+
+	// FateDuplicate delivers the segment twice.
+	// Dials are never duplicated.
+	FateDuplicate
+)
+
+// NATType is the type of the NAT in front of a memory transport.
+type NATType int
+
+const (
+	// NATNone accepts every dial.
+	NATNone NATType = iota
+
+	// NATPortRestricted only accepts the dials from the transports
+	// which the transport behind it has dialed.
+	NATPortRestricted
+
+	// NATSymmetric accepts no dial, as the dials of the transport behind
+	// it are mapped to another address for each destination.
+	NATSymmetric
+)
+
+// LinkConditions are the conditions of the link from a memory transport
+// to another one.
+type LinkConditions struct {
+	// Loss and Duplicate are the probabilities that a segment
+	// is lost or delivered twice.
+	Loss      float64
+	Duplicate float64
+
+	// Latency delays each segment.
+	Latency time.Duration
+}
+
+// LinkStats counts the segments sent over a memory link.
+type LinkStats struct {
+	Delivered  int
+	Dropped    int
+	Duplicated int
+}
+
+type memoryLink struct {
+	conditions LinkConditions
+	script     []LinkFate
+	stats      LinkStats
+}
+
+// MemoryNetwork connects memory transports, with scriptable conditions on
+// the link of each directed pair of transports, for the tests of the
+// router without sockets. The sessions are encrypted streams, so a lost
+// or duplicated write corrupts the session, which the router detects and
+// closes as it would a broken link. The conditions are drawn from a
+// seeded generator, so that the tests are reproducible.
+type MemoryNetwork struct {
+	rand      *rand.Rand
+	links     map[[2]string]*memoryLink
+	listeners map[string]*memoryListener
+	nats      map[string]NATType
+	dialed    map[[2]string]bool
+	mutex     sync.Mutex
+}
+
+// NewMemoryNetwork returns a network of memory transports whose
+// conditions are drawn from the seed.
+func NewMemoryNetwork(seed int64) *MemoryNetwork {
+	return &MemoryNetwork{
+		rand:      rand.New(rand.NewSource(seed)),
+		links:     make(map[[2]string]*memoryLink),
+		listeners: make(map[string]*memoryListener),
+		nats:      make(map[string]NATType),
+		dialed:    make(map[[2]string]bool),
+	}
+}
+
+// Transport returns the transport of the network listening on the name,
+// which is its address.
+func (n *MemoryNetwork) Transport(name string) StreamTransport {
+	return &memoryTransport{network: n, name: name}
+}
+
+func (n *MemoryNetwork) link(from, to string) *memoryLink {
+	k := [2]string{from, to}
+	l, ok := n.links[k]
+	if !ok {
+		l = &memoryLink{}
+		n.links[k] = l
+	}
+	return l
+}
+
+// SetLink sets the conditions of the link from a transport to another.
+// Links are perfect until their conditions are set.
+func (n *MemoryNetwork) SetLink(from, to string, c LinkConditions) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.link(from, to).conditions = c
+}
+
+// Script queues the fates of the next segments sent over the link from
+// a transport to another. The conditions of the link apply again once
+// the script has been played.
+func (n *MemoryNetwork) Script(from, to string, fates ...LinkFate) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	l := n.link(from, to)
+	l.script = append(l.script, fates...)
+}
+
+// SetNAT puts the transport listening on the name behind a NAT of the
+// given type. The dials which the NAT does not accept time out at once.
+func (n *MemoryNetwork) SetNAT(name string, t NATType) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.nats[name] = t
+}
+
+// admit reports whether the NAT in front of a transport accepts a dial
+// from another one. The caller holds the mutex.
+func (n *MemoryNetwork) admit(from, to string) bool {
+	switch n.nats[to] {
+	case NATPortRestricted:
+		return n.dialed[[2]string{to, from}]
+	case NATSymmetric:
+		return false
+	}
+	return true
+}
+
+// LinkStats returns the counters of the link from a transport to another.
+func (n *MemoryNetwork) LinkStats(from, to string) LinkStats {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.link(from, to).stats
+}
+
+// fate draws the fate and the latency of a segment sent over a link.
+func (n *MemoryNetwork) fate(from, to string) (LinkFate, time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	l := n.link(from, to)
+	f := FateDeliver
+	if len(l.script) > 0 {
+		f = l.script[0]
+		l.script = l.script[1:]
+	} else if r := n.rand.Float64(); r < l.conditions.Loss {
+		f = FateDrop
+	} else if r < l.conditions.Loss+l.conditions.Duplicate {
+		f = FateDuplicate
+	}
+	switch f {
+	case FateDrop:
+		l.stats.Dropped++
+	case FateDuplicate:
+		l.stats.Duplicated++
+	default:
+		l.stats.Delivered++
+	}
+	return f, l.conditions.Latency
+}
+
+// memoryTransport is a transport of a MemoryNetwork.
+type memoryTransport struct {
+	network *MemoryNetwork
+	name    string
+}
+
+func (t *memoryTransport) Scheme() string {
+	return MemoryScheme
+}
+
+func (t *memoryTransport) Listen() (StreamListener, error) {
+	t.network.mutex.Lock()
+	defer t.network.mutex.Unlock()
+	if _, ok := t.network.listeners[t.name]; ok {
+		return nil, errors.New("memory address already in use")
+	}
+	l := &memoryListener{
+		network: t.network,
+		name:    t.name,
+		conns:   make(chan net.Conn, 16),
+		closed:  make(chan struct{}),
+	}
+	t.network.listeners[t.name] = l
+	return l, nil
+}
+
+func (t *memoryTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	t.network.mutex.Lock()
+	l, ok := t.network.listeners[address]
+	admitted := t.network.admit(t.name, address)
+	if ok && admitted {
+		t.network.dialed[[2]string{t.name, address}] = true
+	}
+	t.network.mutex.Unlock()
+	if !ok {
+		return nil, errors.New("connection refused")
+	}
+	if !admitted {
+		return nil, memoryTimeout{}
+	}
+
+	f, latency := t.network.fate(t.name, address)
+	if f == FateDrop {
+		time.Sleep(timeout)
+		return nil, memoryTimeout{}
+	}
+	if latency >= timeout {
+		time.Sleep(timeout)
+		return nil, memoryTimeout{}
+	}
+	time.Sleep(latency)
+
+	c, s := newMemoryConn(t.network, t.name, address), newMemoryConn(t.network, address, t.name)
+	c.peer, s.peer = s, c
+	select {
+	case l.conns <- s:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("connection refused")
+	case <-time.After(timeout - latency):
+		return nil, memoryTimeout{}
+	}
+}
+
+func (t *memoryTransport) ParseAddr(address string) (string, error) {
+	if address == "" {
+		return "", errors.New("empty memory address")
+	}
+	return address, nil
+}
+
+type memoryListener struct {
+	network *MemoryNetwork
+	name    string
+	conns   chan net.Conn
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.closed)
+		l.network.mutex.Lock()
+		delete(l.network.listeners, l.name)
+		l.network.mutex.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() string {
+	return l.name
+}
+
+// memoryAddr is the address of a memory transport.
+type memoryAddr string
+
+func (a memoryAddr) Network() string { return MemoryScheme }
+func (a memoryAddr) String() string  { return string(a) }
+
+type memoryTimeout struct{}
+
+func (memoryTimeout) Error() string   { return "i/o timeout" }
+func (memoryTimeout) Timeout() bool   { return true }
+func (memoryTimeout) Temporary() bool { return true }
+
+// memorySegment is the bytes of a write, delivered at a given time.
+type memorySegment struct {
+	data []byte
+	at   time.Time
+}
+
+// memoryConn is an end of a stream between memory transports.
+type memoryConn struct {
+	network    *MemoryNetwork
+	local      string
+	remote     string
+	peer       *memoryConn
+	queue      []memorySegment
+	buf        []byte
+	closed     bool
+	peerClosed bool
+	deadline   time.Time
+	notify     chan struct{}
+	mutex      sync.Mutex
+}
+
+func newMemoryConn(n *MemoryNetwork, local, remote string) *memoryConn {
+	return &memoryConn{
+		network: n,
+		local:   local,
+		remote:  remote,
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+func (c *memoryConn) wake() {
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (c *memoryConn) Read(b []byte) (int, error) {
+	for {
+		c.mutex.Lock()
+		if c.closed {
+			c.mutex.Unlock()
+			return 0, errors.New("use of closed connection")
+		}
+		if len(c.buf) > 0 {
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			c.mutex.Unlock()
+			return n, nil
+		}
+		now := time.Now()
+		if len(c.queue) > 0 && !now.Before(c.queue[0].at) {
+			c.buf = c.queue[0].data
+			c.queue = c.queue[1:]
+			c.mutex.Unlock()
+			continue
+		}
+		if len(c.queue) == 0 && c.peerClosed {
+			c.mutex.Unlock()
+			return 0, io.EOF
+		}
+		if !c.deadline.IsZero() && !now.Before(c.deadline) {
+			c.mutex.Unlock()
+			return 0, memoryTimeout{}
+		}
+		wait := time.Hour
+		if len(c.queue) > 0 {
+			wait = c.queue[0].at.Sub(now)
+		}
+		if !c.deadline.IsZero() && c.deadline.Sub(now) < wait {
+			wait = c.deadline.Sub(now)
+		}
+		c.mutex.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.notify:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Write sends the bytes as a segment, which is lost, delayed or
+// duplicated as the link from this end to the other dictates.
+func (c *memoryConn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	closed := c.closed
+	c.mutex.Unlock()
+	if closed {
+		return 0, errors.New("use of closed connection")
+	}
+
+	f, latency := c.network.fate(c.local, c.remote)
+	seg := memorySegment{data: append([]byte(nil), b...), at: time.Now().Add(latency)}
+	p := c.peer
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return 0, errors.New("broken pipe")
+	}
+	switch f {
+	case FateDeliver:
+		p.queue = append(p.queue, seg)
+	case FateDuplicate:
+		p.queue = append(p.queue, seg, seg)
+	}
+	p.mutex.Unlock()
+	p.wake()
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	c.mutex.Unlock()
+	c.wake()
+
+	p := c.peer
+	p.mutex.Lock()
+	p.peerClosed = true
+	p.mutex.Unlock()
+	p.wake()
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr  { return memoryAddr(c.local) }
+func (c *memoryConn) RemoteAddr() net.Addr { return memoryAddr(c.remote) }
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	c.deadline = t
+	c.mutex.Unlock()
+	c.wake()
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes never block.
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
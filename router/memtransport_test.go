@@ -0,0 +1,125 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestMemoryTransport(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	a, b := n.Transport("a"), n.Transport("b")
+	l, err := b.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := n.Transport("b").Listen(); err == nil {
+		t.Errorf("Listen() should fail for an address in use")
+	}
+	if _, err := a.Dial("c", time.Second); err == nil {
+		t.Errorf("Dial() should fail for an address without listener")
+	}
+
+	n.Script("a", "b", FateDrop)
+	if _, err := a.Dial("b", 10*time.Millisecond); err == nil {
+		t.Errorf("Dial() should time out when the dial is lost")
+	}
+
+	c, err := a.Dial("b", time.Second)
+	if err != nil {
+		t.Fatalf("Dial() returns %v", err)
+	}
+	defer c.Close()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	n.SetLink("a", "b", LinkConditions{Latency: 50 * time.Millisecond})
+	n.Script("a", "b", FateDrop, FateDuplicate)
+	for _, m := range []string{"x", "y", "z"} {
+		c.Write([]byte(m))
+	}
+	start := time.Now()
+	var got []byte
+	for len(got) < 3 {
+		var buf [8]byte
+		s.SetReadDeadline(time.Now().Add(time.Second))
+		l, err := s.Read(buf[:])
+		if err != nil {
+			t.Fatalf("Read() returns %v", err)
+		}
+		got = append(got, buf[:l]...)
+	}
+	if string(got) != "yyz" {
+		t.Errorf("Read() returns %q; expects yyz", got)
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("segments are delivered after %v; expects 50ms", d)
+	}
+	if st := n.LinkStats("a", "b"); st.Dropped != 2 || st.Duplicated != 1 || st.Delivered != 2 {
+		t.Errorf("LinkStats() returns %+v; expects 2 dropped, 1 duplicated and 2 delivered", st)
+	}
+
+	s.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	var buf [8]byte
+	if _, err := s.Read(buf[:]); err == nil {
+		t.Errorf("Read() should time out without data")
+	}
+}
+
+func TestMemoryTransportDialRetry(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	config := utils.DefaultConfig
+	config.Retry.Dial.Timeout = 100 * time.Millisecond
+	router1, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, config, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router2, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, config, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+
+	n := NewMemoryNetwork(1)
+	if err := router1.RegisterTransport(n.Transport("node")); err != nil {
+		t.Fatal(err)
+	}
+	addr := JoinTransportAddr(MemoryScheme, "node")
+
+	n.Script("node", "node", FateDrop)
+	now := time.Now()
+	if router1.connect(router2.ID(), addr) != nil {
+		t.Errorf("connect() should fail when the dial is lost")
+	}
+	router1.dialFailed(router2.ID(), now)
+	if router1.dialAllowed(router2.ID(), now) {
+		t.Errorf("dialAllowed() should delay the dial after a failure")
+	}
+	if !router1.dialAllowed(router2.ID(), now.Add(router1.retry.Dial.Delay(1))) {
+		t.Errorf("dialAllowed() should allow the dial after the delay")
+	}
+
+	s := router1.connect(router2.ID(), addr)
+	if s == nil {
+		t.Fatalf("connect() should open a session once the link delivers")
+	}
+	if !s.ID().Match(router2.ID()) {
+		t.Errorf("session is to %v; expects %v", s.ID(), router2.ID())
+	}
+	if st := n.LinkStats("node", "node"); st.Dropped != 1 {
+		t.Errorf("LinkStats() returns %+v; expects 1 dropped segment", st)
+	}
+}
@@ -0,0 +1,54 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+var errNotLocal = errors.New("destination outside of the local network")
+
+// isLocalIP reports whether the address can be reached without leaving
+// the local network: loopback, private, link-local and unique local
+// addresses, and the multicast groups of the link.
+func isLocalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// isLocalAddr reports whether a UDP or stream address is local.
+// Addresses of the transports other than uTP, such as Bluetooth,
+// do not leave the local network.
+func isLocalAddr(address string) bool {
+	scheme, addr := SplitTransportAddr(address)
+	if scheme != UTPScheme {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if i := strings.Index(host, "%"); i >= 0 {
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && isLocalIP(ip)
+}
+
+// localPacketConn drops the packets written to the addresses
+// outside of the local network, such as in mesh mode.
+type localPacketConn struct {
+	net.PacketConn
+}
+
+func (c localPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if addr == nil || !isLocalAddr(addr.String()) {
+		return 0, errNotLocal
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// Mesh reports whether the transport only reaches the local network.
+func (t *Transport) Mesh() bool {
+	return t.mesh
+}
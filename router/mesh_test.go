@@ -0,0 +1,194 @@
+package router
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+// recordConn records the destinations of the written packets.
+type recordConn struct {
+	dsts   []string
+	closed chan struct{}
+	mutex  sync.Mutex
+}
+
+func (c *recordConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	<-c.closed
+	return 0, nil, net.ErrClosed
+}
+
+func (c *recordConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.dsts = append(c.dsts, addr.String())
+	return len(b), nil
+}
+
+func (c *recordConn) Close() error                       { return nil }
+func (c *recordConn) LocalAddr() net.Addr                { return &net.UDPAddr{} }
+func (c *recordConn) SetDeadline(t time.Time) error      { return nil }
+func (c *recordConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *recordConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// recordStream records the dialed addresses.
+type recordStream struct {
+	dials []string
+}
+
+func (s *recordStream) Scheme() string                     { return UTPScheme }
+func (s *recordStream) Listen() (StreamListener, error)    { return nil, nil }
+func (s *recordStream) ParseAddr(a string) (string, error) { return a, nil }
+
+func (s *recordStream) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	s.dials = append(s.dials, address)
+	c, _ := net.Pipe()
+	return c, nil
+}
+
+func TestIsLocalAddr(t *testing.T) {
+	local := []string{"127.0.0.1:9200", "10.1.2.3:9200", "192.168.0.10:9200", "[fe80::1%eth0]:9200", "[fd00::1]:9200", "224.0.0.251:5353", "ble://aa:bb"}
+	for _, a := range local {
+		if !isLocalAddr(a) {
+			t.Errorf("isLocalAddr(%q) returns false; expects true", a)
+		}
+	}
+	remote := []string{"203.0.113.1:9200", "[2001:db8::1]:9200", "8.8.8.8:53", "example.com:9200"}
+	for _, a := range remote {
+		if isLocalAddr(a) {
+			t.Errorf("isLocalAddr(%q) returns true; expects false", a)
+		}
+	}
+}
+
+func TestMeshPackets(t *testing.T) {
+	rec := &recordConn{closed: make(chan struct{})}
+	defer close(rec.closed)
+	id := utils.NewRandomNodeID(namespace)
+	d := dht.NewDHT(10, id, id, localPacketConn{rec}, log.NewLogger())
+	defer d.Close()
+
+	d.Discover(&net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 9200})
+	d.Discover(&net.UDPAddr{IP: net.ParseIP("192.168.0.10"), Port: 9200})
+	d.AddNode(utils.NodeInfo{
+		ID:   utils.NewRandomNodeID(namespace),
+		Addr: &net.UDPAddr{IP: net.ParseIP("198.51.100.1"), Port: 9200},
+	})
+	d.StoreValue("key", "value")
+
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	if len(rec.dsts) == 0 {
+		t.Fatalf("no packet sent to the local node")
+	}
+	for _, a := range rec.dsts {
+		if !isLocalAddr(a) {
+			t.Errorf("packet sent to %s in mesh mode", a)
+		}
+	}
+}
+
+func TestMeshDial(t *testing.T) {
+	s := &recordStream{}
+	tr := &Transport{mesh: true, streams: map[string]StreamTransport{UTPScheme: s}}
+
+	if _, err := tr.dial("203.0.113.1:9200", time.Second); err != errNotLocal {
+		t.Errorf("dial() returns %v; expects %v", err, errNotLocal)
+	}
+	if _, err := tr.dial("192.168.0.10:9200", time.Second); err != nil {
+		t.Errorf("dial() returns %v; expects nil", err)
+	}
+	if len(s.dials) != 1 || s.dials[0] != "192.168.0.10:9200" {
+		t.Errorf("dialed %v; expects only the local address", s.dials)
+	}
+}
+
+// remoteConn is a connection from the given remote address.
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.addr }
+
+// connListener accepts the given connections once.
+type connListener struct {
+	conns []net.Conn
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	if len(l.conns) == 0 {
+		return nil, net.ErrClosed
+	}
+	c := l.conns[0]
+	l.conns = l.conns[1:]
+	return c, nil
+}
+
+func (l *connListener) Close() error { return nil }
+func (l *connListener) Addr() string { return "" }
+
+func TestMeshAccept(t *testing.T) {
+	logger := log.NewLogger()
+	closed := make(chan int)
+	defer close(closed)
+	tr := &Transport{
+		mesh:       true,
+		network:    newNetworkKey("secret"),
+		handshakes: make(chan struct{}, maxHandshakes),
+		supervisor: newSupervisor(closed, logger),
+		logger:     logger,
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	addr := &net.UDPAddr{IP: net.ParseIP("203.0.113.1"), Port: 9200}
+	tr.accept(UTPScheme, &connListener{conns: []net.Conn{remoteConn{Conn: local, addr: addr}}})
+
+	remote.SetReadDeadline(time.Now().Add(time.Second))
+	var b [1]byte
+	if n, err := remote.Read(b[:]); n != 0 || err != io.EOF {
+		t.Errorf("Read() returns %d, %v; expects the connection from %v to be closed without data", n, err, addr)
+	}
+}
+
+func TestMeshBootstrap(t *testing.T) {
+	config := utils.Config{B: []string{"203.0.113.1:9200-9210"}, Mesh: true}
+	if addrs := config.Bootstrap(); len(addrs) != 0 {
+		t.Errorf("Bootstrap() returns %v in mesh mode; expects none", addrs)
+	}
+}
+
+func TestMDNSMessages(t *testing.T) {
+	id := utils.NewRandomNodeID(namespace)
+	query, list, err := parseMDNS(mdnsResponse(mdnsAnnouncement{ID: id, Port: 9200}))
+	if err != nil || query {
+		t.Fatalf("parseMDNS() returns %v, %v; expects a response", query, err)
+	}
+	if len(list) != 1 || !list[0].ID.Match(id) || list[0].Port != 9200 {
+		t.Errorf("parseMDNS() returns %v; expects the announced node", list)
+	}
+
+	query, list, err = parseMDNS(mdnsQuery())
+	if err != nil || !query || len(list) != 0 {
+		t.Errorf("parseMDNS() returns %v, %v, %v; expects a query", query, list, err)
+	}
+
+	// Names are compressed by other responders.
+	b := appendDNSName(dnsHeader(0, 2, 0), mdnsService)
+	b = append(b, 0, dnsTypePTR, 0, dnsClassIN)
+	b = append(b, 0xc0, 12, 0, dnsTypePTR, 0, dnsClassIN)
+	if query, _, err := parseMDNS(b); err != nil || !query {
+		t.Errorf("parseMDNS() returns %v, %v; expects a compressed query", query, err)
+	}
+	b = append(dnsHeader(0, 1, 0), 0xc0, 12)
+	if _, _, err := parseMDNS(b); err == nil {
+		t.Errorf("parseMDNS() should reject a looping name")
+	}
+}
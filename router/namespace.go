@@ -0,0 +1,41 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// NamespaceError is returned when a packet has a source or destination
+// namespace which is not allowed for its type. Packets are always sent
+// from the global ID of a node, to a node or, for messages, to a group.
+type NamespaceError struct {
+	Src    utils.NodeID
+	Dst    utils.NodeID
+	Type   string
+	Reason string
+}
+
+func (e *NamespaceError) Error() string {
+	return fmt.Sprintf("%s packet from %s to %s: %s", e.Type, e.Src.String(), e.Dst.String(), e.Reason)
+}
+
+// checkNamespaces returns a *NamespaceError if a packet of the given type
+// cannot be sent from src to dst.
+func checkNamespaces(src, dst utils.NodeID, typ string) error {
+	if !bytes.Equal(src.NS[:], utils.GlobalNamespace[:]) {
+		return &NamespaceError{Src: src, Dst: dst, Type: typ, Reason: "source is not a global node ID"}
+	}
+	if bytes.Equal(dst.NS[:], utils.GlobalNamespace[:]) {
+		return nil
+	}
+	if !bytes.Equal(dst.NS[:], utils.GroupNamespace[:]) {
+		return &NamespaceError{Src: src, Dst: dst, Type: typ, Reason: "unknown destination namespace"}
+	}
+	if typ != protocol.TypeMsg {
+		return &NamespaceError{Src: src, Dst: dst, Type: typ, Reason: "only messages can be sent to a group"}
+	}
+	return nil
+}
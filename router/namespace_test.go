@@ -0,0 +1,40 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestCheckNamespaces(t *testing.T) {
+	node := utils.NewRandomNodeID(utils.GlobalNamespace)
+	peer := utils.NewRandomNodeID(utils.GlobalNamespace)
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	other := utils.NewRandomNodeID(utils.Namespace{2, 0, 0, 0})
+
+	cases := []struct {
+		src, dst utils.NodeID
+		typ      string
+		ok       bool
+	}{
+		{node, peer, protocol.TypeMsg, true},
+		{node, peer, protocol.TypePing, true},
+		{node, group, protocol.TypeMsg, true},
+		{node, group, protocol.TypeMember, false},
+		{group, peer, protocol.TypeMsg, false},
+		{group, group, protocol.TypeMsg, false},
+		{node, other, protocol.TypeMsg, false},
+	}
+	for _, c := range cases {
+		err := checkNamespaces(c.src, c.dst, c.typ)
+		if (err == nil) != c.ok {
+			t.Errorf("checkNamespaces(%v, %v, %q) returns %v; expects ok=%v", c.src.NS, c.dst.NS, c.typ, err, c.ok)
+		}
+		if err != nil {
+			if _, ok := err.(*NamespaceError); !ok {
+				t.Errorf("checkNamespaces() returns %T; expects *NamespaceError", err)
+			}
+		}
+	}
+}
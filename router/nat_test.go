@@ -0,0 +1,95 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+// newNATRouter starts a router with its own transport listening on the
+// name in the memory network, behind a NAT of the given type.
+func newNATRouter(t *testing.T, n *MemoryNetwork, name string, typ NATType) *Router {
+	r, err := NewRouter(utils.GeneratePrivateKey(), log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.SetNAT(name, typ)
+	if err := r.RegisterTransport(n.Transport(name)); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// recvMessage waits for a message of the router.
+func recvMessage(r *Router, timeout time.Duration) (Message, bool) {
+	ch := make(chan Message, 1)
+	go func() {
+		if m, err := r.RecvMessage(); err == nil {
+			ch <- m
+		}
+	}()
+	select {
+	case m := <-ch:
+		return m, true
+	case <-time.After(timeout):
+		return Message{}, false
+	}
+}
+
+func TestRouterNATPortRestricted(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	public := newNATRouter(t, n, "public", NATNone)
+	defer public.Close()
+	private := newNATRouter(t, n, "private", NATPortRestricted)
+	defer private.Close()
+
+	if public.connect(private.ID(), JoinTransportAddr(MemoryScheme, "private")) != nil {
+		t.Fatalf("connect() to an unsolicited NAT should fail")
+	}
+	if private.connect(public.ID(), JoinTransportAddr(MemoryScheme, "public")) == nil {
+		t.Fatalf("connect() from behind the NAT should open a session")
+	}
+
+	// The session opened from behind the NAT carries the messages
+	// of the public node.
+	public.SendMessage(private.ID(), []byte("hello"))
+	if m, ok := recvMessage(private, 5*time.Second); !ok || string(m.Payload) != "hello" || !m.Node.Match(public.ID()) {
+		t.Errorf("RecvMessage() returns %q; expects the message of the public node", m.Payload)
+	}
+
+	// Once the node behind the NAT has dialed the public node,
+	// the public node can dial it back.
+	public.CloseSession(private.ID())
+	private.CloseSession(public.ID())
+	if public.connect(private.ID(), JoinTransportAddr(MemoryScheme, "private")) == nil {
+		t.Errorf("connect() through a punched NAT should open a session")
+	}
+}
+
+func TestRouterNATSymmetric(t *testing.T) {
+	n := NewMemoryNetwork(1)
+	public := newNATRouter(t, n, "public", NATNone)
+	defer public.Close()
+	private := newNATRouter(t, n, "private", NATSymmetric)
+	defer private.Close()
+
+	if private.connect(public.ID(), JoinTransportAddr(MemoryScheme, "public")) == nil {
+		t.Fatalf("connect() from behind the NAT should open a session")
+	}
+	if public.connect(private.ID(), JoinTransportAddr(MemoryScheme, "private")) != nil {
+		t.Errorf("connect() through a symmetric NAT should fail")
+	}
+
+	// The messages of both nodes go through the session
+	// opened from behind the NAT.
+	public.SendMessage(private.ID(), []byte("hello"))
+	if m, ok := recvMessage(private, 5*time.Second); !ok || string(m.Payload) != "hello" {
+		t.Errorf("RecvMessage() returns %q; expects the message of the public node", m.Payload)
+	}
+	private.SendMessage(public.ID(), []byte("reply"))
+	if m, ok := recvMessage(public, 5*time.Second); !ok || string(m.Payload) != "reply" {
+		t.Errorf("RecvMessage() returns %q; expects the reply", m.Payload)
+	}
+}
@@ -0,0 +1,232 @@
+package router
+
+import (
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+)
+
+// connectivityInterval is the interval at which the addresses
+// of the network interfaces are checked.
+const connectivityInterval = 5 * time.Second
+
+// Flags of the IPv6 addresses in /proc/net/if_inet6.
+const (
+	ifaTemporary  = 0x01
+	ifaDeprecated = 0x20
+)
+
+// routeProbes are the destinations whose routes identify the network.
+// No packet is sent to them.
+var routeProbes = []string{"192.0.2.1:9", "[2001:db8::1]:9"}
+
+// localAddrs returns the sorted global unicast addresses of the network
+// interfaces. The temporary and deprecated IPv6 addresses are left out,
+// since they come and go without any change of the network.
+func localAddrs() []string {
+	addrs := []string{}
+	ifaddrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return addrs
+	}
+	unstable := map[string]bool{}
+	if data, err := ioutil.ReadFile("/proc/net/if_inet6"); err == nil {
+		unstable = unstableAddrs(string(data))
+	}
+	for _, a := range ifaddrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() && !unstable[ipnet.IP.String()] {
+			addrs = append(addrs, ipnet.IP.String())
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// unstableAddrs returns the temporary and deprecated IPv6 addresses
+// listed in the format of /proc/net/if_inet6.
+func unstableAddrs(data string) map[string]bool {
+	m := make(map[string]bool)
+	for _, line := range strings.Split(data, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 5 {
+			continue
+		}
+		b, err := hex.DecodeString(f[0])
+		if err != nil || len(b) != net.IPv6len {
+			continue
+		}
+		flags, err := strconv.ParseUint(f[4], 16, 32)
+		if err == nil && flags&(ifaTemporary|ifaDeprecated) != 0 {
+			m[net.IP(b).String()] = true
+		}
+	}
+	return m
+}
+
+// defaultRoute identifies the default routes by the interfaces and the
+// source addresses which the system chooses for them. Only the /64 prefix
+// of an IPv6 source is kept, since the temporary addresses rotate within
+// it.
+func defaultRoute() string {
+	var l []string
+	for _, dst := range routeProbes {
+		conn, err := net.Dial("udp", dst)
+		if err != nil {
+			continue
+		}
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		conn.Close()
+		name := interfaceOf(ip)
+		if ip.To4() == nil {
+			ip = ip.Mask(net.CIDRMask(64, 128))
+		}
+		l = append(l, name+" "+ip.String())
+	}
+	return strings.Join(l, ", ")
+}
+
+// interfaceOf returns the name of the interface with the given address.
+func interfaceOf(ip net.IP) string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
+
+// updateNetwork records the current addresses of the network interfaces
+// and the default route, and reports whether each has changed since the
+// last check.
+func (p *Router) updateNetwork(addrs []string, route string) (changed, moved bool) {
+	p.netMutex.Lock()
+	defer p.netMutex.Unlock()
+	if p.addrs == nil {
+		p.addrs = addrs
+		p.route = route
+		return false, false
+	}
+	changed = len(addrs) != len(p.addrs)
+	for i := 0; !changed && i < len(addrs); i++ {
+		changed = addrs[i] != p.addrs[i]
+	}
+	moved = route != p.route
+	p.addrs = addrs
+	p.route = route
+	return changed, moved
+}
+
+// checkConnectivity detects changes of the network, such as switching to
+// another Wi-Fi network. The listener is bound to the wildcard address and
+// keeps working, but when the default route changes, the sessions and the
+// NAT mappings of the old network are stale, so the sessions are closed,
+// the known nodes are pinged again and the addresses of this node are
+// announced again. When only the addresses change, they are published.
+func (p *Router) checkConnectivity() {
+	addrs := localAddrs()
+	changed, moved := p.updateNetwork(addrs, defaultRoute())
+	if !changed && !moved {
+		return
+	}
+	p.logger.Info("Network addresses changed: %v", addrs)
+	if moved {
+		p.resetNetwork()
+	}
+	p.publishCapabilities()
+	p.publishAddress()
+
+	p.netMutex.Lock()
+	h := p.connectivityHandler
+	p.netMutex.Unlock()
+	if h != nil {
+		h(addrs)
+	}
+}
+
+// resetNetwork closes the sessions, pings the known nodes again and
+// announces this node again after the default route has changed.
+func (p *Router) resetNetwork() {
+	p.logger.Info("Default route changed")
+	p.sessionMutex.RLock()
+	var sessions []*session
+	for _, s := range p.sessions {
+		sessions = append(sessions, s)
+	}
+	p.sessionMutex.RUnlock()
+	for _, s := range sessions {
+		p.removeSession(s)
+	}
+
+	p.dhtMutex.RLock()
+	dhts := []*dht.DHT{p.mainDht}
+	var groups []utils.NodeID
+	for g, d := range p.groupDht {
+		dhts = append(dhts, d)
+		groups = append(groups, g)
+	}
+	p.dhtMutex.RUnlock()
+	for _, d := range dhts {
+		for _, n := range d.KnownNodes() {
+			d.DiscoverNode(n)
+		}
+	}
+
+	p.resetBootstrap()
+	p.retryBootstrap(time.Now())
+
+	self := []utils.NodeInfo{utils.NodeInfo{ID: p.id, Addr: p.transport.Addr()}}
+	for _, g := range groups {
+		p.mainDht.StoreNodes(g.String(), self)
+	}
+	p.announceMutex.Lock()
+	var keys []string
+	for k := range p.announced {
+		keys = append(keys, k)
+	}
+	p.announceMutex.Unlock()
+	for _, k := range keys {
+		p.mainDht.StoreNodes(k, self)
+	}
+}
+
+// Addrs returns the addresses of the network interfaces with the port
+// of the listener, followed by those of the registered transports.
+func (p *Router) Addrs() []string {
+	_, port, _ := net.SplitHostPort(p.transport.Addr().String())
+	p.netMutex.Lock()
+	addrs := p.addrs
+	p.netMutex.Unlock()
+	if addrs == nil {
+		addrs = localAddrs()
+	}
+	var l []string
+	for _, a := range addrs {
+		l = append(l, net.JoinHostPort(a, port))
+	}
+	return append(l, p.transport.streamAddrs()...)
+}
+
+// SetConnectivityHandler sets a function which is called with the new
+// addresses of the network interfaces when they change.
+func (p *Router) SetConnectivityHandler(h func(addrs []string)) {
+	p.netMutex.Lock()
+	defer p.netMutex.Unlock()
+	p.connectivityHandler = h
+}
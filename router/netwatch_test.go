@@ -0,0 +1,31 @@
+package router
+
+import "testing"
+
+func TestUpdateNetwork(t *testing.T) {
+	var p Router
+	if changed, moved := p.updateNetwork([]string{}, "eth0 192.0.2.1"); changed || moved {
+		t.Errorf("updateNetwork() returns %v, %v for the first addresses", changed, moved)
+	}
+	if changed, moved := p.updateNetwork([]string{"192.0.2.1"}, "eth0 192.0.2.1"); !changed || moved {
+		t.Errorf("updateNetwork() returns %v, %v for a new address; expects true, false", changed, moved)
+	}
+	if changed, moved := p.updateNetwork([]string{"192.0.2.1"}, "eth0 192.0.2.1"); changed || moved {
+		t.Errorf("updateNetwork() returns %v, %v for the same network", changed, moved)
+	}
+	if changed, moved := p.updateNetwork([]string{"198.51.100.1"}, "wlan0 198.51.100.1"); !changed || !moved {
+		t.Errorf("updateNetwork() returns %v, %v for another network; expects true, true", changed, moved)
+	}
+}
+
+func TestUnstableAddrs(t *testing.T) {
+	data := `20010db8000000000000000000000001 02 40 00 80     eth0
+20010db8000000001111222233334444 02 40 00 01     eth0
+20010db8000000005555666677778888 02 40 00 20     eth0
+fe800000000000000000000000000001 02 40 20 80     eth0
+`
+	m := unstableAddrs(data)
+	if len(m) != 2 || !m["2001:db8::1111:2222:3333:4444"] || !m["2001:db8::5555:6666:7777:8888"] {
+		t.Errorf("unstableAddrs() returns %v; expects the temporary and the deprecated address", m)
+	}
+}
@@ -0,0 +1,230 @@
+package router
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var errNetworkKey = errors.New("packet not sealed with the network key")
+
+// networkKey protects the traffic of a private network with a secret
+// shared by its nodes. DHT packets are sealed with AES-GCM, so that the
+// packets of other nodes are dropped. Sessions are split into records
+// sealed with AES-GCM from their first byte, under a key derived from the
+// secret and a random salt of each direction; a node without the secret
+// cannot complete the handshake since its records do not open, and
+// a modified, replayed or reordered record closes the session.
+type networkKey struct {
+	packet cipher.AEAD
+	stream []byte
+}
+
+// newNetworkKey derives the keys of the secret. It returns nil
+// if the secret is empty, which disables the private network.
+func newNetworkKey(secret string) *networkKey {
+	if secret == "" {
+		return nil
+	}
+	pkey := sha256.Sum256([]byte("murcott packet:" + secret))
+	skey := sha256.Sum256([]byte("murcott stream:" + secret))
+	block, err := aes.NewCipher(pkey[:])
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return &networkKey{packet: aead, stream: skey[:]}
+}
+
+// streamCipher returns the cipher of the records of a direction
+// of a session, whose salt is sent before its first record.
+func (k *networkKey) streamCipher(salt []byte) cipher.AEAD {
+	mac := hmac.New(sha256.New, k.stream)
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// seal encrypts a packet. The random nonce is prepended.
+func (k *networkKey) seal(b []byte) []byte {
+	nonce := make([]byte, k.packet.NonceSize(), k.packet.NonceSize()+len(b)+k.packet.Overhead())
+	rand.Read(nonce)
+	return k.packet.Seal(nonce, nonce, b, nil)
+}
+
+// open decrypts a packet sealed by seal.
+func (k *networkKey) open(b []byte) ([]byte, error) {
+	n := k.packet.NonceSize()
+	if len(b) < n {
+		return nil, errNetworkKey
+	}
+	data, err := k.packet.Open(nil, b[:n], b[n:], nil)
+	if err != nil {
+		return nil, errNetworkKey
+	}
+	return data, nil
+}
+
+// packetConn seals the packets written to conn
+// and drops the received packets which do not open.
+func (k *networkKey) packetConn(conn net.PacketConn) net.PacketConn {
+	if k == nil {
+		return conn
+	}
+	return networkPacketConn{PacketConn: conn, key: k}
+}
+
+// streamConn encrypts a session. It sends the salt of the written
+// stream and reads that of the peer before its first record.
+func (k *networkKey) streamConn(conn net.Conn) (net.Conn, error) {
+	if k == nil {
+		return conn, nil
+	}
+	salt := make([]byte, streamSaltSize)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(salt)
+	if err != nil {
+		return nil, err
+	}
+	return &networkStreamConn{
+		Conn: conn,
+		key:  k,
+		salt: salt,
+		w:    k.streamCipher(salt),
+	}, nil
+}
+
+type networkPacketConn struct {
+	net.PacketConn
+	key *networkKey
+}
+
+func (c networkPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	_, err := c.PacketConn.WriteTo(c.key.seal(b), addr)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c networkPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+c.key.packet.NonceSize()+c.key.packet.Overhead())
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, addr, err
+		}
+		data, err := c.key.open(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, data), addr, nil
+	}
+}
+
+const (
+	streamSaltSize = 16
+
+	// maxStreamRecord is the largest plaintext of a record.
+	maxStreamRecord = 16 * 1024
+)
+
+// networkStreamConn reads and writes records made of the length of the
+// sealed data in 2 bytes and the data sealed with the nonce given by the
+// number of the record in the stream.
+type networkStreamConn struct {
+	net.Conn
+	key  *networkKey
+	salt []byte
+
+	r      cipher.AEAD
+	rseq   uint64
+	rbuf   []byte
+	w      cipher.AEAD
+	wseq   uint64
+	wmutex sync.Mutex
+}
+
+func streamNonce(aead cipher.AEAD, seq uint64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], seq)
+	return nonce
+}
+
+func (c *networkStreamConn) Read(b []byte) (int, error) {
+	if c.r == nil {
+		salt := make([]byte, streamSaltSize)
+		_, err := io.ReadFull(c.Conn, salt)
+		if err != nil {
+			return 0, err
+		}
+		// A stream reflected back to this node would open otherwise.
+		if bytes.Equal(salt, c.salt) {
+			return 0, errNetworkKey
+		}
+		c.r = c.key.streamCipher(salt)
+	}
+	for len(c.rbuf) == 0 {
+		var header [2]byte
+		_, err := io.ReadFull(c.Conn, header[:])
+		if err != nil {
+			return 0, err
+		}
+		sealed := make([]byte, binary.BigEndian.Uint16(header[:]))
+		_, err = io.ReadFull(c.Conn, sealed)
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf, err = c.r.Open(sealed[:0], streamNonce(c.r, c.rseq), sealed, header[:])
+		if err != nil {
+			return 0, errNetworkKey
+		}
+		c.rseq++
+	}
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
+
+func (c *networkStreamConn) Write(b []byte) (int, error) {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+	n := 0
+	for n < len(b) {
+		chunk := b[n:]
+		if len(chunk) > maxStreamRecord {
+			chunk = chunk[:maxStreamRecord]
+		}
+		record := make([]byte, 2, 2+len(chunk)+c.w.Overhead())
+		binary.BigEndian.PutUint16(record, uint16(len(chunk)+c.w.Overhead()))
+		record = c.w.Seal(record, streamNonce(c.w, c.wseq), chunk, record[:2])
+		c.wseq++
+		_, err := c.Conn.Write(record)
+		if err != nil {
+			return n, err
+		}
+		n += len(chunk)
+	}
+	return n, nil
+}
@@ -0,0 +1,89 @@
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestNetworkKeyPacket(t *testing.T) {
+	if newNetworkKey("") != nil {
+		t.Errorf("newNetworkKey() should return nil for an empty secret")
+	}
+	k := newNetworkKey("secret")
+	data := []byte("find node")
+	sealed := k.seal(data)
+	if bytes.Contains(sealed, data) {
+		t.Errorf("seal() does not encrypt the packet")
+	}
+	if b, err := k.open(sealed); err != nil || !bytes.Equal(b, data) {
+		t.Errorf("open() returns %q, %v; expects %q", b, err, data)
+	}
+	if _, err := newNetworkKey("other").open(sealed); err == nil {
+		t.Errorf("open() accepts a packet sealed with another secret")
+	}
+	if _, err := k.open(data); err == nil {
+		t.Errorf("open() accepts a plain packet")
+	}
+}
+
+func TestNetworkKeyStream(t *testing.T) {
+	for _, secret := range []string{"secret", "other"} {
+		a, b := net.Pipe()
+		done := make(chan []byte)
+		go func() {
+			c, _ := newNetworkKey("secret").streamConn(a)
+			c.Write([]byte("hello"))
+			a.Close()
+		}()
+		go func() {
+			c, _ := newNetworkKey(secret).streamConn(writeOnly{b})
+			data, _ := ioutil.ReadAll(c)
+			done <- data
+		}()
+		data := <-done
+		if (secret == "secret") != bytes.Equal(data, []byte("hello")) {
+			t.Errorf("stream with secret %q reads %q", secret, data)
+		}
+	}
+}
+
+func TestNetworkKeyStreamTampered(t *testing.T) {
+	a, b := net.Pipe()
+	go func() {
+		c, _ := newNetworkKey("secret").streamConn(&tamper{Conn: a})
+		c.Write(bytes.Repeat([]byte("hello"), maxStreamRecord))
+		a.Close()
+	}()
+	c, _ := newNetworkKey("secret").streamConn(writeOnly{b})
+	data, err := ioutil.ReadAll(c)
+	if err != errNetworkKey || len(data) != maxStreamRecord {
+		t.Errorf("stream reads %d bytes, %v; expects the first record and errNetworkKey", len(data), err)
+	}
+}
+
+// tamper flips a bit of the third write to a pipe, which is the second
+// record after the salt.
+type tamper struct {
+	net.Conn
+	writes int
+}
+
+func (c *tamper) Write(b []byte) (int, error) {
+	c.writes++
+	if c.writes == 3 {
+		b = append([]byte{}, b...)
+		b[len(b)-1] ^= 1
+	}
+	return c.Conn.Write(b)
+}
+
+// writeOnly discards the writes to a pipe, whose peer only writes.
+type writeOnly struct {
+	net.Conn
+}
+
+func (c writeOnly) Write(b []byte) (int, error) {
+	return len(b), nil
+}
@@ -0,0 +1,181 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// observeInterval is the interval at which an observer node samples
+// the network.
+const observeInterval = time.Minute
+
+var errObserver = errors.New("observer node cannot send messages")
+
+// NetworkStats describes the network as seen by an observer node.
+type NetworkStats struct {
+	Time time.Time
+
+	// Nodes is the number of known nodes and Sessions is the number
+	// of nodes with an open session.
+	Nodes    int
+	Sessions int
+
+	// Joined and Left are the numbers of nodes which appeared and
+	// disappeared since the previous sample.
+	Joined int
+	Left   int
+
+	// Groups is the number of known members of each joined group.
+	Groups map[utils.NodeID]int
+
+	// Versions is the number of nodes which support each protocol version.
+	// Nodes whose capability record is not known are counted as "unknown".
+	Versions map[string]int
+}
+
+// WriteMetrics writes the statistics in the Prometheus text format.
+func (s NetworkStats) WriteMetrics(w io.Writer) error {
+	metrics := []struct {
+		name, help string
+		value      int
+	}{
+		{"murcott_nodes", "Number of known nodes.", s.Nodes},
+		{"murcott_sessions", "Number of nodes with an open session.", s.Sessions},
+		{"murcott_joined_nodes", "Number of nodes which appeared since the previous sample.", s.Joined},
+		{"murcott_left_nodes", "Number of nodes which disappeared since the previous sample.", s.Left},
+	}
+	for _, m := range metrics {
+		_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", m.name, m.help, m.name, m.name, m.value)
+		if err != nil {
+			return err
+		}
+	}
+
+	groups := make(map[string]int)
+	for g, n := range s.Groups {
+		groups[g.String()] = n
+	}
+	err := writeLabeled(w, "murcott_group_members", "Number of known members of a group.", "group", groups)
+	if err != nil {
+		return err
+	}
+	return writeLabeled(w, "murcott_protocol_nodes", "Number of nodes which support a protocol version.", "version", s.Versions)
+}
+
+func writeLabeled(w io.Writer, name, help, label string, values map[string]int) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		_, err := fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, k, values[k])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// observer keeps the samples of an observer node.
+type observer struct {
+	nodes map[utils.NodeID]bool
+	stats NetworkStats
+	mutex sync.Mutex
+}
+
+// sample records the currently known nodes and returns the nodes which
+// have appeared since the previous sample. Churn is not counted
+// for the first sample.
+func (o *observer) sample(now time.Time, nodes []utils.NodeID) []utils.NodeID {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	first := o.nodes == nil
+	current := make(map[utils.NodeID]bool)
+	var joined []utils.NodeID
+	for _, id := range nodes {
+		current[id] = true
+		if !o.nodes[id] {
+			joined = append(joined, id)
+		}
+	}
+	left := 0
+	for id := range o.nodes {
+		if !current[id] {
+			left++
+		}
+	}
+	o.nodes = current
+	o.stats = NetworkStats{Time: now, Nodes: len(nodes)}
+	if !first {
+		o.stats.Joined = len(joined)
+		o.stats.Left = left
+	}
+	return joined
+}
+
+// observe samples the network and looks up the capability records
+// of the new nodes for the version distribution.
+func (p *Router) observe(now time.Time) {
+	var ids []utils.NodeID
+	for _, n := range p.KnownNodes() {
+		ids = append(ids, n.ID)
+	}
+	joined := p.observer.sample(now, ids)
+	for _, id := range joined {
+		if _, ok := p.knownCapabilities(id); !ok {
+			p.Capabilities(id)
+		}
+	}
+
+	versions := make(map[string]int)
+	for _, id := range ids {
+		c, ok := p.knownCapabilities(id)
+		if !ok || len(c.Protocols) == 0 {
+			versions["unknown"]++
+		}
+		for _, v := range c.Protocols {
+			versions[v]++
+		}
+	}
+
+	p.dhtMutex.RLock()
+	var list []utils.NodeID
+	for g := range p.groupDht {
+		list = append(list, g)
+	}
+	p.dhtMutex.RUnlock()
+	groups := make(map[utils.NodeID]int)
+	for _, g := range list {
+		groups[g] = p.MemberCount(g)
+	}
+
+	sessions := len(p.ActiveSessions())
+
+	p.observer.mutex.Lock()
+	defer p.observer.mutex.Unlock()
+	p.observer.stats.Sessions = sessions
+	p.observer.stats.Groups = groups
+	p.observer.stats.Versions = versions
+}
+
+// NetworkStats returns the latest sample of an observer node.
+// It returns false if the node is not an observer.
+func (p *Router) NetworkStats() (NetworkStats, bool) {
+	if p.observer == nil {
+		return NetworkStats{}, false
+	}
+	p.observer.mutex.Lock()
+	defer p.observer.mutex.Unlock()
+	return p.observer.stats, true
+}
@@ -0,0 +1,63 @@
+package router
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestObserverSample(t *testing.T) {
+	a := utils.NewRandomNodeID(namespace)
+	b := utils.NewRandomNodeID(namespace)
+	c := utils.NewRandomNodeID(namespace)
+
+	var o observer
+	now := time.Now()
+	joined := o.sample(now, []utils.NodeID{a, b})
+	if len(joined) != 2 {
+		t.Errorf("sample() returns %d nodes; expects 2", len(joined))
+	}
+	if o.stats.Joined != 0 || o.stats.Left != 0 {
+		t.Errorf("first sample counts churn: %+v", o.stats)
+	}
+
+	joined = o.sample(now.Add(observeInterval), []utils.NodeID{b, c})
+	if len(joined) != 1 || !joined[0].Match(c) {
+		t.Errorf("sample() returns %v; expects [%v]", joined, c)
+	}
+	if o.stats.Nodes != 2 || o.stats.Joined != 1 || o.stats.Left != 1 {
+		t.Errorf("stats are %+v; expects 2 nodes, 1 joined and 1 left", o.stats)
+	}
+}
+
+func TestNetworkStatsMetrics(t *testing.T) {
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	s := NetworkStats{
+		Nodes:    5,
+		Sessions: 2,
+		Joined:   1,
+		Groups:   map[utils.NodeID]int{group: 3},
+		Versions: map[string]int{"murcott/1": 4, "unknown": 1},
+	}
+	var buf bytes.Buffer
+	err := s.WriteMetrics(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"murcott_nodes 5",
+		"murcott_sessions 2",
+		"murcott_joined_nodes 1",
+		"murcott_left_nodes 0",
+		"murcott_group_members{group=\"" + group.String() + "\"} 3",
+		"murcott_protocol_nodes{version=\"murcott/1\"} 4",
+		"murcott_protocol_nodes{version=\"unknown\"} 1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("WriteMetrics() output does not contain %q", line)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package router
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+// QueuedMessage describes a message of this node waiting in the outbox
+// for a route to its destination.
+type QueuedMessage struct {
+	ID      [20]byte
+	Dst     utils.NodeID
+	Age     time.Duration
+	Retries int
+	Size    int
+}
+
+// OutboxPacket is a queued message of this node in the form in which
+// it is kept across restarts.
+type OutboxPacket struct {
+	Packet  protocol.Packet `msgpack:"packet"`
+	Queued  time.Time       `msgpack:"queued"`
+	Retries int             `msgpack:"retries"`
+}
+
+type queuedPacket struct {
+	pkt     protocol.Packet
+	queued  time.Time
+	next    time.Time
+	retries int
+}
+
+// Outbox returns the queued messages of this node, oldest first.
+func (p *Router) Outbox() []QueuedMessage {
+	now := time.Now()
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	var list []QueuedMessage
+	for _, q := range p.queuedPackets {
+		if q.pkt.Type != protocol.TypeMsg || !q.pkt.Src.Match(p.id) {
+			continue
+		}
+		list = append(list, QueuedMessage{
+			ID:      q.pkt.ID,
+			Dst:     q.pkt.Dst,
+			Age:     now.Sub(q.queued),
+			Retries: q.retries,
+			Size:    len(q.pkt.Payload),
+		})
+	}
+	return list
+}
+
+// OutboxPackets returns the queued messages of this node with their
+// packets, oldest first, so that they can be restored by RestoreOutbox.
+func (p *Router) OutboxPackets() []OutboxPacket {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	var list []OutboxPacket
+	for _, q := range p.queuedPackets {
+		if q.pkt.Type != protocol.TypeMsg || !q.pkt.Src.Match(p.id) {
+			continue
+		}
+		list = append(list, OutboxPacket{Packet: q.pkt, Queued: q.queued, Retries: q.retries})
+	}
+	return list
+}
+
+// RestoreOutbox queues the messages saved by OutboxPackets again. They are
+// retried on the next tick. Messages of other nodes, messages which are
+// already queued and messages which do not fit in the queue are skipped.
+// It returns the number of restored messages.
+func (p *Router) RestoreOutbox(l []OutboxPacket) int {
+	now := time.Now()
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	queued := make(map[[20]byte]bool)
+	for _, q := range p.queuedPackets {
+		queued[q.pkt.ID] = true
+	}
+	n := 0
+	for _, o := range l {
+		if len(p.queuedPackets) >= maxQueuedPackets {
+			break
+		}
+		if o.Packet.Type != protocol.TypeMsg || !o.Packet.Src.Match(p.id) || queued[o.Packet.ID] {
+			continue
+		}
+		queued[o.Packet.ID] = true
+		p.queuedPackets = append(p.queuedPackets, &queuedPacket{
+			pkt:     o.Packet,
+			queued:  o.Queued,
+			next:    now,
+			retries: o.Retries,
+		})
+		n++
+	}
+	p.governor.setQueued(len(p.queuedPackets))
+	return n
+}
+
+// CancelMessage removes a queued message of this node from the outbox.
+// It returns false if the message is not queued.
+func (p *Router) CancelMessage(id [20]byte) bool {
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	for i, q := range p.queuedPackets {
+		if q.pkt.ID == id && q.pkt.Src.Match(p.id) {
+			p.queuedPackets = append(p.queuedPackets[:i], p.queuedPackets[i+1:]...)
+			p.governor.setQueued(len(p.queuedPackets))
+			return true
+		}
+	}
+	return false
+}
+
+// retryQueued starts looking up the destinations of the queued packets
+// which are due according to the resend policy, without waiting for the
+// lookups. The packets of a destination are sent as soon as its lookup
+// completes.
+func (p *Router) retryQueued(now time.Time) {
+	p.queueMutex.Lock()
+	dsts := make(map[utils.NodeID]bool)
+	for _, q := range p.queuedPackets {
+		if !now.Before(q.next) {
+			dsts[q.pkt.Dst] = true
+		}
+	}
+	p.queueMutex.Unlock()
+
+	for dst := range dsts {
+		dst := dst
+		p.locateAsync(dst, func(bool) { p.sendQueued(dst, time.Now()) })
+	}
+}
+
+// locateAsync looks up the given ID in the background and calls done
+// when the lookup completes. Concurrent lookups of the same ID are
+// merged into one.
+func (p *Router) locateAsync(id utils.NodeID, done func(found bool)) {
+	p.locateMutex.Lock()
+	if p.locating == nil {
+		p.locating = make(map[utils.NodeID][]func(bool))
+	}
+	callbacks, running := p.locating[id]
+	p.locating[id] = append(callbacks, done)
+	p.locateMutex.Unlock()
+	if running {
+		return
+	}
+
+	go func() {
+		found := p.locate(id)
+		p.locateMutex.Lock()
+		callbacks := p.locating[id]
+		delete(p.locating, id)
+		p.locateMutex.Unlock()
+		for _, f := range callbacks {
+			f(found)
+		}
+	}()
+}
+
+// connectAsync dials the sessions to the node, or to the members of the
+// group, in the background and calls done, if not nil, with whether a
+// session is open. Concurrent attempts for the same ID are merged into one.
+func (p *Router) connectAsync(id utils.NodeID, done func(found bool)) {
+	p.locateMutex.Lock()
+	if p.connecting == nil {
+		p.connecting = make(map[utils.NodeID][]func(bool))
+	}
+	callbacks, running := p.connecting[id]
+	if done != nil {
+		callbacks = append(callbacks, done)
+	}
+	p.connecting[id] = callbacks
+	p.locateMutex.Unlock()
+	if running {
+		return
+	}
+
+	p.supervisor.spawn(SubsystemRouter, func() {
+		found := len(p.getSessions(id, true)) > 0
+		p.locateMutex.Lock()
+		callbacks := p.connecting[id]
+		delete(p.connecting, id)
+		p.locateMutex.Unlock()
+		for _, f := range callbacks {
+			f(found)
+		}
+	})
+}
+
+// sendQueued sends the queued packets of the destination. Packets are
+// dropped when the resend policy has no attempt left. The queue is not
+// locked while the packets are sent, so the packets queued or cancelled
+// in the meantime are kept as is.
+func (p *Router) sendQueued(dst utils.NodeID, now time.Time) {
+	p.queueMutex.Lock()
+	var queued []*queuedPacket
+	for _, q := range p.queuedPackets {
+		if q.pkt.Dst.Match(dst) {
+			queued = append(queued, q)
+		}
+	}
+	p.queueMutex.Unlock()
+	if len(queued) == 0 {
+		return
+	}
+
+	sent := make(map[*queuedPacket]bool)
+	for _, q := range queued {
+		pkt := q.pkt
+		sessions, found := p.routeSessions(pkt, true)
+		if !found {
+			p.logger.Error("Route not found: %v", pkt.Dst)
+			sent[q] = false
+			continue
+		}
+		ok := true
+		for _, s := range sessions {
+			err := s.Write(pkt)
+			if err != nil {
+				p.logger.Error("Remove session(%s): %v", pkt.Dst.String(), err)
+				p.removeSession(s)
+				ok = false
+			}
+		}
+		sent[q] = ok
+	}
+
+	p.queueMutex.Lock()
+	defer p.queueMutex.Unlock()
+	var rest []*queuedPacket
+	for _, q := range p.queuedPackets {
+		ok, tried := sent[q]
+		if ok {
+			continue
+		}
+		if tried {
+			// The first attempt is the one which queued the packet.
+			q.retries++
+			if p.retry.Resend.Exhausted(q.retries + 1) {
+				p.governor.drop()
+				continue
+			}
+			q.next = now.Add(p.retry.Resend.Delay(q.retries + 1))
+		}
+		rest = append(rest, q)
+	}
+	p.queuedPackets = rest
+	p.governor.setQueued(len(rest))
+}
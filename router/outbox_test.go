@@ -0,0 +1,172 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestOutbox(t *testing.T) {
+	id := utils.NewRandomNodeID(namespace)
+	p := &Router{id: id, governor: newGovernor(utils.Config{})}
+	dst := utils.NewRandomNodeID(namespace)
+
+	own := protocol.Packet{Dst: dst, Src: id, Type: protocol.TypeMsg, ID: [20]byte{1}, Payload: []byte("hello")}
+	ping := protocol.Packet{Dst: dst, Src: id, Type: protocol.TypePing, ID: [20]byte{2}}
+	forwarded := protocol.Packet{Dst: dst, Src: dst, Type: protocol.TypeMsg, ID: [20]byte{3}}
+	p.queuePacket(own)
+	p.queuePacket(ping)
+	p.queuePacket(forwarded)
+
+	list := p.Outbox()
+	if len(list) != 1 {
+		t.Fatalf("Outbox() returns %d messages; expects 1", len(list))
+	}
+	if list[0].ID != own.ID || !list[0].Dst.Match(dst) || list[0].Size != 5 {
+		t.Errorf("Outbox() returns %+v; expects the message of this node", list[0])
+	}
+
+	if p.CancelMessage(forwarded.ID) {
+		t.Errorf("CancelMessage() cancels a forwarded packet")
+	}
+	if !p.CancelMessage(own.ID) {
+		t.Errorf("CancelMessage() returns false; expects true")
+	}
+	if p.CancelMessage(own.ID) {
+		t.Errorf("CancelMessage() returns true for a cancelled message; expects false")
+	}
+	if len(p.Outbox()) != 0 || len(p.queuedPackets) != 2 {
+		t.Errorf("CancelMessage() should only remove the message")
+	}
+}
+
+func TestRestoreOutbox(t *testing.T) {
+	id := utils.NewRandomNodeID(namespace)
+	p := &Router{id: id, governor: newGovernor(utils.Config{})}
+	dst := utils.NewRandomNodeID(namespace)
+	own := protocol.Packet{Dst: dst, Src: id, Type: protocol.TypeMsg, ID: [20]byte{1}}
+	p.queuePacket(own)
+	p.queuePacket(protocol.Packet{Dst: dst, Src: dst, Type: protocol.TypeMsg, ID: [20]byte{2}})
+
+	saved := p.OutboxPackets()
+	if len(saved) != 1 || saved[0].Packet.ID != own.ID {
+		t.Fatalf("OutboxPackets() returns %+v; expects the message of this node", saved)
+	}
+	saved[0].Retries = 2
+	other := protocol.Packet{Dst: dst, Src: dst, Type: protocol.TypeMsg, ID: [20]byte{3}}
+	saved = append(saved, OutboxPacket{Packet: other})
+
+	r := &Router{id: id, governor: newGovernor(utils.Config{})}
+	if n := r.RestoreOutbox(saved); n != 1 {
+		t.Errorf("RestoreOutbox() returns %d; expects 1", n)
+	}
+	if n := r.RestoreOutbox(saved); n != 0 {
+		t.Errorf("RestoreOutbox() returns %d for queued messages; expects 0", n)
+	}
+	list := r.Outbox()
+	if len(list) != 1 || list[0].ID != own.ID || list[0].Retries != 2 {
+		t.Errorf("Outbox() returns %+v after RestoreOutbox(); expects the saved message", list)
+	}
+}
+
+func TestSendQueued(t *testing.T) {
+	logger := log.NewLogger()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	p := &Router{
+		id:       id,
+		mainDht:  dht.NewDHT(10, id, id, conn, logger),
+		governor: newGovernor(utils.Config{}),
+		retry:    utils.RetryConfig{Resend: utils.RetryPolicy{Initial: time.Second, Multiplier: 2, Attempts: 3}}.WithDefaults(),
+		logger:   logger,
+	}
+	dst := utils.NewRandomNodeID(utils.GlobalNamespace)
+	other := utils.NewRandomNodeID(utils.GlobalNamespace)
+	p.queuePacket(protocol.Packet{Dst: dst, Src: id, Type: protocol.TypeMsg, ID: [20]byte{1}})
+	p.queuePacket(protocol.Packet{Dst: other, Src: id, Type: protocol.TypeMsg, ID: [20]byte{2}})
+
+	done := make(chan bool, 2)
+	p.locateAsync(dst, func(found bool) { done <- found })
+	p.locateAsync(dst, func(found bool) { done <- found })
+	for i := 0; i < 2; i++ {
+		select {
+		case found := <-done:
+			if found {
+				t.Errorf("locateAsync() finds an unknown node")
+			}
+		case <-time.After(2 * locateTimeout):
+			t.Fatalf("locateAsync() does not call the callbacks")
+		}
+	}
+
+	now := time.Now()
+	p.sendQueued(dst, now)
+	q := p.queuedPackets[0]
+	if q.retries != 1 || !q.next.Equal(now.Add(2*time.Second)) {
+		t.Errorf("sendQueued() should back off; retries %d, next in %v", q.retries, q.next.Sub(now))
+	}
+	if p.queuedPackets[1].retries != 0 {
+		t.Errorf("sendQueued() should only retry the packets of the destination")
+	}
+	p.sendQueued(dst, now)
+	if len(p.queuedPackets) != 1 || !p.queuedPackets[0].pkt.Dst.Match(other) {
+		t.Errorf("sendQueued() should drop the packet after the last attempt")
+	}
+}
+
+func TestConnectAsync(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	router1, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router2, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+
+	n := NewMemoryNetwork(1)
+	if err := router1.RegisterTransport(n.Transport("node")); err != nil {
+		t.Fatal(err)
+	}
+	router1.hints.filter = func(utils.NodeID) bool { return true }
+	router1.hints.learn(router2.ID(), JoinTransportAddr(MemoryScheme, "node"))
+
+	if router1.openSession(router2.ID()) != nil {
+		t.Fatalf("openSession() returns a session before it is dialed")
+	}
+	ch := make(chan bool, 2)
+	router1.connectAsync(router2.ID(), func(found bool) { ch <- found })
+	router1.connectAsync(router2.ID(), func(found bool) { ch <- found })
+	for i := 0; i < 2; i++ {
+		select {
+		case found := <-ch:
+			if !found {
+				t.Errorf("connectAsync() reports no session; expects the dialed one")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("connectAsync() does not call back")
+		}
+	}
+	if router1.openSession(router2.ID()) == nil {
+		t.Errorf("openSession() returns nil after connectAsync()")
+	}
+}
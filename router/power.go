@@ -0,0 +1,91 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// Power modes of a router.
+const (
+	// PowerNormal runs the maintenance of the router every second.
+	PowerNormal = iota
+
+	// PowerLow trades latency for battery. The router wakes up every
+	// lowPowerTick, pings the peers every lowPowerPingInterval, runs the
+	// DHT maintenance and resends the queued messages in batches every
+	// lowPowerBatchInterval, and suspends the membership gossip and the
+	// cover traffic. Messages to nodes without a session can be delayed
+	// by up to lowPowerBatchInterval, and the peers which have gone away
+	// are detected after up to lowPowerPingInterval more.
+	PowerLow
+)
+
+const (
+	lowPowerTick          = 5 * time.Second
+	lowPowerPingInterval  = 30 * time.Second
+	lowPowerBatchInterval = time.Minute
+)
+
+// powerState holds the power mode and the time of the last batch of
+// maintenance.
+type powerState struct {
+	mode      int
+	lastBatch time.Time
+	mutex     sync.Mutex
+}
+
+// SetPowerMode sets the power mode of the router.
+func (p *Router) SetPowerMode(mode int) {
+	p.power.mutex.Lock()
+	defer p.power.mutex.Unlock()
+	p.power.mode = mode
+}
+
+// PowerMode returns the power mode of the router.
+func (p *Router) PowerMode() int {
+	p.power.mutex.Lock()
+	defer p.power.mutex.Unlock()
+	return p.power.mode
+}
+
+func (p *Router) lowPower() bool {
+	return p.PowerMode() == PowerLow
+}
+
+// tickInterval returns the interval of the maintenance loop.
+func (p *Router) tickInterval() time.Duration {
+	if p.lowPower() {
+		return lowPowerTick
+	}
+	return time.Second
+}
+
+// pingInterval returns the interval of the pings to the peers.
+func (p *Router) pingInterval() time.Duration {
+	if p.lowPower() && p.retry.Ping.Initial < lowPowerPingInterval {
+		return lowPowerPingInterval
+	}
+	return p.retry.Ping.Initial
+}
+
+// sessionTimeout returns the silence of a peer after which its session
+// is closed. It is extended in low-power mode, in which the peers may
+// only answer the less frequent pings of this node.
+func (p *Router) sessionTimeout() time.Duration {
+	if p.lowPower() {
+		return p.retry.Ping.Timeout + p.pingInterval()
+	}
+	return p.retry.Ping.Timeout
+}
+
+// batchDue reports whether the batched maintenance should run now.
+// It is always due in normal mode.
+func (p *Router) batchDue(now time.Time) bool {
+	p.power.mutex.Lock()
+	defer p.power.mutex.Unlock()
+	if p.power.mode == PowerLow && now.Sub(p.power.lastBatch) < lowPowerBatchInterval {
+		return false
+	}
+	p.power.lastBatch = now
+	return true
+}
@@ -0,0 +1,34 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestPowerMode(t *testing.T) {
+	p := &Router{retry: utils.DefaultRetryConfig}
+	now := time.Now()
+
+	if !p.batchDue(now) || !p.batchDue(now) {
+		t.Errorf("batchDue() returns false in normal mode; expects true")
+	}
+	if p.pingInterval() != time.Second || p.sessionTimeout() != 5*time.Second {
+		t.Errorf("normal mode should use the ping policy")
+	}
+
+	p.SetPowerMode(PowerLow)
+	if p.tickInterval() != lowPowerTick || p.pingInterval() != lowPowerPingInterval {
+		t.Errorf("low-power mode should widen the intervals")
+	}
+	if p.sessionTimeout() <= p.pingInterval() {
+		t.Errorf("sessionTimeout() returns %v; expects more than the ping interval", p.sessionTimeout())
+	}
+	if p.batchDue(now.Add(time.Second)) {
+		t.Errorf("batchDue() returns true within the batch interval")
+	}
+	if !p.batchDue(now.Add(lowPowerBatchInterval)) {
+		t.Errorf("batchDue() returns false after the batch interval")
+	}
+}
@@ -0,0 +1,102 @@
+package router
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Privacy levels. Each level includes the protections of the lower ones.
+const (
+	// PrivacyOff sends packets as they are.
+	PrivacyOff = iota
+
+	// PrivacyPadding pads packets to size buckets, so that observers
+	// cannot infer the length of messages.
+	PrivacyPadding
+
+	// PrivacyCover also sends pings of random sizes to random peers at
+	// random intervals, so that observers cannot tell when a
+	// conversation takes place.
+	PrivacyCover
+)
+
+// paddingBuckets are the sizes to which encoded packets are padded.
+// Larger packets are padded to a multiple of the last bucket.
+var paddingBuckets = []int{256, 1024, 4096, 16384}
+
+const (
+	// coverInterval is the mean interval between cover pings.
+	coverInterval = 10 * time.Second
+
+	// maxCoverPayload is the maximum payload size of a cover ping.
+	maxCoverPayload = 1024
+)
+
+// paddedSize returns the bucket size for an encoded packet of n bytes.
+func paddedSize(n int) int {
+	for _, b := range paddingBuckets {
+		if n <= b {
+			return b
+		}
+	}
+	last := paddingBuckets[len(paddingBuckets)-1]
+	return (n + last - 1) / last * last
+}
+
+func encodedSize(pkt *protocol.Packet) int {
+	data, err := msgpack.Marshal(pkt)
+	if err != nil {
+		return 0
+	}
+	return len(data)
+}
+
+// padPacket fills the Padding field of a signed packet so that its
+// encoding has the size of a bucket. Since the length prefix of the
+// padding grows with its size, the size is corrected a few times and
+// may be off by a few bytes in rare cases.
+func padPacket(pkt *protocol.Packet) {
+	pkt.Padding = nil
+	target := paddedSize(encodedSize(pkt) + 3)
+	for i := 0; i < 3; i++ {
+		d := target - encodedSize(pkt)
+		if d == 0 {
+			return
+		}
+		n := len(pkt.Padding) + d
+		if n < 0 {
+			n = 0
+		}
+		pkt.Padding = make([]byte, n)
+	}
+}
+
+// coverDelay returns the time until the next cover ping. The delays are
+// exponentially distributed, which makes the pings look like
+// independent events.
+func coverDelay() time.Duration {
+	return time.Duration(rand.ExpFloat64() * float64(coverInterval))
+}
+
+// sendCover sends a ping with a random payload to a random peer.
+// Receivers ignore the payload of pings.
+func (p *Router) sendCover() {
+	p.sessionMutex.RLock()
+	var list []*session
+	for _, s := range p.sessions {
+		list = append(list, s)
+	}
+	p.sessionMutex.RUnlock()
+	if len(list) == 0 {
+		return
+	}
+	s := list[rand.Intn(len(list))]
+	payload := make([]byte, rand.Intn(maxCoverPayload))
+	pkt, err := p.makePacket(s.ID(), protocol.TypePing, payload)
+	if err == nil {
+		p.send <- pkt
+	}
+}
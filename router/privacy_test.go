@@ -0,0 +1,43 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestPaddedSize(t *testing.T) {
+	cases := []struct {
+		n, size int
+	}{
+		{0, 256},
+		{256, 256},
+		{257, 1024},
+		{5000, 16384},
+		{16385, 32768},
+	}
+	for _, c := range cases {
+		if size := paddedSize(c.n); size != c.size {
+			t.Errorf("paddedSize(%d) returns %d; expects %d", c.n, size, c.size)
+		}
+	}
+}
+
+func TestPadPacket(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(utils.GlobalNamespace, key.Digest())
+	for _, n := range []int{0, 10, 100, 600, 3000, 20000} {
+		pkt := protocol.Packet{Dst: id, Src: id, Type: protocol.TypeMsg, Payload: make([]byte, n)}
+		pkt.Sign(key)
+		size := encodedSize(&pkt)
+		padPacket(&pkt)
+		padded := encodedSize(&pkt)
+		if padded != paddedSize(size+3) {
+			t.Errorf("padded packet with %d bytes of payload has %d bytes; expects %d", n, padded, paddedSize(size+3))
+		}
+		if !pkt.Verify(&key.PublicKey) {
+			t.Errorf("padded packet with %d bytes of payload cannot be verified", n)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	defaultRoomRate  = 5.0
+	defaultRoomBurst = 20
+	limiterIdle      = time.Minute
+)
+
+type limiterKey struct {
+	group utils.NodeID
+	src   utils.NodeID
+}
+
+type tokenBucket struct {
+	tokens   float64
+	last     time.Time
+	flooding bool
+}
+
+// rateLimiter limits the rate of messages per sender within each group
+// with token buckets.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[limiterKey]*tokenBucket
+	mutex   sync.Mutex
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate == 0 {
+		rate = defaultRoomRate
+	}
+	if burst == 0 {
+		burst = defaultRoomBurst
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[limiterKey]*tokenBucket),
+	}
+}
+
+// allow reports whether a message from src in the group is within the limit.
+// flood is true for the first message dropped after a period within the limit.
+func (l *rateLimiter) allow(group, src utils.NodeID, now time.Time) (ok bool, flood bool) {
+	if l.rate < 0 {
+		return true, false
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	k := limiterKey{group, src}
+	b, exist := l.buckets[k]
+	if !exist {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[k] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		b.flooding = false
+		return true, false
+	}
+	flood = !b.flooding
+	b.flooding = true
+	return false, flood
+}
+
+// prune removes the buckets of senders which have been idle.
+func (l *rateLimiter) prune(now time.Time) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > limiterIdle {
+			delete(l.buckets, k)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(1, 2)
+	group := utils.NewRandomNodeID(utils.GroupNamespace)
+	src := utils.NewRandomNodeID(namespace)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(group, src, now); !ok {
+			t.Errorf("message %d within the burst should be allowed", i)
+		}
+	}
+	if ok, flood := l.allow(group, src, now); ok || !flood {
+		t.Errorf("allow() returns %v, %v; expects false, true", ok, flood)
+	}
+	if ok, flood := l.allow(group, src, now); ok || flood {
+		t.Errorf("allow() returns %v, %v; expects false, false", ok, flood)
+	}
+	if ok, _ := l.allow(group, utils.NewRandomNodeID(namespace), now); !ok {
+		t.Errorf("other senders should not be limited")
+	}
+	if ok, _ := l.allow(group, src, now.Add(time.Second)); !ok {
+		t.Errorf("message should be allowed after the bucket is refilled")
+	}
+
+	l.prune(now.Add(time.Hour))
+	if len(l.buckets) != 0 {
+		t.Errorf("prune() leaves %d buckets", len(l.buckets))
+	}
+}
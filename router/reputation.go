@@ -0,0 +1,162 @@
+package router
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/utils"
+)
+
+// Kinds of misbehavior of peers.
+const (
+	AbuseInvalidSignature = "invalid-signature"
+	AbuseMalformed        = "malformed"
+	AbuseFlood            = "flood"
+	AbuseReported         = "reported"
+)
+
+var abusePenalties = map[string]float64{
+	AbuseInvalidSignature: 20,
+	AbuseMalformed:        5,
+	AbuseFlood:            10,
+	AbuseReported:         25,
+}
+
+const (
+	// MaxReputation is the reputation of peers without misbehavior.
+	MaxReputation = 100.0
+
+	// MinReputation is the reputation below which a peer is distrusted.
+	// Distrusted peers are removed from the routing tables, are not
+	// selected as relays and their messages are dropped.
+	MinReputation = 50.0
+
+	// reputationRecovery is the number of points recovered per hour.
+	reputationRecovery = 10.0
+)
+
+type reputation struct {
+	score float64
+	last  time.Time
+}
+
+// reputationTable holds the local reputation scores of the peers.
+// Scores are lowered by misbehavior and recover linearly over time.
+type reputationTable struct {
+	peers map[utils.NodeID]*reputation
+	mutex sync.Mutex
+}
+
+func newReputationTable() *reputationTable {
+	return &reputationTable{peers: make(map[utils.NodeID]*reputation)}
+}
+
+func (r *reputation) current(now time.Time) float64 {
+	s := r.score + now.Sub(r.last).Hours()*reputationRecovery
+	if s > MaxReputation {
+		return MaxReputation
+	}
+	return s
+}
+
+// penalize lowers the score of the peer and returns the old
+// and the new score.
+func (t *reputationTable) penalize(id utils.NodeID, penalty float64, now time.Time) (float64, float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	r, ok := t.peers[id]
+	if !ok {
+		r = &reputation{score: MaxReputation, last: now}
+		t.peers[id] = r
+	}
+	old := r.current(now)
+	r.score = old - penalty
+	if r.score < 0 {
+		r.score = 0
+	}
+	r.last = now
+	return old, r.score
+}
+
+func (t *reputationTable) score(id utils.NodeID, now time.Time) float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if r, ok := t.peers[id]; ok {
+		return r.current(now)
+	}
+	return MaxReputation
+}
+
+// prune removes the peers whose score has fully recovered.
+func (t *reputationTable) prune(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, r := range t.peers {
+		if r.current(now) >= MaxReputation {
+			delete(t.peers, id)
+		}
+	}
+}
+
+// reportMisbehavior lowers the reputation of the peer. When the peer
+// becomes distrusted, it is removed from the routing tables and its
+// session is closed.
+func (p *Router) reportMisbehavior(id utils.NodeID, kind string) {
+	old, score := p.reputation.penalize(id, abusePenalties[kind], time.Now())
+	p.logger.Info("Misbehavior of %s: %s (reputation %.0f)", id.String(), kind, score)
+	if old < MinReputation || score >= MinReputation {
+		return
+	}
+
+	p.logger.Info("Distrust %s", id.String())
+	p.dhtMutex.RLock()
+	p.mainDht.RemoveNode(id)
+	for _, d := range p.groupDht {
+		d.RemoveNode(id)
+	}
+	p.dhtMutex.RUnlock()
+
+	p.sessionMutex.RLock()
+	s := p.sessions[id]
+	p.sessionMutex.RUnlock()
+	if s != nil {
+		p.removeSession(s)
+	}
+}
+
+// ReportAbuse lowers the reputation of the peer on behalf of
+// the application, for example when its user reports spam.
+func (p *Router) ReportAbuse(id utils.NodeID) {
+	p.reportMisbehavior(id, AbuseReported)
+}
+
+// Reputation returns the local reputation score of the peer,
+// from 0 to MaxReputation.
+func (p *Router) Reputation(id utils.NodeID) float64 {
+	return p.reputation.score(id, time.Now())
+}
+
+// Trusted reports whether the reputation of the peer
+// is at least MinReputation.
+func (p *Router) Trusted(id utils.NodeID) bool {
+	return p.Reputation(id) >= MinReputation
+}
+
+// Ban ignores the DHT packets from the IP address for d, or until Unban
+// if d is zero. Sessions are not affected.
+func (p *Router) Ban(ip net.IP, d time.Duration, reason string) {
+	p.guard.Ban(ip, d, reason)
+}
+
+// Unban lifts the ban of the IP address.
+func (p *Router) Unban(ip net.IP) {
+	p.guard.Unban(ip)
+}
+
+// Bans returns the IP addresses whose DHT packets are ignored, either
+// banned with Ban or automatically for sending malformed packets.
+func (p *Router) Bans() []dht.Ban {
+	return p.guard.Bans()
+}
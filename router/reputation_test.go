@@ -0,0 +1,41 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestReputation(t *testing.T) {
+	r := newReputationTable()
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+
+	if s := r.score(id, now); s != MaxReputation {
+		t.Errorf("score() returns %v; expects %v", s, MaxReputation)
+	}
+
+	old, s := r.penalize(id, abusePenalties[AbuseInvalidSignature], now)
+	if old != MaxReputation || s != MaxReputation-20 {
+		t.Errorf("penalize() returns %v, %v; expects %v, %v", old, s, MaxReputation, MaxReputation-20)
+	}
+	r.penalize(id, abusePenalties[AbuseReported], now)
+	r.penalize(id, abusePenalties[AbuseFlood], now)
+	if s := r.score(id, now); s >= MinReputation {
+		t.Errorf("score() returns %v; expects less than %v", s, MinReputation)
+	}
+
+	if s := r.score(id, now.Add(time.Hour)); s != MaxReputation-45 {
+		t.Errorf("score() returns %v after an hour; expects %v", s, MaxReputation-45)
+	}
+
+	r.prune(now.Add(time.Hour))
+	if len(r.peers) != 1 {
+		t.Errorf("peer should not be pruned before recovery")
+	}
+	r.prune(now.Add(10 * time.Hour))
+	if len(r.peers) != 0 {
+		t.Errorf("recovered peer should be pruned")
+	}
+}
@@ -0,0 +1,39 @@
+package router
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// dialBackoff holds the failed dials to a node.
+type dialBackoff struct {
+	failures int
+	next     time.Time
+}
+
+// dialAllowed reports whether the node can be dialed, which is not the
+// case until the delay of the dial policy after a failed dial has passed.
+func (p *Router) dialAllowed(id utils.NodeID, now time.Time) bool {
+	p.dialMutex.Lock()
+	defer p.dialMutex.Unlock()
+	b, ok := p.dials[id]
+	return !ok || !now.Before(b.next)
+}
+
+// dialFailed delays the next dial to the node.
+func (p *Router) dialFailed(id utils.NodeID, now time.Time) {
+	p.dialMutex.Lock()
+	defer p.dialMutex.Unlock()
+	b := p.dials[id]
+	b.failures++
+	b.next = now.Add(p.retry.Dial.Delay(b.failures))
+	p.dials[id] = b
+}
+
+// dialSucceeded forgets the failed dials to the node.
+func (p *Router) dialSucceeded(id utils.NodeID) {
+	p.dialMutex.Lock()
+	defer p.dialMutex.Unlock()
+	delete(p.dials, id)
+}
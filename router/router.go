@@ -3,6 +3,7 @@ package router
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"errors"
 	"net"
@@ -11,38 +12,133 @@ import (
 	"time"
 
 	"github.com/h2so5/murcott/dht"
-	"github.com/h2so5/murcott/internal"
 	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
 	"github.com/h2so5/murcott/utils"
 	"github.com/h2so5/utp"
 )
 
 type Message struct {
 	Node    utils.NodeID
+	Dst     utils.NodeID
 	Payload []byte
 	ID      []byte
 }
 
+// Conversation returns the group of a group message, or the sender otherwise.
+func (m Message) Conversation() utils.NodeID {
+	if bytes.Equal(m.Dst.NS[:], utils.GroupNamespace[:]) {
+		return m.Dst
+	}
+	return m.Node
+}
+
 type Router struct {
 	id       utils.NodeID
 	mainDht  *dht.DHT
 	groupDht map[utils.NodeID]*dht.DHT
 	dhtMutex sync.RWMutex
 
-	listener *utp.Listener
-	key      *utils.PrivateKey
-
-	sessions     map[utils.NodeID]*session
-	sessionMutex sync.RWMutex
+	// tablePath is the file which retains the routing table
+	// of the main DHT.
+	tablePath string
+
+	dispatcher *dispatcher
+	supervisor *supervisor
+
+	transport    *Transport
+	ownTransport bool
+	key          *utils.PrivateKey
+
+	sessions      map[utils.NodeID]*session
+	closedTraffic Traffic
+	sessionMutex  sync.RWMutex
+
+	retry     utils.RetryConfig
+	alpha     int
+	replicas  int
+	dials     map[utils.NodeID]dialBackoff
+	preferred map[utils.NodeID]string
+	dialMutex sync.Mutex
+
+	power     powerState
+	keepalive keepaliveState
+	wake      wakeState
+	hints     routeHints
+
+	queuedPackets   []*queuedPacket
+	queueMutex      sync.Mutex
+	locating        map[utils.NodeID][]func(found bool)
+	connecting      map[utils.NodeID][]func(found bool)
+	locateMutex     sync.Mutex
+	receivedPackets *utils.DuplicateFilter
+	stats           Stats
+	statsMutex      sync.Mutex
+
+	trees     map[utils.NodeID]*broadcastTree
+	treeMutex sync.Mutex
+
+	ingress      map[utils.NodeID][]utils.NodeID
+	ingressMutex sync.Mutex
+
+	members       map[utils.NodeID]map[utils.NodeID]MemberRecord
+	ownMembers    map[utils.NodeID]MemberRecord
+	countersigned map[utils.NodeID]bool
+	memberMutex   sync.RWMutex
+
+	admission admissionState
+
+	caps      CapabilityRecord
+	peerCaps  map[utils.NodeID]cachedCapabilities
+	capsMutex sync.RWMutex
+
+	probes            []ProbeResult
+	bootstrapAddrs    []net.UDPAddr
+	bootstrapAttempts int
+	nextBootstrap     time.Time
+	bootstrapNodes    int
+	joined            bool
+	lastNeighborhood  time.Time
+	bootstrapMutex    sync.Mutex
+
+	addrs               []string
+	route               string
+	connectivityHandler func(addrs []string)
+	netMutex            sync.Mutex
+
+	announced     map[string]bool
+	announceMutex sync.Mutex
+
+	offsets    map[utils.NodeID]time.Duration
+	clockMutex sync.RWMutex
+
+	privacy int
+
+	// observer is not nil if the node is a read-only monitor.
+	observer *observer
+
+	reputation *reputationTable
+	governor   *governor
+	guard      *dht.Guard
+	versions   *versionTable
+
+	limiter      *rateLimiter
+	floodHandler func(group, src utils.NodeID)
+	floodMutex   sync.RWMutex
+
+	logger    *log.Logger
+	recv      chan Message
+	send      chan protocol.Packet
+	exit      chan int
+	closeOnce sync.Once
+}
 
-	queuedPackets   []internal.Packet
-	receivedPackets map[[20]byte]int
+// locateTimeout is the maximum duration of a lookup for a queued packet.
+const locateTimeout = 2 * time.Second
 
-	logger *log.Logger
-	recv   chan Message
-	send   chan internal.Packet
-	exit   chan int
-}
+// valueStoreMaxAge is the age after which persistent DHT records
+// which have not been stored again are discarded on startup.
+const valueStoreMaxAge = dht.ValueTTL
 
 func getOpenPortConn(config utils.Config) (*utp.Listener, error) {
 	for _, port := range config.Ports() {
@@ -56,39 +152,143 @@ func getOpenPortConn(config utils.Config) (*utp.Listener, error) {
 }
 
 func NewRouter(key *utils.PrivateKey, logger *log.Logger, config utils.Config) (*Router, error) {
-	exit := make(chan int)
-	listener, err := getOpenPortConn(config)
+	t, err := NewTransport(logger, config)
 	if err != nil {
 		return nil, err
 	}
+	r, err := newRouter(key, logger, config, t)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	r.ownTransport = true
+	return r, nil
+}
 
-	logger.Info("Node ID: %s", key.Digest().String())
-	logger.Info("Node Socket: %v", listener.Addr())
+// NewSharedRouter creates a router which uses the given transport.
+// The transport can be shared by the routers of several identities.
+// It is not closed with the router.
+func NewSharedRouter(key *utils.PrivateKey, logger *log.Logger, config utils.Config, t *Transport) (*Router, error) {
+	return newRouter(key, logger, config, t)
+}
+
+func newRouter(key *utils.PrivateKey, logger *log.Logger, config utils.Config, t *Transport) (*Router, error) {
+	exit := make(chan int)
+	sup := newSupervisor(exit, logger)
 
 	ns := utils.GlobalNamespace
 	id := utils.NewNodeID(ns, key.Digest())
 
-	r := Router{
-		id:       id,
-		listener: listener,
-		key:      key,
-		sessions: make(map[utils.NodeID]*session),
-		mainDht:  dht.NewDHT(10, id, id, listener.RawConn, logger),
-		groupDht: make(map[utils.NodeID]*dht.DHT),
+	mainDht := dht.NewDHT(10, id, id, t.conn(), logger)
+	guard := dht.NewGuard(config.DHTRate, config.DHTBurst)
+	guard.SetAutoBan(config.NetworkKey != "")
+	mainDht.SetGuard(guard)
+	if config.ValueStore != "" {
+		s, err := dht.OpenBoltValueStore(config.ValueStore, valueStoreMaxAge)
+		if err != nil {
+			return nil, err
+		}
+		mainDht.SetValueStore(s)
+	}
+	if config.RoutingTable != "" {
+		loadTableFile(mainDht, config.RoutingTable, logger)
+	}
+
+	logger.Info("Node ID: %s", key.Digest().String())
+	logger.Info("Node Socket: %v", t.Addr())
 
-		receivedPackets: make(map[[20]byte]int),
+	r := Router{
+		id:        id,
+		transport: t,
+		key:       key,
+		sessions:  make(map[utils.NodeID]*session),
+		retry:     config.Retry.WithDefaults(),
+		alpha:     config.LookupAlpha,
+		replicas:  config.Replication,
+		dials:     make(map[utils.NodeID]dialBackoff),
+		keepalive: newKeepaliveState(config),
+		mainDht:   mainDht,
+		groupDht:  make(map[utils.NodeID]*dht.DHT),
+		tablePath: config.RoutingTable,
+
+		dispatcher: newDispatcher(id, mainDht, sup),
+		supervisor: sup,
+
+		receivedPackets: utils.NewDuplicateFilter(config.DedupCapacity, config.DedupFalsePositive),
+		trees:           make(map[utils.NodeID]*broadcastTree),
+		ingress:         make(map[utils.NodeID][]utils.NodeID),
+
+		members:       make(map[utils.NodeID]map[utils.NodeID]MemberRecord),
+		ownMembers:    make(map[utils.NodeID]MemberRecord),
+		countersigned: make(map[utils.NodeID]bool),
+
+		caps:     newCapabilityRecord(id, config),
+		peerCaps: make(map[utils.NodeID]cachedCapabilities),
+
+		announced: make(map[string]bool),
+		offsets:   make(map[utils.NodeID]time.Duration),
+
+		privacy:    config.Privacy,
+		reputation: newReputationTable(),
+		governor:   newGovernor(config),
+		guard:      guard,
+		versions:   newVersionTable(config.MinProtocol),
+		limiter:    newRateLimiter(config.RoomRate, config.RoomBurst),
 
 		logger: logger,
 		recv:   make(chan Message, 100),
-		send:   make(chan internal.Packet, 100),
+		send:   make(chan protocol.Packet, 100),
 		exit:   exit,
 	}
 
-	go r.run()
+	if config.Observer {
+		r.observer = &observer{}
+	}
+	r.bootstrapNodes = config.BootstrapNodes
+	if r.bootstrapNodes <= 0 {
+		r.bootstrapNodes = 1
+	}
+
+	mainDht.SetNodeFilter(r.Trusted)
+	mainDht.SetMaxPendingRPCs(r.governor.maxPendingRPCs)
+	mainDht.SetRetryPolicy(r.retry.RPC)
+	mainDht.SetLookupAlpha(r.alpha)
+	mainDht.SetReplication(r.replicas)
+
+	err := r.caps.sign(key)
+	if err != nil {
+		r.dispatcher.close()
+		mainDht.Close()
+		return nil, err
+	}
+
+	err = t.add(&r)
+	if err != nil {
+		r.dispatcher.close()
+		mainDht.Close()
+		return nil, err
+	}
+
+	go r.supervisor.run(SubsystemRouter, r.run)
+	if t.mesh {
+		go r.supervisor.run(SubsystemRouter, r.runMDNS)
+	}
 	return &r, nil
 }
 
+// Discover sends discovery packets to the given nodes. When several
+// nodes are given, they are probed concurrently and the group DHTs only
+// discover the fastest ones. All of them are discovered again with
+// backoff until the node is bootstrapped.
 func (p *Router) Discover(addrs []net.UDPAddr) {
+	for _, addr := range addrs {
+		p.guard.Exempt(addr.IP)
+	}
+	p.addBootstrapNodes(addrs, time.Now())
+	if len(addrs) > 1 {
+		go p.bootstrap(addrs)
+		return
+	}
 	p.dhtMutex.RLock()
 	defer p.dhtMutex.RUnlock()
 	for _, addr := range addrs {
@@ -98,6 +298,8 @@ func (p *Router) Discover(addrs []net.UDPAddr) {
 		}
 		p.logger.Info("Sent discovery packet to %v:%d", addr.IP, addr.Port)
 	}
+	go p.publishCapabilities()
+	go p.publishAddress()
 }
 
 func (p *Router) getGroupDht(group utils.NodeID) *dht.DHT {
@@ -108,18 +310,21 @@ func (p *Router) getGroupDht(group utils.NodeID) *dht.DHT {
 
 func (p *Router) Join(group utils.NodeID) error {
 	if p.getGroupDht(group) == nil {
-		d := dht.NewDHT(10, p.ID(), group, p.listener.RawConn, p.logger)
-		for _, n := range p.mainDht.LoadNodes(group.String()) {
-			if !n.ID.Match(p.id) {
-				d.Discover(n.Addr)
-			}
+		d := dht.NewDHT(10, p.ID(), group, p.transport.conn(), p.logger)
+		d.SetNodeFilter(p.memberFilter(group))
+		d.SetGuard(p.guard)
+		d.SetMaxPendingRPCs(p.governor.maxPendingRPCs)
+		d.SetRetryPolicy(p.retry.RPC)
+		d.SetLookupAlpha(p.alpha)
+		d.SetReplication(p.replicas)
+		for _, r := range p.loadMembers(group) {
+			discoverMember(d, r)
 		}
 		p.dhtMutex.Lock()
 		p.groupDht[group] = d
 		p.dhtMutex.Unlock()
-		p.mainDht.StoreNodes(group.String(), []utils.NodeInfo{
-			utils.NodeInfo{ID: p.id, Addr: p.listener.Addr()},
-		})
+		p.dispatcher.add(group, d)
+		p.publishMembership(group)
 		return nil
 	}
 	return errors.New("already joined")
@@ -130,18 +335,111 @@ func (p *Router) Leave(group utils.NodeID) error {
 		p.dhtMutex.Lock()
 		delete(p.groupDht, group)
 		p.dhtMutex.Unlock()
+		p.dispatcher.remove(group)
+		p.treeMutex.Lock()
+		delete(p.trees, group)
+		p.treeMutex.Unlock()
+		p.ingressMutex.Lock()
+		delete(p.ingress, group)
+		p.ingressMutex.Unlock()
+		p.memberMutex.Lock()
+		delete(p.members, group)
+		p.memberMutex.Unlock()
+		p.forgetAdmissions(group)
 		return nil
 	}
 	return errors.New("not joined")
 }
 
+// Announce registers this node as a provider of the given key in the DHT.
+// The key is announced again when the addresses of this node change.
+func (p *Router) Announce(key string) {
+	p.announceMutex.Lock()
+	p.announced[key] = true
+	p.announceMutex.Unlock()
+	p.mainDht.StoreNodes(key, []utils.NodeInfo{
+		utils.NodeInfo{ID: p.id, Addr: p.transport.Addr()},
+	})
+}
+
+// Providers returns the nodes which have announced the given key.
+func (p *Router) Providers(key string) []utils.NodeInfo {
+	var nodes []utils.NodeInfo
+	for _, n := range p.mainDht.LoadNodes(key) {
+		if !n.ID.Match(p.id) {
+			p.mainDht.AddNode(n)
+			nodes = append(nodes, n)
+		}
+	}
+	return nodes
+}
+
+// StoreValue stores the value at the given key in the main DHT.
+func (p *Router) StoreValue(key, value string) {
+	p.mainDht.StoreValue(key, value)
+}
+
+// LoadValue returns the value at the given key in the main DHT.
+func (p *Router) LoadValue(key string) *string {
+	return p.mainDht.LoadValue(key)
+}
+
+// StoreSignedValue stores a record of the given name signed by this node
+// in the main DHT. Only this node can replace it.
+func (p *Router) StoreSignedValue(name, value string) error {
+	return p.mainDht.StoreSigned(name, value, p.key)
+}
+
+// LoadSignedValue returns the record of the given name
+// signed by the given node in the main DHT.
+func (p *Router) LoadSignedValue(id utils.NodeID, name string) *string {
+	return p.mainDht.LoadSigned(id.Digest, name)
+}
+
+// StoreSet adds the values to the set at the given key in the main DHT.
+func (p *Router) StoreSet(key string, values []string) {
+	p.mainDht.StoreSet(key, values)
+}
+
+// LoadSet returns the set at the given key in the main DHT.
+func (p *Router) LoadSet(key string) []string {
+	return p.mainDht.LoadSet(key)
+}
+
+// StoreMultiValue adds the value published by this node for the given
+// time to the multi-value key in the main DHT.
+func (p *Router) StoreMultiValue(key, value string, ttl time.Duration) {
+	p.mainDht.StoreMultiValue(key, value, ttl)
+}
+
+// LoadMultiValues returns the values of all the publishers
+// of the multi-value key in the main DHT.
+func (p *Router) LoadMultiValues(key string) []dht.MultiValue {
+	return p.mainDht.LoadMultiValues(key)
+}
+
+// MemberCount returns the number of known members of a joined group.
+func (p *Router) MemberCount(group utils.NodeID) int {
+	return len(p.groupMembers(group))
+}
+
 func (p *Router) SendMessage(dst utils.NodeID, payload []byte) error {
-	pkt, err := p.makePacket(dst, "msg", payload)
+	_, err := p.SendMessageID(dst, payload)
+	return err
+}
+
+// SendMessageID sends the message like SendMessage and returns the ID of
+// its packet, with which it can be found in the outbox and cancelled.
+func (p *Router) SendMessageID(dst utils.NodeID, payload []byte) ([20]byte, error) {
+	if p.observer != nil {
+		return [20]byte{}, errObserver
+	}
+	pkt, err := p.makePacket(dst, protocol.TypeMsg, payload)
 	if err != nil {
-		return err
+		return [20]byte{}, err
 	}
 	p.send <- pkt
-	return nil
+	return pkt.ID, nil
 }
 
 func (p *Router) SendPing() {
@@ -154,8 +452,14 @@ func (p *Router) SendPing() {
 	p.sessionMutex.RUnlock()
 
 	for _, id := range list {
-		pkt, err := p.makePacket(id, "ping", nil)
+		pkt, err := p.makePacket(id, protocol.TypePing, nil)
 		if err == nil {
+			p.sessionMutex.RLock()
+			s := p.sessions[id]
+			p.sessionMutex.RUnlock()
+			if s != nil {
+				s.ping(pkt.ID, time.Now())
+			}
 			p.send <- pkt
 		}
 	}
@@ -169,104 +473,149 @@ func (p *Router) RecvMessage() (Message, error) {
 }
 
 func (p *Router) run() {
-	acceptch := make(chan *session)
-
-	go func() {
-		for {
-			conn, err := p.listener.Accept()
-			if err != nil {
-				p.logger.Error("%v", err)
-				return
-			}
-			s, err := newSesion(conn, p.key)
-			if err != nil {
-				conn.Close()
-				p.logger.Error("%v", err)
-				continue
-			} else {
-				go p.readSession(s)
-				acceptch <- s
-			}
-		}
-	}()
+	interval := p.tickInterval()
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
 
-	go func() {
-		var b [102400]byte
-		for {
-			l, addr, err := p.listener.RawConn.ReadFrom(b[:])
-			if err != nil {
-				p.logger.Error("%v", err)
-				return
-			}
-			p.dhtMutex.RLock()
-			p.mainDht.ProcessPacket(b[:l], addr)
-			for _, d := range p.groupDht {
-				d.ProcessPacket(b[:l], addr)
-			}
-			p.dhtMutex.RUnlock()
-		}
-	}()
+	gossip := time.NewTicker(gossipInterval)
+	defer gossip.Stop()
 
-	tick := time.NewTicker(time.Second * 1)
-	defer tick.Stop()
+	publish := time.NewTicker(capabilityInterval)
+	defer publish.Stop()
+
+	netwatch := time.NewTicker(connectivityInterval)
+	defer netwatch.Stop()
+	p.updateNetwork(localAddrs(), defaultRoute())
+
+	var cover <-chan time.Time
+	if p.privacy >= PrivacyCover {
+		cover = time.After(coverDelay())
+	}
+
+	var lastPing time.Time
+
+	var observe <-chan time.Time
+	if p.observer != nil {
+		t := time.NewTicker(observeInterval)
+		defer t.Stop()
+		observe = t.C
+	}
 
 	for {
 		select {
-		case s := <-acceptch:
-			p.addSession(s)
 		case pkt := <-p.send:
-			sessions := p.getSessions(pkt.Dst)
-			if len(sessions) > 0 {
+			// Only the open sessions are used here. The packets without
+			// one wait in the queue while the sessions are dialed in the
+			// background.
+			sessions, found := p.routeSessions(pkt, false)
+			if found {
 				for _, s := range sessions {
 					err := s.Write(pkt)
 					if err != nil {
 						p.logger.Error("Remove session(%s): %v", pkt.Dst.String(), err)
 						p.removeSession(s)
-						p.queuedPackets = append(p.queuedPackets, pkt)
+						p.queuePacket(pkt)
 					}
 				}
-			} else {
-				p.logger.Error("Route not found: %v", pkt.Dst)
-				p.queuedPackets = append(p.queuedPackets, pkt)
-			}
-		case <-tick.C:
-			p.SendPing()
-			var rest []internal.Packet
-			for _, pkt := range p.queuedPackets {
-				p.dhtMutex.RLock()
-				p.mainDht.FindNearestNode(pkt.Dst)
-				for _, d := range p.groupDht {
-					d.FindNearestNode(pkt.Dst)
+				if bytes.Equal(pkt.Dst.NS[:], utils.GroupNamespace[:]) {
+					p.connectAsync(pkt.Dst, nil)
 				}
-				p.dhtMutex.RUnlock()
-				sessions := p.getSessions(pkt.Dst)
-				if len(sessions) > 0 {
-					for _, s := range sessions {
-						err := s.Write(pkt)
-						if err != nil {
-							p.logger.Error("Remove session(%s): %v", pkt.Dst.String(), err)
-							p.removeSession(s)
-							rest = append(rest, pkt)
+			} else {
+				p.queuePacket(pkt)
+				dst := pkt.Dst
+				wake := pkt.Type == protocol.TypeMsg && pkt.Src.Match(p.id) && !bytes.Equal(pkt.Dst.NS[:], utils.GroupNamespace[:])
+				p.connectAsync(dst, func(found bool) {
+					if found {
+						p.sendQueued(dst, time.Now())
+						return
+					}
+					p.logger.Error("Route not found: %v", dst)
+					p.locateAsync(dst, func(found bool) {
+						if found {
+							p.sendQueued(dst, time.Now())
 						}
+					})
+					if wake {
+						p.notifyWake(dst)
 					}
-				} else {
-					p.logger.Error("Route not found: %v", pkt.Dst)
-					rest = append(rest, pkt)
-				}
+				})
+			}
+		case <-tick.C:
+			if i := p.tickInterval(); i != interval {
+				interval = i
+				tick.Reset(interval)
 			}
-			p.queuedPackets = rest
+			if now := time.Now(); now.Sub(lastPing) >= p.pingInterval() {
+				p.SendPing()
+				lastPing = now
+			}
+			p.limiter.prune(time.Now())
+			p.reputation.prune(time.Now())
+			p.guard.Prune(time.Now())
+			p.checkVersions(time.Now())
+			p.checkSessions(time.Now())
+			if p.keepalive.due(time.Now()) {
+				p.supervisor.spawn(SubsystemRouter, p.sendKeepalives)
+			}
+			if p.batchDue(time.Now()) {
+				p.supervisor.spawn(SubsystemRouter, p.repairTrees)
+				p.supervisor.spawn(SubsystemRouter, func() { p.retryBootstrap(time.Now()) })
+				p.supervisor.spawn(SubsystemRouter, func() { p.maintainNeighborhood(time.Now()) })
+				p.supervisor.spawn(SubsystemRouter, func() { p.maintainValues(time.Now()) })
+				p.retryQueued(time.Now())
+			}
+		case <-gossip.C:
+			if !p.lowPower() {
+				p.supervisor.spawn(SubsystemRouter, p.gossipMembership)
+			}
+		case <-publish.C:
+			p.supervisor.spawn(SubsystemRouter, p.publishCapabilities)
+			p.supervisor.spawn(SubsystemRouter, p.publishAddress)
+			p.supervisor.spawn(SubsystemRouter, p.publishMemberships)
+		case <-netwatch.C:
+			p.supervisor.spawn(SubsystemRouter, p.checkConnectivity)
+		case <-cover:
+			if !p.lowPower() {
+				p.supervisor.spawn(SubsystemRouter, p.sendCover)
+			}
+			cover = time.After(coverDelay())
+		case <-observe:
+			p.supervisor.spawn(SubsystemRouter, func() { p.observe(time.Now()) })
 		case <-p.exit:
 			return
 		}
 	}
 }
 
+// accept adds a session which has been accepted by the transport.
+func (p *Router) accept(s *session) {
+	s.padding = p.privacy >= PrivacyPadding
+	go p.readSession(s)
+	p.addSession(s)
+}
+
+// processCommand passes a command received by the transport
+// to the DHT of its network.
+func (p *Router) processCommand(c protocol.RPCCommand, addr net.Addr) {
+	p.dispatcher.dispatch(c, addr)
+}
+
 func (p *Router) addSession(s *session) {
 	p.sessionMutex.Lock()
 	defer p.sessionMutex.Unlock()
 	id := s.ID()
 	if _, ok := p.sessions[id]; !ok {
 		p.sessions[id] = s
+		p.setClockOffset(id, s.offset)
+		p.checkCapabilities(id, s.version)
+		p.versions.seen(id, s.agent, s.peerHello.Offer, time.Now())
+		// The peers which send their record in the handshake have
+		// received this one too.
+		if len(s.peerHello.Caps) > 0 {
+			go p.processCapabilities(id, s.peerHello.Caps)
+		} else {
+			go p.sendCapabilities(s)
+		}
 	}
 }
 
@@ -274,61 +623,172 @@ func (p *Router) removeSession(s *session) {
 	p.sessionMutex.Lock()
 	defer p.sessionMutex.Unlock()
 	s.Close()
+	if p.sessions[s.ID()] == s {
+		p.closedTraffic.add(s.counter.traffic())
+	}
 	delete(p.sessions, s.ID())
 }
 
 func (p *Router) readSession(s *session) {
+	defer func() {
+		if v := recover(); v != nil {
+			p.supervisor.crashed(SubsystemSession, v)
+			p.removeSession(s)
+		}
+	}()
 	for {
 		pkt, err := s.Read()
+		if err == errInvalidSignature {
+			p.reportMisbehavior(s.ID(), AbuseInvalidSignature)
+		}
 		if err != nil {
 			p.logger.Error("Remove session(%s): %v", pkt.Dst.String(), err)
 			p.removeSession(s)
 			return
 		}
+		s.seen(time.Now())
 		if pkt.Src.Match(p.id) {
 			continue
 		}
-		d := pkt.Digest()
-		if _, ok := p.receivedPackets[d]; ok {
+		if err := checkNamespaces(pkt.Src, pkt.Dst, pkt.Type); err != nil {
+			p.logger.Error("Drop packet: %v", err)
+			p.reportMisbehavior(s.ID(), AbuseMalformed)
 			continue
-		} else {
-			p.receivedPackets[d] = 0
 		}
 		group := bytes.Equal(pkt.Dst.NS[:], utils.GroupNamespace[:])
+		if !p.acceptPacket(pkt) {
+			if group && p.getGroupDht(pkt.Dst) != nil {
+				p.pruneTree(pkt.Dst, s.ID())
+			}
+			continue
+		}
 		if group {
 			d := p.getGroupDht(pkt.Dst)
 			if d != nil {
-				pkt.TTL--
-				if pkt.TTL > 0 {
-					p.send <- pkt
+				if !p.admitted(pkt.Dst, pkt.Src) || !p.admitted(pkt.Dst, s.ID()) {
+					continue
+				}
+				if !p.allowGroupPacket(pkt) {
+					continue
 				}
+				p.deliverTree(s.ID(), pkt)
+				p.forwardPacket(pkt)
 			} else {
 				continue
 			}
 		}
-		if pkt.Type == "msg" && (!group || p.getGroupDht(pkt.Dst) != nil) {
+		if pkt.Type == protocol.TypePing && !group {
+			p.handle(func() { p.sendPong(s, pkt.ID) })
+			continue
+		}
+		if pkt.Type == protocol.TypePong && !group {
+			s.pong(pkt.Payload, time.Now())
+			continue
+		}
+		if pkt.Type == protocol.TypeMember && !group {
+			p.handle(func() { p.processMembership(pkt.Src, pkt.Payload) })
+			continue
+		}
+		if pkt.Type == protocol.TypeCaps && !group {
+			p.handle(func() { p.processCapabilities(pkt.Src, pkt.Payload) })
+			continue
+		}
+		if pkt.Type == protocol.TypeWakeRegister && !group {
+			p.handle(func() { p.processWakeRegistration(pkt.Src, pkt.Payload) })
+			continue
+		}
+		if pkt.Type == protocol.TypeWake && !group {
+			p.handle(func() { p.processWake(pkt.Payload) })
+			continue
+		}
+		if (pkt.Type == protocol.TypePrune || pkt.Type == protocol.TypeIHave || pkt.Type == protocol.TypeGraft) && !group {
+			p.handle(func() { p.processTree(pkt.Type, pkt.Src, pkt.Payload) })
+			continue
+		}
+		if pkt.Type == protocol.TypeMsg && (!group || p.getGroupDht(pkt.Dst) != nil) && p.Trusted(pkt.Src) {
 			id, _ := time.Now().MarshalBinary()
-			p.recv <- Message{Node: pkt.Src, Payload: pkt.Payload, ID: id}
+			p.recv <- Message{Node: pkt.Src, Dst: pkt.Dst, Payload: pkt.Payload, ID: id}
+		}
+	}
+}
+
+// SetFloodHandler sets a function which is called when a sender
+// starts exceeding the message rate limit of a group.
+func (p *Router) SetFloodHandler(h func(group, src utils.NodeID)) {
+	p.floodMutex.Lock()
+	defer p.floodMutex.Unlock()
+	p.floodHandler = h
+}
+
+// allowGroupPacket reports whether the packet is within the rate limit
+// of its sender in the group. Packets exceeding the limit are neither
+// delivered nor forwarded.
+func (p *Router) allowGroupPacket(pkt protocol.Packet) bool {
+	ok, flood := p.limiter.allow(pkt.Dst, pkt.Src, time.Now())
+	if flood {
+		p.logger.Info("Flood from %s in %s", pkt.Src.String(), pkt.Dst.String())
+		p.reportMisbehavior(pkt.Src, AbuseFlood)
+		p.floodMutex.RLock()
+		h := p.floodHandler
+		p.floodMutex.RUnlock()
+		if h != nil {
+			h(pkt.Dst, pkt.Src)
 		}
 	}
+	return ok
 }
 
-func (p *Router) getSessions(id utils.NodeID) []*session {
+// locate looks up the given ID in the DHTs. The lookup stops
+// as soon as the address of the node is found.
+func (p *Router) locate(id utils.NodeID) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), locateTimeout)
+	defer cancel()
+
+	p.dhtMutex.RLock()
+	dhts := []*dht.DHT{p.mainDht}
+	for _, d := range p.groupDht {
+		dhts = append(dhts, d)
+	}
+	p.dhtMutex.RUnlock()
+
+	for _, d := range dhts {
+		for r := range d.FindNode(ctx, id) {
+			if r.Node.ID.Match(id) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// getSessions returns the sessions to the node, or to the members of the
+// group. The missing sessions are dialed and the members looked up only
+// if dial is true, which blocks and must not be done by the run loop.
+func (p *Router) getSessions(id utils.NodeID, dial bool) []*session {
+	get := p.openSession
+	if dial {
+		get = p.getDirectSession
+	}
 	var sessions []*session
 	if bytes.Equal(id.NS[:], utils.GlobalNamespace[:]) {
-		s := p.getDirectSession(id)
+		s := get(id)
 		if s != nil {
 			sessions = append(sessions, s)
 		}
 	} else {
-		if d, ok := p.groupDht[id]; ok {
-			for _, n := range p.mainDht.LoadNodes(id.String()) {
-				if !n.ID.Match(p.id) {
-					d.Discover(n.Addr)
+		if d := p.getGroupDht(id); d != nil {
+			if dial {
+				for _, r := range p.loadMembers(id) {
+					if d.GetNodeInfo(r.ID) == nil {
+						discoverMember(d, r)
+					}
 				}
 			}
 			for _, n := range d.FingerNodes() {
-				s := p.getDirectSession(n.ID)
+				if !p.isMember(id, n.ID) {
+					continue
+				}
+				s := get(n.ID)
 				if s != nil {
 					sessions = append(sessions, s)
 				}
@@ -338,6 +798,16 @@ func (p *Router) getSessions(id utils.NodeID) []*session {
 	return sessions
 }
 
+// openSession returns the open session to the node, or nil.
+func (p *Router) openSession(id utils.NodeID) *session {
+	p.sessionMutex.RLock()
+	defer p.sessionMutex.RUnlock()
+	return p.sessions[id]
+}
+
+// getDirectSession returns the session to the node, and dials it if there
+// is none, looking up its address if needed. It blocks, so it is only
+// called by the workers which dial the sessions, never by the run loop.
 func (p *Router) getDirectSession(id utils.NodeID) *session {
 	if id.Match(p.id) {
 		return nil
@@ -349,6 +819,13 @@ func (p *Router) getDirectSession(id utils.NodeID) *session {
 	}
 	p.sessionMutex.RUnlock()
 
+	if s := p.dialPreferred(id); s != nil {
+		return s
+	}
+	if s := p.dialHint(id); s != nil {
+		return s
+	}
+
 	var info *utils.NodeInfo
 	p.dhtMutex.RLock()
 	info = p.mainDht.GetNodeInfo(id)
@@ -362,46 +839,90 @@ func (p *Router) getDirectSession(id utils.NodeID) *session {
 	}
 	p.dhtMutex.RUnlock()
 
-	if info == nil {
+	if info != nil {
+		return p.dial(id, info.Addr.String())
+	}
+
+	r, err := p.LookupAddress(id)
+	if err != nil {
+		return nil
+	}
+	for _, a := range dialAddrs(r.Addrs) {
+		if s := p.dial(id, a); s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+// dial opens a session to the node at the given address.
+func (p *Router) dial(id utils.NodeID, address string) *session {
+	if !p.dialAllowed(id, time.Now()) {
+		return nil
+	}
+
+	s := p.connect(id, address)
+	if s == nil {
+		p.dialFailed(id, time.Now())
 		return nil
 	}
+	p.dialSucceeded(id)
+	return s
+}
 
-	addr, err := utp.ResolveAddr("utp", info.Addr.String())
+// connect performs the handshake of a session to the node at the given
+// address, over the transport of its scheme, and starts reading it.
+func (p *Router) connect(id utils.NodeID, address string) *session {
+	conn, err := p.transport.dial(address, p.retry.Dial.Timeout)
 	if err != nil {
-		p.logger.Error("%v", err)
+		p.logger.Error("%v %v", address, err)
 		return nil
 	}
 
-	conn, err := utp.DialUTPTimeout("utp", nil, addr, 100*time.Millisecond)
+	nconn, err := p.transport.network.streamConn(conn)
 	if err != nil {
-		p.logger.Error("%v %v", addr, err)
+		conn.Close()
+		p.logger.Error("%v", err)
 		return nil
 	}
 
-	s, err := newSesion(conn, p.key)
+	s, err := newSesion(nconn, p.key, id, p.encodedCapabilities())
 	if err != nil {
 		conn.Close()
 		p.logger.Error("%v", err)
 		return nil
-	} else {
-		go p.readSession(s)
-		p.addSession(s)
+	} else if !s.ID().Match(id) {
+		s.Close()
+		p.logger.Error("%v is not %s", address, id.String())
+		return nil
 	}
 
+	p.hints.learn(id, address)
+	s.padding = p.privacy >= PrivacyPadding
+	go p.readSession(s)
+	p.addSession(s)
 	return s
 }
 
-func (p *Router) makePacket(dst utils.NodeID, typ string, payload []byte) (internal.Packet, error) {
+func (p *Router) makePacket(dst utils.NodeID, typ string, payload []byte) (protocol.Packet, error) {
+	if err := checkNamespaces(p.id, dst, typ); err != nil {
+		return protocol.Packet{}, err
+	}
 	var id [20]byte
 	rand.Read(id[:])
-	return internal.Packet{
+	pkt := protocol.Packet{
 		Dst:     dst,
 		Src:     p.id,
 		Type:    typ,
 		Payload: payload,
 		ID:      id,
-		TTL:     3,
-	}, nil
+		TTL:     defaultTTL,
+	}
+	if bytes.Equal(dst.NS[:], utils.GroupNamespace[:]) {
+		pkt.TTL = groupTTL(p.MemberCount(dst))
+		pkt.Visit(p.id)
+	}
+	return pkt, nil
 }
 
 func (p *Router) AddNode(info utils.NodeInfo) {
@@ -427,7 +948,8 @@ func (p *Router) ActiveSessions() []utils.NodeInfo {
 	p.sessionMutex.RLock()
 	defer p.sessionMutex.RUnlock()
 	for _, n := range p.KnownNodes() {
-		if _, ok := p.sessions[n.ID]; ok {
+		if s, ok := p.sessions[n.ID]; ok {
+			n.RTT, n.LastSeen = s.liveness()
 			nodes = append(nodes, n)
 		}
 	}
@@ -455,10 +977,30 @@ func (p *Router) ID() utils.NodeID {
 	return p.id
 }
 
+// Addr returns the local address of the listener.
+func (p *Router) Addr() net.Addr {
+	return p.transport.Addr()
+}
+
+// Transport returns the transport of the router, which other routers
+// can share with NewSharedRouter while the router is open.
+func (p *Router) Transport() *Transport {
+	return p.transport
+}
+
+// Close stops the router. Closing the router again does nothing.
 func (p *Router) Close() {
-	p.exit <- 0
-	p.mainDht.Close()
-	for _, d := range p.groupDht {
-		d.Close()
-	}
+	p.closeOnce.Do(func() {
+		close(p.exit)
+		p.transport.remove(p)
+		p.dispatcher.close()
+		p.saveTableFile()
+		p.mainDht.Close()
+		for _, d := range p.groupDht {
+			d.Close()
+		}
+		if p.ownTransport {
+			p.transport.Close()
+		}
+	})
 }
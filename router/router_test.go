@@ -61,6 +61,15 @@ func TestRouterMessageExchange(t *testing.T) {
 	router2.Close()
 }
 
+func TestRouterClose(t *testing.T) {
+	router, err := NewRouter(utils.GeneratePrivateKey(), log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.Close()
+	router.Close()
+}
+
 func TestRouterRouteExchange(t *testing.T) {
 	logger := log.NewLogger()
 	msg := "The quick brown fox jumps over the lazy dog"
@@ -89,7 +98,7 @@ func TestRouterRouteExchange(t *testing.T) {
 		t.Fatal(err)
 	}
 	defer router3.Close()
-	addr, _ := net.ResolveUDPAddr("udp", router1.listener.Addr().String())
+	addr, _ := net.ResolveUDPAddr("udp", router1.Addr().String())
 	router3.Discover([]net.UDPAddr{net.UDPAddr{Port: addr.Port, IP: net.ParseIP("127.0.0.1")}})
 
 	time.Sleep(100 * time.Millisecond)
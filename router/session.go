@@ -1,38 +1,104 @@
 package router
 
 import (
+	"bufio"
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"io"
 	"net"
 	"sync"
 	"time"
 
-	"github.com/h2so5/murcott/internal"
+	"github.com/h2so5/murcott/protocol"
 	"github.com/h2so5/murcott/utils"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
+var errInvalidSignature = errors.New("receive wrong packet")
+
+const (
+	// writeBufferSize is the size of the write buffer of a session.
+	// The buffer is flushed when it is full.
+	writeBufferSize = 32 * 1024
+
+	// flushDelay is the time after which the packets buffered by a session
+	// are flushed when no other packet is written.
+	flushDelay = 2 * time.Millisecond
+)
+
 type session struct {
-	conn   net.Conn
+	conn    net.Conn
+	counter *countedConn
+
+	// r starts as a buffered reader of conn, on which the handshake packets
+	// are decoded without losing the bytes read ahead. dec decodes the
+	// encrypted packets which follow and keeps its buffer between them.
 	r      io.Reader
 	w      io.Writer
+	dec    *msgpack.Decoder
 	rkey   *utils.PublicKey
 	lkey   *utils.PrivateKey
 	wmutex sync.Mutex
+
+	// buf buffers the encrypted packets, so that bursts of messages are
+	// written to the connection together. Control packets are flushed
+	// immediately and the others after flushDelay.
+	buf        *bufio.Writer
+	flushTimer *time.Timer
+	werr       error
+
+	// offset is the difference between the clock of the peer and the local
+	// clock, measured during the handshake. It is zero for peers which
+	// do not send their time.
+	offset time.Duration
+
+	// padding enables padding of the written packets to size buckets.
+	padding bool
+
+	// hello and peerHello are the pubkey packets of the handshake, whose
+	// offers are confirmed by the finish packets. version is the newest
+	// protocol version offered by both nodes, or empty if the peer does
+	// not offer versions.
+	hello     protocol.Packet
+	peerHello protocol.Packet
+	dialed    bool
+	version   string
+
+	// agent is the software version of the peer, or empty if it does
+	// not send it.
+	agent string
+
+	// caps is the encoded capability record sent in the handshake.
+	caps []byte
+
+	// opened is the time the handshake of the session started.
+	opened time.Time
+
+	heartbeat
 }
 
-func newSesion(conn net.Conn, lkey *utils.PrivateKey) (*session, error) {
+// newSesion performs the handshake of an outgoing session to dst,
+// sending the encoded capability record caps.
+func newSesion(conn net.Conn, lkey *utils.PrivateKey, dst utils.NodeID, caps []byte) (*session, error) {
+	c := &countedConn{Conn: conn}
 	s := session{
-		conn: conn,
-		r:    conn,
-		w:    conn,
-		lkey: lkey,
+		conn:    c,
+		counter: c,
+		r:       bufio.NewReader(c),
+		buf:     bufio.NewWriterSize(c, writeBufferSize),
+		lkey:    lkey,
+		caps:    caps,
 	}
+	s.w = s.buf
+	s.lastSeen = time.Now()
+	s.opened = s.lastSeen
+	s.dialed = true
 
-	err := s.sendPubkey()
+	err := s.sendPubkey(dst)
 	if err != nil {
 		return nil, err
 	}
@@ -42,6 +108,40 @@ func newSesion(conn net.Conn, lkey *utils.PrivateKey) (*session, error) {
 		return nil, err
 	}
 
+	return s.exchangeKeys()
+}
+
+// acceptSession performs the handshake of an incoming session whose
+// public key packet has already been read, sending the encoded capability
+// record caps.
+func acceptSession(conn net.Conn, lkey *utils.PrivateKey, pkt protocol.Packet, caps []byte) (*session, error) {
+	c := &countedConn{Conn: conn}
+	s := session{
+		conn:    c,
+		counter: c,
+		r:       bufio.NewReader(c),
+		buf:     bufio.NewWriterSize(c, writeBufferSize),
+		lkey:    lkey,
+		caps:    caps,
+	}
+	s.w = s.buf
+	s.lastSeen = time.Now()
+	s.opened = s.lastSeen
+
+	err := s.setPubkey(pkt)
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.sendPubkey(pkt.Src)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.exchangeKeys()
+}
+
+func (s *session) exchangeKeys() (*session, error) {
 	outkey, err := s.sendCommonKey()
 	if err != nil {
 		return nil, err
@@ -53,63 +153,193 @@ func newSesion(conn net.Conn, lkey *utils.PrivateKey) (*session, error) {
 	}
 	s.setKey(inkey, outkey)
 
-	return &s, nil
+	if s.version != "" {
+		err = s.finish()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// finish exchanges the digests of the pubkey packets, which detects
+// an attacker who has stripped or replaced the offer of either node.
+func (s *session) finish() error {
+	digest := s.transcript()
+	pkt := protocol.Packet{
+		Src:     utils.NewNodeID(utils.GlobalNamespace, s.lkey.Digest()),
+		Type:    protocol.TypeFinish,
+		Payload: digest[:],
+	}
+	err := s.Write(pkt)
+	if err != nil {
+		return err
+	}
+
+	s.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	defer s.conn.SetReadDeadline(time.Time{})
+	packet, err := s.Read()
+	if err != nil {
+		return err
+	}
+	if packet.Type != protocol.TypeFinish || !bytes.Equal(packet.Payload, digest[:]) {
+		return errors.New("handshake transcript mismatch")
+	}
+	return nil
+}
+
+// transcript returns the digest of the pubkey packets,
+// that of the dialing node first.
+func (s *session) transcript() [sha256.Size]byte {
+	first, second := s.peerHello, s.hello
+	if s.dialed {
+		first, second = s.hello, s.peerHello
+	}
+	return sha256.Sum256(append(first.Serialize(), second.Serialize()...))
+}
+
+// commonVersion returns the newest version of local which is in remote.
+func commonVersion(local, remote []string) string {
+	for i := len(local) - 1; i >= 0; i-- {
+		for _, v := range remote {
+			if v == local[i] {
+				return v
+			}
+		}
+	}
+	return ""
 }
 
 func (s *session) ID() utils.NodeID {
 	return utils.NewNodeID(utils.GlobalNamespace, s.rkey.Digest())
 }
 
-func (s *session) Read() (internal.Packet, error) {
-	var packet internal.Packet
-	d := msgpack.NewDecoder(s.r)
-	err := d.Decode(&packet)
+func (s *session) Read() (protocol.Packet, error) {
+	var packet protocol.Packet
+	err := s.dec.Decode(&packet)
 	if err != nil {
-		return internal.Packet{}, err
+		return protocol.Packet{}, err
 	}
 	if !packet.Verify(s.rkey) {
-		return internal.Packet{}, errors.New("receive wrong packet")
+		return protocol.Packet{}, errInvalidSignature
 	}
 	return packet, nil
 }
 
-func (s *session) Write(p internal.Packet) error {
+func (s *session) Write(p protocol.Packet) error {
 	s.wmutex.Lock()
 	defer s.wmutex.Unlock()
+	if s.werr != nil {
+		return s.werr
+	}
 	err := p.Sign(s.lkey)
 	if err != nil {
 		return err
 	}
+	p.Padding = nil
+	if s.padding {
+		padPacket(&p)
+	}
 	b, err := msgpack.Marshal(p)
 	if err != nil {
 		return err
 	}
 	_, err = s.w.Write(b)
+	if err == nil {
+		if flushPacket(p) {
+			err = s.flush()
+		} else if s.flushTimer == nil {
+			s.flushTimer = time.AfterFunc(flushDelay, s.Flush)
+		}
+	}
+	if err != nil {
+		s.werr = err
+	}
 	return err
 }
 
+// flushPacket reports whether the packet should be sent without waiting
+// for the packets following it. Only messages are buffered; handshakes
+// and control packets such as pings are sent immediately.
+func flushPacket(p protocol.Packet) bool {
+	return p.Type != protocol.TypeMsg
+}
+
+// Flush writes the buffered packets to the connection. An error is
+// returned by the next Write.
+func (s *session) Flush() {
+	s.wmutex.Lock()
+	defer s.wmutex.Unlock()
+	if s.werr == nil {
+		s.werr = s.flush()
+	}
+}
+
+func (s *session) flush() error {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+		s.flushTimer = nil
+	}
+	return s.buf.Flush()
+}
+
+// Close flushes the buffered packets and closes the connection.
+// The flush is abandoned after a second if the peer does not read.
 func (s *session) Close() error {
+	s.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	s.Flush()
 	return s.conn.Close()
 }
 
+// readHandshake reads the first packet of a session.
+func readHandshake(conn net.Conn) (protocol.Packet, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	defer conn.SetReadDeadline(time.Time{})
+	r := msgpack.NewDecoder(conn)
+	var packet protocol.Packet
+	err := r.Decode(&packet)
+	return packet, err
+}
+
 func (s *session) verifyPubkey() error {
 	s.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
 	defer s.conn.SetReadDeadline(time.Time{})
-	r := msgpack.NewDecoder(s.r)
-	var packet internal.Packet
-	err := r.Decode(&packet)
+	var packet protocol.Packet
+	err := msgpack.NewDecoder(s.r).Decode(&packet)
 	if err != nil {
 		return err
 	}
-	if packet.Type == "pubkey" {
+	return s.setPubkey(packet)
+}
+
+func (s *session) setPubkey(packet protocol.Packet) error {
+	if packet.Type == protocol.TypePubkey {
 		var key utils.PublicKey
 		err := msgpack.Unmarshal(packet.Payload, &key)
-		if err == nil {
-			id := utils.NewNodeID(utils.GlobalNamespace, key.Digest())
-			if id.Digest.Cmp(packet.Src.Digest) != 0 {
-				return errors.New("receive wrong public key")
+		if err != nil {
+			return err
+		}
+		if key.IsZero() {
+			return errors.New("receive wrong public key")
+		}
+		id := utils.NewNodeID(utils.GlobalNamespace, key.Digest())
+		if id.Digest.Cmp(packet.Src.Digest) != 0 {
+			return errors.New("receive wrong public key")
+		}
+		if !packet.Verify(&key) {
+			return errInvalidSignature
+		}
+		if len(packet.Offer) > 0 {
+			s.version = commonVersion(protocolVersions, packet.Offer)
+			if s.version == "" {
+				return errors.New("no common protocol version")
 			}
-			s.rkey = &key
+		}
+		s.rkey = &key
+		s.peerHello = packet
+		s.agent = packet.Agent
+		if packet.Time != 0 {
+			s.offset = time.Unix(0, packet.Time).Sub(time.Now())
 		}
 	} else {
 		return errors.New("receive wrong packet")
@@ -121,29 +351,42 @@ func (s *session) verifyCommonKey() ([]byte, error) {
 	s.conn.SetReadDeadline(time.Now().Add(time.Second * 2))
 	defer s.conn.SetReadDeadline(time.Time{})
 	r := msgpack.NewDecoder(s.r)
-	var packet internal.Packet
+	var packet protocol.Packet
 	err := r.Decode(&packet)
 	if err != nil {
 		return nil, err
 	}
-	if packet.Type == "key" {
+	if packet.Type == protocol.TypeKey {
+		if !packet.Verify(s.rkey) {
+			return nil, errInvalidSignature
+		}
 		return packet.Payload, nil
 	} else {
 		return nil, errors.New("receive wrong packet")
 	}
 }
 
-func (s *session) sendPubkey() error {
+func (s *session) sendPubkey(dst utils.NodeID) error {
 	data, err := msgpack.Marshal(s.lkey.PublicKey)
 	if err != nil {
 		return err
 	}
 
-	pkt := internal.Packet{
+	pkt := protocol.Packet{
+		Dst:     dst,
 		Src:     utils.NewNodeID(utils.GlobalNamespace, s.lkey.Digest()),
-		Type:    "pubkey",
+		Type:    protocol.TypePubkey,
 		Payload: data,
+		Time:    time.Now().UnixNano(),
+		Offer:   protocolVersions,
+		Agent:   SoftwareVersion,
+		Caps:    s.caps,
+	}
+	_, err = rand.Read(pkt.ID[:])
+	if err != nil {
+		return err
 	}
+	s.hello = pkt
 
 	err = s.Write(pkt)
 	if err != nil {
@@ -159,9 +402,9 @@ func (s *session) sendCommonKey() ([]byte, error) {
 		return nil, err
 	}
 
-	pkt := internal.Packet{
+	pkt := protocol.Packet{
 		Src:     utils.NewNodeID(utils.GlobalNamespace, s.lkey.Digest()),
-		Type:    "key",
+		Type:    protocol.TypeKey,
 		Payload: key[:],
 	}
 
@@ -179,6 +422,7 @@ func (s *session) setKey(inkey, outkey []byte) error {
 	}
 	var iniv [aes.BlockSize]byte
 	s.r = cipher.StreamReader{S: cipher.NewOFB(block, iniv[:]), R: s.r}
+	s.dec = msgpack.NewDecoder(s.r)
 
 	block, err = aes.NewCipher(outkey)
 	if err != nil {
@@ -0,0 +1,147 @@
+package router
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestSessionFlush(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	s := &session{conn: local, buf: bufio.NewWriterSize(local, writeBufferSize), lkey: utils.GeneratePrivateKey()}
+	s.w = s.buf
+
+	packets := make(chan protocol.Packet, 4)
+	go func() {
+		d := msgpack.NewDecoder(remote)
+		for {
+			var pkt protocol.Packet
+			if d.Decode(&pkt) != nil {
+				return
+			}
+			packets <- pkt
+		}
+	}()
+
+	src := utils.NewNodeID(utils.GlobalNamespace, s.lkey.Digest())
+	for i := 0; i < 2; i++ {
+		err := s.Write(protocol.Packet{Src: src, Type: protocol.TypeMsg, Payload: []byte{byte(i)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.wmutex.Lock()
+	buffered := s.buf.Buffered()
+	s.wmutex.Unlock()
+	if buffered == 0 {
+		t.Errorf("Write() should buffer the messages")
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case pkt := <-packets:
+			if pkt.Payload[0] != byte(i) {
+				t.Errorf("packet %d has payload %v; expects %d", i, pkt.Payload, i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("buffered messages are not flushed")
+		}
+	}
+
+	err := s.Write(protocol.Packet{Src: src, Type: protocol.TypePing})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.buf.Buffered() != 0 {
+		t.Errorf("Write() should flush a ping immediately")
+	}
+	if pkt := <-packets; pkt.Type != protocol.TypePing {
+		t.Errorf("packet type is %s; expects %s", pkt.Type, protocol.TypePing)
+	}
+	s.Close()
+}
+
+func TestHandshake(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lkey := utils.GeneratePrivateKey()
+	rkey := utils.GeneratePrivateKey()
+	accepted := make(chan *session, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		pkt, err := readHandshake(conn)
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		s, _ := acceptSession(conn, rkey, pkt, []byte("remote caps"))
+		accepted <- s
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := newSesion(conn, lkey, utils.NewNodeID(utils.GlobalNamespace, rkey.Digest()), []byte("local caps"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	r := <-accepted
+	if r == nil {
+		t.Fatal("acceptSession() fails")
+	}
+	defer r.Close()
+	if s.version != protocolVersions[len(protocolVersions)-1] || r.version != s.version {
+		t.Errorf("negotiated versions are %q and %q; expects %q", s.version, r.version, protocolVersions[len(protocolVersions)-1])
+	}
+	if s.transcript() != r.transcript() {
+		t.Errorf("transcript() differs between the nodes")
+	}
+	if string(s.peerHello.Caps) != "remote caps" || string(r.peerHello.Caps) != "local caps" {
+		t.Errorf("handshake carries %q and %q; expects the capability records", s.peerHello.Caps, r.peerHello.Caps)
+	}
+}
+
+func TestHandshakeOffer(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	data, _ := msgpack.Marshal(key.PublicKey)
+	pkt := protocol.Packet{
+		Src:     utils.NewNodeID(utils.GlobalNamespace, key.Digest()),
+		Type:    protocol.TypePubkey,
+		Payload: data,
+		Offer:   []string{"murcott/0", "murcott/1"},
+	}
+	pkt.Sign(key)
+
+	var s session
+	if err := s.setPubkey(pkt); err != nil || s.version != "murcott/1" {
+		t.Errorf("setPubkey() returns %v with version %q; expects murcott/1", err, s.version)
+	}
+	pkt.Offer = pkt.Offer[:1]
+	if err := s.setPubkey(pkt); err == nil {
+		t.Errorf("setPubkey() accepts a modified offer")
+	}
+	pkt.Offer = []string{"murcott/0"}
+	pkt.Sign(key)
+	if err := s.setPubkey(pkt); err == nil {
+		t.Errorf("setPubkey() accepts an offer without a common version")
+	}
+
+	if v := commonVersion([]string{"a", "b", "c"}, []string{"c", "a"}); v != "c" {
+		t.Errorf("commonVersion() returns %q; expects c", v)
+	}
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"sort"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// SessionInfo describes an open session of the router.
+type SessionInfo struct {
+	ID utils.NodeID
+
+	// Addr is the remote address of the stream of the session, and
+	// Dialed reports whether this node opened it.
+	Addr   string
+	Dialed bool
+
+	// Version is the protocol version agreed with the peer,
+	// or empty if the peer does not offer versions, and Agent
+	// the software version of the peer.
+	Version string
+	Agent   string
+
+	RTT      time.Duration
+	LastSeen time.Time
+	Opened   time.Time
+
+	// Traffic counts the bytes exchanged in the session.
+	Traffic Traffic
+}
+
+// Age returns the time since the session was opened.
+func (i SessionInfo) Age(now time.Time) time.Duration {
+	return now.Sub(i.Opened)
+}
+
+type byOpened []SessionInfo
+
+func (s byOpened) Len() int           { return len(s) }
+func (s byOpened) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byOpened) Less(i, j int) bool { return s[i].Opened.Before(s[j].Opened) }
+
+func (s *session) info() SessionInfo {
+	i := SessionInfo{
+		ID:      s.ID(),
+		Dialed:  s.dialed,
+		Version: s.version,
+		Agent:   s.agent,
+		Opened:  s.opened,
+		Traffic: s.counter.traffic(),
+	}
+	if addr := s.conn.RemoteAddr(); addr != nil {
+		i.Addr = addr.String()
+	}
+	i.RTT, i.LastSeen = s.liveness()
+	return i
+}
+
+// Sessions describes the open sessions of the router, from the oldest.
+func (p *Router) Sessions() []SessionInfo {
+	p.sessionMutex.RLock()
+	list := make([]SessionInfo, 0, len(p.sessions))
+	for _, s := range p.sessions {
+		list = append(list, s.info())
+	}
+	p.sessionMutex.RUnlock()
+	sort.Sort(byOpened(list))
+	return list
+}
+
+// CloseSession closes the session to the node, so that a session which
+// misbehaves can be reset. A new session is opened when a packet is next
+// sent to the node. It reports whether a session was open.
+func (p *Router) CloseSession(id utils.NodeID) bool {
+	p.sessionMutex.RLock()
+	s := p.sessions[id]
+	p.sessionMutex.RUnlock()
+	if s == nil {
+		return false
+	}
+	p.logger.Info("Close session: %s", id.String())
+	p.removeSession(s)
+	return true
+}
@@ -0,0 +1,76 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestSessions(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	router1, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router2, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+
+	n := NewMemoryNetwork(1)
+	if err := router1.RegisterTransport(n.Transport("node")); err != nil {
+		t.Fatal(err)
+	}
+	if router1.connect(router2.ID(), JoinTransportAddr(MemoryScheme, "node")) == nil {
+		t.Fatalf("connect() should open a session over the memory transport")
+	}
+
+	// The capability records are exchanged in the handshake.
+	for i := 0; i < 100; i++ {
+		if _, ok := router1.KnownCapabilities(router2.ID()); ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, ok := router1.KnownCapabilities(router2.ID()); !ok {
+		t.Errorf("KnownCapabilities() should return the record sent in the handshake")
+	}
+
+	list := router1.Sessions()
+	if len(list) != 1 {
+		t.Fatalf("Sessions() returns %d sessions; expects 1", len(list))
+	}
+	s := list[0]
+	if !s.ID.Match(router2.ID()) || !s.Dialed || s.Addr != "node" {
+		t.Errorf("Sessions() returns %+v; expects the session dialed to %v", s, router2.ID())
+	}
+	if s.Agent != SoftwareVersion {
+		t.Errorf("Sessions() returns agent %q; expects %q", s.Agent, SoftwareVersion)
+	}
+	if s.Traffic.Sent == 0 || s.Traffic.Received == 0 {
+		t.Errorf("Sessions() returns traffic %+v; expects the bytes of the handshake", s.Traffic)
+	}
+	if age := s.Age(time.Now()); age < 0 || age > time.Minute {
+		t.Errorf("Age() returns %v; expects the time since the handshake", age)
+	}
+
+	if !router1.CloseSession(router2.ID()) {
+		t.Errorf("CloseSession() should report the open session")
+	}
+	if len(router1.Sessions()) != 0 {
+		t.Errorf("Sessions() should not return a closed session")
+	}
+	if router1.CloseSession(router2.ID()) {
+		t.Errorf("CloseSession() should report that no session is open")
+	}
+}
@@ -0,0 +1,178 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/h2so5/utp"
+)
+
+// UTPScheme is the scheme of the uTP transport, whose addresses
+// are written without it.
+const UTPScheme = "utp"
+
+// StreamTransport is a network over which the sessions of the routers are
+// established, such as Bluetooth LE, LoRa or a serial link. A transport
+// is registered with Router.RegisterTransport, and its addresses are
+// written as "scheme://address" in the address records of the node.
+// The uTP transport of the listener is the reference implementation.
+// The DHT always runs over the socket of the listener.
+type StreamTransport interface {
+	// Scheme returns the name of the transport in the addresses.
+	Scheme() string
+
+	// Listen starts accepting the streams of the transport.
+	Listen() (StreamListener, error)
+
+	// Dial opens a stream to an address of the transport,
+	// given without the scheme.
+	Dial(address string, timeout time.Duration) (net.Conn, error)
+
+	// ParseAddr checks an address of the transport, given without
+	// the scheme, and returns its canonical form.
+	ParseAddr(address string) (string, error)
+}
+
+// StreamListener accepts the streams of a transport.
+type StreamListener interface {
+	Accept() (net.Conn, error)
+	Close() error
+
+	// Addr returns the address of the listener without the scheme.
+	Addr() string
+}
+
+// JoinTransportAddr returns the address of a transport
+// in the form used by the address records.
+func JoinTransportAddr(scheme, address string) string {
+	if scheme == UTPScheme {
+		return address
+	}
+	return scheme + "://" + address
+}
+
+// SplitTransportAddr splits an address into the scheme of its transport
+// and the address within it. Addresses without a scheme are uTP ones.
+func SplitTransportAddr(address string) (scheme, addr string) {
+	if i := strings.Index(address, "://"); i >= 0 {
+		return address[:i], address[i+3:]
+	}
+	return UTPScheme, address
+}
+
+// utpTransport is the uTP transport of the listener of a Transport.
+type utpTransport struct {
+	listener *utp.Listener
+}
+
+func (t utpTransport) Scheme() string {
+	return UTPScheme
+}
+
+func (t utpTransport) Listen() (StreamListener, error) {
+	return utpListener{t.listener}, nil
+}
+
+func (t utpTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	addr, err := utp.ResolveAddr("utp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := utp.DialUTPTimeout("utp", nil, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (t utpTransport) ParseAddr(address string) (string, error) {
+	addr, err := utp.ResolveAddr("utp", address)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+type utpListener struct {
+	*utp.Listener
+}
+
+func (l utpListener) Addr() string {
+	return l.Listener.Addr().String()
+}
+
+// Register adds a transport to those over which the sessions of the
+// routers are accepted and dialed. A scheme can only be registered once.
+func (t *Transport) Register(s StreamTransport) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if _, ok := t.streams[s.Scheme()]; ok {
+		return errors.New("transport already registered")
+	}
+	l, err := s.Listen()
+	if err != nil {
+		return err
+	}
+	t.streams[s.Scheme()] = s
+	t.listeners = append(t.listeners, streamListener{scheme: s.Scheme(), StreamListener: l})
+	go t.supervisor.run(SubsystemTransport, func() { t.accept(s.Scheme(), l) })
+	return nil
+}
+
+type streamListener struct {
+	StreamListener
+	scheme string
+}
+
+// schemes returns the schemes of the registered transports.
+func (t *Transport) schemes() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var l []string
+	for _, s := range t.listeners {
+		l = append(l, s.scheme)
+	}
+	return l
+}
+
+// streamAddrs returns the addresses of the listeners of the transports
+// other than uTP.
+func (t *Transport) streamAddrs() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	var l []string
+	for _, s := range t.listeners {
+		if s.scheme != UTPScheme {
+			l = append(l, JoinTransportAddr(s.scheme, s.Addr()))
+		}
+	}
+	return l
+}
+
+// dial opens a stream to the address with its transport. In mesh mode,
+// only the addresses of the local network are dialed.
+func (t *Transport) dial(address string, timeout time.Duration) (net.Conn, error) {
+	scheme, addr := SplitTransportAddr(address)
+	t.mutex.RLock()
+	s, ok := t.streams[scheme]
+	t.mutex.RUnlock()
+	if !ok {
+		return nil, errors.New("unknown transport: " + scheme)
+	}
+	addr, err := s.ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if t.mesh && !isLocalAddr(JoinTransportAddr(scheme, addr)) {
+		return nil, errNotLocal
+	}
+	return s.Dial(addr, timeout)
+}
+
+// RegisterTransport adds a transport to the transport of the router,
+// which is shared with the other routers using it.
+func (p *Router) RegisterTransport(s StreamTransport) error {
+	return p.transport.Register(s)
+}
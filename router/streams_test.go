@@ -0,0 +1,108 @@
+package router
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+// tcpTransport is a stream transport over loopback TCP.
+type tcpTransport struct {
+	listener net.Listener
+}
+
+func (t *tcpTransport) Scheme() string { return "tcp" }
+
+func (t *tcpTransport) Listen() (StreamListener, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	t.listener = l
+	return tcpListener{l}, nil
+}
+
+func (t *tcpTransport) Dial(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func (t *tcpTransport) ParseAddr(address string) (string, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return "", err
+	}
+	return addr.String(), nil
+}
+
+type tcpListener struct {
+	net.Listener
+}
+
+func (l tcpListener) Addr() string {
+	return l.Listener.Addr().String()
+}
+
+func TestSplitTransportAddr(t *testing.T) {
+	if s, a := SplitTransportAddr("192.0.2.1:9200"); s != UTPScheme || a != "192.0.2.1:9200" {
+		t.Errorf("SplitTransportAddr() returns %q, %q; expects utp address", s, a)
+	}
+	if s, a := SplitTransportAddr("ble://aa:bb"); s != "ble" || a != "aa:bb" {
+		t.Errorf("SplitTransportAddr() returns %q, %q; expects ble, aa:bb", s, a)
+	}
+	if a := JoinTransportAddr("ble", "aa:bb"); a != "ble://aa:bb" {
+		t.Errorf("JoinTransportAddr() returns %q; expects ble://aa:bb", a)
+	}
+}
+
+func TestStreamTransport(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	config := utils.DefaultConfig
+	config.Retry.Dial.Timeout = time.Second
+	router1, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, config, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router1.Close()
+	router2, err := NewSharedRouter(utils.GeneratePrivateKey(), logger, config, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer router2.Close()
+
+	tcp := &tcpTransport{}
+	if err := router1.RegisterTransport(tcp); err != nil {
+		t.Fatal(err)
+	}
+	if router2.RegisterTransport(&tcpTransport{}) == nil {
+		t.Errorf("RegisterTransport() should fail for a registered scheme")
+	}
+
+	addr := JoinTransportAddr("tcp", tcp.listener.Addr().String())
+	found := false
+	for _, a := range router2.Addrs() {
+		found = found || a == addr
+	}
+	if !found {
+		t.Errorf("Addrs() returns %v; expects %s", router2.Addrs(), addr)
+	}
+
+	s := router1.connect(router2.ID(), addr)
+	if s == nil {
+		t.Fatalf("connect() should open a session over the TCP transport")
+	}
+	if !s.ID().Match(router2.ID()) {
+		t.Errorf("session is to %v; expects %v", s.ID(), router2.ID())
+	}
+	if router1.connect(router2.ID(), "ble://aa:bb") != nil {
+		t.Errorf("connect() should fail for an unknown transport")
+	}
+}
@@ -0,0 +1,140 @@
+package router
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/utils"
+)
+
+// Subsystems of a node reported in a CrashError.
+const (
+	SubsystemRouter    = "router"
+	SubsystemSession   = "session"
+	SubsystemDHT       = "dht"
+	SubsystemTransport = "transport"
+	SubsystemClient    = "client"
+)
+
+// restartPolicy is the backoff between the restarts of a crashed
+// subsystem. The backoff is reset once the subsystem has run for
+// restartReset without crashing.
+var restartPolicy = utils.RetryPolicy{
+	Initial:    100 * time.Millisecond,
+	Max:        30 * time.Second,
+	Multiplier: 2,
+}
+
+const restartReset = time.Minute
+
+// CrashError describes a panic recovered in a goroutine of a subsystem.
+type CrashError struct {
+	Subsystem string
+	Value     interface{}
+	Stack     []byte
+}
+
+func (e *CrashError) Error() string {
+	return fmt.Sprintf("%s crashed: %v", e.Subsystem, e.Value)
+}
+
+// supervisor recovers the panics of the goroutines of a router or of a
+// transport instead of letting them kill the whole process, and restarts
+// the long-running ones with backoff until done is closed.
+type supervisor struct {
+	done    <-chan int
+	logger  *log.Logger
+	handler func(err *CrashError)
+	mutex   sync.RWMutex
+}
+
+func newSupervisor(done <-chan int, logger *log.Logger) *supervisor {
+	return &supervisor{done: done, logger: logger}
+}
+
+func (s *supervisor) setHandler(h func(err *CrashError)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handler = h
+}
+
+// report passes a crash to the handler.
+func (s *supervisor) report(err *CrashError) {
+	s.mutex.RLock()
+	h := s.handler
+	s.mutex.RUnlock()
+	if h != nil {
+		h(err)
+	}
+}
+
+// crashed logs a recovered panic and reports it. It must be called
+// from the deferred function which has recovered the panic, so that the
+// stack trace includes the panicking frames.
+func (s *supervisor) crashed(name string, v interface{}) {
+	err := &CrashError{Subsystem: name, Value: v, Stack: debug.Stack()}
+	s.logger.Error("%v\n%s", err, err.Stack)
+	s.report(err)
+}
+
+// call runs f and reports whether it has returned without panicking.
+func (s *supervisor) call(name string, f func()) (ok bool) {
+	defer func() {
+		if v := recover(); v != nil {
+			s.crashed(name, v)
+		}
+	}()
+	f()
+	return true
+}
+
+// spawn runs f in a new goroutine without restarting it.
+// It is used for the tasks which run again on the next tick anyway.
+func (s *supervisor) spawn(name string, f func()) {
+	go s.call(name, f)
+}
+
+// run runs f until it returns, restarting it with backoff when it panics.
+// It gives up when done is closed.
+func (s *supervisor) run(name string, f func()) {
+	crashes := 0
+	for {
+		start := time.Now()
+		if s.call(name, f) {
+			return
+		}
+		if time.Since(start) >= restartReset {
+			crashes = 0
+		}
+		crashes++
+		delay := restartPolicy.Delay(crashes)
+		s.logger.Info("Restart %s in %v", name, delay)
+		select {
+		case <-time.After(delay):
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// SetCrashHandler sets a function which is called when a goroutine of the
+// router or of its transport panics. The crashed subsystem is restarted
+// automatically, and a crashed session is closed.
+func (p *Router) SetCrashHandler(h func(err *CrashError)) {
+	p.supervisor.setHandler(h)
+}
+
+// Supervise runs f and restarts it with backoff when it panics, until it
+// returns or the router is closed. The panics are reported to the crash
+// handler under the given subsystem name.
+func (p *Router) Supervise(name string, f func()) {
+	p.supervisor.run(name, f)
+}
+
+// handle runs a packet handler within the goroutine limit.
+func (p *Router) handle(f func()) {
+	p.governor.spawn(func() { p.supervisor.call(SubsystemRouter, f) })
+}
@@ -0,0 +1,49 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/log"
+)
+
+func TestSupervisorRun(t *testing.T) {
+	s := newSupervisor(make(chan int), log.NewLogger())
+	var crashes []*CrashError
+	s.setHandler(func(err *CrashError) { crashes = append(crashes, err) })
+
+	runs := 0
+	s.run(SubsystemDHT, func() {
+		runs++
+		if runs < 3 {
+			panic("crash")
+		}
+	})
+	if runs != 3 {
+		t.Errorf("run() runs f %d times; expects 3", runs)
+	}
+	if len(crashes) != 2 {
+		t.Fatalf("handler is called %d times; expects 2", len(crashes))
+	}
+	if crashes[0].Subsystem != SubsystemDHT || crashes[0].Value != "crash" || len(crashes[0].Stack) == 0 {
+		t.Errorf("handler receives %v; expects a crash of %s", crashes[0], SubsystemDHT)
+	}
+}
+
+func TestSupervisorDone(t *testing.T) {
+	done := make(chan int)
+	s := newSupervisor(done, log.NewLogger())
+	s.setHandler(func(err *CrashError) { close(done) })
+
+	runs := 0
+	s.run(SubsystemRouter, func() {
+		runs++
+		panic("crash")
+	})
+	if runs != 1 {
+		t.Errorf("run() runs f %d times after done; expects 1", runs)
+	}
+	s.setHandler(nil)
+	if s.call(SubsystemRouter, func() { panic("crash") }) {
+		t.Errorf("call() returns true for a panic; expects false")
+	}
+}
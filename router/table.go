@@ -0,0 +1,53 @@
+package router
+
+import (
+	"io"
+	"os"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/storage/atomicfile"
+)
+
+// SaveTable writes the verified nodes of the routing table of the main
+// DHT to w.
+func (p *Router) SaveTable(w io.Writer) error {
+	return p.mainDht.SaveTable(w)
+}
+
+// LoadTable restores the nodes of a routing table written by SaveTable
+// into the main DHT, and returns their number.
+func (p *Router) LoadTable(r io.Reader) (int, error) {
+	return p.mainDht.LoadTable(r)
+}
+
+// loadTableFile restores the routing table of the DHT from the file
+// at path. A missing file is ignored.
+func loadTableFile(d *dht.DHT, path string, logger *log.Logger) {
+	f, err := os.Open(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Error("routing table: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+	n, err := d.LoadTable(f)
+	if err != nil {
+		logger.Error("routing table: %v", err)
+		return
+	}
+	logger.Info("Restored %d nodes of the routing table", n)
+}
+
+// saveTableFile writes the routing table of the main DHT to the file of
+// the configuration, if any.
+func (p *Router) saveTableFile() {
+	if p.tablePath == "" {
+		return
+	}
+	err := atomicfile.Write(p.tablePath, 0600, p.mainDht.SaveTable)
+	if err != nil {
+		p.logger.Error("routing table: %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package router
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// Traffic counts the bytes exchanged in the sessions of the router,
+// including the handshakes and the framing.
+type Traffic struct {
+	Sent     int64
+	Received int64
+}
+
+func (t *Traffic) add(o Traffic) {
+	t.Sent += o.Sent
+	t.Received += o.Received
+}
+
+// countedConn counts the bytes read from and written to a connection.
+type countedConn struct {
+	net.Conn
+	read    int64
+	written int64
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+func (c *countedConn) traffic() Traffic {
+	if c == nil {
+		return Traffic{}
+	}
+	return Traffic{
+		Sent:     atomic.LoadInt64(&c.written),
+		Received: atomic.LoadInt64(&c.read),
+	}
+}
+
+// Traffic returns the bytes exchanged in the sessions of the router since
+// it was created, including the sessions which have been closed.
+func (p *Router) Traffic() Traffic {
+	p.sessionMutex.RLock()
+	defer p.sessionMutex.RUnlock()
+	t := p.closedTraffic
+	for _, s := range p.sessions {
+		t.add(s.counter.traffic())
+	}
+	return t
+}
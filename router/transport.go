@@ -0,0 +1,249 @@
+package router
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"github.com/h2so5/utp"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// Transport is a listener which can be shared by several routers with
+// different identities, so that one process can run multiple clients on
+// a single port. Incoming sessions are demultiplexed by the destination
+// of the handshake. DHT packets are decoded once and passed to the router
+// of their destination, each router being a separate node of the DHT.
+// The routers share the network key of the transport. The crashes of the
+// transport are reported to the crash handlers of all the routers.
+// Sessions are also accepted and dialed over the registered stream
+// transports. In mesh mode, nothing is sent outside of the local network.
+type Transport struct {
+	listener   *utp.Listener
+	streams    map[string]StreamTransport
+	listeners  []streamListener
+	network    *networkKey
+	mesh       bool
+	routers    []*Router
+	mutex      sync.RWMutex
+	handshakes chan struct{}
+	supervisor *supervisor
+	closed     chan int
+	logger     *log.Logger
+}
+
+// NewTransport binds a listener to one of the ports of the config.
+func NewTransport(logger *log.Logger, config utils.Config) (*Transport, error) {
+	listener, err := getOpenPortConn(config)
+	if err != nil {
+		return nil, err
+	}
+	closed := make(chan int)
+	t := &Transport{
+		listener:   listener,
+		streams:    make(map[string]StreamTransport),
+		network:    newNetworkKey(config.NetworkKey),
+		mesh:       config.Mesh,
+		handshakes: make(chan struct{}, maxHandshakes),
+		supervisor: newSupervisor(closed, logger),
+		closed:     closed,
+		logger:     logger,
+	}
+	t.supervisor.setHandler(t.crashed)
+	t.Register(utpTransport{listener})
+	go t.supervisor.run(SubsystemTransport, t.read)
+	return t, nil
+}
+
+// Addr returns the local address of the listener.
+func (t *Transport) Addr() net.Addr {
+	return t.listener.Addr()
+}
+
+// Close closes the listeners. The routers using the transport
+// should be closed first.
+func (t *Transport) Close() error {
+	close(t.closed)
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, l := range t.listeners {
+		if l.scheme != UTPScheme {
+			l.Close()
+		}
+	}
+	return t.listener.Close()
+}
+
+// crashed passes a crash of the transport to the routers.
+func (t *Transport) crashed(err *CrashError) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	for _, r := range t.routers {
+		r.supervisor.report(err)
+	}
+}
+
+// conn returns the socket of the listener for the DHTs. In mesh mode,
+// the packets to the addresses outside of the local network are dropped.
+func (t *Transport) conn() net.PacketConn {
+	conn := t.network.packetConn(t.listener.RawConn)
+	if t.mesh {
+		conn = localPacketConn{conn}
+	}
+	return sharedConn{conn}
+}
+
+// sharedConn prevents the DHTs from closing the socket of the transport.
+type sharedConn struct {
+	net.PacketConn
+}
+
+func (c sharedConn) Close() error {
+	return nil
+}
+
+func (t *Transport) add(r *Router) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for _, o := range t.routers {
+		if o.id.Match(r.id) {
+			return errors.New("identity already uses the transport")
+		}
+	}
+	t.routers = append(t.routers, r)
+	return nil
+}
+
+func (t *Transport) remove(r *Router) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for i, o := range t.routers {
+		if o == r {
+			t.routers = append(t.routers[:i], t.routers[i+1:]...)
+			return
+		}
+	}
+}
+
+// route returns the router of the given destination. Handshakes without
+// a known destination, such as those of older nodes, go to the first router.
+func (t *Transport) route(dst utils.NodeID) *Router {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if len(t.routers) == 0 {
+		return nil
+	}
+	for _, r := range t.routers {
+		if r.id.Match(dst) {
+			return r
+		}
+	}
+	return t.routers[0]
+}
+
+// accept accepts the sessions of a stream transport. In mesh mode, the
+// connections from outside of the local network are closed before
+// anything is sent to them.
+func (t *Transport) accept(scheme string, l StreamListener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			t.logger.Error("%v", err)
+			return
+		}
+		if t.mesh && (conn.RemoteAddr() == nil || !isLocalAddr(JoinTransportAddr(scheme, conn.RemoteAddr().String()))) {
+			conn.Close()
+			continue
+		}
+		select {
+		case t.handshakes <- struct{}{}:
+			go func() {
+				defer func() { <-t.handshakes }()
+				t.supervisor.call(SubsystemTransport, func() { t.handshake(conn) })
+			}()
+		default:
+			conn.Close()
+		}
+	}
+}
+
+func (t *Transport) handshake(raw net.Conn) {
+	conn, err := t.network.streamConn(raw)
+	if err != nil {
+		raw.Close()
+		t.logger.Error("%v", err)
+		return
+	}
+	pkt, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		t.logger.Error("%v", err)
+		return
+	}
+	r := t.route(pkt.Dst)
+	if r == nil || !r.admit() {
+		conn.Close()
+		return
+	}
+	s, err := acceptSession(conn, r.key, pkt, r.encodedCapabilities())
+	if err != nil {
+		conn.Close()
+		t.logger.Error("%v", err)
+		return
+	}
+	r.accept(s)
+}
+
+func (t *Transport) read() {
+	var b [102400]byte
+	conn := t.network.packetConn(t.listener.RawConn)
+	for {
+		l, addr, err := conn.ReadFrom(b[:])
+		if err != nil {
+			t.logger.Error("%v", err)
+			return
+		}
+		var c protocol.RPCCommand
+		err = msgpack.Unmarshal(b[:l], &c)
+		if err != nil {
+			t.logger.Error("%v", err)
+			t.mutex.RLock()
+			for _, r := range t.routers {
+				r.mainDht.Malformed(addr)
+			}
+			t.mutex.RUnlock()
+			continue
+		}
+		for _, r := range t.recipients(c) {
+			r.processCommand(c, addr)
+		}
+	}
+}
+
+// recipients returns the routers to which a DHT command is passed, which
+// is the router of its destination. The requests without a destination
+// go to the first router, and the responses without a destination to
+// every router, as only the router which waits for them accepts them.
+func (t *Transport) recipients(c protocol.RPCCommand) []*Router {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if len(t.routers) == 0 {
+		return nil
+	}
+	if len(c.Dst) == 0 {
+		if c.Method == "" {
+			return append([]*Router(nil), t.routers...)
+		}
+		return t.routers[:1]
+	}
+	for _, r := range t.routers {
+		if bytes.Equal(r.id.Bytes(), c.Dst) {
+			return []*Router{r}
+		}
+	}
+	return nil
+}
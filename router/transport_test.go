@@ -0,0 +1,72 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestTransportShared(t *testing.T) {
+	logger := log.NewLogger()
+	tr, err := NewTransport(logger, utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+
+	key1 := utils.GeneratePrivateKey()
+	key2 := utils.GeneratePrivateKey()
+
+	router1, err := NewSharedRouter(key1, logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router2, err := NewSharedRouter(key2, logger, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if router1.Addr().String() != router2.Addr().String() {
+		t.Errorf("routers listen on %v and %v; expects the same address", router1.Addr(), router2.Addr())
+	}
+
+	if r := tr.route(router2.ID()); r != router2 {
+		t.Errorf("route(%v) returns wrong router", router2.ID())
+	}
+	if r := tr.route(utils.NodeID{}); r != router1 {
+		t.Errorf("route() without destination should return the first router")
+	}
+
+	c := protocol.RPCCommand{Dst: router2.ID().Bytes(), Method: protocol.RPCPing}
+	if r := tr.recipients(c); len(r) != 1 || r[0] != router2 {
+		t.Errorf("recipients() returns %v; expects the router of the destination", r)
+	}
+	c.Dst = utils.NewRandomNodeID(utils.GlobalNamespace).Bytes()
+	if r := tr.recipients(c); len(r) != 0 {
+		t.Errorf("recipients() returns %v for an unknown destination; expects none", r)
+	}
+	c.Dst = nil
+	if r := tr.recipients(c); len(r) != 1 || r[0] != router1 {
+		t.Errorf("recipients() returns %v for a request without destination; expects the first router", r)
+	}
+	c.Method = ""
+	if r := tr.recipients(c); len(r) != 2 {
+		t.Errorf("recipients() returns %v for a response without destination; expects every router", r)
+	}
+
+	_, err = NewSharedRouter(key1, logger, utils.DefaultConfig, tr)
+	if err == nil {
+		t.Errorf("NewSharedRouter() should fail for an identity which uses the transport")
+	}
+
+	router1.Close()
+	if r := tr.route(router1.ID()); r != router2 {
+		t.Errorf("route(%v) returns a closed router", router1.ID())
+	}
+	router2.Close()
+	if r := tr.route(router2.ID()); r != nil {
+		t.Errorf("route() returns %v; expects nil", r)
+	}
+}
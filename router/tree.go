@@ -0,0 +1,231 @@
+package router
+
+import (
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// ihaveTimeout is the time to wait for a message announced by a lazy
+	// peer before grafting the peer into the tree.
+	ihaveTimeout = 2 * time.Second
+
+	// treeCacheAge is the time for which forwarded messages are kept
+	// to answer graft requests.
+	treeCacheAge = time.Minute
+)
+
+// broadcastTree is the Plumtree state of a group. Messages are pushed
+// eagerly along the tree and announced lazily to the other peers.
+// Peers are eager until they are pruned after delivering a duplicate.
+type broadcastTree struct {
+	lazy    map[utils.NodeID]bool
+	missing map[[20]byte]announcement
+	cache   map[[20]byte]cachedPacket
+}
+
+type announcement struct {
+	src  utils.NodeID
+	time time.Time
+}
+
+type cachedPacket struct {
+	pkt  protocol.Packet
+	time time.Time
+}
+
+// treeMessage is the payload of the prune, ihave and graft packets.
+type treeMessage struct {
+	Group utils.NodeID `msgpack:"group"`
+	IDs   [][20]byte   `msgpack:"ids"`
+}
+
+func newBroadcastTree() *broadcastTree {
+	return &broadcastTree{
+		lazy:    make(map[utils.NodeID]bool),
+		missing: make(map[[20]byte]announcement),
+		cache:   make(map[[20]byte]cachedPacket),
+	}
+}
+
+// deliver records a message received from a peer for the first time.
+// The peer becomes the parent of this node in the tree.
+func (t *broadcastTree) deliver(peer utils.NodeID, pkt protocol.Packet, now time.Time) {
+	delete(t.lazy, peer)
+	t.remember(pkt, now)
+}
+
+// remember keeps a message to answer graft requests.
+func (t *broadcastTree) remember(pkt protocol.Packet, now time.Time) {
+	d := pkt.Digest()
+	delete(t.missing, d)
+	if _, ok := t.cache[d]; !ok {
+		t.cache[d] = cachedPacket{pkt: pkt, time: now}
+	}
+}
+
+// announce records a message announced by a lazy peer
+// if it has not been received yet.
+func (t *broadcastTree) announce(peer utils.NodeID, d [20]byte, received bool, now time.Time) {
+	if received {
+		return
+	}
+	if _, ok := t.missing[d]; !ok {
+		t.missing[d] = announcement{src: peer, time: now}
+	}
+}
+
+// expire returns the peers to graft for the messages which have not arrived
+// within ihaveTimeout, and removes old messages from the cache.
+func (t *broadcastTree) expire(now time.Time) map[utils.NodeID][][20]byte {
+	grafts := make(map[utils.NodeID][][20]byte)
+	for d, a := range t.missing {
+		if now.Sub(a.time) > ihaveTimeout {
+			delete(t.missing, d)
+			delete(t.lazy, a.src)
+			grafts[a.src] = append(grafts[a.src], d)
+		}
+	}
+	for d, c := range t.cache {
+		if now.Sub(c.time) > treeCacheAge {
+			delete(t.cache, d)
+		}
+	}
+	return grafts
+}
+
+func (p *Router) getTree(group utils.NodeID) *broadcastTree {
+	t, ok := p.trees[group]
+	if !ok {
+		t = newBroadcastTree()
+		p.trees[group] = t
+	}
+	return t
+}
+
+// lazyPeers remembers a group packet to be sent and returns
+// the lazy peers of the group.
+func (p *Router) lazyPeers(pkt protocol.Packet) map[utils.NodeID]bool {
+	p.treeMutex.Lock()
+	defer p.treeMutex.Unlock()
+	t := p.getTree(pkt.Dst)
+	t.remember(pkt, time.Now())
+	lazy := make(map[utils.NodeID]bool)
+	for id := range t.lazy {
+		lazy[id] = true
+	}
+	return lazy
+}
+
+func (p *Router) deliverTree(peer utils.NodeID, pkt protocol.Packet) {
+	p.treeMutex.Lock()
+	defer p.treeMutex.Unlock()
+	p.getTree(pkt.Dst).deliver(peer, pkt, time.Now())
+}
+
+// pruneTree moves a peer which has delivered a duplicate to the lazy peers
+// and asks it to do the same.
+func (p *Router) pruneTree(group, peer utils.NodeID) {
+	p.treeMutex.Lock()
+	p.getTree(group).lazy[peer] = true
+	p.treeMutex.Unlock()
+	p.sendTreeMessage(peer, protocol.TypePrune, treeMessage{Group: group})
+}
+
+// sendIHave announces a message to a lazy peer.
+func (p *Router) sendIHave(s *session, pkt protocol.Packet) {
+	payload, err := msgpack.Marshal(treeMessage{Group: pkt.Dst, IDs: [][20]byte{pkt.Digest()}})
+	if err != nil {
+		return
+	}
+	ihave, err := p.makePacket(s.ID(), protocol.TypeIHave, payload)
+	if err != nil {
+		return
+	}
+	if s.Write(ihave) != nil {
+		p.removeSession(s)
+	}
+}
+
+func (p *Router) sendTreeMessage(dst utils.NodeID, typ string, m treeMessage) {
+	payload, err := msgpack.Marshal(m)
+	if err != nil {
+		return
+	}
+	pkt, err := p.makePacket(dst, typ, payload)
+	if err == nil {
+		p.send <- pkt
+	}
+}
+
+// repairTrees grafts the lazy peers whose announced messages
+// have not arrived.
+func (p *Router) repairTrees() {
+	now := time.Now()
+	grafts := make(map[utils.NodeID]map[utils.NodeID][][20]byte)
+	p.treeMutex.Lock()
+	for g, t := range p.trees {
+		grafts[g] = t.expire(now)
+	}
+	p.treeMutex.Unlock()
+
+	for g, m := range grafts {
+		for peer, ids := range m {
+			p.sendTreeMessage(peer, protocol.TypeGraft, treeMessage{Group: g, IDs: ids})
+		}
+	}
+}
+
+func (p *Router) processTree(typ string, src utils.NodeID, payload []byte) {
+	var m treeMessage
+	err := msgpack.Unmarshal(payload, &m)
+	if err != nil {
+		p.reportMisbehavior(src, AbuseMalformed)
+		return
+	}
+	if p.getGroupDht(m.Group) == nil {
+		return
+	}
+
+	p.treeMutex.Lock()
+	t := p.getTree(m.Group)
+	var resend []protocol.Packet
+	switch typ {
+	case protocol.TypePrune:
+		t.lazy[src] = true
+	case protocol.TypeIHave:
+		for _, d := range m.IDs {
+			t.announce(src, d, p.hasReceived(d), time.Now())
+		}
+	case protocol.TypeGraft:
+		delete(t.lazy, src)
+		for _, d := range m.IDs {
+			if c, ok := t.cache[d]; ok {
+				resend = append(resend, c.pkt)
+			}
+		}
+	}
+	p.treeMutex.Unlock()
+
+	if len(resend) > 0 {
+		s := p.openSession(src)
+		if s == nil {
+			return
+		}
+		for _, pkt := range resend {
+			if s.Write(pkt) != nil {
+				p.removeSession(s)
+				return
+			}
+		}
+	}
+}
+
+func (p *Router) hasReceived(d [20]byte) bool {
+	p.statsMutex.Lock()
+	defer p.statsMutex.Unlock()
+	return p.receivedPackets.Contains(d[:])
+}
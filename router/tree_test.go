@@ -0,0 +1,51 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestBroadcastTree(t *testing.T) {
+	tree := newBroadcastTree()
+	peer := utils.NewRandomNodeID(namespace)
+	other := utils.NewRandomNodeID(namespace)
+	pkt := protocol.Packet{
+		Dst:     utils.NewRandomNodeID(utils.GroupNamespace),
+		Src:     utils.NewRandomNodeID(namespace),
+		Type:    "msg",
+		Payload: []byte("payload"),
+	}
+	d := pkt.Digest()
+	now := time.Now()
+
+	tree.lazy[peer] = true
+	tree.announce(peer, d, false, now)
+	tree.announce(other, d, false, now)
+	if g := tree.expire(now); len(g) != 0 {
+		t.Errorf("expire() returns %v; expects no grafts", g)
+	}
+
+	g := tree.expire(now.Add(ihaveTimeout + time.Second))
+	if len(g) != 1 || len(g[peer]) != 1 || g[peer][0] != d {
+		t.Errorf("expire() returns %v; expects a graft of the first announcer", g)
+	}
+	if tree.lazy[peer] {
+		t.Errorf("grafted peer should be eager")
+	}
+
+	tree.announce(peer, d, false, now)
+	tree.deliver(other, pkt, now)
+	if len(tree.missing) != 0 {
+		t.Errorf("delivered message should not be missing")
+	}
+	if _, ok := tree.cache[d]; !ok {
+		t.Errorf("delivered message should be cached")
+	}
+	tree.expire(now.Add(treeCacheAge + time.Second))
+	if _, ok := tree.cache[d]; ok {
+		t.Errorf("old message should be removed from the cache")
+	}
+}
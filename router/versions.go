@@ -0,0 +1,193 @@
+package router
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// SoftwareVersion is the version of this implementation,
+// which is sent to the peers in the handshake.
+const SoftwareVersion = "murcott/0.1"
+
+const (
+	// versionWindow is the time during which a peer is counted
+	// in the version telemetry after its last session.
+	versionWindow = 24 * time.Hour
+
+	// DeprecationShare is the share of the peers seen lately which do
+	// not support the minimum protocol version of the node above which
+	// a DeprecationWarning is emitted, once minVersionPeers have been
+	// seen.
+	DeprecationShare = 0.1
+	minVersionPeers  = 10
+)
+
+// VersionCount is the number of peers seen lately with a software
+// version and a newest protocol version. The versions are empty for
+// the peers which do not send them.
+type VersionCount struct {
+	Agent    string
+	Protocol string
+	Peers    int
+}
+
+type byPeers []VersionCount
+
+func (v byPeers) Len() int      { return len(v) }
+func (v byPeers) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v byPeers) Less(i, j int) bool {
+	if v[i].Peers != v[j].Peers {
+		return v[i].Peers > v[j].Peers
+	}
+	if v[i].Protocol != v[j].Protocol {
+		return v[i].Protocol > v[j].Protocol
+	}
+	return v[i].Agent < v[j].Agent
+}
+
+// DeprecationWarning reports that requiring MinProtocol would drop the
+// compatibility with Incompatible of the Peers seen lately.
+type DeprecationWarning struct {
+	MinProtocol  string
+	Incompatible int
+	Peers        int
+	Share        float64
+}
+
+type peerVersion struct {
+	agent    string
+	protocol string
+	seen     time.Time
+}
+
+// versionTable holds the versions of the peers seen lately.
+type versionTable struct {
+	peers   map[utils.NodeID]peerVersion
+	min     string
+	warned  bool
+	handler func(DeprecationWarning)
+	mutex   sync.Mutex
+}
+
+func newVersionTable(min string) *versionTable {
+	return &versionTable{peers: make(map[utils.NodeID]peerVersion), min: min}
+}
+
+// protocolNumber returns the number of a protocol version of the form
+// "murcott/N", or -1 for the other versions.
+func protocolNumber(v string) int {
+	if !strings.HasPrefix(v, "murcott/") {
+		return -1
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(v, "murcott/"))
+	if err != nil {
+		return -1
+	}
+	return n
+}
+
+// seen records the versions of the peer of a new session. offer is the
+// list of the protocol versions of the peer, oldest first.
+func (t *versionTable) seen(id utils.NodeID, agent string, offer []string, now time.Time) {
+	v := peerVersion{agent: agent, seen: now}
+	if len(offer) > 0 {
+		v.protocol = offer[len(offer)-1]
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.peers[id] = v
+}
+
+// prune forgets the peers which have not been seen lately.
+func (t *versionTable) prune(now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for id, v := range t.peers {
+		if now.Sub(v.seen) > versionWindow {
+			delete(t.peers, id)
+		}
+	}
+}
+
+func (t *versionTable) counts() []VersionCount {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m := make(map[[2]string]int)
+	for _, v := range t.peers {
+		m[[2]string{v.agent, v.protocol}]++
+	}
+	var l []VersionCount
+	for k, n := range m {
+		l = append(l, VersionCount{Agent: k[0], Protocol: k[1], Peers: n})
+	}
+	sort.Sort(byPeers(l))
+	return l
+}
+
+// check returns a warning when the share of the peers which do not
+// support the minimum protocol version rises above DeprecationShare.
+// It warns again once the share has fallen below and risen again.
+func (t *versionTable) check() (DeprecationWarning, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	min := protocolNumber(t.min)
+	if min < 0 || len(t.peers) < minVersionPeers {
+		return DeprecationWarning{}, false
+	}
+	w := DeprecationWarning{MinProtocol: t.min, Peers: len(t.peers)}
+	for _, v := range t.peers {
+		if protocolNumber(v.protocol) < min {
+			w.Incompatible++
+		}
+	}
+	w.Share = float64(w.Incompatible) / float64(w.Peers)
+	if w.Share < DeprecationShare {
+		t.warned = false
+		return w, false
+	}
+	if t.warned {
+		return w, false
+	}
+	t.warned = true
+	return w, true
+}
+
+// checkVersions forgets the peers which have not been seen lately, and
+// warns if the minimum protocol version would drop a significant share
+// of the network.
+func (p *Router) checkVersions(now time.Time) {
+	p.versions.prune(now)
+	w, ok := p.versions.check()
+	if !ok {
+		return
+	}
+	p.logger.Warning("%d of %d peers (%.0f%%) do not support %s",
+		w.Incompatible, w.Peers, w.Share*100, w.MinProtocol)
+	p.versions.mutex.Lock()
+	h := p.versions.handler
+	p.versions.mutex.Unlock()
+	if h != nil {
+		h(w)
+	}
+}
+
+// PeerVersions counts the peers which have opened a session with this
+// node within a day by software and protocol version, from the most
+// common versions.
+func (p *Router) PeerVersions() []VersionCount {
+	return p.versions.counts()
+}
+
+// SetDeprecationHandler sets a function which is called when the share
+// of the peers which do not support the minimum protocol version of the
+// configuration rises above DeprecationShare.
+func (p *Router) SetDeprecationHandler(h func(DeprecationWarning)) {
+	p.versions.mutex.Lock()
+	defer p.versions.mutex.Unlock()
+	p.versions.handler = h
+}
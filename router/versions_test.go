@@ -0,0 +1,48 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestVersionTable(t *testing.T) {
+	v := newVersionTable("murcott/2")
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		v.seen(utils.NewRandomNodeID(utils.GlobalNamespace), "murcott/0.2", []string{"murcott/1", "murcott/2"}, now)
+	}
+	if _, ok := v.check(); ok {
+		t.Errorf("check() should not warn before %d peers are seen", minVersionPeers)
+	}
+	old := utils.NewRandomNodeID(utils.GlobalNamespace)
+	v.seen(old, "murcott/0.1", []string{"murcott/1"}, now)
+	v.seen(utils.NewRandomNodeID(utils.GlobalNamespace), "", nil, now.Add(-versionWindow))
+
+	counts := v.counts()
+	if len(counts) != 3 || counts[0].Agent != "murcott/0.2" || counts[0].Protocol != "murcott/2" || counts[0].Peers != 8 {
+		t.Errorf("counts() returns %+v; expects 8 peers of murcott/0.2 first", counts)
+	}
+
+	w, ok := v.check()
+	if !ok || w.Incompatible != 2 || w.Peers != 10 || w.Share != 0.2 {
+		t.Errorf("check() returns %+v, %v; expects 2 of 10 incompatible peers", w, ok)
+	}
+	if _, ok := v.check(); ok {
+		t.Errorf("check() should only warn once")
+	}
+
+	v.prune(now.Add(time.Hour))
+	v.seen(old, "murcott/0.2", []string{"murcott/2"}, now)
+	for i := 0; i < 2; i++ {
+		v.seen(utils.NewRandomNodeID(utils.GlobalNamespace), "murcott/0.2", []string{"murcott/2"}, now)
+	}
+	if w, ok := v.check(); ok || w.Incompatible != 0 {
+		t.Errorf("check() returns %+v, %v; expects no incompatible peer", w, ok)
+	}
+
+	if protocolNumber("murcott/12") != 12 || protocolNumber("other/1") != -1 || protocolNumber("") != -1 {
+		t.Errorf("protocolNumber() should parse the murcott protocol versions")
+	}
+}
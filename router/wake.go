@@ -0,0 +1,287 @@
+package router
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	// wakeNodes is the number of mailbox nodes chosen by RegisterWake.
+	wakeNodes = 3
+
+	// wakeTTL is the time after which a registration expires
+	// on the mailbox nodes.
+	wakeTTL = 24 * time.Hour
+
+	// wakeInterval is the minimum interval between the wake-ups
+	// of a node, both requested by senders and run by mailboxes.
+	wakeInterval = time.Minute
+)
+
+// WakeRegistration asks mailbox nodes to wake up a node in low-power mode
+// when messages are queued for it. Token is opaque to the mailboxes and is
+// passed to their wake handler, for example to trigger a platform push.
+// The registration is also published in the DHT without the token, so that
+// senders know which mailboxes to notify. It is signed with the key of
+// the node. An empty token cancels the registration.
+type WakeRegistration struct {
+	ID    utils.NodeID    `msgpack:"id"`
+	Token []byte          `msgpack:"token"`
+	Nodes []utils.NodeID  `msgpack:"nodes"`
+	Time  int64           `msgpack:"time"`
+	Key   utils.PublicKey `msgpack:"key"`
+	Sign  utils.Signature `msgpack:"sign"`
+}
+
+func (r *WakeRegistration) serialize() []byte {
+	var nodes [][]byte
+	for _, n := range r.Nodes {
+		nodes = append(nodes, n.Bytes())
+	}
+	data, _ := msgpack.Marshal([]interface{}{
+		r.ID.Bytes(),
+		r.Token,
+		nodes,
+		r.Time,
+	})
+	return data
+}
+
+func (r *WakeRegistration) sign(key *utils.PrivateKey) error {
+	r.Key = key.PublicKey
+	sign := key.Sign(r.serialize())
+	if sign == nil {
+		return errors.New("cannot sign wake registration")
+	}
+	r.Sign = *sign
+	return nil
+}
+
+// Verify checks that the registration is signed by its node.
+func (r *WakeRegistration) Verify() error {
+	if r.ID.Digest.Cmp(r.Key.Digest()) != 0 {
+		return errors.New("wake registration signed by wrong key")
+	}
+	if !r.Key.Verify(r.serialize(), &r.Sign) {
+		return errors.New("invalid wake registration signature")
+	}
+	return nil
+}
+
+func wakeKey(id utils.NodeID) string {
+	return "wake:" + id.String()
+}
+
+// wakeState holds the registrations received by a mailbox node,
+// the nodes chosen by this node and the time of the last wake-ups.
+type wakeState struct {
+	registrations map[utils.NodeID]WakeRegistration
+	nodes         []utils.NodeID
+	notified      wakeLimiter
+	woken         wakeLimiter
+	handler       func(id utils.NodeID, token []byte)
+	mutex         sync.Mutex
+}
+
+// wakeLimiter limits the wake-ups of each node to one per wakeInterval.
+type wakeLimiter struct {
+	last map[utils.NodeID]time.Time
+}
+
+// allow reports whether the node can be woken up again,
+// and records the wake-up if so.
+func (l *wakeLimiter) allow(id utils.NodeID, now time.Time) bool {
+	if t, ok := l.last[id]; ok && now.Sub(t) < wakeInterval {
+		return false
+	}
+	if l.last == nil {
+		l.last = make(map[utils.NodeID]time.Time)
+	}
+	for k, t := range l.last {
+		if now.Sub(t) >= wakeInterval {
+			delete(l.last, k)
+		}
+	}
+	l.last[id] = now
+	return true
+}
+
+// SetWakeHandler sets a function which is called when messages are queued
+// for a node which has registered a wake token with this node. The node
+// must advertise the mailbox or the relay service to accept registrations.
+func (p *Router) SetWakeHandler(h func(id utils.NodeID, token []byte)) {
+	p.wake.mutex.Lock()
+	defer p.wake.mutex.Unlock()
+	p.wake.handler = h
+}
+
+// RegisterWake registers the token with the given mailbox nodes before
+// this node goes to low-power mode or offline. If there are none, the
+// known nodes which advertise the mailbox service are chosen, then those
+// which advertise the relay service.
+func (p *Router) RegisterWake(token []byte, nodes []utils.NodeID) error {
+	if len(token) == 0 {
+		return errors.New("empty wake token")
+	}
+	if len(nodes) == 0 {
+		candidates := append(p.NodesWithService(ServiceMailbox), p.NodesWithService(ServiceRelay)...)
+		for _, n := range candidates {
+			if len(nodes) == wakeNodes {
+				break
+			}
+			dup := false
+			for _, id := range nodes {
+				dup = dup || id.Match(n.ID)
+			}
+			if !dup {
+				nodes = append(nodes, n.ID)
+			}
+		}
+	}
+	if len(nodes) == 0 {
+		return errors.New("no mailbox nodes found")
+	}
+	p.wake.mutex.Lock()
+	p.wake.nodes = nodes
+	p.wake.mutex.Unlock()
+	return p.sendWakeRegistration(token, nodes)
+}
+
+// UnregisterWake cancels the registration of RegisterWake.
+func (p *Router) UnregisterWake() error {
+	p.wake.mutex.Lock()
+	nodes := p.wake.nodes
+	p.wake.nodes = nil
+	p.wake.mutex.Unlock()
+	if len(nodes) == 0 {
+		return nil
+	}
+	return p.sendWakeRegistration(nil, nodes)
+}
+
+// sendWakeRegistration sends the registration to the mailbox nodes and
+// publishes it without the token.
+func (p *Router) sendWakeRegistration(token []byte, nodes []utils.NodeID) error {
+	r := WakeRegistration{ID: p.id, Token: token, Nodes: nodes, Time: time.Now().UnixNano()}
+	err := r.sign(p.key)
+	if err != nil {
+		return err
+	}
+	payload, err := msgpack.Marshal(r)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		pkt, err := p.makePacket(n, protocol.TypeWakeRegister, payload)
+		if err != nil {
+			return err
+		}
+		p.send <- pkt
+	}
+
+	public := WakeRegistration{ID: p.id, Time: r.Time}
+	if len(token) > 0 {
+		public.Nodes = nodes
+	}
+	err = public.sign(p.key)
+	if err != nil {
+		return err
+	}
+	data, err := msgpack.Marshal(public)
+	if err != nil {
+		return err
+	}
+	p.mainDht.StoreValue(wakeKey(p.id), string(data))
+	return nil
+}
+
+// processWakeRegistration stores the registration of a node
+// if this node is a mailbox or a relay.
+func (p *Router) processWakeRegistration(src utils.NodeID, payload []byte) {
+	if caps := p.ownCapabilities(); !caps.Supports(ServiceMailbox) && !caps.Supports(ServiceRelay) {
+		return
+	}
+	var r WakeRegistration
+	err := msgpack.Unmarshal(payload, &r)
+	if err != nil {
+		p.reportMisbehavior(src, AbuseMalformed)
+		return
+	}
+	if !r.ID.Match(src) || r.Verify() != nil {
+		return
+	}
+	p.wake.mutex.Lock()
+	defer p.wake.mutex.Unlock()
+	if old, ok := p.wake.registrations[src]; ok && old.Time >= r.Time {
+		return
+	}
+	if len(r.Token) == 0 {
+		delete(p.wake.registrations, src)
+		return
+	}
+	if p.wake.registrations == nil {
+		p.wake.registrations = make(map[utils.NodeID]WakeRegistration)
+	}
+	p.wake.registrations[src] = r
+}
+
+// processWake calls the wake handler for the node of the payload if it
+// has registered a token with this node which has not expired. Any node
+// can request a wake-up, so the wake-ups are rate-limited.
+func (p *Router) processWake(payload []byte) {
+	var id utils.NodeID
+	if msgpack.Unmarshal(payload, &id) != nil {
+		return
+	}
+	now := time.Now()
+	p.wake.mutex.Lock()
+	r, ok := p.wake.registrations[id]
+	if ok && now.Sub(p.PeerTime(id, time.Unix(0, r.Time))) > wakeTTL {
+		delete(p.wake.registrations, id)
+		ok = false
+	}
+	h := p.wake.handler
+	ok = ok && h != nil && p.wake.woken.allow(id, now)
+	p.wake.mutex.Unlock()
+	if ok {
+		h(id, r.Token)
+	}
+}
+
+// notifyWake asks the mailbox nodes of the destination of a queued
+// message to wake it up.
+func (p *Router) notifyWake(dst utils.NodeID) {
+	p.wake.mutex.Lock()
+	ok := p.wake.notified.allow(dst, time.Now())
+	p.wake.mutex.Unlock()
+	if !ok {
+		return
+	}
+	str := p.mainDht.LoadValue(wakeKey(dst))
+	if str == nil {
+		return
+	}
+	var r WakeRegistration
+	if msgpack.Unmarshal([]byte(*str), &r) != nil || !r.ID.Match(dst) || r.Verify() != nil {
+		return
+	}
+	payload, err := msgpack.Marshal(dst)
+	if err != nil {
+		return
+	}
+	for _, n := range r.Nodes {
+		if n.Match(p.id) {
+			p.processWake(payload)
+			continue
+		}
+		pkt, err := p.makePacket(n, protocol.TypeWake, payload)
+		if err == nil {
+			p.send <- pkt
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestWakeRegistration(t *testing.T) {
+	p := &Router{
+		id:   utils.NewRandomNodeID(namespace),
+		caps: CapabilityRecord{Services: []string{ServiceMailbox}},
+	}
+	var woken []utils.NodeID
+	p.SetWakeHandler(func(id utils.NodeID, token []byte) {
+		if string(token) != "token" {
+			t.Errorf("wake handler receives %q; expects %q", token, "token")
+		}
+		woken = append(woken, id)
+	})
+
+	key := utils.GeneratePrivateKey()
+	id := utils.NewNodeID(namespace, key.Digest())
+	register := func(token string, tm time.Time) {
+		r := WakeRegistration{ID: id, Token: []byte(token), Nodes: []utils.NodeID{p.id}, Time: tm.UnixNano()}
+		r.sign(key)
+		payload, _ := msgpack.Marshal(r)
+		p.processWakeRegistration(id, payload)
+	}
+	wake, _ := msgpack.Marshal(id)
+
+	p.processWake(wake)
+	if len(woken) != 0 {
+		t.Errorf("processWake() wakes an unregistered node")
+	}
+
+	now := time.Now()
+	register("token", now)
+	p.processWake(wake)
+	p.processWake(wake)
+	if len(woken) != 1 || !woken[0].Match(id) {
+		t.Errorf("processWake() wakes %d nodes; expects 1 within the wake interval", len(woken))
+	}
+
+	register("", now.Add(-time.Second))
+	if _, ok := p.wake.registrations[id]; !ok {
+		t.Errorf("an older registration should be ignored")
+	}
+	register("", now.Add(time.Second))
+	if _, ok := p.wake.registrations[id]; ok {
+		t.Errorf("an empty token should cancel the registration")
+	}
+
+	other := utils.NewRandomNodeID(namespace)
+	r := WakeRegistration{ID: id, Token: []byte("token"), Time: now.UnixNano()}
+	r.sign(key)
+	payload, _ := msgpack.Marshal(r)
+	p.processWakeRegistration(other, payload)
+	if len(p.wake.registrations) != 0 {
+		t.Errorf("a registration relayed by another node should be ignored")
+	}
+}
@@ -0,0 +1,170 @@
+// Package search provides a full-text index for archived messages.
+package search
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// Document represents an indexed message.
+type Document struct {
+	ID      string
+	Contact utils.NodeID
+	Src     utils.NodeID
+	Time    time.Time
+	Text    string
+}
+
+// Query represents a search query. Zero values are ignored.
+type Query struct {
+	Text    string
+	Phrase  bool
+	Contact *utils.NodeID
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+// Index is implemented by full-text index backends.
+// External engines such as bleve or SQLite FTS can be plugged in
+// by implementing this interface.
+type Index interface {
+	Add(doc Document) error
+	Remove(id string) error
+	Search(q Query) ([]Document, error)
+}
+
+// MemoryIndex is an in-memory inverted index.
+type MemoryIndex struct {
+	tokenizer Tokenizer
+	docs      map[string]Document
+	terms     map[string]map[string][]int
+	mutex     sync.RWMutex
+}
+
+// NewMemoryIndex generates an empty MemoryIndex with the given Tokenizer.
+func NewMemoryIndex(t Tokenizer) *MemoryIndex {
+	if t == nil {
+		t = DefaultTokenizer
+	}
+	return &MemoryIndex{
+		tokenizer: t,
+		docs:      make(map[string]Document),
+		terms:     make(map[string]map[string][]int),
+	}
+}
+
+func (x *MemoryIndex) Add(doc Document) error {
+	if doc.ID == "" {
+		return errors.New("empty document id")
+	}
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(doc.ID)
+	x.docs[doc.ID] = doc
+	for i, t := range x.tokenizer.Tokenize(doc.Text) {
+		if x.terms[t] == nil {
+			x.terms[t] = make(map[string][]int)
+		}
+		x.terms[t][doc.ID] = append(x.terms[t][doc.ID], i)
+	}
+	return nil
+}
+
+func (x *MemoryIndex) Remove(id string) error {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.remove(id)
+	return nil
+}
+
+func (x *MemoryIndex) remove(id string) {
+	doc, ok := x.docs[id]
+	if !ok {
+		return
+	}
+	delete(x.docs, id)
+	for _, t := range x.tokenizer.Tokenize(doc.Text) {
+		if m, ok := x.terms[t]; ok {
+			delete(m, id)
+			if len(m) == 0 {
+				delete(x.terms, t)
+			}
+		}
+	}
+}
+
+func (x *MemoryIndex) Search(q Query) ([]Document, error) {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	tokens := x.tokenizer.Tokenize(q.Text)
+
+	var res []Document
+	for id, doc := range x.docs {
+		if q.Contact != nil && !q.Contact.Match(doc.Contact) {
+			continue
+		}
+		if !q.Since.IsZero() && doc.Time.Before(q.Since) {
+			continue
+		}
+		if !q.Until.IsZero() && doc.Time.After(q.Until) {
+			continue
+		}
+		if x.match(id, tokens, q.Phrase) {
+			res = append(res, doc)
+		}
+	}
+
+	sort.Sort(byTime(res))
+	if q.Limit > 0 && len(res) > q.Limit {
+		res = res[:q.Limit]
+	}
+	return res, nil
+}
+
+func (x *MemoryIndex) match(id string, tokens []string, phrase bool) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	for _, t := range tokens {
+		if _, ok := x.terms[t][id]; !ok {
+			return false
+		}
+	}
+	if !phrase {
+		return true
+	}
+	for _, p := range x.terms[tokens[0]][id] {
+		if x.phraseAt(id, tokens, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *MemoryIndex) phraseAt(id string, tokens []string, pos int) bool {
+	for i, t := range tokens[1:] {
+		found := false
+		for _, p := range x.terms[t][id] {
+			if p == pos+i+1 {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+type byTime []Document
+
+func (s byTime) Len() int           { return len(s) }
+func (s byTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
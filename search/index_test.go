@@ -0,0 +1,58 @@
+package search
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestTokenizer(t *testing.T) {
+	tokens := UnicodeTokenizer{}.Tokenize("Hello, World! 今日は晴れ")
+	expected := []string{"hello", "world", "今日", "日は", "は晴", "晴れ"}
+	if !reflect.DeepEqual(tokens, expected) {
+		t.Errorf("Tokenize() returns %v; expects %v", tokens, expected)
+	}
+}
+
+func TestMemoryIndexSearch(t *testing.T) {
+	x := NewMemoryIndex(nil)
+	alice := utils.NewRandomNodeID(utils.GlobalNamespace)
+	bob := utils.NewRandomNodeID(utils.GlobalNamespace)
+	now := time.Now()
+
+	x.Add(Document{ID: "1", Contact: alice, Time: now, Text: "the quick brown fox"})
+	x.Add(Document{ID: "2", Contact: bob, Time: now.Add(time.Hour), Text: "the brown quick fox"})
+	x.Add(Document{ID: "3", Contact: alice, Time: now.Add(time.Hour * 2), Text: "lazy dog"})
+
+	ids := func(q Query) []string {
+		docs, err := x.Search(q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var l []string
+		for _, d := range docs {
+			l = append(l, d.ID)
+		}
+		return l
+	}
+
+	if l := ids(Query{Text: "quick fox"}); !reflect.DeepEqual(l, []string{"1", "2"}) {
+		t.Errorf("term query returns %v", l)
+	}
+	if l := ids(Query{Text: "quick brown", Phrase: true}); !reflect.DeepEqual(l, []string{"1"}) {
+		t.Errorf("phrase query returns %v", l)
+	}
+	if l := ids(Query{Contact: &alice}); !reflect.DeepEqual(l, []string{"1", "3"}) {
+		t.Errorf("contact query returns %v", l)
+	}
+	if l := ids(Query{Since: now.Add(time.Minute)}); !reflect.DeepEqual(l, []string{"2", "3"}) {
+		t.Errorf("date query returns %v", l)
+	}
+
+	x.Remove("1")
+	if l := ids(Query{Text: "quick"}); !reflect.DeepEqual(l, []string{"2"}) {
+		t.Errorf("removed document should not match: %v", l)
+	}
+}
@@ -0,0 +1,66 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Tokenizer splits a text into index terms.
+type Tokenizer interface {
+	Tokenize(text string) []string
+}
+
+// WordTokenizer splits a text at non-alphanumeric characters and lowercases each word.
+type WordTokenizer struct{}
+
+func (WordTokenizer) Tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// UnicodeTokenizer behaves like WordTokenizer but splits runs of
+// Han, Hiragana, Katakana and Hangul characters into overlapping bigrams,
+// since these scripts do not separate words with spaces.
+type UnicodeTokenizer struct{}
+
+func (UnicodeTokenizer) Tokenize(text string) []string {
+	var tokens []string
+	for _, w := range (WordTokenizer{}).Tokenize(text) {
+		var run []rune
+		flush := func() {
+			if len(run) == 1 {
+				tokens = append(tokens, string(run))
+			}
+			for i := 0; i+1 < len(run); i++ {
+				tokens = append(tokens, string(run[i:i+2]))
+			}
+			run = nil
+		}
+		var word []rune
+		for _, r := range w {
+			if isCJK(r) {
+				if len(word) > 0 {
+					tokens = append(tokens, string(word))
+					word = nil
+				}
+				run = append(run, r)
+			} else {
+				flush()
+				word = append(word, r)
+			}
+		}
+		flush()
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+		}
+	}
+	return tokens
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// DefaultTokenizer is used when no tokenizer is given to NewMemoryIndex.
+var DefaultTokenizer Tokenizer = UnicodeTokenizer{}
@@ -0,0 +1,172 @@
+package murcott
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// snapshotInterval is the interval between the statistics snapshots.
+	snapshotInterval = 5 * time.Minute
+
+	// Snapshots older than snapshotFullResolution are thinned to the
+	// first one of each hour and the last one of each run, and those
+	// older than snapshotRetention are dropped.
+	snapshotFullResolution = 24 * time.Hour
+	snapshotRetention      = 30 * 24 * time.Hour
+)
+
+// StatsSnapshot records the statistics of the node at a point in time.
+// The traffic is counted since Start, the time at which the client was
+// created, and the deliveries within the last hour as in DeliveryStats.
+type StatsSnapshot struct {
+	Time          time.Time `msgpack:"time"`
+	Start         time.Time `msgpack:"start"`
+	Sessions      int       `msgpack:"sessions"`
+	KnownNodes    int       `msgpack:"known"`
+	Delivered     int       `msgpack:"delivered"`
+	Failed        int       `msgpack:"failed"`
+	BytesSent     int64     `msgpack:"bytes-sent"`
+	BytesReceived int64     `msgpack:"bytes-received"`
+}
+
+// Uptime returns the time for which the client had been running
+// when the snapshot was taken.
+func (s StatsSnapshot) Uptime() time.Duration {
+	return s.Time.Sub(s.Start)
+}
+
+// UptimePeriod is a run of the client recorded by the snapshots.
+// End is the time of the last snapshot of the run.
+type UptimePeriod struct {
+	Start time.Time
+	End   time.Time
+}
+
+type bySnapshotTime []StatsSnapshot
+
+func (s bySnapshotTime) Len() int           { return len(s) }
+func (s bySnapshotTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s bySnapshotTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// snapshotHistory holds the snapshots of the current run and of the
+// previous ones restored from the storage, oldest first.
+type snapshotHistory struct {
+	list  []StatsSnapshot
+	start time.Time
+	last  time.Time
+	mutex sync.Mutex
+}
+
+func (h *snapshotHistory) due(now time.Time) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return now.Sub(h.last) >= snapshotInterval
+}
+
+func (h *snapshotHistory) add(s StatsSnapshot) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.last = s.Time
+	h.list = append(h.list, s)
+	h.prune(s.Time)
+}
+
+// prune applies the retention policy of the snapshots.
+func (h *snapshotHistory) prune(now time.Time) {
+	var list []StatsSnapshot
+	var hour time.Time
+	for i, s := range h.list {
+		age := now.Sub(s.Time)
+		if age > snapshotRetention {
+			continue
+		}
+		lastOfRun := i == len(h.list)-1 || !h.list[i+1].Start.Equal(s.Start)
+		newHour := !s.Time.Truncate(time.Hour).Equal(hour)
+		hour = s.Time.Truncate(time.Hour)
+		if age <= snapshotFullResolution || lastOfRun || newHour {
+			list = append(list, s)
+		}
+	}
+	h.list = list
+}
+
+// merge replaces the snapshots of the previous runs with the given ones.
+func (h *snapshotHistory) merge(list []StatsSnapshot, now time.Time) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, s := range h.list {
+		if s.Start.Equal(h.start) {
+			list = append(list, s)
+		}
+	}
+	sort.Sort(bySnapshotTime(list))
+	h.list = list
+	h.prune(now)
+}
+
+func (h *snapshotHistory) snapshots() []StatsSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return append([]StatsSnapshot(nil), h.list...)
+}
+
+func (h *snapshotHistory) since(t time.Time) []StatsSnapshot {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var list []StatsSnapshot
+	for _, s := range h.list {
+		if !s.Time.Before(t) {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func (h *snapshotHistory) uptime() []UptimePeriod {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	var list []UptimePeriod
+	for _, s := range h.list {
+		if n := len(list); n > 0 && list[n-1].Start.Equal(s.Start) {
+			list[n-1].End = s.Time
+			continue
+		}
+		list = append(list, UptimePeriod{Start: s.Start, End: s.Time})
+	}
+	return list
+}
+
+// snapshot collects the statistics of the client.
+func (c *Client) snapshot(now time.Time) StatsSnapshot {
+	traffic := c.router.Traffic()
+	s := StatsSnapshot{
+		Time:          now,
+		Start:         c.snapshots.start,
+		Sessions:      c.router.Usage().Sessions,
+		KnownNodes:    len(c.router.KnownNodes()),
+		BytesSent:     traffic.Sent,
+		BytesReceived: traffic.Received,
+	}
+	for _, id := range c.delivery.conversations() {
+		d := c.delivery.stats(id, now)
+		s.Delivered += d.Delivered
+		s.Failed += d.Failed
+	}
+	return s
+}
+
+// StatsHistory returns the statistics snapshots taken since the given
+// time, oldest first. The snapshots are taken every five minutes and
+// kept across restarts by Save and Load. Those older than a day are
+// thinned to one per hour, and those older than 30 days are dropped.
+func (c *Client) StatsHistory(since time.Time) []StatsSnapshot {
+	return c.snapshots.since(since)
+}
+
+// UptimeHistory returns the runs of the client recorded by the
+// statistics snapshots, oldest first.
+func (c *Client) UptimeHistory() []UptimePeriod {
+	return c.snapshots.uptime()
+}
@@ -0,0 +1,45 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapshotHistoryPrune(t *testing.T) {
+	now := time.Date(2015, 6, 1, 12, 0, 0, 0, time.UTC)
+	run1 := now.Add(-40 * 24 * time.Hour)
+	run2 := now.Add(-3 * 24 * time.Hour)
+	var list []StatsSnapshot
+	for _, d := range []time.Duration{0, time.Hour} {
+		list = append(list, StatsSnapshot{Time: run1.Add(d), Start: run1})
+	}
+	for d := time.Duration(0); d <= 2*time.Hour; d += snapshotInterval {
+		list = append(list, StatsSnapshot{Time: run2.Add(d), Start: run2})
+	}
+
+	h := snapshotHistory{start: now}
+	h.merge(list, now)
+	for d := time.Duration(0); d < time.Hour; d += snapshotInterval {
+		h.add(StatsSnapshot{Time: now.Add(d), Start: now})
+	}
+
+	// The first run is dropped and the second one is thinned
+	// to one snapshot per hour.
+	if l := h.since(time.Time{}); len(l) != 3+12 {
+		t.Errorf("since() returns %d snapshots; expects %d", len(l), 3+12)
+	}
+	if l := h.since(now); len(l) != 12 || !l[0].Time.Equal(now) {
+		t.Errorf("since() should return the snapshots of the current run")
+	}
+
+	periods := h.uptime()
+	if len(periods) != 2 {
+		t.Fatalf("uptime() returns %d periods; expects 2", len(periods))
+	}
+	if !periods[0].Start.Equal(run2) || !periods[0].End.Equal(run2.Add(2*time.Hour)) {
+		t.Errorf("uptime() returns %v; expects the second run", periods[0])
+	}
+	if p := periods[1]; p.End.Sub(p.Start) != 55*time.Minute {
+		t.Errorf("uptime() returns %v for the current run; expects 55m", p.End.Sub(p.Start))
+	}
+}
@@ -0,0 +1,285 @@
+package murcott
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+)
+
+const (
+	// deliveryTimeout is the time after which an unacknowledged message
+	// is counted as failed.
+	deliveryTimeout = 30 * time.Second
+
+	// statsWindow is the period covered by DeliveryStats.
+	statsWindow = time.Hour
+
+	maxDeliverySamples = 1024
+
+	// roomAckers is the number of the members of a room which
+	// acknowledge each room message on average.
+	roomAckers = 4
+)
+
+// DeliveryStats summarizes the delivery of the messages sent to a contact
+// or a room within the last hour. Room messages are acknowledged by about
+// roomAckers members, chosen by the message ID, and are counted as
+// delivered when the first of them acknowledges them.
+type DeliveryStats struct {
+	Sent      int
+	Delivered int
+	Failed    int
+	Pending   int
+
+	// Success is the ratio of delivered messages to the messages
+	// which have been delivered or failed.
+	Success float64
+
+	// Latency percentiles of the delivered messages.
+	P50 time.Duration
+	P90 time.Duration
+	P99 time.Duration
+}
+
+type deliverySample struct {
+	time      time.Time
+	latency   time.Duration
+	delivered bool
+}
+
+type pendingDelivery struct {
+	conv   utils.NodeID
+	packet [20]byte
+	sent   time.Time
+}
+
+type deliveryTracker struct {
+	pending map[string]pendingDelivery
+	samples map[utils.NodeID][]deliverySample
+	mutex   sync.Mutex
+}
+
+func (t *deliveryTracker) sent(id []byte, conv utils.NodeID, packet [20]byte, now time.Time) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.pending == nil {
+		t.pending = make(map[string]pendingDelivery)
+	}
+	t.pending[hex.EncodeToString(id)] = pendingDelivery{conv: conv, packet: packet, sent: now}
+}
+
+// packets returns the message IDs of the pending messages
+// by the IDs of their packets.
+func (t *deliveryTracker) packets() map[[20]byte][]byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m := make(map[[20]byte][]byte)
+	for k, p := range t.pending {
+		id, _ := hex.DecodeString(k)
+		m[p.packet] = id
+	}
+	return m
+}
+
+type queuedDelivery struct {
+	id   []byte
+	conv utils.NodeID
+}
+
+// queued returns the IDs and the conversations of the pending messages
+// by the IDs of their packets.
+func (t *deliveryTracker) queued() map[[20]byte]queuedDelivery {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	m := make(map[[20]byte]queuedDelivery)
+	for k, p := range t.pending {
+		id, _ := hex.DecodeString(k)
+		m[p.packet] = queuedDelivery{id: id, conv: p.conv}
+	}
+	return m
+}
+
+// cancel forgets a pending message and returns the ID of its packet.
+func (t *deliveryTracker) cancel(id []byte) ([20]byte, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	k := hex.EncodeToString(id)
+	p, ok := t.pending[k]
+	delete(t.pending, k)
+	return p.packet, ok
+}
+
+// acked records the delivery of a pending message and returns
+// its conversation.
+func (t *deliveryTracker) acked(id []byte, now time.Time) (utils.NodeID, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	k := hex.EncodeToString(id)
+	p, ok := t.pending[k]
+	if !ok {
+		return utils.NodeID{}, false
+	}
+	delete(t.pending, k)
+	t.add(p.conv, deliverySample{time: now, latency: now.Sub(p.sent), delivered: true})
+	return p.conv, true
+}
+
+type failedDelivery struct {
+	id   []byte
+	conv utils.NodeID
+}
+
+// expire counts the messages which have not been acknowledged
+// within deliveryTimeout as failed, and returns them.
+func (t *deliveryTracker) expire(now time.Time) []failedDelivery {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var failed []failedDelivery
+	for k, p := range t.pending {
+		if now.Sub(p.sent) > deliveryTimeout {
+			delete(t.pending, k)
+			t.add(p.conv, deliverySample{time: now})
+			id, _ := hex.DecodeString(k)
+			failed = append(failed, failedDelivery{id: id, conv: p.conv})
+		}
+	}
+	return failed
+}
+
+// forget drops the samples and the pending messages of a conversation.
+func (t *deliveryTracker) forget(conv utils.NodeID) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.samples, conv)
+	for k, p := range t.pending {
+		if p.conv.Match(conv) {
+			delete(t.pending, k)
+		}
+	}
+}
+
+func (t *deliveryTracker) add(conv utils.NodeID, s deliverySample) {
+	if t.samples == nil {
+		t.samples = make(map[utils.NodeID][]deliverySample)
+	}
+	l := append(t.samples[conv], s)
+	if len(l) > maxDeliverySamples {
+		l = l[len(l)-maxDeliverySamples:]
+	}
+	t.samples[conv] = l
+}
+
+func (t *deliveryTracker) stats(conv utils.NodeID, now time.Time) DeliveryStats {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	var s DeliveryStats
+	var latencies []time.Duration
+	for _, e := range t.samples[conv] {
+		if now.Sub(e.time) > statsWindow {
+			continue
+		}
+		if e.delivered {
+			s.Delivered++
+			latencies = append(latencies, e.latency)
+		} else {
+			s.Failed++
+		}
+	}
+	for _, p := range t.pending {
+		if p.conv.Match(conv) {
+			s.Pending++
+		}
+	}
+	s.Sent = s.Delivered + s.Failed + s.Pending
+	if n := s.Delivered + s.Failed; n > 0 {
+		s.Success = float64(s.Delivered) / float64(n)
+	}
+
+	sort.Sort(byDuration(latencies))
+	s.P50 = percentile(latencies, 50)
+	s.P90 = percentile(latencies, 90)
+	s.P99 = percentile(latencies, 99)
+	return s
+}
+
+func (t *deliveryTracker) conversations() []utils.NodeID {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	seen := make(map[utils.NodeID]bool)
+	var l []utils.NodeID
+	for id := range t.samples {
+		seen[id] = true
+		l = append(l, id)
+	}
+	for _, p := range t.pending {
+		if !seen[p.conv] {
+			seen[p.conv] = true
+			l = append(l, p.conv)
+		}
+	}
+	return l
+}
+
+// percentile returns the p-th percentile of the sorted list.
+func percentile(l []time.Duration, p int) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := (len(l)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return l[i]
+}
+
+type byDuration []time.Duration
+
+func (s byDuration) Len() int           { return len(s) }
+func (s byDuration) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byDuration) Less(i, j int) bool { return s[i] < s[j] }
+
+// roomAcker reports whether the member is one of those which acknowledge
+// the message in a room of n members, so that a room message is not
+// acknowledged by every member.
+func roomAcker(member utils.NodeID, msgid []byte, n int) bool {
+	if n <= roomAckers {
+		return true
+	}
+	h := sha256.Sum256(append(append([]byte(nil), msgid...), member.Bytes()...))
+	return binary.BigEndian.Uint64(h[:8]) < math.MaxUint64/uint64(n)*roomAckers
+}
+
+// ackMessage acknowledges a chat message. The room messages are only
+// acknowledged by the members chosen by roomAcker.
+func (c *Client) ackMessage(rm router.Message, msgid []byte) {
+	conv := rm.Conversation()
+	if bytes.Equal(conv.NS[:], utils.GroupNamespace[:]) && !roomAcker(c.id, msgid, c.router.MemberCount(conv)) {
+		return
+	}
+	c.sendAck(rm.Node, msgid)
+}
+
+// DeliveryStats returns the delivery statistics of the messages
+// sent to the given contact or room.
+func (c *Client) DeliveryStats(id utils.NodeID) DeliveryStats {
+	return c.delivery.stats(id, time.Now())
+}
+
+// Stats returns the delivery statistics of every conversation.
+func (c *Client) Stats() map[utils.NodeID]DeliveryStats {
+	now := time.Now()
+	m := make(map[utils.NodeID]DeliveryStats)
+	for _, id := range c.delivery.conversations() {
+		m[id] = c.delivery.stats(id, now)
+	}
+	return m
+}
@@ -0,0 +1,81 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestDeliveryTracker(t *testing.T) {
+	var d deliveryTracker
+	id := utils.NewNodeID(utils.GlobalNamespace, utils.GeneratePrivateKey().Digest())
+	now := time.Now()
+
+	for i := 0; i < 10; i++ {
+		msgid := []byte{byte(i)}
+		d.sent(msgid, id, [20]byte{byte(i)}, now)
+		if i < 8 {
+			d.acked(msgid, now.Add(time.Duration(i+1)*time.Second))
+		}
+	}
+	d.acked([]byte{0}, now.Add(time.Minute))
+
+	if m := d.packets(); len(m) != 2 || m[[20]byte{9}][0] != 9 {
+		t.Errorf("packets() returns %v; expects the 2 pending messages", m)
+	}
+
+	s := d.stats(id, now)
+	if s.Sent != 10 || s.Delivered != 8 || s.Pending != 2 {
+		t.Errorf("stats() returns %+v; expects 10 sent, 8 delivered, 2 pending", s)
+	}
+	if s.Success != 1 {
+		t.Errorf("Success should be %v; expects %v", s.Success, 1)
+	}
+	if s.P50 != 4*time.Second {
+		t.Errorf("P50 should be %v; expects %v", s.P50, 4*time.Second)
+	}
+	if s.P99 != 8*time.Second {
+		t.Errorf("P99 should be %v; expects %v", s.P99, 8*time.Second)
+	}
+
+	if f := d.expire(now.Add(deliveryTimeout + time.Second)); len(f) != 2 || f[0].conv != id {
+		t.Errorf("expire() returns %d messages; expects 2", len(f))
+	}
+	s = d.stats(id, now)
+	if s.Failed != 2 || s.Pending != 0 {
+		t.Errorf("stats() returns %+v; expects 2 failed, 0 pending", s)
+	}
+	if s.Success != 0.8 {
+		t.Errorf("Success should be %v; expects %v", s.Success, 0.8)
+	}
+
+	s = d.stats(id, now.Add(2*statsWindow))
+	if s.Sent != 0 {
+		t.Errorf("Sent should be %v; expects %v", s.Sent, 0)
+	}
+}
+
+func TestRoomAcker(t *testing.T) {
+	msgid := []byte("message")
+	for i := 0; i < roomAckers; i++ {
+		if !roomAcker(utils.NewRandomNodeID(utils.GlobalNamespace), msgid, roomAckers) {
+			t.Errorf("roomAcker() should choose every member of a small room")
+		}
+	}
+	var members []utils.NodeID
+	for i := 0; i < 100; i++ {
+		members = append(members, utils.NewRandomNodeID(utils.GlobalNamespace))
+	}
+	ackers := 0
+	for i := 0; i < 100; i++ {
+		for _, m := range members {
+			if roomAcker(m, []byte{byte(i)}, len(members)) {
+				ackers++
+			}
+		}
+	}
+	if ackers < 50*roomAckers || ackers > 150*roomAckers {
+		t.Errorf("roomAcker() chooses %d members for 100 messages; expects about %d", ackers, 100*roomAckers)
+	}
+}
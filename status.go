@@ -1,12 +1,186 @@
 package murcott
 
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott/protocol"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
 const (
 	StatusOffline = "offline"
 	StatusAway    = "away"
 	StatusActive  = "active"
 )
 
+// defaultAwayTimeout is the idle time after which an active user
+// becomes away.
+const defaultAwayTimeout = 5 * time.Minute
+
 type UserStatus struct {
 	Type    string `msgpack:"type"`
 	Message string `msgpack:"message"`
 }
+
+// StatusEvent is emitted when the status of this user changes.
+// Auto is true if the status has been changed automatically,
+// by idleness or network loss, rather than set by the user.
+type StatusEvent struct {
+	Status UserStatus
+	Auto   bool
+}
+
+// PresenceEvent is emitted when a contact announces its status.
+type PresenceEvent struct {
+	ID     utils.NodeID
+	Status UserStatus
+}
+
+type scheduledStatus struct {
+	Time   time.Time
+	Status UserStatus
+}
+
+type byScheduledTime []scheduledStatus
+
+func (s byScheduledTime) Len() int           { return len(s) }
+func (s byScheduledTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byScheduledTime) Less(i, j int) bool { return s[i].Time.Before(s[j].Time) }
+
+// presence derives the status of this user from the status set by the
+// user, the idleness reported by the application and the network state.
+type presence struct {
+	manual   UserStatus
+	current  UserStatus
+	idle     time.Duration
+	timeout  time.Duration
+	disabled bool
+	offline  bool
+	schedule []scheduledStatus
+	mutex    sync.Mutex
+}
+
+func (p *presence) status() UserStatus {
+	s := p.manual
+	if s.Type == "" {
+		s.Type = StatusActive
+	}
+	timeout := p.timeout
+	if timeout == 0 {
+		timeout = defaultAwayTimeout
+	}
+	if p.offline {
+		s.Type = StatusOffline
+	} else if s.Type == StatusActive && !p.disabled && p.idle >= timeout {
+		s.Type = StatusAway
+	}
+	return s
+}
+
+// update applies the scheduled statuses due at now and reports whether
+// the status has changed.
+func (p *presence) update(now time.Time) (UserStatus, bool) {
+	for len(p.schedule) > 0 && !p.schedule[0].Time.After(now) {
+		p.manual = p.schedule[0].Status
+		p.schedule = p.schedule[1:]
+	}
+	s := p.status()
+	if s == p.current {
+		return s, false
+	}
+	p.current = s
+	return s, true
+}
+
+// SetStatus sets the status of this user. An active status becomes away
+// while the user is idle, and any status becomes offline while the
+// network is lost.
+func (c *Client) SetStatus(s UserStatus) {
+	c.presence.mutex.Lock()
+	c.presence.manual = s
+	c.presence.mutex.Unlock()
+	c.updateStatus(false)
+}
+
+// Status returns the current status of this user.
+func (c *Client) Status() UserStatus {
+	c.presence.mutex.Lock()
+	defer c.presence.mutex.Unlock()
+	return c.presence.status()
+}
+
+// SetAwayTimeout sets the idle time after which an active user becomes
+// away. A negative timeout disables auto-away.
+func (c *Client) SetAwayTimeout(d time.Duration) {
+	c.presence.mutex.Lock()
+	c.presence.timeout = d
+	c.presence.disabled = d < 0
+	c.presence.mutex.Unlock()
+	c.updateStatus(true)
+}
+
+// NotifyIdle reports how long the user has been idle. Applications should
+// call it periodically, and with zero when the user is active again.
+func (c *Client) NotifyIdle(d time.Duration) {
+	c.presence.mutex.Lock()
+	c.presence.idle = d
+	c.presence.mutex.Unlock()
+	c.updateStatus(true)
+}
+
+// ScheduleStatus sets the status of this user at the given time.
+func (c *Client) ScheduleStatus(t time.Time, s UserStatus) {
+	c.presence.mutex.Lock()
+	c.presence.schedule = append(c.presence.schedule, scheduledStatus{Time: t, Status: s})
+	sort.Stable(byScheduledTime(c.presence.schedule))
+	c.presence.mutex.Unlock()
+	c.updateStatus(false)
+}
+
+// ClearScheduledStatuses cancels the statuses set by ScheduleStatus
+// which are not applied yet.
+func (c *Client) ClearScheduledStatuses() {
+	c.presence.mutex.Lock()
+	defer c.presence.mutex.Unlock()
+	c.presence.schedule = nil
+}
+
+// setNetworkLost makes this user offline while there are no network
+// addresses.
+func (c *Client) setNetworkLost(lost bool) {
+	c.presence.mutex.Lock()
+	c.presence.offline = lost
+	c.presence.mutex.Unlock()
+	c.updateStatus(true)
+}
+
+// updateStatus emits a StatusEvent and announces the status to the
+// contacts if it has changed.
+func (c *Client) updateStatus(auto bool) {
+	c.presence.mutex.Lock()
+	s, changed := c.presence.update(time.Now())
+	lost := c.presence.offline
+	c.presence.mutex.Unlock()
+	if !changed {
+		return
+	}
+	c.mbuf.Push(readPair{M: StatusEvent{Status: s, Auto: auto}, ID: c.id})
+	if !lost && c.router != nil {
+		go c.sendPresence(s)
+	}
+}
+
+func (c *Client) sendPresence(s UserStatus) {
+	t := protocol.Envelope{Type: protocol.MsgPresence, ID: c.id.String(), Content: UserPresence{Status: s}}
+	data, err := msgpack.Marshal(t)
+	if err != nil {
+		return
+	}
+	ids := c.Roster.List()
+	for _, id := range ids {
+		c.sendBatched(id, data)
+	}
+}
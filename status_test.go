@@ -0,0 +1,55 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStatusTransitions(t *testing.T) {
+	c := &Client{mbuf: newMessageBuffer(16)}
+
+	check := func(name string, typ string, auto bool) {
+		if s := c.Status(); s.Type != typ {
+			t.Errorf("%s: Status() returns %q; expects %q", name, s.Type, typ)
+		}
+		m, _ := c.mbuf.Pop()
+		if e, ok := m.M.(StatusEvent); !ok || e.Status.Type != typ || e.Auto != auto {
+			t.Errorf("%s: emits %v; expects a StatusEvent of %q", name, m.M, typ)
+		}
+	}
+
+	c.SetStatus(UserStatus{Type: StatusActive, Message: "hi"})
+	check("SetStatus", StatusActive, false)
+
+	c.SetAwayTimeout(time.Minute)
+	c.NotifyIdle(30 * time.Second)
+	if c.mbuf.size != 0 {
+		t.Errorf("NotifyIdle() should not change the status before the timeout")
+	}
+	c.NotifyIdle(2 * time.Minute)
+	check("NotifyIdle", StatusAway, true)
+	if s := c.Status(); s.Message != "hi" {
+		t.Errorf("auto-away should keep the status message; got %q", s.Message)
+	}
+
+	c.setNetworkLost(true)
+	check("setNetworkLost", StatusOffline, true)
+	c.setNetworkLost(false)
+	check("setNetworkLost", StatusAway, true)
+	c.NotifyIdle(0)
+	check("NotifyIdle", StatusActive, true)
+
+	c.SetAwayTimeout(-1)
+	c.NotifyIdle(time.Hour)
+	if c.mbuf.size != 0 {
+		t.Errorf("NotifyIdle() should not change the status if auto-away is disabled")
+	}
+
+	c.ScheduleStatus(time.Now().Add(time.Hour), UserStatus{Type: StatusOffline})
+	c.ScheduleStatus(time.Now().Add(-time.Second), UserStatus{Type: StatusAway})
+	check("ScheduleStatus", StatusAway, false)
+	c.ClearScheduledStatuses()
+	if len(c.presence.schedule) != 0 {
+		t.Errorf("ClearScheduledStatuses() leaves %d statuses", len(c.presence.schedule))
+	}
+}
@@ -0,0 +1,112 @@
+// Package atomicfile provides crash-safe file writes.
+//
+// Files are written to a temporary file in the same directory, synced,
+// and renamed over the destination, so readers observe either the old
+// or the new contents but never a partial write.
+package atomicfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// ErrNoHeader is returned by ReadVersioned when the file has no header,
+// e.g. because it was written before headers were introduced.
+var ErrNoHeader = errors.New("missing file header")
+
+const headerSize = 4 + 1 + 4
+
+// Write replaces the file at path with the output of fn.
+func Write(path string, perm os.FileMode, fn func(w io.Writer) error) error {
+	dir := filepath.Dir(path)
+	f, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+
+	err = fn(f)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
+
+// WriteFile replaces the file at path with data.
+func WriteFile(path string, data []byte, perm os.FileMode) error {
+	return Write(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// WriteVersioned replaces the file at path with data preceded by a header
+// which holds the 4-byte magic, the format version and a checksum of data.
+func WriteVersioned(path string, magic string, version byte, data []byte, perm os.FileMode) error {
+	if len(magic) != 4 {
+		return errors.New("magic must be 4 bytes")
+	}
+	return Write(path, perm, func(w io.Writer) error {
+		var h [headerSize]byte
+		copy(h[:4], magic)
+		h[4] = version
+		binary.BigEndian.PutUint32(h[5:], crc32.ChecksumIEEE(data))
+		_, err := w.Write(h[:])
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+// ReadVersioned reads a file written by WriteVersioned with the same magic
+// and returns its format version and data.
+// If the file has no header, ErrNoHeader is returned with the whole contents.
+func ReadVersioned(path string, magic string) (byte, []byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(b) < headerSize || !bytes.Equal(b[:4], []byte(magic)) {
+		return 0, b, ErrNoHeader
+	}
+	version := b[4]
+	sum := binary.BigEndian.Uint32(b[5:headerSize])
+	data := b[headerSize:]
+	if crc32.ChecksumIEEE(data) != sum {
+		return version, nil, fmt.Errorf("%s: checksum mismatch", path)
+	}
+	return version, data, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	// Some platforms do not support syncing directories.
+	d.Sync()
+	return nil
+}
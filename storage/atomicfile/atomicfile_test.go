@@ -0,0 +1,75 @@
+package atomicfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	err = WriteFile(path, []byte("old"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Write(path, 0600, func(w io.Writer) error {
+		w.Write([]byte("partial"))
+		return errors.New("interrupted")
+	})
+	if err == nil {
+		t.Errorf("Write() should return the error of the callback")
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	if string(b) != "old" {
+		t.Errorf("failed write replaced the file: %q", b)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("temporary file is left: %d files", len(files))
+	}
+}
+
+func TestVersioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	err = WriteVersioned(path, "TEST", 2, []byte("data"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, data, err := ReadVersioned(path, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v != 2 || !bytes.Equal(data, []byte("data")) {
+		t.Errorf("ReadVersioned() returns %d %q; expects 2 data", v, data)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	b[len(b)-1] ^= 1
+	ioutil.WriteFile(path, b, 0600)
+	if _, _, err := ReadVersioned(path, "TEST"); err == nil {
+		t.Errorf("ReadVersioned() should detect a corrupt file")
+	}
+
+	ioutil.WriteFile(path, []byte("legacy"), 0600)
+	_, data, err = ReadVersioned(path, "TEST")
+	if err != ErrNoHeader || string(data) != "legacy" {
+		t.Errorf("ReadVersioned() returns %q %v for a legacy file", data, err)
+	}
+}
@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemoryStorage is a volatile Storage intended for tests.
+type MemoryStorage struct {
+	buckets map[string]map[string][]byte
+	mutex   sync.RWMutex
+}
+
+// NewMemoryStorage generates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStorage) Update(fn func(Tx) error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	tx := &memoryTx{buckets: make(map[string]map[string][]byte), writable: true}
+	for name, b := range s.buckets {
+		c := make(map[string][]byte, len(b))
+		for k, v := range b {
+			c[k] = v
+		}
+		tx.buckets[name] = c
+	}
+	err := fn(tx)
+	if err != nil {
+		return err
+	}
+	s.buckets = tx.buckets
+	return nil
+}
+
+func (s *MemoryStorage) View(fn func(Tx) error) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return fn(&memoryTx{buckets: s.buckets})
+}
+
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	buckets  map[string]map[string][]byte
+	writable bool
+}
+
+func (tx *memoryTx) Get(bucket string, key []byte) ([]byte, error) {
+	if v, ok := tx.buckets[bucket][string(key)]; ok {
+		return append([]byte{}, v...), nil
+	}
+	return nil, nil
+}
+
+func (tx *memoryTx) Put(bucket string, key, value []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	b := tx.buckets[bucket]
+	if b == nil {
+		b = make(map[string][]byte)
+		tx.buckets[bucket] = b
+	}
+	b[string(key)] = append([]byte{}, value...)
+	return nil
+}
+
+func (tx *memoryTx) Delete(bucket string, key []byte) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	delete(tx.buckets[bucket], string(key))
+	return nil
+}
+
+func (tx *memoryTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	b := tx.buckets[bucket]
+	var keys []string
+	for k := range b {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		err := fn([]byte(k), append([]byte{}, b[k]...))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *memoryTx) DeleteBucket(bucket string) error {
+	if !tx.writable {
+		return ErrReadOnly
+	}
+	delete(tx.buckets, bucket)
+	return nil
+}
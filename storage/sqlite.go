@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS kv (
+	bucket TEXT NOT NULL,
+	key    BLOB NOT NULL,
+	value  BLOB NOT NULL,
+	PRIMARY KEY (bucket, key)
+)`
+
+// SQLiteStorage is a Storage backed by a SQLite database file.
+type SQLiteStorage struct {
+	db *sql.DB
+}
+
+// OpenSQLite opens the SQLite database at the given path, creating it if necessary.
+func OpenSQLite(path string) (*SQLiteStorage, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = db.Exec(sqliteSchema)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteStorage{db: db}, nil
+}
+
+func (s *SQLiteStorage) Update(fn func(Tx) error) error {
+	return s.exec(fn, true)
+}
+
+func (s *SQLiteStorage) View(fn func(Tx) error) error {
+	return s.exec(fn, false)
+}
+
+func (s *SQLiteStorage) exec(fn func(Tx) error, writable bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = fn(sqliteTx{tx: tx, writable: writable})
+	if err != nil || !writable {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *SQLiteStorage) Close() error {
+	return s.db.Close()
+}
+
+type sqliteTx struct {
+	tx       *sql.Tx
+	writable bool
+}
+
+func (t sqliteTx) Get(bucket string, key []byte) ([]byte, error) {
+	var v []byte
+	err := t.tx.QueryRow("SELECT value FROM kv WHERE bucket = ? AND key = ?", bucket, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (t sqliteTx) Put(bucket string, key, value []byte) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	_, err := t.tx.Exec("INSERT OR REPLACE INTO kv (bucket, key, value) VALUES (?, ?, ?)", bucket, key, value)
+	return err
+}
+
+func (t sqliteTx) Delete(bucket string, key []byte) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	_, err := t.tx.Exec("DELETE FROM kv WHERE bucket = ? AND key = ?", bucket, key)
+	return err
+}
+
+func (t sqliteTx) ForEach(bucket string, fn func(key, value []byte) error) error {
+	rows, err := t.tx.Query("SELECT key, value FROM kv WHERE bucket = ? ORDER BY key", bucket)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k, v []byte
+		err := rows.Scan(&k, &v)
+		if err != nil {
+			return err
+		}
+		err = fn(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (t sqliteTx) DeleteBucket(bucket string) error {
+	if !t.writable {
+		return ErrReadOnly
+	}
+	_, err := t.tx.Exec("DELETE FROM kv WHERE bucket = ?", bucket)
+	return err
+}
@@ -0,0 +1,38 @@
+// Package storage provides a key-value storage abstraction for client persistence.
+package storage
+
+import (
+	"errors"
+)
+
+// ErrReadOnly is returned when a read-only transaction is modified.
+var ErrReadOnly = errors.New("read-only transaction")
+
+// Storage is implemented by persistence backends.
+// Embedders can supply their own backend by implementing this interface.
+type Storage interface {
+	// Update executes fn within a read-write transaction.
+	// The transaction is committed if fn returns nil and rolled back otherwise.
+	Update(fn func(Tx) error) error
+
+	// View executes fn within a read-only transaction.
+	View(fn func(Tx) error) error
+
+	Close() error
+}
+
+// Tx represents a storage transaction.
+// Keys are grouped by bucket and iterated in byte order.
+type Tx interface {
+	// Get returns the value for the given key, or nil if it does not exist.
+	Get(bucket string, key []byte) ([]byte, error)
+	Put(bucket string, key, value []byte) error
+	Delete(bucket string, key []byte) error
+
+	// ForEach calls fn for each key-value pair in the given bucket.
+	// The iteration stops when fn returns an error.
+	ForEach(bucket string, fn func(key, value []byte) error) error
+
+	// DeleteBucket removes the given bucket and all its keys.
+	DeleteBucket(bucket string) error
+}
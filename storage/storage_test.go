@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	testStorage(t, NewMemoryStorage())
+}
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenBolt(filepath.Join(dir, "murcott.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+}
+
+func TestSQLiteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "murcott")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s, err := OpenSQLite(filepath.Join(dir, "murcott.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	testStorage(t, s)
+}
+
+// testStorage checks the behavior which every backend must share.
+func testStorage(t *testing.T, s Storage) {
+	s.View(func(tx Tx) error {
+		if v, err := tx.Get("b", []byte("1")); v != nil || err != nil {
+			t.Errorf("Get() returns %q, %v for a missing bucket", v, err)
+		}
+		return nil
+	})
+
+	err := s.Update(func(tx Tx) error {
+		tx.Put("b", []byte("2"), []byte("two"))
+		tx.Put("b", []byte{0xff}, []byte("high"))
+		tx.Put("b", []byte("1"), []byte("one"))
+		return tx.Put("c", []byte("1"), []byte("other"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.Update(func(tx Tx) error {
+		tx.Put("b", []byte("3"), []byte("three"))
+		return errors.New("rollback")
+	})
+	if err == nil {
+		t.Errorf("Update() should return the error of the callback")
+	}
+
+	s.View(func(tx Tx) error {
+		var keys []string
+		tx.ForEach("b", func(k, v []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+		if !reflect.DeepEqual(keys, []string{"1", "2", "\xff"}) {
+			t.Errorf("ForEach() iterates %q; expects [1 2 \\xff]", keys)
+		}
+		if tx.Put("b", []byte("4"), []byte("four")) != ErrReadOnly {
+			t.Errorf("Put() should fail in a read-only transaction")
+		}
+		if tx.Delete("b", []byte("1")) != ErrReadOnly {
+			t.Errorf("Delete() should fail in a read-only transaction")
+		}
+		if tx.DeleteBucket("b") != ErrReadOnly {
+			t.Errorf("DeleteBucket() should fail in a read-only transaction")
+		}
+		return nil
+	})
+
+	s.Update(func(tx Tx) error {
+		tx.Delete("b", []byte("1"))
+		return tx.DeleteBucket("c")
+	})
+	s.View(func(tx Tx) error {
+		if v, _ := tx.Get("b", []byte("1")); v != nil {
+			t.Errorf("Get() returns %q for a deleted key", v)
+		}
+		if v, _ := tx.Get("b", []byte("2")); string(v) != "two" {
+			t.Errorf("Get() returns %q; expects two", v)
+		}
+		if v, _ := tx.Get("b", []byte("3")); v != nil {
+			t.Errorf("Get() returns %q for a rolled back key", v)
+		}
+		if v, _ := tx.Get("c", []byte("1")); v != nil {
+			t.Errorf("Get() returns %q for a deleted bucket", v)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,734 @@
+package murcott
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+const (
+	rosterBucket   = "roster"
+	settingsBucket = "settings"
+	aliasesBucket  = "aliases"
+	historyBucket  = "history"
+	nodesBucket    = "nodes"
+	countersBucket = "counters"
+	devicesBucket  = "devices"
+	syncBucket     = "sync"
+	statsBucket    = "stats"
+	capsBucket     = "caps"
+	reachBucket    = "reach"
+	tagsBucket     = "tags"
+	favBucket      = "favorites"
+	secretsBucket  = "secrets"
+	roomKeysBucket = "roomkeys"
+	roomMetaBucket = "roommeta"
+	channelsBucket = "channels"
+	approvedBucket = "approved"
+	outboxBucket   = "outbox"
+	sentBucket     = "sent"
+)
+
+func (r *Roster) save(tx storage.Tx) error {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	for _, b := range []string{rosterBucket, settingsBucket, aliasesBucket, tagsBucket, favBucket, secretsBucket, approvedBucket} {
+		err := tx.DeleteBucket(b)
+		if err != nil {
+			return err
+		}
+	}
+	for id, p := range r.M {
+		err := putValue(tx, rosterBucket, id.Bytes(), p)
+		if err != nil {
+			return err
+		}
+	}
+	for id, s := range r.Settings {
+		err := putValue(tx, settingsBucket, id.Bytes(), s)
+		if err != nil {
+			return err
+		}
+	}
+	for id, a := range r.Aliases {
+		err := putValue(tx, aliasesBucket, id.Bytes(), a)
+		if err != nil {
+			return err
+		}
+	}
+	for id, t := range r.Tags {
+		err := putValue(tx, tagsBucket, id.Bytes(), t)
+		if err != nil {
+			return err
+		}
+	}
+	for id, f := range r.Favorites {
+		err := putValue(tx, favBucket, id.Bytes(), f)
+		if err != nil {
+			return err
+		}
+	}
+	for id, c := range r.Secrets {
+		err := putValue(tx, secretsBucket, id.Bytes(), c)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range r.Approved {
+		err := tx.Put(approvedBucket, id.Bytes(), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Roster) restore(tx storage.Tx) error {
+	var s Roster
+	s.M = make(map[utils.NodeID]UserProfile)
+	s.Settings = make(map[utils.NodeID]ContactSettings)
+	s.Aliases = make(map[utils.NodeID]string)
+	s.Tags = make(map[utils.NodeID][]string)
+	s.Favorites = make(map[utils.NodeID]bool)
+	s.Secrets = make(map[utils.NodeID][]byte)
+	s.Approved = make(map[utils.NodeID]bool)
+	err := tx.ForEach(rosterBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var p UserProfile
+		err = msgpack.Unmarshal(v, &p)
+		s.M[id] = p
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(settingsBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var c ContactSettings
+		err = msgpack.Unmarshal(v, &c)
+		s.Settings[id] = c
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(aliasesBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var a string
+		err = msgpack.Unmarshal(v, &a)
+		s.Aliases[id] = a
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(tagsBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var t []string
+		err = msgpack.Unmarshal(v, &t)
+		s.Tags[id] = t
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(favBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var f bool
+		err = msgpack.Unmarshal(v, &f)
+		s.Favorites[id] = f
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(secretsBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var c []byte
+		err = msgpack.Unmarshal(v, &c)
+		s.Secrets[id] = c
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(approvedBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		s.Approved[id] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.load(&s)
+	return nil
+}
+
+func (h *History) save(tx storage.Tx) error {
+	h.mutex.RLock()
+	defer h.mutex.RUnlock()
+	err := tx.DeleteBucket(historyBucket)
+	if err != nil {
+		return err
+	}
+	for id, list := range h.M {
+		err := putValue(tx, historyBucket, id.Bytes(), list)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *History) restore(tx storage.Tx) error {
+	var s History
+	s.M = make(map[utils.NodeID][]HistoryEntry)
+	err := tx.ForEach(historyBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var list []HistoryEntry
+		err = msgpack.Unmarshal(v, &list)
+		s.M[id] = list
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	h.load(&s)
+	return nil
+}
+
+func (m *messageCounters) save(tx storage.Tx) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	err := tx.DeleteBucket(countersBucket)
+	if err != nil {
+		return err
+	}
+	for id, n := range m.M {
+		err := putValue(tx, countersBucket, id.Bytes(), n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *messageCounters) restore(tx storage.Tx) error {
+	counters := make(map[utils.NodeID]uint64)
+	err := tx.ForEach(countersBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var n uint64
+		err = msgpack.Unmarshal(v, &n)
+		counters[id] = n
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.M = counters
+	return nil
+}
+
+func (s *sentMessages) save(tx storage.Tx) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	err := tx.DeleteBucket(sentBucket)
+	if err != nil {
+		return err
+	}
+	for id, m := range s.M {
+		err := putValue(tx, sentBucket, []byte(id), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sentMessages) restore(tx storage.Tx) error {
+	sent := make(map[string]sentMessage)
+	err := tx.ForEach(sentBucket, func(k, v []byte) error {
+		var m sentMessage
+		err := msgpack.Unmarshal(v, &m)
+		sent[string(k)] = m
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.M = sent
+	return nil
+}
+
+func (d *deviceSync) save(tx storage.Tx) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, b := range []string{devicesBucket, syncBucket} {
+		err := tx.DeleteBucket(b)
+		if err != nil {
+			return err
+		}
+	}
+	for id := range d.devices {
+		err := tx.Put(devicesBucket, id.Bytes(), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+	for k, e := range d.state {
+		err := putValue(tx, syncBucket, []byte(k), e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *deviceSync) restore(tx storage.Tx) error {
+	devices := make(map[utils.NodeID]time.Time)
+	state := make(lwwMap)
+	err := tx.ForEach(devicesBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		devices[id] = time.Time{}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = tx.ForEach(syncBucket, func(k, v []byte) error {
+		var e lwwEntry
+		err := msgpack.Unmarshal(v, &e)
+		state[string(k)] = e
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.devices = devices
+	d.state = state
+	return nil
+}
+
+func (h *snapshotHistory) save(tx storage.Tx) error {
+	err := tx.DeleteBucket(statsBucket)
+	if err != nil {
+		return err
+	}
+	for _, s := range h.snapshots() {
+		var key [8]byte
+		binary.BigEndian.PutUint64(key[:], uint64(s.Time.UnixNano()))
+		err := putValue(tx, statsBucket, key[:], s)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *snapshotHistory) restore(tx storage.Tx) error {
+	var list []StatsSnapshot
+	err := tx.ForEach(statsBucket, func(k, v []byte) error {
+		var s StatsSnapshot
+		err := msgpack.Unmarshal(v, &s)
+		list = append(list, s)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	h.merge(list, time.Now())
+	return nil
+}
+
+func (r *reachability) save(tx storage.Tx) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := tx.DeleteBucket(reachBucket)
+	if err != nil {
+		return err
+	}
+	for id, e := range r.M {
+		err := putValue(tx, reachBucket, id.Bytes(), e)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *reachability) restore(tx storage.Tx) error {
+	entries := make(map[utils.NodeID]reachEntry)
+	err := tx.ForEach(reachBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var e reachEntry
+		err = msgpack.Unmarshal(v, &e)
+		entries[id] = e
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.M = entries
+	return nil
+}
+
+func (r *roomKeys) save(tx storage.Tx) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	err := tx.DeleteBucket(roomKeysBucket)
+	if err != nil {
+		return err
+	}
+	for id, k := range r.m {
+		err := putValue(tx, roomKeysBucket, id.Bytes(), k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *roomKeys) restore(tx storage.Tx) error {
+	chains := make(map[utils.NodeID]*roomKeyChain)
+	err := tx.ForEach(roomKeysBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var c roomKeyChain
+		err = msgpack.Unmarshal(v, &c)
+		if c.Last == nil {
+			c.Last = make(map[string]int64)
+		}
+		chains[id] = &c
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.m = chains
+	return nil
+}
+
+func (c *roomMetadataCache) save(tx storage.Tx) error {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	err := tx.DeleteBucket(roomMetaBucket)
+	if err != nil {
+		return err
+	}
+	for id, m := range c.m {
+		err := putValue(tx, roomMetaBucket, id.Bytes(), m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *roomMetadataCache) restore(tx storage.Tx) error {
+	m := make(map[utils.NodeID]RoomMetadata)
+	err := tx.ForEach(roomMetaBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var r RoomMetadata
+		err = msgpack.Unmarshal(v, &r)
+		m[id] = r
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.m = m
+	return nil
+}
+
+func (s *channelStore) save(tx storage.Tx) error {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	err := tx.DeleteBucket(channelsBucket)
+	if err != nil {
+		return err
+	}
+	for id, list := range s.posts {
+		err := putValue(tx, channelsBucket, id.Bytes(), list)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *channelStore) restore(tx storage.Tx) error {
+	posts := make(map[utils.NodeID][]ChannelPost)
+	err := tx.ForEach(channelsBucket, func(k, v []byte) error {
+		id, err := utils.NewNodeIDFromBytes(k)
+		if err != nil {
+			return err
+		}
+		var list []ChannelPost
+		err = msgpack.Unmarshal(v, &list)
+		if list == nil {
+			list = []ChannelPost{}
+		}
+		posts[id] = list
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.posts = posts
+	return nil
+}
+
+func putValue(tx storage.Tx, bucket string, key []byte, v interface{}) error {
+	data, err := msgpack.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return tx.Put(bucket, key, data)
+}
+
+// Save writes the roster, the message history, the message counters, the
+// conversations of the sent messages, the devices of the user with the
+// synced roster state, the statistics snapshots, the reachability of the
+// contacts, the key chains and the metadata of the rooms, the subscribed
+// channels with their posts, the chat messages waiting in the outbox, the
+// known nodes and the cached capabilities of the peers to the given
+// storage in a single transaction.
+func (c *Client) Save(s storage.Storage) error {
+	nodes := c.router.KnownNodes()
+	caps := c.router.CapabilityCache()
+	outbox := c.outboxRecords()
+	return s.Update(func(tx storage.Tx) error {
+		err := c.Roster.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.History.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.counters.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.sent.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.devices.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.snapshots.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.reach.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.roomKeys.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.roomMetadata.save(tx)
+		if err != nil {
+			return err
+		}
+		err = c.channels.save(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.DeleteBucket(outboxBucket)
+		if err != nil {
+			return err
+		}
+		for _, o := range outbox {
+			// The keys start with the queueing time to restore the outbox
+			// in order.
+			var key [8]byte
+			binary.BigEndian.PutUint64(key[:], uint64(o.Packet.Queued.UnixNano()))
+			err := putValue(tx, outboxBucket, append(key[:], o.Packet.Packet.ID[:]...), o)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.DeleteBucket(nodesBucket)
+		if err != nil {
+			return err
+		}
+		for _, n := range nodes {
+			err := putValue(tx, nodesBucket, n.ID.Bytes(), n)
+			if err != nil {
+				return err
+			}
+		}
+		err = tx.DeleteBucket(capsBucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range caps {
+			err := putValue(tx, capsBucket, e.Record.ID.Bytes(), e)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Load replaces the roster, the message history, the message counters, the
+// conversations of the sent messages, the devices, the statistics
+// snapshots, the reachability of the contacts, the key chains and the
+// metadata of the rooms and the subscribed channels of the previous runs with the contents of the given storage, queues the
+// stored outbox again, discovers the stored nodes, joins the channels,
+// applies the preferred transports of the contacts and restores the cached
+// capabilities of the peers.
+func (c *Client) Load(s storage.Storage) error {
+	var nodes []utils.NodeInfo
+	var caps []router.CachedCapabilities
+	var outbox []outboxRecord
+	err := s.View(func(tx storage.Tx) error {
+		err := c.Roster.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.History.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.counters.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.sent.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.devices.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.snapshots.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.reach.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.roomKeys.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.roomMetadata.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = c.channels.restore(tx)
+		if err != nil {
+			return err
+		}
+		err = tx.ForEach(outboxBucket, func(k, v []byte) error {
+			var o outboxRecord
+			if msgpack.Unmarshal(v, &o) == nil {
+				outbox = append(outbox, o)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = tx.ForEach(nodesBucket, func(k, v []byte) error {
+			var n utils.NodeInfo
+			err := msgpack.Unmarshal(v, &n)
+			if err == nil {
+				nodes = append(nodes, n)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return tx.ForEach(capsBucket, func(k, v []byte) error {
+			var e router.CachedCapabilities
+			if msgpack.Unmarshal(v, &e) == nil {
+				caps = append(caps, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	c.restoreOutbox(outbox)
+	for _, n := range nodes {
+		c.router.DiscoverNode(n)
+	}
+	c.Roster.mutex.RLock()
+	for id, s := range c.Roster.Settings {
+		c.router.SetPreferredTransport(id, s.Transport)
+	}
+	c.Roster.mutex.RUnlock()
+	for _, id := range c.channels.list() {
+		c.router.Join(id)
+	}
+	c.router.RestoreCapabilityCache(caps)
+	c.indexHistory()
+	return nil
+}
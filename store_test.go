@@ -0,0 +1,173 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/storage"
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestStoreRosterHistory(t *testing.T) {
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	s := storage.NewMemoryStorage()
+
+	var r Roster
+	var h History
+	r.Set(id, UserProfile{Nickname: "stored"})
+	r.SetSettings(id, ContactSettings{Muted: true, Ephemeral: time.Minute})
+	r.SetAlias(id, "alias")
+	r.setSecret(id, []byte("0123456789abcdef0123456789abcdef"))
+	r.approve(id)
+	h.Push(id, newHistoryEntry(id, NewPlainChatMessage("hello")))
+
+	err := s.Update(func(tx storage.Tx) error {
+		err := r.save(tx)
+		if err != nil {
+			return err
+		}
+		return h.save(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r2 Roster
+	var h2 History
+	err = s.View(func(tx storage.Tx) error {
+		err := r2.restore(tx)
+		if err != nil {
+			return err
+		}
+		return h2.restore(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r2.Get(id).Nickname != "stored" {
+		t.Errorf("restored profile: %v", r2.Get(id))
+	}
+	if r2.GetSettings(id) != r.GetSettings(id) {
+		t.Errorf("restored settings: %v; expects %v", r2.GetSettings(id), r.GetSettings(id))
+	}
+	if a := r2.Alias(id); a != "alias" {
+		t.Errorf("restored alias: %q; expects %q", a, "alias")
+	}
+	if s := r2.secret(id); string(s) != "0123456789abcdef0123456789abcdef" {
+		t.Errorf("restored secret: %q; expects the secret of the contact", s)
+	}
+	if !r2.approved(id) {
+		t.Errorf("restored roster does not approve the contact")
+	}
+	if l := h2.List(id); len(l) != 1 || l[0].Message.Text() != "hello" {
+		t.Errorf("restored history: %v", l)
+	}
+}
+
+func TestStoreRosterTags(t *testing.T) {
+	dev := utils.NewRandomNodeID(utils.GlobalNamespace)
+	id := utils.NewRandomNodeID(utils.GlobalNamespace)
+	s := storage.NewMemoryStorage()
+	now := time.Now()
+
+	var r Roster
+	var d deviceSync
+	r.Set(id, UserProfile{Nickname: "stored"})
+	r.AddTag(id, "work")
+	r.SetFavorite(id, true)
+	d.observe(r.syncState(), dev, now)
+
+	err := s.Update(func(tx storage.Tx) error {
+		err := r.save(tx)
+		if err != nil {
+			return err
+		}
+		return d.save(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var r2 Roster
+	var d2 deviceSync
+	err = s.View(func(tx storage.Tx) error {
+		err := r2.restore(tx)
+		if err != nil {
+			return err
+		}
+		return d2.restore(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tags := r2.GetTags(id); len(tags) != 1 || tags[0] != "work" {
+		t.Errorf("restored tags: %v; expects [work]", tags)
+	}
+	if !r2.IsFavorite(id) {
+		t.Errorf("restored favorite: false; expects true")
+	}
+	d2.observe(r2.syncState(), dev, now.Add(time.Second))
+	for k, e := range d2.state {
+		if e.Deleted {
+			t.Errorf("observe() returns a tombstone for %s after a restore", k)
+		}
+	}
+}
+
+func TestStoreOutbox(t *testing.T) {
+	key := utils.GeneratePrivateKey()
+	tr, err := router.NewTransport(log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	c, err := NewClientWithTransport(key, utils.DefaultConfig, tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	dst := utils.NewRandomNodeID(utils.GlobalNamespace)
+	msgid, err := c.SendMessageID(dst, NewPlainChatMessage("queued"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The message is queued once no route to the destination is found.
+	for i := 0; i < 500; i++ {
+		if len(c.Outbox()) > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l := c.Outbox(); len(l) != 1 {
+		t.Fatalf("Outbox() returns %d messages; expects 1", len(l))
+	}
+	s := storage.NewMemoryStorage()
+	err = c.Save(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr2, err := router.NewTransport(log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr2.Close()
+	c2, err := NewClientWithTransport(key, utils.DefaultConfig, tr2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	err = c2.Load(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := c2.Outbox()
+	if len(l) != 1 || formatMessageID(l[0].MsgID) != msgid || !l[0].Dst.Match(dst) {
+		t.Errorf("Outbox() returns %+v after Load(); expects the queued message", l)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/h2so5/murcott"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// Scopes of the API tokens. An admin token has all scopes.
+const (
+	scopeSend  = "send"
+	scopeRead  = "read"
+	scopeAdmin = "admin"
+)
+
+const (
+	defaultTokenRate  = 10.0
+	defaultTokenBurst = 20
+)
+
+var (
+	errUnauthorized = errors.New("invalid API token")
+	errForbidden    = errors.New("API token out of scope")
+	errRateLimited  = errors.New("API token rate limit exceeded")
+	errPublicAPI    = errors.New("API address is not a loopback address; use -api-public to listen on it")
+)
+
+// apiToken lets a local application use the API within its scope.
+// Rate is the number of requests per second, with bursts of up to Burst
+// requests. Zero values use the defaults and a negative Rate disables
+// the limit.
+type apiToken struct {
+	Name  string  `yaml:"name"`
+	Token string  `yaml:"token"`
+	Scope string  `yaml:"scope"`
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+
+	tokens float64
+	last   time.Time
+}
+
+// apiTokens holds the tokens of tokens.yml, which the applications
+// send in the Authorization header as "Bearer <token>".
+type apiTokens struct {
+	list  []*apiToken
+	mutex sync.Mutex
+}
+
+func loadTokens(filename string) (*apiTokens, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var list []*apiToken
+	err = yaml.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range list {
+		switch t.Scope {
+		case scopeSend, scopeRead, scopeAdmin:
+		default:
+			return nil, errors.New("unknown scope of API token " + t.Name + ": " + t.Scope)
+		}
+		if t.Token == "" {
+			return nil, errors.New("empty API token " + t.Name)
+		}
+		if t.Rate == 0 {
+			t.Rate = defaultTokenRate
+		}
+		if t.Burst == 0 {
+			t.Burst = defaultTokenBurst
+		}
+		t.tokens = float64(t.Burst)
+	}
+	if len(list) == 0 {
+		return nil, errors.New("no API tokens in " + filename)
+	}
+	return &apiTokens{list: list}, nil
+}
+
+// authorize checks that the secret is a token with the given scope
+// which is within its rate limit.
+func (a *apiTokens) authorize(secret, scope string, now time.Time) (*apiToken, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	var token *apiToken
+	for _, t := range a.list {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(secret)) == 1 {
+			token = t
+		}
+	}
+	if token == nil {
+		return nil, errUnauthorized
+	}
+	if token.Scope != scope && token.Scope != scopeAdmin {
+		return nil, errForbidden
+	}
+	if token.Rate < 0 {
+		return token, nil
+	}
+	if !token.last.IsZero() {
+		token.tokens += now.Sub(token.last).Seconds() * token.Rate
+		if token.tokens > float64(token.Burst) {
+			token.tokens = float64(token.Burst)
+		}
+	}
+	token.last = now
+	if token.tokens < 1 {
+		return nil, errRateLimited
+	}
+	token.tokens--
+	return token, nil
+}
+
+// handle wraps an API handler with the authorization of the scope.
+func (a *apiTokens) handle(scope string, f func(w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		_, err := a.authorize(secret, scope, time.Now())
+		switch err {
+		case nil:
+			f(w, r)
+		case errUnauthorized:
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+		case errForbidden:
+			http.Error(w, err.Error(), http.StatusForbidden)
+		default:
+			http.Error(w, err.Error(), http.StatusTooManyRequests)
+		}
+	}
+}
+
+type apiMessage struct {
+	Src  string    `json:"src"`
+	Time time.Time `json:"time"`
+	Text string    `json:"text"`
+}
+
+// loopbackAddr reports whether the listen address only accepts
+// connections from the local host.
+func loopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// serveAPI lets the local applications with a token of tokens.yml
+// share the client:
+//
+//	POST /send?dst=ID     sends the body as a plain message (send)
+//	GET  /history?id=ID   returns the history with a contact (read)
+//	GET  /contacts        returns the IDs of the roster (read)
+//	POST /contacts?id=ID  adds a contact to the roster (admin)
+//
+// The tokens are sent in the clear, so the API only listens on a loopback
+// address unless public is set.
+func serveAPI(addr string, public bool, tokens *apiTokens, client *murcott.Client) error {
+	if !public && !loopbackAddr(addr) {
+		return errPublicAPI
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/send", tokens.handle(scopeSend, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		dst, err := utils.NewNodeIDFromString(r.URL.Query().Get("dst"))
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 64*1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := client.SendMessageID(dst, murcott.NewPlainChatMessage(string(body)))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id": id})
+	}))
+	mux.HandleFunc("/history", tokens.handle(scopeRead, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := utils.NewNodeIDFromString(r.URL.Query().Get("id"))
+		if err != nil {
+			http.Error(w, "invalid ID", http.StatusBadRequest)
+			return
+		}
+		list := []apiMessage{}
+		for _, e := range client.History.List(id) {
+			list = append(list, apiMessage{Src: e.Src.String(), Time: e.Message.Time, Text: e.Message.Text()})
+		}
+		json.NewEncoder(w).Encode(list)
+	}))
+	mux.HandleFunc("/contacts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			tokens.handle(scopeAdmin, func(w http.ResponseWriter, r *http.Request) {
+				id, err := utils.NewNodeIDFromString(r.URL.Query().Get("id"))
+				if err != nil {
+					http.Error(w, "invalid ID", http.StatusBadRequest)
+					return
+				}
+				client.AddContact(id, murcott.UserProfile{})
+			})(w, r)
+			return
+		}
+		tokens.handle(scopeRead, func(w http.ResponseWriter, r *http.Request) {
+			list := []string{}
+			for _, id := range client.Roster.List() {
+				list = append(list, id.String())
+			}
+			json.NewEncoder(w).Encode(list)
+		})(w, r)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAPITokens(t *testing.T) {
+	tokens := &apiTokens{list: []*apiToken{
+		{Name: "bot", Token: "send-secret", Scope: scopeSend, Rate: 1, Burst: 2, tokens: 2},
+		{Name: "admin", Token: "admin-secret", Scope: scopeAdmin, Rate: -1},
+	}}
+	now := time.Now()
+
+	if _, err := tokens.authorize("wrong", scopeSend, now); err != errUnauthorized {
+		t.Errorf("authorize() returns %v for an unknown token; expects %v", err, errUnauthorized)
+	}
+	if _, err := tokens.authorize("send-secret", scopeRead, now); err != errForbidden {
+		t.Errorf("authorize() returns %v out of scope; expects %v", err, errForbidden)
+	}
+	if _, err := tokens.authorize("admin-secret", scopeRead, now); err != nil {
+		t.Errorf("authorize() returns %v for an admin token; expects nil", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := tokens.authorize("send-secret", scopeSend, now); err != nil {
+			t.Errorf("authorize() returns %v within the burst", err)
+		}
+	}
+	if _, err := tokens.authorize("send-secret", scopeSend, now); err != errRateLimited {
+		t.Errorf("authorize() returns %v beyond the burst; expects %v", err, errRateLimited)
+	}
+	if _, err := tokens.authorize("send-secret", scopeSend, now.Add(time.Second)); err != nil {
+		t.Errorf("authorize() returns %v after the refill", err)
+	}
+}
+
+func TestLoopbackAddr(t *testing.T) {
+	for addr, expected := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"[::1]:8080":     true,
+		"localhost:8080": true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"192.0.2.1:8080": false,
+		"8080":           false,
+	} {
+		if loopbackAddr(addr) != expected {
+			t.Errorf("loopbackAddr(%q) returns %v; expects %v", addr, !expected, expected)
+		}
+	}
+	if err := serveAPI(":8080", false, nil, nil); err != errPublicAPI {
+		t.Errorf("serveAPI() returns %v for a public address; expects %v", err, errPublicAPI)
+	}
+}
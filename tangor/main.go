@@ -12,12 +12,19 @@ import (
 	"time"
 
 	"github.com/h2so5/murcott"
+	"github.com/h2so5/murcott/keystore"
+	"github.com/h2so5/murcott/storage/atomicfile"
 	"github.com/h2so5/murcott/utils"
 	"github.com/skratchdot/open-golang/open"
 	"github.com/wsxiaoys/terminal/color"
 	"gopkg.in/yaml.v2"
 )
 
+const (
+	dataMagic   = "MCNC"
+	dataVersion = 1
+)
+
 func main() {
 	path := os.Getenv("TANGORPATH")
 	if path == "" {
@@ -29,6 +36,11 @@ func main() {
 	keyfile := flag.String("i", path+"/id_dsa", "Identity file")
 	bootstrap := flag.String("b", "", "Additional bootstrap node")
 	web := flag.Bool("web", false, "Open web browser")
+	observer := flag.Bool("observer", false, "Run as a read-only monitor")
+	metrics := flag.String("metrics", "", "Address to export the network statistics of an observer")
+	api := flag.String("api", "", "Address of the API for the local applications with a token of tokens.yml")
+	apiPublic := flag.Bool("api-public", false, "Allow the API to listen on a non-loopback address")
+	keychain := flag.Bool("keychain", false, "Store the identity in the system keychain")
 	flag.Parse()
 
 	color.Print("\n@{Gk} @{Yk}  tangor  @{Gk} @{|}\n\n")
@@ -36,8 +48,11 @@ func main() {
 	if len(*bootstrap) > 0 {
 		config.B = append(config.B, *bootstrap)
 	}
+	if *observer {
+		config.Observer = true
+	}
 
-	key, err := getKey(*keyfile)
+	key, err := getKey(*keyfile, *keychain)
 	if err != nil {
 		color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
 		os.Exit(-1)
@@ -53,11 +68,34 @@ func main() {
 	defer client.Close()
 
 	filename := filepath.Join(path, id.Digest.String()+".dat")
-	data, err := ioutil.ReadFile(filename)
-	if err == nil {
+	_, data, err := atomicfile.ReadVersioned(filename, dataMagic)
+	if err == nil || err == atomicfile.ErrNoHeader {
 		client.UnmarshalBinary(data)
 	}
 
+	if len(*metrics) > 0 {
+		go func() {
+			err := serveMetrics(*metrics, client)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			}
+		}()
+	}
+
+	if len(*api) > 0 {
+		tokens, err := loadTokens(filepath.Join(path, "tokens.yml"))
+		if err != nil {
+			color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			os.Exit(-1)
+		}
+		go func() {
+			err := serveAPI(*api, *apiPublic, tokens, client)
+			if err != nil {
+				color.Printf(" -> @{Rk}ERROR:@{|} %v\n", err)
+			}
+		}()
+	}
+
 	if *web {
 		go webui()
 		open.Run("http://localhost:3000")
@@ -92,40 +130,51 @@ func getConfig(path string) utils.Config {
 	} else {
 		data, err := yaml.Marshal(config)
 		if err == nil {
-			ioutil.WriteFile(filename, data, 0644)
+			atomicfile.WriteFile(filename, data, 0644)
 		}
 	}
 	return config
 }
 
-func getKey(keyfile string) (*utils.PrivateKey, error) {
-	_, err := os.Stat(filepath.Dir(keyfile))
-
-	if _, err := os.Stat(keyfile); err != nil {
-		err := os.MkdirAll(filepath.Dir(keyfile), 0755)
-		if err != nil {
-			return nil, err
+// getKey returns the key of the identity file, or the key of the same name
+// in the system keychain, to which the key of the file is copied once.
+func getKey(keyfile string, keychain bool) (*utils.PrivateKey, error) {
+	files := keystore.NewFileKeystore(filepath.Dir(keyfile))
+	name := filepath.Base(keyfile)
+	if !keychain {
+		key, created, err := keystore.LoadOrCreate(files, name)
+		if created {
+			fmt.Printf(" -> Create a new private key: %s\n", keyfile)
 		}
-		key := utils.GeneratePrivateKey()
-		pem, err := key.MarshalText()
-		err = ioutil.WriteFile(keyfile, pem, 0644)
+		return key, err
+	}
+
+	store, err := keystore.NewSystemKeystore()
+	if err != nil {
+		return nil, err
+	}
+	key, err := store.Load(name)
+	if err != keystore.ErrNotFound {
+		return key, err
+	}
+	key, err = files.Load(name)
+	if err == nil {
+		err = store.Save(name, key)
 		if err != nil {
 			return nil, err
 		}
-		fmt.Printf(" -> Create a new private key: %s\n", keyfile)
+		fmt.Printf(" -> Copy the private key to the system keychain: %s can be deleted\n", keyfile)
+		return key, nil
 	}
-
-	pem, err := ioutil.ReadFile(keyfile)
-	if err != nil {
+	if err != keystore.ErrNotFound {
 		return nil, err
 	}
-
-	var key utils.PrivateKey
-	err = key.UnmarshalText(pem)
+	key, _, err = keystore.LoadOrCreate(store, name)
 	if err != nil {
 		return nil, err
 	}
-	return &key, nil
+	fmt.Printf(" -> Create a new private key in the system keychain\n")
+	return key, nil
 }
 
 type Session struct {
@@ -158,7 +207,7 @@ func (s *Session) save(filename string) error {
 	if err != nil {
 		return err
 	}
-	return ioutil.WriteFile(filename, data, 0755)
+	return atomicfile.WriteVersioned(filename, dataMagic, dataVersion, data, 0600)
 }
 
 func (s *Session) commandLoop() {
@@ -177,8 +226,12 @@ func (s *Session) commandLoop() {
 						color.Printf("\n -> Start a chat with @{Wk} %s @{|}\n\n", src.String())
 					}
 				*/
-				str := src.String()
-				color.Printf("\r* @{Wk}%s@{|} %s\n", str[len(str)-8:], msg.Text())
+				name := s.cli.Roster.Name(src)
+				if name == "" {
+					str := src.String()
+					name = str[len(str)-8:]
+				}
+				color.Printf("\r* @{Wk}%s@{|} %s\n", name, msg.Text())
 				fmt.Print("* ")
 			}
 		}
@@ -221,7 +274,18 @@ func (s *Session) commandLoop() {
 				if err != nil {
 					color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
 				} else {
-					s.cli.Roster.Set(nid, murcott.UserProfile{})
+					s.cli.AddContact(nid, murcott.UserProfile{})
+				}
+			}
+		case "/alias":
+			if len(c) < 2 {
+				color.Printf(" -> @{Rk}ERROR:@{|} /alias takes 1 or 2 arguments\n")
+			} else {
+				nid, err := utils.NewNodeIDFromString(c[1])
+				if err != nil {
+					color.Printf(" -> @{Rk}ERROR:@{|} invalid ID\n")
+				} else {
+					s.cli.Roster.SetAlias(nid, strings.Join(c[2:], " "))
 				}
 			}
 		case "/mkg":
@@ -234,12 +298,21 @@ func (s *Session) commandLoop() {
 			nodes := s.cli.ActiveSessions()
 			color.Printf("  * active sessions (%d) *\n", len(nodes))
 			for _, n := range nodes {
-				color.Printf(" %v\n", n)
+				color.Printf(" %v %v %v\n", n.ID, n.Addr, n.RTT)
+			}
+			probes := s.cli.BootstrapProbes()
+			color.Printf("  * bootstrap nodes (%d) *\n", len(probes))
+			for _, p := range probes {
+				if p.Err != nil {
+					color.Printf(" %v %v\n", p.Addr.String(), p.Err)
+				} else {
+					color.Printf(" %v %v\n", p.Addr.String(), p.RTT)
+				}
 			}
 			list := s.cli.Roster.List()
 			color.Printf("  * Roster (%d) *\n", len(list))
 			for _, n := range list {
-				color.Printf(" %v %s \n", n, s.cli.Roster.Get(n).Nickname)
+				color.Printf(" %v %s \n", n, s.cli.Roster.Name(n))
 			}
 
 		case "/end":
@@ -271,6 +344,7 @@ func showHelp() {
  @{Kg}/chat [ID]@{|}	Start a chat with [ID]
  @{Kg}/end      @{|}	End current chat
  @{Kg}/add  [ID]@{|}	Add [ID] to roster
+ @{Kg}/alias [ID] [NAME]@{|}	Name [ID] locally, or remove its name
  @{Kg}/mkg      @{|}	Generate new group id
  @{Kg}/help     @{|}	Show this message
  @{Kg}/stat     @{|}	Show node status
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/h2so5/murcott"
+)
+
+// serveMetrics exports the network statistics of an observer client
+// at /metrics in the Prometheus text format.
+func serveMetrics(addr string, client *murcott.Client) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		stats, ok := client.NetworkStats()
+		if !ok {
+			http.Error(w, "not an observer node", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		stats.WriteMetrics(w)
+	})
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,93 @@
+package murcott
+
+import (
+	"sync"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// MessageTransformer modifies a chat message exchanged with a peer, for
+// example to redact it, filter it or add an encryption layer. It returns
+// the message to pass on, or an error to veto the message.
+type MessageTransformer func(peer utils.NodeID, msg ChatMessage) (ChatMessage, error)
+
+// TransformError is returned by SendMessage when an outbound transformer
+// vetoes a message.
+type TransformError struct {
+	Err error
+}
+
+func (e *TransformError) Error() string {
+	return "message vetoed: " + e.Err.Error()
+}
+
+// RejectedEvent is emitted when an inbound transformer vetoes a received
+// message. The message is acknowledged, so that the sender does not
+// send it again, but it is neither emitted nor archived.
+type RejectedEvent struct {
+	Src utils.NodeID
+	ID  string
+	Err error
+}
+
+// transformers holds the outbound and inbound transformers
+// in the order in which they were added.
+type transformers struct {
+	outbound []MessageTransformer
+	inbound  []MessageTransformer
+	mutex    sync.RWMutex
+}
+
+// AddOutboundTransformer adds a transformer of the messages sent by
+// SendMessage. The outbound transformers run in the order in which they
+// were added, each on the result of the previous one, and the first
+// error stops the message. Only the message on the wire is transformed:
+// the local echo and the history keep the message of the application.
+func (c *Client) AddOutboundTransformer(f MessageTransformer) {
+	c.transformers.mutex.Lock()
+	defer c.transformers.mutex.Unlock()
+	c.transformers.outbound = append(c.transformers.outbound, f)
+}
+
+// AddInboundTransformer adds a transformer of the received messages.
+// The inbound transformers run in the reverse order of their addition,
+// so that a pair of transformers added at the same position undo each
+// other, like encryption layers. They run before the message is emitted
+// and archived, and the first error drops the message.
+func (c *Client) AddInboundTransformer(f MessageTransformer) {
+	c.transformers.mutex.Lock()
+	defer c.transformers.mutex.Unlock()
+	c.transformers.inbound = append(c.transformers.inbound, f)
+}
+
+// transformOutbound runs the outbound transformers on a message to peer.
+func (c *Client) transformOutbound(peer utils.NodeID, msg ChatMessage) (ChatMessage, error) {
+	c.transformers.mutex.RLock()
+	list := c.transformers.outbound
+	c.transformers.mutex.RUnlock()
+	for _, f := range list {
+		m, err := f(peer, msg)
+		if err != nil {
+			return ChatMessage{}, &TransformError{Err: err}
+		}
+		m.ID = msg.ID
+		msg = m
+	}
+	return msg, nil
+}
+
+// transformInbound runs the inbound transformers on a message from peer.
+func (c *Client) transformInbound(peer utils.NodeID, msg ChatMessage) (ChatMessage, error) {
+	c.transformers.mutex.RLock()
+	list := c.transformers.inbound
+	c.transformers.mutex.RUnlock()
+	for i := len(list) - 1; i >= 0; i-- {
+		m, err := list[i](peer, msg)
+		if err != nil {
+			return ChatMessage{}, err
+		}
+		m.ID = msg.ID
+		msg = m
+	}
+	return msg, nil
+}
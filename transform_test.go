@@ -0,0 +1,55 @@
+package murcott
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+func TestTransformers(t *testing.T) {
+	peer := utils.NewRandomNodeID(utils.GlobalNamespace)
+	suffix := func(s string) MessageTransformer {
+		return func(id utils.NodeID, msg ChatMessage) (ChatMessage, error) {
+			return NewPlainChatMessage(msg.Text() + s), nil
+		}
+	}
+	trim := func(s string) MessageTransformer {
+		return func(id utils.NodeID, msg ChatMessage) (ChatMessage, error) {
+			text := msg.Text()
+			if len(text) < len(s) || text[len(text)-len(s):] != s {
+				return msg, errors.New("missing " + s)
+			}
+			return NewPlainChatMessage(text[:len(text)-len(s)]), nil
+		}
+	}
+
+	var c Client
+	c.AddOutboundTransformer(suffix("a"))
+	c.AddOutboundTransformer(suffix("b"))
+	c.AddInboundTransformer(trim("a"))
+	c.AddInboundTransformer(trim("b"))
+
+	msg := NewPlainChatMessage("hello")
+	msg.ID = "id"
+	out, err := c.transformOutbound(peer, msg)
+	if err != nil || out.Text() != "helloab" || out.ID != "id" {
+		t.Errorf("transformOutbound() returns %q, %v; expects helloab", out.Text(), err)
+	}
+	in, err := c.transformInbound(peer, out)
+	if err != nil || in.Text() != "hello" || in.ID != "id" {
+		t.Errorf("transformInbound() returns %q, %v; expects hello", in.Text(), err)
+	}
+	if _, err := c.transformInbound(peer, msg); err == nil {
+		t.Errorf("transformInbound() should return the veto of a transformer")
+	}
+
+	c.AddOutboundTransformer(func(id utils.NodeID, msg ChatMessage) (ChatMessage, error) {
+		return msg, errors.New("blocked")
+	})
+	if _, err := c.transformOutbound(peer, msg); err == nil {
+		t.Errorf("transformOutbound() should return the veto of a transformer")
+	} else if _, ok := err.(*TransformError); !ok {
+		t.Errorf("transformOutbound() returns %T; expects *TransformError", err)
+	}
+}
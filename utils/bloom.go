@@ -0,0 +1,174 @@
+package utils
+
+import (
+	"hash/maphash"
+	"math"
+	"math/bits"
+)
+
+const (
+	// DefaultDedupCapacity is the default number of items remembered
+	// by a DuplicateFilter.
+	DefaultDedupCapacity = 16384
+
+	// DefaultDedupFalsePositive is the default rate of new items which
+	// a DuplicateFilter reports as duplicates.
+	DefaultDedupFalsePositive = 1e-6
+)
+
+// FilterStats describes the occupancy of a DuplicateFilter.
+type FilterStats struct {
+	// Capacity is the number of items added to a filter before it is
+	// rotated, and Items is the number of items in the current filter.
+	Capacity int
+	Items    int
+
+	// Bits is the size of each of the two filters, and Fill is the
+	// ratio of set bits in the current one.
+	Bits int
+	Fill float64
+
+	// FalsePositive is the estimated probability that a new item is
+	// reported as a duplicate with the current occupancy.
+	FalsePositive float64
+
+	// Rotations is the number of times the previous filter has been
+	// dropped.
+	Rotations int
+}
+
+// DuplicateFilter remembers the items added to it in bounded memory, with
+// two bloom filters. Items are added to the current filter and looked up
+// in both; when the current filter holds capacity items, the previous one
+// is dropped and a new one is started. An item is thus remembered for at
+// least capacity further items, and a new item is mistaken for a
+// duplicate with about the target false-positive rate. A DuplicateFilter
+// is not safe for concurrent use.
+type DuplicateFilter struct {
+	capacity  int
+	hashes    int
+	current   []uint64
+	previous  []uint64
+	items     int
+	rotations int
+	seed      maphash.Seed
+}
+
+// NewDuplicateFilter returns a filter sized for capacity items at the given
+// false-positive rate. Zero values use the defaults.
+func NewDuplicateFilter(capacity int, falsePositive float64) *DuplicateFilter {
+	if capacity <= 0 {
+		capacity = DefaultDedupCapacity
+	}
+	if falsePositive <= 0 || falsePositive >= 1 {
+		falsePositive = DefaultDedupFalsePositive
+	}
+	// Both filters are looked up, so each gets half of the rate.
+	p := falsePositive / 2
+	m := math.Ceil(-float64(capacity) * math.Log(p) / (math.Ln2 * math.Ln2))
+	words := int(math.Ceil(m / 64))
+	k := int(math.Round(float64(words*64) / float64(capacity) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &DuplicateFilter{
+		capacity: capacity,
+		hashes:   k,
+		current:  make([]uint64, words),
+		previous: make([]uint64, words),
+		seed:     maphash.MakeSeed(),
+	}
+}
+
+// indexes returns the bits of the item. The hash is seeded randomly, so
+// that other nodes cannot craft items which collide with legitimate ones,
+// and each bit is drawn from it with the splitmix64 generator, which keeps
+// the bits independent in small filters unlike double hashing.
+func (f *DuplicateFilter) indexes(item []byte) []uint64 {
+	var h maphash.Hash
+	h.SetSeed(f.seed)
+	h.Write(item)
+	x := h.Sum64()
+	m := uint64(len(f.current) * 64)
+	idx := make([]uint64, f.hashes)
+	for i := range idx {
+		x += 0x9e3779b97f4a7c15
+		z := (x ^ x>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		idx[i] = (z ^ z>>31) % m
+	}
+	return idx
+}
+
+func testBits(filter []uint64, idx []uint64) bool {
+	for _, i := range idx {
+		if filter[i/64]&(1<<(i%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Contains reports whether the item has been added to the filter.
+func (f *DuplicateFilter) Contains(item []byte) bool {
+	idx := f.indexes(item)
+	return testBits(f.current, idx) || testBits(f.previous, idx)
+}
+
+// Add adds the item to the filter. It returns false if the item
+// had already been added.
+func (f *DuplicateFilter) Add(item []byte) bool {
+	idx := f.indexes(item)
+	if testBits(f.current, idx) {
+		return false
+	}
+	found := testBits(f.previous, idx)
+	if f.items >= f.capacity {
+		f.rotate()
+	}
+	for _, i := range idx {
+		f.current[i/64] |= 1 << (i % 64)
+	}
+	f.items++
+	return !found
+}
+
+func (f *DuplicateFilter) rotate() {
+	f.current, f.previous = f.previous, f.current
+	for i := range f.current {
+		f.current[i] = 0
+	}
+	f.items = 0
+	f.rotations++
+}
+
+// Reset removes all the items from the filter.
+func (f *DuplicateFilter) Reset() {
+	for i := range f.current {
+		f.current[i] = 0
+		f.previous[i] = 0
+	}
+	f.items = 0
+}
+
+func fill(filter []uint64) float64 {
+	n := 0
+	for _, w := range filter {
+		n += bits.OnesCount64(w)
+	}
+	return float64(n) / float64(len(filter)*64)
+}
+
+// Stats returns the occupancy of the filter.
+func (f *DuplicateFilter) Stats() FilterStats {
+	cur, prev := fill(f.current), fill(f.previous)
+	k := float64(f.hashes)
+	return FilterStats{
+		Capacity:      f.capacity,
+		Items:         f.items,
+		Bits:          len(f.current) * 64,
+		Fill:          cur,
+		FalsePositive: 1 - (1-math.Pow(cur, k))*(1-math.Pow(prev, k)),
+		Rotations:     f.rotations,
+	}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDuplicateFilter(t *testing.T) {
+	f := NewDuplicateFilter(1000, 0.01)
+	item := func(i int) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], uint64(i))
+		return b[:]
+	}
+
+	added := 0
+	for i := 0; i < 1000; i++ {
+		if f.Add(item(i)) {
+			added++
+		}
+	}
+	if added < 980 {
+		t.Errorf("Add() returns true for %d of 1000 new items; expects about 995", added)
+	}
+	for i := 0; i < 1000; i++ {
+		if f.Add(item(i)) {
+			t.Errorf("Add(%d) returns true for a duplicate", i)
+		}
+	}
+
+	s := f.Stats()
+	if s.Items != added || s.Rotations != 0 || s.Fill <= 0 || s.Fill >= 1 {
+		t.Errorf("Stats() returns %+v; expects a partly filled filter", s)
+	}
+	if s.FalsePositive > 0.02 {
+		t.Errorf("Stats() estimates a false-positive rate of %v; expects at most 0.01", s.FalsePositive)
+	}
+
+	// The items are remembered across one rotation, and the memory
+	// does not grow with the number of items.
+	bits := s.Bits
+	for i := 1000; i < 2000; i++ {
+		f.Add(item(i))
+	}
+	if !f.Contains(item(999)) {
+		t.Errorf("Contains() should find an item of the previous filter")
+	}
+	for i := 2000; i < 3100; i++ {
+		f.Add(item(i))
+	}
+	if s := f.Stats(); s.Rotations != 3 || s.Bits != bits {
+		t.Errorf("Stats() returns %+v; expects 3 rotations of %d bits", s, bits)
+	}
+
+	falsePositives := 0
+	for i := 0; i < 1000; i++ {
+		if f.Contains(item(i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 50 {
+		t.Errorf("Contains() finds %d of 1000 forgotten items; expects about 10", falsePositives)
+	}
+}
@@ -2,32 +2,341 @@
 package utils
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Config struct {
+	// P is the specification of the ports to listen on. See ParsePorts.
 	P string   `yaml:"port"`
 	B []string `yaml:"bootstrap"`
+
+	// ValueStore is the path of a database file which retains the DHT records
+	// stored on this node across restarts. Records are kept in memory if empty.
+	ValueStore string `yaml:"valuestore"`
+
+	// RoutingTable is the path of a file which retains the verified nodes
+	// of the DHT routing table across restarts, so that the node does not
+	// have to discover the network again from the bootstrap nodes.
+	// The table is not saved if empty.
+	RoutingTable string `yaml:"routingtable"`
+
+	// RoomRate is the number of messages per second which each sender may
+	// send to a group, with bursts of up to RoomBurst messages.
+	// Zero values use the defaults and a negative RoomRate disables the limit.
+	RoomRate  float64 `yaml:"roomrate"`
+	RoomBurst int     `yaml:"roomburst"`
+
+	// Services lists the services which this node offers to other nodes,
+	// such as "relay", "mailbox" and "bootstrap", and Bandwidth is its
+	// bandwidth class from 1 (low) to 3 (high). Both are advertised
+	// in the capability record of the node.
+	Services  []string `yaml:"services"`
+	Bandwidth int      `yaml:"bandwidth"`
+
+	// Privacy is the level of protection against traffic analysis:
+	// 0 sends packets as they are, 1 pads packets to size buckets and
+	// 2 also sends cover traffic at random intervals.
+	Privacy int `yaml:"privacy"`
+
+	// Observer makes the node a read-only monitor. It joins the DHT and
+	// groups to collect statistics of the network, but neither sends
+	// nor forwards messages.
+	Observer bool `yaml:"observer"`
+
+	// DHTRate is the number of DHT requests per second which the node
+	// handles from each peer, with bursts of up to DHTBurst requests.
+	// The IP addresses which send malformed packets repeatedly are
+	// banned for an hour. Zero values use the defaults and a negative
+	// DHTRate disables the limit.
+	DHTRate  float64 `yaml:"dhtrate"`
+	DHTBurst int     `yaml:"dhtburst"`
+
+	// MaxSessions, MaxGoroutines and MaxPendingRPCs limit the sessions,
+	// the goroutines handling received packets and the pending requests
+	// of each DHT, so that floods cannot exhaust the node. New sessions
+	// and packets beyond the limits are rejected. Zero values use the
+	// defaults.
+	MaxSessions    int `yaml:"maxsessions"`
+	MaxGoroutines  int `yaml:"maxgoroutines"`
+	MaxPendingRPCs int `yaml:"maxpendingrpcs"`
+
+	// Retry holds the timing of the retried operations. Embedders on
+	// battery-powered devices can make them less frequent at the cost
+	// of latency. Zero values use DefaultRetryConfig.
+	Retry RetryConfig `yaml:"retry"`
+
+	// BootstrapNodes is the number of nodes in the routing table from
+	// which the node is bootstrapped. The bootstrap nodes are discovered
+	// again according to Retry.Bootstrap until then. Zero uses 1.
+	BootstrapNodes int `yaml:"bootstrapnodes"`
+
+	// KeepalivePeers is the number of DHT peers to which a keepalive is
+	// sent every KeepaliveInterval, so that the NAT mapping of the node
+	// survives while it has no session. Zero values use the defaults and
+	// a negative KeepalivePeers disables the keepalives.
+	KeepalivePeers    int           `yaml:"keepalivepeers"`
+	KeepaliveInterval time.Duration `yaml:"keepaliveinterval"`
+
+	// LookupAlpha is the number of requests of a DHT lookup which are in
+	// flight at the same time. Zero uses 3. The timeout and the attempts
+	// of each request are set by Retry.RPC.
+	LookupAlpha int `yaml:"lookupalpha"`
+
+	// Replication is the number of nodes near the key of a value published
+	// by this node which must acknowledge it. Failed nodes are replaced by
+	// the next nearest ones until it is reached. Zero uses 3.
+	Replication int `yaml:"replication"`
+
+	// StrictDecoding rejects the received messages of unknown types or
+	// missing required fields, and reports them as decode errors
+	// instead of dropping them silently.
+	StrictDecoding bool `yaml:"strictdecoding"`
+
+	// RosterOnly drops the direct messages from the nodes which are
+	// neither in the roster nor devices of the user. Strangers can
+	// still reach the user through a public inbox.
+	RosterOnly bool `yaml:"rosteronly"`
+
+	// MinProtocol is the oldest protocol version which the node plans
+	// to support, such as "murcott/2". The node warns when the peers
+	// seen lately which do not support it are a significant share of
+	// the network. Sessions are not affected. No check is made if empty.
+	MinProtocol string `yaml:"minprotocol"`
+
+	// NetworkKey is the secret of a private network. If set, all packets
+	// are encrypted and authenticated with it, and only the nodes with
+	// the same secret can communicate with the node.
+	NetworkKey string `yaml:"networkkey"`
+
+	// Mesh runs the node on a LAN without internet access. The bootstrap
+	// nodes are ignored, the nodes of the LAN are discovered with
+	// multicast DNS, and no packet is sent outside of the local network.
+	Mesh bool `yaml:"mesh"`
+
+	// DedupCapacity is the number of received packets and messages which
+	// are remembered to drop their duplicates, and DedupFalsePositive is
+	// the target rate of new ones dropped as duplicates by mistake. They
+	// size rotating bloom filters, whose memory does not grow with the
+	// uptime. Zero values use the defaults.
+	DedupCapacity      int     `yaml:"dedupcapacity"`
+	DedupFalsePositive float64 `yaml:"dedupfalsepositive"`
 }
 
-func (c Config) Ports() []int {
+// RetryPolicy controls the timing of an operation which may be retried.
+// Each attempt waits up to Timeout. After n failed attempts, the next one
+// is delayed by Initial multiplied n-1 times by Multiplier, up to Max.
+// Attempts is the maximum number of attempts, or unlimited if negative.
+// Jitter is the fraction by which JitteredDelay randomly varies the delay
+// in either direction. Each operation only uses the fields relevant to it.
+type RetryPolicy struct {
+	Timeout    time.Duration `yaml:"timeout"`
+	Initial    time.Duration `yaml:"initial"`
+	Max        time.Duration `yaml:"max"`
+	Multiplier float64       `yaml:"multiplier"`
+	Attempts   int           `yaml:"attempts"`
+	Jitter     float64       `yaml:"jitter"`
+}
+
+// Delay returns the delay before the next attempt after n failed ones.
+func (p RetryPolicy) Delay(n int) time.Duration {
+	d := float64(p.Initial)
+	for i := 1; i < n; i++ {
+		d *= p.Multiplier
+		if p.Max > 0 && d >= float64(p.Max) {
+			return p.Max
+		}
+	}
+	if p.Max > 0 && d > float64(p.Max) {
+		return p.Max
+	}
+	return time.Duration(d)
+}
+
+// JitteredDelay returns Delay(n) varied by Jitter according to r,
+// a random number in [0, 1).
+func (p RetryPolicy) JitteredDelay(n int, r float64) time.Duration {
+	d := float64(p.Delay(n))
+	return time.Duration(d * (1 + p.Jitter*(2*r-1)))
+}
+
+// Exhausted reports whether no attempt is left after n attempts.
+func (p RetryPolicy) Exhausted(n int) bool {
+	return p.Attempts > 0 && n >= p.Attempts
+}
+
+func (p RetryPolicy) withDefaults(d RetryPolicy) RetryPolicy {
+	if p.Timeout == 0 {
+		p.Timeout = d.Timeout
+	}
+	if p.Initial == 0 {
+		p.Initial = d.Initial
+	}
+	if p.Max == 0 {
+		p.Max = d.Max
+	}
+	if p.Multiplier == 0 {
+		p.Multiplier = d.Multiplier
+	}
+	if p.Attempts == 0 {
+		p.Attempts = d.Attempts
+	}
+	if p.Jitter == 0 {
+		p.Jitter = d.Jitter
+	}
+	return p
+}
+
+// RetryConfig holds the retry policies of a node.
+type RetryConfig struct {
+	// RPC is the policy of the DHT requests: Timeout, the delays
+	// between the attempts and Attempts are used. The requests of the
+	// lookups are attempted at most 3 times if Attempts is unlimited.
+	RPC RetryPolicy `yaml:"rpc"`
+
+	// Dial is the policy of the sessions dialed to other nodes. Timeout
+	// bounds each dial, and a node is not dialed again until the delay
+	// after its failed dials has passed.
+	Dial RetryPolicy `yaml:"dial"`
+
+	// Resend is the policy of the messages queued until a route to their
+	// destination is found. A message is dropped after Attempts attempts.
+	Resend RetryPolicy `yaml:"resend"`
+
+	// Ping is the policy of the pings which keep the sessions alive.
+	// Initial is the interval of the pings and Timeout is the silence of
+	// a peer after which its session is closed, which must be longer than
+	// the ping interval of the peers.
+	Ping RetryPolicy `yaml:"ping"`
+
+	// Bootstrap is the policy of the discovery of the bootstrap nodes,
+	// which is retried while the node is not bootstrapped. The delays
+	// and Attempts are used, and Jitter spreads the retries of the nodes
+	// which have lost the bootstrap nodes at the same time.
+	Bootstrap RetryPolicy `yaml:"bootstrap"`
+}
+
+// DefaultRetryConfig is the default timing of the retried operations.
+var DefaultRetryConfig = RetryConfig{
+	RPC:    RetryPolicy{Timeout: time.Second, Initial: 500 * time.Millisecond, Multiplier: 2, Attempts: 1},
+	Dial:   RetryPolicy{Timeout: 100 * time.Millisecond, Initial: time.Second, Max: time.Minute, Multiplier: 2, Attempts: -1},
+	Resend: RetryPolicy{Initial: time.Second, Max: 30 * time.Second, Multiplier: 2, Attempts: -1},
+	Ping:   RetryPolicy{Timeout: 5 * time.Second, Initial: time.Second, Multiplier: 1, Attempts: -1},
+
+	Bootstrap: RetryPolicy{Initial: 2 * time.Second, Max: 5 * time.Minute, Multiplier: 2, Attempts: -1, Jitter: 0.2},
+}
+
+// WithDefaults returns the config with the zero values replaced
+// by those of DefaultRetryConfig.
+func (c RetryConfig) WithDefaults() RetryConfig {
+	d := DefaultRetryConfig
+	return RetryConfig{
+		RPC:    c.RPC.withDefaults(d.RPC),
+		Dial:   c.Dial.withDefaults(d.Dial),
+		Resend: c.Resend.withDefaults(d.Resend),
+		Ping:   c.Ping.withDefaults(d.Ping),
+
+		Bootstrap: c.Bootstrap.withDefaults(d.Bootstrap),
+	}
+}
+
+// ParsePorts parses a port specification, a comma-separated list of ports
+// ("9200"), ranges ("9200-9300"), exclusions ("!9250" or "!9250-9259")
+// and "random", which lets the system choose a free port. The ports are
+// returned in ascending order, followed by 0 for "random".
+func ParsePorts(spec string) ([]int, error) {
+	allowed := make(map[int]bool)
+	excluded := make(map[int]bool)
+	random := false
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if item == "random" {
+			random = true
+			continue
+		}
+		set := allowed
+		if strings.HasPrefix(item, "!") {
+			set = excluded
+			item = item[1:]
+		}
+		begin, end, err := parsePortRange(item)
+		if err != nil {
+			return nil, err
+		}
+		for p := begin; p <= end; p++ {
+			set[p] = true
+		}
+	}
+
 	var ports []int
-	var begin, end int
-	_, err := fmt.Sscanf(c.P, "%d-%d", &begin, &end)
-	if err == nil {
-		if begin < end {
-			for p := begin; p <= end; p++ {
-				ports = append(ports, p)
-			}
+	for p := range allowed {
+		if !excluded[p] {
+			ports = append(ports, p)
 		}
 	}
+	sort.Ints(ports)
+	if random {
+		ports = append(ports, 0)
+	}
+	return ports, nil
+}
+
+func parsePortRange(s string) (int, int, error) {
+	z := strings.SplitN(s, "-", 2)
+	begin, err := strconv.Atoi(z[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid port: %s", s)
+	}
+	end := begin
+	if len(z) == 2 {
+		end, err = strconv.Atoi(z[1])
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid port: %s", s)
+		}
+	}
+	if begin < 1 || end > 65535 || begin > end {
+		return 0, 0, fmt.Errorf("invalid port range: %s", s)
+	}
+	return begin, end, nil
+}
+
+// Ports returns the ports to listen on in random order, so that nodes on
+// the same host do not all try the same port first. The random port of
+// the system (0) is tried last. Invalid specifications yield no ports.
+func (c Config) Ports() []int {
+	ports, err := ParsePorts(c.P)
+	if err != nil {
+		return nil
+	}
+	n := len(ports)
+	if n > 0 && ports[n-1] == 0 {
+		n--
+	}
+	var seed [8]byte
+	crand.Read(seed[:])
+	r := rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(seed[:]))))
+	for i := n - 1; i > 0; i-- {
+		j := r.Intn(i + 1)
+		ports[i], ports[j] = ports[j], ports[i]
+	}
 	return ports
 }
 
 func (c Config) Bootstrap() []net.UDPAddr {
 	var udpaddrs []net.UDPAddr
+	if c.Mesh {
+		return nil
+	}
 	for _, s := range c.B {
 		z := strings.SplitN(s, ":", 2)
 		if len(z) != 2 {
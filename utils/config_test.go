@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestParsePorts(t *testing.T) {
+	cases := []struct {
+		spec  string
+		ports []int
+	}{
+		{"9200-9203", []int{9200, 9201, 9202, 9203}},
+		{"9200", []int{9200}},
+		{"9200,9300, 9400", []int{9200, 9300, 9400}},
+		{"9200-9205,!9202-9203", []int{9200, 9201, 9204, 9205}},
+		{"!9201,9200-9202", []int{9200, 9202}},
+		{"9200-9201,random", []int{9200, 9201, 0}},
+		{"random", []int{0}},
+		{"", nil},
+	}
+	for _, c := range cases {
+		ports, err := ParsePorts(c.spec)
+		if err != nil {
+			t.Errorf("ParsePorts(%q) returns %v", c.spec, err)
+		} else if !reflect.DeepEqual(ports, c.ports) {
+			t.Errorf("ParsePorts(%q) returns %v; expects %v", c.spec, ports, c.ports)
+		}
+	}
+
+	for _, spec := range []string{"abc", "9300-9200", "0", "70000", "9200-x"} {
+		if _, err := ParsePorts(spec); err == nil {
+			t.Errorf("ParsePorts(%q) should fail", spec)
+		}
+	}
+}
+
+func TestConfigPorts(t *testing.T) {
+	c := Config{P: "9200-9299,random"}
+	ports := c.Ports()
+	if len(ports) != 101 || ports[100] != 0 {
+		t.Fatalf("Ports() returns %v; expects 100 ports and 0", ports)
+	}
+	sorted := append([]int(nil), ports[:100]...)
+	sort.Ints(sorted)
+	for i, p := range sorted {
+		if p != 9200+i {
+			t.Fatalf("Ports() returns %v; expects a permutation of 9200-9299", ports)
+		}
+	}
+	if reflect.DeepEqual(sorted, ports[:100]) && reflect.DeepEqual(c.Ports()[:100], sorted) {
+		t.Errorf("Ports() should be in random order")
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Initial: time.Second, Max: 5 * time.Second, Multiplier: 2, Attempts: 3}
+	delays := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, d := range delays {
+		if r := p.Delay(i + 1); r != d {
+			t.Errorf("Delay(%d) returns %v; expects %v", i+1, r, d)
+		}
+	}
+	if p.Exhausted(2) || !p.Exhausted(3) {
+		t.Errorf("Exhausted() should be true from 3 attempts")
+	}
+	p.Attempts = -1
+	if p.Exhausted(100) {
+		t.Errorf("Exhausted() returns true for an unlimited policy")
+	}
+
+	p.Jitter = 0.5
+	if d := p.JitteredDelay(2, 0); d != time.Second {
+		t.Errorf("JitteredDelay(2, 0) returns %v; expects %v", d, time.Second)
+	}
+	if d := p.JitteredDelay(2, 0.5); d != 2*time.Second {
+		t.Errorf("JitteredDelay(2, 0.5) returns %v; expects %v", d, 2*time.Second)
+	}
+
+	c := RetryConfig{Ping: RetryPolicy{Initial: time.Minute}}.WithDefaults()
+	if c.Ping.Initial != time.Minute || c.Ping.Timeout != DefaultRetryConfig.Ping.Timeout {
+		t.Errorf("WithDefaults() returns %+v; expects the default timeout", c.Ping)
+	}
+	if c.RPC != DefaultRetryConfig.RPC {
+		t.Errorf("WithDefaults() returns %+v; expects %+v", c.RPC, DefaultRetryConfig.RPC)
+	}
+}
@@ -189,23 +189,32 @@ func (p *PublicKey) IsZero() bool {
 	return (p.x == nil || p.y == nil || p.x.Int64() == 0 || p.y.Int64() == 0)
 }
 
+// intBytes returns the bytes of i, or nil for keys and signatures
+// which have not been set.
+func intBytes(i *big.Int) []byte {
+	if i == nil {
+		return nil
+	}
+	return i.Bytes()
+}
+
 func init() {
 	msgpack.Register(reflect.TypeOf(Signature{}),
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(Signature)
 			return e.Encode(map[string][]byte{
-				"r": sign.r.Bytes(),
-				"s": sign.s.Bytes(),
+				"r": intBytes(sign.r),
+				"s": intBytes(sign.s),
 			})
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
-			i, err := d.DecodeMap()
+			var m map[string][]byte
+			err := d.Decode(&m)
 			if err != nil {
 				return err
 			}
-			m := i.(map[interface{}]interface{})
-			if r, ok := m["r"].([]byte); ok {
-				if s, ok := m["s"].([]byte); ok {
+			if r, ok := m["r"]; ok {
+				if s, ok := m["s"]; ok {
 					v.Set(reflect.ValueOf(Signature{
 						r: big.NewInt(0).SetBytes(r),
 						s: big.NewInt(0).SetBytes(s),
@@ -219,20 +228,20 @@ func init() {
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(PrivateKey)
 			return e.Encode(map[string][]byte{
-				"x": sign.x.Bytes(),
-				"y": sign.y.Bytes(),
-				"d": sign.d.Bytes(),
+				"x": intBytes(sign.x),
+				"y": intBytes(sign.y),
+				"d": intBytes(sign.d),
 			})
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
-			i, err := d.DecodeMap()
+			var m map[string][]byte
+			err := d.Decode(&m)
 			if err != nil {
 				return err
 			}
-			m := i.(map[interface{}]interface{})
-			if x, ok := m["x"].([]byte); ok {
-				if y, ok := m["y"].([]byte); ok {
-					if d, ok := m["d"].([]byte); ok {
+			if x, ok := m["x"]; ok {
+				if y, ok := m["y"]; ok {
+					if d, ok := m["d"]; ok {
 						v.Set(reflect.ValueOf(PrivateKey{
 							PublicKey: PublicKey{
 								x: big.NewInt(0).SetBytes(x),
@@ -250,18 +259,18 @@ func init() {
 		func(e *msgpack.Encoder, v reflect.Value) error {
 			sign := v.Interface().(PublicKey)
 			return e.Encode(map[string][]byte{
-				"x": sign.x.Bytes(),
-				"y": sign.y.Bytes(),
+				"x": intBytes(sign.x),
+				"y": intBytes(sign.y),
 			})
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
-			i, err := d.DecodeMap()
+			var m map[string][]byte
+			err := d.Decode(&m)
 			if err != nil {
 				return err
 			}
-			m := i.(map[interface{}]interface{})
-			if x, ok := m["x"].([]byte); ok {
-				if y, ok := m["y"].([]byte); ok {
+			if x, ok := m["x"]; ok {
+				if y, ok := m["y"]; ok {
 					v.Set(reflect.ValueOf(PublicKey{
 						x: big.NewInt(0).SetBytes(x),
 						y: big.NewInt(0).SetBytes(y),
@@ -1,9 +1,12 @@
 package utils
 
 import (
+	"encoding/base32"
+	"encoding/hex"
 	"errors"
 	"math/big"
 	"reflect"
+	"strings"
 
 	"github.com/tv42/base58"
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -11,6 +14,28 @@ import (
 
 const NodeIDPrefix = 144
 
+// NodeIDEncoding is a string form of node IDs.
+type NodeIDEncoding int
+
+const (
+	// EncodingBase58 is the base58 form returned by String, without prefix.
+	EncodingBase58 NodeIDEncoding = iota
+
+	// EncodingHex is lowercase hexadecimal with the multibase prefix "f".
+	// Its width is fixed and it is decoded regardless of case.
+	EncodingHex
+
+	// EncodingBase32 is lowercase unpadded base32 of RFC 4648 with the
+	// multibase prefix "b". Its width is fixed and it is decoded
+	// regardless of case.
+	EncodingBase32
+
+	// EncodingMultibase58 is the base58 form with the multibase prefix "z".
+	EncodingMultibase58
+)
+
+var lowerBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
 var GlobalNamespace Namespace = [4]byte{0, 0, 0, 0}
 var GroupNamespace Namespace = [4]byte{1, 0, 0, 0}
 
@@ -68,8 +93,36 @@ func NewNodeIDFromBytes(b []byte) (NodeID, error) {
 	return NodeID{NS: ns, Digest: digest}, nil
 }
 
-// NewNodeIDFromString generates NodeID from the given base58-encoded string.
+// NewNodeIDFromString generates NodeID from the given string in any of the
+// forms of NodeIDEncoding, which are told apart by their multibase prefix.
+// The base58 form without prefix never starts with "f" or "b", and starts
+// with "z" only with a shorter length than the prefixed one.
 func NewNodeIDFromString(str string) (NodeID, error) {
+	if str == "" {
+		return NodeID{}, errors.New("empty node ID")
+	}
+	switch str[0] {
+	case 'f', 'F':
+		b, err := hex.DecodeString(str[1:])
+		if err != nil {
+			return NodeID{}, err
+		}
+		return NewNodeIDFromBytes(b)
+	case 'b', 'B':
+		b, err := lowerBase32.DecodeString(strings.ToLower(str[1:]))
+		if err != nil {
+			return NodeID{}, err
+		}
+		return NewNodeIDFromBytes(b)
+	case 'z':
+		if id, err := nodeIDFromBase58(str[1:]); err == nil {
+			return id, nil
+		}
+	}
+	return nodeIDFromBase58(str)
+}
+
+func nodeIDFromBase58(str string) (NodeID, error) {
 	i, err := base58.DecodeToBig([]byte(str))
 	if err != nil {
 		return NodeID{}, err
@@ -93,6 +146,20 @@ func (id NodeID) String() string {
 	return string(base58.EncodeBig(nil, &i))
 }
 
+// Encode returns identifier in the given string form, which
+// NewNodeIDFromString decodes.
+func (id NodeID) Encode(e NodeIDEncoding) string {
+	switch e {
+	case EncodingHex:
+		return "f" + hex.EncodeToString(id.Bytes())
+	case EncodingBase32:
+		return "b" + lowerBase32.EncodeToString(id.Bytes())
+	case EncodingMultibase58:
+		return "z" + id.String()
+	}
+	return id.String()
+}
+
 func (d NodeID) Match(n NodeID) bool {
 	return d.NS.Match(n.NS) && d.Digest.Cmp(n.Digest) == 0
 }
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"strings"
 	"testing"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
@@ -28,6 +29,40 @@ func TestNodeIDString(t *testing.T) {
 	}
 }
 
+func TestNodeIDEncoding(t *testing.T) {
+	id := NewRandomNodeID(GroupNamespace)
+	for _, e := range []NodeIDEncoding{EncodingBase58, EncodingHex, EncodingBase32, EncodingMultibase58} {
+		str := id.Encode(e)
+		id2, err := NewNodeIDFromString(str)
+		if err != nil || !id2.Match(id) {
+			t.Errorf("NewNodeIDFromString(%q) returns %v, %v; expects %v", str, id2, err, id)
+		}
+	}
+	if str := id.Encode(EncodingHex); len(str) != 51 || str[0] != 'f' {
+		t.Errorf("Encode(EncodingHex) returns %q; expects 50 hex digits after f", str)
+	}
+	if str := id.Encode(EncodingBase32); len(str) != 41 || str[0] != 'b' {
+		t.Errorf("Encode(EncodingBase32) returns %q; expects 40 characters after b", str)
+	}
+	for _, str := range []string{strings.ToUpper(id.Encode(EncodingHex)), strings.ToUpper(id.Encode(EncodingBase32))} {
+		if id2, err := NewNodeIDFromString(str); err != nil || !id2.Match(id) {
+			t.Errorf("NewNodeIDFromString(%q) should ignore the case", str)
+		}
+	}
+
+	// Base58 strings without prefix which start with "z" are still
+	// decoded as such.
+	for i := 0; i < 100; i++ {
+		id := NewRandomNodeID(GlobalNamespace)
+		if id2, err := NewNodeIDFromString(id.String()); err != nil || !id2.Match(id) {
+			t.Errorf("NewNodeIDFromString(%q) returns %v, %v; expects %v", id.String(), id2, err, id)
+		}
+	}
+	if _, err := NewNodeIDFromString(""); err == nil {
+		t.Errorf("NewNodeIDFromString() should fail for an empty string")
+	}
+}
+
 func TestNodeIDNamespace(t *testing.T) {
 	ns := Namespace([4]byte{1, 1, 0, 0})
 
@@ -3,6 +3,7 @@ package utils
 import (
 	"net"
 	"reflect"
+	"time"
 
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
@@ -10,6 +11,11 @@ import (
 type NodeInfo struct {
 	ID   NodeID
 	Addr net.Addr
+
+	// RTT is the round-trip time and LastSeen is the time of the last
+	// packet of an active session. They are not encoded.
+	RTT      time.Duration
+	LastSeen time.Time
 }
 
 type NodeInfoSorter struct {
@@ -41,13 +47,13 @@ func init() {
 			})
 		},
 		func(d *msgpack.Decoder, v reflect.Value) error {
-			i, err := d.DecodeMap()
+			var m map[string][]byte
+			err := d.Decode(&m)
 			if err != nil {
 				return err
 			}
-			m := i.(map[interface{}]interface{})
-			if id, ok := m["id"].([]byte); ok {
-				if addrstr, ok := m["addr"].([]byte); ok {
+			if id, ok := m["id"]; ok {
+				if addrstr, ok := m["addr"]; ok {
 					addr, err := net.ResolveUDPAddr("udp", string(addrstr))
 					if err != nil {
 						return err
@@ -0,0 +1,38 @@
+package murcott
+
+import (
+	"errors"
+
+	"github.com/h2so5/murcott/utils"
+)
+
+// MaxValueSize is the size of the largest value which an application
+// can store in the DHT.
+const MaxValueSize = 8 * 1024
+
+// appValuePrefix starts the names of the values of the applications,
+// which cannot replace the records of the nodes.
+const appValuePrefix = "app:"
+
+var errValueNotFound = errors.New("value not found")
+
+// StoreValue publishes a small value, such as an avatar or a service
+// announcement, at the given key in the shared DHT. The value is signed
+// with the key of the client, so that only the client can replace it, and
+// other nodes load it with LoadValue and the ID of the client.
+func (c *Client) StoreValue(key string, value []byte) error {
+	if len(value) > MaxValueSize {
+		return errors.New("value too large")
+	}
+	return c.router.StoreSignedValue(appValuePrefix+key, string(value))
+}
+
+// LoadValue returns the value stored at the given key by the node
+// with the given ID.
+func (c *Client) LoadValue(id utils.NodeID, key string) ([]byte, error) {
+	str := c.router.LoadSignedValue(id, appValuePrefix+key)
+	if str == nil {
+		return nil, errValueNotFound
+	}
+	return []byte(*str), nil
+}
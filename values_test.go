@@ -0,0 +1,96 @@
+package murcott
+
+import (
+	"testing"
+	"time"
+
+	"github.com/h2so5/murcott/dht"
+	"github.com/h2so5/murcott/log"
+	"github.com/h2so5/murcott/router"
+	"github.com/h2so5/murcott/utils"
+	"gopkg.in/vmihailenco/msgpack.v2"
+)
+
+func TestStoreValueSize(t *testing.T) {
+	c := &Client{}
+	if err := c.StoreValue("avatar", make([]byte, MaxValueSize+1)); err == nil {
+		t.Errorf("StoreValue() should reject a value larger than %d bytes", MaxValueSize)
+	}
+}
+
+func TestStoreValue(t *testing.T) {
+	tr, err := router.NewTransport(log.NewLogger(), utils.DefaultConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tr.Close()
+	var clients []*Client
+	for i := 0; i < 2; i++ {
+		c, err := NewClientWithTransport(utils.GeneratePrivateKey(), utils.DefaultConfig, tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+	owner, other := clients[0], clients[1]
+
+	// The owner dials the other client over the memory transport,
+	// which is accepted by the shared transport.
+	n := router.NewMemoryNetwork(1)
+	if err := owner.router.RegisterTransport(n.Transport("node")); err != nil {
+		t.Fatal(err)
+	}
+	owner.Roster.Set(other.id, UserProfile{})
+	owner.router.AddRouteHint(other.id, router.JoinTransportAddr(router.MemoryScheme, "node"))
+	owner.router.AddNode(utils.NodeInfo{ID: other.id, Addr: tr.Addr()})
+	for i := 0; i < 100; i++ {
+		if knows(other, owner.id) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	other.router.AddNode(utils.NodeInfo{ID: owner.id, Addr: tr.Addr()})
+
+	if err := owner.StoreValue("avatar", []byte("owner")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if v, err := other.LoadValue(owner.id, "avatar"); err == nil && string(v) == "owner" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := other.LoadValue(owner.id, "avatar"); err != nil || string(v) != "owner" {
+		t.Fatalf("LoadValue() returns %q, %v; expects %q", v, err, "owner")
+	}
+
+	// Another node neither replaces the value with its own
+	// nor with a record which it has not signed.
+	other.StoreValue("avatar", []byte("other"))
+	key := dht.SignedKey(owner.id.Digest, appValuePrefix+"avatar")
+	forged, _ := msgpack.Marshal(dht.SignedRecord{Key: key, Value: "forged", Time: time.Now().UnixNano()})
+	other.router.StoreValue(key, string(forged))
+	// The value of the other node shows that its stores have been handled.
+	for i := 0; i < 100; i++ {
+		if v, err := owner.LoadValue(other.id, "avatar"); err == nil && string(v) == "other" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if v, err := other.LoadValue(owner.id, "avatar"); err != nil || string(v) != "owner" {
+		t.Errorf("LoadValue() returns %q, %v; expects %q", v, err, "owner")
+	}
+	if v, err := owner.LoadValue(owner.id, "avatar"); err != nil || string(v) != "owner" {
+		t.Errorf("LoadValue() returns %q, %v; expects %q", v, err, "owner")
+	}
+}
+
+func knows(c *Client, id utils.NodeID) bool {
+	for _, n := range c.router.KnownNodes() {
+		if n.ID.Match(id) {
+			return true
+		}
+	}
+	return false
+}